@@ -0,0 +1,25 @@
+// k8s-kms-plugin is a Kubernetes KMS v2 plugin backed by an emulator crypto
+// key, so kube-apiserver envelope encryption of Secrets can be tested in kind
+// clusters without Cloud KMS.
+//
+// Usage:
+//
+//	k8s-kms-plugin --key projects/p/locations/global/keyRings/k8s/cryptoKeys/etcd --create-key
+//	k8s-kms-plugin --listen /var/run/kmsplugin/socket.sock --endpoint kms:9090 --key ...
+//
+// Point the kms provider of kube-apiserver's EncryptionConfiguration at the
+// socket with apiVersion v2 (endpoint: unix:///var/run/kmsplugin/socket.sock).
+//
+// Environment Variables:
+//
+//	K8S_KMS_PLUGIN_SOCKET - Socket path (default: /var/run/kmsplugin/socket.sock)
+//	K8S_KMS_PLUGIN_KEY    - Crypto key name
+//	KMS_EMULATOR_HOST     - Emulator gRPC address (default: localhost:9090)
+//	GCP_KMS_LOG_LEVEL     - Log level (default: info)
+package main
+
+import "github.com/blackwell-systems/gcp-kms-emulator/internal/k8skms"
+
+func main() {
+	k8skms.Main()
+}
@@ -0,0 +1,23 @@
+// kms-bench is a load generator for the KMS emulator or real Cloud KMS. It
+// drives a weighted mix of calls at a target rate and reports the latency
+// percentiles and error rate of each operation.
+//
+// Usage:
+//
+//	kms-bench --duration 30s --qps 500 --concurrency 32
+//	kms-bench --mix encrypt=45,decrypt=45,get-key=10 --payload 4096 --json
+//	kms-bench --mix sign,mac,random --qps 0
+//	kms-bench --cloud-kms --project my-project --location us-east1 --qps 50
+//
+// Environment Variables:
+//
+//	KMS_BENCH_ENDPOINT    - gRPC address to load (default: KMS_EMULATOR_HOST or localhost:9090)
+//	KMS_EMULATOR_HOST     - Emulator gRPC address shared with client libraries
+//	CLOUDSDK_CORE_PROJECT - Default --project, as with gcloud
+package main
+
+import "github.com/blackwell-systems/gcp-kms-emulator/internal/bench"
+
+func main() {
+	bench.Main()
+}
@@ -0,0 +1,27 @@
+// kms-emu is a command line client for a running KMS emulator, with
+// gcloud-like commands for teammates who do not want to hand-craft REST calls.
+//
+// Usage:
+//
+//	kms-emu create-keyring ring1 --project my-project --location global
+//	kms-emu create-key key1 --keyring ring1 --purpose encryption
+//	kms-emu list --keyring ring1
+//	kms-emu encrypt --key key1 --keyring ring1 --plaintext-file secret.txt --ciphertext-file secret.enc
+//	kms-emu decrypt --key key1 --keyring ring1 --ciphertext-file secret.enc --plaintext-file -
+//	kms-emu sign --key signer --keyring ring1 --version 1 --input-file doc.txt --signature-file doc.sig
+//	kms-emu verify --key signer --keyring ring1 --version 1 --input-file doc.txt --signature-file doc.sig
+//	kms-emu reset --admin-endpoint localhost:9091
+//
+// Environment Variables:
+//
+//	KMS_EMU_ENDPOINT       - Emulator gRPC address (default: KMS_EMULATOR_HOST or localhost:9090)
+//	KMS_EMULATOR_HOST      - Emulator gRPC address shared with client libraries
+//	KMS_EMU_ADMIN_ENDPOINT - Emulator admin API address for reset (default: localhost:9091)
+//	CLOUDSDK_CORE_PROJECT  - Default --project, as with gcloud
+package main
+
+import "github.com/blackwell-systems/gcp-kms-emulator/internal/kmsemu"
+
+func main() {
+	kmsemu.Main()
+}
@@ -0,0 +1,20 @@
+/* Platform macros for the OASIS PKCS#11 headers, as pkcs11.h asks its
+ * includers to define them, for Unix-like systems. */
+
+#ifndef KMS_PKCS11_H
+#define KMS_PKCS11_H
+
+#define CK_PTR *
+#define CK_DECLARE_FUNCTION(returnType, name) returnType name
+#define CK_DECLARE_FUNCTION_POINTER(returnType, name) returnType (* name)
+#define CK_CALLBACK_FUNCTION(returnType, name) returnType (* name)
+#ifndef NULL_PTR
+#define NULL_PTR 0
+#endif
+
+#include "pkcs11.h"
+
+/* The Go side encodes CK_ULONG attribute values as 8 bytes. */
+_Static_assert(sizeof(CK_ULONG) == 8, "CK_ULONG must be 64 bits");
+
+#endif
@@ -0,0 +1,587 @@
+// kms-pkcs11 is a PKCS#11 library backed by the emulator, so HSM clients
+// (OpenSSL engines and providers, Java SunPKCS11, pkcs11-tool, database TDE)
+// can sign, encrypt and generate keys against emulator crypto keys.
+//
+// Build it as a shared library:
+//
+//	go build -buildmode=c-shared -o libkmspkcs11.so ./cmd/kms-pkcs11
+//
+// and point it at a configuration in the format of Google's Cloud KMS
+// PKCS#11 library, with one token per key ring:
+//
+//	tokens:
+//	  - key_ring: projects/my-project/locations/global/keyRings/hsm
+//	kms_endpoint: localhost:9090
+//
+// Environment Variables:
+//
+//	KMS_PKCS11_CONFIG - Configuration path, unless passed in pReserved of
+//	                    C_Initialize's arguments
+//	KMS_EMULATOR_HOST - Emulator gRPC address when kms_endpoint is unset
+//	                    (default: localhost:9090)
+package main
+
+/*
+#include "kms.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"unsafe"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/pkcs11"
+)
+
+func main() {}
+
+var (
+	mu     sync.Mutex
+	module *pkcs11.Module
+)
+
+// current returns the initialized module
+func current() (*pkcs11.Module, C.CK_RV) {
+	mu.Lock()
+	defer mu.Unlock()
+	if module == nil {
+		return nil, C.CKR_CRYPTOKI_NOT_INITIALIZED
+	}
+	return module, C.CKR_OK
+}
+
+// rv converts a module error to a return value
+func rv(err error) C.CK_RV {
+	var e pkcs11.Error
+	if errors.As(err, &e) {
+		return C.CK_RV(e)
+	}
+	if err != nil {
+		return C.CKR_FUNCTION_FAILED
+	}
+	return C.CKR_OK
+}
+
+//export C_Initialize
+func C_Initialize(pInitArgs C.CK_VOID_PTR) C.CK_RV {
+	mu.Lock()
+	defer mu.Unlock()
+	if module != nil {
+		return C.CKR_CRYPTOKI_ALREADY_INITIALIZED
+	}
+	var path string
+	if pInitArgs != nil {
+		args := (*C.CK_C_INITIALIZE_ARGS)(pInitArgs)
+		if args.pReserved != nil {
+			path = C.GoString((*C.char)(args.pReserved))
+		}
+	}
+	m, err := pkcs11.Initialize(path)
+	if err != nil {
+		// C_Initialize has no way to say why; applications show stderr
+		fmt.Fprintf(os.Stderr, "kms-pkcs11: %v\n", err)
+		return C.CKR_GENERAL_ERROR
+	}
+	module = m
+	return C.CKR_OK
+}
+
+//export C_Finalize
+func C_Finalize(pReserved C.CK_VOID_PTR) C.CK_RV {
+	if pReserved != nil {
+		return C.CKR_ARGUMENTS_BAD
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if module == nil {
+		return C.CKR_CRYPTOKI_NOT_INITIALIZED
+	}
+	module.Finalize()
+	module = nil
+	return C.CKR_OK
+}
+
+//export C_GetInfo
+func C_GetInfo(pInfo C.CK_INFO_PTR) C.CK_RV {
+	if _, r := current(); r != C.CKR_OK {
+		return r
+	}
+	if pInfo == nil {
+		return C.CKR_ARGUMENTS_BAD
+	}
+	*pInfo = C.CK_INFO{}
+	pInfo.cryptokiVersion = C.CK_VERSION{major: 2, minor: 40}
+	pad(pInfo.manufacturerID[:], pkcs11.Manufacturer)
+	pad(pInfo.libraryDescription[:], "Cloud KMS emulator PKCS#11")
+	pInfo.libraryVersion = C.CK_VERSION{major: 1, minor: 0}
+	return C.CKR_OK
+}
+
+//export C_GetSlotList
+func C_GetSlotList(tokenPresent C.CK_BBOOL, pSlotList C.CK_SLOT_ID_PTR, pulCount C.CK_ULONG_PTR) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	slots := m.Slots()
+	return list(slots, (*C.CK_ULONG)(pSlotList), pulCount)
+}
+
+//export C_GetSlotInfo
+func C_GetSlotInfo(slotID C.CK_SLOT_ID, pInfo C.CK_SLOT_INFO_PTR) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	if pInfo == nil {
+		return C.CKR_ARGUMENTS_BAD
+	}
+	info, err := m.SlotInfo(uint(slotID))
+	if err != nil {
+		return rv(err)
+	}
+	*pInfo = C.CK_SLOT_INFO{flags: C.CK_FLAGS(info.Flags)}
+	pad(pInfo.slotDescription[:], info.Description)
+	pad(pInfo.manufacturerID[:], pkcs11.Manufacturer)
+	return C.CKR_OK
+}
+
+//export C_GetTokenInfo
+func C_GetTokenInfo(slotID C.CK_SLOT_ID, pInfo C.CK_TOKEN_INFO_PTR) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	if pInfo == nil {
+		return C.CKR_ARGUMENTS_BAD
+	}
+	info, err := m.TokenInfo(uint(slotID))
+	if err != nil {
+		return rv(err)
+	}
+	unavailable := C.CK_ULONG(pkcs11.UnavailableInformation)
+	*pInfo = C.CK_TOKEN_INFO{
+		flags:                C.CK_FLAGS(info.Flags),
+		ulMaxSessionCount:    C.CK_EFFECTIVELY_INFINITE,
+		ulSessionCount:       C.CK_ULONG(info.SessionCount),
+		ulMaxRwSessionCount:  C.CK_EFFECTIVELY_INFINITE,
+		ulRwSessionCount:     unavailable,
+		ulMaxPinLen:          255,
+		ulTotalPublicMemory:  unavailable,
+		ulFreePublicMemory:   unavailable,
+		ulTotalPrivateMemory: unavailable,
+		ulFreePrivateMemory:  unavailable,
+	}
+	pad(pInfo.label[:], info.Label)
+	pad(pInfo.manufacturerID[:], pkcs11.Manufacturer)
+	pad(pInfo.model[:], info.Model)
+	pad(pInfo.serialNumber[:], info.SerialNumber)
+	return C.CKR_OK
+}
+
+//export C_GetMechanismList
+func C_GetMechanismList(slotID C.CK_SLOT_ID, pMechanismList C.CK_MECHANISM_TYPE_PTR, pulCount C.CK_ULONG_PTR) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	types, err := m.Mechanisms(uint(slotID))
+	if err != nil {
+		return rv(err)
+	}
+	return list(types, (*C.CK_ULONG)(pMechanismList), pulCount)
+}
+
+//export C_GetMechanismInfo
+func C_GetMechanismInfo(slotID C.CK_SLOT_ID, typ C.CK_MECHANISM_TYPE, pInfo C.CK_MECHANISM_INFO_PTR) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	if pInfo == nil {
+		return C.CKR_ARGUMENTS_BAD
+	}
+	info, err := m.MechanismInfo(uint(slotID), uint(typ))
+	if err != nil {
+		return rv(err)
+	}
+	*pInfo = C.CK_MECHANISM_INFO{
+		ulMinKeySize: C.CK_ULONG(info.MinKeySize),
+		ulMaxKeySize: C.CK_ULONG(info.MaxKeySize),
+		flags:        C.CK_FLAGS(info.Flags),
+	}
+	return C.CKR_OK
+}
+
+//export C_OpenSession
+func C_OpenSession(slotID C.CK_SLOT_ID, flags C.CK_FLAGS, pApplication C.CK_VOID_PTR, notify C.CK_NOTIFY, phSession C.CK_SESSION_HANDLE_PTR) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	if phSession == nil {
+		return C.CKR_ARGUMENTS_BAD
+	}
+	h, err := m.OpenSession(uint(slotID), uint(flags))
+	if err != nil {
+		return rv(err)
+	}
+	*phSession = C.CK_SESSION_HANDLE(h)
+	return C.CKR_OK
+}
+
+//export C_CloseSession
+func C_CloseSession(hSession C.CK_SESSION_HANDLE) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	return rv(m.CloseSession(uint(hSession)))
+}
+
+//export C_CloseAllSessions
+func C_CloseAllSessions(slotID C.CK_SLOT_ID) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	return rv(m.CloseAllSessions(uint(slotID)))
+}
+
+//export C_GetSessionInfo
+func C_GetSessionInfo(hSession C.CK_SESSION_HANDLE, pInfo C.CK_SESSION_INFO_PTR) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	if pInfo == nil {
+		return C.CKR_ARGUMENTS_BAD
+	}
+	info, err := m.SessionInfo(uint(hSession))
+	if err != nil {
+		return rv(err)
+	}
+	*pInfo = C.CK_SESSION_INFO{
+		slotID: C.CK_SLOT_ID(info.Slot),
+		state:  C.CK_STATE(info.State),
+		flags:  C.CK_FLAGS(info.Flags),
+	}
+	return C.CKR_OK
+}
+
+//export C_Login
+func C_Login(hSession C.CK_SESSION_HANDLE, userType C.CK_USER_TYPE, pPin C.CK_UTF8CHAR_PTR, ulPinLen C.CK_ULONG) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	return rv(m.Login(uint(hSession), uint(userType)))
+}
+
+//export C_Logout
+func C_Logout(hSession C.CK_SESSION_HANDLE) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	return rv(m.Logout(uint(hSession)))
+}
+
+//export C_GetAttributeValue
+func C_GetAttributeValue(hSession C.CK_SESSION_HANDLE, hObject C.CK_OBJECT_HANDLE, pTemplate C.CK_ATTRIBUTE_PTR, ulCount C.CK_ULONG) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	if pTemplate == nil && ulCount > 0 {
+		return C.CKR_ARGUMENTS_BAD
+	}
+	template := unsafe.Slice(pTemplate, int(ulCount))
+	types := make([]uint, len(template))
+	for i, a := range template {
+		types[i] = uint(a._type)
+	}
+	attrs, err := m.GetAttributeValue(uint(hSession), uint(hObject), types)
+	if attrs == nil {
+		return rv(err)
+	}
+	result := rv(err)
+	for i, a := range attrs {
+		t := &template[i]
+		switch {
+		case a.Value == nil:
+			t.ulValueLen = C.CK_ULONG(pkcs11.UnavailableInformation)
+		case t.pValue == nil:
+			t.ulValueLen = C.CK_ULONG(len(a.Value))
+		case int(t.ulValueLen) < len(a.Value):
+			t.ulValueLen = C.CK_ULONG(pkcs11.UnavailableInformation)
+			if result == C.CKR_OK {
+				result = C.CKR_BUFFER_TOO_SMALL
+			}
+		default:
+			copy(unsafe.Slice((*byte)(t.pValue), len(a.Value)), a.Value)
+			t.ulValueLen = C.CK_ULONG(len(a.Value))
+		}
+	}
+	return result
+}
+
+//export C_FindObjectsInit
+func C_FindObjectsInit(hSession C.CK_SESSION_HANDLE, pTemplate C.CK_ATTRIBUTE_PTR, ulCount C.CK_ULONG) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	if pTemplate == nil && ulCount > 0 {
+		return C.CKR_ARGUMENTS_BAD
+	}
+	return rv(m.FindObjectsInit(uint(hSession), attributes(pTemplate, ulCount)))
+}
+
+//export C_FindObjects
+func C_FindObjects(hSession C.CK_SESSION_HANDLE, phObject C.CK_OBJECT_HANDLE_PTR, ulMaxObjectCount C.CK_ULONG, pulObjectCount C.CK_ULONG_PTR) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	if (phObject == nil && ulMaxObjectCount > 0) || pulObjectCount == nil {
+		return C.CKR_ARGUMENTS_BAD
+	}
+	found, err := m.FindObjects(uint(hSession), int(ulMaxObjectCount))
+	if err != nil {
+		return rv(err)
+	}
+	out := unsafe.Slice(phObject, len(found))
+	for i, h := range found {
+		out[i] = C.CK_OBJECT_HANDLE(h)
+	}
+	*pulObjectCount = C.CK_ULONG(len(found))
+	return C.CKR_OK
+}
+
+//export C_FindObjectsFinal
+func C_FindObjectsFinal(hSession C.CK_SESSION_HANDLE) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	return rv(m.FindObjectsFinal(uint(hSession)))
+}
+
+//export C_EncryptInit
+func C_EncryptInit(hSession C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_PTR, hKey C.CK_OBJECT_HANDLE) C.CK_RV {
+	return initOperation(hSession, pMechanism, hKey, (*pkcs11.Module).EncryptInit)
+}
+
+//export C_Encrypt
+func C_Encrypt(hSession C.CK_SESSION_HANDLE, pData C.CK_BYTE_PTR, ulDataLen C.CK_ULONG, pEncryptedData C.CK_BYTE_PTR, pulEncryptedDataLen C.CK_ULONG_PTR) C.CK_RV {
+	return output(hSession, pData, ulDataLen, pEncryptedData, pulEncryptedDataLen, (*pkcs11.Module).Encrypt)
+}
+
+//export C_DecryptInit
+func C_DecryptInit(hSession C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_PTR, hKey C.CK_OBJECT_HANDLE) C.CK_RV {
+	return initOperation(hSession, pMechanism, hKey, (*pkcs11.Module).DecryptInit)
+}
+
+//export C_Decrypt
+func C_Decrypt(hSession C.CK_SESSION_HANDLE, pEncryptedData C.CK_BYTE_PTR, ulEncryptedDataLen C.CK_ULONG, pData C.CK_BYTE_PTR, pulDataLen C.CK_ULONG_PTR) C.CK_RV {
+	return output(hSession, pEncryptedData, ulEncryptedDataLen, pData, pulDataLen, (*pkcs11.Module).Decrypt)
+}
+
+//export C_SignInit
+func C_SignInit(hSession C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_PTR, hKey C.CK_OBJECT_HANDLE) C.CK_RV {
+	return initOperation(hSession, pMechanism, hKey, (*pkcs11.Module).SignInit)
+}
+
+//export C_Sign
+func C_Sign(hSession C.CK_SESSION_HANDLE, pData C.CK_BYTE_PTR, ulDataLen C.CK_ULONG, pSignature C.CK_BYTE_PTR, pulSignatureLen C.CK_ULONG_PTR) C.CK_RV {
+	return output(hSession, pData, ulDataLen, pSignature, pulSignatureLen, (*pkcs11.Module).Sign)
+}
+
+//export C_VerifyInit
+func C_VerifyInit(hSession C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_PTR, hKey C.CK_OBJECT_HANDLE) C.CK_RV {
+	return initOperation(hSession, pMechanism, hKey, (*pkcs11.Module).VerifyInit)
+}
+
+//export C_Verify
+func C_Verify(hSession C.CK_SESSION_HANDLE, pData C.CK_BYTE_PTR, ulDataLen C.CK_ULONG, pSignature C.CK_BYTE_PTR, ulSignatureLen C.CK_ULONG) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	return rv(m.Verify(uint(hSession), bytes(pData, ulDataLen), bytes(pSignature, ulSignatureLen)))
+}
+
+//export C_GenerateKey
+func C_GenerateKey(hSession C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_PTR, pTemplate C.CK_ATTRIBUTE_PTR, ulCount C.CK_ULONG, phKey C.CK_OBJECT_HANDLE_PTR) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	if pMechanism == nil || phKey == nil || (pTemplate == nil && ulCount > 0) {
+		return C.CKR_ARGUMENTS_BAD
+	}
+	h, err := m.GenerateKey(uint(hSession), mechanism(pMechanism), attributes(pTemplate, ulCount))
+	if err != nil {
+		return rv(err)
+	}
+	*phKey = C.CK_OBJECT_HANDLE(h)
+	return C.CKR_OK
+}
+
+//export C_GenerateKeyPair
+func C_GenerateKeyPair(hSession C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_PTR, pPublicKeyTemplate C.CK_ATTRIBUTE_PTR, ulPublicKeyAttributeCount C.CK_ULONG, pPrivateKeyTemplate C.CK_ATTRIBUTE_PTR, ulPrivateKeyAttributeCount C.CK_ULONG, phPublicKey C.CK_OBJECT_HANDLE_PTR, phPrivateKey C.CK_OBJECT_HANDLE_PTR) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	if pMechanism == nil || phPublicKey == nil || phPrivateKey == nil ||
+		(pPublicKeyTemplate == nil && ulPublicKeyAttributeCount > 0) ||
+		(pPrivateKeyTemplate == nil && ulPrivateKeyAttributeCount > 0) {
+		return C.CKR_ARGUMENTS_BAD
+	}
+	pub, priv, err := m.GenerateKeyPair(uint(hSession), mechanism(pMechanism),
+		attributes(pPublicKeyTemplate, ulPublicKeyAttributeCount),
+		attributes(pPrivateKeyTemplate, ulPrivateKeyAttributeCount))
+	if err != nil {
+		return rv(err)
+	}
+	*phPublicKey = C.CK_OBJECT_HANDLE(pub)
+	*phPrivateKey = C.CK_OBJECT_HANDLE(priv)
+	return C.CKR_OK
+}
+
+//export C_GenerateRandom
+func C_GenerateRandom(hSession C.CK_SESSION_HANDLE, randomData C.CK_BYTE_PTR, ulRandomLen C.CK_ULONG) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	if randomData == nil && ulRandomLen > 0 {
+		return C.CKR_ARGUMENTS_BAD
+	}
+	data, err := m.GenerateRandom(uint(hSession), int(ulRandomLen))
+	if err != nil {
+		return rv(err)
+	}
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(randomData)), len(data)), data)
+	return C.CKR_OK
+}
+
+// initOperation implements the C_*Init functions
+func initOperation(hSession C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_PTR, hKey C.CK_OBJECT_HANDLE, init func(*pkcs11.Module, uint, pkcs11.Mechanism, uint) error) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	if pMechanism == nil {
+		return C.CKR_ARGUMENTS_BAD
+	}
+	return rv(init(m, uint(hSession), mechanism(pMechanism), uint(hKey)))
+}
+
+// output implements single-part functions with output, such as C_Sign.
+// A NULL output buffer asks for the output length only.
+func output(hSession C.CK_SESSION_HANDLE, pIn C.CK_BYTE_PTR, ulInLen C.CK_ULONG, pOut C.CK_BYTE_PTR, pulOutLen C.CK_ULONG_PTR, do func(*pkcs11.Module, uint, []byte, int) ([]byte, error)) C.CK_RV {
+	m, r := current()
+	if r != C.CKR_OK {
+		return r
+	}
+	if pulOutLen == nil || (pIn == nil && ulInLen > 0) {
+		return C.CKR_ARGUMENTS_BAD
+	}
+	capacity := -1
+	if pOut != nil {
+		capacity = int(*pulOutLen)
+	}
+	out, err := do(m, uint(hSession), bytes(pIn, ulInLen), capacity)
+	if err != nil && !errors.Is(err, pkcs11.CKR_BUFFER_TOO_SMALL) {
+		return rv(err)
+	}
+	*pulOutLen = C.CK_ULONG(len(out))
+	if err != nil {
+		return rv(err)
+	}
+	if pOut != nil {
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(pOut)), len(out)), out)
+	}
+	return C.CKR_OK
+}
+
+// list returns a list of CK_ULONGs with PKCS#11's length query convention
+func list(values []uint, pList *C.CK_ULONG, pulCount C.CK_ULONG_PTR) C.CK_RV {
+	if pulCount == nil {
+		return C.CKR_ARGUMENTS_BAD
+	}
+	if pList == nil {
+		*pulCount = C.CK_ULONG(len(values))
+		return C.CKR_OK
+	}
+	if int(*pulCount) < len(values) {
+		*pulCount = C.CK_ULONG(len(values))
+		return C.CKR_BUFFER_TOO_SMALL
+	}
+	out := unsafe.Slice(pList, len(values))
+	for i, v := range values {
+		out[i] = C.CK_ULONG(v)
+	}
+	*pulCount = C.CK_ULONG(len(values))
+	return C.CKR_OK
+}
+
+// mechanism converts a CK_MECHANISM, decoding OAEP and PSS parameters
+func mechanism(p C.CK_MECHANISM_PTR) pkcs11.Mechanism {
+	mech := pkcs11.Mechanism{Type: uint(p.mechanism)}
+	switch {
+	case mech.Type == C.CKM_RSA_PKCS_OAEP && p.ulParameterLen == C.sizeof_CK_RSA_PKCS_OAEP_PARAMS:
+		params := (*C.CK_RSA_PKCS_OAEP_PARAMS)(p.pParameter)
+		mech.RSA = &pkcs11.RSAParams{
+			Hash:  uint(params.hashAlg),
+			MGF:   uint(params.mgf),
+			Label: bytes((C.CK_BYTE_PTR)(params.pSourceData), params.ulSourceDataLen),
+		}
+	case mech.Type == C.CKM_RSA_PKCS_PSS && p.ulParameterLen == C.sizeof_CK_RSA_PKCS_PSS_PARAMS:
+		params := (*C.CK_RSA_PKCS_PSS_PARAMS)(p.pParameter)
+		mech.RSA = &pkcs11.RSAParams{
+			Hash:       uint(params.hashAlg),
+			MGF:        uint(params.mgf),
+			SaltLength: uint(params.sLen),
+		}
+	case p.pParameter != nil:
+		mech.Parameter = C.GoBytes(unsafe.Pointer(p.pParameter), C.int(p.ulParameterLen))
+	}
+	return mech
+}
+
+// attributes converts a template
+func attributes(p C.CK_ATTRIBUTE_PTR, n C.CK_ULONG) []pkcs11.Attribute {
+	var attrs []pkcs11.Attribute
+	for _, a := range unsafe.Slice(p, int(n)) {
+		attrs = append(attrs, pkcs11.Attribute{
+			Type:  uint(a._type),
+			Value: bytes((C.CK_BYTE_PTR)(a.pValue), a.ulValueLen),
+		})
+	}
+	return attrs
+}
+
+// bytes copies a C buffer
+func bytes(p C.CK_BYTE_PTR, n C.CK_ULONG) []byte {
+	if p == nil {
+		return nil
+	}
+	return C.GoBytes(unsafe.Pointer(p), C.int(n))
+}
+
+// pad fills a blank-padded CK_UTF8CHAR field
+func pad(field []C.CK_UTF8CHAR, s string) {
+	for i := range field {
+		field[i] = ' '
+	}
+	for i := 0; i < len(field) && i < len(s); i++ {
+		field[i] = C.CK_UTF8CHAR(s[i])
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !cgo
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	fmt.Fprintln(os.Stderr, "kms-pkcs11 needs cgo: go build -buildmode=c-shared -o libkmspkcs11.so ./cmd/kms-pkcs11")
+	os.Exit(1)
+}
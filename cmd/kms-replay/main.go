@@ -0,0 +1,116 @@
+// kms-replay re-issues calls recorded by the emulator's --record flag against
+// a fresh emulator and reports the calls that ended differently, to
+// reproduce flaky CI failures locally or to run a recording as a regression
+// suite.
+//
+// Usage:
+//
+//	server-dual --record calls.jsonl      # in CI
+//	kms-replay calls.jsonl                # against a fresh in-process emulator
+//	kms-replay --endpoint localhost:9090 calls.jsonl
+//	kms-replay -v - < calls.jsonl         # print every call
+//
+// A replay compares status codes only. It exits 1 if any call ended
+// differently and 2 on invalid arguments or recordings.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/recording"
+	"github.com/blackwell-systems/gcp-kms-emulator/pkg/emulator"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("kms-replay", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	endpoint := fs.String("endpoint", "", "Replay against the emulator at this gRPC address instead of a fresh in-process one")
+	iamMode := fs.String("iam-mode", "off", "IAM mode of the in-process emulator (off, permissive or strict)")
+	verbose := fs.Bool("v", false, "Print every call, not only those that ended differently")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: kms-replay [FLAGS] RECORDING")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	in := stdin
+	if path := fs.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(stderr, "kms-replay: %v\n", err)
+			return 2
+		}
+		defer f.Close()
+		in = f
+	}
+	records, err := recording.Read(in)
+	if err != nil {
+		fmt.Fprintf(stderr, "kms-replay: invalid recording: %v\n", err)
+		return 2
+	}
+
+	ctx := context.Background()
+	var conn *grpc.ClientConn
+	if *endpoint != "" {
+		conn, err = grpc.NewClient(*endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	} else {
+		var emu *emulator.Emulator
+		emu, err = emulator.Start(ctx, emulator.WithBufconn(), emulator.WithIAMMode(*iamMode))
+		if err != nil {
+			fmt.Fprintf(stderr, "kms-replay: failed to start emulator: %v\n", err)
+			return 1
+		}
+		defer emu.Close()
+		conn, err = emu.Dial()
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "kms-replay: failed to connect: %v\n", err)
+		return 1
+	}
+	defer conn.Close()
+
+	results, err := recording.Replay(ctx, conn, records)
+	differed := 0
+	for i, r := range results {
+		if r.Match() && !*verbose {
+			continue
+		}
+		if !r.Match() {
+			differed++
+		}
+		line := fmt.Sprintf("%d %s: recorded %s, replayed %s", i+1, r.Method, r.Want, r.Got)
+		if r.Message != "" {
+			line += ": " + r.Message
+		}
+		fmt.Fprintln(stdout, line)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "kms-replay: %v\n", err)
+		return 2
+	}
+	fmt.Fprintf(stdout, "Replayed %d calls, %d ended differently\n", len(results), differed)
+	if differed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -1,98 +1,54 @@
 // GCP KMS Emulator Server
 //
 // A lightweight emulator implementation of Google Cloud KMS API for local testing.
-// This server implements the gRPC KMS API without requiring GCP credentials.
+// One binary serves gRPC, REST or both without requiring GCP credentials.
 //
 // Usage:
 //
-//	gcp-kms-emulator --port 9090
+//	server --mode grpc --grpc-port 9090
+//	server --mode rest --http-port 8080
+//	server --mode dual --grpc-port 9090 --http-port 8080
 //
 // Environment Variables:
 //
-//	GCP_KMS_PORT        - Port to listen on (default: 9090)
+//	GCP_KMS_MODE        - Protocols to serve: grpc, rest, dual (default: grpc)
+//	GCP_KMS_HOST        - Address to bind, e.g. 127.0.0.1 (default: all interfaces)
+//	GCP_KMS_GRPC_PORT   - gRPC port to listen on (default: 9090; GCP_KMS_PORT is also accepted)
+//	GCP_KMS_HTTP_PORT   - HTTP port to listen on (default: 8080)
+//	GCP_KMS_GATEWAY_TRANSPORT - How REST reaches gRPC: inprocess, loopback (default: inprocess)
 //	GCP_KMS_LOG_LEVEL   - Log level: debug, info, warn, error (default: info)
+//	GCP_KMS_LOG_FORMAT  - Log format: text, json (default: text)
+//	GCP_KMS_PROXY_RESOURCES - Forward calls on resources matching these comma-separated patterns to Cloud KMS (default: none)
+//	GCP_KMS_PROXY_UNIMPLEMENTED - Forward calls the emulator does not implement to Cloud KMS (default: false)
+//	GCP_KMS_PROXY_ENDPOINT - Cloud KMS endpoint for forwarded calls and GCP_KMS_MIRROR (default: cloudkms.googleapis.com:443)
+//	GCP_KMS_MIRROR      - Copy key metadata from these comma-separated Cloud KMS projects or locations at startup (default: none)
+//	GCP_KMS_CONFIG      - Runtime configuration file (JSON), reloaded on SIGHUP (default: none)
+//	GCP_KMS_AUDIT_LOG   - Cloud Audit Log JSON lines file, or - for stdout (default: disabled)
+//	GCP_KMS_RECORD_FILE - Record sanitized calls for kms-replay to this file, or - for stdout (default: disabled)
+//	GCP_KMS_PUBSUB_TOPIC - Publish key lifecycle events to projects/{project}/topics/{topic} (default: disabled)
+//	PUBSUB_EMULATOR_HOST - Pub/Sub emulator host for GCP_KMS_PUBSUB_TOPIC
+//	GCP_KMS_STATE_FILE  - Path to persist state across restarts (default: disabled)
+//	GCP_KMS_GCLOUD_IMPORT - Comma-separated gcloud kms list --format=json files to recreate at startup (default: none)
+//	GCP_KMS_FIXTURES    - Fixtures manifest of key versions with supplied key material (default: none)
+//	GCP_KMS_STATE_URI   - gs://, s3:// or file:// snapshot location (default: disabled)
+//	GCP_KMS_STATE_SYNC_INTERVAL - Periodic snapshot upload interval, e.g. 30s (default: on shutdown only)
+//	GCP_KMS_TLS_CERT    - PEM certificate file; enables TLS together with GCP_KMS_TLS_KEY
+//	GCP_KMS_TLS_KEY     - PEM private key file
+//	GCP_KMS_ADMIN_PORT  - Admin API port for reset, state dump, stats and config (default: disabled)
+//	GCP_KMS_CHAOS       - Fraction of calls failed with UNAVAILABLE/DEADLINE_EXCEEDED, e.g. 0.05 (default: 0)
+//	GCP_KMS_SHUTDOWN_TIMEOUT - How long to drain in-flight requests on shutdown (default: 5s)
+//	GCP_KMS_KEEPALIVE_TIME - Ping idle clients after this long (default: 2h)
+//	GCP_KMS_KEEPALIVE_TIMEOUT - Keepalive ping acknowledgement timeout (default: 20s)
+//	GCP_KMS_MAX_CONNECTION_IDLE - GOAWAY connections idle this long (default: disabled)
+//	GCP_KMS_MAX_CONNECTION_AGE - GOAWAY connections older than this (default: disabled)
+//	GCP_KMS_MAX_CONNECTION_AGE_GRACE - Time for RPCs to finish after a max-age GOAWAY (default: unlimited)
+//	GCP_KMS_KEEPALIVE_MIN_TIME - Minimum client ping interval before too_many_pings (default: 5m)
+//	GCP_KMS_KEEPALIVE_PERMIT_WITHOUT_STREAM - Allow client pings with no active RPCs (default: false)
+//	GCP_KMS_RELAX_SIZE_LIMITS - Lift the Cloud KMS message and payload size limits (default: false)
 package main
 
-import (
-	"flag"
-	"fmt"
-	"log"
-	"net"
-	"os"
-	"os/signal"
-	"syscall"
-
-	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/reflection"
-
-	"github.com/blackwell-systems/gcp-kms-emulator/internal/server"
-)
-
-var (
-	port     = flag.Int("port", getEnvInt("GCP_KMS_PORT", 9090), "Port to listen on")
-	logLevel = flag.String("log-level", getEnv("GCP_KMS_LOG_LEVEL", "info"), "Log level (debug, info, warn, error)")
-	version  = "0.1.0"
-)
+import "github.com/blackwell-systems/gcp-kms-emulator/internal/cli"
 
 func main() {
-	flag.Parse()
-
-	log.Printf("GCP KMS Emulator v%s", version)
-	log.Printf("Starting on port %d with log level: %s", *port, *logLevel)
-
-	// Create listener
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
-	if err != nil {
-		log.Fatalf("Failed to listen: %v", err)
-	}
-
-	// Create gRPC server
-	grpcServer := grpc.NewServer()
-
-	// Create and register KMS service
-	kmsServer, err := server.NewServer()
-	if err != nil {
-		log.Fatalf("Failed to create KMS server: %v", err)
-	}
-	kmspb.RegisterKeyManagementServiceServer(grpcServer, kmsServer)
-
-	// Register reflection service (for grpc_cli debugging)
-	reflection.Register(grpcServer)
-
-	log.Printf("Server listening at %v", lis.Addr())
-	log.Printf("Ready to accept connections")
-
-	// Start server in goroutine
-	go func() {
-		if err := grpcServer.Serve(lis); err != nil {
-			log.Fatalf("Failed to serve: %v", err)
-		}
-	}()
-
-	// Wait for interrupt signal to gracefully shutdown
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-
-	log.Println("Shutting down server...")
-	grpcServer.GracefulStop()
-	log.Println("Server stopped")
-}
-
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return defaultValue
-}
-
-func getEnvInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
-		var intValue int
-		if _, err := fmt.Sscanf(value, "%d", &intValue); err == nil {
-			return intValue
-		}
-	}
-	return defaultValue
+	cli.Main(cli.ModeGRPC)
 }
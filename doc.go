@@ -46,10 +46,12 @@
 //
 // # Server Variants
 //
-// Three server variants are available:
-//   - server: gRPC only (fastest startup, SDK users)
-//   - server-rest: REST/HTTP only (curl, scripts, any language)
-//   - server-dual: Both gRPC and REST (maximum flexibility)
+// One server binary serves every protocol, selected with --mode:
+//   - grpc: gRPC only (fastest startup, SDK users)
+//   - rest: REST/HTTP only (curl, scripts, any language)
+//   - dual: Both gRPC and REST (maximum flexibility)
+//
+// server-rest and server-dual are thin wrappers defaulting to rest and dual.
 //
 // # Docker
 //
@@ -77,7 +79,7 @@
 // Thread-safe in-memory storage with sync.RWMutex for concurrent operations.
 // Real AES-256-GCM encryption (not mocked) for authentic behavior. Custom HTTP
 // gateway for REST API (not grpc-gateway) with GCP-compatible endpoints.
-// Three server variants built from same codebase using build tags.
+// A single command line implementation (internal/cli) backs every binary.
 //
 // # License
 //
@@ -0,0 +1,30 @@
+#!/bin/sh
+# Generates the files Vault needs to trust the emulator as Cloud KMS:
+# a self-signed certificate for cloudkms.googleapis.com and a throwaway
+# service account key. Vault signs its own JWTs with the key, so it never
+# contacts Google.
+set -eu
+cd "$(dirname "$0")"
+mkdir -p certs
+
+openssl req -x509 -newkey ec -pkeyopt ec_paramgen_curve:P-256 -nodes -days 365 \
+  -subj "/CN=cloudkms.googleapis.com" \
+  -addext "subjectAltName=DNS:cloudkms.googleapis.com" \
+  -addext "basicConstraints=critical,CA:TRUE" \
+  -keyout certs/key.pem -out certs/cert.pem
+
+openssl genpkey -algorithm RSA -pkeyopt rsa_keygen_bits:2048 -out certs/sa-key.pem
+key=$(awk '{printf "%s\\n", $0}' certs/sa-key.pem)
+cat > certs/service-account.json <<JSON
+{
+  "type": "service_account",
+  "project_id": "vault-test",
+  "private_key_id": "emulator",
+  "private_key": "$key",
+  "client_email": "vault@vault-test.iam.gserviceaccount.com",
+  "client_id": "1",
+  "token_uri": "https://oauth2.googleapis.com/token"
+}
+JSON
+rm certs/sa-key.pem
+chmod 644 certs/*
@@ -0,0 +1,20 @@
+storage "file" {
+  path = "/vault/file"
+}
+
+listener "tcp" {
+  address     = "0.0.0.0:8200"
+  tls_disable = true
+}
+
+# Vault dials cloudkms.googleapis.com:443, which the compose network
+# resolves to the emulator
+seal "gcpckms" {
+  project    = "vault-test"
+  region     = "global"
+  key_ring   = "vault"
+  crypto_key = "unseal"
+}
+
+disable_mlock = true
+ui            = true
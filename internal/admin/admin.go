@@ -0,0 +1,775 @@
+// Package admin provides the emulator's administrative HTTP API.
+//
+// The admin API runs on its own listener, separate from the gRPC and REST
+// KMS ports, so tests that talk to the emulator like a real KMS endpoint can
+// never reach it by accident.
+//
+// # Endpoints
+//
+//   - POST   /admin/reset         - delete all keyrings, keys and versions, or
+//     only those of one project with ?project= or one key ring with ?keyRing=
+//   - GET    /admin/state         - dump state as JSON (key material omitted
+//     unless ?include_key_material=true, which returns a loadable snapshot)
+//   - POST   /admin/fixtures      - create key versions with supplied key material
+//     (a storage.Fixtures manifest with keys given inline)
+//   - POST   /admin/import        - add a version with unwrapped key material
+//     to a key ({"cryptoKey": "...", "key": "<base64>"} or "privateKeyPem")
+//   - POST   /admin/inspect       - find the version that produced a ciphertext
+//     and whether it would decrypt now, without decrypting it
+//     ({"ciphertext": "<base64>"}, optionally "cryptoKey" and
+//     "additionalAuthenticatedData")
+//   - GET    /admin/tink/keyset   - export the enabled and disabled versions of
+//     a symmetric or MAC key as a cleartext Tink JSON keyset (?cryptoKey=)
+//   - POST   /admin/tink/keyset   - add a version to a key for each key in a
+//     cleartext Tink JSON keyset (?cryptoKey=)
+//   - GET    /admin/export        - all resources as a Cloud Asset Inventory
+//     export, one asset per line (?assetTypes=, ?parent=projects/p)
+//   - GET    /admin/snapshots     - list named in-memory snapshots
+//   - POST   /admin/snapshots/{name} - save the current state as a snapshot
+//   - POST   /admin/snapshots/{name}:restore - replace the state with a snapshot
+//   - DELETE /admin/snapshots/{name} - delete a snapshot
+//   - GET    /admin/stats         - resource counts, per-method call counters
+//     and the use counts and last use times of every key and version
+//   - GET    /admin/cost          - operations by type and price class with
+//     the Cloud KMS bill they would have run up, and costly call patterns
+//   - GET    /admin/config        - effective runtime configuration
+//   - PATCH  /admin/config        - change runtime settings ({"logLevel":"debug",
+//     "chaos":0.05})
+//   - POST   /admin/config:reload - re-read the --config file
+//   - GET    /admin/faults        - list fault injection rules
+//   - POST   /admin/faults        - add a fault injection rule
+//   - DELETE /admin/faults        - remove all fault injection rules
+//   - DELETE /admin/faults/{id}   - remove one fault injection rule
+//   - GET    /admin/authz/decisions - recent permission checks, newest first
+//     (?limit=, ?outcome=DENIED, ?principal=)
+//   - DELETE /admin/authz/decisions - forget the recorded permission checks
+//   - GET    /admin/authz/cache   - IAM answer cache hits, misses and size
+//   - DELETE /admin/authz/cache   - drop cached IAM answers, or only those of
+//     one resource and the resources below it with ?resource=
+//   - POST   /admin/dashboard/{action} - enable, disable, destroy or restore a
+//     version, rotate a key, or encrypt and decrypt text with it
+//     ({"name": "...", "plaintext": "..."} or "ciphertext": "<base64>")
+//   - GET    /ui/                 - the web dashboard (/ redirects to it)
+//   - GET    /health              - liveness check
+//
+// Reset is also served over gRPC on the admin port (see ResetMethod), for
+// suites that only speak gRPC. It is never served on the KMS port.
+//
+// # Usage
+//
+//	stats := admin.NewStats()
+//	grpcServer := grpc.NewServer(grpc.ChainUnaryInterceptor(stats.UnaryServerInterceptor()))
+//	adminServer := admin.NewServer(kmsServer.Storage(), stats, admin.Config{Version: version})
+//	go adminServer.Start(":9091")
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/assetinventory"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/authz"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/fault"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/logging"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/tinkkeyset"
+)
+
+// Config describes the runtime configuration exposed by /admin/config
+type Config struct {
+	// Version is the emulator version
+	Version string
+	// Settings holds read-only startup settings (ports, modes, paths)
+	Settings map[string]string
+	// LogLevel, when set, is reported and can be changed via PATCH
+	LogLevel *slog.LevelVar
+	// Faults, when set, is managed via /admin/faults
+	Faults *fault.Injector
+	// Chaos, when set, is reported and its rate can be changed via PATCH
+	Chaos *fault.Chaos
+	// Reload, when set, re-reads the configuration file
+	Reload func() error
+	// Decisions, when set, is served via /admin/authz/decisions
+	Decisions *authz.DecisionLog
+	// IAMCache, when set, is reported in /admin/stats and managed via
+	// /admin/authz/cache
+	IAMCache *authz.DecisionCache
+	// Pricing prices the /admin/cost report; nil uses DefaultPricing
+	Pricing *Pricing
+}
+
+// Server serves the admin API
+type Server struct {
+	storage *storage.Storage
+	stats   *Stats
+	config  Config
+
+	mu         sync.Mutex
+	httpServer *http.Server
+	stopped    bool
+}
+
+// NewServer creates an admin server for the given storage. stats may be nil
+// if call counting is not enabled.
+func NewServer(st *storage.Storage, stats *Stats, config Config) *Server {
+	return &Server{
+		storage: st,
+		stats:   stats,
+		config:  config,
+	}
+}
+
+// Handler returns the admin API routes, with the admin gRPC service for
+// gRPC requests. Serving gRPC needs HTTP/2, which Start enables without TLS.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/reset", s.handleReset)
+	mux.HandleFunc("/admin/state", s.handleState)
+	mux.HandleFunc("/admin/fixtures", s.handleFixtures)
+	mux.HandleFunc("/admin/import", s.handleImport)
+	mux.HandleFunc("/admin/inspect", s.handleInspect)
+	mux.HandleFunc("/admin/tink/keyset", s.handleTinkKeyset)
+	mux.HandleFunc("/admin/export", s.handleExport)
+	mux.HandleFunc("/admin/snapshots", s.handleSnapshots)
+	mux.HandleFunc("/admin/snapshots/", s.handleSnapshot)
+	mux.HandleFunc("/admin/stats", s.handleStats)
+	mux.HandleFunc("/admin/cost", s.handleCost)
+	mux.HandleFunc("/admin/config", s.handleConfig)
+	mux.HandleFunc("/admin/config:reload", s.handleReload)
+	mux.HandleFunc("/admin/faults", s.handleFaults)
+	mux.HandleFunc("/admin/faults/", s.handleFault)
+	mux.HandleFunc("/admin/authz/decisions", s.handleDecisions)
+	mux.HandleFunc("/admin/authz/cache", s.handleIAMCache)
+	mux.HandleFunc("/admin/dashboard/", s.handleDashboardAction)
+	mux.HandleFunc("/ui/", s.handleUI)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		http.Redirect(w, r, "/ui/", http.StatusFound)
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "healthy"})
+	})
+	return withGRPC(s.newGRPCServer(), mux)
+}
+
+// Start starts the admin server on the specified address
+func (s *Server) Start(addr string) error {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return http.ErrServerClosed
+	}
+	srv := &http.Server{
+		Addr:      addr,
+		Handler:   s.Handler(),
+		Protocols: protocols(),
+	}
+	s.httpServer = srv
+	s.mu.Unlock()
+
+	return srv.ListenAndServe()
+}
+
+// Stop gracefully stops the admin server
+func (s *Server) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	s.stopped = true
+	srv := s.httpServer
+	s.mu.Unlock()
+
+	if srv != nil {
+		return srv.Shutdown(ctx)
+	}
+	return nil
+}
+
+func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	resp, err := s.reset(r.URL.Query().Get("project"), r.URL.Query().Get("keyRing"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// keyRingPattern matches the names reset accepts for keyRing
+var keyRingPattern = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+$`)
+
+// reset deletes all state, that of one project or that of one key ring, and
+// returns the response shared by the HTTP and gRPC calls
+func (s *Server) reset(project, keyRing string) (map[string]any, error) {
+	switch {
+	case project != "" && keyRing != "":
+		return nil, fmt.Errorf("project and keyRing are mutually exclusive")
+	case keyRing != "":
+		if !keyRingPattern.MatchString(keyRing) {
+			return nil, fmt.Errorf("invalid keyRing %q (expected projects/{project}/locations/{location}/keyRings/{keyRing})", keyRing)
+		}
+		deleted := 0
+		if s.storage.ClearKeyRing(keyRing) {
+			deleted = 1
+		}
+		slog.Info("Key ring state reset via admin API", "key_ring", keyRing, "key_rings", deleted)
+		return map[string]any{"status": "reset", "keyRing": keyRing, "keyRingsDeleted": deleted}, nil
+	case project != "":
+		deleted := s.storage.ClearProject(project)
+		slog.Info("Project state reset via admin API", "project", project, "key_rings", deleted)
+		return map[string]any{"status": "reset", "project": project, "keyRingsDeleted": deleted}, nil
+	default:
+		s.storage.Clear()
+		slog.Info("State reset via admin API")
+		return map[string]any{"status": "reset"}, nil
+	}
+}
+
+func (s *Server) handleState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	var err error
+	if r.URL.Query().Get("include_key_material") == "true" {
+		err = s.storage.SaveState(w)
+	} else {
+		err = s.storage.DumpState(w)
+	}
+	if err != nil {
+		slog.Error("Failed to dump state", "error", err)
+	}
+}
+
+func (s *Server) handleFixtures(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var fixtures storage.Fixtures
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fixtures); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid fixtures: %v", err))
+		return
+	}
+
+	// Key files would be read from the server's disk, which the
+	// unauthenticated admin API must not expose
+	created, err := s.storage.LoadFixtures(fixtures)
+	if err != nil {
+		code := http.StatusBadRequest
+		if strings.Contains(err.Error(), "already exists") {
+			code = http.StatusConflict
+		}
+		writeError(w, code, err.Error())
+		return
+	}
+	slog.Info("Fixtures loaded via admin API", "versions", len(fixtures.Versions), "created", created)
+	writeJSON(w, http.StatusOK, map[string]int{"versionsCreated": created})
+}
+
+// importRequest is the body of POST /admin/import
+type importRequest struct {
+	CryptoKey string `json:"cryptoKey"`
+	// Algorithm defaults to the key's version template algorithm
+	Algorithm     string `json:"algorithm"`
+	Key           []byte `json:"key"`
+	PrivateKeyPEM string `json:"privateKeyPem"`
+}
+
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var req importRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid import request: %v", err))
+		return
+	}
+	algorithm, ok := kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm_value[req.Algorithm]
+	if !ok && req.Algorithm != "" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown algorithm %q", req.Algorithm))
+		return
+	}
+	material := req.Key
+	switch {
+	case req.CryptoKey == "":
+		writeError(w, http.StatusBadRequest, "cryptoKey is required")
+		return
+	case len(material) > 0 && req.PrivateKeyPEM != "":
+		writeError(w, http.StatusBadRequest, "key and privateKeyPem are mutually exclusive")
+		return
+	case req.PrivateKeyPEM != "":
+		material = []byte(req.PrivateKeyPEM)
+	case len(material) == 0:
+		writeError(w, http.StatusBadRequest, "key or privateKeyPem is required")
+		return
+	}
+
+	version, err := s.storage.ImportRawKeyMaterial(req.CryptoKey, kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm(algorithm), material)
+	if err != nil {
+		code := http.StatusBadRequest
+		if strings.Contains(err.Error(), "not found") {
+			code = http.StatusNotFound
+		}
+		writeError(w, code, err.Error())
+		return
+	}
+	data, err := protojson.Marshal(version)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	slog.Info("Key material imported via admin API", "version", version.Name, "algorithm", version.Algorithm)
+	writeJSON(w, http.StatusCreated, json.RawMessage(data))
+}
+
+// inspectRequest is the body of POST /admin/inspect
+type inspectRequest struct {
+	Ciphertext []byte `json:"ciphertext"`
+	// CryptoKey narrows the search to one key; by default every
+	// ENCRYPT_DECRYPT key is searched
+	CryptoKey                   string `json:"cryptoKey"`
+	AdditionalAuthenticatedData []byte `json:"additionalAuthenticatedData"`
+}
+
+func (s *Server) handleInspect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var req inspectRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid inspect request: %v", err))
+		return
+	}
+	if len(req.Ciphertext) == 0 {
+		writeError(w, http.StatusBadRequest, "ciphertext is required")
+		return
+	}
+
+	inspection, err := s.storage.InspectCiphertext(req.CryptoKey, req.Ciphertext, req.AdditionalAuthenticatedData)
+	if err != nil {
+		code := http.StatusBadRequest
+		if strings.Contains(err.Error(), "not found") {
+			code = http.StatusNotFound
+		}
+		writeError(w, code, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, inspection)
+}
+
+func (s *Server) handleTinkKeyset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		return
+	}
+	keyName := r.URL.Query().Get("cryptoKey")
+	if keyName == "" {
+		writeError(w, http.StatusBadRequest, "cryptoKey is required")
+		return
+	}
+	storageError := func(err error) {
+		code := http.StatusBadRequest
+		if strings.Contains(err.Error(), "not found") {
+			code = http.StatusNotFound
+		}
+		writeError(w, code, err.Error())
+	}
+
+	if r.Method == http.MethodGet {
+		versions, err := s.storage.ExportSymmetricVersions(keyName)
+		if err != nil {
+			storageError(err)
+			return
+		}
+		data, err := tinkkeyset.Marshal(versions)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		slog.Info("Tink keyset exported via admin API", "key", keyName, "versions", len(versions))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	versions, err := tinkkeyset.Unmarshal(data)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	imported, err := s.storage.ImportSymmetricVersions(keyName, versions)
+	if err != nil {
+		storageError(err)
+		return
+	}
+	out := make([]json.RawMessage, len(imported))
+	for i, version := range imported {
+		if out[i], err = protojson.Marshal(version); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	slog.Info("Tink keyset imported via admin API", "key", keyName, "versions", len(imported))
+	writeJSON(w, http.StatusCreated, map[string]any{"cryptoKeyVersions": out})
+}
+
+// handleExport writes a Cloud Asset Inventory export of content type
+// RESOURCE, the only one the emulator can produce
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	query := r.URL.Query()
+	if contentType := query.Get("contentType"); contentType != "" && contentType != "RESOURCE" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported contentType %q; only RESOURCE is exported", contentType))
+		return
+	}
+	opts := assetinventory.Options{Parent: query.Get("parent")}
+	for _, value := range query["assetTypes"] {
+		for _, assetType := range strings.Split(value, ",") {
+			if assetType = strings.TrimSpace(assetType); assetType != "" {
+				opts.AssetTypes = append(opts.AssetTypes, assetType)
+			}
+		}
+	}
+
+	inv, err := s.storage.Inventory()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	assets, err := assetinventory.Assets(inv, opts)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if err := assetinventory.Write(w, assets); err != nil {
+		slog.Error("Failed to write asset export", "error", err)
+		return
+	}
+	slog.Info("Assets exported via admin API", "assets", len(assets))
+}
+
+func (s *Server) handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"snapshots": s.storage.ListSnapshots()})
+}
+
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	name, verb, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/snapshots/"), ":")
+	if name == "" || strings.Contains(name, "/") {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("invalid snapshot name %q", name))
+		return
+	}
+
+	switch {
+	case verb == "restore":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		info, err := s.storage.RestoreSnapshot(name)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		slog.Info("Snapshot restored via admin API", "name", name, "key_rings", info.KeyRings)
+		writeJSON(w, http.StatusOK, info)
+	case verb != "":
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown snapshot action %q", verb))
+	case r.Method == http.MethodPost:
+		info, err := s.storage.SaveSnapshot(name)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		slog.Info("Snapshot saved via admin API", "name", name, "key_rings", info.KeyRings)
+		writeJSON(w, http.StatusCreated, info)
+	case r.Method == http.MethodDelete:
+		if err := s.storage.DeleteSnapshot(name); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		slog.Info("Snapshot deleted via admin API", "name", name)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+	default:
+		methodNotAllowed(w, http.MethodPost, http.MethodDelete)
+	}
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	resp := map[string]any{
+		"resources": s.storage.Stats(),
+		"keyUsage":  s.storage.UsageReport(),
+	}
+	if s.stats != nil {
+		resp["uptimeSeconds"] = int64(s.stats.Uptime().Seconds())
+		resp["requests"] = s.stats.Snapshot()
+	}
+	if s.config.IAMCache != nil {
+		resp["iamCache"] = s.config.IAMCache.Stats()
+	}
+	if generation := s.storage.GenerationStats(); generation != nil {
+		resp["keyGeneration"] = generation
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.configView())
+	case http.MethodPatch:
+		var patch struct {
+			LogLevel *string  `json:"logLevel"`
+			Chaos    *float64 `json:"chaos"`
+		}
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&patch); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid config patch: %v", err))
+			return
+		}
+
+		if patch.LogLevel != nil {
+			if s.config.LogLevel == nil {
+				writeError(w, http.StatusBadRequest, "log level is not adjustable at runtime")
+				return
+			}
+			level, err := logging.ParseLevel(*patch.LogLevel)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			s.config.LogLevel.Set(level)
+			slog.Info("Log level changed via admin API", "level", level.String())
+		}
+
+		if patch.Chaos != nil {
+			if s.config.Chaos == nil {
+				writeError(w, http.StatusBadRequest, "chaos is not adjustable at runtime")
+				return
+			}
+			if err := s.config.Chaos.SetRate(*patch.Chaos); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			slog.Info("Chaos rate changed via admin API", "rate", *patch.Chaos)
+		}
+
+		writeJSON(w, http.StatusOK, s.configView())
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPatch)
+	}
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if s.config.Reload == nil {
+		writeError(w, http.StatusNotFound, "no config file configured (start with --config)")
+		return
+	}
+	if err := s.config.Reload(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	slog.Info("Config reloaded via admin API")
+	writeJSON(w, http.StatusOK, s.configView())
+}
+
+func (s *Server) handleFaults(w http.ResponseWriter, r *http.Request) {
+	if s.config.Faults == nil {
+		writeError(w, http.StatusNotFound, "fault injection is not enabled")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]any{"rules": s.config.Faults.Rules()})
+	case http.MethodPost:
+		var rule fault.Rule
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&rule); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid fault rule: %v", err))
+			return
+		}
+
+		added, err := s.config.Faults.AddRule(rule)
+		if err != nil {
+			code := http.StatusInternalServerError
+			if errors.Is(err, fault.ErrInvalidRule) {
+				code = http.StatusBadRequest
+			}
+			writeError(w, code, err.Error())
+			return
+		}
+		slog.Info("Fault rule added via admin API", "id", added.ID, "action", added.Action, "method", added.Method, "resource", added.Resource)
+		writeJSON(w, http.StatusCreated, added)
+	case http.MethodDelete:
+		s.config.Faults.Clear()
+		slog.Info("Fault rules cleared via admin API")
+		writeJSON(w, http.StatusOK, map[string]any{"rules": []fault.Rule{}})
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodDelete)
+	}
+}
+
+func (s *Server) handleFault(w http.ResponseWriter, r *http.Request) {
+	if s.config.Faults == nil {
+		writeError(w, http.StatusNotFound, "fault injection is not enabled")
+		return
+	}
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodDelete)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/admin/faults/")
+	if !s.config.Faults.RemoveRule(id) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("fault rule %q not found", id))
+		return
+	}
+	slog.Info("Fault rule removed via admin API", "id", id)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "removed"})
+}
+
+func (s *Server) handleDecisions(w http.ResponseWriter, r *http.Request) {
+	if s.config.Decisions == nil {
+		writeError(w, http.StatusNotFound, "authorization decisions are not recorded")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		limit := 0
+		if v := query.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit %q", v))
+				return
+			}
+			limit = n
+		}
+		outcome := strings.ToUpper(query.Get("outcome"))
+		principal := query.Get("principal")
+
+		decisions := []authz.Decision{}
+		for _, d := range s.config.Decisions.Recent(0) {
+			if (outcome != "" && d.Outcome != outcome) || (principal != "" && d.Principal != principal) {
+				continue
+			}
+			decisions = append(decisions, d)
+			if limit > 0 && len(decisions) == limit {
+				break
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"decisions": decisions})
+	case http.MethodDelete:
+		s.config.Decisions.Clear()
+		slog.Info("Authorization decisions cleared via admin API")
+		writeJSON(w, http.StatusOK, map[string]any{"decisions": []authz.Decision{}})
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+func (s *Server) handleIAMCache(w http.ResponseWriter, r *http.Request) {
+	if s.config.IAMCache == nil {
+		writeError(w, http.StatusNotFound, "IAM answers are not cached")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.config.IAMCache.Stats())
+	case http.MethodDelete:
+		resource := r.URL.Query().Get("resource")
+		n := s.config.IAMCache.Invalidate(resource)
+		slog.Info("IAM cache invalidated via admin API", "resource", resource, "entries", n)
+		writeJSON(w, http.StatusOK, map[string]int{"invalidated": n})
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+func (s *Server) configView() map[string]any {
+	view := map[string]any{
+		"version":  s.config.Version,
+		"settings": s.config.Settings,
+	}
+	if s.config.LogLevel != nil {
+		view["logLevel"] = strings.ToLower(s.config.LogLevel.Level().String())
+	}
+	if s.config.Chaos != nil {
+		view["chaos"] = s.config.Chaos.Rate()
+	}
+	return view
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
@@ -0,0 +1,769 @@
+package admin
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/authz"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/fault"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, *storage.Storage, *Stats, *slog.LevelVar) {
+	t.Helper()
+
+	st := storage.NewStorage()
+	if _, err := st.CreateKeyRing("projects/p/locations/global/keyRings/ring"); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	if _, err := st.CreateCryptoKey("projects/p/locations/global/keyRings/ring", "key", kmspb.CryptoKey_ENCRYPT_DECRYPT, nil, nil); err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+
+	chaos, err := fault.NewChaos(0)
+	if err != nil {
+		t.Fatalf("NewChaos failed: %v", err)
+	}
+
+	stats := NewStats()
+	level := new(slog.LevelVar)
+	srv := NewServer(st, stats, Config{
+		Version:  "test",
+		Settings: map[string]string{"port": "9090"},
+		LogLevel: level,
+		Faults:   fault.NewInjector(),
+		Chaos:    chaos,
+	})
+
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(ts.Close)
+	return ts, st, stats, level
+}
+
+func doRequest(t *testing.T, method, url, body string) (*http.Response, map[string]any) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	var out map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("Invalid JSON response: %v", err)
+	}
+	return resp, out
+}
+
+func TestReset(t *testing.T) {
+	ts, st, _, _ := newTestServer(t)
+
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/admin/reset", ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /admin/reset: expected 405, got %d", resp.StatusCode)
+	}
+
+	resp, _ := doRequest(t, http.MethodPost, ts.URL+"/admin/reset", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	if got := st.Stats().KeyRings; got != 0 {
+		t.Errorf("Expected empty storage after reset, got %d keyrings", got)
+	}
+}
+
+func TestResetProject(t *testing.T) {
+	ts, st, _, _ := newTestServer(t)
+	if _, err := st.CreateKeyRing("projects/other/locations/global/keyRings/ring"); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+
+	resp, body := doRequest(t, http.MethodPost, ts.URL+"/admin/reset?project=p", "")
+	if resp.StatusCode != http.StatusOK || body["project"] != "p" || body["keyRingsDeleted"] != float64(1) {
+		t.Fatalf("Expected project p reset, got %d %v", resp.StatusCode, body)
+	}
+	if _, err := st.GetKeyRing("projects/other/locations/global/keyRings/ring"); err != nil {
+		t.Errorf("Expected other projects to be kept: %v", err)
+	}
+	if _, err := st.GetKeyRing("projects/p/locations/global/keyRings/ring"); err == nil {
+		t.Error("Expected project p to be reset")
+	}
+}
+
+func TestResetKeyRing(t *testing.T) {
+	ts, st, _, _ := newTestServer(t)
+	const other = "projects/p/locations/global/keyRings/other"
+	if _, err := st.CreateKeyRing(other); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+
+	resp, body := doRequest(t, http.MethodPost, ts.URL+"/admin/reset?keyRing=projects/p/locations/global/keyRings/ring", "")
+	if resp.StatusCode != http.StatusOK || body["keyRing"] != "projects/p/locations/global/keyRings/ring" || body["keyRingsDeleted"] != float64(1) {
+		t.Fatalf("Expected key ring ring reset, got %d %v", resp.StatusCode, body)
+	}
+	if _, err := st.GetKeyRing(other); err != nil {
+		t.Errorf("Expected other key rings of the project to be kept: %v", err)
+	}
+	if _, err := st.GetCryptoKey("projects/p/locations/global/keyRings/ring/cryptoKeys/key"); err == nil {
+		t.Error("Expected the key ring's keys to be deleted")
+	}
+
+	// Resetting again is not an error, so cleanup can run unconditionally
+	if _, body := doRequest(t, http.MethodPost, ts.URL+"/admin/reset?keyRing=projects/p/locations/global/keyRings/ring", ""); body["keyRingsDeleted"] != float64(0) {
+		t.Errorf("Expected nothing deleted the second time, got %v", body)
+	}
+
+	for _, query := range []string{"keyRing=projects/p", "keyRing=" + other + "&project=p"} {
+		if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/admin/reset?"+query, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestResetGRPC(t *testing.T) {
+	st := storage.NewStorage()
+	for _, name := range []string{"projects/a/locations/global/keyRings/ring", "projects/b/locations/global/keyRings/ring"} {
+		if _, err := st.CreateKeyRing(name); err != nil {
+			t.Fatalf("CreateKeyRing failed: %v", err)
+		}
+	}
+
+	// gRPC shares the admin listener with the HTTP routes
+	ts := httptest.NewUnstartedServer(NewServer(st, nil, Config{}).Handler())
+	ts.Config.Protocols = protocols()
+	ts.Start()
+	defer ts.Close()
+
+	conn, err := grpc.NewClient(ts.Listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	defer conn.Close()
+
+	req, _ := structpb.NewStruct(map[string]any{"project": "a"})
+	var resp structpb.Struct
+	if err := conn.Invoke(context.Background(), ResetMethod, req, &resp); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if got := resp.Fields["keyRingsDeleted"].GetNumberValue(); got != 1 {
+		t.Errorf("Expected 1 key ring deleted, got %v", got)
+	}
+	if got := st.Stats().KeyRings; got != 1 {
+		t.Errorf("Expected project b to be kept, got %d keyrings", got)
+	}
+
+	req, _ = structpb.NewStruct(map[string]any{"keyRing": "projects/b"})
+	if err := conn.Invoke(context.Background(), ResetMethod, req, &resp); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected an invalid key ring name to fail with InvalidArgument, got %v", err)
+	}
+
+	if err := conn.Invoke(context.Background(), ResetMethod, &structpb.Struct{}, &resp); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if got := st.Stats().KeyRings; got != 0 {
+		t.Errorf("Expected empty storage after reset, got %d keyrings", got)
+	}
+}
+
+func TestFixtures(t *testing.T) {
+	ts, st, _, _ := newTestServer(t)
+
+	version := "projects/test/locations/global/keyRings/golden/cryptoKeys/mac/cryptoKeyVersions/1"
+	body := `{"versions": [{"name": "` + version + `", "algorithm": "HMAC_SHA256", "key": "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="}]}`
+	resp, got := doRequest(t, http.MethodPost, ts.URL+"/admin/fixtures", body)
+	if resp.StatusCode != http.StatusOK || got["versionsCreated"] != float64(1) {
+		t.Fatalf("Expected 1 version created, got %d %v", resp.StatusCode, got)
+	}
+	if _, err := st.GetCryptoKeyVersion(version); err != nil {
+		t.Errorf("Expected the fixture version to exist: %v", err)
+	}
+
+	tests := []struct {
+		desc, method, body string
+		want               int
+	}{
+		{"same again", http.MethodPost, body, http.StatusOK},
+		{"different key", http.MethodPost, `{"versions": [{"name": "` + version + `", "algorithm": "HMAC_SHA256", "key": "` + strings.Repeat("A", 43) + `="}]}`, http.StatusConflict},
+		{"key file", http.MethodPost, `{"versions": [{"name": "` + version + `", "algorithm": "HMAC_SHA256", "keyFile": "/etc/passwd"}]}`, http.StatusBadRequest},
+		{"unknown field", http.MethodPost, `{"keys": []}`, http.StatusBadRequest},
+		{"GET", http.MethodGet, "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if resp, got := doRequest(t, tt.method, ts.URL+"/admin/fixtures", tt.body); resp.StatusCode != tt.want {
+			t.Errorf("%s: expected %d, got %d %v", tt.desc, tt.want, resp.StatusCode, got)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	ts, st, _, _ := newTestServer(t)
+	if _, err := st.CreateCryptoKey("projects/p/locations/global/keyRings/ring", "mac", kmspb.CryptoKey_MAC,
+		&kmspb.CryptoKeyVersionTemplate{Algorithm: kmspb.CryptoKeyVersion_HMAC_SHA256}, nil); err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+	key := "projects/p/locations/global/keyRings/ring/cryptoKeys/mac"
+	material := "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+
+	resp, body := doRequest(t, http.MethodPost, ts.URL+"/admin/import", `{"cryptoKey": "`+key+`", "key": "`+material+`"}`)
+	if resp.StatusCode != http.StatusCreated || body["name"] != key+"/cryptoKeyVersions/2" || body["algorithm"] != "HMAC_SHA256" {
+		t.Fatalf("Expected version 2 to be created, got %d %v", resp.StatusCode, body)
+	}
+	mac, _, err := st.MacSign(key+"/cryptoKeyVersions/2", []byte("data"))
+	if err != nil {
+		t.Fatalf("MacSign failed: %v", err)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(material)
+	want := hmac.New(sha256.New, raw)
+	want.Write([]byte("data"))
+	if !hmac.Equal(mac, want.Sum(nil)) {
+		t.Error("Expected the MAC to use the imported key")
+	}
+
+	tests := []struct {
+		desc, method, body string
+		want               int
+	}{
+		{"missing key", http.MethodPost, `{"cryptoKey": "` + key + `-missing", "key": "` + material + `"}`, http.StatusNotFound},
+		{"wrong size", http.MethodPost, `{"cryptoKey": "` + key + `", "key": "AAEC"}`, http.StatusBadRequest},
+		{"unknown algorithm", http.MethodPost, `{"cryptoKey": "` + key + `", "algorithm": "HMAC_MD5", "key": "` + material + `"}`, http.StatusBadRequest},
+		{"no material", http.MethodPost, `{"cryptoKey": "` + key + `"}`, http.StatusBadRequest},
+		{"GET", http.MethodGet, "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if resp, got := doRequest(t, tt.method, ts.URL+"/admin/import", tt.body); resp.StatusCode != tt.want {
+			t.Errorf("%s: expected %d, got %d %v", tt.desc, tt.want, resp.StatusCode, got)
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	ts, st, _, _ := newTestServer(t)
+	key := "projects/p/locations/global/keyRings/ring/cryptoKeys/key"
+	ciphertext, version, _, err := st.Encrypt(key, []byte("secret"), []byte("aad"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(ciphertext)
+
+	resp, body := doRequest(t, http.MethodPost, ts.URL+"/admin/inspect", `{"ciphertext": "`+encoded+`", "additionalAuthenticatedData": "YWFk"}`)
+	if resp.StatusCode != http.StatusOK || body["cryptoKeyVersion"] != version || body["decrypts"] != true || body["state"] != "ENABLED" {
+		t.Fatalf("Expected %s to be found, got %d %v", version, resp.StatusCode, body)
+	}
+	if _, ok := body["plaintext"]; ok {
+		t.Error("Expected no plaintext in the inspection")
+	}
+
+	resp, body = doRequest(t, http.MethodPost, ts.URL+"/admin/inspect", `{"ciphertext": "`+encoded+`", "cryptoKey": "`+key+`"}`)
+	if resp.StatusCode != http.StatusOK || body["decrypts"] != false || body["reason"] == nil {
+		t.Errorf("Expected a reason without the AAD, got %d %v", resp.StatusCode, body)
+	}
+
+	tests := []struct {
+		desc, method, body string
+		want               int
+	}{
+		{"missing key", http.MethodPost, `{"ciphertext": "` + encoded + `", "cryptoKey": "` + key + `-missing"}`, http.StatusNotFound},
+		{"no ciphertext", http.MethodPost, `{}`, http.StatusBadRequest},
+		{"GET", http.MethodGet, "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if resp, got := doRequest(t, tt.method, ts.URL+"/admin/inspect", tt.body); resp.StatusCode != tt.want {
+			t.Errorf("%s: expected %d, got %d %v", tt.desc, tt.want, resp.StatusCode, got)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	ts, _, _, _ := newTestServer(t)
+
+	resp, err := http.Get(ts.URL + "/admin/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Expected 200 with NDJSON, got %d %s: %s", resp.StatusCode, resp.Header.Get("Content-Type"), data)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[1], `"asset_type":"cloudkms.googleapis.com/CryptoKey"`) {
+		t.Errorf("Expected key ring, key and version assets, got:\n%s", data)
+	}
+
+	resp, err = http.Get(ts.URL + "/admin/export?assetTypes=cloudkms.googleapis.com/KeyRing&parent=projects/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(data) != 0 {
+		t.Errorf("Expected an empty export for another project, got %d %s", resp.StatusCode, data)
+	}
+
+	for _, query := range []string{"contentType=IAM_POLICY", "assetTypes=compute.googleapis.com/Instance", "parent=folders/1"} {
+		if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/admin/export?"+query, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, resp.StatusCode)
+		}
+	}
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/admin/export", ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST, got %d", resp.StatusCode)
+	}
+}
+
+func TestTinkKeyset(t *testing.T) {
+	ts, st, _, _ := newTestServer(t)
+	key := "projects/p/locations/global/keyRings/ring/cryptoKeys/key"
+	url := ts.URL + "/admin/tink/keyset?cryptoKey=" + key
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyset, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(keyset), `"primaryKeyId":1`) || !strings.Contains(string(keyset), "AesGcmKey") {
+		t.Fatalf("Expected an AES-GCM keyset, got %d %s", resp.StatusCode, keyset)
+	}
+
+	// Importing the keyset into another key copies the material
+	if _, err := st.CreateCryptoKey("projects/p/locations/global/keyRings/ring", "copy", kmspb.CryptoKey_ENCRYPT_DECRYPT, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	resp, body := doRequest(t, http.MethodPost, ts.URL+"/admin/tink/keyset?cryptoKey="+key[:strings.LastIndex(key, "/")]+"/copy", string(keyset))
+	versions, _ := body["cryptoKeyVersions"].([]any)
+	if resp.StatusCode != http.StatusCreated || len(versions) != 1 {
+		t.Fatalf("Expected one version to be imported, got %d %v", resp.StatusCode, body)
+	}
+	copyKey, err := st.GetCryptoKey("projects/p/locations/global/keyRings/ring/cryptoKeys/copy")
+	if err != nil || copyKey.Primary.GetName() != versions[0].(map[string]any)["name"] {
+		t.Errorf("Expected the imported version to be primary, got %v: %v", copyKey, err)
+	}
+
+	tests := []struct {
+		desc, method, query, body string
+		want                      int
+	}{
+		{"missing cryptoKey", http.MethodGet, "", "", http.StatusBadRequest},
+		{"unknown key", http.MethodGet, "?cryptoKey=" + key + "-missing", "", http.StatusNotFound},
+		{"invalid keyset", http.MethodPost, "?cryptoKey=" + key, "{}", http.StatusBadRequest},
+		{"DELETE", http.MethodDelete, "?cryptoKey=" + key, "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if resp, got := doRequest(t, tt.method, ts.URL+"/admin/tink/keyset"+tt.query, tt.body); resp.StatusCode != tt.want {
+			t.Errorf("%s: expected %d, got %d %v", tt.desc, tt.want, resp.StatusCode, got)
+		}
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	ts, st, _, _ := newTestServer(t)
+
+	resp, body := doRequest(t, http.MethodPost, ts.URL+"/admin/snapshots/fixture", "")
+	if resp.StatusCode != http.StatusCreated || body["name"] != "fixture" || body["keyRings"] != float64(1) {
+		t.Fatalf("Expected the snapshot to be saved, got %d %v", resp.StatusCode, body)
+	}
+
+	st.Clear()
+	resp, body = doRequest(t, http.MethodPost, ts.URL+"/admin/snapshots/fixture:restore", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %v", resp.StatusCode, body)
+	}
+	if got := st.Stats().KeyRings; got != 1 {
+		t.Errorf("Expected 1 keyring after restore, got %d", got)
+	}
+
+	_, body = doRequest(t, http.MethodGet, ts.URL+"/admin/snapshots", "")
+	if list, _ := body["snapshots"].([]any); len(list) != 1 {
+		t.Errorf("Expected 1 snapshot, got %v", body)
+	}
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/admin/snapshots/fixture", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/admin/snapshots/fixture:restore", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/admin/snapshots/fixture:undo", http.StatusNotFound},
+		{http.MethodPost, "/admin/snapshots/missing:restore", http.StatusNotFound},
+		{http.MethodDelete, "/admin/snapshots/fixture", http.StatusOK},
+		{http.MethodDelete, "/admin/snapshots/fixture", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if resp, body := doRequest(t, tt.method, ts.URL+tt.path, ""); resp.StatusCode != tt.want {
+			t.Errorf("%s %s: expected %d, got %d %v", tt.method, tt.path, tt.want, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestStateDumpOmitsKeyMaterial(t *testing.T) {
+	ts, _, _, _ := newTestServer(t)
+
+	_, dump := doRequest(t, http.MethodGet, ts.URL+"/admin/state", "")
+	raw, _ := json.Marshal(dump)
+	if !strings.Contains(string(raw), "projects/p/locations/global/keyRings/ring/cryptoKeys/key") {
+		t.Errorf("Expected dump to contain the crypto key, got %s", raw)
+	}
+	if strings.Contains(string(raw), "symmetricKey") {
+		t.Errorf("Dump leaked key material: %s", raw)
+	}
+
+	_, full := doRequest(t, http.MethodGet, ts.URL+"/admin/state?include_key_material=true", "")
+	raw, _ = json.Marshal(full)
+	if !strings.Contains(string(raw), "symmetricKey") {
+		t.Errorf("Expected key material when requested, got %s", raw)
+	}
+}
+
+func TestStats(t *testing.T) {
+	ts, st, stats, _ := newTestServer(t)
+	if _, _, _, err := st.Encrypt("projects/p/locations/global/keyRings/ring/cryptoKeys/key", []byte("data"), nil); err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	interceptor := stats.UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/google.cloud.kms.v1.KeyManagementService/Encrypt"}
+	ok := func(context.Context, any) (any, error) { return nil, nil }
+	fail := func(context.Context, any) (any, error) { return nil, status.Error(codes.NotFound, "not found") }
+	_, _ = interceptor(context.Background(), nil, info, ok)
+	_, _ = interceptor(context.Background(), nil, info, fail)
+
+	_, out := doRequest(t, http.MethodGet, ts.URL+"/admin/stats", "")
+
+	resources := out["resources"].(map[string]any)
+	if resources["keyRings"] != float64(1) || resources["cryptoKeys"] != float64(1) {
+		t.Errorf("Unexpected resource counts: %v", resources)
+	}
+
+	encrypt := out["requests"].(map[string]any)["Encrypt"].(map[string]any)
+	if encrypt["calls"] != float64(2) || encrypt["errors"] != float64(1) {
+		t.Errorf("Unexpected Encrypt counters: %v", encrypt)
+	}
+	if codes := encrypt["codes"].(map[string]any); codes["OK"] != float64(1) || codes["NotFound"] != float64(1) {
+		t.Errorf("Unexpected Encrypt codes: %v", codes)
+	}
+
+	usage := out["keyUsage"].([]any)
+	if len(usage) != 1 {
+		t.Fatalf("Expected the usage of one key, got %v", usage)
+	}
+	key := usage[0].(map[string]any)
+	if key["useCount"] != float64(1) || key["lastUseTime"] == nil || len(key["versions"].([]any)) != 1 {
+		t.Errorf("Unexpected key usage: %v", key)
+	}
+}
+
+func TestCost(t *testing.T) {
+	ts, st, _, _ := newTestServer(t)
+	key := "projects/p/locations/global/keyRings/ring/cryptoKeys/key"
+	for range perRecordMinCalls {
+		if _, _, _, err := st.Encrypt(key, []byte("row"), nil); err != nil {
+			t.Fatalf("Encrypt failed: %v", err)
+		}
+	}
+	unused := "projects/p/locations/global/keyRings/ring/cryptoKeys/unused"
+	if _, err := st.CreateCryptoKey("projects/p/locations/global/keyRings/ring", "unused", kmspb.CryptoKey_ENCRYPT_DECRYPT, nil, nil); err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+
+	_, out := doRequest(t, http.MethodGet, ts.URL+"/admin/cost", "")
+
+	operations := out["operations"].([]any)
+	if len(operations) != 1 {
+		t.Fatalf("Expected one operation, got %v", operations)
+	}
+	if op := operations[0].(map[string]any); op["operation"] != "encrypt" || op["priceClass"] != "SOFTWARE" || op["count"] != float64(perRecordMinCalls) || op["cost"] != 0.003 {
+		t.Errorf("Unexpected operation cost: %v", op)
+	}
+	if out["monthlyKeyVersionCost"] != 0.12 {
+		t.Errorf("Expected two active SOFTWARE versions at 0.06, got %v", out["monthlyKeyVersionCost"])
+	}
+	findings := map[string]string{}
+	for _, f := range out["findings"].([]any) {
+		finding := f.(map[string]any)
+		findings[finding["cryptoKey"].(string)] = finding["finding"].(string)
+	}
+	if !strings.Contains(findings[key], "per-record encryption") || !strings.Contains(findings[unused], "never used") {
+		t.Errorf("Unexpected findings: %v", findings)
+	}
+
+	resp, _ := doRequest(t, http.MethodPost, ts.URL+"/admin/cost", "")
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected POST to fail with 405, got %d", resp.StatusCode)
+	}
+}
+
+func TestLoadPricing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pricing.json")
+	if err := os.WriteFile(path, []byte(`{"operationsPer10k":{"HSM":0.05}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pricing, err := LoadPricing(path)
+	if err != nil {
+		t.Fatalf("LoadPricing failed: %v", err)
+	}
+	if pricing.OperationsPer10k["HSM"] != 0.05 || pricing.OperationsPer10k["SOFTWARE"] != DefaultPricing.OperationsPer10k["SOFTWARE"] || pricing.KeyVersionMonthly["HSM"] != DefaultPricing.KeyVersionMonthly["HSM"] {
+		t.Errorf("Expected the file's prices over the defaults, got %+v", pricing)
+	}
+
+	for _, body := range []string{`{"operationsPer10k":{"GOLD":1}}`, `{"keyVersionMonthly":{"HSM":-1}}`, `{`} {
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadPricing(path); err == nil {
+			t.Errorf("Expected %s to be rejected", body)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	ts, _, _, level := newTestServer(t)
+
+	_, out := doRequest(t, http.MethodGet, ts.URL+"/admin/config", "")
+	if out["version"] != "test" || out["logLevel"] != "info" {
+		t.Errorf("Unexpected config: %v", out)
+	}
+
+	resp, out := doRequest(t, http.MethodPatch, ts.URL+"/admin/config", `{"logLevel":"debug"}`)
+	if resp.StatusCode != http.StatusOK || out["logLevel"] != "debug" {
+		t.Errorf("Expected logLevel=debug, got %d %v", resp.StatusCode, out)
+	}
+	if level.Level() != slog.LevelDebug {
+		t.Errorf("Expected level var to change, got %v", level.Level())
+	}
+
+	resp, out = doRequest(t, http.MethodPatch, ts.URL+"/admin/config", `{"chaos":0.05}`)
+	if resp.StatusCode != http.StatusOK || out["chaos"] != 0.05 {
+		t.Errorf("Expected chaos=0.05, got %d %v", resp.StatusCode, out)
+	}
+
+	for _, body := range []string{`{"logLevel":"verbose"}`, `{"chaos":2}`, `{"port":1}`, `not json`} {
+		if resp, _ := doRequest(t, http.MethodPatch, ts.URL+"/admin/config", body); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("PATCH %s: expected 400, got %d", body, resp.StatusCode)
+		}
+	}
+}
+
+func TestFaults(t *testing.T) {
+	ts, _, _, _ := newTestServer(t)
+
+	resp, rule := doRequest(t, http.MethodPost, ts.URL+"/admin/faults", `{"method":"Encrypt","action":"error","code":"INTERNAL"}`)
+	if resp.StatusCode != http.StatusCreated || rule["id"] == "" {
+		t.Fatalf("Expected 201 with rule ID, got %d %v", resp.StatusCode, rule)
+	}
+
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/admin/faults", `{"action":"explode"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid rule, got %d", resp.StatusCode)
+	}
+
+	_, list := doRequest(t, http.MethodGet, ts.URL+"/admin/faults", "")
+	if rules := list["rules"].([]any); len(rules) != 1 {
+		t.Errorf("Expected 1 rule, got %v", rules)
+	}
+
+	id := rule["id"].(string)
+	if resp, _ := doRequest(t, http.MethodDelete, ts.URL+"/admin/faults/"+id, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 deleting rule, got %d", resp.StatusCode)
+	}
+	if resp, _ := doRequest(t, http.MethodDelete, ts.URL+"/admin/faults/"+id, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 deleting missing rule, got %d", resp.StatusCode)
+	}
+}
+
+func TestDecisions(t *testing.T) {
+	ts, _, _, _ := newTestServer(t)
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/admin/authz/decisions", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 without a decision log, got %d", resp.StatusCode)
+	}
+
+	decisions := authz.NewDecisionLog(10)
+	for _, d := range []authz.Decision{
+		{Principal: "user:a@example.com", Permission: "cloudkms.cryptoKeys.encrypt", Outcome: authz.OutcomeAllowed},
+		{Principal: "user:a@example.com", Permission: "cloudkms.cryptoKeys.decrypt", Outcome: authz.OutcomeDenied},
+		{Principal: "user:b@example.com", Permission: "cloudkms.cryptoKeys.decrypt", Outcome: authz.OutcomeDenied},
+	} {
+		decisions.Record(context.Background(), d)
+	}
+	ts = httptest.NewServer(NewServer(storage.NewStorage(), nil, Config{Decisions: decisions}).Handler())
+	defer ts.Close()
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"user:b@example.com", "user:a@example.com", "user:a@example.com"}},
+		{"?limit=1", []string{"user:b@example.com"}},
+		{"?outcome=denied", []string{"user:b@example.com", "user:a@example.com"}},
+		{"?outcome=DENIED&principal=user:a@example.com", []string{"user:a@example.com"}},
+	}
+	for _, tt := range tests {
+		resp, out := doRequest(t, http.MethodGet, ts.URL+"/admin/authz/decisions"+tt.query, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", tt.query, resp.StatusCode)
+		}
+		var got []string
+		for _, d := range out["decisions"].([]any) {
+			got = append(got, d.(map[string]any)["principal"].(string))
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: expected %v, got %v", tt.query, tt.want, got)
+		}
+	}
+
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/admin/authz/decisions?limit=x", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid limit, got %d", resp.StatusCode)
+	}
+	if resp, _ := doRequest(t, http.MethodDelete, ts.URL+"/admin/authz/decisions", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 clearing decisions, got %d", resp.StatusCode)
+	}
+	if len(decisions.Recent(0)) != 0 {
+		t.Error("Expected no decisions after clearing")
+	}
+}
+
+func TestIAMCache(t *testing.T) {
+	cache := authz.NewDecisionCache(time.Minute)
+	cache.Put("user:a@example.com", "projects/p/locations/global/keyRings/r", "cloudkms.keyRings.get", true)
+	cache.Put("user:a@example.com", "projects/q/locations/global/keyRings/r", "cloudkms.keyRings.get", true)
+	cache.Get("user:a@example.com", "projects/p/locations/global/keyRings/r", "cloudkms.keyRings.get")
+	ts := httptest.NewServer(NewServer(storage.NewStorage(), nil, Config{IAMCache: cache}).Handler())
+	defer ts.Close()
+
+	_, stats := doRequest(t, http.MethodGet, ts.URL+"/admin/stats", "")
+	if c, _ := stats["iamCache"].(map[string]any); c["hits"] != 1.0 || c["entries"] != 2.0 {
+		t.Errorf("Expected cache stats in /admin/stats, got %v", stats["iamCache"])
+	}
+	if _, out := doRequest(t, http.MethodDelete, ts.URL+"/admin/authz/cache?resource=projects/p", ""); out["invalidated"] != 1.0 {
+		t.Errorf("Expected 1 invalidated answer, got %v", out)
+	}
+	if _, out := doRequest(t, http.MethodGet, ts.URL+"/admin/authz/cache", ""); out["entries"] != 1.0 {
+		t.Errorf("Expected 1 remaining answer, got %v", out)
+	}
+}
+
+func TestReload(t *testing.T) {
+	ts, _, _, _ := newTestServer(t)
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/admin/config:reload", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 without a config file, got %d", resp.StatusCode)
+	}
+
+	reloadErr := errors.New("invalid config file")
+	reloads := 0
+	srv := NewServer(storage.NewStorage(), nil, Config{Reload: func() error {
+		reloads++
+		return reloadErr
+	}})
+	ts = httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	if resp, out := doRequest(t, http.MethodPost, ts.URL+"/admin/config:reload", ""); resp.StatusCode != http.StatusBadRequest || out["error"] != reloadErr.Error() {
+		t.Errorf("Expected 400 for failed reload, got %d %v", resp.StatusCode, out)
+	}
+	reloadErr = nil
+	if resp, _ := doRequest(t, http.MethodPost, ts.URL+"/admin/config:reload", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200, got %d", resp.StatusCode)
+	}
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/admin/config:reload", ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET, got %d", resp.StatusCode)
+	}
+	if reloads != 2 {
+		t.Errorf("Expected 2 reloads, got %d", reloads)
+	}
+}
+
+func TestDashboardUI(t *testing.T) {
+	ts, _, _, _ := newTestServer(t)
+
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatalf("GET / failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/ui/" {
+		t.Fatalf("GET / ended at %s with %d, expected the dashboard", resp.Request.URL.Path, resp.StatusCode)
+	}
+	if !strings.Contains(resp.Header.Get("Content-Type"), "text/html") || !strings.Contains(string(body), "/admin/dashboard/") {
+		t.Errorf("Expected the dashboard page, got %s", resp.Header.Get("Content-Type"))
+	}
+
+	if resp, _ := doRequest(t, http.MethodGet, ts.URL+"/nope", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /nope: expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestDashboardActions(t *testing.T) {
+	ts, st, _, _ := newTestServer(t)
+	key := "projects/p/locations/global/keyRings/ring/cryptoKeys/key"
+	action := func(name, body string) (*http.Response, map[string]any) {
+		return doRequest(t, http.MethodPost, ts.URL+"/admin/dashboard/"+name, body)
+	}
+
+	resp, body := action("rotate", `{"name": "`+key+`"}`)
+	if resp.StatusCode != http.StatusOK || body["name"] != key+"/cryptoKeyVersions/2" {
+		t.Fatalf("rotate: %d %v", resp.StatusCode, body)
+	}
+	if ck, _ := st.GetCryptoKey(key); ck.Primary.GetName() != key+"/cryptoKeyVersions/2" {
+		t.Errorf("Expected rotate to make version 2 primary, got %s", ck.Primary.GetName())
+	}
+
+	version := `{"name": "` + key + `/cryptoKeyVersions/1"}`
+	for _, step := range []struct{ action, state string }{
+		{"disable", "DISABLED"},
+		{"enable", "ENABLED"},
+		{"destroy", "DESTROY_SCHEDULED"},
+		{"restore", "DISABLED"},
+	} {
+		if resp, body := action(step.action, version); resp.StatusCode != http.StatusOK || body["state"] != step.state {
+			t.Errorf("%s: %d %v, expected %s", step.action, resp.StatusCode, body, step.state)
+		}
+	}
+
+	resp, body = action("encrypt", `{"name": "`+key+`", "plaintext": "hello"}`)
+	if resp.StatusCode != http.StatusOK || body["name"] != key+"/cryptoKeyVersions/2" {
+		t.Fatalf("encrypt: %d %v", resp.StatusCode, body)
+	}
+	resp, body = action("decrypt", `{"name": "`+key+`", "ciphertext": "`+body["ciphertext"].(string)+`"}`)
+	if resp.StatusCode != http.StatusOK || body["plaintext"] != "hello" {
+		t.Errorf("decrypt: %d %v", resp.StatusCode, body)
+	}
+
+	tests := []struct {
+		desc, method, action, body string
+		want                       int
+	}{
+		{"unknown action", http.MethodPost, "explode", `{"name": "` + key + `"}`, http.StatusNotFound},
+		{"no name", http.MethodPost, "rotate", `{}`, http.StatusBadRequest},
+		{"missing key", http.MethodPost, "rotate", `{"name": "` + key + `-missing"}`, http.StatusNotFound},
+		{"already enabled", http.MethodPost, "restore", `{"name": "` + key + `/cryptoKeyVersions/2"}`, http.StatusBadRequest},
+		{"GET", http.MethodGet, "rotate", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if resp, got := doRequest(t, tt.method, ts.URL+"/admin/dashboard/"+tt.action, tt.body); resp.StatusCode != tt.want {
+			t.Errorf("%s: expected %d, got %d %v", tt.desc, tt.want, resp.StatusCode, got)
+		}
+	}
+}
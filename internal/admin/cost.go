@@ -0,0 +1,234 @@
+package admin
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+// GET /admin/cost tallies the operations counted by usage tracking by
+// operation and price class and estimates what Cloud KMS would have charged
+// for them and for the active key versions, to show what the emulator saved
+// and to point out call patterns that would be expensive in production.
+
+// Pricing is the Cloud KMS price list the cost report uses, in USD, by
+// price class: SOFTWARE, HSM (symmetric and MAC), HSM_ASYMMETRIC and
+// EXTERNAL
+type Pricing struct {
+	// OperationsPer10k is the price of 10,000 cryptographic operations
+	OperationsPer10k map[string]float64 `json:"operationsPer10k"`
+	// KeyVersionMonthly is the monthly price of an active key version
+	KeyVersionMonthly map[string]float64 `json:"keyVersionMonthly"`
+}
+
+// DefaultPricing is the Cloud KMS list price in USD at the time of writing.
+// Prices change; pass a file to LoadPricing (--pricing-file) to use current
+// or negotiated ones.
+var DefaultPricing = Pricing{
+	OperationsPer10k: map[string]float64{
+		"SOFTWARE":       0.03,
+		"HSM":            0.03,
+		"HSM_ASYMMETRIC": 0.15,
+		"EXTERNAL":       0.03,
+	},
+	KeyVersionMonthly: map[string]float64{
+		"SOFTWARE":       0.06,
+		"HSM":            1.00,
+		"HSM_ASYMMETRIC": 2.50,
+		"EXTERNAL":       3.00,
+	},
+}
+
+// LoadPricing reads a JSON Pricing file. Price classes it leaves out keep
+// their DefaultPricing prices.
+func LoadPricing(path string) (*Pricing, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file Pricing
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid pricing file %s: %w", path, err)
+	}
+	pricing := Pricing{OperationsPer10k: map[string]float64{}, KeyVersionMonthly: map[string]float64{}}
+	for _, prices := range []struct{ dst, def, file map[string]float64 }{
+		{pricing.OperationsPer10k, DefaultPricing.OperationsPer10k, file.OperationsPer10k},
+		{pricing.KeyVersionMonthly, DefaultPricing.KeyVersionMonthly, file.KeyVersionMonthly},
+	} {
+		for class, price := range prices.def {
+			prices.dst[class] = price
+		}
+		for class, price := range prices.file {
+			if _, ok := prices.def[class]; !ok {
+				return nil, fmt.Errorf("invalid pricing file %s: unknown price class %q", path, class)
+			}
+			if price < 0 {
+				return nil, fmt.Errorf("invalid pricing file %s: negative price for %s", path, class)
+			}
+			prices.dst[class] = price
+		}
+	}
+	return &pricing, nil
+}
+
+// Thresholds of the per-record encryption finding: keys with at least
+// perRecordMinCalls Encrypt and Decrypt calls averaging under
+// perRecordMaxBytes of plaintext
+const (
+	perRecordMinCalls = 1000
+	perRecordMaxBytes = 1024
+)
+
+// topKeys is how many of the most expensive keys the report lists
+const topKeys = 10
+
+type costReport struct {
+	Currency   string          `json:"currency"`
+	Operations []operationCost `json:"operations"`
+	// OperationsCost is for the operations counted since startup or the
+	// last reset
+	OperationsCost float64 `json:"operationsCost"`
+	// ProjectedMonthlyOperationsCost extrapolates OperationsCost to 30 days
+	// of uptime at the same rate
+	ProjectedMonthlyOperationsCost float64          `json:"projectedMonthlyOperationsCost,omitempty"`
+	UptimeSeconds                  int64            `json:"uptimeSeconds,omitempty"`
+	KeyVersions                    []keyVersionCost `json:"keyVersions"`
+	MonthlyKeyVersionCost          float64          `json:"monthlyKeyVersionCost"`
+	TopKeys                        []keyCost        `json:"topKeys"`
+	Findings                       []costFinding    `json:"findings,omitempty"`
+	Pricing                        Pricing          `json:"pricing"`
+}
+
+type operationCost struct {
+	Operation  string  `json:"operation"`
+	PriceClass string  `json:"priceClass"`
+	Count      int64   `json:"count"`
+	Cost       float64 `json:"cost"`
+}
+
+type keyVersionCost struct {
+	PriceClass  string  `json:"priceClass"`
+	Active      int     `json:"active"`
+	MonthlyCost float64 `json:"monthlyCost"`
+}
+
+type keyCost struct {
+	Name       string  `json:"name"`
+	Operations int64   `json:"operations"`
+	Cost       float64 `json:"cost"`
+}
+
+type costFinding struct {
+	CryptoKey string `json:"cryptoKey"`
+	Finding   string `json:"finding"`
+}
+
+func (s *Server) handleCost(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	pricing := DefaultPricing
+	if s.config.Pricing != nil {
+		pricing = *s.config.Pricing
+	}
+	var uptime float64
+	if s.stats != nil {
+		uptime = s.stats.Uptime().Seconds()
+	}
+	writeJSON(w, http.StatusOK, estimateCost(s.storage.UsageReport(), pricing, uptime))
+}
+
+// estimateCost prices a usage report
+func estimateCost(usage []storage.KeyUsage, pricing Pricing, uptimeSeconds float64) costReport {
+	report := costReport{Currency: "USD", Pricing: pricing, Operations: []operationCost{}, KeyVersions: []keyVersionCost{}, TopKeys: []keyCost{}}
+	operations := map[[2]string]int64{}
+	active := map[string]int{}
+
+	for _, key := range usage {
+		var keyOps int64
+		var keyOpsCost, keyMonthly float64
+		var keyActive int
+		for _, version := range key.Versions {
+			class := priceClass(key.Purpose, version.ProtectionLevel)
+			for op, count := range version.Operations {
+				operations[[2]string{op, class}] += count
+				keyOps += count
+				keyOpsCost += float64(count) / 10000 * pricing.OperationsPer10k[class]
+			}
+			if version.State == "ENABLED" || version.State == "DISABLED" {
+				active[class]++
+				keyActive++
+				keyMonthly += pricing.KeyVersionMonthly[class]
+			}
+		}
+		if keyOps > 0 {
+			report.TopKeys = append(report.TopKeys, keyCost{Name: key.Name, Operations: keyOps, Cost: roundCost(keyOpsCost)})
+		}
+
+		switch calls := key.Operations["encrypt"] + key.Operations["decrypt"]; {
+		case calls >= perRecordMinCalls && key.Bytes/calls < perRecordMaxBytes:
+			report.Findings = append(report.Findings, costFinding{CryptoKey: key.Name, Finding: fmt.Sprintf(
+				"%d Encrypt and Decrypt calls averaging %d bytes look like per-record encryption; envelope encryption (one call per data encryption key) would need far fewer", calls, key.Bytes/calls)})
+		case key.UseCount == 0 && keyActive > 0:
+			report.Findings = append(report.Findings, costFinding{CryptoKey: key.Name, Finding: fmt.Sprintf(
+				"never used, but its %d active versions would cost %.2f USD a month", keyActive, keyMonthly)})
+		}
+	}
+
+	for op, count := range operations {
+		cost := float64(count) / 10000 * pricing.OperationsPer10k[op[1]]
+		report.Operations = append(report.Operations, operationCost{Operation: op[0], PriceClass: op[1], Count: count, Cost: roundCost(cost)})
+		report.OperationsCost += cost
+	}
+	slices.SortFunc(report.Operations, func(a, b operationCost) int {
+		return cmp.Or(cmp.Compare(a.Operation, b.Operation), cmp.Compare(a.PriceClass, b.PriceClass))
+	})
+	for class, n := range active {
+		cost := float64(n) * pricing.KeyVersionMonthly[class]
+		report.KeyVersions = append(report.KeyVersions, keyVersionCost{PriceClass: class, Active: n, MonthlyCost: roundCost(cost)})
+		report.MonthlyKeyVersionCost += cost
+	}
+	slices.SortFunc(report.KeyVersions, func(a, b keyVersionCost) int { return cmp.Compare(a.PriceClass, b.PriceClass) })
+	slices.SortFunc(report.TopKeys, func(a, b keyCost) int {
+		return cmp.Or(cmp.Compare(b.Cost, a.Cost), cmp.Compare(b.Operations, a.Operations), cmp.Compare(a.Name, b.Name))
+	})
+	if len(report.TopKeys) > topKeys {
+		report.TopKeys = report.TopKeys[:topKeys]
+	}
+
+	if uptimeSeconds > 0 {
+		report.UptimeSeconds = int64(uptimeSeconds)
+		report.ProjectedMonthlyOperationsCost = roundCost(report.OperationsCost / uptimeSeconds * 30 * 24 * 3600)
+	}
+	report.OperationsCost = roundCost(report.OperationsCost)
+	report.MonthlyKeyVersionCost = roundCost(report.MonthlyKeyVersionCost)
+	return report
+}
+
+// priceClass is the Pricing class of a version
+func priceClass(purpose, protectionLevel string) string {
+	switch protectionLevel {
+	case "HSM":
+		if purpose == "ASYMMETRIC_SIGN" || purpose == "ASYMMETRIC_DECRYPT" {
+			return "HSM_ASYMMETRIC"
+		}
+		return "HSM"
+	case "EXTERNAL", "EXTERNAL_VPC":
+		return "EXTERNAL"
+	default:
+		return "SOFTWARE"
+	}
+}
+
+// roundCost rounds to a millionth of a dollar, so sums of many tiny
+// operation prices stay readable
+func roundCost(cost float64) float64 {
+	return math.Round(cost*1e6) / 1e6
+}
@@ -0,0 +1,133 @@
+package admin
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+// The dashboard at /ui/ is a single page listing the keyrings, keys and
+// versions of GET /admin/state, with buttons for POST /admin/dashboard/*
+// and an encrypt/decrypt scratchpad. It needs nothing but the admin port.
+
+//go:embed ui/index.html
+var uiFiles embed.FS
+
+// dashboardRequest is the body of POST /admin/dashboard/{action}. Name is a
+// crypto key, or a version for enable, disable, destroy and restore.
+// Plaintext is text, so the scratchpad can show it as typed.
+type dashboardRequest struct {
+	Name       string `json:"name"`
+	Plaintext  string `json:"plaintext,omitempty"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+}
+
+func (s *Server) handleUI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	if r.URL.Path != "/ui/" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	http.ServeFileFS(w, r, uiFiles, "ui/index.html")
+}
+
+func (s *Server) handleDashboardAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var req dashboardRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid dashboard request: %v", err))
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	action := strings.TrimPrefix(r.URL.Path, "/admin/dashboard/")
+	var result any
+	var err error
+	switch action {
+	case "enable":
+		result, err = s.storage.UpdateCryptoKeyVersion(req.Name, kmspb.CryptoKeyVersion_ENABLED, "")
+	case "disable":
+		result, err = s.storage.UpdateCryptoKeyVersion(req.Name, kmspb.CryptoKeyVersion_DISABLED, "")
+	case "destroy":
+		result, err = s.storage.DestroyCryptoKeyVersion(req.Name)
+	case "restore":
+		result, err = s.storage.RestoreCryptoKeyVersion(req.Name)
+	case "rotate":
+		result, err = s.rotate(req.Name)
+	case "encrypt":
+		var ciphertext []byte
+		var version string
+		ciphertext, version, _, err = s.storage.Encrypt(req.Name, []byte(req.Plaintext), nil)
+		result = map[string]any{"name": version, "ciphertext": ciphertext}
+	case "decrypt":
+		var plaintext []byte
+		plaintext, _, _, err = s.storage.Decrypt(req.Name, req.Ciphertext, nil)
+		result = map[string]any{"plaintext": string(plaintext)}
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown dashboard action %q", action))
+		return
+	}
+	if err != nil {
+		code := http.StatusBadRequest
+		if strings.Contains(err.Error(), "not found") {
+			code = http.StatusNotFound
+		}
+		writeError(w, code, err.Error())
+		return
+	}
+
+	if action != "encrypt" && action != "decrypt" {
+		slog.Info("Dashboard action", "action", action, "name", req.Name)
+	}
+	if m, ok := result.(proto.Message); ok {
+		data, err := protojson.Marshal(m)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		result = json.RawMessage(data)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// rotate creates a version of a crypto key and, for keys with a primary
+// version, makes it primary, as a scheduled rotation would. It returns the
+// new version.
+func (s *Server) rotate(keyName string) (*kmspb.CryptoKeyVersion, error) {
+	version, err := s.storage.CreateCryptoKeyVersion(keyName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.storage.GetCryptoKey(keyName)
+	if err != nil {
+		return nil, err
+	}
+	if !storage.HasPrimaryVersion(key.Purpose) || version.State != kmspb.CryptoKeyVersion_ENABLED {
+		return version, nil
+	}
+	if _, err := s.storage.UpdateCryptoKeyPrimaryVersion(keyName, version.Name); err != nil {
+		return nil, err
+	}
+	return version, nil
+}
@@ -0,0 +1,74 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// GRPCServiceName is the gRPC service serving admin calls
+const GRPCServiceName = "gcpkmsemulator.v1.Admin"
+
+// ResetMethod is the gRPC method behind POST /admin/reset. It is served on
+// the admin port, never the KMS port. Its request and response are
+// google.protobuf.Struct values shaped like the HTTP query (project or
+// keyRing) and JSON response:
+//
+//	conn, _ := grpc.NewClient("localhost:9091", grpc.WithTransportCredentials(insecure.NewCredentials()))
+//	req, _ := structpb.NewStruct(map[string]any{"project": "my-project"})
+//	var resp structpb.Struct
+//	err := conn.Invoke(ctx, admin.ResetMethod, req, &resp)
+const ResetMethod = "/" + GRPCServiceName + "/Reset"
+
+// newGRPCServer returns the gRPC server behind the admin port. It has no
+// interceptors, so resetting between tests is never failed by fault
+// injection or chaos, nor counted in call stats.
+func (s *Server) newGRPCServer() *grpc.Server {
+	g := grpc.NewServer()
+	g.RegisterService(&grpc.ServiceDesc{
+		ServiceName: GRPCServiceName,
+		HandlerType: (*any)(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Reset",
+			Handler:    s.handleGRPCReset,
+		}},
+	}, s)
+	return g
+}
+
+// withGRPC sends gRPC requests (HTTP/2 with a gRPC content type) to g and
+// everything else to h, so one listener serves both
+func withGRPC(g *grpc.Server, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			g.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// protocols accepts HTTP/1 and, for gRPC clients, unencrypted HTTP/2
+func protocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetUnencryptedHTTP2(true)
+	return p
+}
+
+func (s *Server) handleGRPCReset(_ any, _ context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+	req := new(structpb.Struct)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	resp, err := s.reset(req.GetFields()["project"].GetStringValue(), req.GetFields()["keyRing"].GetStringValue())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return structpb.NewStruct(resp)
+}
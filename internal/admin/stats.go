@@ -0,0 +1,87 @@
+package admin
+
+import (
+	"context"
+	"path"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Stats counts gRPC calls handled by the emulator
+type Stats struct {
+	start time.Time
+
+	mu      sync.Mutex
+	methods map[string]*MethodStats
+}
+
+// MethodStats holds call counters for a single RPC method
+type MethodStats struct {
+	Calls  int64            `json:"calls"`
+	Errors int64            `json:"errors"`
+	Codes  map[string]int64 `json:"codes"`
+}
+
+// NewStats creates an empty call counter
+func NewStats() *Stats {
+	return &Stats{
+		start:   time.Now(),
+		methods: make(map[string]*MethodStats),
+	}
+}
+
+// UnaryServerInterceptor records the method and status code of every call
+func (s *Stats) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		resp, err := handler(ctx, req)
+		s.record(path.Base(info.FullMethod), status.Code(err).String(), err != nil)
+		return resp, err
+	}
+}
+
+func (s *Stats) record(method, code string, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.methods[method]
+	if !ok {
+		m = &MethodStats{Codes: make(map[string]int64)}
+		s.methods[method] = m
+	}
+	m.Calls++
+	m.Codes[code]++
+	if failed {
+		m.Errors++
+	}
+}
+
+// Snapshot returns a copy of the per-method counters
+func (s *Stats) Snapshot() map[string]MethodStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make(map[string]MethodStats, len(s.methods))
+	for name, m := range s.methods {
+		codes := make(map[string]int64, len(m.Codes))
+		for code, n := range m.Codes {
+			codes[code] = n
+		}
+		out[name] = MethodStats{Calls: m.Calls, Errors: m.Errors, Codes: codes}
+	}
+	return out
+}
+
+// Uptime returns how long the counters have been running
+func (s *Stats) Uptime() time.Duration {
+	return time.Since(s.start)
+}
+
+// Reset clears all call counters
+func (s *Stats) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.methods = make(map[string]*MethodStats)
+}
@@ -0,0 +1,181 @@
+// Package assetinventory formats the emulator's resources as a Cloud Asset
+// Inventory export, so pipelines that ingest exportAssets output can be
+// tested against emulated KMS resources.
+//
+// Each resource becomes one asset of content type RESOURCE, written one per
+// line as exportAssets writes them to Cloud Storage:
+//
+//	{"name":"//cloudkms.googleapis.com/projects/p/locations/global/keyRings/r",
+//	 "asset_type":"cloudkms.googleapis.com/KeyRing",
+//	 "resource":{"version":"v1","discovery_name":"KeyRing","data":{...},...},
+//	 "ancestors":["projects/p"],"update_time":"..."}
+//
+// resource.data is the REST representation of the resource. The emulator
+// has no project numbers, so ancestors and key ring parents name projects by
+// ID. The emulator keeps no update times either: update_time is the latest
+// event the resource records, such as a version's import or destruction.
+package assetinventory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+// Asset types of the KMS resources the emulator holds
+const (
+	KeyRingType          = "cloudkms.googleapis.com/KeyRing"
+	CryptoKeyType        = "cloudkms.googleapis.com/CryptoKey"
+	CryptoKeyVersionType = "cloudkms.googleapis.com/CryptoKeyVersion"
+	ImportJobType        = "cloudkms.googleapis.com/ImportJob"
+)
+
+// AssetTypes lists the asset types in the order Assets returns them
+var AssetTypes = []string{KeyRingType, CryptoKeyType, CryptoKeyVersionType, ImportJobType}
+
+const (
+	serviceName          = "//cloudkms.googleapis.com/"
+	projectParent        = "//cloudresourcemanager.googleapis.com/"
+	discoveryDocumentURI = "https://cloudkms.googleapis.com/$discovery/rest"
+)
+
+// Asset is one asset of an export
+type Asset struct {
+	Name       string   `json:"name"`
+	AssetType  string   `json:"asset_type"`
+	Resource   Resource `json:"resource"`
+	Ancestors  []string `json:"ancestors"`
+	UpdateTime string   `json:"update_time"`
+}
+
+// Resource is the RESOURCE content of an asset
+type Resource struct {
+	Version              string          `json:"version"`
+	DiscoveryDocumentURI string          `json:"discovery_document_uri"`
+	DiscoveryName        string          `json:"discovery_name"`
+	Parent               string          `json:"parent"`
+	Data                 json.RawMessage `json:"data"`
+	Location             string          `json:"location"`
+}
+
+// Options narrows an export
+type Options struct {
+	// AssetTypes limits the export to these types; empty exports all
+	AssetTypes []string
+	// Parent limits the export to one project ("projects/p"); empty exports
+	// every project
+	Parent string
+}
+
+// Assets returns the assets of the inventory selected by opts, grouped by
+// type in AssetTypes order and ordered by name within each type
+func Assets(inv storage.Inventory, opts Options) ([]Asset, error) {
+	for _, assetType := range opts.AssetTypes {
+		if !slices.Contains(AssetTypes, assetType) {
+			return nil, fmt.Errorf("unsupported asset type %q; expected one of %s", assetType, strings.Join(AssetTypes, ", "))
+		}
+	}
+	if opts.Parent != "" && (!strings.HasPrefix(opts.Parent, "projects/") || strings.Count(opts.Parent, "/") != 1) {
+		return nil, fmt.Errorf("invalid parent %q; expected projects/{project}", opts.Parent)
+	}
+	wanted := func(assetType string) bool {
+		return len(opts.AssetTypes) == 0 || slices.Contains(opts.AssetTypes, assetType)
+	}
+
+	var assets []Asset
+	add := func(assetType, discoveryName, name string, msg proto.Message, times ...*timestamppb.Timestamp) error {
+		if !wanted(assetType) || (opts.Parent != "" && !strings.HasPrefix(name, opts.Parent+"/")) {
+			return nil
+		}
+		asset, err := newAsset(assetType, discoveryName, name, msg, times)
+		if err != nil {
+			return err
+		}
+		assets = append(assets, asset)
+		return nil
+	}
+
+	for _, kr := range inv.KeyRings {
+		if err := add(KeyRingType, "KeyRing", kr.Name, kr, kr.CreateTime); err != nil {
+			return nil, err
+		}
+	}
+	for _, ck := range inv.CryptoKeys {
+		if err := add(CryptoKeyType, "CryptoKey", ck.Name, ck, ck.CreateTime); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range inv.CryptoKeyVersions {
+		if err := add(CryptoKeyVersionType, "CryptoKeyVersion", v.Name, v, v.CreateTime, v.ImportTime, v.DestroyEventTime); err != nil {
+			return nil, err
+		}
+	}
+	for _, job := range inv.ImportJobs {
+		if err := add(ImportJobType, "ImportJob", job.Name, job, job.CreateTime, job.ExpireEventTime); err != nil {
+			return nil, err
+		}
+	}
+	return assets, nil
+}
+
+// newAsset builds the asset of one resource. Its parent is the resource one
+// level up, or the project for key rings.
+func newAsset(assetType, discoveryName, name string, msg proto.Message, times []*timestamppb.Timestamp) (Asset, error) {
+	data, err := protojson.Marshal(msg)
+	if err != nil {
+		return Asset{}, fmt.Errorf("failed to encode %s: %w", name, err)
+	}
+
+	segments := strings.Split(name, "/")
+	if len(segments) < 6 {
+		return Asset{}, fmt.Errorf("invalid resource name %q", name)
+	}
+	project := strings.Join(segments[:2], "/")
+	parent := projectParent + project
+	if assetType != KeyRingType {
+		parent = serviceName + strings.Join(segments[:len(segments)-2], "/")
+	}
+
+	var updated time.Time
+	for _, t := range times {
+		if t != nil && t.AsTime().After(updated) {
+			updated = t.AsTime()
+		}
+	}
+
+	return Asset{
+		Name:      serviceName + name,
+		AssetType: assetType,
+		Resource: Resource{
+			Version:              "v1",
+			DiscoveryDocumentURI: discoveryDocumentURI,
+			DiscoveryName:        discoveryName,
+			Parent:               parent,
+			Data:                 data,
+			Location:             segments[3],
+		},
+		Ancestors:  []string{project},
+		UpdateTime: updated.UTC().Format(time.RFC3339Nano),
+	}, nil
+}
+
+// Write writes assets as newline-delimited JSON, the format of exports to
+// Cloud Storage and of BigQuery loads from them
+func Write(w io.Writer, assets []Asset) error {
+	enc := json.NewEncoder(w)
+	for _, asset := range assets {
+		if err := enc.Encode(asset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
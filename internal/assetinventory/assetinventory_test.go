@@ -0,0 +1,131 @@
+package assetinventory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+func newInventory(t *testing.T) storage.Inventory {
+	t.Helper()
+	s := storage.NewStorage()
+	for _, ring := range []string{"projects/p/locations/us-east1/keyRings/r", "projects/q/locations/global/keyRings/r"} {
+		if _, err := s.CreateKeyRing(ring); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.CreateCryptoKey("projects/p/locations/us-east1/keyRings/r", "k", kmspb.CryptoKey_ENCRYPT_DECRYPT, nil, map[string]string{"env": "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DestroyCryptoKeyVersion("projects/p/locations/us-east1/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateImportJob("projects/p/locations/us-east1/keyRings/r", "j", kmspb.ImportJob_RSA_OAEP_3072_SHA256, kmspb.ProtectionLevel_SOFTWARE); err != nil {
+		t.Fatal(err)
+	}
+	inv, err := s.Inventory()
+	if err != nil {
+		t.Fatalf("Inventory failed: %v", err)
+	}
+	return inv
+}
+
+func TestAssets(t *testing.T) {
+	assets, err := Assets(newInventory(t), Options{})
+	if err != nil {
+		t.Fatalf("Assets failed: %v", err)
+	}
+
+	var got []string
+	for _, a := range assets {
+		got = append(got, a.AssetType+" "+a.Name)
+	}
+	want := []string{
+		KeyRingType + " //cloudkms.googleapis.com/projects/p/locations/us-east1/keyRings/r",
+		KeyRingType + " //cloudkms.googleapis.com/projects/q/locations/global/keyRings/r",
+		CryptoKeyType + " //cloudkms.googleapis.com/projects/p/locations/us-east1/keyRings/r/cryptoKeys/k",
+		CryptoKeyVersionType + " //cloudkms.googleapis.com/projects/p/locations/us-east1/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1",
+		ImportJobType + " //cloudkms.googleapis.com/projects/p/locations/us-east1/keyRings/r/importJobs/j",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("Unexpected assets:\n%s", strings.Join(got, "\n"))
+	}
+
+	ring, key, version := assets[0], assets[2], assets[3]
+	if ring.Resource.Parent != "//cloudresourcemanager.googleapis.com/projects/p" || ring.Resource.Location != "us-east1" || ring.Ancestors[0] != "projects/p" {
+		t.Errorf("Unexpected key ring asset: %+v", ring)
+	}
+	if key.Resource.Parent != "//cloudkms.googleapis.com/projects/p/locations/us-east1/keyRings/r" || key.Resource.DiscoveryName != "CryptoKey" {
+		t.Errorf("Unexpected key asset: %+v", key)
+	}
+	var data map[string]any
+	if err := json.Unmarshal(key.Resource.Data, &data); err != nil || data["purpose"] != "ENCRYPT_DECRYPT" || data["labels"].(map[string]any)["env"] != "test" {
+		t.Errorf("Expected the REST representation of the key, got %s: %v", key.Resource.Data, err)
+	}
+
+	// A destroyed version was last updated when it was scheduled for
+	// destruction, after it was created
+	if err := json.Unmarshal(version.Resource.Data, &data); err != nil || data["state"] != "DESTROY_SCHEDULED" {
+		t.Errorf("Expected a version scheduled for destruction, got %s: %v", version.Resource.Data, err)
+	}
+	if version.UpdateTime < data["createTime"].(string) {
+		t.Errorf("Expected update_time %s after createTime %s", version.UpdateTime, data["createTime"])
+	}
+}
+
+func TestAssetsOptions(t *testing.T) {
+	inv := newInventory(t)
+
+	assets, err := Assets(inv, Options{AssetTypes: []string{KeyRingType}, Parent: "projects/q"})
+	if err != nil {
+		t.Fatalf("Assets failed: %v", err)
+	}
+	if len(assets) != 1 || assets[0].Name != "//cloudkms.googleapis.com/projects/q/locations/global/keyRings/r" {
+		t.Errorf("Expected project q's key ring only, got %+v", assets)
+	}
+
+	for _, opts := range []Options{
+		{AssetTypes: []string{"cloudkms.googleapis.com/EkmConnection"}},
+		{Parent: "projects/p/locations/global"},
+		{Parent: "folders/1"},
+	} {
+		if _, err := Assets(inv, opts); err == nil {
+			t.Errorf("Expected an error for %+v", opts)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	assets, err := Assets(newInventory(t), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, assets); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	lines := 0
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var asset map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &asset); err != nil {
+			t.Fatalf("Line %d is not JSON: %v", lines+1, err)
+		}
+		for _, field := range []string{"name", "asset_type", "resource", "ancestors", "update_time"} {
+			if _, ok := asset[field]; !ok {
+				t.Errorf("Line %d has no %s", lines+1, field)
+			}
+		}
+		lines++
+	}
+	if lines != len(assets) {
+		t.Errorf("Expected %d lines, got %d", len(assets), lines)
+	}
+}
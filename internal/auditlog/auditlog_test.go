@@ -0,0 +1,180 @@
+package auditlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/principal"
+)
+
+const keyName = "projects/p/locations/global/keyRings/ring/cryptoKeys/key"
+
+// payload mirrors the AuditLog fields the tests inspect
+type payload struct {
+	Type         string `json:"@type"`
+	ServiceName  string `json:"serviceName"`
+	MethodName   string `json:"methodName"`
+	ResourceName string `json:"resourceName"`
+	Status       struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+	AuthenticationInfo struct {
+		PrincipalEmail               string `json:"principalEmail"`
+		ServiceAccountDelegationInfo []struct {
+			FirstPartyPrincipal struct {
+				PrincipalEmail string `json:"principalEmail"`
+			} `json:"firstPartyPrincipal"`
+		} `json:"serviceAccountDelegationInfo"`
+	} `json:"authenticationInfo"`
+	AuthorizationInfo []struct {
+		Resource   string `json:"resource"`
+		Permission string `json:"permission"`
+		Granted    bool   `json:"granted"`
+	} `json:"authorizationInfo"`
+	RequestMetadata struct {
+		CallerIP                string `json:"callerIp"`
+		CallerSuppliedUserAgent string `json:"callerSuppliedUserAgent"`
+	} `json:"requestMetadata"`
+	Request map[string]any `json:"request"`
+}
+
+func record(t *testing.T, ctx context.Context, method string, req, resp any, callErr error) (Entry, payload) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	l := New(&buf)
+	l.now = func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/google.cloud.kms.v1.KeyManagementService/" + method}
+	_, _ = l.UnaryServerInterceptor()(ctx, req, info, func(context.Context, any) (any, error) {
+		return resp, callErr
+	})
+
+	var entry Entry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Invalid audit entry %q: %v", buf.String(), err)
+	}
+	var p payload
+	if err := json.Unmarshal(entry.ProtoPayload, &p); err != nil {
+		t.Fatalf("Invalid protoPayload: %v", err)
+	}
+	return entry, p
+}
+
+func TestDataAccessEntry(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"x-emulator-principal", "user:ci@example.com",
+		"user-agent", "test-client/1.0",
+	))
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 7), Port: 5555}})
+
+	req := &kmspb.EncryptRequest{Name: keyName, Plaintext: []byte("secret")}
+	entry, p := record(t, ctx, "Encrypt", req, &kmspb.EncryptResponse{Name: keyName + "/cryptoKeyVersions/1"}, nil)
+
+	if entry.LogName != "projects/p/logs/cloudaudit.googleapis.com%2Fdata_access" || entry.Severity != "INFO" {
+		t.Errorf("Unexpected log name or severity: %s %s", entry.LogName, entry.Severity)
+	}
+	if entry.Timestamp != "2026-01-02T03:04:05Z" || entry.InsertID == "" {
+		t.Errorf("Unexpected timestamp or insertId: %s %q", entry.Timestamp, entry.InsertID)
+	}
+	if entry.Resource.Type != "cloudkms_cryptokey" || entry.Resource.Labels["key_ring_id"] != "ring" || entry.Resource.Labels["crypto_key_id"] != "key" {
+		t.Errorf("Unexpected monitored resource: %+v", entry.Resource)
+	}
+	if p.Type != "type.googleapis.com/google.cloud.audit.AuditLog" || p.ServiceName != ServiceName || p.MethodName != "Encrypt" || p.ResourceName != keyName {
+		t.Errorf("Unexpected payload: %+v", p)
+	}
+	if p.AuthenticationInfo.PrincipalEmail != "ci@example.com" {
+		t.Errorf("Expected principal ci@example.com, got %q", p.AuthenticationInfo.PrincipalEmail)
+	}
+	if len(p.AuthorizationInfo) != 1 || p.AuthorizationInfo[0].Permission != "cloudkms.cryptoKeys.encrypt" || !p.AuthorizationInfo[0].Granted {
+		t.Errorf("Unexpected authorization info: %+v", p.AuthorizationInfo)
+	}
+	if p.RequestMetadata.CallerIP != "10.0.0.7" || p.RequestMetadata.CallerSuppliedUserAgent != "test-client/1.0" {
+		t.Errorf("Unexpected request metadata: %+v", p.RequestMetadata)
+	}
+	if p.Request["@type"] != "type.googleapis.com/google.cloud.kms.v1.EncryptRequest" || p.Request["name"] != keyName {
+		t.Errorf("Unexpected request: %v", p.Request)
+	}
+	if !strings.Contains(string(entry.ProtoPayload), `"status":{}`) {
+		t.Errorf("Expected an empty status on success, got %s", entry.ProtoPayload)
+	}
+	if _, ok := p.Request["plaintext"]; ok || strings.Contains(string(entry.ProtoPayload), "c2VjcmV0") {
+		t.Error("Audit entry must not contain plaintext")
+	}
+}
+
+func TestActivityEntry(t *testing.T) {
+	req := &kmspb.CreateCryptoKeyRequest{Parent: "projects/p/locations/global/keyRings/ring", CryptoKeyId: "key"}
+	entry, p := record(t, context.Background(), "CreateCryptoKey", req, &kmspb.CryptoKey{Name: keyName}, nil)
+
+	if entry.LogName != "projects/p/logs/cloudaudit.googleapis.com%2Factivity" || entry.Severity != "NOTICE" {
+		t.Errorf("Unexpected log name or severity: %s %s", entry.LogName, entry.Severity)
+	}
+	if p.ResourceName != keyName {
+		t.Errorf("Expected the created key as resource name, got %q", p.ResourceName)
+	}
+	if len(p.AuthorizationInfo) != 1 || p.AuthorizationInfo[0].Resource != req.Parent {
+		t.Errorf("Expected authorization against the parent, got %+v", p.AuthorizationInfo)
+	}
+}
+
+func TestFailedEntry(t *testing.T) {
+	req := &kmspb.DecryptRequest{Name: keyName}
+	entry, p := record(t, context.Background(), "Decrypt", req, nil, status.Error(codes.PermissionDenied, "Permission denied"))
+
+	if entry.Severity != "ERROR" {
+		t.Errorf("Expected ERROR severity, got %s", entry.Severity)
+	}
+	if p.Status.Code != int(codes.PermissionDenied) || p.Status.Message != "Permission denied" {
+		t.Errorf("Unexpected status: %+v", p.Status)
+	}
+	if len(p.AuthorizationInfo) != 1 || p.AuthorizationInfo[0].Granted {
+		t.Errorf("Expected a denied authorization, got %+v", p.AuthorizationInfo)
+	}
+}
+
+func TestLocationEntry(t *testing.T) {
+	entry, _ := record(t, context.Background(), "ListKeyRings", &kmspb.ListKeyRingsRequest{Parent: "projects/p/locations/global"}, &kmspb.ListKeyRingsResponse{}, nil)
+	if entry.Resource.Type != "audited_resource" || entry.Resource.Labels["method"] != "google.cloud.kms.v1.KeyManagementService.ListKeyRings" {
+		t.Errorf("Unexpected monitored resource: %+v", entry.Resource)
+	}
+}
+
+func TestDelegatedEntry(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"x-emulator-principal", "user:dev@example.com",
+		"x-emulator-impersonate", "ci@p.iam.gserviceaccount.com,app@p.iam.gserviceaccount.com",
+	))
+	var p payload
+	_, err := principal.NewResolver(nil).UnaryServerInterceptor()(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, _ any) (any, error) {
+		_, p = record(t, ctx, "Encrypt", &kmspb.EncryptRequest{Name: keyName}, &kmspb.EncryptResponse{}, nil)
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.AuthenticationInfo.PrincipalEmail != "app@p.iam.gserviceaccount.com" {
+		t.Errorf("Expected the impersonated service account as principal, got %q", p.AuthenticationInfo.PrincipalEmail)
+	}
+	var chain []string
+	for _, d := range p.AuthenticationInfo.ServiceAccountDelegationInfo {
+		chain = append(chain, d.FirstPartyPrincipal.PrincipalEmail)
+	}
+	if got := strings.Join(chain, ","); got != "dev@example.com,ci@p.iam.gserviceaccount.com" {
+		t.Errorf("Unexpected delegation chain %q", got)
+	}
+}
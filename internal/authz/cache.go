@@ -0,0 +1,112 @@
+package authz
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCacheEntries bounds a DecisionCache; when full, expired entries are
+// dropped, and everything if none have expired
+const maxCacheEntries = 10000
+
+// DecisionCache remembers IAM emulator answers per principal, resource and
+// permission for a short TTL, saving a round trip per call. Changing a
+// resource's policy invalidates the answers for it and the resources below it.
+type DecisionCache struct {
+	ttl time.Duration
+
+	mu            sync.Mutex
+	entries       map[cacheKey]cacheEntry
+	hits          int64
+	misses        int64
+	invalidations int64
+}
+
+type cacheKey struct {
+	principal, resource, permission string
+}
+
+type cacheEntry struct {
+	allowed bool
+	expires time.Time
+}
+
+// CacheStats are the counters of a DecisionCache
+type CacheStats struct {
+	TTLSeconds    float64 `json:"ttlSeconds"`
+	Entries       int     `json:"entries"`
+	Hits          int64   `json:"hits"`
+	Misses        int64   `json:"misses"`
+	HitRate       float64 `json:"hitRate"`
+	Invalidations int64   `json:"invalidations"`
+}
+
+// NewDecisionCache creates a cache keeping answers for ttl
+func NewDecisionCache(ttl time.Duration) *DecisionCache {
+	return &DecisionCache{ttl: ttl, entries: make(map[cacheKey]cacheEntry)}
+}
+
+// Get returns a cached answer, and whether there was one
+func (c *DecisionCache) Get(principal, resource, permission string) (allowed, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[cacheKey{principal, resource, permission}]
+	if !ok || time.Now().After(e.expires) {
+		c.misses++
+		return false, false
+	}
+	c.hits++
+	return e.allowed, true
+}
+
+// Put caches an answer
+func (c *DecisionCache) Put(principal, resource, permission string, allowed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= maxCacheEntries {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCacheEntries {
+			clear(c.entries)
+		}
+	}
+	c.entries[cacheKey{principal, resource, permission}] = cacheEntry{allowed: allowed, expires: now.Add(c.ttl)}
+}
+
+// Invalidate drops the answers for resource and the resources below it, or
+// all answers if resource is empty, and returns how many it dropped
+func (c *DecisionCache) Invalidate(resource string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidations++
+	n := 0
+	for k := range c.entries {
+		if resource == "" || k.resource == resource || strings.HasPrefix(k.resource, resource+"/") {
+			delete(c.entries, k)
+			n++
+		}
+	}
+	return n
+}
+
+// Stats returns the cache counters
+func (c *DecisionCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := CacheStats{
+		TTLSeconds:    c.ttl.Seconds(),
+		Entries:       len(c.entries),
+		Hits:          c.hits,
+		Misses:        c.misses,
+		Invalidations: c.invalidations,
+	}
+	if total := c.hits + c.misses; total > 0 {
+		s.HitRate = float64(c.hits) / float64(total)
+	}
+	return s
+}
@@ -0,0 +1,36 @@
+package authz
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecisionCache(t *testing.T) {
+	const key = "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+	c := NewDecisionCache(time.Minute)
+	if _, ok := c.Get("user:a", key, "p"); ok {
+		t.Fatal("Expected a miss on an empty cache")
+	}
+	c.Put("user:a", key, "p", true)
+	c.Put("user:a", "projects/p/locations/global/keyRings/rr", "p", false)
+	if allowed, ok := c.Get("user:a", key, "p"); !ok || !allowed {
+		t.Errorf("Expected a cached allow, got %v %v", allowed, ok)
+	}
+
+	if n := c.Invalidate("projects/p/locations/global/keyRings/r"); n != 1 {
+		t.Errorf("Expected the key's answer to be dropped with its key ring, and not the sibling's, got %d", n)
+	}
+	if stats := c.Stats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 || stats.Invalidations != 1 || stats.HitRate != 0.5 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if n := c.Invalidate(""); n != 1 {
+		t.Errorf("Expected everything to be dropped, got %d", n)
+	}
+
+	expired := NewDecisionCache(time.Nanosecond)
+	expired.Put("user:a", key, "p", true)
+	time.Sleep(time.Millisecond)
+	if _, ok := expired.Get("user:a", key, "p"); ok {
+		t.Error("Expected an expired answer to miss")
+	}
+}
@@ -0,0 +1,122 @@
+package authz
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// DefaultDecisionLogSize is how many decisions a DecisionLog keeps
+const DefaultDecisionLogSize = 1000
+
+// Outcomes of an authorization decision
+const (
+	OutcomeAllowed = "ALLOWED"
+	OutcomeDenied  = "DENIED"
+	OutcomeError   = "ERROR"
+)
+
+// Decision is the outcome of one permission check
+type Decision struct {
+	Time       time.Time     `json:"time"`
+	Operation  string        `json:"operation"`
+	Principal  string        `json:"principal"`
+	Permission string        `json:"permission"`
+	Resource   string        `json:"resource"`
+	Outcome    string        `json:"outcome"`
+	Error      string        `json:"error,omitempty"`
+	Cached     bool          `json:"cached,omitempty"`
+	Forced     bool          `json:"forced,omitempty"`
+	Latency    time.Duration `json:"-"`
+	LatencyMs  float64       `json:"latencyMs"`
+}
+
+// DecisionLog logs permission checks and keeps the most recent ones, so
+// tests can find out why a call was denied
+type DecisionLog struct {
+	mu        sync.Mutex
+	decisions []Decision // ring buffer of up to size decisions
+	next      int
+	size      int
+	logger    *slog.Logger // nil logs to slog.Default()
+}
+
+// NewDecisionLog creates a log keeping the last size decisions
+func NewDecisionLog(size int) *DecisionLog {
+	if size <= 0 {
+		size = DefaultDecisionLogSize
+	}
+	return &DecisionLog{size: size}
+}
+
+// SetLogger logs decisions to logger instead of slog.Default(). Call it
+// before recording decisions.
+func (l *DecisionLog) SetLogger(logger *slog.Logger) {
+	l.logger = logger
+}
+
+// Record logs a decision and keeps it. Denials and errors log at info,
+// allowed calls at debug.
+func (l *DecisionLog) Record(ctx context.Context, d Decision) {
+	d.LatencyMs = float64(d.Latency) / float64(time.Millisecond)
+	level := slog.LevelDebug
+	if d.Outcome != OutcomeAllowed {
+		level = slog.LevelInfo
+	}
+	attrs := []slog.Attr{
+		slog.String("operation", d.Operation),
+		slog.String("principal", d.Principal),
+		slog.String("permission", d.Permission),
+		slog.String("resource", d.Resource),
+		slog.String("outcome", d.Outcome),
+		slog.Duration("latency", d.Latency),
+	}
+	if d.Cached {
+		attrs = append(attrs, slog.Bool("cached", true))
+	}
+	if d.Forced {
+		attrs = append(attrs, slog.Bool("forced", true))
+	}
+	if d.Error != "" {
+		attrs = append(attrs, slog.String("error", d.Error))
+	}
+	logger := l.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.LogAttrs(ctx, level, "Authorization decision", attrs...)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.decisions) < l.size {
+		l.decisions = append(l.decisions, d)
+	} else {
+		l.decisions[l.next] = d
+	}
+	l.next = (l.next + 1) % l.size
+}
+
+// Recent returns up to limit kept decisions, newest first, or all of them if
+// limit is 0
+func (l *DecisionLog) Recent(limit int) []Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := len(l.decisions)
+	if limit <= 0 || limit > n {
+		limit = n
+	}
+	recent := make([]Decision, 0, limit)
+	for i := 1; i <= limit; i++ {
+		recent = append(recent, l.decisions[(l.next-i+n)%n])
+	}
+	return recent
+}
+
+// Clear drops the kept decisions
+func (l *DecisionLog) Clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.decisions = nil
+	l.next = 0
+}
@@ -0,0 +1,37 @@
+package authz
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestDecisionLog(t *testing.T) {
+	l := NewDecisionLog(3)
+	if got := l.Recent(0); len(got) != 0 {
+		t.Fatalf("Expected an empty log, got %v", got)
+	}
+	for i := range 5 {
+		l.Record(context.Background(), Decision{Resource: fmt.Sprint(i), Outcome: OutcomeAllowed})
+	}
+
+	resources := func(ds []Decision) string {
+		var s string
+		for _, d := range ds {
+			s += d.Resource
+		}
+		return s
+	}
+	if got := resources(l.Recent(0)); got != "432" {
+		t.Errorf("Expected the last 3 decisions newest first, got %s", got)
+	}
+	if got := resources(l.Recent(2)); got != "43" {
+		t.Errorf("Expected the last 2 decisions, got %s", got)
+	}
+
+	l.Clear()
+	l.Record(context.Background(), Decision{Resource: "5"})
+	if got := resources(l.Recent(0)); got != "5" {
+		t.Errorf("Expected only the decision after clearing, got %s", got)
+	}
+}
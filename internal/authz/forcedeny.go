@@ -0,0 +1,36 @@
+package authz
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// ForceDenyHeader is the test-only metadata key that makes a call fail
+// authorization for the comma-separated permissions it lists, or for every
+// permission with "*", whatever the policy or IAM mode says
+const ForceDenyHeader = "x-emulator-force-deny"
+
+// ForcedDenials returns the permissions a call's ForceDenyHeader denies
+func ForcedDenials(ctx context.Context) map[string]bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var denied map[string]bool
+	for _, value := range md.Get(ForceDenyHeader) {
+		for _, perm := range strings.Split(value, ",") {
+			if perm = strings.TrimSpace(perm); perm != "" {
+				if denied == nil {
+					denied = make(map[string]bool)
+				}
+				denied[perm] = true
+			}
+		}
+	}
+	return denied
+}
+
+// IsForcedDenial reports whether permission is in denied, as returned by
+// ForcedDenials
+func IsForcedDenial(denied map[string]bool, permission string) bool {
+	return denied["*"] || denied[permission]
+}
@@ -16,6 +16,10 @@ type PermissionCheck struct {
 	Target     ResourceTarget
 }
 
+// ImpersonatePermission is required on a service account to act as it
+// (roles/iam.serviceAccountTokenCreator)
+const ImpersonatePermission = "iam.serviceAccounts.getAccessToken"
+
 // OperationPermissions maps KMS operations to their required permissions
 //
 // Based on GCP KMS permission model:
@@ -87,7 +91,7 @@ var OperationPermissions = map[string]PermissionCheck{
 		Target:     ResourceTargetSelf,
 	},
 	"RestoreCryptoKeyVersion": {
-		Permission: "cloudkms.cryptoKeyVersions.update",
+		Permission: "cloudkms.cryptoKeyVersions.restore",
 		Target:     ResourceTargetSelf,
 	},
 
@@ -112,6 +116,30 @@ var OperationPermissions = map[string]PermissionCheck{
 		Permission: "cloudkms.cryptoKeyVersions.useToMacVerify",
 		Target:     ResourceTargetSelf, // Check against cryptokeyversion
 	},
+
+	// Import operations
+	"CreateImportJob": {
+		Permission: "cloudkms.importJobs.create",
+		Target:     ResourceTargetParent, // Check against keyring
+	},
+	"GetImportJob": {
+		Permission: "cloudkms.importJobs.get",
+		Target:     ResourceTargetSelf,
+	},
+	"ListImportJobs": {
+		Permission: "cloudkms.importJobs.list",
+		Target:     ResourceTargetParent, // Check against keyring
+	},
+	"ImportCryptoKeyVersion": {
+		Permission: "cloudkms.cryptoKeyVersions.create",
+		Target:     ResourceTargetParent, // Check against cryptokey
+	},
+
+	// Location operations
+	"GenerateRandomBytes": {
+		Permission: "cloudkms.locations.generateRandomBytes",
+		Target:     ResourceTargetSelf, // Check against location
+	},
 }
 
 // GetPermission returns the permission and target for an operation
@@ -0,0 +1,177 @@
+package authz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Members that match more than one principal, as in IAM policies
+const (
+	AllUsers              = "allUsers"
+	AllAuthenticatedUsers = "allAuthenticatedUsers"
+)
+
+// Policy is a static IAM policy: the roles each principal holds and the
+// resources it holds them on. It answers permission checks locally, in
+// place of the IAM emulator.
+//
+// # Format
+//
+//	principals:
+//	  user:dev@example.com:
+//	    roles/cloudkms.admin:
+//	      - projects/test-project
+//	  serviceAccount:app@test-project.iam.gserviceaccount.com:
+//	    roles/cloudkms.cryptoKeyEncrypterDecrypter:
+//	      - projects/test-project/locations/*/keyRings/app
+//	    cloudkms.cryptoKeyVersions.viewPublicKey:
+//	      - projects/test-project/locations/global/keyRings/app/cryptoKeys/signing
+//
+// The same structure is accepted as JSON. Principals are member strings
+// (user:, serviceAccount:, group:, domain:) or allUsers and
+// allAuthenticatedUsers. Roles are expanded with RolePermissions, so raw
+// permissions can be granted too. A resource pattern grants on the resource
+// it names and everything below it, as IAM policies are inherited; each path
+// segment may use path.Match wildcards, so locations/* matches every
+// location.
+type Policy struct {
+	grants []grant
+}
+
+// grant is one role held by a principal on some resources
+type grant struct {
+	principal   string
+	permissions map[string]bool
+	resources   [][]string // patterns split into segments
+}
+
+// policyFile is the file format of a Policy
+type policyFile struct {
+	Principals map[string]map[string][]string `json:"principals" yaml:"principals"`
+}
+
+// LoadPolicy reads a policy from a YAML or JSON file
+func LoadPolicy(filename string) (*Policy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var f policyFile
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	default:
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid IAM policy %s: %w", filename, err)
+	}
+	p, err := newPolicy(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IAM policy %s: %w", filename, err)
+	}
+	return p, nil
+}
+
+func newPolicy(f policyFile) (*Policy, error) {
+	if len(f.Principals) == 0 {
+		return nil, errors.New("no principals")
+	}
+	p := &Policy{}
+	for _, principal := range sortedKeys(f.Principals) {
+		if principal != AllUsers && principal != AllAuthenticatedUsers && !strings.Contains(principal, ":") {
+			return nil, fmt.Errorf("principal %q must be allUsers, allAuthenticatedUsers or TYPE:ID", principal)
+		}
+		roles := f.Principals[principal]
+		for _, role := range sortedKeys(roles) {
+			perms, err := RolePermissions(role)
+			if err != nil {
+				return nil, fmt.Errorf("principal %s: %w", principal, err)
+			}
+			g := grant{principal: principal, permissions: make(map[string]bool)}
+			for _, perm := range perms {
+				g.permissions[perm] = true
+			}
+			if len(roles[role]) == 0 {
+				return nil, fmt.Errorf("principal %s: no resources for %s", principal, role)
+			}
+			for _, pattern := range roles[role] {
+				segments := strings.Split(strings.Trim(pattern, "/"), "/")
+				for _, seg := range segments {
+					if _, err := path.Match(seg, ""); err != nil || seg == "" {
+						return nil, fmt.Errorf("principal %s: invalid resource pattern %q", principal, pattern)
+					}
+				}
+				g.resources = append(g.resources, segments)
+			}
+			p.grants = append(p.grants, g)
+		}
+	}
+	return p, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CheckPermission reports whether principal holds permission on resource. It
+// has the signature of the IAM emulator client's, so either can check
+// permissions.
+func (p *Policy) CheckPermission(_ context.Context, principal, resource, permission string) (bool, error) {
+	segments := strings.Split(resource, "/")
+	for _, g := range p.grants {
+		if !g.permissions[permission] || !memberMatches(g.principal, principal) {
+			continue
+		}
+		for _, pattern := range g.resources {
+			if resourceMatches(pattern, segments) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func memberMatches(member, principal string) bool {
+	switch member {
+	case AllUsers:
+		return true
+	case AllAuthenticatedUsers:
+		return principal != ""
+	default:
+		return member == principal
+	}
+}
+
+// resourceMatches reports whether pattern names the resource or one of its
+// ancestors
+func resourceMatches(pattern, resource []string) bool {
+	if len(pattern) > len(resource) {
+		return false
+	}
+	for i, seg := range pattern {
+		if ok, _ := path.Match(seg, resource[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
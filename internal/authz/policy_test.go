@@ -0,0 +1,94 @@
+package authz
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writePolicy(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPolicy(t *testing.T) {
+	p, err := LoadPolicy(writePolicy(t, "policy.yaml", `
+principals:
+  user:admin@example.com:
+    roles/cloudkms.admin:
+      - projects/p
+  serviceAccount:app@p.iam.gserviceaccount.com:
+    roles/cloudkms.cryptoKeyEncrypterDecrypter:
+      - projects/p/locations/*/keyRings/app
+    cloudkms.cryptoKeyVersions.viewPublicKey:
+      - projects/p/locations/global/keyRings/app/cryptoKeys/signing
+  allAuthenticatedUsers:
+    roles/cloudkms.viewer:
+      - projects/shared
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		admin = "user:admin@example.com"
+		app   = "serviceAccount:app@p.iam.gserviceaccount.com"
+	)
+	tests := []struct {
+		principal, resource, permission string
+		want                            bool
+	}{
+		{admin, "projects/p/locations/global", "cloudkms.keyRings.create", true},
+		{admin, "projects/p/locations/global/keyRings/app/cryptoKeys/k", "cloudkms.cryptoKeyVersions.destroy", true},
+		{admin, "projects/p/locations/global/keyRings/app/cryptoKeys/k", "cloudkms.cryptoKeys.encrypt", false},
+		{admin, "projects/other/locations/global", "cloudkms.keyRings.create", false},
+		{app, "projects/p/locations/us-east1/keyRings/app/cryptoKeys/k", "cloudkms.cryptoKeys.encrypt", true},
+		{app, "projects/p/locations/global/keyRings/application/cryptoKeys/k", "cloudkms.cryptoKeys.encrypt", false},
+		{app, "projects/p/locations/global/keyRings/app", "cloudkms.cryptoKeys.create", false},
+		{app, "projects/p/locations/global/keyRings/app/cryptoKeys/signing/cryptoKeyVersions/1", "cloudkms.cryptoKeyVersions.viewPublicKey", true},
+		{app, "projects/p/locations/global/keyRings/app/cryptoKeys/other/cryptoKeyVersions/1", "cloudkms.cryptoKeyVersions.viewPublicKey", false},
+		{"user:anyone@example.com", "projects/shared/locations/global/keyRings/r", "cloudkms.keyRings.get", true},
+		{"", "projects/shared/locations/global/keyRings/r", "cloudkms.keyRings.get", false},
+	}
+	for _, tt := range tests {
+		got, err := p.CheckPermission(context.Background(), tt.principal, tt.resource, tt.permission)
+		if err != nil || got != tt.want {
+			t.Errorf("CheckPermission(%q, %q, %q) = %v, %v; want %v", tt.principal, tt.resource, tt.permission, got, err, tt.want)
+		}
+	}
+}
+
+func TestLoadPolicyJSON(t *testing.T) {
+	p, err := LoadPolicy(writePolicy(t, "policy.json", `{"principals": {"allUsers": {"roles/cloudkms.publicKeyViewer": ["projects/p"]}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := p.CheckPermission(context.Background(), "", "projects/p/locations/global/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1", "cloudkms.cryptoKeyVersions.viewPublicKey"); !ok {
+		t.Error("Expected allUsers to include anonymous callers")
+	}
+}
+
+func TestLoadPolicyInvalid(t *testing.T) {
+	tests := map[string]string{
+		"empty":         ``,
+		"no principals": `principals: {}`,
+		"unknown field": `bindings: []`,
+		"bad principal": "principals:\n  dev@example.com:\n    roles/cloudkms.viewer: [projects/p]",
+		"unknown role":  "principals:\n  user:dev@example.com:\n    roles/cloudkms.superuser: [projects/p]",
+		"no resources":  "principals:\n  user:dev@example.com:\n    roles/cloudkms.viewer: []",
+		"bad pattern":   "principals:\n  user:dev@example.com:\n    roles/cloudkms.viewer: ['projects/[p']",
+		"empty segment": "principals:\n  user:dev@example.com:\n    roles/cloudkms.viewer: ['projects//locations']",
+	}
+	for name, content := range tests {
+		path := writePolicy(t, "policy.yaml", content)
+		if _, err := LoadPolicy(path); err == nil || !strings.Contains(err.Error(), "invalid IAM policy") {
+			t.Errorf("%s: expected an invalid policy error, got %v", name, err)
+		}
+	}
+}
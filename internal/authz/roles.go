@@ -0,0 +1,114 @@
+package authz
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Roles maps predefined roles to the permissions they grant, in the names
+// OperationPermissions checks. Like their Cloud KMS counterparts, the admin
+// roles manage keys but cannot use them.
+//
+// Based on GCP KMS roles:
+// https://cloud.google.com/kms/docs/reference/permissions-and-roles#predefined_roles
+var Roles = map[string][]string{
+	"roles/cloudkms.admin": operationPermissions(
+		"CreateKeyRing", "GetKeyRing", "ListKeyRings",
+		"CreateCryptoKey", "GetCryptoKey", "ListCryptoKeys", "UpdateCryptoKey",
+		"CreateCryptoKeyVersion", "GetCryptoKeyVersion", "ListCryptoKeyVersions", "UpdateCryptoKeyVersion",
+		"DestroyCryptoKeyVersion", "RestoreCryptoKeyVersion", "GetPublicKey",
+		"CreateImportJob", "GetImportJob", "ListImportJobs",
+		"GenerateRandomBytes",
+	),
+	"roles/cloudkms.viewer":                      viewerPermissions,
+	"roles/cloudkms.cryptoKeyEncrypterDecrypter": operationPermissions("Encrypt", "Decrypt"),
+	"roles/cloudkms.cryptoKeyEncrypter":          operationPermissions("Encrypt"),
+	"roles/cloudkms.cryptoKeyDecrypter":          operationPermissions("Decrypt", "AsymmetricDecrypt"),
+	"roles/cloudkms.signer":                      operationPermissions("AsymmetricSign", "MacSign"),
+	"roles/cloudkms.signerVerifier":              operationPermissions("AsymmetricSign", "GetPublicKey", "MacSign", "MacVerify"),
+	"roles/cloudkms.verifier":                    operationPermissions("GetPublicKey", "MacVerify"),
+	"roles/cloudkms.publicKeyViewer":             operationPermissions("GetPublicKey"),
+	"roles/cloudkms.importer":                    operationPermissions("CreateImportJob", "GetImportJob", "ListImportJobs", "ImportCryptoKeyVersion"),
+	"roles/cloudkms.cryptoOperator": operationPermissions(
+		"Encrypt", "Decrypt", "AsymmetricSign", "AsymmetricDecrypt", "MacSign", "MacVerify",
+		"GetPublicKey", "GenerateRandomBytes",
+	),
+
+	// Basic roles
+	"roles/owner":  allPermissions(),
+	"roles/editor": allPermissions(),
+	"roles/viewer": viewerPermissions,
+
+	"roles/iam.serviceAccountTokenCreator": {ImpersonatePermission},
+}
+
+// viewerPermissions are the get and list permissions
+var viewerPermissions = operationPermissions(
+	"GetKeyRing", "ListKeyRings",
+	"GetCryptoKey", "ListCryptoKeys",
+	"GetCryptoKeyVersion", "ListCryptoKeyVersions",
+	"GetImportJob", "ListImportJobs",
+)
+
+// operationPermissions returns the permissions of operations, without
+// duplicates
+func operationPermissions(operations ...string) []string {
+	seen := make(map[string]bool)
+	var perms []string
+	for _, op := range operations {
+		check, ok := OperationPermissions[op]
+		if !ok {
+			panic("authz: unknown operation " + op)
+		}
+		if !seen[check.Permission] {
+			seen[check.Permission] = true
+			perms = append(perms, check.Permission)
+		}
+	}
+	return perms
+}
+
+// allPermissions returns every KMS permission
+func allPermissions() []string {
+	operations := make([]string, 0, len(OperationPermissions))
+	for op := range OperationPermissions {
+		operations = append(operations, op)
+	}
+	sort.Strings(operations)
+	return operationPermissions(operations...)
+}
+
+// RolePermissions returns the permissions a role grants. Anything that is
+// not a role ("roles/..." or a custom "projects/.../roles/...") is a single
+// raw permission, so bindings can mix both.
+func RolePermissions(role string) ([]string, error) {
+	if !strings.HasPrefix(role, "roles/") && !strings.Contains(role, "/roles/") {
+		return []string{role}, nil
+	}
+	perms, ok := Roles[role]
+	if !ok {
+		return nil, fmt.Errorf("unknown role %q", role)
+	}
+	return perms, nil
+}
+
+// ExpandRoles returns the permissions granted by roles, as RolePermissions
+// expands each of them, without duplicates
+func ExpandRoles(roles ...string) ([]string, error) {
+	seen := make(map[string]bool)
+	var perms []string
+	for _, role := range roles {
+		granted, err := RolePermissions(role)
+		if err != nil {
+			return nil, err
+		}
+		for _, perm := range granted {
+			if !seen[perm] {
+				seen[perm] = true
+				perms = append(perms, perm)
+			}
+		}
+	}
+	return perms, nil
+}
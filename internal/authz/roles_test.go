@@ -0,0 +1,50 @@
+package authz
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRoles(t *testing.T) {
+	known := map[string]bool{ImpersonatePermission: true}
+	for _, check := range OperationPermissions {
+		known[check.Permission] = true
+	}
+	for role, perms := range Roles {
+		if len(perms) == 0 {
+			t.Errorf("%s grants no permissions", role)
+		}
+		for _, perm := range perms {
+			if !known[perm] {
+				t.Errorf("%s grants %s, which no operation checks", role, perm)
+			}
+		}
+	}
+
+	admin := Roles["roles/cloudkms.admin"]
+	if !slices.Contains(admin, "cloudkms.cryptoKeyVersions.destroy") || slices.Contains(admin, "cloudkms.cryptoKeys.decrypt") {
+		t.Errorf("Expected the admin to manage but not use keys, got %v", admin)
+	}
+	for _, check := range OperationPermissions {
+		if !slices.Contains(Roles["roles/owner"], check.Permission) {
+			t.Errorf("Expected roles/owner to grant %s", check.Permission)
+		}
+	}
+}
+
+func TestExpandRoles(t *testing.T) {
+	perms, err := ExpandRoles("roles/cloudkms.cryptoKeyEncrypterDecrypter", "roles/cloudkms.cryptoKeyEncrypter", "cloudkms.keyRings.get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"cloudkms.cryptoKeys.encrypt", "cloudkms.cryptoKeys.decrypt", "cloudkms.keyRings.get"}
+	if !slices.Equal(perms, want) {
+		t.Errorf("Expected %v, got %v", want, perms)
+	}
+
+	for _, role := range []string{"roles/cloudkms.unknown", "projects/p/roles/custom"} {
+		if _, err := ExpandRoles(role); err == nil {
+			t.Errorf("Expected an error for %s", role)
+		}
+	}
+}
@@ -0,0 +1,467 @@
+// Package bench implements kms-bench, a load generator for the emulator or
+// real Cloud KMS.
+//
+// kms-bench drives a weighted mix of calls at a target rate from a number of
+// workers, then reports the calls, errors and latency percentiles of each
+// operation:
+//
+//	kms-bench --duration 30s --qps 500 --mix encrypt=45,decrypt=45,get-key=10
+//	kms-bench --cloud-kms --project my-project --location us-east1 --qps 50
+//
+// Before the run it creates a key ring (unless --keyring names one) with the
+// keys the mix needs, so runs are independent. Against Cloud KMS the versions
+// it created are scheduled for destruction afterwards.
+package bench
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/conformance"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/proxy"
+)
+
+// Exit codes
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// defaultMix is mostly data-path calls, as in typical applications
+const defaultMix = "encrypt=40,decrypt=40,get-key=10,list-keys=5,create-version=5"
+
+// operation issues one call, using the worker's rng to pick a key
+type operation func(ctx context.Context, b *bench, rng *mathrand.Rand) error
+
+var operations = map[string]operation{
+	"encrypt": func(ctx context.Context, b *bench, rng *mathrand.Rand) error {
+		_, err := b.client.Encrypt(ctx, &kmspb.EncryptRequest{Name: b.keys[rng.IntN(len(b.keys))], Plaintext: b.payload})
+		return err
+	},
+	"decrypt": func(ctx context.Context, b *bench, rng *mathrand.Rand) error {
+		i := rng.IntN(len(b.keys))
+		_, err := b.client.Decrypt(ctx, &kmspb.DecryptRequest{Name: b.keys[i], Ciphertext: b.ciphertexts[i]})
+		return err
+	},
+	"get-key": func(ctx context.Context, b *bench, rng *mathrand.Rand) error {
+		_, err := b.client.GetCryptoKey(ctx, &kmspb.GetCryptoKeyRequest{Name: b.keys[rng.IntN(len(b.keys))]})
+		return err
+	},
+	"list-keys": func(ctx context.Context, b *bench, _ *mathrand.Rand) error {
+		_, err := b.client.ListCryptoKeys(ctx, &kmspb.ListCryptoKeysRequest{Parent: b.keyRing})
+		return err
+	},
+	"create-version": func(ctx context.Context, b *bench, rng *mathrand.Rand) error {
+		_, err := b.client.CreateCryptoKeyVersion(ctx, &kmspb.CreateCryptoKeyVersionRequest{Parent: b.keys[rng.IntN(len(b.keys))]})
+		return err
+	},
+	"sign": func(ctx context.Context, b *bench, _ *mathrand.Rand) error {
+		_, err := b.client.AsymmetricSign(ctx, &kmspb.AsymmetricSignRequest{Name: b.signer, Data: b.payload})
+		return err
+	},
+	"mac": func(ctx context.Context, b *bench, _ *mathrand.Rand) error {
+		_, err := b.client.MacSign(ctx, &kmspb.MacSignRequest{Name: b.macKey, Data: b.payload})
+		return err
+	},
+	"random": func(ctx context.Context, b *bench, _ *mathrand.Rand) error {
+		_, err := b.client.GenerateRandomBytes(ctx, &kmspb.GenerateRandomBytesRequest{
+			Location:        b.parent,
+			LengthBytes:     32,
+			ProtectionLevel: kmspb.ProtectionLevel_HSM,
+		})
+		return err
+	},
+}
+
+// weighted is one operation of the mix
+type weighted struct {
+	name   string
+	weight int
+}
+
+// bench holds the flags and the resources of one run
+type bench struct {
+	stdout, stderr io.Writer
+
+	endpoint    string
+	cloudKMS    bool
+	project     string
+	location    string
+	keyRingID   string
+	mix         []weighted
+	qps         float64
+	duration    time.Duration
+	concurrency int
+	keyCount    int
+	payloadSize int
+	timeout     time.Duration
+	json        bool
+
+	conn        *grpc.ClientConn
+	client      kmspb.KeyManagementServiceClient
+	parent      string
+	keyRing     string
+	keys        []string
+	ciphertexts [][]byte
+	signer      string
+	macKey      string
+	payload     []byte
+}
+
+// Main runs kms-bench with the process arguments and exits
+func Main() {
+	os.Exit(Run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// Run runs kms-bench and returns its exit code
+func Run(args []string, stdout, stderr io.Writer) int {
+	b := &bench{stdout: stdout, stderr: stderr}
+	fs := flag.NewFlagSet("kms-bench", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&b.endpoint, "endpoint", getEnv("KMS_BENCH_ENDPOINT", getEnv("KMS_EMULATOR_HOST", "localhost:9090")), "gRPC address of the emulator, or of Cloud KMS with --cloud-kms")
+	fs.BoolVar(&b.cloudKMS, "cloud-kms", false, "Run against real Cloud KMS with Application Default Credentials (--endpoint defaults to "+proxy.DefaultEndpoint+")")
+	fs.StringVar(&b.project, "project", getEnv("CLOUDSDK_CORE_PROJECT", "kms-bench"), "Project ID")
+	fs.StringVar(&b.location, "location", "global", "Location of the key ring")
+	fs.StringVar(&b.keyRingID, "keyring", "", "Existing key ring ID to create the keys in (default: a new key ring)")
+	mix := fs.String("mix", defaultMix, "Operations and their weights, from "+strings.Join(operationNames(), ", "))
+	fs.Float64Var(&b.qps, "qps", 100, "Target rate of calls per second across all workers, or 0 for as fast as possible")
+	fs.DurationVar(&b.duration, "duration", 10*time.Second, "Length of the run")
+	fs.IntVar(&b.concurrency, "concurrency", 16, "Number of concurrent workers")
+	fs.IntVar(&b.keyCount, "keys", 4, "Number of symmetric keys to spread calls across")
+	fs.IntVar(&b.payloadSize, "payload", 1024, "Size in bytes of plaintexts and signed data")
+	fs.DurationVar(&b.timeout, "timeout", 10*time.Second, "Deadline for each call")
+	fs.BoolVar(&b.json, "json", false, "Print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(stderr, "kms-bench: unexpected arguments %q\n", fs.Args())
+		return exitUsage
+	}
+
+	var err error
+	if b.mix, err = parseMix(*mix); err != nil {
+		fmt.Fprintf(stderr, "kms-bench: invalid --mix: %v\n", err)
+		return exitUsage
+	}
+	switch {
+	case b.qps < 0:
+		err = errors.New("--qps must not be negative")
+	case b.duration <= 0:
+		err = errors.New("--duration must be positive")
+	case b.concurrency < 1:
+		err = errors.New("--concurrency must be at least 1")
+	case b.keyCount < 1:
+		err = errors.New("--keys must be at least 1")
+	case b.payloadSize < 1 || b.payloadSize > 64*1024:
+		err = errors.New("--payload must be between 1 and 65536 bytes")
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "kms-bench: %v\n", err)
+		return exitUsage
+	}
+	if b.cloudKMS && !isSet(fs, "endpoint") {
+		b.endpoint = proxy.DefaultEndpoint
+	}
+
+	ctx := context.Background()
+	if err := b.dial(ctx); err != nil {
+		fmt.Fprintf(stderr, "kms-bench: %v\n", err)
+		return exitError
+	}
+	defer b.conn.Close()
+
+	err = b.setup(ctx)
+	if b.cloudKMS && b.keyRingID == "" && b.keyRing != "" {
+		// Keys cannot be deleted, but destroyed versions are not billed
+		defer conformance.Cleanup(ctx, b.client, b.keyRing)
+	}
+	if err != nil {
+		if s, ok := status.FromError(err); ok {
+			err = fmt.Errorf("%s: %s", s.Code(), s.Message())
+		}
+		fmt.Fprintf(stderr, "kms-bench: setup failed: %v\n", err)
+		return exitError
+	}
+
+	report := b.run(ctx)
+	if b.json {
+		err = report.writeJSON(stdout)
+	} else {
+		err = report.writeText(stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "kms-bench: %v\n", err)
+		return exitError
+	}
+	return exitOK
+}
+
+func (b *bench) dial(ctx context.Context) error {
+	var err error
+	if b.cloudKMS {
+		b.conn, err = proxy.Dial(ctx, b.endpoint)
+	} else {
+		b.conn, err = grpc.NewClient(b.endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", b.endpoint, err)
+	}
+	b.client = kmspb.NewKeyManagementServiceClient(b.conn)
+	return nil
+}
+
+// setup creates the key ring and keys the mix needs, and a ciphertext per key
+// for decrypt
+func (b *bench) setup(ctx context.Context) error {
+	b.parent = "projects/" + b.project + "/locations/" + b.location
+	if b.keyRingID == "" {
+		id := fmt.Sprintf("kms-bench-%d", time.Now().UnixNano())
+		if _, err := b.client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: b.parent, KeyRingId: id}); err != nil {
+			return err
+		}
+		b.keyRing = b.parent + "/keyRings/" + id
+	} else {
+		b.keyRing = b.parent + "/keyRings/" + b.keyRingID
+	}
+	b.payload = make([]byte, b.payloadSize)
+	if _, err := rand.Read(b.payload); err != nil {
+		return err
+	}
+
+	// Keys get a per-run suffix, so an existing key ring can be reused
+	suffix := strconv.FormatInt(time.Now().Unix(), 36)
+	for i := 0; i < b.keyCount; i++ {
+		key, err := b.createKey(ctx, fmt.Sprintf("bench-%s-%d", suffix, i), &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT})
+		if err != nil {
+			return err
+		}
+		resp, err := b.client.Encrypt(ctx, &kmspb.EncryptRequest{Name: key, Plaintext: b.payload})
+		if err != nil {
+			return err
+		}
+		b.keys = append(b.keys, key)
+		b.ciphertexts = append(b.ciphertexts, resp.Ciphertext)
+	}
+
+	for _, op := range b.mix {
+		var err error
+		switch op.name {
+		case "sign":
+			b.signer, err = b.createVersionedKey(ctx, "bench-"+suffix+"-signer", kmspb.CryptoKey_ASYMMETRIC_SIGN, kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256)
+		case "mac":
+			b.macKey, err = b.createVersionedKey(ctx, "bench-"+suffix+"-mac", kmspb.CryptoKey_MAC, kmspb.CryptoKeyVersion_HMAC_SHA256)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *bench) createKey(ctx context.Context, id string, key *kmspb.CryptoKey) (string, error) {
+	created, err := b.client.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{Parent: b.keyRing, CryptoKeyId: id, CryptoKey: key})
+	if err != nil {
+		return "", err
+	}
+	return created.Name, nil
+}
+
+// createVersionedKey creates a key with one version and waits for it to be
+// generated, as asymmetric and MAC versions are asynchronously in Cloud KMS
+func (b *bench) createVersionedKey(ctx context.Context, id string, purpose kmspb.CryptoKey_CryptoKeyPurpose, algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm) (string, error) {
+	key, err := b.createKey(ctx, id, &kmspb.CryptoKey{
+		Purpose:         purpose,
+		VersionTemplate: &kmspb.CryptoKeyVersionTemplate{Algorithm: algorithm},
+	})
+	if err != nil {
+		return "", err
+	}
+	version := key + "/cryptoKeyVersions/1"
+	env := &conformance.Env{Client: b.client}
+	if err := env.WaitForVersion(ctx, version); err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// run issues calls until --duration has passed and returns the report
+func (b *bench) run(ctx context.Context) *report {
+	ctx, cancel := context.WithTimeout(ctx, b.duration)
+	defer cancel()
+
+	// With a target rate, a pacer hands out one token per call
+	var tokens chan struct{}
+	if b.qps > 0 {
+		tokens = make(chan struct{})
+		go pace(ctx, b.qps, tokens)
+	}
+
+	total := 0
+	for _, op := range b.mix {
+		total += op.weight
+	}
+
+	start := time.Now()
+	results := make([]map[string]*opStats, b.concurrency)
+	var wg sync.WaitGroup
+	for w := range results {
+		stats := make(map[string]*opStats)
+		results[w] = stats
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := mathrand.New(mathrand.NewPCG(uint64(time.Now().UnixNano()), uint64(w)))
+			for {
+				if tokens != nil {
+					select {
+					case <-ctx.Done():
+						return
+					case <-tokens:
+					}
+				} else if ctx.Err() != nil {
+					return
+				}
+
+				name := pick(b.mix, total, rng)
+				callCtx, callCancel := context.WithTimeout(context.Background(), b.timeout)
+				callStart := time.Now()
+				err := operations[name](callCtx, b, rng)
+				elapsed := time.Since(callStart)
+				callCancel()
+
+				s := stats[name]
+				if s == nil {
+					s = &opStats{errors: make(map[string]int)}
+					stats[name] = s
+				}
+				s.latencies = append(s.latencies, elapsed)
+				if err != nil {
+					s.errors[status.Code(err).String()]++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return newReport(b, time.Since(start), results)
+}
+
+// pace sends one token per 1/qps until ctx is done. Tokens are not queued
+// while every worker is busy, so a saturated target shows as a lower
+// achieved rate rather than a burst.
+func pace(ctx context.Context, qps float64, tokens chan<- struct{}) {
+	interval := time.Duration(float64(time.Second) / qps)
+	next := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case tokens <- struct{}{}:
+		}
+		next = next.Add(interval)
+		if wait := time.Until(next); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		} else if wait < -time.Second {
+			// Do not catch up on more than a second of missed calls
+			next = time.Now()
+		}
+	}
+}
+
+// pick returns a random operation of the mix by weight
+func pick(mix []weighted, total int, rng *mathrand.Rand) string {
+	n := rng.IntN(total)
+	for _, op := range mix {
+		if n < op.weight {
+			return op.name
+		}
+		n -= op.weight
+	}
+	return mix[len(mix)-1].name
+}
+
+// parseMix parses a mix such as encrypt=45,decrypt=45,get-key=10. A name
+// without a weight has weight 1.
+func parseMix(s string) ([]weighted, error) {
+	var mix []weighted
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, weightStr, hasWeight := strings.Cut(part, "=")
+		if _, ok := operations[name]; !ok {
+			return nil, fmt.Errorf("unknown operation %q (expected one of %s)", name, strings.Join(operationNames(), ", "))
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("operation %q is given twice", name)
+		}
+		seen[name] = true
+		weight := 1
+		if hasWeight {
+			var err error
+			if weight, err = strconv.Atoi(weightStr); err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid weight %q for %s", weightStr, name)
+			}
+		}
+		if weight > 0 {
+			mix = append(mix, weighted{name: name, weight: weight})
+		}
+	}
+	if len(mix) == 0 {
+		return nil, errors.New("no operations")
+	}
+	return mix, nil
+}
+
+func operationNames() []string {
+	names := make([]string, 0, len(operations))
+	for name := range operations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func isSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
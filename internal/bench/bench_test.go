@@ -0,0 +1,124 @@
+package bench
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/pkg/emulator"
+)
+
+// kmsBench runs kms-bench with args and returns its exit code and output
+func kmsBench(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := Run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestRun(t *testing.T) {
+	emu, err := emulator.Start(context.Background(), emulator.WithIAMMode("off"))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer emu.Close()
+
+	code, stdout, stderr := kmsBench("--endpoint", emu.Addr(), "--duration", "300ms", "--qps", "200", "--concurrency", "4",
+		"--mix", "encrypt,decrypt,get-key,list-keys,create-version,sign,mac,random", "--json")
+	if code != exitOK {
+		t.Fatalf("Exit %d: %s", code, stderr)
+	}
+	var r report
+	if err := json.Unmarshal([]byte(stdout), &r); err != nil {
+		t.Fatalf("Invalid JSON report: %v\n%s", err, stdout)
+	}
+	if len(r.Operations) != 8 {
+		t.Errorf("Expected 8 operations, got %d", len(r.Operations))
+	}
+	if r.Total.Calls == 0 || r.Total.Errors != 0 {
+		t.Errorf("Expected calls without errors, got %+v", r.Total)
+	}
+	// The rate is paced, with some slack for slow machines
+	if limit := int(200 * r.Seconds * 1.5); r.Total.Calls > limit {
+		t.Errorf("Expected at most %d calls at 200/s, got %d", limit, r.Total.Calls)
+	}
+	if !strings.Contains(stdout, `"p99Ms"`) {
+		t.Errorf("Expected latencies in milliseconds, got %s", stdout)
+	}
+
+	code, stdout, stderr = kmsBench("--endpoint", emu.Addr(), "--duration", "100ms", "--qps", "0", "--keyring", "existing")
+	if code != exitError || !strings.Contains(stderr, "NotFound") {
+		t.Errorf("Expected a missing key ring to fail setup, got exit %d: %s", code, stderr)
+	}
+	if stdout != "" {
+		t.Errorf("Expected no report, got %s", stdout)
+	}
+}
+
+func TestTextReport(t *testing.T) {
+	b := &bench{endpoint: "localhost:9090", keyRing: "ring", concurrency: 2, mix: []weighted{{"encrypt", 1}, {"decrypt", 1}}}
+	r := newReport(b, time.Second, []map[string]*opStats{
+		{"encrypt": {latencies: []time.Duration{time.Millisecond, 3 * time.Millisecond}, errors: map[string]int{}}},
+		{"encrypt": {latencies: []time.Duration{2 * time.Millisecond}, errors: map[string]int{"Unavailable": 1}}},
+	})
+	var buf bytes.Buffer
+	if err := r.writeText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"target rate unlimited", "encrypt      3       1", "33.33%", "2.00ms", "3.00ms", "encrypt: Unavailable x1"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected %q in report:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]time.Duration, 100)
+	for i := range sorted {
+		sorted[i] = time.Duration(i + 1)
+	}
+	for p, want := range map[float64]time.Duration{0.5: 50, 0.9: 90, 0.99: 99, 1: 100} {
+		if got := percentile(sorted, p); got != want {
+			t.Errorf("percentile(%v) = %d, want %d", p, got, want)
+		}
+	}
+	if got := percentile(sorted[:1], 0.99); got != 1 {
+		t.Errorf("Expected the only latency, got %d", got)
+	}
+}
+
+func TestParseMix(t *testing.T) {
+	mix, err := parseMix("encrypt=3, decrypt ,sign=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mix) != 2 || mix[0] != (weighted{"encrypt", 3}) || mix[1] != (weighted{"decrypt", 1}) {
+		t.Errorf("Unexpected mix %v", mix)
+	}
+	for _, bad := range []string{"", "sign=0", "nope", "encrypt=x", "encrypt=-1", "encrypt,encrypt"} {
+		if _, err := parseMix(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+	for _, args := range [][]string{
+		{"--mix", "nope"},
+		{"--qps", "-1"},
+		{"--duration", "0s"},
+		{"--concurrency", "0"},
+		{"--payload", "0"},
+		{"extra"},
+		{"--unknown"},
+	} {
+		if code, _, _ := kmsBench(args...); code != exitUsage {
+			t.Errorf("%v: expected exit %d, got %d", args, exitUsage, code)
+		}
+	}
+	if code, _, _ := kmsBench("--help"); code != exitOK {
+		t.Errorf("--help: expected exit %d, got %d", exitOK, code)
+	}
+}
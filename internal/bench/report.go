@@ -0,0 +1,170 @@
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// opStats are one worker's results for one operation
+type opStats struct {
+	latencies []time.Duration
+	errors    map[string]int
+}
+
+// report is the outcome of a run
+type report struct {
+	Target      string         `json:"target"`
+	KeyRing     string         `json:"keyRing"`
+	Duration    time.Duration  `json:"-"`
+	Seconds     float64        `json:"durationSeconds"`
+	Concurrency int            `json:"concurrency"`
+	TargetQPS   float64        `json:"targetQps,omitempty"`
+	Operations  []operationRow `json:"operations"`
+	Total       operationRow   `json:"total"`
+}
+
+// operationRow summarizes the calls of one operation, or of all of them
+type operationRow struct {
+	Name      string         `json:"name"`
+	Calls     int            `json:"calls"`
+	Errors    int            `json:"errors"`
+	ErrorRate float64        `json:"errorRate"`
+	QPS       float64        `json:"qps"`
+	P50       time.Duration  `json:"-"`
+	P90       time.Duration  `json:"-"`
+	P99       time.Duration  `json:"-"`
+	Max       time.Duration  `json:"-"`
+	Codes     map[string]int `json:"errorCodes,omitempty"`
+}
+
+// MarshalJSON reports latencies in milliseconds
+func (row operationRow) MarshalJSON() ([]byte, error) {
+	type plain operationRow
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return json.Marshal(struct {
+		plain
+		P50 float64 `json:"p50Ms"`
+		P90 float64 `json:"p90Ms"`
+		P99 float64 `json:"p99Ms"`
+		Max float64 `json:"maxMs"`
+	}{plain(row), ms(row.P50), ms(row.P90), ms(row.P99), ms(row.Max)})
+}
+
+func newReport(b *bench, elapsed time.Duration, results []map[string]*opStats) *report {
+	r := &report{
+		Target:      b.endpoint,
+		KeyRing:     b.keyRing,
+		Duration:    elapsed,
+		Seconds:     elapsed.Seconds(),
+		Concurrency: b.concurrency,
+		TargetQPS:   b.qps,
+	}
+
+	var all []time.Duration
+	totalCodes := make(map[string]int)
+	for _, op := range b.mix {
+		var latencies []time.Duration
+		codes := make(map[string]int)
+		for _, stats := range results {
+			if s := stats[op.name]; s != nil {
+				latencies = append(latencies, s.latencies...)
+				for code, n := range s.errors {
+					codes[code] += n
+					totalCodes[code] += n
+				}
+			}
+		}
+		all = append(all, latencies...)
+		r.Operations = append(r.Operations, newRow(op.name, latencies, codes, elapsed))
+	}
+	r.Total = newRow("total", all, totalCodes, elapsed)
+	return r
+}
+
+func newRow(name string, latencies []time.Duration, codes map[string]int, elapsed time.Duration) operationRow {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	row := operationRow{Name: name, Calls: len(latencies)}
+	for _, n := range codes {
+		row.Errors += n
+	}
+	if len(codes) > 0 {
+		row.Codes = codes
+	}
+	if row.Calls == 0 {
+		return row
+	}
+	row.ErrorRate = float64(row.Errors) / float64(row.Calls)
+	row.QPS = float64(row.Calls) / elapsed.Seconds()
+	row.P50 = percentile(latencies, 0.50)
+	row.P90 = percentile(latencies, 0.90)
+	row.P99 = percentile(latencies, 0.99)
+	row.Max = latencies[len(latencies)-1]
+	return row
+}
+
+// percentile returns the p-th percentile of sorted latencies by the
+// nearest-rank method
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(p*float64(len(sorted))+0.999999) - 1
+	rank = max(0, min(rank, len(sorted)-1))
+	return sorted[rank]
+}
+
+func (r *report) writeText(w io.Writer) error {
+	target := "unlimited"
+	if r.TargetQPS > 0 {
+		target = fmt.Sprintf("%g/s", r.TargetQPS)
+	}
+	fmt.Fprintf(w, "Target:   %s\nKey ring: %s\nRan %s with %d workers, target rate %s\n\n",
+		r.Target, r.KeyRing, r.Duration.Round(time.Millisecond), r.Concurrency, target)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "OPERATION\tCALLS\tERRORS\tERROR RATE\tRATE/S\tP50\tP90\tP99\tMAX\t")
+	for _, row := range append(r.Operations, r.Total) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.2f%%\t%.1f\t%s\t%s\t%s\t%s\t\n",
+			row.Name, row.Calls, row.Errors, 100*row.ErrorRate, row.QPS,
+			latency(row.P50), latency(row.P90), latency(row.P99), latency(row.Max))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(r.Total.Codes) > 0 {
+		fmt.Fprintln(w, "\nErrors:")
+		for _, row := range r.Operations {
+			codes := make([]string, 0, len(row.Codes))
+			for code := range row.Codes {
+				codes = append(codes, code)
+			}
+			sort.Strings(codes)
+			for _, code := range codes {
+				fmt.Fprintf(w, "  %s: %s x%d\n", row.Name, code, row.Codes[code])
+			}
+		}
+	}
+	return nil
+}
+
+func (r *report) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// latency formats a latency for the text report
+func latency(d time.Duration) string {
+	switch {
+	case d == 0:
+		return "-"
+	case d < time.Millisecond:
+		return fmt.Sprintf("%dµs", d.Microseconds())
+	case d < time.Second:
+		return fmt.Sprintf("%.2fms", float64(d)/float64(time.Millisecond))
+	default:
+		return fmt.Sprintf("%.2fs", d.Seconds())
+	}
+}
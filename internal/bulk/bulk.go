@@ -0,0 +1,152 @@
+// Package bulk serves streaming encrypt and decrypt, an emulator extension
+// that Cloud KMS does not have. Data migration rehearsals that would issue
+// millions of unary Encrypt or Decrypt calls send them over one stream
+// instead. It is only served with --extensions.
+//
+// Each stream works with one crypto key. The requests and responses are the
+// Cloud KMS EncryptRequest/EncryptResponse and DecryptRequest/DecryptResponse
+// messages, one response per request and in the same order. The first
+// request names the key; later requests may leave the name empty or repeat
+// it. Every request goes through the unary interceptors as an Encrypt or
+// Decrypt call of its own, so principals, IAM, size limits, the CRC32C
+// fields, faults, stats and audit logs apply to it as to the unary call; the
+// first failure ends the stream with its status code and the index of the
+// request.
+//
+// There is no generated client. Open a stream on the connection with the
+// exported descriptors:
+//
+//	stream, err := conn.NewStream(ctx, &bulk.EncryptStreamDesc, bulk.StreamEncryptMethod)
+//	err = stream.SendMsg(&kmspb.EncryptRequest{Name: key, Plaintext: data})
+//	var resp kmspb.EncryptResponse
+//	err = stream.RecvMsg(&resp)
+package bulk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/server"
+)
+
+// ServiceName is the gRPC service serving the streams
+const ServiceName = "gcpkmsemulator.v1.Bulk"
+
+// StreamEncryptMethod streams kmspb.EncryptRequest messages in and
+// kmspb.EncryptResponse messages out
+const StreamEncryptMethod = "/" + ServiceName + "/StreamEncrypt"
+
+// StreamDecryptMethod streams kmspb.DecryptRequest messages in and
+// kmspb.DecryptResponse messages out
+const StreamDecryptMethod = "/" + ServiceName + "/StreamDecrypt"
+
+// EncryptStreamDesc and DecryptStreamDesc describe the streams for
+// grpc.ClientConn.NewStream
+var (
+	EncryptStreamDesc = grpc.StreamDesc{StreamName: "StreamEncrypt", ServerStreams: true, ClientStreams: true}
+	DecryptStreamDesc = grpc.StreamDesc{StreamName: "StreamDecrypt", ServerStreams: true, ClientStreams: true}
+)
+
+// Service serves the streams with the unary calls of a KMS server
+type Service struct {
+	kms          *server.Server
+	interceptors []grpc.UnaryServerInterceptor
+}
+
+// NewService returns a service encrypting and decrypting through kms. Each
+// request runs through interceptors, first to last, as the server's unary
+// interceptor chain would run it.
+func NewService(kms *server.Server, interceptors ...grpc.UnaryServerInterceptor) *Service {
+	return &Service{kms: kms, interceptors: interceptors}
+}
+
+// Register serves the streams on s
+func (b *Service) Register(s *grpc.Server) {
+	encrypt, decrypt := EncryptStreamDesc, DecryptStreamDesc
+	encrypt.Handler = b.handleStreamEncrypt
+	decrypt.Handler = b.handleStreamDecrypt
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: ServiceName,
+		HandlerType: (*any)(nil),
+		Streams:     []grpc.StreamDesc{encrypt, decrypt},
+	}, b)
+}
+
+func (b *Service) handleStreamEncrypt(_ any, stream grpc.ServerStream) error {
+	return serve(stream,
+		func(req *kmspb.EncryptRequest) *string { return &req.Name },
+		func(ctx context.Context, req *kmspb.EncryptRequest) (any, error) {
+			return b.invoke(ctx, kmspb.KeyManagementService_Encrypt_FullMethodName, req, func(ctx context.Context, req any) (any, error) {
+				return b.kms.Encrypt(ctx, req.(*kmspb.EncryptRequest))
+			})
+		})
+}
+
+func (b *Service) handleStreamDecrypt(_ any, stream grpc.ServerStream) error {
+	return serve(stream,
+		func(req *kmspb.DecryptRequest) *string { return &req.Name },
+		func(ctx context.Context, req *kmspb.DecryptRequest) (any, error) {
+			return b.invoke(ctx, kmspb.KeyManagementService_Decrypt_FullMethodName, req, func(ctx context.Context, req any) (any, error) {
+				return b.kms.Decrypt(ctx, req.(*kmspb.DecryptRequest))
+			})
+		})
+}
+
+// invoke calls handler through the interceptors as the unary method
+func (b *Service) invoke(ctx context.Context, method string, req any, handler grpc.UnaryHandler) (any, error) {
+	info := &grpc.UnaryServerInfo{Server: b.kms, FullMethod: method}
+	for i := len(b.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := b.interceptors[i], handler
+		handler = func(ctx context.Context, req any) (any, error) {
+			return interceptor(ctx, req, info, next)
+		}
+	}
+	return handler(ctx, req)
+}
+
+// serve answers each request on stream with call, holding every request to
+// the key the first one names
+func serve[Req any, PReq interface {
+	*Req
+	proto.Message
+}](stream grpc.ServerStream, name func(PReq) *string, call func(context.Context, PReq) (any, error)) error {
+	var key string
+	for i := 0; ; i++ {
+		req := PReq(new(Req))
+		if err := stream.RecvMsg(req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		reqName := name(req)
+		switch {
+		case i == 0 && *reqName == "":
+			return status.Error(codes.InvalidArgument, "the first request of a stream must name the crypto key")
+		case i == 0:
+			key = *reqName
+		case *reqName == "":
+			*reqName = key
+		case *reqName != key:
+			return status.Errorf(codes.InvalidArgument, "request %d names %s, but the stream is for %s", i, *reqName, key)
+		}
+
+		resp, err := call(stream.Context(), req)
+		if err != nil {
+			st := status.Convert(err)
+			return status.Error(st.Code(), fmt.Sprintf("request %d: %s", i, st.Message()))
+		}
+		if err := stream.SendMsg(resp); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Package capabilities reports what the emulator supports, so test suites can
+// skip operations it does not implement instead of failing on Unimplemented.
+//
+// The report lists every KeyManagementService method with whether it is
+// implemented, the supported key purposes and algorithms, and the features
+// enabled for this instance:
+//
+//	{
+//	  "version": "0.1.0",
+//	  "service": "google.cloud.kms.v1.KeyManagementService",
+//	  "methods": [{"name": "CreateKeyRing", "implemented": true}, ...],
+//	  "purposes": ["ENCRYPT_DECRYPT", "ASYMMETRIC_SIGN", "ASYMMETRIC_DECRYPT", "MAC"],
+//	  "algorithms": ["GOOGLE_SYMMETRIC_ENCRYPTION", "RSA_SIGN_PSS_2048_SHA256", "EC_SIGN_P256_SHA256", ...],
+//	  "features": {"iamMode": "off", "persistence": "none", ...}
+//	}
+//
+// It is served over gRPC as a custom method and by the REST gateway at
+// GET /capabilities:
+//
+//	var report structpb.Struct
+//	err := conn.Invoke(ctx, capabilities.FullMethod, &emptypb.Empty{}, &report)
+package capabilities
+
+import (
+	"context"
+	"encoding/json"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/server"
+)
+
+// ServiceName is the gRPC service serving the report
+const ServiceName = "gcpkmsemulator.v1.Emulator"
+
+// FullMethod is the gRPC method returning the report as a
+// google.protobuf.Struct; its request is a google.protobuf.Empty
+const FullMethod = "/" + ServiceName + "/GetCapabilities"
+
+// Report describes what the emulator supports
+type Report struct {
+	Version    string   `json:"version"`
+	Service    string   `json:"service"`
+	Methods    []Method `json:"methods"`
+	Purposes   []string `json:"purposes"`
+	Algorithms []string `json:"algorithms"`
+	Features   Features `json:"features"`
+}
+
+// Method reports whether one KeyManagementService method is implemented
+type Method struct {
+	Name        string `json:"name"`
+	Implemented bool   `json:"implemented"`
+}
+
+// Features describes the optional features enabled for this instance
+type Features struct {
+	// IAMMode is off, permissive or strict
+	IAMMode string `json:"iamMode"`
+	// Protocols lists the APIs served: grpc, rest
+	Protocols []string `json:"protocols"`
+	// Persistence is none, file (--state-file) or snapshot (--state-uri)
+	Persistence string `json:"persistence"`
+	TLS         bool   `json:"tls"`
+	AdminAPI    bool   `json:"adminApi"`
+	AuditLog    bool   `json:"auditLog"`
+	// LifecycleNotifications reports whether events are published to Pub/Sub
+	LifecycleNotifications bool `json:"lifecycleNotifications"`
+	// Webhook reports whether call events are POSTed to --webhook-url
+	Webhook     bool     `json:"webhook"`
+	Compression []string `json:"compression"`
+	// MaxMessageBytes and MaxPayloadBytes are 0 when size limits are relaxed
+	MaxMessageBytes int `json:"maxMessageBytes"`
+	MaxPayloadBytes int `json:"maxPayloadBytes"`
+	// MockCrypto reports that Encrypt and Decrypt do not encrypt
+	// (--mock-crypto)
+	MockCrypto bool `json:"mockCrypto"`
+	// DeterministicEncryption reports that every crypto key encrypts with
+	// AES-SIV (--deterministic-encryption)
+	DeterministicEncryption bool `json:"deterministicEncryption"`
+	// FrozenTime is the time recorded for every resource timestamp, empty
+	// unless the clock is frozen (--frozen-time)
+	FrozenTime string `json:"frozenTime,omitempty"`
+	// Extensions lists the emulator-only gRPC services served (--extensions)
+	Extensions []string `json:"extensions,omitempty"`
+}
+
+// Reporter builds the report for a running emulator
+type Reporter struct {
+	version  string
+	kms      *server.Server
+	features Features
+}
+
+// NewReporter creates a reporter. features describes the startup
+// configuration; the IAM mode is read from kms each time since it can change
+// at runtime.
+func NewReporter(version string, kms *server.Server, features Features) *Reporter {
+	return &Reporter{version: version, kms: kms, features: features}
+}
+
+// Report returns the current report
+func (r *Reporter) Report() *Report {
+	report := &Report{
+		Version:  r.version,
+		Service:  string(kmspb.File_google_cloud_kms_v1_service_proto.Services().ByName("KeyManagementService").FullName()),
+		Features: r.features,
+	}
+	for _, name := range server.Methods() {
+		report.Methods = append(report.Methods, Method{Name: name, Implemented: server.Implemented(name)})
+	}
+	for _, p := range server.SupportedPurposes {
+		report.Purposes = append(report.Purposes, p.String())
+	}
+	for _, a := range server.SupportedAlgorithms {
+		report.Algorithms = append(report.Algorithms, a.String())
+	}
+	if r.kms != nil {
+		report.Features.IAMMode = string(r.kms.IAMMode())
+	}
+	return report
+}
+
+// Register serves the report on s at FullMethod
+func (r *Reporter) Register(s *grpc.Server) {
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: ServiceName,
+		HandlerType: (*any)(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "GetCapabilities",
+			Handler:    r.handleGetCapabilities,
+		}},
+	}, r)
+}
+
+// handleGetCapabilities deliberately skips the interceptor chain: discovering
+// capabilities must not be failed by fault injection or chaos, nor show up in
+// call stats and audit logs
+func (r *Reporter) handleGetCapabilities(_ any, _ context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+	if err := dec(new(emptypb.Empty)); err != nil {
+		return nil, err
+	}
+	return r.Struct()
+}
+
+// Struct returns the report as a google.protobuf.Struct
+func (r *Reporter) Struct() (*structpb.Struct, error) {
+	data, err := json.Marshal(r.Report())
+	if err != nil {
+		return nil, err
+	}
+	var s structpb.Struct
+	if err := protojson.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
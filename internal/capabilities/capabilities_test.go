@@ -0,0 +1,124 @@
+package capabilities
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/server"
+)
+
+func newConn(t *testing.T, reporter *Reporter, kms *server.Server) *grpc.ClientConn {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	kmspb.RegisterKeyManagementServiceServer(s, kms)
+	reporter.Register(s)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestGetCapabilities(t *testing.T) {
+	t.Setenv("IAM_MODE", "off")
+	kms, err := server.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	reporter := NewReporter("1.2.3", kms, Features{Protocols: []string{"grpc"}, Persistence: "file"})
+	conn := newConn(t, reporter, kms)
+
+	var report structpb.Struct
+	if err := conn.Invoke(context.Background(), FullMethod, &emptypb.Empty{}, &report); err != nil {
+		t.Fatalf("GetCapabilities: %v", err)
+	}
+
+	fields := report.GetFields()
+	if got := fields["version"].GetStringValue(); got != "1.2.3" {
+		t.Errorf("version = %q, want 1.2.3", got)
+	}
+	if got := fields["service"].GetStringValue(); got != "google.cloud.kms.v1.KeyManagementService" {
+		t.Errorf("service = %q", got)
+	}
+	features := fields["features"].GetStructValue().GetFields()
+	if got := features["iamMode"].GetStringValue(); got != "off" {
+		t.Errorf("iamMode = %q, want off", got)
+	}
+	if got := features["persistence"].GetStringValue(); got != "file" {
+		t.Errorf("persistence = %q, want file", got)
+	}
+
+	implemented := make(map[string]bool)
+	for _, m := range fields["methods"].GetListValue().GetValues() {
+		method := m.GetStructValue().GetFields()
+		implemented[method["name"].GetStringValue()] = method["implemented"].GetBoolValue()
+	}
+	if len(implemented) != len(server.Methods()) {
+		t.Errorf("got %d methods, want %d", len(implemented), len(server.Methods()))
+	}
+	if !implemented["Encrypt"] {
+		t.Error("Encrypt reported as unimplemented")
+	}
+	if implemented["Decapsulate"] {
+		t.Error("Decapsulate reported as implemented")
+	}
+}
+
+// TestImplementedMatchesServer calls every method with an empty request and
+// checks that exactly the methods reported as unimplemented return
+// Unimplemented
+func TestImplementedMatchesServer(t *testing.T) {
+	t.Setenv("IAM_MODE", "off")
+	kms, err := server.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	conn := newConn(t, NewReporter("test", kms, Features{}), kms)
+
+	methods := kmspb.File_google_cloud_kms_v1_service_proto.Services().ByName("KeyManagementService").Methods()
+	for i := 0; i < methods.Len(); i++ {
+		md := methods.Get(i)
+		name := string(md.Name())
+		t.Run(name, func(t *testing.T) {
+			req := newMessage(t, md.Input())
+			resp := newMessage(t, md.Output())
+			err := conn.Invoke(context.Background(), "/google.cloud.kms.v1.KeyManagementService/"+name, req, resp)
+
+			unimplemented := status.Code(err) == codes.Unimplemented
+			if unimplemented == server.Implemented(name) {
+				t.Errorf("Implemented(%s) = %v, but the server returned %v", name, server.Implemented(name), err)
+			}
+		})
+	}
+}
+
+func newMessage(t *testing.T, desc protoreflect.MessageDescriptor) proto.Message {
+	t.Helper()
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(desc.FullName())
+	if err != nil {
+		t.Fatalf("FindMessageByName(%s): %v", desc.FullName(), err)
+	}
+	return mt.New().Interface()
+}
@@ -0,0 +1,234 @@
+// Package cli implements the emulator command line shared by every server
+// binary.
+//
+// All protocols are served by the same code path; --mode (or GCP_KMS_MODE)
+// selects which listeners are started:
+//
+//   - grpc: gRPC API only
+//   - rest: REST API, backed by a gRPC server bound to loopback
+//   - dual: gRPC and REST APIs
+//
+// In rest and dual modes the REST gateway reaches the gRPC server in
+// process over an in-memory connection by default, so REST calls pass through
+// the same interceptors (logging, stats, fault injection) without a network
+// hop. --gateway-transport=loopback dials the gRPC port over TCP instead.
+//
+// The server, server-rest and server-dual binaries differ only in their
+// default mode, so features cannot drift between variants.
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/proxy"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/service"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+// Serving modes
+const (
+	ModeGRPC = "grpc"
+	ModeREST = "rest"
+	ModeDual = "dual"
+)
+
+// Gateway transports
+const (
+	transportInProcess = "inprocess"
+	transportLoopback  = "loopback"
+)
+
+var (
+	mode             = flag.String("mode", getEnv("GCP_KMS_MODE", ""), "Protocols to serve: grpc, rest or dual (default depends on the binary)")
+	host             = flag.String("host", getEnv("GCP_KMS_HOST", ""), "Address to bind (empty binds all interfaces)")
+	grpcPort         = flag.Int("grpc-port", getEnvInt("GCP_KMS_GRPC_PORT", getEnvInt("GCP_KMS_PORT", 9090)), "gRPC port to listen on (loopback only in rest mode)")
+	httpPort         = flag.Int("http-port", getEnvInt("GCP_KMS_HTTP_PORT", 8080), "HTTP port to listen on (rest and dual modes)")
+	logLevel         = flag.String("log-level", getEnv("GCP_KMS_LOG_LEVEL", "info"), "Log level (debug, info, warn, error)")
+	logFormat        = flag.String("log-format", getEnv("GCP_KMS_LOG_FORMAT", "text"), "Log format (text, json)")
+	auditLog         = flag.String("audit-log", getEnv("GCP_KMS_AUDIT_LOG", ""), "Write Cloud Audit Log entries to this file, or - for stdout (empty disables)")
+	recordFile       = flag.String("record", getEnv("GCP_KMS_RECORD_FILE", ""), "Record sanitized calls to this file for kms-replay, or - for stdout (empty disables)")
+	pubsubTopic      = flag.String("pubsub-topic", getEnv("GCP_KMS_PUBSUB_TOPIC", ""), "Publish key lifecycle events to this topic (projects/{project}/topics/{topic})")
+	pubsubHost       = flag.String("pubsub-host", getEnv("PUBSUB_EMULATOR_HOST", ""), "Pub/Sub emulator host for --pubsub-topic")
+	webhookURL       = flag.String("webhook-url", getEnv("GCP_KMS_WEBHOOK_URL", ""), "POST a JSON event for every KMS call to this URL (empty disables)")
+	webhookFilter    = flag.String("webhook-filter", getEnv("GCP_KMS_WEBHOOK_FILTER", ""), "Comma-separated globs over method names and lifecycle event types selecting the calls sent to --webhook-url (empty sends all)")
+	webhookRetries   = flag.Int("webhook-retries", getEnvInt("GCP_KMS_WEBHOOK_RETRIES", 3), "Times a failed --webhook-url delivery is retried, with exponential backoff")
+	proxyResources   = flag.String("proxy-resources", getEnv("GCP_KMS_PROXY_RESOURCES", ""), "Forward calls on resources matching these comma-separated patterns to Cloud KMS (empty disables)")
+	proxyUnimpl      = flag.Bool("proxy-unimplemented", getEnvBool("GCP_KMS_PROXY_UNIMPLEMENTED", false), "Forward calls the emulator does not implement to Cloud KMS")
+	proxyEndpoint    = flag.String("proxy-endpoint", getEnv("GCP_KMS_PROXY_ENDPOINT", proxy.DefaultEndpoint), "Cloud KMS endpoint for forwarded calls and --mirror")
+	gcloudImport     = flag.String("gcloud-import", getEnv("GCP_KMS_GCLOUD_IMPORT", ""), "Recreate the resources in these comma-separated files of gcloud kms list --format=json output at startup")
+	mirrorSources    = flag.String("mirror", getEnv("GCP_KMS_MIRROR", ""), "Copy key ring, key and version metadata from these comma-separated Cloud KMS projects or locations at startup")
+	configFile       = flag.String("config", getEnv("GCP_KMS_CONFIG", ""), "Runtime configuration file (JSON), reloaded on SIGHUP")
+	stateFile        = flag.String("state-file", getEnv("GCP_KMS_STATE_FILE", ""), "Path to persist state across restarts (empty disables persistence)")
+	fixturesFile     = flag.String("fixtures", getEnv("GCP_KMS_FIXTURES", ""), "Fixtures manifest (JSON) of key versions to create with supplied key material at startup")
+	migrateState     = flag.Bool("migrate-state", false, "Migrate --state-file to the current schema version and exit")
+	stateURI         = flag.String("state-uri", getEnv("GCP_KMS_STATE_URI", ""), "Snapshot location to restore at startup and upload on shutdown (gs://, s3:// or file://)")
+	tlsCert          = flag.String("tls-cert", getEnv("GCP_KMS_TLS_CERT", ""), "TLS certificate file (PEM); serves TLS when set with --tls-key")
+	tlsKey           = flag.String("tls-key", getEnv("GCP_KMS_TLS_KEY", ""), "TLS private key file (PEM)")
+	stateSync        = flag.Duration("state-sync-interval", getEnvDuration("GCP_KMS_STATE_SYNC_INTERVAL", 0), "Upload the state snapshot periodically (0 uploads on shutdown only)")
+	adminPort        = flag.Int("admin-port", getEnvInt("GCP_KMS_ADMIN_PORT", 0), "Admin API port (0 disables the admin API)")
+	chaosRate        = flag.Float64("chaos", getEnvFloat("GCP_KMS_CHAOS", 0), "Fraction of calls to fail with UNAVAILABLE or DEADLINE_EXCEEDED (0 disables)")
+	gatewayTransport = flag.String("gateway-transport", getEnv("GCP_KMS_GATEWAY_TRANSPORT", transportInProcess), "How the REST gateway reaches the gRPC server: inprocess or loopback")
+	shutdownTimeout  = flag.Duration("shutdown-timeout", getEnvDuration("GCP_KMS_SHUTDOWN_TIMEOUT", 5*time.Second), "How long to drain in-flight requests on shutdown before closing connections")
+	keepaliveTime    = flag.Duration("keepalive-time", getEnvDuration("GCP_KMS_KEEPALIVE_TIME", 2*time.Hour), "Ping idle clients after this long to check the connection is alive")
+	keepaliveTimeout = flag.Duration("keepalive-timeout", getEnvDuration("GCP_KMS_KEEPALIVE_TIMEOUT", 20*time.Second), "Close the connection if a keepalive ping is not acknowledged within this time")
+	maxConnIdle      = flag.Duration("max-connection-idle", getEnvDuration("GCP_KMS_MAX_CONNECTION_IDLE", 0), "Send GOAWAY to connections idle for this long (0 disables)")
+	maxConnAge       = flag.Duration("max-connection-age", getEnvDuration("GCP_KMS_MAX_CONNECTION_AGE", 0), "Send GOAWAY to connections older than this, like Google frontends do (0 disables)")
+	maxConnAgeGrace  = flag.Duration("max-connection-age-grace", getEnvDuration("GCP_KMS_MAX_CONNECTION_AGE_GRACE", 0), "Time allowed for RPCs to finish after a max-age GOAWAY before closing (0 waits forever)")
+	keepaliveMinTime = flag.Duration("keepalive-min-time", getEnvDuration("GCP_KMS_KEEPALIVE_MIN_TIME", 5*time.Minute), "Minimum interval between client pings; faster clients get GOAWAY too_many_pings")
+	permitNoStream   = flag.Bool("keepalive-permit-without-stream", getEnvBool("GCP_KMS_KEEPALIVE_PERMIT_WITHOUT_STREAM", false), "Allow client pings when there are no active RPCs")
+	jwksSources      = flag.String("jwks", getEnv("GCP_KMS_JWKS", ""), "Verify Bearer JWTs against these comma-separated JSON Web Key Set URLs or files before using them as the principal (empty trusts them unverified)")
+	iamPolicyFile    = flag.String("iam-policy", getEnv("GCP_KMS_IAM_POLICY", ""), "Check permissions against this static IAM policy (YAML or JSON) instead of the IAM emulator; enforced in strict mode unless IAM_MODE is permissive")
+	iamCacheTTL      = flag.Duration("iam-cache-ttl", getEnvDuration("GCP_KMS_IAM_CACHE_TTL", 0), "Cache the IAM emulator's permission answers this long (0 disables); SetIamPolicy through the emulator drops the affected answers")
+	destroyDelay     = flag.Duration("destroy-scheduled-duration", getEnvDuration("GCP_KMS_DESTROY_SCHEDULED_DURATION", storage.DefaultDestroyScheduledDuration), "How long destroyed versions stay DESTROY_SCHEDULED before their key material is wiped (0 destroys at once)")
+	keyPool          = flag.String("key-pool", getEnv("GCP_KMS_KEY_POOL", ""), "Keep this many asymmetric keys of each type generated ahead for fast key creation, e.g. rsa-4096=4,ec-p256=16 (types: "+strings.Join(storage.KeyPoolTypes(), ", ")+")")
+	keyGenWorkers    = flag.Int("key-generation-workers", getEnvInt("GCP_KMS_KEY_GENERATION_WORKERS", 0), "Create asymmetric versions PENDING_GENERATION and generate their keys on this many background workers, like Cloud KMS (0 generates them on creation)")
+	keyGenLimits     = flag.String("key-generation-limits", getEnv("GCP_KMS_KEY_GENERATION_LIMITS", ""), "Generate at most this many keys of each type at once in the background, e.g. rsa-4096=1,rsa-3072=2 (types: "+strings.Join(storage.GenerationKeyTypes(), ", ")+")")
+	extraLocations   = flag.String("extra-locations", getEnv("GCP_KMS_EXTRA_LOCATIONS", ""), "Accept keyrings in these comma-separated location IDs as well as in the Cloud KMS locations")
+	extensions       = flag.Bool("extensions", getEnvBool("GCP_KMS_EXTENSIONS", false), "Serve emulator-only gRPC extensions that Cloud KMS does not have: streaming bulk encrypt and decrypt (gcpkmsemulator.v1.Bulk)")
+	mockCrypto       = flag.Bool("mock-crypto", getEnvBool("GCP_KMS_MOCK_CRYPTO", false), "INSECURE: make Encrypt and Decrypt wrap plaintext in a readable envelope instead of AES-GCM, for unit test suites that need API semantics but not cryptography")
+	deterministic    = flag.Bool("deterministic-encryption", getEnvBool("GCP_KMS_DETERMINISTIC_ENCRYPTION", false), "Encrypt with AES-SIV so the same plaintext and AAD always give the same ciphertext, for golden files; keys labelled emulator-encryption=deterministic do so without it")
+	frozenTime       = flag.String("frozen-time", getEnv("GCP_KMS_FROZEN_TIME", ""), "Record this RFC 3339 time as every create, generate, import and destroy time, so responses are byte-stable for golden tests (empty uses the clock)")
+	pricingFile      = flag.String("pricing-file", getEnv("GCP_KMS_PRICING_FILE", ""), "JSON file of Cloud KMS prices for the /admin/cost report (empty uses list prices)")
+	relaxSizeLimits  = flag.Bool("relax-size-limits", getEnvBool("GCP_KMS_RELAX_SIZE_LIMITS", false), "Lift the Cloud KMS message and payload size limits (for stress tests)")
+	restProtoNames   = flag.Bool("rest-proto-names", getEnvBool("GCP_KMS_REST_PROTO_NAMES", false), "Write snake_case proto field names in REST responses instead of the camelCase names of the real API")
+	pkcs11Module     = flag.String("pkcs11-module", getEnv("GCP_KMS_PKCS11_MODULE", ""), "Keep the key material of selected keys in an HSM through this PKCS#11 library (empty disables)")
+	pkcs11Token      = flag.String("pkcs11-token", getEnv("GCP_KMS_PKCS11_TOKEN", ""), "Label of the PKCS#11 token holding the keys (empty picks the first token)")
+	pkcs11PIN        = flag.String("pkcs11-pin", getEnv("GCP_KMS_PKCS11_PIN", ""), "User PIN of the PKCS#11 token")
+	pkcs11Keys       = flag.String("pkcs11-keys", getEnv("GCP_KMS_PKCS11_KEYS", ""), "Keep new versions of crypto keys matching these comma-separated patterns in the HSM; keys labelled emulator-key-backend=pkcs11 are kept there too")
+	version          = "0.1.0"
+)
+
+func init() {
+	// --port predates --grpc-port and is kept for existing scripts
+	flag.IntVar(grpcPort, "port", *grpcPort, "Alias for --grpc-port")
+}
+
+// Main parses the command line and runs the emulator until it receives
+// SIGINT or SIGTERM, or a stop request when running as a Windows service.
+// defaultMode is used when neither --mode nor GCP_KMS_MODE is set.
+func Main(defaultMode string) {
+	flag.Parse()
+
+	if *mode == "" {
+		*mode = defaultMode
+	}
+	switch *mode {
+	case ModeGRPC, ModeREST, ModeDual:
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid mode %q (expected grpc, rest or dual)\n", *mode)
+		os.Exit(service.ExitConfig)
+	}
+	switch *gatewayTransport {
+	case transportInProcess, transportLoopback:
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid gateway transport %q (expected inprocess or loopback)\n", *gatewayTransport)
+		os.Exit(service.ExitConfig)
+	}
+
+	for name, d := range map[string]time.Duration{
+		"keepalive-time":           *keepaliveTime,
+		"keepalive-timeout":        *keepaliveTimeout,
+		"max-connection-idle":      *maxConnIdle,
+		"max-connection-age":       *maxConnAge,
+		"max-connection-age-grace": *maxConnAgeGrace,
+		"keepalive-min-time":       *keepaliveMinTime,
+	} {
+		if d < 0 {
+			fmt.Fprintf(os.Stderr, "Invalid --%s %s (must not be negative)\n", name, d)
+			os.Exit(service.ExitConfig)
+		}
+	}
+
+	if service.IsWindowsService() {
+		os.Exit(service.RunWindowsService(func(stop <-chan struct{}) int {
+			run(stop)
+			return service.ExitOK
+		}))
+	}
+	run(nil)
+}
+
+// serveGRPCPublicly reports whether the gRPC API is exposed to clients
+func serveGRPCPublicly() bool {
+	return *mode == ModeGRPC || *mode == ModeDual
+}
+
+// serveREST reports whether the REST gateway is started
+func serveREST() bool {
+	return *mode == ModeREST || *mode == ModeDual
+}
+
+// gatewayInProcess reports whether the gateway uses an in-memory connection
+// to the gRPC server
+func gatewayInProcess() bool {
+	return serveREST() && *gatewayTransport == transportInProcess
+}
+
+// flagSettings reports the effective value of every flag for /admin/config
+func flagSettings() map[string]string {
+	settings := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		settings[f.Name] = f.Value.String()
+	})
+	return settings
+}
+
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return defaultValue
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		var intValue int
+		if _, err := fmt.Sscanf(value, "%d", &intValue); err == nil {
+			return intValue
+		}
+	}
+	return defaultValue
+}
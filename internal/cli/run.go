@@ -0,0 +1,710 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/iam/apiv1/iampb"
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	locationpb "google.golang.org/genproto/googleapis/cloud/location"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/encoding/gzip" // accept gzip-compressed RPCs
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/admin"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/auditlog"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/authz"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/bulk"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/capabilities"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/config"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/fault"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/gateway"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/hsm"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/logging"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/mirror"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/notify"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/principal"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/proxy"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/recording"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/routing"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/server"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/service"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/statestore"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/webhook"
+)
+
+// inProcessBufferSize is the buffer of the in-memory gateway connection
+const inProcessBufferSize = 1 << 20
+
+// run serves until SIGINT or SIGTERM, or until stop is closed (by the Windows
+// service control manager), then shuts down cleanly
+func run(stop <-chan struct{}) {
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(service.ExitConfig)
+	}
+	logLevelVar := new(slog.LevelVar)
+	logLevelVar.Set(level)
+
+	logger, err := logging.New(os.Stderr, logLevelVar, *logFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(service.ExitConfig)
+	}
+	slog.SetDefault(logger)
+
+	if *stateFile != "" && *stateURI != "" {
+		fatalConfig("--state-file and --state-uri are mutually exclusive")
+	}
+
+	if *migrateState {
+		if *stateFile == "" {
+			fatalConfig("--migrate-state requires --state-file")
+		}
+		from, err := storage.MigrateStateFile(*stateFile)
+		if err != nil {
+			fatal("Failed to migrate state file", "error", err)
+		}
+		slog.Info("State file migrated", "path", *stateFile, "from", from, "to", storage.CurrentStateVersion)
+		return
+	}
+
+	slog.Info("GCP KMS Emulator", "version", version, "mode", *mode, "log_level", *logLevel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The gRPC port is opened unless the server only backs an in-process
+	// gateway. In rest mode it only backs the gateway, so it stays on loopback.
+	var lis net.Listener
+	grpcAddr := listenAddr(*grpcPort)
+	if !serveGRPCPublicly() {
+		grpcAddr = net.JoinHostPort("localhost", strconv.Itoa(*grpcPort))
+	}
+	if serveGRPCPublicly() || !gatewayInProcess() {
+		lis, err = net.Listen("tcp", grpcAddr)
+		if err != nil {
+			fatal("Failed to listen on gRPC port", "error", err)
+		}
+	}
+
+	// The in-process gateway reaches the gRPC server over an in-memory pipe
+	var inProcessLis *bufconn.Listener
+	if gatewayInProcess() {
+		inProcessLis = bufconn.Listen(inProcessBufferSize)
+	}
+
+	// Cloud KMS rejects oversized messages; --relax-size-limits lifts the caps
+	maxMessageBytes := server.MaxMessageBytes
+	if *relaxSizeLimits {
+		maxMessageBytes = math.MaxInt32
+		slog.Warn("Message size limits relaxed")
+	}
+	grpcOpts := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(maxMessageBytes),
+		grpc.MaxSendMsgSize(maxMessageBytes),
+	}
+	grpcOpts = append(grpcOpts, keepaliveOptions()...)
+	if *tlsCert != "" || *tlsKey != "" {
+		creds, err := credentials.NewServerTLSFromFile(*tlsCert, *tlsKey)
+		if err != nil {
+			fatalConfig("Failed to load TLS credentials", "error", err)
+		}
+		grpcOpts = append(grpcOpts, grpc.Creds(creds))
+		slog.Info("TLS enabled", "cert", *tlsCert)
+	}
+
+	// Fault rules and chaos run innermost so injected failures are logged and counted
+	stats := admin.NewStats()
+	faults := fault.NewInjector()
+	if lis != nil {
+		lis = faults.WrapListener(lis)
+	}
+	chaos, err := fault.NewChaos(*chaosRate)
+	if err != nil {
+		fatalConfig("Invalid chaos rate", "error", err)
+	}
+	if *chaosRate > 0 {
+		slog.Warn("Chaos mode enabled", "rate", *chaosRate)
+	}
+	// The principal is resolved first, so every interceptor sees it
+	var keys *principal.KeySet
+	if *jwksSources != "" {
+		keys, err = principal.LoadKeySet(ctx, splitList(*jwksSources)...)
+		if err != nil {
+			fatalConfig("Failed to load JWKS", "error", err)
+		}
+		slog.Info("Verifying Bearer JWTs", "jwks", splitList(*jwksSources))
+	}
+	interceptors := []grpc.UnaryServerInterceptor{
+		principal.NewResolver(keys).UnaryServerInterceptor(),
+		logging.UnaryServerInterceptor(logger),
+		routing.UnaryServerInterceptor(),
+		stats.UnaryServerInterceptor(),
+		faults.UnaryServerInterceptor(),
+		chaos.UnaryServerInterceptor(),
+	}
+
+	// Forwarded calls end here: audit logging, recording and notifications
+	// describe emulated resources only
+	if *proxyResources != "" || *proxyUnimpl {
+		upstream, err := proxy.Dial(ctx, *proxyEndpoint)
+		if err != nil {
+			fatalConfig("Failed to connect to Cloud KMS", "endpoint", *proxyEndpoint, "error", err)
+		}
+		defer upstream.Close()
+		patterns := splitList(*proxyResources)
+		px, err := proxy.New(upstream, patterns, *proxyUnimpl)
+		if err != nil {
+			fatalConfig("Invalid proxy configuration", "error", err)
+		}
+		interceptors = append(interceptors, px.UnaryServerInterceptor())
+		if *proxyUnimpl {
+			grpcOpts = append(grpcOpts, grpc.UnknownServiceHandler(px.UnknownServiceHandler()))
+		}
+		slog.Warn("Forwarding calls to Cloud KMS", "endpoint", *proxyEndpoint, "resources", patterns, "unimplemented", *proxyUnimpl)
+	}
+
+	// Audit logging runs after fault injection so only calls that reach the
+	// service are audited, as in Cloud KMS
+	if *auditLog != "" {
+		var auditOut io.Writer = os.Stdout
+		if *auditLog != "-" {
+			f, err := os.OpenFile(*auditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+			if err != nil {
+				fatal("Failed to open audit log", "error", err)
+			}
+			defer f.Close()
+			auditOut = f
+		}
+		interceptors = append(interceptors, auditlog.New(auditOut).UnaryServerInterceptor())
+		slog.Info("Audit logging enabled", "path", *auditLog)
+	}
+
+	// Recording sits with audit logging so only calls that reach the service
+	// are replayed
+	if *recordFile != "" {
+		var recordOut io.Writer = os.Stdout
+		if *recordFile != "-" {
+			f, err := os.OpenFile(*recordFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+			if err != nil {
+				fatal("Failed to open recording file", "error", err)
+			}
+			defer f.Close()
+			recordOut = f
+		}
+		interceptors = append(interceptors, recording.NewRecorder(recordOut).UnaryServerInterceptor())
+		slog.Info("Recording calls", "path", *recordFile)
+	}
+
+	var publisher *notify.Publisher
+	if *pubsubTopic != "" {
+		if *pubsubHost == "" {
+			fatalConfig("--pubsub-topic requires --pubsub-host or PUBSUB_EMULATOR_HOST")
+		}
+		publisher, err = notify.NewPublisher(*pubsubHost, *pubsubTopic)
+		if err != nil {
+			fatalConfig("Invalid Pub/Sub configuration", "error", err)
+		}
+		// The Pub/Sub emulator may still be starting; the topic is created again
+		// when the first publish finds it missing
+		topicCtx, cancelTopic := context.WithTimeout(ctx, 5*time.Second)
+		if err := publisher.EnsureTopic(topicCtx); err != nil {
+			slog.Warn("Could not create Pub/Sub topic", "error", err)
+		}
+		cancelTopic()
+		interceptors = append(interceptors, publisher.UnaryServerInterceptor())
+		slog.Info("Publishing key lifecycle events", "topic", *pubsubTopic, "host", *pubsubHost)
+	}
+
+	var sender *webhook.Sender
+	if *webhookURL != "" {
+		sender, err = webhook.NewSender(webhook.Config{URL: *webhookURL, Filter: splitList(*webhookFilter), Retries: *webhookRetries})
+		if err != nil {
+			fatalConfig("Invalid webhook configuration", "error", err)
+		}
+		interceptors = append(interceptors, sender.UnaryServerInterceptor())
+		slog.Info("Sending events to webhook", "url", *webhookURL, "filter", splitList(*webhookFilter))
+	}
+	grpcOpts = append(grpcOpts, grpc.ChainUnaryInterceptor(interceptors...))
+	grpcServer := grpc.NewServer(grpcOpts...)
+
+	// Create and register KMS service
+	kmsServer, err := server.NewServer()
+	if err != nil {
+		fatal("Failed to create KMS server", "error", err)
+	}
+	if err := kmsServer.SetCustomLocations(splitList(*extraLocations)); err != nil {
+		fatalConfig("Invalid --extra-locations", "error", err)
+	}
+	if *relaxSizeLimits {
+		kmsServer.SetMaxPayloadBytes(0)
+	}
+	kmsServer.Storage().SetDestroyScheduledDuration(*destroyDelay)
+	if *pkcs11Module != "" {
+		backend, err := hsm.Open(hsm.Config{Module: *pkcs11Module, TokenLabel: *pkcs11Token, PIN: *pkcs11PIN})
+		if err != nil {
+			fatalConfig("Failed to open PKCS#11 token", "error", err)
+		}
+		defer backend.Close()
+		if err := kmsServer.Storage().SetKeyBackend(backend, splitList(*pkcs11Keys)); err != nil {
+			fatalConfig("Invalid --pkcs11-keys", "error", err)
+		}
+		slog.Info("PKCS#11 key backend enabled", "module", *pkcs11Module, "keys", splitList(*pkcs11Keys))
+	}
+	if *mockCrypto {
+		kmsServer.Storage().SetMockCrypto(true)
+		slog.Warn("MOCK CRYPTO ENABLED: Encrypt and Decrypt do not encrypt, and ciphertexts contain the plaintext")
+	}
+	if *deterministic {
+		kmsServer.Storage().SetDeterministicEncryption(true)
+		slog.Info("Deterministic encryption enabled for all crypto keys")
+	}
+	if *frozenTime != "" {
+		t, err := time.Parse(time.RFC3339Nano, *frozenTime)
+		if err != nil {
+			fatalConfig("Invalid --frozen-time", "error", err)
+		}
+		kmsServer.Storage().SetFrozenTime(t)
+		slog.Info("Clock frozen", "time", t.UTC())
+	}
+	kmsServer.Storage().StartDestroyer(ctx, storage.DestroyCheckInterval)
+	if *keyPool != "" {
+		sizes, err := storage.ParseKeyPool(*keyPool)
+		if err == nil {
+			err = kmsServer.Storage().StartKeyPool(ctx, sizes)
+		}
+		if err != nil {
+			fatalConfig("Invalid --key-pool", "error", err)
+		}
+		slog.Info("Key pool enabled", "sizes", sizes)
+	}
+	if *keyGenWorkers > 0 {
+		limits, err := storage.ParseGenerationLimits(*keyGenLimits)
+		if err == nil {
+			err = kmsServer.Storage().StartKeyGeneration(ctx, *keyGenWorkers, limits)
+		}
+		if err != nil {
+			fatalConfig("Invalid --key-generation-limits", "error", err)
+		}
+		slog.Info("Background key generation enabled", "workers", *keyGenWorkers, "limits", limits)
+	}
+	if *iamCacheTTL > 0 {
+		kmsServer.SetIAMCacheTTL(*iamCacheTTL)
+	}
+	if *iamPolicyFile != "" {
+		policy, err := authz.LoadPolicy(*iamPolicyFile)
+		if err != nil {
+			fatalConfig("Failed to load IAM policy", "error", err)
+		}
+		if err := kmsServer.SetIAMPolicy(policy); err != nil {
+			fatal("Failed to apply IAM policy", "error", err)
+		}
+		slog.Info("IAM policy loaded", "path", *iamPolicyFile, "iamMode", kmsServer.IAMMode().String())
+	}
+
+	// Apply the runtime configuration file; it is re-read on SIGHUP
+	runtimeConfig := &config.Runtime{
+		LogLevel: logLevelVar,
+		Chaos:    chaos,
+		Faults:   faults,
+		KMS:      kmsServer,
+	}
+	var reloadConfig func() error
+	if *configFile != "" {
+		reloadConfig = func() error { return runtimeConfig.Reload(*configFile) }
+		if err := reloadConfig(); err != nil {
+			fatalConfig("Failed to load config file", "error", err)
+		}
+		slog.Info("Config file loaded", "path", *configFile)
+	}
+
+	// Restore persisted state (a missing file just means a fresh start)
+	if *stateFile != "" {
+		if err := kmsServer.Storage().LoadStateFile(*stateFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fatal("Failed to load state", "error", err)
+		}
+	}
+
+	// Restore state snapshot from object storage
+	var stateStore statestore.Store
+	syncCtx, stopSync := context.WithCancel(context.Background())
+	defer stopSync()
+	if *stateURI != "" {
+		stateStore, err = statestore.Open(*stateURI)
+		if err != nil {
+			fatalConfig("Invalid state URI", "error", err)
+		}
+		if err := statestore.Restore(syncCtx, stateStore, kmsServer.Storage()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fatal("Failed to restore state", "error", err)
+		}
+		statestore.StartSync(syncCtx, stateStore, kmsServer.Storage(), *stateSync)
+		slog.Info("State snapshot configured", "uri", stateStore.String())
+	}
+
+	// Mirrored and imported resources load on top of restored state, which
+	// may already hold them
+	if *mirrorSources != "" {
+		upstream, err := proxy.Dial(ctx, *proxyEndpoint)
+		if err != nil {
+			fatalConfig("Failed to connect to Cloud KMS", "endpoint", *proxyEndpoint, "error", err)
+		}
+		for _, source := range splitList(*mirrorSources) {
+			rings, err := mirror.Fetch(ctx, upstream, source)
+			if err != nil {
+				fatal("Failed to read mirrored resources", "source", source, "error", err)
+			}
+			stats, err := kmsServer.Storage().LoadMirror(rings)
+			if err != nil {
+				fatal("Failed to load mirrored resources", "source", source, "error", err)
+			}
+			for _, skipped := range stats.Skipped {
+				slog.Warn("Resource not mirrored", "reason", skipped)
+			}
+			slog.Info("Mirrored Cloud KMS resources", "source", source, "key_rings", stats.KeyRings, "crypto_keys", stats.CryptoKeys, "versions", stats.CryptoKeyVersions)
+		}
+		upstream.Close()
+	}
+
+	if *gcloudImport != "" {
+		paths := splitList(*gcloudImport)
+		rings, err := storage.ReadGCloudExports(paths...)
+		if err != nil {
+			fatalConfig("Failed to read gcloud exports", "error", err)
+		}
+		stats, err := kmsServer.Storage().LoadMirror(rings)
+		if err != nil {
+			fatalConfig("Failed to import gcloud exports", "error", err)
+		}
+		for _, skipped := range stats.Skipped {
+			slog.Warn("Resource not imported", "reason", skipped)
+		}
+		slog.Info("gcloud exports imported", "paths", paths, "key_rings", stats.KeyRings, "crypto_keys", stats.CryptoKeys, "versions", stats.CryptoKeyVersions)
+	}
+
+	// Fixtures load on top of restored, mirrored and imported state, which may
+	// already hold them
+	if *fixturesFile != "" {
+		fixtures, err := storage.ReadFixtures(*fixturesFile)
+		if err != nil {
+			fatalConfig("Failed to read fixtures", "error", err)
+		}
+		created, err := kmsServer.Storage().LoadFixtures(fixtures)
+		if err != nil {
+			fatalConfig("Failed to load fixtures", "error", err)
+		}
+		slog.Info("Fixtures loaded", "path", *fixturesFile, "versions", len(fixtures.Versions), "created", created)
+	}
+
+	kmspb.RegisterKeyManagementServiceServer(grpcServer, kmsServer)
+	iampb.RegisterIAMPolicyServer(grpcServer, kmsServer.IAMPolicy())
+	locationpb.RegisterLocationsServer(grpcServer, kmsServer.Locations())
+	capabilities.NewReporter(version, kmsServer, capabilityFeatures()).Register(grpcServer)
+	if *extensions {
+		bulk.NewService(kmsServer, interceptors...).Register(grpcServer)
+		slog.Info("Emulator extensions enabled", "services", []string{bulk.ServiceName})
+	}
+
+	// Register reflection service (for grpc_cli debugging)
+	reflection.Register(grpcServer)
+
+	// Start admin API on its own port so KMS clients can never reach it
+	var adminServer *admin.Server
+	if *adminPort != 0 {
+		var pricing *admin.Pricing
+		if *pricingFile != "" {
+			if pricing, err = admin.LoadPricing(*pricingFile); err != nil {
+				fatalConfig("Failed to load --pricing-file", "error", err)
+			}
+		}
+		adminServer = admin.NewServer(kmsServer.Storage(), stats, admin.Config{
+			Version:   version,
+			Settings:  flagSettings(),
+			LogLevel:  logLevelVar,
+			Faults:    faults,
+			Chaos:     chaos,
+			Reload:    reloadConfig,
+			Decisions: kmsServer.Decisions(),
+			IAMCache:  kmsServer.IAMCache(),
+			Pricing:   pricing,
+		})
+		adminAddr := listenAddr(*adminPort)
+		go func() {
+			slog.Info("Admin API listening", "addr", adminAddr)
+			if err := adminServer.Start(adminAddr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("Failed to serve admin API", "error", err)
+			}
+		}()
+	}
+
+	// Start gRPC server in background
+	if lis != nil {
+		go func() {
+			slog.Info("gRPC server listening", "addr", lis.Addr().String())
+			if err := grpcServer.Serve(lis); err != nil {
+				fatal("Failed to serve gRPC", "error", err)
+			}
+		}()
+	}
+	if inProcessLis != nil {
+		go func() {
+			if err := grpcServer.Serve(faults.WrapListener(inProcessLis)); err != nil {
+				fatal("Failed to serve in-process gRPC", "error", err)
+			}
+		}()
+	}
+
+	// Start REST gateway
+	var gatewayServer *gateway.Server
+	if serveREST() {
+		httpAddr := listenAddr(*httpPort)
+		// The gateway dials our own gRPC server, so it skips
+		// certificate verification rather than requiring a cert valid for that address
+		scheme := "http"
+		var gatewayDialOpts []grpc.DialOption
+		if *tlsCert != "" {
+			scheme = "https"
+			gatewayDialOpts = append(gatewayDialOpts, grpc.WithTransportCredentials(
+				credentials.NewTLS(&tls.Config{InsecureSkipVerify: true}), //nolint:gosec // loopback to our own listener
+			))
+		}
+		gatewayTarget := dialAddr(*grpcPort)
+		if !serveGRPCPublicly() {
+			gatewayTarget = grpcAddr
+		}
+		if inProcessLis != nil {
+			gatewayTarget = "passthrough:///in-process"
+			gatewayDialOpts = append(gatewayDialOpts, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return inProcessLis.DialContext(ctx)
+			}))
+		}
+		gatewayDialOpts = append(gatewayDialOpts, grpc.WithDefaultCallOptions(
+			grpc.MaxCallRecvMsgSize(maxMessageBytes),
+			grpc.MaxCallSendMsgSize(maxMessageBytes),
+		))
+		gatewayServer, err = gateway.NewServer(gatewayTarget, gatewayDialOpts...)
+		if err != nil {
+			fatal("Failed to create HTTP gateway", "error", err)
+		}
+		if *relaxSizeLimits {
+			gatewayServer.SetMaxBodyBytes(0)
+		}
+		gatewayServer.SetProtoNames(*restProtoNames)
+		slog.Debug("HTTP gateway transport", "transport", *gatewayTransport, "target", gatewayTarget)
+
+		go func() {
+			slog.Info("HTTP gateway listening", "addr", httpAddr)
+			slog.Info("Endpoints", "rest", fmt.Sprintf("%s://%s/v1/projects/{project}/locations/{location}/keyRings", scheme, dialAddr(*httpPort)))
+			serve := func() error { return gatewayServer.Start(ctx, httpAddr) }
+			if *tlsCert != "" {
+				serve = func() error { return gatewayServer.StartTLS(ctx, httpAddr, *tlsCert, *tlsKey) }
+			}
+			if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("Failed to serve HTTP", "error", err)
+			}
+		}()
+	}
+
+	slog.Info("Ready to accept connections")
+	if err := service.Ready("Ready to accept connections"); err != nil {
+		slog.Warn("Failed to notify service manager", "error", err)
+	}
+	service.StartWatchdog(ctx)
+
+	if reloadConfig != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				_ = service.Reloading()
+				if err := reloadConfig(); err != nil {
+					slog.Error("Config reload failed, keeping previous settings", "error", err)
+				} else {
+					slog.Info("Config reloaded", "path", *configFile)
+				}
+				_ = service.Ready("Ready to accept connections")
+			}
+		}()
+	}
+
+	// Wait for interrupt signal to gracefully shutdown
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-quit:
+	case <-stop:
+	}
+	_ = service.Stopping()
+
+	// A second signal skips the drain
+	go func() {
+		<-quit
+		fatal("Received second signal, exiting without draining or saving state")
+	}()
+
+	slog.Info("Shutting down...", "drain_timeout", shutdownTimeout.String())
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancelShutdown()
+
+	if adminServer != nil {
+		if err := adminServer.Stop(shutdownCtx); err != nil {
+			slog.Error("Error stopping admin API", "error", err)
+		}
+	}
+
+	// Stop accepting REST requests and let in-flight ones finish first;
+	// they still need the gRPC server
+	if gatewayServer != nil {
+		if err := gatewayServer.Stop(shutdownCtx); err != nil {
+			slog.Error("Error stopping HTTP gateway", "error", err)
+		}
+	}
+
+	// Stop accepting new RPCs and finish in-flight ones
+	drainGRPC(shutdownCtx, grpcServer)
+
+	if publisher != nil {
+		if err := publisher.Close(shutdownCtx); err != nil {
+			slog.Error("Error publishing remaining lifecycle events", "error", err)
+		}
+	}
+	if sender != nil {
+		if err := sender.Close(shutdownCtx); err != nil {
+			slog.Error("Error delivering remaining webhook events", "error", err)
+		}
+	}
+
+	if *stateFile != "" {
+		if err := kmsServer.Storage().SaveStateFile(*stateFile); err != nil {
+			slog.Error("Error saving state", "error", err)
+		}
+	}
+
+	if stateStore != nil {
+		stopSync()
+		if err := statestore.Persist(context.Background(), stateStore, kmsServer.Storage()); err != nil {
+			slog.Error("Error uploading state", "error", err)
+		}
+	}
+
+	slog.Info("Server stopped")
+}
+
+// listenAddr returns the address to listen on for port, honoring --host
+func listenAddr(port int) string {
+	return net.JoinHostPort(*host, strconv.Itoa(port))
+}
+
+// dialAddr returns the address local clients use to reach port. Wildcard
+// hosts are reached over loopback; specific hosts are dialed directly.
+func dialAddr(port int) string {
+	h := *host
+	if ip := net.ParseIP(h); h == "" || (ip != nil && ip.IsUnspecified()) {
+		h = "localhost"
+	}
+	return net.JoinHostPort(h, strconv.Itoa(port))
+}
+
+// capabilityFeatures describes the enabled features for the capability report
+func capabilityFeatures() capabilities.Features {
+	features := capabilities.Features{
+		Persistence:            "none",
+		TLS:                    *tlsCert != "",
+		AdminAPI:               *adminPort != 0,
+		AuditLog:               *auditLog != "",
+		LifecycleNotifications: *pubsubTopic != "",
+		Webhook:                *webhookURL != "",
+		Compression:            []string{"gzip"},
+		MaxMessageBytes:        server.MaxMessageBytes,
+		MaxPayloadBytes:        server.MaxPayloadBytes,
+	}
+	if serveGRPCPublicly() {
+		features.Protocols = append(features.Protocols, "grpc")
+	}
+	if serveREST() {
+		features.Protocols = append(features.Protocols, "rest")
+	}
+	switch {
+	case *stateFile != "":
+		features.Persistence = "file"
+	case *stateURI != "":
+		features.Persistence = "snapshot"
+	}
+	features.MockCrypto = *mockCrypto
+	features.DeterministicEncryption = *deterministic
+	features.FrozenTime = *frozenTime
+	if *extensions {
+		features.Extensions = append(features.Extensions, bulk.ServiceName)
+	}
+	if *relaxSizeLimits {
+		features.MaxMessageBytes = 0
+		features.MaxPayloadBytes = 0
+	}
+	return features
+}
+
+// keepaliveOptions returns the keepalive parameters and ping enforcement
+// policy configured by the keepalive and max-connection flags
+func keepaliveOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:                  *keepaliveTime,
+			Timeout:               *keepaliveTimeout,
+			MaxConnectionIdle:     *maxConnIdle,
+			MaxConnectionAge:      *maxConnAge,
+			MaxConnectionAgeGrace: *maxConnAgeGrace,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             *keepaliveMinTime,
+			PermitWithoutStream: *permitNoStream,
+		}),
+	}
+}
+
+// drainGRPC stops accepting new RPCs and waits for in-flight ones to finish.
+// Connections still busy when ctx expires are closed.
+func drainGRPC(ctx context.Context, s *grpc.Server) {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("Drain deadline exceeded, closing remaining connections")
+		s.Stop()
+		<-done
+	}
+}
+
+// fatal exits after a runtime failure
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(service.ExitFailure)
+}
+
+// fatalConfig exits after a configuration error; service managers should not
+// restart the emulator until the configuration is fixed
+func fatalConfig(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(service.ExitConfig)
+}
@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/admin"
+)
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer lis.Close()
+	return lis.Addr().(*net.TCPAddr).Port
+}
+
+func TestAdminResetNotOnKMSPort(t *testing.T) {
+	t.Setenv("IAM_MODE", "off")
+	*mode, *host = ModeGRPC, "localhost"
+	*grpcPort, *adminPort = freePort(t), freePort(t)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run(stop)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		resp, err := http.Get("http://" + dialAddr(*adminPort) + "/health")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Admin API did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	invoke := func(port int) error {
+		conn, err := grpc.NewClient(dialAddr(port), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatalf("NewClient failed: %v", err)
+		}
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return conn.Invoke(ctx, admin.ResetMethod, &structpb.Struct{}, new(structpb.Struct), grpc.WaitForReady(true))
+	}
+	if err := invoke(*grpcPort); status.Code(err) != codes.Unimplemented {
+		t.Errorf("Expected Reset to be Unimplemented on the KMS port, got %v", err)
+	}
+	if err := invoke(*adminPort); err != nil {
+		t.Errorf("Expected Reset to be served on the admin port, got %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+// Package config loads the emulator's runtime configuration file.
+//
+// The file holds the settings that can change while the emulator runs, so a
+// test suite can reconfigure it without a restart (which would wipe state).
+// It is applied at startup and again on SIGHUP or POST /admin/config:reload.
+//
+// # Format
+//
+//	{
+//	  "logLevel": "debug",
+//	  "chaos": 0.05,
+//	  "iamMode": "strict",
+//	  "faults": [
+//	    {"method": "Decrypt", "action": "error", "code": "UNAVAILABLE", "times": 2}
+//	  ]
+//	}
+//
+// Every field is optional; omitted settings keep their current value. A
+// present "faults" list replaces all fault rules, so "faults": [] clears them.
+// Unknown fields are rejected so typos do not silently do nothing.
+//
+// A reload is all or nothing: the whole file is validated before any
+// setting changes.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	emulatorauth "github.com/blackwell-systems/gcp-emulator-auth"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/fault"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/logging"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/server"
+)
+
+// File is the contents of a runtime configuration file
+type File struct {
+	// LogLevel is debug, info, warn or error
+	LogLevel *string `json:"logLevel,omitempty"`
+	// Chaos is the fraction of calls failed with retryable errors
+	Chaos *float64 `json:"chaos,omitempty"`
+	// IAMMode is off, permissive or strict
+	IAMMode *string `json:"iamMode,omitempty"`
+	// Faults replaces the fault injection rules when present
+	Faults []fault.Rule `json:"faults,omitempty"`
+}
+
+// Load reads and validates the configuration file at path
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f File
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if err := f.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return &f, nil
+}
+
+// Validate checks every setting without applying any
+func (f *File) Validate() error {
+	if f.LogLevel != nil {
+		if _, err := logging.ParseLevel(*f.LogLevel); err != nil {
+			return err
+		}
+	}
+	if f.Chaos != nil {
+		if err := fault.ValidateChaosRate(*f.Chaos); err != nil {
+			return err
+		}
+	}
+	if f.IAMMode != nil {
+		if _, err := parseIAMMode(*f.IAMMode); err != nil {
+			return err
+		}
+	}
+	if f.Faults != nil {
+		if err := fault.ValidateRules(f.Faults); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Runtime holds the components a configuration file reconfigures. Nil
+// components are skipped.
+type Runtime struct {
+	LogLevel *slog.LevelVar
+	Chaos    *fault.Chaos
+	Faults   *fault.Injector
+	KMS      *server.Server
+}
+
+// Reload loads the file at path and applies it
+func (rt *Runtime) Reload(path string) error {
+	f, err := Load(path)
+	if err != nil {
+		return err
+	}
+	return rt.Apply(f)
+}
+
+// Apply validates f and then applies every setting it contains
+func (rt *Runtime) Apply(f *File) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+
+	// Switching IAM mode is the only step that can fail, so it goes first
+	if f.IAMMode != nil && rt.KMS != nil {
+		mode, _ := parseIAMMode(*f.IAMMode)
+		if mode != rt.KMS.IAMMode() {
+			if err := rt.KMS.SetIAMMode(mode); err != nil {
+				return err
+			}
+			slog.Info("IAM mode changed", "mode", mode.String())
+		}
+	}
+	if f.Faults != nil && rt.Faults != nil {
+		if err := rt.Faults.SetRules(f.Faults); err != nil {
+			return err
+		}
+		slog.Info("Fault rules replaced", "rules", len(f.Faults))
+	}
+	if f.LogLevel != nil && rt.LogLevel != nil {
+		if level, _ := logging.ParseLevel(*f.LogLevel); level != rt.LogLevel.Level() {
+			rt.LogLevel.Set(level)
+			slog.Info("Log level changed", "level", level.String())
+		}
+	}
+	if f.Chaos != nil && rt.Chaos != nil && *f.Chaos != rt.Chaos.Rate() {
+		if err := rt.Chaos.SetRate(*f.Chaos); err != nil {
+			return err
+		}
+		slog.Info("Chaos rate changed", "rate", *f.Chaos)
+	}
+	return nil
+}
+
+// parseIAMMode is stricter than emulatorauth.ParseAuthMode, which maps
+// unknown values to off
+func parseIAMMode(s string) (emulatorauth.AuthMode, error) {
+	switch mode := emulatorauth.AuthMode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case emulatorauth.AuthModeOff, emulatorauth.AuthModePermissive, emulatorauth.AuthModeStrict:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid IAM mode %q (expected off, permissive or strict)", s)
+	}
+}
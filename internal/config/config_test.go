@@ -0,0 +1,109 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	emulatorauth "github.com/blackwell-systems/gcp-emulator-auth"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/fault"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/server"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return path
+}
+
+func newRuntime(t *testing.T) *Runtime {
+	t.Helper()
+	t.Setenv("IAM_MODE", "off")
+
+	chaos, err := fault.NewChaos(0)
+	if err != nil {
+		t.Fatalf("NewChaos failed: %v", err)
+	}
+	kms, err := server.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	return &Runtime{
+		LogLevel: new(slog.LevelVar),
+		Chaos:    chaos,
+		Faults:   fault.NewInjector(),
+		KMS:      kms,
+	}
+}
+
+func TestReload(t *testing.T) {
+	rt := newRuntime(t)
+	path := writeConfig(t, `{
+		"logLevel": "debug",
+		"chaos": 0.25,
+		"iamMode": "permissive",
+		"faults": [{"method": "Decrypt", "action": "error", "code": "UNAVAILABLE"}]
+	}`)
+
+	if err := rt.Reload(path); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if rt.LogLevel.Level() != slog.LevelDebug {
+		t.Errorf("Expected debug level, got %v", rt.LogLevel.Level())
+	}
+	if rt.Chaos.Rate() != 0.25 {
+		t.Errorf("Expected chaos 0.25, got %v", rt.Chaos.Rate())
+	}
+	if rt.KMS.IAMMode() != emulatorauth.AuthModePermissive {
+		t.Errorf("Expected permissive IAM mode, got %v", rt.KMS.IAMMode())
+	}
+	if rules := rt.Faults.Rules(); len(rules) != 1 || rules[0].Method != "Decrypt" {
+		t.Errorf("Expected one Decrypt rule, got %v", rules)
+	}
+
+	// Omitted settings keep their value; an empty fault list clears rules
+	if err := rt.Reload(writeConfig(t, `{"iamMode": "off", "faults": []}`)); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if rt.LogLevel.Level() != slog.LevelDebug || rt.Chaos.Rate() != 0.25 {
+		t.Errorf("Omitted settings changed: level %v, chaos %v", rt.LogLevel.Level(), rt.Chaos.Rate())
+	}
+	if rt.KMS.IAMMode() != emulatorauth.AuthModeOff || len(rt.Faults.Rules()) != 0 {
+		t.Errorf("Expected IAM off and no rules, got %v %v", rt.KMS.IAMMode(), rt.Faults.Rules())
+	}
+}
+
+func TestReloadIsAllOrNothing(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{"invalid chaos", `{"logLevel": "debug", "chaos": 2}`},
+		{"invalid log level", `{"logLevel": "verbose", "chaos": 0.5}`},
+		{"invalid IAM mode", `{"logLevel": "debug", "iamMode": "sometimes"}`},
+		{"invalid fault rule", `{"logLevel": "debug", "faults": [{"action": "explode"}]}`},
+		{"unknown setting", `{"logLevel": "debug", "latency": "5s"}`},
+		{"malformed JSON", `{"logLevel": `},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := newRuntime(t)
+			if err := rt.Reload(writeConfig(t, tt.contents)); err == nil {
+				t.Fatal("Expected reload to fail")
+			}
+			if rt.LogLevel.Level() != slog.LevelInfo || rt.Chaos.Rate() != 0 {
+				t.Errorf("Failed reload changed settings: level %v, chaos %v", rt.LogLevel.Level(), rt.Chaos.Rate())
+			}
+		})
+	}
+
+	if err := newRuntime(t).Reload(filepath.Join(t.TempDir(), "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected not-exist error, got %v", err)
+	}
+}
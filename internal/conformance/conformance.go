@@ -0,0 +1,329 @@
+// Package conformance runs the same scenarios against the emulator and real
+// Cloud KMS and compares the responses field by field, to check that the
+// emulator behaves like the service as methods are added.
+//
+// Each scenario issues a sequence of calls, recorded as steps. Steps are
+// compared by status code and, for successful calls, by every response
+// field. Fields that differ on every call, such as ciphertexts, signatures
+// and timestamps, are compared by presence only. Error messages are reported
+// but not compared.
+//
+// The suite in conformance_test.go runs against real Cloud KMS only when
+// GCP_KMS_CONFORMANCE_PROJECT is set (see the README). Resources are created
+// in a new key ring per run, since key rings cannot be deleted; versions are
+// scheduled for destruction afterwards so they stop being billed.
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// volatileFields differ between calls and targets, so only their presence is
+// compared
+var volatileFields = map[protoreflect.Name]bool{
+	"create_time":           true,
+	"generate_time":         true,
+	"destroy_time":          true,
+	"destroy_event_time":    true,
+	"next_rotation_time":    true,
+	"ciphertext":            true,
+	"ciphertext_crc32c":     true,
+	"signature":             true,
+	"signature_crc32c":      true,
+	"mac":                   true,
+	"mac_crc32c":            true,
+	"pem":                   true,
+	"pem_crc32c":            true,
+	"data":                  true,
+	"data_crc32c":           true,
+	"attestation":           true,
+	"initialization_vector": true,
+	"tag_length":            true,
+}
+
+// Target is a KMS to run scenarios against
+type Target struct {
+	Name   string
+	Client kmspb.KeyManagementServiceClient
+}
+
+// Scenario is a sequence of calls
+type Scenario struct {
+	Name string
+	// Run issues the calls, recording each with Env.Record. It returns an
+	// error if a call it depends on failed and it cannot go on.
+	Run func(ctx context.Context, env *Env) error
+}
+
+// Env is the environment of one scenario run on one target
+type Env struct {
+	Client kmspb.KeyManagementServiceClient
+	// Location and KeyRing are the full names of the location and of the key
+	// ring created for the run
+	Location string
+	KeyRing  string
+
+	steps []step
+}
+
+// step is one recorded call
+type step struct {
+	name    string
+	code    codes.Code
+	message string
+	fields  map[string]string
+}
+
+// Record records a call's outcome and returns err
+func (e *Env) Record(name string, resp proto.Message, err error) error {
+	s := step{name: name, code: status.Code(err)}
+	if err != nil {
+		s.message = status.Convert(err).Message()
+	} else if resp != nil {
+		s.fields = make(map[string]string)
+		flatten(resp.ProtoReflect(), "", s.fields)
+	}
+	e.steps = append(e.steps, s)
+	return err
+}
+
+// WaitForVersion waits for a version still being generated, as asymmetric
+// versions are in Cloud KMS. The polling calls are not recorded.
+func (e *Env) WaitForVersion(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	for {
+		v, err := e.Client.GetCryptoKeyVersion(ctx, &kmspb.GetCryptoKeyVersionRequest{Name: name})
+		if err != nil {
+			return err
+		}
+		if v.State != kmspb.CryptoKeyVersion_PENDING_GENERATION {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s is still being generated: %w", name, ctx.Err())
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// Report is the outcome of comparing a candidate with a reference
+type Report struct {
+	Reference, Candidate string
+	KeyRing              string
+	Scenarios            []ScenarioReport
+}
+
+// ScenarioReport compares one scenario
+type ScenarioReport struct {
+	Name string
+	// ReferenceError and CandidateError are set if the scenario stopped early
+	ReferenceError, CandidateError string
+	Steps                          []StepReport
+}
+
+// StepReport compares one call
+type StepReport struct {
+	Name        string
+	Differences []Difference
+}
+
+// Difference is a field whose values differ. Field is "code" for status
+// codes; a missing field has the value "<unset>".
+type Difference struct {
+	Field                string
+	Reference, Candidate string
+}
+
+// Differences counts the steps that differ
+func (r Report) Differences() int {
+	n := 0
+	for _, s := range r.Scenarios {
+		n += s.Differences()
+	}
+	return n
+}
+
+// Differences counts the steps of the scenario that differ, counting a
+// scenario that stopped on only one target as one
+func (s ScenarioReport) Differences() int {
+	n := 0
+	if (s.ReferenceError == "") != (s.CandidateError == "") {
+		n++
+	}
+	for _, st := range s.Steps {
+		if len(st.Differences) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Run creates keyRingID in location on both targets and runs the scenarios
+// against each, comparing candidate with reference. Versions created are
+// scheduled for destruction afterwards.
+func Run(ctx context.Context, scenarios []Scenario, location, keyRingID string, reference, candidate Target) (Report, error) {
+	report := Report{
+		Reference: reference.Name,
+		Candidate: candidate.Name,
+		KeyRing:   location + "/keyRings/" + keyRingID,
+	}
+	for _, target := range []Target{reference, candidate} {
+		if _, err := target.Client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: location, KeyRingId: keyRingID}); err != nil {
+			return report, fmt.Errorf("%s: failed to create key ring: %w", target.Name, err)
+		}
+		defer Cleanup(ctx, target.Client, report.KeyRing)
+	}
+
+	for _, scenario := range scenarios {
+		ref := &Env{Client: reference.Client, Location: location, KeyRing: report.KeyRing}
+		cand := &Env{Client: candidate.Client, Location: location, KeyRing: report.KeyRing}
+		sr := ScenarioReport{Name: scenario.Name}
+		if err := scenario.Run(ctx, ref); err != nil {
+			sr.ReferenceError = err.Error()
+		}
+		if err := scenario.Run(ctx, cand); err != nil {
+			sr.CandidateError = err.Error()
+		}
+		sr.Steps = compareSteps(ref.steps, cand.steps)
+		report.Scenarios = append(report.Scenarios, sr)
+	}
+	return report, nil
+}
+
+// Cleanup schedules every version in the key ring for destruction, ignoring
+// errors
+func Cleanup(ctx context.Context, client kmspb.KeyManagementServiceClient, keyRing string) {
+	keys, err := client.ListCryptoKeys(ctx, &kmspb.ListCryptoKeysRequest{Parent: keyRing, PageSize: 1000})
+	if err != nil {
+		return
+	}
+	for _, key := range keys.CryptoKeys {
+		versions, err := client.ListCryptoKeyVersions(ctx, &kmspb.ListCryptoKeyVersionsRequest{Parent: key.Name, PageSize: 1000})
+		if err != nil {
+			continue
+		}
+		for _, v := range versions.CryptoKeyVersions {
+			if v.State == kmspb.CryptoKeyVersion_ENABLED || v.State == kmspb.CryptoKeyVersion_DISABLED {
+				_, _ = client.DestroyCryptoKeyVersion(ctx, &kmspb.DestroyCryptoKeyVersionRequest{Name: v.Name})
+			}
+		}
+	}
+}
+
+// compareSteps compares recorded steps in order
+func compareSteps(ref, cand []step) []StepReport {
+	var reports []StepReport
+	for i := 0; i < max(len(ref), len(cand)); i++ {
+		switch {
+		case i >= len(cand):
+			reports = append(reports, StepReport{Name: ref[i].name, Differences: []Difference{{Field: "step", Reference: "called", Candidate: "<not called>"}}})
+		case i >= len(ref):
+			reports = append(reports, StepReport{Name: cand[i].name, Differences: []Difference{{Field: "step", Reference: "<not called>", Candidate: "called"}}})
+		default:
+			reports = append(reports, StepReport{Name: ref[i].name, Differences: compareStep(ref[i], cand[i])})
+		}
+	}
+	return reports
+}
+
+func compareStep(ref, cand step) []Difference {
+	if ref.code != cand.code {
+		return []Difference{{
+			Field:     "code",
+			Reference: codeString(ref.code, ref.message),
+			Candidate: codeString(cand.code, cand.message),
+		}}
+	}
+
+	var diffs []Difference
+	fields := make(map[string]bool)
+	for f := range ref.fields {
+		fields[f] = true
+	}
+	for f := range cand.fields {
+		fields[f] = true
+	}
+	for f := range fields {
+		r, ok := ref.fields[f]
+		if !ok {
+			r = "<unset>"
+		}
+		c, ok := cand.fields[f]
+		if !ok {
+			c = "<unset>"
+		}
+		if r != c {
+			diffs = append(diffs, Difference{Field: f, Reference: r, Candidate: c})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Field < diffs[j].Field })
+	return diffs
+}
+
+func codeString(c codes.Code, message string) string {
+	s := c.String()
+	if message != "" {
+		s += ": " + message
+	}
+	return s
+}
+
+// flatten adds the set fields of m to fields, keyed by path
+func flatten(m protoreflect.Message, prefix string, fields map[string]string) {
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		path := prefix + string(fd.Name())
+		switch {
+		case volatileFields[fd.Name()]:
+			fields[path] = "<set>"
+		case fd.IsList():
+			list := v.List()
+			fields[path+".length"] = fmt.Sprint(list.Len())
+			for i := 0; i < list.Len(); i++ {
+				flattenValue(fd, list.Get(i), fmt.Sprintf("%s[%d]", path, i), fields)
+			}
+		case fd.IsMap():
+			v.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+				flattenValue(fd.MapValue(), mv, fmt.Sprintf("%s[%s]", path, k.String()), fields)
+				return true
+			})
+		default:
+			flattenValue(fd, v, path, fields)
+		}
+		return true
+	})
+}
+
+func flattenValue(fd protoreflect.FieldDescriptor, v protoreflect.Value, path string, fields map[string]string) {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		// Well-known wrappers hold a single value
+		if fd.Message().Fields().Len() == 1 && strings.HasPrefix(string(fd.Message().FullName()), "google.protobuf.") {
+			inner := fd.Message().Fields().Get(0)
+			fields[path] = fmt.Sprint(v.Message().Get(inner).Interface())
+			return
+		}
+		flatten(v.Message(), path+".", fields)
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			fields[path] = string(ev.Name())
+		} else {
+			fields[path] = fmt.Sprint(v.Enum())
+		}
+	case protoreflect.BytesKind:
+		fields[path] = fmt.Sprintf("%x", v.Bytes())
+	default:
+		fields[path] = fmt.Sprint(v.Interface())
+	}
+}
@@ -0,0 +1,157 @@
+package conformance
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/proxy"
+	"github.com/blackwell-systems/gcp-kms-emulator/pkg/emulator"
+)
+
+// emulatorTarget starts an in-memory emulator
+func emulatorTarget(t *testing.T, name string) Target {
+	t.Helper()
+	emu, err := emulator.Start(t.Context(), emulator.WithBufconn(), emulator.WithIAMMode("off"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { emu.Close() })
+	conn, err := emu.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return Target{Name: name, Client: kmspb.NewKeyManagementServiceClient(conn)}
+}
+
+// TestConformance runs the scenarios against real Cloud KMS and the emulator.
+// It needs Application Default Credentials and a project to create key rings
+// in:
+//
+//	GCP_KMS_CONFORMANCE_PROJECT   project (required)
+//	GCP_KMS_CONFORMANCE_LOCATION  location (default global)
+//	GCP_KMS_CONFORMANCE_REPORT    path to write the Markdown parity report to
+func TestConformance(t *testing.T) {
+	project := os.Getenv("GCP_KMS_CONFORMANCE_PROJECT")
+	if project == "" {
+		t.Skip("Skipping conformance tests - GCP_KMS_CONFORMANCE_PROJECT not set")
+	}
+	location := os.Getenv("GCP_KMS_CONFORMANCE_LOCATION")
+	if location == "" {
+		location = "global"
+	}
+
+	ctx := t.Context()
+	conn, err := proxy.Dial(ctx, proxy.DefaultEndpoint)
+	if err != nil {
+		t.Fatalf("Failed to connect to Cloud KMS: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	report, err := Run(ctx, Scenarios,
+		"projects/"+project+"/locations/"+location,
+		fmt.Sprintf("conformance-%d", time.Now().Unix()),
+		Target{Name: "Cloud KMS", Client: kmspb.NewKeyManagementServiceClient(conn)},
+		emulatorTarget(t, "emulator"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var md bytes.Buffer
+	if err := report.WriteMarkdown(&md); err != nil {
+		t.Fatal(err)
+	}
+	if path := os.Getenv("GCP_KMS_CONFORMANCE_REPORT"); path != "" {
+		if err := os.WriteFile(path, md.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := report.Differences(); n > 0 {
+		t.Errorf("%d steps differ from Cloud KMS:\n%s", n, md.String())
+	}
+}
+
+// TestSelfParity runs the scenarios against two emulators, which must agree:
+// anything else is a volatile field the comparison does not account for
+func TestSelfParity(t *testing.T) {
+	report, err := Run(t.Context(), Scenarios, "projects/p/locations/global", "conformance",
+		emulatorTarget(t, "first"), emulatorTarget(t, "second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range report.Scenarios {
+		if s.ReferenceError != "" {
+			t.Errorf("%s stopped: %s", s.Name, s.ReferenceError)
+		}
+		if len(s.Steps) == 0 {
+			t.Errorf("%s recorded no steps", s.Name)
+		}
+	}
+	if n := report.Differences(); n > 0 {
+		var md bytes.Buffer
+		_ = report.WriteMarkdown(&md)
+		t.Errorf("%d steps differ:\n%s", n, md.String())
+	}
+}
+
+func TestCompare(t *testing.T) {
+	record := func(calls func(env *Env)) []step {
+		env := &Env{}
+		calls(env)
+		return env.steps
+	}
+	ref := record(func(env *Env) {
+		_ = env.Record("GetCryptoKey", &kmspb.CryptoKey{
+			Name:       "k",
+			Purpose:    kmspb.CryptoKey_ENCRYPT_DECRYPT,
+			CreateTime: timestamppb.Now(),
+			Labels:     map[string]string{"a": "1"},
+			Primary:    &kmspb.CryptoKeyVersion{State: kmspb.CryptoKeyVersion_ENABLED},
+		}, nil)
+		_ = env.Record("Decrypt", nil, status.Error(codes.InvalidArgument, "bad"))
+		_ = env.Record("Encrypt", &kmspb.EncryptResponse{Ciphertext: []byte("a")}, nil)
+	})
+	cand := record(func(env *Env) {
+		_ = env.Record("GetCryptoKey", &kmspb.CryptoKey{
+			Name:       "k",
+			Purpose:    kmspb.CryptoKey_ENCRYPT_DECRYPT,
+			CreateTime: timestamppb.New(time.Unix(0, 0)),
+			Labels:     map[string]string{"a": "2"},
+			Primary:    &kmspb.CryptoKeyVersion{State: kmspb.CryptoKeyVersion_DISABLED},
+		}, nil)
+		_ = env.Record("Decrypt", nil, status.Error(codes.FailedPrecondition, "bad"))
+	})
+
+	steps := compareSteps(ref, cand)
+	if len(steps) != 3 {
+		t.Fatalf("Expected 3 steps, got %d", len(steps))
+	}
+	got := fmt.Sprint(steps[0].Differences)
+	if want := "[{labels[a] 1 2} {primary.state ENABLED DISABLED}]"; got != want {
+		t.Errorf("Expected differences %s, got %s (create times are volatile)", want, got)
+	}
+	if d := steps[1].Differences; len(d) != 1 || d[0].Field != "code" || d[0].Candidate != "FailedPrecondition: bad" {
+		t.Errorf("Expected a code difference, got %v", d)
+	}
+	if d := steps[2].Differences; len(d) != 1 || d[0].Candidate != "<not called>" {
+		t.Errorf("Expected a missing step, got %v", d)
+	}
+
+	report := Report{Reference: "real", Candidate: "emulator", Scenarios: []ScenarioReport{{Name: "keys", Steps: steps}}}
+	var md bytes.Buffer
+	if err := report.WriteMarkdown(&md); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(md.String(), "| keys | 3 | 3 |") || !strings.Contains(md.String(), "| `primary.state` | ENABLED | DISABLED |") {
+		t.Errorf("Unexpected report:\n%s", md.String())
+	}
+}
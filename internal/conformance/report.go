@@ -0,0 +1,55 @@
+package conformance
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteMarkdown writes the report as a Markdown parity report: a summary
+// table of the scenarios, then the differences of each step
+func (r Report) WriteMarkdown(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# KMS Conformance Report\n\n")
+	fmt.Fprintf(&b, "Reference: %s  \nCandidate: %s  \nKey ring: `%s`\n\n", r.Reference, r.Candidate, r.KeyRing)
+
+	fmt.Fprintf(&b, "| Scenario | Steps | Differences |\n|---|---|---|\n")
+	steps, total := 0, 0
+	for _, s := range r.Scenarios {
+		fmt.Fprintf(&b, "| %s | %d | %d |\n", s.Name, len(s.Steps), s.Differences())
+		steps += len(s.Steps)
+		total += s.Differences()
+	}
+	fmt.Fprintf(&b, "| **Total** | %d | %d |\n", steps, total)
+
+	for _, s := range r.Scenarios {
+		if s.Differences() == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n## %s\n", s.Name)
+		if s.ReferenceError != "" {
+			fmt.Fprintf(&b, "\nStopped on %s: %s\n", r.Reference, s.ReferenceError)
+		}
+		if s.CandidateError != "" {
+			fmt.Fprintf(&b, "\nStopped on %s: %s\n", r.Candidate, s.CandidateError)
+		}
+		for _, st := range s.Steps {
+			if len(st.Differences) == 0 {
+				continue
+			}
+			fmt.Fprintf(&b, "\n### %s\n\n| Field | %s | %s |\n|---|---|---|\n", st.Name, r.Reference, r.Candidate)
+			for _, d := range st.Differences {
+				fmt.Fprintf(&b, "| `%s` | %s | %s |\n", d.Field, markdownCell(d.Reference), markdownCell(d.Candidate))
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// markdownCell escapes a value for a table cell
+func markdownCell(s string) string {
+	s = strings.ReplaceAll(s, "|", `\|`)
+	return strings.ReplaceAll(s, "\n", " ")
+}
@@ -0,0 +1,285 @@
+package conformance
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"path"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// crc32c matches the checksums the KMS API uses
+func crc32c(data []byte) *wrapperspb.Int64Value {
+	return wrapperspb.Int64(int64(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))))
+}
+
+// Scenarios is the scenario set, covering the methods the emulator
+// implements. Each scenario creates its own keys in the run's key ring.
+var Scenarios = []Scenario{
+	{Name: "key rings", Run: keyRings},
+	{Name: "symmetric encryption", Run: symmetricEncryption},
+	{Name: "version lifecycle", Run: versionLifecycle},
+	{Name: "asymmetric signing", Run: asymmetricSigning},
+	{Name: "asymmetric decryption", Run: asymmetricDecryption},
+	{Name: "MAC", Run: mac},
+	{Name: "random bytes", Run: randomBytes},
+	{Name: "invalid requests", Run: invalidRequests},
+}
+
+func keyRings(ctx context.Context, env *Env) error {
+	c := env.Client
+	kr, err := c.GetKeyRing(ctx, &kmspb.GetKeyRingRequest{Name: env.KeyRing})
+	if err := env.Record("GetKeyRing", kr, err); err != nil {
+		return err
+	}
+	kr, err = c.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: env.Location, KeyRingId: path.Base(kr.Name)})
+	_ = env.Record("CreateKeyRing existing", kr, err)
+	kr, err = c.GetKeyRing(ctx, &kmspb.GetKeyRingRequest{Name: env.KeyRing + "-missing"})
+	_ = env.Record("GetKeyRing missing", kr, err)
+	kr, err = c.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: env.Location, KeyRingId: "not a valid id"})
+	_ = env.Record("CreateKeyRing invalid id", kr, err)
+	return nil
+}
+
+func symmetricEncryption(ctx context.Context, env *Env) error {
+	c := env.Client
+	key, err := c.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent:      env.KeyRing,
+		CryptoKeyId: "symmetric",
+		CryptoKey: &kmspb.CryptoKey{
+			Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT,
+			Labels:  map[string]string{"suite": "conformance"},
+		},
+	})
+	if err := env.Record("CreateCryptoKey", key, err); err != nil {
+		return err
+	}
+	got, err := c.GetCryptoKey(ctx, &kmspb.GetCryptoKeyRequest{Name: key.Name})
+	_ = env.Record("GetCryptoKey", got, err)
+
+	plaintext, aad := []byte("conformance plaintext"), []byte("conformance aad")
+	enc, err := c.Encrypt(ctx, &kmspb.EncryptRequest{
+		Name:                              key.Name,
+		Plaintext:                         plaintext,
+		AdditionalAuthenticatedData:       aad,
+		PlaintextCrc32C:                   crc32c(plaintext),
+		AdditionalAuthenticatedDataCrc32C: crc32c(aad),
+	})
+	if err := env.Record("Encrypt", enc, err); err != nil {
+		return err
+	}
+	dec, err := c.Decrypt(ctx, &kmspb.DecryptRequest{
+		Name:                              key.Name,
+		Ciphertext:                        enc.Ciphertext,
+		AdditionalAuthenticatedData:       aad,
+		CiphertextCrc32C:                  crc32c(enc.Ciphertext),
+		AdditionalAuthenticatedDataCrc32C: crc32c(aad),
+	})
+	_ = env.Record("Decrypt", dec, err)
+	dec, err = c.Decrypt(ctx, &kmspb.DecryptRequest{Name: key.Name, Ciphertext: enc.Ciphertext, AdditionalAuthenticatedData: []byte("other aad")})
+	_ = env.Record("Decrypt wrong AAD", dec, err)
+	enc, err = c.Encrypt(ctx, &kmspb.EncryptRequest{Name: key.Name, Plaintext: plaintext, PlaintextCrc32C: wrapperspb.Int64(1)})
+	_ = env.Record("Encrypt wrong checksum", enc, err)
+	return nil
+}
+
+func versionLifecycle(ctx context.Context, env *Env) error {
+	c := env.Client
+	key, err := c.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent:      env.KeyRing,
+		CryptoKeyId: "versions",
+		CryptoKey:   &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT},
+	})
+	if err := env.Record("CreateCryptoKey", key, err); err != nil {
+		return err
+	}
+	v2, err := c.CreateCryptoKeyVersion(ctx, &kmspb.CreateCryptoKeyVersionRequest{Parent: key.Name, CryptoKeyVersion: &kmspb.CryptoKeyVersion{}})
+	if err := env.Record("CreateCryptoKeyVersion", v2, err); err != nil {
+		return err
+	}
+	updated, err := c.UpdateCryptoKeyPrimaryVersion(ctx, &kmspb.UpdateCryptoKeyPrimaryVersionRequest{Name: key.Name, CryptoKeyVersionId: "2"})
+	_ = env.Record("UpdateCryptoKeyPrimaryVersion", updated, err)
+	list, err := c.ListCryptoKeyVersions(ctx, &kmspb.ListCryptoKeyVersionsRequest{Parent: key.Name})
+	_ = env.Record("ListCryptoKeyVersions", list, err)
+
+	v1 := key.Name + "/cryptoKeyVersions/1"
+	v, err := c.UpdateCryptoKeyVersion(ctx, &kmspb.UpdateCryptoKeyVersionRequest{
+		CryptoKeyVersion: &kmspb.CryptoKeyVersion{Name: v1, State: kmspb.CryptoKeyVersion_DISABLED},
+		UpdateMask:       &fieldmaskpb.FieldMask{Paths: []string{"state"}},
+	})
+	_ = env.Record("UpdateCryptoKeyVersion disable", v, err)
+	v, err = c.DestroyCryptoKeyVersion(ctx, &kmspb.DestroyCryptoKeyVersionRequest{Name: v1})
+	_ = env.Record("DestroyCryptoKeyVersion", v, err)
+	v, err = c.RestoreCryptoKeyVersion(ctx, &kmspb.RestoreCryptoKeyVersionRequest{Name: v1})
+	_ = env.Record("RestoreCryptoKeyVersion", v, err)
+	v, err = c.RestoreCryptoKeyVersion(ctx, &kmspb.RestoreCryptoKeyVersionRequest{Name: v2.Name})
+	_ = env.Record("RestoreCryptoKeyVersion enabled", v, err)
+	v, err = c.GetCryptoKeyVersion(ctx, &kmspb.GetCryptoKeyVersionRequest{Name: key.Name + "/cryptoKeyVersions/99"})
+	_ = env.Record("GetCryptoKeyVersion missing", v, err)
+	return nil
+}
+
+func asymmetricSigning(ctx context.Context, env *Env) error {
+	c := env.Client
+	key, err := c.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent:      env.KeyRing,
+		CryptoKeyId: "signing",
+		CryptoKey: &kmspb.CryptoKey{
+			Purpose:         kmspb.CryptoKey_ASYMMETRIC_SIGN,
+			VersionTemplate: &kmspb.CryptoKeyVersionTemplate{Algorithm: kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256},
+		},
+	})
+	if err := env.Record("CreateCryptoKey", key, err); err != nil {
+		return err
+	}
+	version := key.Name + "/cryptoKeyVersions/1"
+	if err := env.WaitForVersion(ctx, version); err != nil {
+		return err
+	}
+	pub, err := c.GetPublicKey(ctx, &kmspb.GetPublicKeyRequest{Name: version})
+	_ = env.Record("GetPublicKey", pub, err)
+
+	digest := sha256.Sum256([]byte("conformance message"))
+	sig, err := c.AsymmetricSign(ctx, &kmspb.AsymmetricSignRequest{
+		Name:         version,
+		Digest:       &kmspb.Digest{Digest: &kmspb.Digest_Sha256{Sha256: digest[:]}},
+		DigestCrc32C: crc32c(digest[:]),
+	})
+	_ = env.Record("AsymmetricSign", sig, err)
+	sig, err = c.AsymmetricSign(ctx, &kmspb.AsymmetricSignRequest{
+		Name:   version,
+		Digest: &kmspb.Digest{Digest: &kmspb.Digest_Sha384{Sha384: make([]byte, 48)}},
+	})
+	_ = env.Record("AsymmetricSign wrong digest", sig, err)
+	enc, err := c.Encrypt(ctx, &kmspb.EncryptRequest{Name: key.Name, Plaintext: []byte("data")})
+	_ = env.Record("Encrypt with signing key", enc, err)
+	return nil
+}
+
+func asymmetricDecryption(ctx context.Context, env *Env) error {
+	c := env.Client
+	key, err := c.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent:      env.KeyRing,
+		CryptoKeyId: "decryption",
+		CryptoKey: &kmspb.CryptoKey{
+			Purpose:         kmspb.CryptoKey_ASYMMETRIC_DECRYPT,
+			VersionTemplate: &kmspb.CryptoKeyVersionTemplate{Algorithm: kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_2048_SHA256},
+		},
+	})
+	if err := env.Record("CreateCryptoKey", key, err); err != nil {
+		return err
+	}
+	version := key.Name + "/cryptoKeyVersions/1"
+	if err := env.WaitForVersion(ctx, version); err != nil {
+		return err
+	}
+	pub, err := c.GetPublicKey(ctx, &kmspb.GetPublicKeyRequest{Name: version})
+	if err := env.Record("GetPublicKey", pub, err); err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode([]byte(pub.Pem))
+	if block == nil {
+		return errors.New("public key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	rsaKey, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("public key is %T, not RSA", parsed)
+	}
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaKey, []byte("conformance secret"), nil)
+	if err != nil {
+		return err
+	}
+	dec, err := c.AsymmetricDecrypt(ctx, &kmspb.AsymmetricDecryptRequest{
+		Name:             version,
+		Ciphertext:       ciphertext,
+		CiphertextCrc32C: crc32c(ciphertext),
+	})
+	_ = env.Record("AsymmetricDecrypt", dec, err)
+	dec, err = c.AsymmetricDecrypt(ctx, &kmspb.AsymmetricDecryptRequest{Name: version, Ciphertext: []byte("not a ciphertext")})
+	_ = env.Record("AsymmetricDecrypt invalid ciphertext", dec, err)
+	return nil
+}
+
+func mac(ctx context.Context, env *Env) error {
+	c := env.Client
+	key, err := c.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent:      env.KeyRing,
+		CryptoKeyId: "mac",
+		CryptoKey: &kmspb.CryptoKey{
+			Purpose:         kmspb.CryptoKey_MAC,
+			VersionTemplate: &kmspb.CryptoKeyVersionTemplate{Algorithm: kmspb.CryptoKeyVersion_HMAC_SHA256},
+		},
+	})
+	if err := env.Record("CreateCryptoKey", key, err); err != nil {
+		return err
+	}
+	version := key.Name + "/cryptoKeyVersions/1"
+	if err := env.WaitForVersion(ctx, version); err != nil {
+		return err
+	}
+	data := []byte("conformance data")
+	sig, err := c.MacSign(ctx, &kmspb.MacSignRequest{Name: version, Data: data, DataCrc32C: crc32c(data)})
+	if err := env.Record("MacSign", sig, err); err != nil {
+		return err
+	}
+	ok, err := c.MacVerify(ctx, &kmspb.MacVerifyRequest{Name: version, Data: data, Mac: sig.Mac, DataCrc32C: crc32c(data), MacCrc32C: crc32c(sig.Mac)})
+	_ = env.Record("MacVerify", ok, err)
+	ok, err = c.MacVerify(ctx, &kmspb.MacVerifyRequest{Name: version, Data: []byte("other data"), Mac: sig.Mac})
+	_ = env.Record("MacVerify other data", ok, err)
+	return nil
+}
+
+func randomBytes(ctx context.Context, env *Env) error {
+	c := env.Client
+	resp, err := c.GenerateRandomBytes(ctx, &kmspb.GenerateRandomBytesRequest{
+		Location:        env.Location,
+		LengthBytes:     32,
+		ProtectionLevel: kmspb.ProtectionLevel_HSM,
+	})
+	_ = env.Record("GenerateRandomBytes", resp, err)
+	resp, err = c.GenerateRandomBytes(ctx, &kmspb.GenerateRandomBytesRequest{
+		Location:        env.Location,
+		LengthBytes:     32,
+		ProtectionLevel: kmspb.ProtectionLevel_SOFTWARE,
+	})
+	_ = env.Record("GenerateRandomBytes software", resp, err)
+	return nil
+}
+
+func invalidRequests(ctx context.Context, env *Env) error {
+	c := env.Client
+	key, err := c.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent:      env.KeyRing,
+		CryptoKeyId: "invalid id!",
+		CryptoKey:   &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT},
+	})
+	_ = env.Record("CreateCryptoKey invalid id", key, err)
+	key, err = c.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent:      env.KeyRing,
+		CryptoKeyId: "mismatch",
+		CryptoKey: &kmspb.CryptoKey{
+			Purpose:         kmspb.CryptoKey_ENCRYPT_DECRYPT,
+			VersionTemplate: &kmspb.CryptoKeyVersionTemplate{Algorithm: kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256},
+		},
+	})
+	_ = env.Record("CreateCryptoKey algorithm mismatch", key, err)
+	key, err = c.GetCryptoKey(ctx, &kmspb.GetCryptoKeyRequest{Name: env.KeyRing + "/cryptoKeys/missing"})
+	_ = env.Record("GetCryptoKey missing", key, err)
+	enc, err := c.Encrypt(ctx, &kmspb.EncryptRequest{Name: env.KeyRing + "/cryptoKeys/missing", Plaintext: []byte("data")})
+	_ = env.Record("Encrypt missing key", enc, err)
+	return nil
+}
@@ -0,0 +1,98 @@
+package fault
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// DefaultChaosRetryDelay is the retry delay advertised on chaos failures
+const DefaultChaosRetryDelay = 100 * time.Millisecond
+
+// Chaos fails a random fraction of all calls with UNAVAILABLE or
+// DEADLINE_EXCEEDED, the transient errors clients are expected to retry.
+//
+// Unlike rules, chaos is a global background failure rate that does not
+// target specific methods or resources. Failed calls never reach the service
+// and carry a google.rpc.RetryInfo detail plus a grpc-retry-pushback-ms
+// trailer so retry policies can be exercised end to end.
+type Chaos struct {
+	rate       atomic.Uint64 // math.Float64bits of the failure rate
+	retryDelay time.Duration
+	rand       func() float64
+}
+
+// NewChaos creates a chaos injector failing the given fraction of calls
+func NewChaos(rate float64) (*Chaos, error) {
+	c := &Chaos{
+		retryDelay: DefaultChaosRetryDelay,
+		rand:       rand.Float64,
+	}
+	if err := c.SetRate(rate); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Rate returns the current failure rate
+func (c *Chaos) Rate() float64 {
+	return math.Float64frombits(c.rate.Load())
+}
+
+// SetRate changes the failure rate. Zero disables chaos.
+func (c *Chaos) SetRate(rate float64) error {
+	if err := ValidateChaosRate(rate); err != nil {
+		return err
+	}
+	c.rate.Store(math.Float64bits(rate))
+	return nil
+}
+
+// ValidateChaosRate reports whether rate is a valid chaos failure rate
+func ValidateChaosRate(rate float64) error {
+	if rate < 0 || rate > 1 || math.IsNaN(rate) {
+		return fmt.Errorf("chaos rate must be between 0 and 1, got %v", rate)
+	}
+	return nil
+}
+
+// UnaryServerInterceptor fails calls at the configured rate
+func (c *Chaos) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		rate := c.Rate()
+		if rate == 0 || c.rand() >= rate {
+			return handler(ctx, req)
+		}
+
+		_ = grpc.SetTrailer(ctx, metadata.Pairs("grpc-retry-pushback-ms", strconv.FormatInt(c.retryDelay.Milliseconds(), 10)))
+		return nil, c.error()
+	}
+}
+
+// error builds a transient error with retry metadata, picking UNAVAILABLE or
+// DEADLINE_EXCEEDED at random
+func (c *Chaos) error() error {
+	code, msg := codes.Unavailable, "chaos: service temporarily unavailable"
+	if c.rand() < 0.5 {
+		code, msg = codes.DeadlineExceeded, "chaos: deadline exceeded"
+	}
+
+	st, err := status.New(code, msg).WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(c.retryDelay),
+	})
+	if err != nil {
+		return status.Error(code, msg)
+	}
+	return st.Err()
+}
@@ -0,0 +1,82 @@
+package fault
+
+import (
+	"context"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestChaosRate(t *testing.T) {
+	if _, err := NewChaos(1.5); err == nil {
+		t.Error("Expected error for rate above 1")
+	}
+	if _, err := NewChaos(-0.1); err == nil {
+		t.Error("Expected error for negative rate")
+	}
+
+	chaos, err := NewChaos(0.05)
+	if err != nil {
+		t.Fatalf("NewChaos failed: %v", err)
+	}
+	if got := chaos.Rate(); got != 0.05 {
+		t.Errorf("Expected rate 0.05, got %v", got)
+	}
+}
+
+func TestChaosFailsWithRetryInfo(t *testing.T) {
+	chaos, err := NewChaos(0.5)
+	if err != nil {
+		t.Fatalf("NewChaos failed: %v", err)
+	}
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/google.cloud.kms.v1.KeyManagementService/Encrypt"}
+	// invoke runs one call; rolls feeds the fire decision and then the
+	// choice between UNAVAILABLE (>= 0.5) and DEADLINE_EXCEEDED (< 0.5)
+	invoke := func(rolls ...float64) (error, bool) {
+		chaos.rand = func() float64 {
+			roll := rolls[0]
+			rolls = rolls[1:]
+			return roll
+		}
+		called := false
+		_, err := chaos.UnaryServerInterceptor()(context.Background(), &kmspb.EncryptRequest{}, info, func(context.Context, any) (any, error) {
+			called = true
+			return &kmspb.EncryptResponse{}, nil
+		})
+		return err, called
+	}
+
+	if err, called := invoke(0.9); err != nil || !called {
+		t.Errorf("Roll above rate should pass through, got %v (called=%v)", err, called)
+	}
+
+	for choice, want := range map[float64]codes.Code{0.7: codes.Unavailable, 0.2: codes.DeadlineExceeded} {
+		err, called := invoke(0.1, choice)
+		if called || status.Code(err) != want {
+			t.Errorf("Expected %v without calling handler, got %v (called=%v)", want, err, called)
+		}
+
+		var retry *errdetails.RetryInfo
+		for _, d := range status.Convert(err).Details() {
+			if ri, ok := d.(*errdetails.RetryInfo); ok {
+				retry = ri
+			}
+		}
+		if retry == nil || retry.GetRetryDelay().AsDuration() != DefaultChaosRetryDelay {
+			t.Errorf("Expected RetryInfo with %v delay, got %v", DefaultChaosRetryDelay, retry)
+		}
+	}
+
+	// Disabling chaos at runtime stops all failures
+	if err := chaos.SetRate(0); err != nil {
+		t.Fatalf("SetRate failed: %v", err)
+	}
+	if err, called := invoke(0); err != nil || !called {
+		t.Errorf("Disabled chaos should pass through, got %v (called=%v)", err, called)
+	}
+}
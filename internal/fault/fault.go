@@ -0,0 +1,384 @@
+// Package fault injects failures into KMS calls so clients can rehearse how
+// they behave when KMS misbehaves.
+//
+// An Injector holds an ordered list of rules. Each call is checked against
+// the rules in order and the first rule that matches (and wins its
+// probability roll) fires. Rules match on:
+//
+//   - method: RPC name such as "Encrypt" (empty or "*" matches any)
+//   - resource: glob over the request's resource name, where "*" matches
+//     within one path segment and "**" matches across segments
+//   - principal: exact calling principal, e.g. "user:ci@example.com"
+//
+// and perform one of the actions:
+//
+//   - error: fail the call with the given status code (e.g. INTERNAL, ABORTED)
+//     without reaching the service
+//   - drop: close the client's connection, as if the server crashed mid-call
+//   - corrupt_checksum: run the call but return wrong CRC32C checksums
+//     (ciphertext_crc32c, plaintext_crc32c, ...) in the response
+//
+// Rules are managed at runtime through the admin API (/admin/faults).
+//
+// Chaos complements rules with a global background failure rate: a random
+// fraction of all calls fails with a retryable error.
+package fault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand/v2"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	emulatorauth "github.com/blackwell-systems/gcp-emulator-auth"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/logging"
+)
+
+// Action is what a rule does when it fires
+type Action string
+
+const (
+	// ActionError fails the call with the rule's status code
+	ActionError Action = "error"
+	// ActionDrop closes the client connection
+	ActionDrop Action = "drop"
+	// ActionCorruptChecksum returns wrong CRC32C checksums in the response
+	ActionCorruptChecksum Action = "corrupt_checksum"
+)
+
+// Rule describes when and how to inject a fault
+type Rule struct {
+	// ID identifies the rule; assigned by AddRule when empty
+	ID string `json:"id"`
+
+	// Method matches the RPC name (empty or "*" matches any)
+	Method string `json:"method,omitempty"`
+	// Resource is a glob over the request's resource name (empty matches any)
+	Resource string `json:"resource,omitempty"`
+	// Principal matches the calling principal exactly (empty matches any)
+	Principal string `json:"principal,omitempty"`
+
+	// Action is the fault to inject
+	Action Action `json:"action"`
+	// Code is the status code for ActionError, e.g. "INTERNAL"
+	Code string `json:"code,omitempty"`
+	// Message is the status message for ActionError
+	Message string `json:"message,omitempty"`
+
+	// Probability that a matching call fires the rule, in (0, 1]. Zero
+	// means always.
+	Probability float64 `json:"probability,omitempty"`
+	// Times limits how often the rule fires. Zero means unlimited.
+	Times int `json:"times,omitempty"`
+
+	// Hits counts how often the rule has fired
+	Hits int `json:"hits"`
+
+	code     codes.Code
+	resource *regexp.Regexp
+}
+
+// ErrInvalidRule is returned by AddRule for malformed rules
+var ErrInvalidRule = errors.New("invalid fault rule")
+
+// Injector evaluates fault rules against incoming calls
+type Injector struct {
+	mu     sync.Mutex
+	rules  []*Rule
+	nextID int
+	rand   func() float64
+
+	conns connTracker
+}
+
+// NewInjector creates an injector with no rules
+func NewInjector() *Injector {
+	return &Injector{
+		rand:  rand.Float64,
+		conns: connTracker{conns: make(map[string]net.Conn)},
+	}
+}
+
+// AddRule validates rule and appends it to the rule list. The stored rule,
+// including its assigned ID, is returned.
+func (i *Injector) AddRule(rule Rule) (Rule, error) {
+	if err := rule.compile(); err != nil {
+		return Rule{}, err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if rule.ID == "" {
+		i.nextID++
+		rule.ID = fmt.Sprintf("rule-%d", i.nextID)
+	}
+	for _, r := range i.rules {
+		if r.ID == rule.ID {
+			return Rule{}, fmt.Errorf("%w: rule %q already exists", ErrInvalidRule, rule.ID)
+		}
+	}
+
+	rule.Hits = 0
+	i.rules = append(i.rules, &rule)
+	return rule, nil
+}
+
+// SetRules replaces all rules with rules, which are validated first so the
+// current rules are kept if any is malformed. Hit counts start from zero.
+func (i *Injector) SetRules(rules []Rule) error {
+	compiled, err := compileRules(rules)
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	taken := make(map[string]bool)
+	for _, r := range compiled {
+		taken[r.ID] = true
+	}
+	for _, r := range compiled {
+		for r.ID == "" {
+			i.nextID++
+			if id := fmt.Sprintf("rule-%d", i.nextID); !taken[id] {
+				r.ID = id
+				taken[id] = true
+			}
+		}
+	}
+	i.rules = compiled
+	return nil
+}
+
+// ValidateRules reports whether rules could be installed with SetRules
+func ValidateRules(rules []Rule) error {
+	_, err := compileRules(rules)
+	return err
+}
+
+func compileRules(rules []Rule) ([]*Rule, error) {
+	compiled := make([]*Rule, 0, len(rules))
+	seen := make(map[string]bool)
+	for n, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", n, err)
+		}
+		if rule.ID != "" {
+			if seen[rule.ID] {
+				return nil, fmt.Errorf("%w: rule %q is defined twice", ErrInvalidRule, rule.ID)
+			}
+			seen[rule.ID] = true
+		}
+		rule.Hits = 0
+		compiled = append(compiled, &rule)
+	}
+	return compiled, nil
+}
+
+// RemoveRule deletes the rule with the given ID and reports whether it existed
+func (i *Injector) RemoveRule(id string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for n, r := range i.rules {
+		if r.ID == id {
+			i.rules = append(i.rules[:n], i.rules[n+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Clear deletes all rules
+func (i *Injector) Clear() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.rules = nil
+}
+
+// Rules returns a copy of the current rules in evaluation order
+func (i *Injector) Rules() []Rule {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	out := make([]Rule, len(i.rules))
+	for n, r := range i.rules {
+		out[n] = *r
+	}
+	return out
+}
+
+// UnaryServerInterceptor injects faults into matching calls
+func (i *Injector) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		rule, ok := i.match(path.Base(info.FullMethod), logging.Resource(req), emulatorauth.ExtractPrincipalFromContext(ctx))
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		switch rule.Action {
+		case ActionError:
+			return nil, status.Error(rule.code, rule.Message)
+		case ActionDrop:
+			if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+				i.conns.close(p.Addr.String())
+			}
+			return nil, status.Error(codes.Unavailable, "connection dropped by fault injection")
+		case ActionCorruptChecksum:
+			resp, err := handler(ctx, req)
+			if err != nil {
+				return resp, err
+			}
+			if msg, ok := resp.(proto.Message); ok {
+				return corruptChecksums(msg), nil
+			}
+			return resp, nil
+		default:
+			return handler(ctx, req)
+		}
+	}
+}
+
+// match returns a copy of the first rule that fires for the call and records
+// the hit
+func (i *Injector) match(method, resource, principal string) (Rule, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, r := range i.rules {
+		if r.Times > 0 && r.Hits >= r.Times {
+			continue
+		}
+		if r.Method != "" && r.Method != "*" && r.Method != method {
+			continue
+		}
+		if r.resource != nil && !r.resource.MatchString(resource) {
+			continue
+		}
+		if r.Principal != "" && r.Principal != principal {
+			continue
+		}
+		if r.Probability > 0 && i.rand() >= r.Probability {
+			continue
+		}
+		r.Hits++
+		return *r, true
+	}
+	return Rule{}, false
+}
+
+// compile validates the rule and prepares its matchers
+func (r *Rule) compile() error {
+	switch r.Action {
+	case ActionError:
+		code, err := parseCode(r.Code)
+		if err != nil {
+			return err
+		}
+		if code == codes.OK {
+			return fmt.Errorf("%w: action error requires a non-OK code", ErrInvalidRule)
+		}
+		r.code = code
+		if r.Message == "" {
+			r.Message = fmt.Sprintf("injected fault: %s", code)
+		}
+	case ActionDrop, ActionCorruptChecksum:
+	default:
+		return fmt.Errorf("%w: unknown action %q (expected error, drop or corrupt_checksum)", ErrInvalidRule, r.Action)
+	}
+
+	if r.Probability < 0 || r.Probability > 1 {
+		return fmt.Errorf("%w: probability must be between 0 and 1", ErrInvalidRule)
+	}
+	if r.Times < 0 {
+		return fmt.Errorf("%w: times must not be negative", ErrInvalidRule)
+	}
+
+	if r.Resource != "" {
+		r.resource = globToRegexp(r.Resource)
+	}
+	return nil
+}
+
+// parseCode accepts status code names in any common spelling (INTERNAL,
+// Internal, DEADLINE_EXCEEDED, DeadlineExceeded)
+func parseCode(name string) (codes.Code, error) {
+	want := strings.ToLower(strings.ReplaceAll(name, "_", ""))
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if strings.ToLower(c.String()) == want {
+			return c, nil
+		}
+	}
+	return codes.Unknown, fmt.Errorf("%w: unknown status code %q", ErrInvalidRule, name)
+}
+
+// globToRegexp converts a resource glob to an anchored regular expression.
+// "**" matches any characters and "*" matches any characters except "/".
+func globToRegexp(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for n := 0; n < len(glob); n++ {
+		switch {
+		case strings.HasPrefix(glob[n:], "**"):
+			b.WriteString(".*")
+			n++
+		case glob[n] == '*':
+			b.WriteString("[^/]*")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[n : n+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// corruptChecksums returns a copy of msg whose *_crc32c fields are wrong for
+// the data they describe
+func corruptChecksums(msg proto.Message) proto.Message {
+	msg = proto.Clone(msg)
+	m := msg.ProtoReflect()
+
+	fields := m.Descriptor().Fields()
+	for n := 0; n < fields.Len(); n++ {
+		fd := fields.Get(n)
+		name := string(fd.Name())
+		if !strings.HasSuffix(name, "_crc32c") || fd.Kind() != protoreflect.MessageKind ||
+			fd.Message().FullName() != "google.protobuf.Int64Value" {
+			continue
+		}
+
+		// Start from the correct checksum of the sibling data field (if
+		// any) so the corrupted value is guaranteed to differ from it
+		var sum uint32
+		if data := fields.ByName(protoreflect.Name(strings.TrimSuffix(name, "_crc32c"))); data != nil && data.Kind() == protoreflect.BytesKind {
+			sum = crc32.Checksum(m.Get(data).Bytes(), crc32cTable)
+		}
+		if m.Has(fd) {
+			if v, ok := m.Get(fd).Message().Interface().(*wrapperspb.Int64Value); ok {
+				sum = uint32(v.GetValue())
+			}
+		}
+
+		m.Set(fd, protoreflect.ValueOfMessage(wrapperspb.Int64(int64(sum^0xFFFFFFFF)).ProtoReflect()))
+	}
+	return msg
+}
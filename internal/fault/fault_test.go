@@ -0,0 +1,239 @@
+package fault
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const keyName = "projects/p/locations/global/keyRings/prod/cryptoKeys/k"
+
+func call(t *testing.T, inj *Injector, method string, ctx context.Context, req any, resp any) (any, error, bool) {
+	t.Helper()
+
+	called := false
+	info := &grpc.UnaryServerInfo{FullMethod: "/google.cloud.kms.v1.KeyManagementService/" + method}
+	out, err := inj.UnaryServerInterceptor()(ctx, req, info, func(context.Context, any) (any, error) {
+		called = true
+		return resp, nil
+	})
+	return out, err, called
+}
+
+func TestErrorRuleMatching(t *testing.T) {
+	inj := NewInjector()
+	if _, err := inj.AddRule(Rule{
+		Method:    "Encrypt",
+		Resource:  "projects/*/locations/*/keyRings/prod/**",
+		Principal: "user:ci@example.com",
+		Action:    ActionError,
+		Code:      "ABORTED",
+	}); err != nil {
+		t.Fatalf("AddRule failed: %v", err)
+	}
+
+	ci := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-emulator-principal", "user:ci@example.com"))
+	other := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-emulator-principal", "user:other@example.com"))
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		method  string
+		req     any
+		wantErr bool
+	}{
+		{"match", ci, "Encrypt", &kmspb.EncryptRequest{Name: keyName}, true},
+		{"other method", ci, "Decrypt", &kmspb.DecryptRequest{Name: keyName}, false},
+		{"other keyring", ci, "Encrypt", &kmspb.EncryptRequest{Name: "projects/p/locations/global/keyRings/dev/cryptoKeys/k"}, false},
+		{"other principal", other, "Encrypt", &kmspb.EncryptRequest{Name: keyName}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err, called := call(t, inj, tt.method, tt.ctx, tt.req, &kmspb.EncryptResponse{})
+			if tt.wantErr {
+				if status.Code(err) != codes.Aborted || called {
+					t.Errorf("Expected injected ABORTED without calling handler, got %v (called=%v)", err, called)
+				}
+			} else if err != nil || !called {
+				t.Errorf("Expected call to pass through, got %v (called=%v)", err, called)
+			}
+		})
+	}
+
+	if hits := inj.Rules()[0].Hits; hits != 1 {
+		t.Errorf("Expected 1 hit, got %d", hits)
+	}
+}
+
+func TestRuleTimesAndProbability(t *testing.T) {
+	inj := NewInjector()
+	inj.rand = func() float64 { return 0.5 }
+
+	if _, err := inj.AddRule(Rule{Action: ActionError, Code: "Internal", Times: 2}); err != nil {
+		t.Fatalf("AddRule failed: %v", err)
+	}
+	for n, want := range []codes.Code{codes.Internal, codes.Internal, codes.OK} {
+		_, err, _ := call(t, inj, "Encrypt", context.Background(), &kmspb.EncryptRequest{Name: keyName}, &kmspb.EncryptResponse{})
+		if status.Code(err) != want {
+			t.Errorf("Call %d: expected %v, got %v", n, want, err)
+		}
+	}
+
+	inj.Clear()
+	if _, err := inj.AddRule(Rule{Action: ActionError, Code: "UNAVAILABLE", Probability: 0.4}); err != nil {
+		t.Fatalf("AddRule failed: %v", err)
+	}
+	if _, err, _ := call(t, inj, "Encrypt", context.Background(), &kmspb.EncryptRequest{}, &kmspb.EncryptResponse{}); err != nil {
+		t.Errorf("Roll of 0.5 should not fire a 0.4 rule, got %v", err)
+	}
+	inj.rand = func() float64 { return 0.1 }
+	if _, err, _ := call(t, inj, "Encrypt", context.Background(), &kmspb.EncryptRequest{}, &kmspb.EncryptResponse{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("Roll of 0.1 should fire a 0.4 rule, got %v", err)
+	}
+}
+
+func TestAddRuleValidation(t *testing.T) {
+	inj := NewInjector()
+
+	invalid := []Rule{
+		{Action: "explode"},
+		{Action: ActionError},
+		{Action: ActionError, Code: "OK"},
+		{Action: ActionError, Code: "NOT_A_CODE"},
+		{Action: ActionDrop, Probability: 1.5},
+		{Action: ActionDrop, Times: -1},
+	}
+	for _, rule := range invalid {
+		if _, err := inj.AddRule(rule); !errors.Is(err, ErrInvalidRule) {
+			t.Errorf("AddRule(%+v): expected ErrInvalidRule, got %v", rule, err)
+		}
+	}
+
+	first, err := inj.AddRule(Rule{Action: ActionDrop})
+	if err != nil || first.ID == "" {
+		t.Fatalf("Expected assigned ID, got %+v, %v", first, err)
+	}
+	if _, err := inj.AddRule(Rule{ID: first.ID, Action: ActionDrop}); !errors.Is(err, ErrInvalidRule) {
+		t.Errorf("Expected duplicate ID to be rejected, got %v", err)
+	}
+	if !inj.RemoveRule(first.ID) || inj.RemoveRule(first.ID) {
+		t.Error("Expected RemoveRule to succeed once")
+	}
+}
+
+func TestCorruptChecksum(t *testing.T) {
+	inj := NewInjector()
+	if _, err := inj.AddRule(Rule{Method: "Encrypt", Action: ActionCorruptChecksum}); err != nil {
+		t.Fatalf("AddRule failed: %v", err)
+	}
+
+	ciphertext := []byte("ciphertext")
+	sum := int64(crc32.Checksum(ciphertext, crc32.MakeTable(crc32.Castagnoli)))
+	resp := &kmspb.EncryptResponse{Ciphertext: ciphertext, CiphertextCrc32C: wrapperspb.Int64(sum)}
+
+	out, err, called := call(t, inj, "Encrypt", context.Background(), &kmspb.EncryptRequest{Name: keyName}, resp)
+	if err != nil || !called {
+		t.Fatalf("Expected handler to run, got %v (called=%v)", err, called)
+	}
+
+	got := out.(*kmspb.EncryptResponse)
+	if got.GetCiphertextCrc32C().GetValue() == sum {
+		t.Error("Expected checksum to be corrupted")
+	}
+	if string(got.Ciphertext) != "ciphertext" {
+		t.Error("Corruption must not change the data")
+	}
+	if resp.GetCiphertextCrc32C().GetValue() != sum {
+		t.Error("Corruption mutated the handler's response")
+	}
+
+	// Responses without a checksum get a wrong one
+	out, _, _ = call(t, inj, "Encrypt", context.Background(), &kmspb.EncryptRequest{Name: keyName}, &kmspb.EncryptResponse{Ciphertext: ciphertext})
+	if v := out.(*kmspb.EncryptResponse).GetCiphertextCrc32C(); v == nil || v.GetValue() == sum {
+		t.Errorf("Expected a wrong checksum to be added, got %v", v)
+	}
+}
+
+func TestDropClosesConnection(t *testing.T) {
+	inj := NewInjector()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	wrapped := inj.WrapListener(lis)
+	defer wrapped.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := wrapped.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	client, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+	server := <-accepted
+	defer server.Close()
+
+	inj.conns.close(client.LocalAddr().String())
+
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected EOF after drop, got %v", err)
+	}
+}
+
+func TestSetRules(t *testing.T) {
+	inj := NewInjector()
+	if _, err := inj.AddRule(Rule{Method: "Encrypt", Action: ActionError, Code: "INTERNAL"}); err != nil {
+		t.Fatalf("AddRule failed: %v", err)
+	}
+
+	invalid := []Rule{
+		{Method: "Decrypt", Action: ActionDrop},
+		{Action: "explode"},
+	}
+	if err := inj.SetRules(invalid); !errors.Is(err, ErrInvalidRule) {
+		t.Fatalf("Expected ErrInvalidRule, got %v", err)
+	}
+	if rules := inj.Rules(); len(rules) != 1 || rules[0].Method != "Encrypt" {
+		t.Errorf("Invalid rules must leave the current rules untouched, got %v", rules)
+	}
+
+	duplicate := []Rule{
+		{ID: "a", Action: ActionDrop},
+		{ID: "a", Action: ActionDrop},
+	}
+	if err := inj.SetRules(duplicate); !errors.Is(err, ErrInvalidRule) {
+		t.Errorf("Expected ErrInvalidRule for duplicate IDs, got %v", err)
+	}
+
+	if err := inj.SetRules([]Rule{{ID: "rule-2", Action: ActionDrop}, {Method: "Decrypt", Action: ActionDrop}}); err != nil {
+		t.Fatalf("SetRules failed: %v", err)
+	}
+	rules := inj.Rules()
+	if len(rules) != 2 || rules[0].ID != "rule-2" || rules[1].ID == "" || rules[1].ID == "rule-2" {
+		t.Errorf("Expected two rules with distinct IDs, got %v", rules)
+	}
+
+	if err := inj.SetRules(nil); err != nil || len(inj.Rules()) != 0 {
+		t.Errorf("Expected SetRules(nil) to clear rules, got %v %v", err, inj.Rules())
+	}
+}
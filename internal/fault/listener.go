@@ -0,0 +1,67 @@
+package fault
+
+import (
+	"net"
+	"sync"
+)
+
+// WrapListener returns a listener whose connections can be dropped by
+// ActionDrop rules. Serve the gRPC server on the returned listener.
+func (i *Injector) WrapListener(lis net.Listener) net.Listener {
+	return &trackingListener{Listener: lis, tracker: &i.conns}
+}
+
+// connTracker remembers open connections by remote address
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[string]net.Conn
+}
+
+func (t *connTracker) add(c net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns[c.RemoteAddr().String()] = c
+}
+
+func (t *connTracker) remove(c net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns[c.RemoteAddr().String()] == c {
+		delete(t.conns, c.RemoteAddr().String())
+	}
+}
+
+// close closes the connection from addr, if it is tracked
+func (t *connTracker) close(addr string) {
+	t.mu.Lock()
+	c, ok := t.conns[addr]
+	t.mu.Unlock()
+	if ok {
+		c.Close()
+	}
+}
+
+type trackingListener struct {
+	net.Listener
+	tracker *connTracker
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.tracker.add(c)
+	return &trackedConn{Conn: c, tracker: l.tracker}, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.tracker.remove(c.Conn) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,33 @@
+package gateway
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Encrypt and Decrypt carry their payloads base64-encoded in JSON, so a
+// 64 KiB plaintext makes a request and a response of about 88 KiB each.
+// Request and response bodies go through pooled buffers so they are not
+// allocated, and grown by repeated copies, on every request.
+
+// maxPooledBuffer is the capacity above which a buffer is dropped rather
+// than pooled, so one outsized request does not pin its memory
+const maxPooledBuffer = 1 << 20
+
+// bodyBuffers recycles request and response body buffers across requests
+var bodyBuffers = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bodyBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns buf to the pool. Nothing may use its bytes afterwards.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		bodyBuffers.Put(buf)
+	}
+}
@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// newLargePayloadGateway returns a gateway with an ENCRYPT_DECRYPT key and
+// its REST path
+func newLargePayloadGateway(t testing.TB) (*Server, string) {
+	t.Helper()
+	s := newTestGateway(t)
+	const keyRings = "/v1/projects/p/locations/global/keyRings"
+	do(s, http.MethodPost, keyRings+"?keyRingId=r", "")
+	if rec := do(s, http.MethodPost, keyRings+"/r/cryptoKeys?cryptoKeyId=k", `{"purpose":"ENCRYPT_DECRYPT"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("CreateCryptoKey: %d %s", rec.Code, rec.Body.String())
+	}
+	return s, keyRings + "/r/cryptoKeys/k"
+}
+
+func TestLargePayloadsUsePooledBuffers(t *testing.T) {
+	s, keyPath := newLargePayloadGateway(t)
+
+	// Each request reuses the buffers of the one before, so a decoded
+	// request or written response keeping them would see the next payload
+	for i, size := range []int{64 << 10, 100, 32 << 10, 64 << 10} {
+		plaintext := bytes.Repeat([]byte{byte('a' + i)}, size)
+		body := fmt.Sprintf(`{"plaintext":%q}`, base64.StdEncoding.EncodeToString(plaintext))
+		rec := do(s, http.MethodPost, keyPath+":encrypt", body)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Encrypt %d bytes: %d %s", size, rec.Code, rec.Body.String())
+		}
+		var enc kmspb.EncryptResponse
+		if err := protojson.Unmarshal(rec.Body.Bytes(), &enc); err != nil {
+			t.Fatalf("Invalid response: %v", err)
+		}
+
+		rec = do(s, http.MethodPost, keyPath+":decrypt", fmt.Sprintf(`{"ciphertext":%q}`, base64.StdEncoding.EncodeToString(enc.Ciphertext)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Decrypt %d bytes: %d %s", size, rec.Code, rec.Body.String())
+		}
+		var dec kmspb.DecryptResponse
+		if err := protojson.Unmarshal(rec.Body.Bytes(), &dec); err != nil {
+			t.Fatalf("Invalid response: %v", err)
+		}
+		if !bytes.Equal(dec.Plaintext, plaintext) {
+			t.Errorf("Decrypt %d bytes returned different plaintext", size)
+		}
+	}
+}
+
+func TestOversizedBuffersAreNotPooled(t *testing.T) {
+	buf := getBuffer()
+	buf.Grow(2 * maxPooledBuffer)
+	putBuffer(buf)
+	for range 10 {
+		if got := getBuffer(); got.Cap() > maxPooledBuffer {
+			t.Fatalf("Got a pooled buffer of %d bytes", got.Cap())
+		}
+	}
+}
+
+// BenchmarkEncrypt64KiB measures the gateway's allocations for the payload
+// size the pooled buffers are meant for
+func BenchmarkEncrypt64KiB(b *testing.B) {
+	s, keyPath := newLargePayloadGateway(b)
+	body := fmt.Sprintf(`{"plaintext":%q}`, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("x"), 64<<10)))
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	for b.Loop() {
+		req := httptest.NewRequest(http.MethodPost, keyPath+":encrypt", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		s.handleRequest(rec, req)
+		if rec.Code != http.StatusOK {
+			b.Fatalf("Encrypt: %d %s", rec.Code, rec.Body.String())
+		}
+	}
+}
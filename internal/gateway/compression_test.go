@@ -0,0 +1,99 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// echo returns the request body unchanged
+var echo = withCompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write(body)
+}))
+
+func gzipBytes(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		t.Fatalf("gzip write failed: %v", err)
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestCompressedRequestBody(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/v1/x", bytes.NewReader(gzipBytes(t, `{"plaintext":"aGk="}`)))
+	req.Header.Set("Content-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	echo.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"plaintext":"aGk="}` {
+		t.Errorf("Expected decoded body, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Content-Encoding") != "" {
+		t.Error("Response must not be compressed without Accept-Encoding")
+	}
+}
+
+func TestCompressedResponse(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/v1/x", strings.NewReader("hello"))
+	req.Header.Set("Accept-Encoding", "deflate, gzip;q=0.8")
+	rec := httptest.NewRecorder()
+	echo.ServeHTTP(rec, req)
+
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected gzip response, got headers %v", rec.Header())
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("Invalid gzip response: %v", err)
+	}
+	if body, _ := io.ReadAll(zr); string(body) != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", body)
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"gzip", true},
+		{"br, GZIP", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0", false},
+		{"identity", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.header); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/x", strings.NewReader("data"))
+	req.Header.Set("Content-Encoding", "br")
+	rec := httptest.NewRecorder()
+	echo.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for unsupported encoding, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/x", strings.NewReader("not gzip"))
+	req.Header.Set("Content-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	echo.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for corrupt gzip body, got %d", rec.Code)
+	}
+}
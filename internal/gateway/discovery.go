@@ -0,0 +1,268 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// DiscoveryPath and LegacyDiscoveryPath serve the Google API Discovery
+// document of the REST surface, at the paths cloudkms.googleapis.com and
+// www.googleapis.com serve it. Discovery-based clients, such as
+// google-api-python-client, fetch it before their first call.
+const (
+	DiscoveryPath       = "/$discovery/rest"
+	LegacyDiscoveryPath = "/discovery/v1/apis/cloudkms/v1/rest"
+)
+
+// discoveryScopes are the OAuth scopes of every method
+var discoveryScopes = []string{
+	"https://www.googleapis.com/auth/cloud-platform",
+	"https://www.googleapis.com/auth/cloudkms",
+}
+
+// discoveryDocument returns the document without its URLs, built on first
+// use since the route table and descriptors are static
+func (s *Server) discoveryDocument() (map[string]any, error) {
+	s.discoveryOnce.Do(func() {
+		s.discovery, s.discoveryErr = buildDiscovery(routes, s.protoNames)
+	})
+	return s.discovery, s.discoveryErr
+}
+
+// handleDiscovery serves the discovery document, with rootUrl pointing at
+// the gateway as the client reached it
+func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+	if version := r.URL.Query().Get("version"); version != "" && version != "v1" {
+		writeError(w, codes.NotFound, "No discovery document for version %q; the emulator serves v1", version)
+		return
+	}
+	doc, err := s.discoveryDocument()
+	if err != nil {
+		writeError(w, codes.Internal, "Failed to build discovery document: %v", err)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	rootURL := fmt.Sprintf("%s://%s/", scheme, r.Host)
+	doc = maps.Clone(doc)
+	doc["rootUrl"] = rootURL
+	doc["baseUrl"] = rootURL
+	doc["mtlsRootUrl"] = rootURL
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		writeError(w, codes.Internal, "Failed to marshal discovery document: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// buildDiscovery generates a discovery document for routes. Methods are
+// grouped into the resources of their path and named as on
+// cloudkms.googleapis.com (cloudkms.projects.locations.keyRings.list), with
+// schemas from the protobuf descriptors as in buildOpenAPI.
+func buildDiscovery(routes []route, protoNames bool) (map[string]any, error) {
+	g := &schemaGenerator{protoNames: protoNames, schemas: map[string]any{}, discovery: true}
+
+	parameters := map[string]any{}
+	for name, param := range systemParameters {
+		param = maps.Clone(param)
+		param["location"] = "query"
+		parameters[name] = param
+	}
+
+	root := map[string]any{}
+	for _, rt := range routes {
+		method, err := rt.methodDescriptor()
+		if err != nil {
+			return nil, err
+		}
+		resources, methodName := rt.discoveryName(method)
+		nameField, err := rt.nameField(method)
+		if err != nil {
+			return nil, err
+		}
+
+		params := map[string]any{
+			nameField: map[string]any{
+				"type":     "string",
+				"location": "path",
+				"required": true,
+				"pattern":  namePattern(rt.name),
+			},
+		}
+		for _, name := range rt.query {
+			field, err := rt.queryField(method, name)
+			if err != nil {
+				return nil, err
+			}
+			param := maps.Clone(g.fieldSchema(field))
+			param["location"] = "query"
+			if field.IsList() {
+				param["repeated"] = true
+			}
+			params[name] = param
+		}
+
+		id := "cloudkms." + strings.Join(resources, ".") + "." + methodName
+		m := map[string]any{
+			"id":             id,
+			"path":           "v1/{+" + nameField + "}" + strings.TrimPrefix(rt.path, rt.name),
+			"flatPath":       "v1/" + rt.path,
+			"httpMethod":     rt.method,
+			"parameters":     params,
+			"parameterOrder": []string{nameField},
+			"response":       g.messageSchema(method.Output()),
+			"scopes":         discoveryScopes,
+		}
+		body, err := rt.bodyMessage(method)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			m["request"] = g.messageSchema(body)
+		}
+
+		// Walk down to the resource, creating the levels on the way
+		node := root
+		for _, name := range resources {
+			children, _ := node["resources"].(map[string]any)
+			if children == nil {
+				children = map[string]any{}
+				node["resources"] = children
+			}
+			child, _ := children[name].(map[string]any)
+			if child == nil {
+				child = map[string]any{}
+				children[name] = child
+			}
+			node = child
+		}
+		methods, _ := node["methods"].(map[string]any)
+		if methods == nil {
+			methods = map[string]any{}
+			node["methods"] = methods
+		}
+		if _, ok := methods[methodName]; ok {
+			return nil, fmt.Errorf("route %s %s: duplicate discovery method %s", rt.method, rt.path, id)
+		}
+		methods[methodName] = m
+	}
+
+	return map[string]any{
+		"kind":             "discovery#restDescription",
+		"discoveryVersion": "v1",
+		"id":               "cloudkms:v1",
+		"name":             "cloudkms",
+		"version":          "v1",
+		"title":            "Cloud Key Management Service (KMS) API",
+		"description":      "REST surface served by the GCP KMS emulator",
+		"protocol":         "rest",
+		"servicePath":      "",
+		"batchPath":        "batch",
+		"ownerDomain":      "google.com",
+		"ownerName":        "Google",
+		"auth": map[string]any{"oauth2": map[string]any{"scopes": map[string]any{
+			discoveryScopes[0]: map[string]any{"description": "See, edit, configure, and delete your Google Cloud data and see the email address for your Google Account."},
+			discoveryScopes[1]: map[string]any{"description": "View and manage your keys and secrets stored in Cloud Key Management Service"},
+		}}},
+		"parameters": parameters,
+		"resources":  root["resources"],
+		"schemas":    g.schemas,
+	}, nil
+}
+
+// discoveryName returns the resource path and method name of the route in
+// the discovery document. Collections followed by an ID form the resource
+// path; a trailing collection belongs to it too, except a singleton like
+// publicKey, which names a get method instead. Custom verbs name their
+// method; other methods are list, create, get or patch.
+func (rt *route) discoveryName(method protoreflect.MethodDescriptor) ([]string, string) {
+	verb := rt.verb()
+	segments := strings.Split(strings.TrimSuffix(rt.path, ":"+verb), "/")
+	isParam := func(segment string) bool { return strings.HasPrefix(segment, "{") }
+
+	var resources []string
+	for i, segment := range segments[:len(segments)-1] {
+		if !isParam(segment) && isParam(segments[i+1]) {
+			resources = append(resources, segment)
+		}
+	}
+
+	rpc := string(method.Name())
+	name := verb
+	if last := segments[len(segments)-1]; !isParam(last) {
+		if strings.HasPrefix(rpc, "Get") && name == "" {
+			name = "get" + string(unicode.ToUpper(rune(last[0]))) + last[1:]
+		} else {
+			resources = append(resources, last)
+		}
+	}
+	if name == "" {
+		switch {
+		case strings.HasPrefix(rpc, "List"):
+			name = "list"
+		case strings.HasPrefix(rpc, "Create"):
+			name = "create"
+		case strings.HasPrefix(rpc, "Update"):
+			name = "patch"
+		default:
+			name = "get"
+		}
+	}
+	return resources, name
+}
+
+// nameField returns the request field the route's resource name fills. For
+// updates it is the name of the resource in the body, called name as on
+// cloudkms.googleapis.com.
+func (rt *route) nameField(method protoreflect.MethodDescriptor) (string, error) {
+	for _, name := range []protoreflect.Name{"name", "parent", "resource", "location"} {
+		if method.Input().Fields().ByName(name) != nil {
+			return string(name), nil
+		}
+	}
+	if body, err := rt.bodyMessage(method); err == nil && body != nil && body.Fields().ByName("name") != nil {
+		return "name", nil
+	}
+	return "", fmt.Errorf("route %s %s: %s has no resource name field", rt.method, rt.path, method.Input().FullName())
+}
+
+// namePattern returns the regular expression resource names of a template
+// match, as discovery documents give it
+func namePattern(template string) string {
+	return "^" + pathParam.ReplaceAllString(template, "[^/]+") + "$"
+}
+
+// discoveryWellKnown adjusts the schema of a well-known type to the formats
+// and any type of discovery documents
+func discoveryWellKnown(name protoreflect.FullName, schema map[string]any) map[string]any {
+	switch name {
+	case "google.protobuf.Timestamp":
+		return map[string]any{"type": "string", "format": "google-datetime"}
+	case "google.protobuf.Duration":
+		return map[string]any{"type": "string", "format": "google-duration"}
+	case "google.protobuf.FieldMask":
+		return map[string]any{"type": "string", "format": "google-fieldmask"}
+	case "google.protobuf.Any", "google.protobuf.Struct":
+		return map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "any"}}
+	case "google.protobuf.Value":
+		return map[string]any{"type": "any"}
+	}
+	return schema
+}
@@ -0,0 +1,95 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestDiscovery(t *testing.T) {
+	s := newTestGateway(t)
+
+	rec := httptest.NewRecorder()
+	s.handleDiscovery(rec, httptest.NewRequest(http.MethodGet, "http://localhost:8080"+DiscoveryPath+"?version=v1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	type method struct {
+		ID             string                    `json:"id"`
+		Path           string                    `json:"path"`
+		HTTPMethod     string                    `json:"httpMethod"`
+		Parameters     map[string]map[string]any `json:"parameters"`
+		ParameterOrder []string                  `json:"parameterOrder"`
+		Request        map[string]string         `json:"request"`
+		Response       map[string]string         `json:"response"`
+	}
+	type resource struct {
+		Methods   map[string]method    `json:"methods"`
+		Resources map[string]*resource `json:"resources"`
+	}
+	var doc struct {
+		ID        string               `json:"id"`
+		RootURL   string               `json:"rootUrl"`
+		Resources map[string]*resource `json:"resources"`
+		Schemas   map[string]any       `json:"schemas"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("Invalid document: %v", err)
+	}
+	if doc.ID != "cloudkms:v1" || doc.RootURL != "http://localhost:8080/" {
+		t.Errorf("Unexpected id %q or rootUrl %q", doc.ID, doc.RootURL)
+	}
+
+	locations := doc.Resources["projects"].Resources["locations"]
+	keyRings := locations.Resources["keyRings"]
+	cryptoKeys := keyRings.Resources["cryptoKeys"]
+	versions := cryptoKeys.Resources["cryptoKeyVersions"]
+
+	list := keyRings.Methods["list"]
+	if list.ID != "cloudkms.projects.locations.keyRings.list" || list.Path != "v1/{+parent}/keyRings" || list.HTTPMethod != http.MethodGet {
+		t.Errorf("Unexpected keyRings.list: %+v", list)
+	}
+	if p := list.Parameters["parent"]; p["location"] != "path" || p["pattern"] != "^projects/[^/]+/locations/[^/]+$" {
+		t.Errorf("Unexpected parent parameter: %v", p)
+	}
+	if p := list.Parameters["pageSize"]; p["location"] != "query" || p["type"] != "integer" {
+		t.Errorf("Unexpected pageSize parameter: %v", p)
+	}
+
+	encrypt := cryptoKeys.Methods["encrypt"]
+	if encrypt.Path != "v1/{+name}:encrypt" || encrypt.Request["$ref"] != "EncryptRequest" || encrypt.Response["$ref"] != "EncryptResponse" {
+		t.Errorf("Unexpected cryptoKeys.encrypt: %+v", encrypt)
+	}
+	if create := cryptoKeys.Methods["create"]; create.Request["$ref"] != "CryptoKey" {
+		t.Errorf("Expected cryptoKeys.create to take a CryptoKey, got %+v", create)
+	}
+	if get := versions.Methods["getPublicKey"]; get.Path != "v1/{+name}/publicKey" {
+		t.Errorf("Unexpected cryptoKeyVersions.getPublicKey: %+v", get)
+	}
+	if imp := versions.Methods["import"]; imp.Path != "v1/{+parent}/cryptoKeyVersions:import" {
+		t.Errorf("Unexpected cryptoKeyVersions.import: %+v", imp)
+	}
+	if policy := keyRings.Methods["getIamPolicy"]; policy.HTTPMethod != http.MethodGet || policy.ParameterOrder[0] != "resource" || policy.Parameters["options.requestedPolicyVersion"] == nil {
+		t.Errorf("Unexpected keyRings.getIamPolicy: %+v", policy)
+	}
+	if _, ok := locations.Methods["generateRandomBytes"]; !ok {
+		t.Error("Expected locations.generateRandomBytes")
+	}
+
+	// Every $ref must resolve to a schema in the document
+	for _, ref := range regexp.MustCompile(`"\$ref": "([^"]+)"`).FindAllStringSubmatch(rec.Body.String(), -1) {
+		if _, ok := doc.Schemas[ref[1]]; !ok {
+			t.Errorf("Unresolved reference %s", ref[1])
+		}
+	}
+
+	// Only v1 exists
+	rec = httptest.NewRecorder()
+	s.handleDiscovery(rec, httptest.NewRequest(http.MethodGet, DiscoveryPath+"?version=v2", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for v2, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,97 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// errorBody is the error envelope returned by Google REST APIs:
+//
+//	{"error": {"code": 404, "message": "...", "status": "NOT_FOUND", "details": [...]}}
+type errorBody struct {
+	Error errorInfo `json:"error"`
+}
+
+type errorInfo struct {
+	Code    int               `json:"code"`
+	Message string            `json:"message"`
+	Status  string            `json:"status"`
+	Details []json.RawMessage `json:"details,omitempty"`
+}
+
+// httpStatusFromCode maps a gRPC code to the HTTP status Google APIs use for it
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499 // Client Closed Request
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeGRPCError writes the status of a failed gRPC call
+func writeGRPCError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	writeStatus(w, httpStatusFromCode(st.Code()), st)
+}
+
+// writeError writes an error raised by the gateway itself
+func writeError(w http.ResponseWriter, code codes.Code, format string, args ...any) {
+	writeStatus(w, httpStatusFromCode(code), status.New(code, fmt.Sprintf(format, args...)))
+}
+
+// writeHTTPError writes an error whose HTTP status has no exact gRPC
+// equivalent, such as 405 or 413
+func writeHTTPError(w http.ResponseWriter, httpStatus int, code codes.Code, format string, args ...any) {
+	writeStatus(w, httpStatus, status.New(code, fmt.Sprintf(format, args...)))
+}
+
+// methodNotAllowed rejects an HTTP method the route does not support
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeHTTPError(w, http.StatusMethodNotAllowed, codes.Unimplemented, "Method %s is not allowed for %s", r.Method, r.URL.Path)
+}
+
+// writeStatus writes st in the Google error envelope. Details whose type is
+// not linked into the binary are omitted.
+func writeStatus(w http.ResponseWriter, httpStatus int, st *status.Status) {
+	body := errorBody{Error: errorInfo{
+		Code:    httpStatus,
+		Message: st.Message(),
+		Status:  code.Code(st.Code()).String(),
+	}}
+	for _, detail := range st.Proto().GetDetails() {
+		if data, err := protojson.Marshal(detail); err == nil {
+			body.Error.Details = append(body.Error.Details, data)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(httpStatus)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,101 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func decodeError(t *testing.T, rec *httptest.ResponseRecorder) errorInfo {
+	t.Helper()
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json; charset=UTF-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var body errorBody
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Invalid error body %q: %v", rec.Body.String(), err)
+	}
+	return body.Error
+}
+
+func TestWriteGRPCError(t *testing.T) {
+	st, err := status.New(codes.FailedPrecondition, "version is destroyed").WithDetails(&errdetails.ErrorInfo{
+		Reason: "KEY_DESTROYED",
+		Domain: "cloudkms.googleapis.com",
+	})
+	if err != nil {
+		t.Fatalf("WithDetails failed: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	writeGRPCError(rec, st.Err())
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", rec.Code)
+	}
+	got := decodeError(t, rec)
+	if got.Code != 400 || got.Status != "FAILED_PRECONDITION" || got.Message != "version is destroyed" {
+		t.Errorf("Unexpected error: %+v", got)
+	}
+	if len(got.Details) != 1 {
+		t.Fatalf("Expected 1 detail, got %d", len(got.Details))
+	}
+	var detail map[string]any
+	if err := json.Unmarshal(got.Details[0], &detail); err != nil {
+		t.Fatalf("Invalid detail: %v", err)
+	}
+	if detail["@type"] != "type.googleapis.com/google.rpc.ErrorInfo" || detail["reason"] != "KEY_DESTROYED" {
+		t.Errorf("Unexpected detail: %v", detail)
+	}
+}
+
+func TestHTTPStatusFromCode(t *testing.T) {
+	tests := map[codes.Code]int{
+		codes.InvalidArgument:   http.StatusBadRequest,
+		codes.NotFound:          http.StatusNotFound,
+		codes.AlreadyExists:     http.StatusConflict,
+		codes.PermissionDenied:  http.StatusForbidden,
+		codes.Unauthenticated:   http.StatusUnauthorized,
+		codes.ResourceExhausted: http.StatusTooManyRequests,
+		codes.Unimplemented:     http.StatusNotImplemented,
+		codes.Unavailable:       http.StatusServiceUnavailable,
+		codes.DeadlineExceeded:  http.StatusGatewayTimeout,
+		codes.Internal:          http.StatusInternalServerError,
+	}
+	for code, want := range tests {
+		if got := httpStatusFromCode(code); got != want {
+			t.Errorf("httpStatusFromCode(%v) = %d, want %d", code, got, want)
+		}
+	}
+}
+
+func TestRouteErrors(t *testing.T) {
+	s, err := NewServer("passthrough:///unused")
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	defer s.Stop(t.Context())
+
+	tests := []struct {
+		method, path string
+		wantCode     int
+		wantStatus   string
+	}{
+		{http.MethodGet, "/v1/unknown", http.StatusNotFound, "NOT_FOUND"},
+		{http.MethodDelete, "/v1/projects/p/locations/global/keyRings", http.StatusMethodNotAllowed, "UNIMPLEMENTED"},
+		{http.MethodPost, "/v1/projects/p/locations/global/keyRings", http.StatusBadRequest, "INVALID_ARGUMENT"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		s.handleRequest(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		got := decodeError(t, rec)
+		if rec.Code != tt.wantCode || got.Code != tt.wantCode || got.Status != tt.wantStatus {
+			t.Errorf("%s %s: got %d %+v, want %d %s", tt.method, tt.path, rec.Code, got, tt.wantCode, tt.wantStatus)
+		}
+	}
+}
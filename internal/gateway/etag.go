@@ -0,0 +1,123 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/server"
+)
+
+// withETags makes REST resources cacheable and safe to update concurrently:
+//
+//   - successful GET and PATCH responses carry an ETag
+//   - GET with a matching If-None-Match is answered 304 Not Modified
+//   - PATCH with If-Match is rejected with 412 Precondition Failed when the
+//     resource no longer has that ETag
+//
+// Crypto keys and versions carry the etag the gRPC server sends in
+// server.ETagHeader, so REST and gRPC clients share one etag per resource.
+// If-Match is forwarded as server.IfMatchHeader (see outgoingContext) and
+// checked by storage under the key ring's lock, so of two concurrent PATCHes
+// with the same ETag only one applies. A fields-pruned response carries the
+// resource's ETag as a weak one, since it is not the full representation.
+// Other resources, such as key rings and lists, get an ETag of the response
+// body for conditional GETs.
+func withETags(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPatch:
+			if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+				if _, ok := ifMatchETag(ifMatch); !ok {
+					writeHTTPError(w, http.StatusPreconditionFailed, codes.Aborted,
+						"If-Match %s must be * or a single strong ETag", ifMatch)
+					return
+				}
+			}
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		buf := newBufferedResponseWriter(w)
+		defer buf.release()
+		next.ServeHTTP(buf, r)
+
+		if buf.status == http.StatusOK {
+			etag := w.Header().Get("ETag")
+			switch {
+			case etag == "":
+				etag = computeETag(buf.body.Bytes())
+			case r.URL.Query().Get("fields") != "":
+				etag = "W/" + etag
+			}
+			w.Header().Set("ETag", etag)
+			if r.Method == http.MethodGet && etagListMatches(r.Header.Get("If-None-Match"), etag) {
+				w.Header().Del("Content-Type")
+				w.Header().Del("Content-Length")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(buf.status)
+		_, _ = w.Write(buf.body.Bytes())
+	})
+}
+
+// ifMatchETag returns the etag an If-Match header requires, unquoted, or ""
+// for "*", which any existing resource matches. Weak ETags never match
+// If-Match, and lists of several ETags are not supported.
+func ifMatchETag(header string) (string, bool) {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return "", true
+	}
+	if len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' || strings.Contains(header[1:len(header)-1], `"`) {
+		return "", false
+	}
+	return header[1 : len(header)-1], true
+}
+
+// writeETag sets the ETag of a crypto key or version from the etag the gRPC
+// server sent in md
+func writeETag(w http.ResponseWriter, md metadata.MD) {
+	if values := md.Get(server.ETagHeader); len(values) > 0 {
+		w.Header().Set("ETag", `"`+values[0]+`"`)
+	}
+}
+
+// writeUpdateError writes the status of a failed update, answering a stale
+// If-Match (ABORTED) with 412 Precondition Failed
+func writeUpdateError(w http.ResponseWriter, err error) {
+	if st := status.Convert(err); st.Code() == codes.Aborted {
+		writeHTTPError(w, http.StatusPreconditionFailed, codes.Aborted, "%s", st.Message())
+		return
+	}
+	writeGRPCError(w, err)
+}
+
+// computeETag returns a strong ETag for a response body
+func computeETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagListMatches reports whether an If-None-Match header matches etag,
+// using weak comparison, which ignores the W/ prefix. "*" matches any ETag.
+func etagListMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
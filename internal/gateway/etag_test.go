@@ -0,0 +1,169 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/server"
+)
+
+func TestETags(t *testing.T) {
+	s := newTestGateway(t)
+	handler := withETags(withPartialResponse(http.HandlerFunc(s.handleRequest)))
+	serve := func(method, path, body string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	const keyRings = "/v1/projects/p/locations/global/keyRings"
+	const key = keyRings + "/r/cryptoKeys/k"
+	serve(http.MethodPost, keyRings+"?keyRingId=r", "")
+	serve(http.MethodPost, keyRings+"/r/cryptoKeys?cryptoKeyId=k", `{"purpose":"ENCRYPT_DECRYPT"}`)
+
+	rec := serve(http.MethodGet, key, "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("Expected 200 with an ETag, got %d %q", rec.Code, etag)
+	}
+
+	// Conditional GET
+	if rec := serve(http.MethodGet, key, "", "If-None-Match", etag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("Expected 304 without a body, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(http.MethodGet, key, "", "If-None-Match", `"stale"`); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a stale If-None-Match, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodGet, key+"?fields=name", ""); rec.Header().Get("ETag") != "W/"+etag {
+		t.Errorf("Expected a partial response to carry the weak ETag of the resource, got %q", rec.Header().Get("ETag"))
+	}
+
+	// Conditional PATCH
+	patch := `{"labels":{"env":"test"}}`
+	if rec := serve(http.MethodPatch, key+"?updateMask=labels", patch, "If-Match", `"stale"`); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a stale If-Match, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = serve(http.MethodPatch, key+"?updateMask=labels", patch, "If-Match", etag)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for a current If-Match, got %d %s", rec.Code, rec.Body.String())
+	}
+	updated := rec.Header().Get("ETag")
+	if updated == "" || updated == etag {
+		t.Errorf("Expected a new ETag after the update, got %q", updated)
+	}
+	if rec := serve(http.MethodGet, key, ""); rec.Header().Get("ETag") != updated {
+		t.Errorf("GET after PATCH returned ETag %q, PATCH returned %q", rec.Header().Get("ETag"), updated)
+	}
+
+	// REST and gRPC share the etag
+	if want := `"` + grpcETag(t, s, key) + `"`; updated != want {
+		t.Errorf("Expected the REST ETag %q to be the gRPC etag %q", updated, want)
+	}
+
+	// The old ETag no longer matches
+	if rec := serve(http.MethodPatch, key+"?updateMask=labels", patch, "If-Match", etag); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for the pre-update ETag, got %d", rec.Code)
+	}
+
+	// Errors carry no ETag
+	if rec := serve(http.MethodGet, keyRings+"/missing", ""); rec.Code != http.StatusNotFound || rec.Header().Get("ETag") != "" {
+		t.Errorf("Expected 404 without an ETag, got %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func TestUsageHeaders(t *testing.T) {
+	s := newTestGateway(t)
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.handleRequest(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	const keyRings = "/v1/projects/p/locations/global/keyRings"
+	const key = keyRings + "/r/cryptoKeys/k"
+	serve(http.MethodPost, keyRings+"?keyRingId=r", "")
+	serve(http.MethodPost, keyRings+"/r/cryptoKeys?cryptoKeyId=k", `{"purpose":"ENCRYPT_DECRYPT"}`)
+	if rec := serve(http.MethodPost, key+":encrypt", `{"plaintext":"ZGF0YQ=="}`); rec.Code != http.StatusOK {
+		t.Fatalf("Encrypt failed: %d %s", rec.Code, rec.Body.String())
+	}
+
+	for _, path := range []string{key, key + "/cryptoKeyVersions/1"} {
+		rec := serve(http.MethodGet, path, "")
+		if rec.Header().Get("X-Emulator-Use-Count") != "1" || rec.Header().Get("X-Emulator-Last-Use-Time") == "" {
+			t.Errorf("GET %s: expected usage headers, got %v", path, rec.Header())
+		}
+	}
+}
+
+// grpcETag returns the etag the gRPC server sends for the crypto key at a
+// REST path
+func grpcETag(t *testing.T, s *Server, path string) string {
+	t.Helper()
+	var md metadata.MD
+	if _, err := s.grpcClient.GetCryptoKey(context.Background(), &kmspb.GetCryptoKeyRequest{Name: strings.TrimPrefix(path, "/v1/")}, grpc.Header(&md)); err != nil {
+		t.Fatalf("GetCryptoKey failed: %v", err)
+	}
+	return md.Get(server.ETagHeader)[0]
+}
+
+func TestConcurrentConditionalPatch(t *testing.T) {
+	s := newTestGateway(t)
+	handler := withETags(http.HandlerFunc(s.handleRequest))
+	serve := func(method, path, body, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	const keyRings = "/v1/projects/p/locations/global/keyRings"
+	const key = keyRings + "/r/cryptoKeys/k"
+	serve(http.MethodPost, keyRings+"?keyRingId=r", "", "")
+	serve(http.MethodPost, keyRings+"/r/cryptoKeys?cryptoKeyId=k", `{"purpose":"ENCRYPT_DECRYPT"}`, "")
+
+	// Of PATCHes racing with the same ETag, exactly one applies
+	for round := range 20 {
+		etag := serve(http.MethodGet, key, "", "").Header().Get("ETag")
+		codes := make([]int, 4)
+		var wg sync.WaitGroup
+		for i := range codes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				patch := fmt.Sprintf(`{"labels":{"round":"r%d","writer":"w%d"}}`, round, i)
+				codes[i] = serve(http.MethodPatch, key+"?updateMask=labels", patch, etag).Code
+			}()
+		}
+		wg.Wait()
+
+		applied := 0
+		for _, code := range codes {
+			switch code {
+			case http.StatusOK:
+				applied++
+			case http.StatusPreconditionFailed:
+			default:
+				t.Fatalf("Unexpected status %d", code)
+			}
+		}
+		if applied != 1 {
+			t.Fatalf("Round %d: expected exactly one PATCH to apply, got %v", round, codes)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+)
+
+// fieldSelection is a parsed fields parameter: each selected field maps to
+// the selection of its sub-fields, or nil when the whole field is kept
+type fieldSelection map[string]fieldSelection
+
+// withPartialResponse honors the standard fields query parameter, pruning
+// successful JSON responses to the selected fields, as Google APIs do:
+//
+//	?fields=name,primary.state
+//	?fields=cryptoKeys(name,labels),nextPageToken
+//	?fields=cryptoKeys/primary/state
+//
+// Sub-fields are separated by "/" or ".", and "*" selects every field.
+// Errors are never pruned.
+func withPartialResponse(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.URL.Query().Get("fields")
+		if value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		selection, err := parseFields(value)
+		if err != nil {
+			writeError(w, codes.InvalidArgument, "Invalid field selection %q: %v", value, err)
+			return
+		}
+
+		buf := newBufferedResponseWriter(w)
+		defer buf.release()
+		next.ServeHTTP(buf, r)
+
+		body := buf.body.Bytes()
+		if buf.status >= 200 && buf.status < 300 && len(bytes.TrimSpace(body)) > 0 {
+			if pruned, err := pruneJSON(body, selection); err == nil {
+				body = pruned
+			}
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(buf.status)
+		_, _ = w.Write(body)
+	})
+}
+
+// bufferedResponseWriter holds the response until the handler returns
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   *bytes.Buffer
+}
+
+// newBufferedResponseWriter buffers a response to w in a pooled buffer,
+// which release returns
+func newBufferedResponseWriter(w http.ResponseWriter) *bufferedResponseWriter {
+	return &bufferedResponseWriter{ResponseWriter: w, status: http.StatusOK, body: getBuffer()}
+}
+
+func (b *bufferedResponseWriter) release() {
+	putBuffer(b.body)
+	b.body = nil
+}
+
+func (b *bufferedResponseWriter) WriteHeader(code int) {
+	b.status = code
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+// parseFields parses a fields parameter
+func parseFields(value string) (fieldSelection, error) {
+	p := &fieldsParser{input: value}
+	selection, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.input) {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.input[p.pos], p.pos)
+	}
+	return selection, nil
+}
+
+type fieldsParser struct {
+	input string
+	pos   int
+}
+
+// parseList parses comma-separated selections up to the end of the input or
+// a closing parenthesis
+func (p *fieldsParser) parseList() (fieldSelection, error) {
+	selection := fieldSelection{}
+	for {
+		if err := p.parseSelection(selection); err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.pos >= len(p.input) || p.input[p.pos] != ',' {
+			return selection, nil
+		}
+		p.pos++
+	}
+}
+
+// parseSelection parses one path such as primary/state or
+// cryptoKeys(name,labels) and merges it into selection
+func (p *fieldsParser) parseSelection(selection fieldSelection) error {
+	var path []string
+	for {
+		name := p.parseName()
+		if name == "" {
+			return fmt.Errorf("expected a field name at offset %d", p.pos)
+		}
+		path = append(path, name)
+		if p.pos < len(p.input) && (p.input[p.pos] == '/' || p.input[p.pos] == '.') {
+			p.pos++
+			continue
+		}
+		break
+	}
+
+	var sub fieldSelection
+	p.skipSpace()
+	if p.pos < len(p.input) && p.input[p.pos] == '(' {
+		p.pos++
+		var err error
+		if sub, err = p.parseList(); err != nil {
+			return err
+		}
+		p.skipSpace()
+		if p.pos >= len(p.input) || p.input[p.pos] != ')' {
+			return fmt.Errorf("missing ) at offset %d", p.pos)
+		}
+		p.pos++
+	}
+
+	// Nest the path, e.g. a/b/c becomes {a: {b: {c: sub}}}
+	for i := len(path) - 1; i > 0; i-- {
+		sub = fieldSelection{path[i]: sub}
+	}
+	selection.merge(path[0], sub)
+	return nil
+}
+
+func (p *fieldsParser) parseName() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		if c == '_' || c == '*' || c == '-' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *fieldsParser) skipSpace() {
+	for p.pos < len(p.input) && p.input[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// merge adds name with its sub-selection. Selecting a whole field wins over
+// selecting some of its sub-fields.
+func (s fieldSelection) merge(name string, sub fieldSelection) {
+	existing, ok := s[name]
+	switch {
+	case !ok:
+		s[name] = sub
+	case existing == nil || sub == nil:
+		s[name] = nil
+	default:
+		for k, v := range sub {
+			existing.merge(k, v)
+		}
+	}
+}
+
+// lookup finds the selection for a JSON key. Keys match exactly or ignoring
+// case and underscores, so a camelCase selection such as nextPageToken also
+// matches next_page_token.
+func (s fieldSelection) lookup(key string) (fieldSelection, bool) {
+	if sub, ok := s[key]; ok {
+		return sub, true
+	}
+	normalized := normalizeFieldName(key)
+	for name, sub := range s {
+		if name != "*" && normalizeFieldName(name) == normalized {
+			return sub, true
+		}
+	}
+	sub, ok := s["*"]
+	return sub, ok
+}
+
+func normalizeFieldName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", ""))
+}
+
+// pruneJSON keeps the selected fields of a JSON document, preserving the
+// order of the remaining fields. Selections apply to each element of arrays.
+func pruneJSON(data []byte, selection fieldSelection) ([]byte, error) {
+	if selection == nil {
+		return data, nil
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return data, nil
+	}
+
+	switch data[0] {
+	case '{':
+		dec := json.NewDecoder(bytes.NewReader(data))
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		var out bytes.Buffer
+		out.WriteByte('{')
+		for dec.More() {
+			token, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, _ := token.(string)
+			var value json.RawMessage
+			if err := dec.Decode(&value); err != nil {
+				return nil, err
+			}
+			sub, ok := selection.lookup(key)
+			if !ok || sub != nil && !selectable(value) {
+				continue
+			}
+			if value, err = pruneJSON(value, sub); err != nil {
+				return nil, err
+			}
+			if out.Len() > 1 {
+				out.WriteByte(',')
+			}
+			name, _ := json.Marshal(key)
+			out.Write(name)
+			out.WriteByte(':')
+			out.Write(value)
+		}
+		out.WriteByte('}')
+		return out.Bytes(), nil
+
+	case '[':
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, err
+		}
+		for i, item := range items {
+			pruned, err := pruneJSON(item, selection)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = pruned
+		}
+		return json.Marshal(items)
+	}
+
+	return data, nil
+}
+
+// selectable reports whether sub-fields can be selected from a JSON value.
+// A scalar has none, so a/b drops a scalar a; null is kept as an unset
+// message.
+func selectable(value json.RawMessage) bool {
+	value = bytes.TrimSpace(value)
+	return len(value) > 0 && (value[0] == '{' || value[0] == '[' || value[0] == 'n')
+}
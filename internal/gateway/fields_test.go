@@ -0,0 +1,70 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPruneJSON(t *testing.T) {
+	const doc = `{"cryptoKeys":[{"name":"k1","purpose":"MAC","primary":{"name":"v1","state":"ENABLED"}},{"name":"k2","purpose":"MAC","primary":null}],"next_page_token":"t","total_size":2}`
+
+	tests := []struct {
+		fields string
+		want   string
+	}{
+		{"nextPageToken", `{"next_page_token":"t"}`},
+		{"cryptoKeys/name", `{"cryptoKeys":[{"name":"k1"},{"name":"k2"}]}`},
+		{"cryptoKeys(name,primary.state),totalSize", `{"cryptoKeys":[{"name":"k1","primary":{"state":"ENABLED"}},{"name":"k2","primary":null}],"total_size":2}`},
+		{"cryptoKeys/primary/state,cryptoKeys", `{"cryptoKeys":[{"name":"k1","purpose":"MAC","primary":{"name":"v1","state":"ENABLED"}},{"name":"k2","purpose":"MAC","primary":null}]}`},
+		{"cryptoKeys/*/state", `{"cryptoKeys":[{"primary":{"state":"ENABLED"}},{"primary":null}]}`},
+		{"missing", `{}`},
+	}
+	for _, tt := range tests {
+		selection, err := parseFields(tt.fields)
+		if err != nil {
+			t.Fatalf("parseFields(%q): %v", tt.fields, err)
+		}
+		got, err := pruneJSON([]byte(doc), selection)
+		if err != nil {
+			t.Fatalf("pruneJSON(%q): %v", tt.fields, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("fields=%s\n got %s\nwant %s", tt.fields, got, tt.want)
+		}
+	}
+}
+
+func TestParseFieldsInvalid(t *testing.T) {
+	for _, fields := range []string{",", "a(b", "a)", "a/", "a b"} {
+		if _, err := parseFields(fields); err == nil {
+			t.Errorf("Expected an error for %q", fields)
+		}
+	}
+}
+
+func TestPartialResponse(t *testing.T) {
+	s := newTestGateway(t)
+	handler := withPartialResponse(http.HandlerFunc(s.handleRequest))
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	const keyRings = "/v1/projects/p/locations/global/keyRings"
+	if rec := serve(http.MethodPost, keyRings+"?keyRingId=r&fields=name"); rec.Code != http.StatusCreated || rec.Body.String() != `{"name":"projects/p/locations/global/keyRings/r"}` {
+		t.Fatalf("CreateKeyRing: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec := serve(http.MethodGet, keyRings+"/missing?fields=name")
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), `"status":"NOT_FOUND"`) {
+		t.Errorf("Expected an unpruned NOT_FOUND error, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = serve(http.MethodGet, keyRings+"?fields=keyRings(")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid selection, got %d %s", rec.Code, rec.Body.String())
+	}
+}
@@ -9,7 +9,29 @@
 //   - Path structure: /v1/projects/{project}/locations/{location}/...
 //   - HTTP methods: GET (retrieve), POST (create/action), PATCH (update)
 //   - JSON request/response bodies using protobuf JSON encoding
-//   - Query parameters for pagination (pageToken, pageSize)
+//   - List query parameters: pageSize, pageToken, filter, orderBy and
+//     versionView (cryptoKeys) or view (cryptoKeyVersions)
+//   - Partial responses with the fields query parameter
+//   - The standard system parameters gcloud and discovery-based clients send:
+//     alt=json, $.xgafv, prettyPrint, key, quotaUser and access_token (see
+//     withSystemParameters)
+//   - ETag on GET and PATCH responses, If-None-Match (304) on GET and
+//     If-Match (412) on PATCH
+//   - x-goog-request-params and x-goog-api-client headers are forwarded to
+//     the gRPC server (see package routing)
+//   - Authorization, X-Emulator-Principal and X-Emulator-Impersonate are
+//     forwarded so IAM checks see the caller; without X-Emulator-Principal,
+//     the gRPC server takes the principal from a Bearer JWT (see package
+//     principal)
+//   - X-Emulator-Force-Deny is forwarded so REST tests can force denials
+//     (see authz.ForceDenyHeader)
+//   - GET responses for crypto keys and versions carry their usage in
+//     X-Emulator-Use-Count and X-Emulator-Last-Use-Time (see
+//     server.UseCountHeader)
+//
+// Requests are dispatched on a declarative route table (routes.go), which also
+// generates the OpenAPI document. A path served only for other methods is
+// answered 405 with an Allow header.
 //
 // # Supported Endpoints
 //
@@ -21,69 +43,220 @@
 // CryptoKeys:
 //   - POST   /v1/.../cryptoKeys?cryptoKeyId=...
 //   - GET    /v1/.../cryptoKeys/{key}
+//   - PATCH  /v1/.../cryptoKeys/{key}?updateMask=...
 //   - GET    /v1/.../cryptoKeys
 //   - POST   /v1/.../cryptoKeys/{key}:encrypt
 //   - POST   /v1/.../cryptoKeys/{key}:decrypt
 //   - POST   /v1/.../cryptoKeys/{key}:updatePrimaryVersion
 //
+// ImportJobs:
+//   - POST   /v1/.../importJobs?importJobId=...
+//   - GET    /v1/.../importJobs/{importJob}
+//   - GET    /v1/.../importJobs
+//
 // CryptoKeyVersions:
 //   - POST   /v1/.../cryptoKeyVersions
+//   - POST   /v1/.../cryptoKeyVersions:import
 //   - GET    /v1/.../cryptoKeyVersions/{version}
 //   - GET    /v1/.../cryptoKeyVersions
 //   - PATCH  /v1/.../cryptoKeyVersions/{version}
 //   - POST   /v1/.../cryptoKeyVersions/{version}:destroy
+//   - POST   /v1/.../cryptoKeyVersions/{version}:restore
+//   - GET    /v1/.../cryptoKeyVersions/{version}/publicKey
+//   - POST   /v1/.../cryptoKeyVersions/{version}:asymmetricSign
+//   - POST   /v1/.../cryptoKeyVersions/{version}:asymmetricDecrypt
+//   - POST   /v1/.../cryptoKeyVersions/{version}:macSign
+//   - POST   /v1/.../cryptoKeyVersions/{version}:macVerify
+//
+// IAM (on keyRings, cryptoKeys and importJobs):
+//   - GET    /v1/...:getIamPolicy?options.requestedPolicyVersion=...
+//   - POST   /v1/...:setIamPolicy
+//   - POST   /v1/...:testIamPermissions
+//
+// Locations:
+//   - GET    /v1/projects/{project}/locations
+//   - GET    /v1/projects/{project}/locations/{location}
+//   - POST   /v1/projects/{project}/locations/{location}:generateRandomBytes
+//
+// Emulator:
+//   - GET    /openapi.json (OpenAPI 3 document of the routes above)
+//   - GET    /$discovery/rest?version=v1 and
+//     /discovery/v1/apis/cloudkms/v1/rest (Google API Discovery document of
+//     the same routes)
+//   - GET    /capabilities (see package capabilities)
+//   - GET    /health
 //
 // # Usage
 //
-//	gateway := gateway.NewServer("localhost:9090")
-//	gateway.Start(":8080")
+//	gateway, err := gateway.NewServer("localhost:9090")
+//	gateway.Start(ctx, ":8080")
+//
+// To skip the network hop when the gRPC server runs in the same process,
+// serve it on a bufconn listener and dial that instead:
+//
+//	gateway, err := gateway.NewServer("passthrough:///bufconn",
+//	    grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+//	        return lis.DialContext(ctx)
+//	    }))
+//
+// Serve HTTPS instead with StartTLS(ctx, ":8443", "cert.pem", "key.pem").
+// Both serve HTTP/1.1 and HTTP/2; without TLS, HTTP/2 clients must use prior
+// knowledge (h2c).
 package gateway
 
 import (
+	"bytes"
 	"context"
-	"encoding/base64"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 
+	"cloud.google.com/go/iam/apiv1/iampb"
 	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	locationpb "google.golang.org/genproto/googleapis/cloud/location"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	emulatorauth "github.com/blackwell-systems/gcp-emulator-auth"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/authz"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/capabilities"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/principal"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/routing"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/server"
 )
 
+// DefaultMaxBodyBytes is the default request body limit, matching the gRPC
+// message limit of Cloud KMS
+const DefaultMaxBodyBytes = 1 << 20
+
 // Server represents the REST gateway server
 type Server struct {
-	grpcClient kmspb.KeyManagementServiceClient
+	grpcClient      kmspb.KeyManagementServiceClient
+	locationsClient locationpb.LocationsClient
+	iamClient       iampb.IAMPolicyClient
+	conn            *grpc.ClientConn
+	maxBodyBytes    int64
+	protoNames      bool
+
+	openAPIOnce sync.Once
+	openAPI     []byte
+	openAPIErr  error
+
+	discoveryOnce sync.Once
+	discovery     map[string]any
+	discoveryErr  error
+
+	mu         sync.Mutex
 	httpServer *http.Server
-	conn       *grpc.ClientConn
+	stopped    bool
 }
 
-// NewServer creates a new REST gateway server that proxies to a gRPC server
-func NewServer(grpcAddr string) *Server {
-	conn, err := grpc.NewClient(
-		grpcAddr,
+// NewServer creates a new REST gateway server that proxies to a gRPC server.
+// The connection is plaintext unless dialOpts supply transport credentials.
+func NewServer(grpcAddr string, dialOpts ...grpc.DialOption) (*Server, error) {
+	opts := append([]grpc.DialOption{
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
-	)
+	}, dialOpts...)
+
+	conn, err := grpc.NewClient(grpcAddr, opts...)
 	if err != nil {
-		panic(fmt.Sprintf("failed to dial gRPC server: %v", err))
+		return nil, fmt.Errorf("failed to create gRPC client for %s: %w", grpcAddr, err)
 	}
 
 	return &Server{
-		grpcClient: kmspb.NewKeyManagementServiceClient(conn),
-		conn:       conn,
-	}
+		grpcClient:      kmspb.NewKeyManagementServiceClient(conn),
+		locationsClient: locationpb.NewLocationsClient(conn),
+		iamClient:       iampb.NewIAMPolicyClient(conn),
+		conn:            conn,
+		maxBodyBytes:    DefaultMaxBodyBytes,
+	}, nil
+}
+
+// SetMaxBodyBytes changes the request body limit. Zero removes the limit.
+// It must be called before Start.
+func (s *Server) SetMaxBodyBytes(n int64) {
+	s.maxBodyBytes = n
+}
+
+// SetProtoNames makes responses use the snake_case proto field names
+// (create_time) instead of the camelCase JSON names (createTime) of the real
+// API, for clients written against older emulator versions. It must be
+// called before Start.
+func (s *Server) SetProtoNames(on bool) {
+	s.protoNames = on
 }
 
 // Start starts the REST gateway server on the specified address
 func (s *Server) Start(ctx context.Context, addr string) error {
+	srv, err := s.prepare(addr)
+	if err != nil {
+		return err
+	}
+	return srv.ListenAndServe()
+}
+
+// StartTLS starts the REST gateway server on the specified address, serving
+// HTTPS with the given certificate and key files
+func (s *Server) StartTLS(ctx context.Context, addr, certFile, keyFile string) error {
+	srv, err := s.prepare(addr)
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	return srv.ListenAndServeTLS(certFile, keyFile)
+}
+
+// Serve serves the REST gateway on an existing listener, for callers that
+// pick the port themselves
+func (s *Server) Serve(lis net.Listener) error {
+	srv, err := s.prepare(lis.Addr().String())
+	if err != nil {
+		return err
+	}
+	return srv.Serve(lis)
+}
+
+// prepare creates the HTTP server, or returns http.ErrServerClosed if Stop
+// was called first so a late Start cannot outlive shutdown
+func (s *Server) prepare(addr string) (*http.Server, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return nil, http.ErrServerClosed
+	}
+	s.httpServer = s.newHTTPServer(addr)
+	return s.httpServer, nil
+}
+
+func (s *Server) newHTTPServer(addr string) *http.Server {
 	mux := http.NewServeMux()
 
 	// Register routes matching GCP's REST API
-	mux.HandleFunc("/v1/", s.handleRequest)
+	mux.Handle("/v1/", withSystemParameters(withETags(withPartialResponse(http.HandlerFunc(s.handleRequest)))))
+
+	// OpenAPI and discovery documents generated from the route table
+	mux.HandleFunc(OpenAPIPath, s.handleOpenAPI)
+	mux.HandleFunc(DiscoveryPath, s.handleDiscovery)
+	mux.HandleFunc(LegacyDiscoveryPath, s.handleDiscovery)
+
+	// Capability report, answered by the gRPC server
+	mux.HandleFunc("/capabilities", s.handleCapabilities)
 
 	// Health check
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -91,180 +264,222 @@ func (s *Server) Start(ctx context.Context, addr string) error {
 		fmt.Fprintf(w, `{"status":"healthy"}`)
 	})
 
-	s.httpServer = &http.Server{
-		Addr:    addr,
-		Handler: mux,
+	// HTTP/2 is negotiated over TLS and also accepted in cleartext (h2c,
+	// prior knowledge) for HTTP/2-only clients and service meshes
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	return &http.Server{
+		Addr:      addr,
+		Handler:   withCompression(mux),
+		Protocols: protocols,
 	}
-
-	return s.httpServer.ListenAndServe()
 }
 
-// Stop gracefully stops the REST gateway server
+// Stop gracefully stops the REST gateway server. New requests are refused
+// and in-flight requests are given until ctx expires to finish before the
+// gRPC connection is closed.
 func (s *Server) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	s.stopped = true
+	srv := s.httpServer
+	s.mu.Unlock()
+
+	var err error
+	if srv != nil {
+		// In-flight requests still need the gRPC connection
+		err = srv.Shutdown(ctx)
+	}
 	if s.conn != nil {
 		s.conn.Close()
 	}
-	if s.httpServer != nil {
-		return s.httpServer.Shutdown(ctx)
-	}
-	return nil
+	return err
 }
 
-// handleRequest routes REST requests to appropriate gRPC calls
-func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-
-	// Parse path: /v1/projects/{project}/locations/{location}/keyRings/{keyring}/cryptoKeys/{key}
-	path := strings.TrimPrefix(r.URL.Path, "/v1/")
-	parts := strings.Split(path, "/")
-
-	// Set JSON content type
-	w.Header().Set("Content-Type", "application/json")
-
-	// Route based on path structure
-	if len(parts) >= 4 && parts[0] == "projects" && parts[2] == "locations" {
-		parent := fmt.Sprintf("projects/%s/locations/%s", parts[1], parts[3])
-
-		// KeyRings operations
-		if len(parts) == 5 && parts[4] == "keyRings" {
-			switch r.Method {
-			case http.MethodGet:
-				s.listKeyRings(ctx, w, r, parent)
-			case http.MethodPost:
-				s.createKeyRing(ctx, w, r, parent)
-			default:
-				http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
-			}
-			return
-		}
+// forwardedHeaders are copied from REST requests into the metadata of the
+// gRPC call, so the server sees the client headers a gRPC client would send
+var forwardedHeaders = []string{
+	routing.RequestParamsHeader,
+	routing.APIClientHeader,
+	principal.AuthorizationHeader,
+	principal.ImpersonateHeader,
+	authz.ForceDenyHeader,
+	emulatorauth.PrincipalMetadataKey,
+}
 
-		// CryptoKeys operations under a keyring
-		if len(parts) == 7 && parts[4] == "keyRings" && parts[6] == "cryptoKeys" {
-			keyRingName := fmt.Sprintf("%s/keyRings/%s", parent, parts[5])
-			switch r.Method {
-			case http.MethodGet:
-				s.listCryptoKeys(ctx, w, r, keyRingName)
-			case http.MethodPost:
-				s.createCryptoKey(ctx, w, r, keyRingName)
-			default:
-				http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
-			}
-			return
+// outgoingContext returns the context for the gRPC call serving r
+func outgoingContext(r *http.Request) context.Context {
+	var pairs []string
+	for _, header := range forwardedHeaders {
+		for _, value := range r.Header.Values(header) {
+			pairs = append(pairs, header, value)
 		}
+	}
+	// If-Match is checked by storage, atomically with the update
+	if etag, ok := ifMatchETag(r.Header.Get("If-Match")); ok && etag != "" {
+		pairs = append(pairs, server.IfMatchHeader, etag)
+	}
+	if len(pairs) == 0 {
+		return r.Context()
+	}
+	return metadata.AppendToOutgoingContext(r.Context(), pairs...)
+}
 
-		// Individual KeyRing operations
-		if len(parts) == 6 && parts[4] == "keyRings" {
-			keyRingName := fmt.Sprintf("%s/keyRings/%s", parent, parts[5])
+// usageHeaders are copied from the response metadata of GetCryptoKey and
+// GetCryptoKeyVersion into the REST response
+var usageHeaders = []string{server.UseCountHeader, server.LastUseTimeHeader}
 
-			// GetKeyRing
-			switch r.Method {
-			case http.MethodGet:
-				s.getKeyRing(ctx, w, r, keyRingName)
-			default:
-				http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
-			}
-			return
+// writeUsageHeaders sets the usage headers found in md on w
+func writeUsageHeaders(w http.ResponseWriter, md metadata.MD) {
+	for _, header := range usageHeaders {
+		if values := md.Get(header); len(values) > 0 {
+			w.Header().Set(header, values[0])
 		}
+	}
+}
 
-		// CryptoKey operations
-		if len(parts) == 8 && parts[4] == "keyRings" && parts[6] == "cryptoKeys" {
-			cryptoKeyName := fmt.Sprintf("%s/keyRings/%s/cryptoKeys/%s", parent, parts[5], parts[7])
-
-			// Check for :encrypt or :decrypt suffix
-			if strings.HasSuffix(parts[7], ":encrypt") {
-				cryptoKeyName = strings.TrimSuffix(cryptoKeyName, ":encrypt")
-				s.encrypt(ctx, w, r, cryptoKeyName)
-				return
-			}
-			if strings.HasSuffix(parts[7], ":decrypt") {
-				cryptoKeyName = strings.TrimSuffix(cryptoKeyName, ":decrypt")
-				s.decrypt(ctx, w, r, cryptoKeyName)
-				return
-			}
-			if strings.HasSuffix(parts[7], ":updatePrimaryVersion") {
-				cryptoKeyName = strings.TrimSuffix(cryptoKeyName, ":updatePrimaryVersion")
-				s.updateCryptoKeyPrimaryVersion(ctx, w, r, cryptoKeyName)
-				return
-			}
+// handleCapabilities serves the emulator capability report
+func (s *Server) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
 
-			// GetCryptoKey
-			switch r.Method {
-			case http.MethodGet:
-				s.getCryptoKey(ctx, w, r, cryptoKeyName)
-			default:
-				http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
-			}
-			return
-		}
+	var report structpb.Struct
+	if err := s.conn.Invoke(r.Context(), capabilities.FullMethod, &emptypb.Empty{}, &report); err != nil {
+		writeGRPCError(w, err)
+		return
+	}
 
-		// CryptoKeyVersions list operations
-		if len(parts) == 9 && parts[4] == "keyRings" && parts[6] == "cryptoKeys" && parts[8] == "cryptoKeyVersions" {
-			cryptoKeyName := fmt.Sprintf("%s/keyRings/%s/cryptoKeys/%s", parent, parts[5], parts[7])
-			switch r.Method {
-			case http.MethodGet:
-				s.listCryptoKeyVersions(ctx, w, r, cryptoKeyName)
-			case http.MethodPost:
-				s.createCryptoKeyVersion(ctx, w, r, cryptoKeyName)
-			default:
-				http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
-			}
-			return
-		}
+	s.writeProtoJSON(w, &report)
+}
 
-		// Individual CryptoKeyVersion operations
-		if len(parts) == 10 && parts[4] == "keyRings" && parts[6] == "cryptoKeys" && parts[8] == "cryptoKeyVersions" {
-			versionName := fmt.Sprintf("%s/keyRings/%s/cryptoKeys/%s/cryptoKeyVersions/%s", parent, parts[5], parts[7], parts[9])
+// listParams holds the standard query parameters of REST list routes
+type listParams struct {
+	pageSize  int32
+	pageToken string
+	filter    string
+	orderBy   string
+}
 
-			if strings.HasSuffix(parts[9], ":destroy") {
-				versionName = strings.TrimSuffix(versionName, ":destroy")
-				s.destroyCryptoKeyVersion(ctx, w, r, versionName)
-				return
-			}
+// parseListParams reads pageSize, pageToken, filter and orderBy, writing an error and returning false if pageSize is not a number
+func parseListParams(w http.ResponseWriter, r *http.Request) (listParams, bool) {
+	query := r.URL.Query()
+	params := listParams{
+		pageToken: query.Get("pageToken"),
+		filter:    query.Get("filter"),
+		orderBy:   query.Get("orderBy"),
+	}
+	if v := query.Get("pageSize"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			writeError(w, codes.InvalidArgument, "Invalid value for pageSize: %q", v)
+			return params, false
+		}
+		params.pageSize = int32(n)
+	}
+	return params, true
+}
 
-			switch r.Method {
-			case http.MethodGet:
-				s.getCryptoKeyVersion(ctx, w, r, versionName)
-			case http.MethodPatch:
-				s.updateCryptoKeyVersion(ctx, w, r, versionName)
-			default:
-				http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+// parseFieldMask converts a REST updateMask ("labels,rotationPeriod") to a
+// FieldMask with the proto field names gRPC expects ("labels",
+// "rotation_period")
+func parseFieldMask(value string) *fieldmaskpb.FieldMask {
+	if value == "" {
+		return nil
+	}
+	mask := &fieldmaskpb.FieldMask{}
+	for _, path := range strings.Split(value, ",") {
+		var b strings.Builder
+		for _, c := range strings.TrimSpace(path) {
+			if c >= 'A' && c <= 'Z' {
+				b.WriteByte('_')
+				c += 'a' - 'A'
 			}
-			return
+			b.WriteRune(c)
 		}
+		mask.Paths = append(mask.Paths, b.String())
 	}
-
-	http.Error(w, `{"error":"Not found"}`, http.StatusNotFound)
+	return mask
 }
 
-// Helper to write protobuf response as JSON
-func writeProtoJSON(w http.ResponseWriter, msg interface{}) {
+// writeProtoJSON writes a protobuf response as JSON, with camelCase field
+// names like cloudkms.googleapis.com unless SetProtoNames is on
+func (s *Server) writeProtoJSON(w http.ResponseWriter, msg interface{}) {
 	marshaler := protojson.MarshalOptions{
 		EmitUnpopulated: true,
-		UseProtoNames:   true,
+		UseProtoNames:   s.protoNames,
 	}
 
 	protoMsg, ok := msg.(interface{ ProtoReflect() protoreflect.Message })
 	if !ok {
-		http.Error(w, `{"error":"Failed to marshal response: not a proto message"}`, http.StatusInternalServerError)
+		writeError(w, codes.Internal, "Failed to marshal response: not a proto message")
 		return
 	}
 
-	data, err := marshaler.Marshal(protoMsg)
+	buf := getBuffer()
+	defer putBuffer(buf)
+	data, err := marshaler.MarshalAppend(buf.AvailableBuffer(), protoMsg)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"Failed to marshal response: %v"}`, err), http.StatusInternalServerError)
+		writeError(w, codes.Internal, "Failed to marshal response: %v", err)
 		return
 	}
+	buf.Write(data)
+
+	// The status line is already sent, so a failed write cannot be reported
+	_, _ = w.Write(buf.Bytes())
+}
+
+// readJSON reads the request body, enforcing the body limit, and decodes it
+// into v: with protojson for protobuf messages, encoding/json otherwise. On
+// failure it writes the error response and returns false.
+func (s *Server) readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	defer r.Body.Close()
+
+	reader := io.Reader(r.Body)
+	if s.maxBodyBytes > 0 {
+		reader = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+	}
 
-	if _, err := w.Write(data); err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"Failed to write response: %v"}`, err), http.StatusInternalServerError)
+	// Reading into a pooled buffer sized from Content-Length avoids the
+	// copies io.ReadAll makes growing its slice. Both unmarshalers copy what
+	// they keep, so the buffer is free again once v is decoded.
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if n := r.ContentLength; n > 0 && n <= maxPooledBuffer && (s.maxBodyBytes <= 0 || n <= s.maxBodyBytes) {
+		buf.Grow(int(n) + bytes.MinRead)
 	}
+	if _, err := buf.ReadFrom(reader); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeHTTPError(w, http.StatusRequestEntityTooLarge, codes.InvalidArgument, "Request body exceeds the %d byte limit", tooLarge.Limit)
+			return false
+		}
+		writeError(w, codes.InvalidArgument, "Failed to read request body: %v", err)
+		return false
+	}
+
+	var err error
+	if msg, ok := v.(proto.Message); ok {
+		err = protojson.Unmarshal(buf.Bytes(), msg)
+	} else {
+		err = json.Unmarshal(buf.Bytes(), v)
+	}
+	if err != nil {
+		writeError(w, codes.InvalidArgument, "Invalid JSON payload: %v", err)
+		return false
+	}
+	return true
 }
 
 // KeyRing operations
 func (s *Server) createKeyRing(ctx context.Context, w http.ResponseWriter, r *http.Request, parent string) {
 	keyRingID := r.URL.Query().Get("keyRingId")
 	if keyRingID == "" {
-		http.Error(w, `{"error":"keyRingId query parameter required"}`, http.StatusBadRequest)
+		writeError(w, codes.InvalidArgument, "keyRingId query parameter required")
 		return
 	}
 
@@ -275,12 +490,12 @@ func (s *Server) createKeyRing(ctx context.Context, w http.ResponseWriter, r *ht
 
 	resp, err := s.grpcClient.CreateKeyRing(ctx, req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusInternalServerError)
+		writeGRPCError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
-	writeProtoJSON(w, resp)
+	s.writeProtoJSON(w, resp)
 }
 
 func (s *Server) getKeyRing(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
@@ -288,43 +503,173 @@ func (s *Server) getKeyRing(ctx context.Context, w http.ResponseWriter, r *http.
 
 	resp, err := s.grpcClient.GetKeyRing(ctx, req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusNotFound)
+		writeGRPCError(w, err)
 		return
 	}
 
-	writeProtoJSON(w, resp)
+	s.writeProtoJSON(w, resp)
 }
 
 func (s *Server) listKeyRings(ctx context.Context, w http.ResponseWriter, r *http.Request, parent string) {
+	params, ok := parseListParams(w, r)
+	if !ok {
+		return
+	}
 	req := &kmspb.ListKeyRingsRequest{
 		Parent:    parent,
-		PageSize:  100,
-		PageToken: r.URL.Query().Get("pageToken"),
+		PageSize:  params.pageSize,
+		PageToken: params.pageToken,
+		Filter:    params.filter,
+		OrderBy:   params.orderBy,
 	}
 
 	resp, err := s.grpcClient.ListKeyRings(ctx, req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusInternalServerError)
+		writeGRPCError(w, err)
 		return
 	}
 
-	writeProtoJSON(w, resp)
+	s.writeProtoJSON(w, resp)
+}
+
+// Location operations
+func (s *Server) listLocations(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
+	params, ok := parseListParams(w, r)
+	if !ok {
+		return
+	}
+	req := &locationpb.ListLocationsRequest{
+		Name:      name,
+		PageSize:  params.pageSize,
+		PageToken: params.pageToken,
+		Filter:    params.filter,
+	}
+
+	resp, err := s.locationsClient.ListLocations(ctx, req)
+	if err != nil {
+		writeGRPCError(w, err)
+		return
+	}
+
+	s.writeProtoJSON(w, resp)
+}
+
+func (s *Server) getLocation(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
+	resp, err := s.locationsClient.GetLocation(ctx, &locationpb.GetLocationRequest{Name: name})
+	if err != nil {
+		writeGRPCError(w, err)
+		return
+	}
+
+	s.writeProtoJSON(w, resp)
+}
+
+func (s *Server) generateRandomBytes(ctx context.Context, w http.ResponseWriter, r *http.Request, location string) {
+	var req kmspb.GenerateRandomBytesRequest
+	if !s.readJSON(w, r, &req) {
+		return
+	}
+	req.Location = location
+
+	resp, err := s.grpcClient.GenerateRandomBytes(ctx, &req)
+	if err != nil {
+		writeGRPCError(w, err)
+		return
+	}
+
+	s.writeProtoJSON(w, resp)
 }
 
 // CryptoKey operations
-func (s *Server) createCryptoKey(ctx context.Context, w http.ResponseWriter, r *http.Request, parent string) {
-	body, _ := io.ReadAll(r.Body)
-	defer r.Body.Close()
+func (s *Server) createImportJob(ctx context.Context, w http.ResponseWriter, r *http.Request, parent string) {
+	var importJob kmspb.ImportJob
+	if !s.readJSON(w, r, &importJob) {
+		return
+	}
+
+	importJobID := r.URL.Query().Get("importJobId")
+	if importJobID == "" {
+		writeError(w, codes.InvalidArgument, "importJobId query parameter required")
+		return
+	}
+
+	req := &kmspb.CreateImportJobRequest{
+		Parent:      parent,
+		ImportJobId: importJobID,
+		ImportJob:   &importJob,
+	}
+
+	resp, err := s.grpcClient.CreateImportJob(ctx, req)
+	if err != nil {
+		writeGRPCError(w, err)
+		return
+	}
 
+	w.WriteHeader(http.StatusCreated)
+	s.writeProtoJSON(w, resp)
+}
+
+func (s *Server) getImportJob(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
+	req := &kmspb.GetImportJobRequest{Name: name}
+
+	resp, err := s.grpcClient.GetImportJob(ctx, req)
+	if err != nil {
+		writeGRPCError(w, err)
+		return
+	}
+
+	s.writeProtoJSON(w, resp)
+}
+
+func (s *Server) listImportJobs(ctx context.Context, w http.ResponseWriter, r *http.Request, parent string) {
+	params, ok := parseListParams(w, r)
+	if !ok {
+		return
+	}
+	req := &kmspb.ListImportJobsRequest{
+		Parent:    parent,
+		PageSize:  params.pageSize,
+		PageToken: params.pageToken,
+		Filter:    params.filter,
+		OrderBy:   params.orderBy,
+	}
+
+	resp, err := s.grpcClient.ListImportJobs(ctx, req)
+	if err != nil {
+		writeGRPCError(w, err)
+		return
+	}
+
+	s.writeProtoJSON(w, resp)
+}
+
+// importCryptoKeyVersion imports wrapped key material. wrappedKey, like every
+// bytes field, is base64 in standard or URL-safe encoding, padded or not.
+func (s *Server) importCryptoKeyVersion(ctx context.Context, w http.ResponseWriter, r *http.Request, parent string) {
+	var req kmspb.ImportCryptoKeyVersionRequest
+	if !s.readJSON(w, r, &req) {
+		return
+	}
+	req.Parent = parent
+
+	resp, err := s.grpcClient.ImportCryptoKeyVersion(ctx, &req)
+	if err != nil {
+		writeGRPCError(w, err)
+		return
+	}
+
+	s.writeProtoJSON(w, resp)
+}
+
+func (s *Server) createCryptoKey(ctx context.Context, w http.ResponseWriter, r *http.Request, parent string) {
 	var cryptoKey kmspb.CryptoKey
-	if err := protojson.Unmarshal(body, &cryptoKey); err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"Invalid JSON: %v"}`, err), http.StatusBadRequest)
+	if !s.readJSON(w, r, &cryptoKey) {
 		return
 	}
 
 	cryptoKeyID := r.URL.Query().Get("cryptoKeyId")
 	if cryptoKeyID == "" {
-		http.Error(w, `{"error":"cryptoKeyId query parameter required"}`, http.StatusBadRequest)
+		writeError(w, codes.InvalidArgument, "cryptoKeyId query parameter required")
 		return
 	}
 
@@ -336,40 +681,80 @@ func (s *Server) createCryptoKey(ctx context.Context, w http.ResponseWriter, r *
 
 	resp, err := s.grpcClient.CreateCryptoKey(ctx, req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusInternalServerError)
+		writeGRPCError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
-	writeProtoJSON(w, resp)
+	s.writeProtoJSON(w, resp)
 }
 
 func (s *Server) getCryptoKey(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
 	req := &kmspb.GetCryptoKeyRequest{Name: name}
 
-	resp, err := s.grpcClient.GetCryptoKey(ctx, req)
+	var md metadata.MD
+	resp, err := s.grpcClient.GetCryptoKey(ctx, req, grpc.Header(&md))
+	if err != nil {
+		writeGRPCError(w, err)
+		return
+	}
+
+	writeUsageHeaders(w, md)
+	writeETag(w, md)
+	s.writeProtoJSON(w, resp)
+}
+
+func (s *Server) updateCryptoKey(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
+	var cryptoKey kmspb.CryptoKey
+	if !s.readJSON(w, r, &cryptoKey) {
+		return
+	}
+	cryptoKey.Name = name
+
+	req := &kmspb.UpdateCryptoKeyRequest{
+		CryptoKey:  &cryptoKey,
+		UpdateMask: parseFieldMask(r.URL.Query().Get("updateMask")),
+	}
+
+	var md metadata.MD
+	resp, err := s.grpcClient.UpdateCryptoKey(ctx, req, grpc.Header(&md))
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusNotFound)
+		writeUpdateError(w, err)
 		return
 	}
 
-	writeProtoJSON(w, resp)
+	writeETag(w, md)
+	s.writeProtoJSON(w, resp)
 }
 
 func (s *Server) listCryptoKeys(ctx context.Context, w http.ResponseWriter, r *http.Request, parent string) {
+	params, ok := parseListParams(w, r)
+	if !ok {
+		return
+	}
 	req := &kmspb.ListCryptoKeysRequest{
 		Parent:    parent,
-		PageSize:  100,
-		PageToken: r.URL.Query().Get("pageToken"),
+		PageSize:  params.pageSize,
+		PageToken: params.pageToken,
+		Filter:    params.filter,
+		OrderBy:   params.orderBy,
+	}
+	if view := r.URL.Query().Get("versionView"); view != "" {
+		value, ok := kmspb.CryptoKeyVersion_CryptoKeyVersionView_value[view]
+		if !ok {
+			writeError(w, codes.InvalidArgument, "Invalid value for versionView: %q", view)
+			return
+		}
+		req.VersionView = kmspb.CryptoKeyVersion_CryptoKeyVersionView(value)
 	}
 
 	resp, err := s.grpcClient.ListCryptoKeys(ctx, req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusInternalServerError)
+		writeGRPCError(w, err)
 		return
 	}
 
-	writeProtoJSON(w, resp)
+	s.writeProtoJSON(w, resp)
 }
 
 func (s *Server) createCryptoKeyVersion(ctx context.Context, w http.ResponseWriter, r *http.Request, parent string) {
@@ -379,29 +764,24 @@ func (s *Server) createCryptoKeyVersion(ctx context.Context, w http.ResponseWrit
 
 	resp, err := s.grpcClient.CreateCryptoKeyVersion(ctx, req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusInternalServerError)
+		writeGRPCError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
-	writeProtoJSON(w, resp)
+	s.writeProtoJSON(w, resp)
 }
 
 func (s *Server) updateCryptoKeyPrimaryVersion(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
-	body, _ := io.ReadAll(r.Body)
-	defer r.Body.Close()
-
 	var reqBody struct {
 		CryptoKeyVersionID string `json:"cryptoKeyVersionId"`
 	}
-
-	if err := json.Unmarshal(body, &reqBody); err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"Invalid JSON: %v"}`, err), http.StatusBadRequest)
+	if !s.readJSON(w, r, &reqBody) {
 		return
 	}
 
 	if reqBody.CryptoKeyVersionID == "" {
-		http.Error(w, `{"error":"cryptoKeyVersionId is required"}`, http.StatusBadRequest)
+		writeError(w, codes.InvalidArgument, "cryptoKeyVersionId is required")
 		return
 	}
 
@@ -412,48 +792,61 @@ func (s *Server) updateCryptoKeyPrimaryVersion(ctx context.Context, w http.Respo
 
 	resp, err := s.grpcClient.UpdateCryptoKeyPrimaryVersion(ctx, req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusInternalServerError)
+		writeGRPCError(w, err)
 		return
 	}
 
-	writeProtoJSON(w, resp)
+	s.writeProtoJSON(w, resp)
 }
 
 func (s *Server) listCryptoKeyVersions(ctx context.Context, w http.ResponseWriter, r *http.Request, parent string) {
+	params, ok := parseListParams(w, r)
+	if !ok {
+		return
+	}
 	req := &kmspb.ListCryptoKeyVersionsRequest{
 		Parent:    parent,
-		PageSize:  100,
-		PageToken: r.URL.Query().Get("pageToken"),
+		PageSize:  params.pageSize,
+		PageToken: params.pageToken,
+		Filter:    params.filter,
+		OrderBy:   params.orderBy,
+	}
+	if view := r.URL.Query().Get("view"); view != "" {
+		value, ok := kmspb.CryptoKeyVersion_CryptoKeyVersionView_value[view]
+		if !ok {
+			writeError(w, codes.InvalidArgument, "Invalid value for view: %q", view)
+			return
+		}
+		req.View = kmspb.CryptoKeyVersion_CryptoKeyVersionView(value)
 	}
 
 	resp, err := s.grpcClient.ListCryptoKeyVersions(ctx, req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusInternalServerError)
+		writeGRPCError(w, err)
 		return
 	}
 
-	writeProtoJSON(w, resp)
+	s.writeProtoJSON(w, resp)
 }
 
 func (s *Server) getCryptoKeyVersion(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
 	req := &kmspb.GetCryptoKeyVersionRequest{Name: name}
 
-	resp, err := s.grpcClient.GetCryptoKeyVersion(ctx, req)
+	var md metadata.MD
+	resp, err := s.grpcClient.GetCryptoKeyVersion(ctx, req, grpc.Header(&md))
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusNotFound)
+		writeGRPCError(w, err)
 		return
 	}
 
-	writeProtoJSON(w, resp)
+	writeUsageHeaders(w, md)
+	writeETag(w, md)
+	s.writeProtoJSON(w, resp)
 }
 
 func (s *Server) updateCryptoKeyVersion(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
-	body, _ := io.ReadAll(r.Body)
-	defer r.Body.Close()
-
 	var version kmspb.CryptoKeyVersion
-	if err := protojson.Unmarshal(body, &version); err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"Invalid JSON: %v"}`, err), http.StatusBadRequest)
+	if !s.readJSON(w, r, &version) {
 		return
 	}
 
@@ -463,13 +856,15 @@ func (s *Server) updateCryptoKeyVersion(ctx context.Context, w http.ResponseWrit
 		CryptoKeyVersion: &version,
 	}
 
-	resp, err := s.grpcClient.UpdateCryptoKeyVersion(ctx, req)
+	var md metadata.MD
+	resp, err := s.grpcClient.UpdateCryptoKeyVersion(ctx, req, grpc.Header(&md))
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusInternalServerError)
+		writeUpdateError(w, err)
 		return
 	}
 
-	writeProtoJSON(w, resp)
+	writeETag(w, md)
+	s.writeProtoJSON(w, resp)
 }
 
 func (s *Server) destroyCryptoKeyVersion(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
@@ -477,78 +872,199 @@ func (s *Server) destroyCryptoKeyVersion(ctx context.Context, w http.ResponseWri
 
 	resp, err := s.grpcClient.DestroyCryptoKeyVersion(ctx, req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusInternalServerError)
+		writeGRPCError(w, err)
 		return
 	}
 
-	writeProtoJSON(w, resp)
+	s.writeProtoJSON(w, resp)
 }
 
-// Encryption operations
-func (s *Server) encrypt(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
-	body, _ := io.ReadAll(r.Body)
-	defer r.Body.Close()
+func (s *Server) restoreCryptoKeyVersion(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
+	req := &kmspb.RestoreCryptoKeyVersionRequest{Name: name}
 
-	var reqBody struct {
-		Plaintext string `json:"plaintext"`
+	resp, err := s.grpcClient.RestoreCryptoKeyVersion(ctx, req)
+	if err != nil {
+		writeGRPCError(w, err)
+		return
 	}
 
-	if err := json.Unmarshal(body, &reqBody); err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"Invalid JSON: %v"}`, err), http.StatusBadRequest)
+	s.writeProtoJSON(w, resp)
+}
+
+func (s *Server) getPublicKey(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
+	req := &kmspb.GetPublicKeyRequest{Name: name}
+	if format := r.URL.Query().Get("publicKeyFormat"); format != "" {
+		value, ok := kmspb.PublicKey_PublicKeyFormat_value[format]
+		if !ok {
+			writeError(w, codes.InvalidArgument, "Invalid value for publicKeyFormat: %q", format)
+			return
+		}
+		req.PublicKeyFormat = kmspb.PublicKey_PublicKeyFormat(value)
+	}
+
+	resp, err := s.grpcClient.GetPublicKey(ctx, req)
+	if err != nil {
+		writeGRPCError(w, err)
 		return
 	}
 
-	// Decode base64 plaintext
-	plaintext, err := base64.StdEncoding.DecodeString(reqBody.Plaintext)
+	s.writeProtoJSON(w, resp)
+}
+
+// asymmetricSign accepts the Cloud KMS request body: a base64 digest
+// ({"digest": {"sha256": "..."}}) or data, with optional digestCrc32c and
+// dataCrc32c checksums
+func (s *Server) asymmetricSign(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
+	var req kmspb.AsymmetricSignRequest
+	if !s.readJSON(w, r, &req) {
+		return
+	}
+	req.Name = name
+
+	resp, err := s.grpcClient.AsymmetricSign(ctx, &req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"Invalid base64 plaintext: %v"}`, err), http.StatusBadRequest)
+		writeGRPCError(w, err)
 		return
 	}
 
-	req := &kmspb.EncryptRequest{
-		Name:      name,
-		Plaintext: plaintext,
+	s.writeProtoJSON(w, resp)
+}
+
+func (s *Server) asymmetricDecrypt(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
+	var req kmspb.AsymmetricDecryptRequest
+	if !s.readJSON(w, r, &req) {
+		return
+	}
+	req.Name = name
+
+	resp, err := s.grpcClient.AsymmetricDecrypt(ctx, &req)
+	if err != nil {
+		writeGRPCError(w, err)
+		return
 	}
 
-	resp, err := s.grpcClient.Encrypt(ctx, req)
+	s.writeProtoJSON(w, resp)
+}
+
+func (s *Server) macSign(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
+	var req kmspb.MacSignRequest
+	if !s.readJSON(w, r, &req) {
+		return
+	}
+	req.Name = name
+
+	resp, err := s.grpcClient.MacSign(ctx, &req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusInternalServerError)
+		writeGRPCError(w, err)
 		return
 	}
 
-	writeProtoJSON(w, resp)
+	s.writeProtoJSON(w, resp)
+}
+
+func (s *Server) macVerify(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
+	var req kmspb.MacVerifyRequest
+	if !s.readJSON(w, r, &req) {
+		return
+	}
+	req.Name = name
+
+	resp, err := s.grpcClient.MacVerify(ctx, &req)
+	if err != nil {
+		writeGRPCError(w, err)
+		return
+	}
+
+	s.writeProtoJSON(w, resp)
+}
+
+// Encryption operations
+
+// encrypt and decrypt accept the Cloud KMS request bodies, including
+// additionalAuthenticatedData and the optional CRC32C checksums
+func (s *Server) encrypt(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
+	var req kmspb.EncryptRequest
+	if !s.readJSON(w, r, &req) {
+		return
+	}
+	req.Name = name
+
+	resp, err := s.grpcClient.Encrypt(ctx, &req)
+	if err != nil {
+		writeGRPCError(w, err)
+		return
+	}
+
+	s.writeProtoJSON(w, resp)
 }
 
 func (s *Server) decrypt(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
-	body, _ := io.ReadAll(r.Body)
-	defer r.Body.Close()
+	var req kmspb.DecryptRequest
+	if !s.readJSON(w, r, &req) {
+		return
+	}
+	req.Name = name
 
-	var reqBody struct {
-		Ciphertext string `json:"ciphertext"`
+	resp, err := s.grpcClient.Decrypt(ctx, &req)
+	if err != nil {
+		writeGRPCError(w, err)
+		return
 	}
 
-	if err := json.Unmarshal(body, &reqBody); err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"Invalid JSON: %v"}`, err), http.StatusBadRequest)
+	s.writeProtoJSON(w, resp)
+}
+
+// IAM operations
+
+// getIamPolicy returns the policy of a key ring, key or import job
+func (s *Server) getIamPolicy(ctx context.Context, w http.ResponseWriter, r *http.Request, resource string) {
+	req := &iampb.GetIamPolicyRequest{Resource: resource}
+	if v := r.URL.Query().Get("options.requestedPolicyVersion"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			writeError(w, codes.InvalidArgument, "Invalid value for options.requestedPolicyVersion: %q", v)
+			return
+		}
+		req.Options = &iampb.GetPolicyOptions{RequestedPolicyVersion: int32(n)}
+	}
+
+	resp, err := s.iamClient.GetIamPolicy(ctx, req)
+	if err != nil {
+		writeGRPCError(w, err)
 		return
 	}
 
-	// Decode base64 ciphertext
-	ciphertext, err := base64.StdEncoding.DecodeString(reqBody.Ciphertext)
+	s.writeProtoJSON(w, resp)
+}
+
+func (s *Server) setIamPolicy(ctx context.Context, w http.ResponseWriter, r *http.Request, resource string) {
+	var req iampb.SetIamPolicyRequest
+	if !s.readJSON(w, r, &req) {
+		return
+	}
+	req.Resource = resource
+
+	resp, err := s.iamClient.SetIamPolicy(ctx, &req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"Invalid base64 ciphertext: %v"}`, err), http.StatusBadRequest)
+		writeGRPCError(w, err)
 		return
 	}
 
-	req := &kmspb.DecryptRequest{
-		Name:       name,
-		Ciphertext: ciphertext,
+	s.writeProtoJSON(w, resp)
+}
+
+func (s *Server) testIamPermissions(ctx context.Context, w http.ResponseWriter, r *http.Request, resource string) {
+	var req iampb.TestIamPermissionsRequest
+	if !s.readJSON(w, r, &req) {
+		return
 	}
+	req.Resource = resource
 
-	resp, err := s.grpcClient.Decrypt(ctx, req)
+	resp, err := s.iamClient.TestIamPermissions(ctx, &req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"%v"}`, err), http.StatusInternalServerError)
+		writeGRPCError(w, err)
 		return
 	}
 
-	writeProtoJSON(w, resp)
+	s.writeProtoJSON(w, resp)
 }
@@ -0,0 +1,927 @@
+package gateway
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/iam/apiv1/iampb"
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	locationpb "google.golang.org/genproto/googleapis/cloud/location"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/capabilities"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/routing"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/server"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+func TestStartAfterStop(t *testing.T) {
+	s, err := NewServer("localhost:0")
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	// A Start that loses the race with Stop must not leave a server running
+	if err := s.Start(context.Background(), "127.0.0.1:0"); !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Expected ErrServerClosed, got %v", err)
+	}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	s, err := NewServer("passthrough:///unused")
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	defer s.Stop(context.Background())
+	s.SetMaxBodyBytes(16)
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"within limit", `{"plaintext":1}`, http.StatusBadRequest},
+		{"over limit", `{"plaintext":"` + strings.Repeat("A", 32) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/projects/p/locations/global/keyRings/r/cryptoKeys/k:encrypt", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			s.handleRequest(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("Expected %d, got %d: %s", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+// newTestGateway returns a gateway backed by a KMS server and capability
+// reporter over an in-memory connection
+func newTestGateway(t testing.TB) *Server {
+	t.Helper()
+	kms, err := server.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	lis := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer(grpc.ChainUnaryInterceptor(routing.UnaryServerInterceptor()))
+	kmspb.RegisterKeyManagementServiceServer(grpcServer, kms)
+	locationpb.RegisterLocationsServer(grpcServer, server.NewLocations())
+	capabilities.NewReporter("test", kms, capabilities.Features{}).Register(grpcServer)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	s, err := NewServer("passthrough:///bufconn", grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}))
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	t.Cleanup(func() { s.Stop(context.Background()) })
+	return s
+}
+
+// do sends a request through the gateway router
+func do(s *Server, method, path, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.handleRequest(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec
+}
+
+func TestCapabilities(t *testing.T) {
+	s := newTestGateway(t)
+
+	rec := httptest.NewRecorder()
+	s.handleCapabilities(rec, httptest.NewRequest(http.MethodGet, "/capabilities", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var report capabilities.Report
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Invalid report: %v", err)
+	}
+	if report.Version != "test" || len(report.Methods) == 0 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+}
+
+func TestRestoreCryptoKeyVersion(t *testing.T) {
+	s := newTestGateway(t)
+	const (
+		keyRings = "/v1/projects/p/locations/global/keyRings"
+		version  = keyRings + "/r/cryptoKeys/k/cryptoKeyVersions/1"
+	)
+
+	if rec := do(s, http.MethodPost, keyRings+"?keyRingId=r", ""); rec.Code != http.StatusCreated {
+		t.Fatalf("CreateKeyRing: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(s, http.MethodPost, keyRings+"/r/cryptoKeys?cryptoKeyId=k", `{"purpose":"ENCRYPT_DECRYPT"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("CreateCryptoKey: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// An enabled version is not scheduled for destruction
+	if rec := do(s, http.MethodPost, version+":restore", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Restore enabled version: expected 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := do(s, http.MethodPost, version+":destroy", ""); rec.Code != http.StatusOK {
+		t.Fatalf("Destroy: %d %s", rec.Code, rec.Body.String())
+	}
+	rec := do(s, http.MethodPost, version+":restore", "{}")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Restore: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var restored kmspb.CryptoKeyVersion
+	if err := protojson.Unmarshal(rec.Body.Bytes(), &restored); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if restored.State != kmspb.CryptoKeyVersion_DISABLED {
+		t.Errorf("Expected DISABLED, got %v", restored.State)
+	}
+
+	if rec := do(s, http.MethodPost, keyRings+"/r/cryptoKeys/k/cryptoKeyVersions/9:restore", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Restore missing version: expected 404, got %d", rec.Code)
+	}
+	if rec := do(s, http.MethodGet, version+":restore", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET restore: expected 405, got %d", rec.Code)
+	}
+}
+
+func TestGetPublicKey(t *testing.T) {
+	s := newTestGateway(t)
+	const keyRings = "/v1/projects/p/locations/global/keyRings"
+
+	if rec := do(s, http.MethodPost, keyRings+"?keyRingId=r", ""); rec.Code != http.StatusCreated {
+		t.Fatalf("CreateKeyRing: %d %s", rec.Code, rec.Body.String())
+	}
+	body := `{"purpose":"ASYMMETRIC_SIGN","versionTemplate":{"algorithm":"EC_SIGN_P256_SHA256"}}`
+	if rec := do(s, http.MethodPost, keyRings+"/r/cryptoKeys?cryptoKeyId=signer", body); rec.Code != http.StatusCreated {
+		t.Fatalf("CreateCryptoKey: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(s, http.MethodPost, keyRings+"/r/cryptoKeys?cryptoKeyId=symmetric", `{"purpose":"ENCRYPT_DECRYPT"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("CreateCryptoKey: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec := do(s, http.MethodGet, keyRings+"/r/cryptoKeys/signer/cryptoKeyVersions/1/publicKey", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GetPublicKey: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var publicKey kmspb.PublicKey
+	if err := protojson.Unmarshal(rec.Body.Bytes(), &publicKey); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if !strings.HasPrefix(publicKey.Pem, "-----BEGIN PUBLIC KEY-----") || publicKey.PemCrc32C == nil {
+		t.Errorf("Unexpected public key: %v", &publicKey)
+	}
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/r/cryptoKeys/symmetric/cryptoKeyVersions/1/publicKey", http.StatusBadRequest},
+		{"/r/cryptoKeys/signer/cryptoKeyVersions/9/publicKey", http.StatusNotFound},
+		{"/r/cryptoKeys/signer/cryptoKeyVersions/1/publicKey?publicKeyFormat=BOGUS", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := do(s, http.MethodGet, keyRings+tt.path, ""); rec.Code != tt.want {
+			t.Errorf("GET %s: expected %d, got %d: %s", tt.path, tt.want, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+// createAsymmetricKey creates keyRing r and an asymmetric key in it, returning
+// the path of its first version and its public key
+func createAsymmetricKey(t *testing.T, s *Server, keyID, purpose, algorithm string) (string, any) {
+	t.Helper()
+	const keyRings = "/v1/projects/p/locations/global/keyRings"
+
+	do(s, http.MethodPost, keyRings+"?keyRingId=r", "")
+	body := fmt.Sprintf(`{"purpose":%q,"versionTemplate":{"algorithm":%q}}`, purpose, algorithm)
+	if rec := do(s, http.MethodPost, keyRings+"/r/cryptoKeys?cryptoKeyId="+keyID, body); rec.Code != http.StatusCreated {
+		t.Fatalf("CreateCryptoKey: %d %s", rec.Code, rec.Body.String())
+	}
+
+	versionPath := keyRings + "/r/cryptoKeys/" + keyID + "/cryptoKeyVersions/1"
+	rec := do(s, http.MethodGet, versionPath+"/publicKey", "")
+	var publicKey kmspb.PublicKey
+	if err := protojson.Unmarshal(rec.Body.Bytes(), &publicKey); err != nil {
+		t.Fatalf("GetPublicKey: %d %s", rec.Code, rec.Body.String())
+	}
+	block, _ := pem.Decode([]byte(publicKey.Pem))
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("ParsePKIXPublicKey failed: %v", err)
+	}
+	return versionPath, pub
+}
+
+func TestAsymmetricSign(t *testing.T) {
+	s := newTestGateway(t)
+	versionPath, pub := createAsymmetricKey(t, s, "signer", "ASYMMETRIC_SIGN", "EC_SIGN_P256_SHA256")
+
+	sum := sha256.Sum256([]byte("message"))
+	digest := base64.StdEncoding.EncodeToString(sum[:])
+	checksum := crc32.Checksum(sum[:], crc32.MakeTable(crc32.Castagnoli))
+
+	body := fmt.Sprintf(`{"digest":{"sha256":%q},"digestCrc32c":"%d"}`, digest, checksum)
+	rec := do(s, http.MethodPost, versionPath+":asymmetricSign", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("AsymmetricSign: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp kmspb.AsymmetricSignResponse
+	if err := protojson.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), sum[:], resp.Signature) {
+		t.Error("Signature did not verify with the public key")
+	}
+	if !resp.VerifiedDigestCrc32C || resp.SignatureCrc32C == nil {
+		t.Errorf("Expected verified digest and a signature checksum, got %v", &resp)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		want   int
+	}{
+		{"checksum mismatch", http.MethodPost, fmt.Sprintf(`{"digest":{"sha256":%q},"digestCrc32c":"%d"}`, digest, checksum+1), http.StatusBadRequest},
+		{"wrong digest type", http.MethodPost, fmt.Sprintf(`{"digest":{"sha512":%q}}`, digest), http.StatusBadRequest},
+		{"missing digest", http.MethodPost, `{}`, http.StatusBadRequest},
+		{"wrong method", http.MethodGet, "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do(s, tt.method, versionPath+":asymmetricSign", tt.body); rec.Code != tt.want {
+				t.Errorf("Expected %d, got %d: %s", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAsymmetricDecrypt(t *testing.T) {
+	s := newTestGateway(t)
+	versionPath, pub := createAsymmetricKey(t, s, "decrypter", "ASYMMETRIC_DECRYPT", "RSA_DECRYPT_OAEP_2048_SHA256")
+
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub.(*rsa.PublicKey), []byte("secret"), nil)
+	if err != nil {
+		t.Fatalf("EncryptOAEP failed: %v", err)
+	}
+
+	body := fmt.Sprintf(`{"ciphertext":%q}`, base64.StdEncoding.EncodeToString(ciphertext))
+	rec := do(s, http.MethodPost, versionPath+":asymmetricDecrypt", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("AsymmetricDecrypt: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp kmspb.AsymmetricDecryptResponse
+	if err := protojson.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if string(resp.Plaintext) != "secret" {
+		t.Errorf("Expected plaintext %q, got %q", "secret", resp.Plaintext)
+	}
+
+	body = fmt.Sprintf(`{"ciphertext":%q}`, base64.StdEncoding.EncodeToString([]byte("garbage")))
+	if rec := do(s, http.MethodPost, versionPath+":asymmetricDecrypt", body); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid ciphertext, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	s := newTestGateway(t)
+	const keyRings = "/v1/projects/p/locations/global/keyRings"
+
+	do(s, http.MethodPost, keyRings+"?keyRingId=r", "")
+	if rec := do(s, http.MethodPost, keyRings+"/r/cryptoKeys?cryptoKeyId=k", `{"purpose":"ENCRYPT_DECRYPT"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("CreateCryptoKey: %d %s", rec.Code, rec.Body.String())
+	}
+	keyPath := keyRings + "/r/cryptoKeys/k"
+
+	// Checksums are passed through, and echoed as verified
+	body := fmt.Sprintf(`{"plaintext":%q,"plaintextCrc32c":"%d"}`, base64.StdEncoding.EncodeToString([]byte("secret")), crc32.Checksum([]byte("secret"), crc32.MakeTable(crc32.Castagnoli)))
+	rec := do(s, http.MethodPost, keyPath+":encrypt", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Encrypt: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var enc kmspb.EncryptResponse
+	if err := protojson.Unmarshal(rec.Body.Bytes(), &enc); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if enc.Name != strings.TrimPrefix(keyPath, "/v1/")+"/cryptoKeyVersions/1" || !enc.VerifiedPlaintextCrc32C {
+		t.Errorf("Unexpected EncryptResponse %v", &enc)
+	}
+
+	body = fmt.Sprintf(`{"plaintext":%q,"plaintextCrc32c":"1"}`, base64.StdEncoding.EncodeToString([]byte("secret")))
+	if rec := do(s, http.MethodPost, keyPath+":encrypt", body); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a wrong checksum, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	body = fmt.Sprintf(`{"ciphertext":%q}`, base64.StdEncoding.EncodeToString(enc.Ciphertext))
+	rec = do(s, http.MethodPost, keyPath+":decrypt", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Decrypt: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var dec kmspb.DecryptResponse
+	if err := protojson.Unmarshal(rec.Body.Bytes(), &dec); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if string(dec.Plaintext) != "secret" || !dec.UsedPrimary {
+		t.Errorf("Unexpected DecryptResponse %v", &dec)
+	}
+}
+
+func TestMacSignVerify(t *testing.T) {
+	s := newTestGateway(t)
+	const keyRings = "/v1/projects/p/locations/global/keyRings"
+
+	do(s, http.MethodPost, keyRings+"?keyRingId=r", "")
+	if rec := do(s, http.MethodPost, keyRings+"/r/cryptoKeys?cryptoKeyId=mac", `{"purpose":"MAC","versionTemplate":{"algorithm":"HMAC_SHA256"}}`); rec.Code != http.StatusCreated {
+		t.Fatalf("CreateCryptoKey: %d %s", rec.Code, rec.Body.String())
+	}
+	versionPath := keyRings + "/r/cryptoKeys/mac/cryptoKeyVersions/1"
+	data := base64.StdEncoding.EncodeToString([]byte("message"))
+
+	rec := do(s, http.MethodPost, versionPath+":macSign", fmt.Sprintf(`{"data":%q}`, data))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("MacSign: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var signed kmspb.MacSignResponse
+	if err := protojson.Unmarshal(rec.Body.Bytes(), &signed); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	mac := base64.StdEncoding.EncodeToString(signed.Mac)
+	checksums := fmt.Sprintf(`,"dataCrc32c":"%d","macCrc32c":"%d"`, crc32.Checksum([]byte("message"), crc32.MakeTable(crc32.Castagnoli)), crc32.Checksum(signed.Mac, crc32.MakeTable(crc32.Castagnoli)))
+
+	tests := []struct {
+		name     string
+		body     string
+		code     int
+		want     bool
+		verified bool
+	}{
+		{"matching tag", fmt.Sprintf(`{"data":%q,"mac":%q}`, data, mac), http.StatusOK, true, false},
+		{"mismatched tag", fmt.Sprintf(`{"data":%q,"mac":%q}`, base64.StdEncoding.EncodeToString([]byte("other")), mac), http.StatusOK, false, false},
+		{"truncated tag", fmt.Sprintf(`{"data":%q,"mac":%q}`, data, base64.StdEncoding.EncodeToString(signed.Mac[:16])), http.StatusOK, false, false},
+		{"checksums", fmt.Sprintf(`{"data":%q,"mac":%q%s}`, data, mac, checksums), http.StatusOK, true, true},
+		{"wrong mac checksum", fmt.Sprintf(`{"data":%q,"mac":%q,"macCrc32c":"1"}`, data, mac), http.StatusBadRequest, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(s, http.MethodPost, versionPath+":macVerify", tt.body)
+			if rec.Code != tt.code {
+				t.Fatalf("MacVerify: expected %d, got %d: %s", tt.code, rec.Code, rec.Body.String())
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			var verified kmspb.MacVerifyResponse
+			if err := protojson.Unmarshal(rec.Body.Bytes(), &verified); err != nil {
+				t.Fatalf("Invalid response: %v", err)
+			}
+			if verified.Success != tt.want {
+				t.Errorf("Expected success=%v, got %v", tt.want, verified.Success)
+			}
+			if verified.VerifiedSuccessIntegrity != verified.Success || verified.VerifiedDataCrc32C != tt.verified || verified.VerifiedMacCrc32C != tt.verified {
+				t.Errorf("Unexpected integrity fields: %v", &verified)
+			}
+		})
+	}
+}
+
+func TestUpdateCryptoKey(t *testing.T) {
+	s := newTestGateway(t)
+	const keyRings = "/v1/projects/p/locations/global/keyRings"
+
+	do(s, http.MethodPost, keyRings+"?keyRingId=r", "")
+	if rec := do(s, http.MethodPost, keyRings+"/r/cryptoKeys?cryptoKeyId=k", `{"purpose":"ENCRYPT_DECRYPT","labels":{"team":"a"}}`); rec.Code != http.StatusCreated {
+		t.Fatalf("CreateCryptoKey: %d %s", rec.Code, rec.Body.String())
+	}
+
+	body := `{"labels":{"team":"b"},"rotationPeriod":"7776000s","nextRotationTime":"2030-01-01T00:00:00Z"}`
+	rec := do(s, http.MethodPatch, keyRings+"/r/cryptoKeys/k?updateMask=rotationPeriod,nextRotationTime", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("UpdateCryptoKey: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var cryptoKey kmspb.CryptoKey
+	if err := protojson.Unmarshal(rec.Body.Bytes(), &cryptoKey); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if cryptoKey.Labels["team"] != "a" {
+		t.Errorf("Expected labels outside the mask unchanged, got %v", cryptoKey.Labels)
+	}
+	if cryptoKey.GetRotationPeriod().GetSeconds() != 7776000 || cryptoKey.GetNextRotationTime().GetSeconds() == 0 {
+		t.Errorf("Expected rotation schedule to be set, got %v", &cryptoKey)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{"labels", "/r/cryptoKeys/k?updateMask=labels", `{"labels":{"team":"b"}}`, http.StatusOK},
+		{"unsupported path", "/r/cryptoKeys/k?updateMask=purpose", `{"purpose":"MAC"}`, http.StatusBadRequest},
+		{"short rotation", "/r/cryptoKeys/k?updateMask=rotationPeriod", `{"rotationPeriod":"60s"}`, http.StatusBadRequest},
+		{"missing key", "/r/cryptoKeys/missing?updateMask=labels", `{"labels":{}}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do(s, http.MethodPatch, keyRings+tt.path, tt.body); rec.Code != tt.want {
+				t.Errorf("Expected %d, got %d: %s", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestParseFieldMask(t *testing.T) {
+	mask := parseFieldMask("labels, rotationPeriod,versionTemplate.protectionLevel")
+	want := []string{"labels", "rotation_period", "version_template.protection_level"}
+	if strings.Join(mask.GetPaths(), ",") != strings.Join(want, ",") {
+		t.Errorf("Expected %v, got %v", want, mask.GetPaths())
+	}
+	if parseFieldMask("") != nil {
+		t.Error("Expected nil mask for an empty updateMask")
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	s := newTestGateway(t)
+	const keyRings = "/v1/projects/p/locations/global/keyRings"
+
+	do(s, http.MethodPost, keyRings+"?keyRingId=r", "")
+	for _, id := range []string{"k1", "k2", "k3"} {
+		body := `{"purpose":"ENCRYPT_DECRYPT","labels":{"id":"` + id + `"}}`
+		if rec := do(s, http.MethodPost, keyRings+"/r/cryptoKeys?cryptoKeyId="+id, body); rec.Code != http.StatusCreated {
+			t.Fatalf("CreateCryptoKey: %d %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	var names []string
+	token := ""
+	for pages := 0; pages < 5; pages++ {
+		rec := do(s, http.MethodGet, keyRings+"/r/cryptoKeys?pageSize=2&pageToken="+token, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("ListCryptoKeys: %d %s", rec.Code, rec.Body.String())
+		}
+		var resp kmspb.ListCryptoKeysResponse
+		if err := protojson.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Invalid response: %v", err)
+		}
+		for _, key := range resp.CryptoKeys {
+			names = append(names, key.Name[strings.LastIndex(key.Name, "/")+1:])
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		token = resp.NextPageToken
+	}
+	if strings.Join(names, ",") != "k1,k2,k3" {
+		t.Errorf("Expected k1,k2,k3 across pages, got %v", names)
+	}
+
+	rec := do(s, http.MethodGet, keyRings+"/r/cryptoKeys?filter=labels.id%3Dk2&orderBy=name+desc", "")
+	var resp kmspb.ListCryptoKeysResponse
+	if err := protojson.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if len(resp.CryptoKeys) != 1 || resp.TotalSize != 1 {
+		t.Errorf("Expected one key matching the filter, got %v", &resp)
+	}
+
+	for _, query := range []string{"pageSize=abc", "filter=bogus%3D1", "versionView=BOGUS"} {
+		if rec := do(s, http.MethodGet, keyRings+"/r/cryptoKeys?"+query, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d: %s", query, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestLocations(t *testing.T) {
+	s := newTestGateway(t)
+
+	rec := do(s, http.MethodGet, "/v1/projects/p/locations", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ListLocations: %d %s", rec.Code, rec.Body.String())
+	}
+	var list locationpb.ListLocationsResponse
+	if err := protojson.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if len(list.Locations) != len(server.KMSLocations) {
+		t.Errorf("Expected %d locations, got %d", len(server.KMSLocations), len(list.Locations))
+	}
+
+	rec = do(s, http.MethodGet, "/v1/projects/p/locations/us-central1", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GetLocation: %d %s", rec.Code, rec.Body.String())
+	}
+	var location locationpb.Location
+	if err := protojson.Unmarshal(rec.Body.Bytes(), &location); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if location.Name != "projects/p/locations/us-central1" || location.LocationId != "us-central1" {
+		t.Errorf("Unexpected location: %v", &location)
+	}
+	var metadata kmspb.LocationMetadata
+	if err := location.Metadata.UnmarshalTo(&metadata); err != nil {
+		t.Errorf("Expected LocationMetadata, got %v", err)
+	}
+
+	if rec := do(s, http.MethodGet, "/v1/projects/p/locations/mars", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown location, got %d", rec.Code)
+	}
+	if rec := do(s, http.MethodPost, "/v1/projects/p/locations", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", rec.Code)
+	}
+}
+
+func TestRoutesAreServed(t *testing.T) {
+	s := newTestGateway(t)
+
+	for _, rt := range routes {
+		path := "/v1/" + pathParam.ReplaceAllString(rt.path, "x")
+		rec := do(s, rt.method, path, "{}")
+		if rec.Code == http.StatusMethodNotAllowed || strings.Contains(rec.Body.String(), "No route for") {
+			t.Errorf("%s %s is in the route table but not served: %d %s", rt.method, rt.path, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	s := newTestGateway(t)
+
+	rec := httptest.NewRecorder()
+	s.handleOpenAPI(rec, httptest.NewRequest(http.MethodGet, OpenAPIPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var doc struct {
+		OpenAPI    string                               `json:"openapi"`
+		Paths      map[string]map[string]map[string]any `json:"paths"`
+		Components struct {
+			Schemas map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("Invalid document: %v", err)
+	}
+	if doc.OpenAPI != "3.0.3" {
+		t.Errorf("Expected openapi 3.0.3, got %q", doc.OpenAPI)
+	}
+	encrypt := doc.Paths["/v1/projects/{project}/locations/{location}/keyRings/{keyRing}/cryptoKeys/{cryptoKey}:encrypt"]["post"]
+	if encrypt["operationId"] != "KeyManagementService_Encrypt" {
+		t.Errorf("Expected the encrypt route, got %v", encrypt)
+	}
+	encryptVersion := doc.Paths["/v1/projects/{project}/locations/{location}/keyRings/{keyRing}/cryptoKeys/{cryptoKey}/cryptoKeyVersions/{cryptoKeyVersion}:encrypt"]["post"]
+	if encryptVersion["operationId"] != "KeyManagementService_Encrypt_2" {
+		t.Errorf("Expected a distinct operationId for encrypting with a version, got %v", encryptVersion)
+	}
+	if _, ok := doc.Components.Schemas["google.cloud.kms.v1.CryptoKey"]; !ok {
+		t.Error("Expected a CryptoKey schema")
+	}
+
+	// Every $ref must resolve to a schema in the document
+	for _, ref := range regexp.MustCompile(`"#/components/schemas/([^"]+)"`).FindAllStringSubmatch(rec.Body.String(), -1) {
+		if _, ok := doc.Components.Schemas[ref[1]]; !ok {
+			t.Errorf("Unresolved reference %s", ref[0])
+		}
+	}
+}
+
+func TestH2C(t *testing.T) {
+	s := newTestGateway(t)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	srv := s.newHTTPServer(lis.Addr().String())
+	go srv.Serve(lis)
+	t.Cleanup(func() { srv.Close() })
+
+	// Prior-knowledge HTTP/2 over cleartext, as HTTP/2-only clients send
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+	resp, err := client.Get("http://" + lis.Addr().String() + "/v1/projects/p/locations/global")
+	if err != nil {
+		t.Fatalf("h2c request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2, got %s", resp.Proto)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200, got %d", resp.StatusCode)
+	}
+
+	// HTTP/1.1 clients keep working on the same port
+	resp, err = http.Get("http://" + lis.Addr().String() + "/health")
+	if err != nil {
+		t.Fatalf("HTTP/1.1 request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 1 {
+		t.Errorf("Expected HTTP/1.1, got %s", resp.Proto)
+	}
+}
+
+func TestRoutingHeadersForwarded(t *testing.T) {
+	s := newTestGateway(t)
+	const keyRings = "/v1/projects/p/locations/global/keyRings"
+	do(s, http.MethodPost, keyRings+"?keyRingId=r", "")
+
+	get := func(params string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, keyRings+"/r", nil)
+		req.Header.Set("X-Goog-Request-Params", params)
+		req.Header.Set("X-Goog-Api-Client", "gl-go/1.24.0")
+		rec := httptest.NewRecorder()
+		s.handleRequest(rec, req)
+		return rec
+	}
+
+	if rec := get("name=projects%2Fp%2Flocations%2Fglobal%2FkeyRings%2Fr"); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for matching routing params, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := get("name=projects%2Fp%2Flocations%2Fglobal%2FkeyRings%2Fother"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for mismatched routing params, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestJSONFieldNames(t *testing.T) {
+	s := newTestGateway(t)
+	const keyRings = "/v1/projects/p/locations/global/keyRings"
+	do(s, http.MethodPost, keyRings+"?keyRingId=r", "")
+	do(s, http.MethodPost, keyRings+"/r/cryptoKeys?cryptoKeyId=k", `{"purpose":"ENCRYPT_DECRYPT"}`)
+
+	// camelCase like cloudkms.googleapis.com by default
+	body := do(s, http.MethodGet, keyRings+"/r/cryptoKeys/k", "").Body.String()
+	for _, name := range []string{`"createTime"`, `"versionTemplate"`, `"protectionLevel"`} {
+		if !strings.Contains(body, name) {
+			t.Errorf("Expected %s in %s", name, body)
+		}
+	}
+	if strings.Contains(body, `"create_time"`) {
+		t.Errorf("Unexpected proto field name in %s", body)
+	}
+
+	s.SetProtoNames(true)
+	body = do(s, http.MethodGet, keyRings+"/r/cryptoKeys/k", "").Body.String()
+	if !strings.Contains(body, `"create_time"`) || !strings.Contains(body, `"version_template"`) {
+		t.Errorf("Expected proto field names with SetProtoNames, got %s", body)
+	}
+}
+
+func TestGenerateRandomBytes(t *testing.T) {
+	s := newTestGateway(t)
+	const path = "/v1/projects/p/locations/global:generateRandomBytes"
+
+	rec := do(s, http.MethodPost, path, `{"lengthBytes":32,"protectionLevel":"HSM"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GenerateRandomBytes: %d %s", rec.Code, rec.Body.String())
+	}
+	var resp kmspb.GenerateRandomBytesResponse
+	if err := protojson.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if len(resp.Data) != 32 {
+		t.Errorf("Expected 32 bytes, got %d", len(resp.Data))
+	}
+	if resp.DataCrc32C.GetValue() != int64(crc32.Checksum(resp.Data, crc32.MakeTable(crc32.Castagnoli))) {
+		t.Error("dataCrc32c does not match the data")
+	}
+
+	for _, body := range []string{
+		`{"lengthBytes":4,"protectionLevel":"HSM"}`,
+		`{"lengthBytes":2048,"protectionLevel":"HSM"}`,
+		`{"lengthBytes":32,"protectionLevel":"SOFTWARE"}`,
+	} {
+		if rec := do(s, http.MethodPost, path, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, rec.Code)
+		}
+	}
+	if rec := do(s, http.MethodGet, path, ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET, got %d", rec.Code)
+	}
+}
+
+func TestImportCryptoKeyVersion(t *testing.T) {
+	s := newTestGateway(t)
+	const keyRing = "/v1/projects/p/locations/global/keyRings/r"
+
+	do(s, http.MethodPost, "/v1/projects/p/locations/global/keyRings?keyRingId=r", "")
+	if rec := do(s, http.MethodPost, keyRing+"/cryptoKeys?cryptoKeyId=mac", `{"purpose":"MAC","versionTemplate":{"algorithm":"HMAC_SHA256"}}`); rec.Code != http.StatusCreated {
+		t.Fatalf("CreateCryptoKey: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec := do(s, http.MethodPost, keyRing+"/importJobs?importJobId=job", `{"importMethod":"RSA_OAEP_3072_SHA256_AES_256","protectionLevel":"SOFTWARE"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("CreateImportJob: expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var job kmspb.ImportJob
+	if err := protojson.Unmarshal(rec.Body.Bytes(), &job); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if job.State != kmspb.ImportJob_ACTIVE || job.PublicKey.GetPem() == "" {
+		t.Fatalf("Expected an ACTIVE job with a public key, got %v", &job)
+	}
+	if rec := do(s, http.MethodGet, keyRing+"/importJobs/job", ""); rec.Code != http.StatusOK {
+		t.Errorf("GetImportJob: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(s, http.MethodGet, keyRing+"/importJobs", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), job.Name) {
+		t.Errorf("ListImportJobs: %d %s", rec.Code, rec.Body.String())
+	}
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	wrapped, err := storage.WrapKeyMaterial(job.ImportMethod, job.PublicKey.Pem, key)
+	if err != nil {
+		t.Fatalf("WrapKeyMaterial failed: %v", err)
+	}
+	// Bytes fields accept URL-safe base64 as well as standard base64
+	body := fmt.Sprintf(`{"algorithm":"HMAC_SHA256","importJob":%q,"wrappedKey":%q}`, job.Name, base64.URLEncoding.EncodeToString(wrapped))
+	rec = do(s, http.MethodPost, keyRing+"/cryptoKeys/mac/cryptoKeyVersions:import", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ImportCryptoKeyVersion: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var version kmspb.CryptoKeyVersion
+	if err := protojson.Unmarshal(rec.Body.Bytes(), &version); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if !strings.HasSuffix(version.Name, "/cryptoKeyVersions/2") || version.State != kmspb.CryptoKeyVersion_ENABLED {
+		t.Fatalf("Expected ENABLED version 2, got %v", &version)
+	}
+
+	// The imported version signs with the imported key
+	rec = do(s, http.MethodPost, "/v1/"+version.Name+":macSign", fmt.Sprintf(`{"data":%q}`, base64.StdEncoding.EncodeToString([]byte("message"))))
+	var signed kmspb.MacSignResponse
+	if err := protojson.Unmarshal(rec.Body.Bytes(), &signed); err != nil {
+		t.Fatalf("MacSign: %d %s", rec.Code, rec.Body.String())
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("message"))
+	if !hmac.Equal(signed.Mac, mac.Sum(nil)) {
+		t.Error("MAC does not match the imported key")
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"garbage is IMPORT_FAILED", fmt.Sprintf(`{"algorithm":"HMAC_SHA256","importJob":%q,"wrappedKey":"AAAA"}`, job.Name), http.StatusOK},
+		{"reimport of an enabled version", fmt.Sprintf(`{"algorithm":"HMAC_SHA256","importJob":%q,"wrappedKey":%q,"cryptoKeyVersion":%q}`, job.Name, base64.StdEncoding.EncodeToString(wrapped), version.Name), http.StatusBadRequest},
+		{"wrong purpose", fmt.Sprintf(`{"algorithm":"GOOGLE_SYMMETRIC_ENCRYPTION","importJob":%q,"wrappedKey":%q}`, job.Name, base64.StdEncoding.EncodeToString(wrapped)), http.StatusBadRequest},
+		{"unknown job", fmt.Sprintf(`{"algorithm":"HMAC_SHA256","importJob":%q,"wrappedKey":%q}`, job.Name+"x", base64.StdEncoding.EncodeToString(wrapped)), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do(s, http.MethodPost, keyRing+"/cryptoKeys/mac/cryptoKeyVersions:import", tt.body); rec.Code != tt.want {
+				t.Errorf("Expected %d, got %d: %s", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestResourceNames(t *testing.T) {
+	s := newTestGateway(t)
+	const keyRings = "/v1/projects/p/locations/global/keyRings"
+	if rec := do(s, http.MethodPost, keyRings+"?keyRingId=r", `{}`); rec.Code != http.StatusCreated {
+		t.Fatalf("CreateKeyRing: %d %s", rec.Code, rec.Body.String())
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   int
+	}{
+		{"exact name", http.MethodGet, keyRings + "/r", http.StatusOK},
+		{"IDs are case-sensitive", http.MethodGet, keyRings + "/R", http.StatusNotFound},
+		{"trailing slash", http.MethodGet, keyRings + "/r/", http.StatusBadRequest},
+		{"encoded character", http.MethodGet, keyRings + "/%72", http.StatusBadRequest},
+		{"encoded slash", http.MethodGet, keyRings + "/r%2FcryptoKeys%2Fk", http.StatusBadRequest},
+		{"invalid ID", http.MethodPost, keyRings + "?keyRingId=not+valid", http.StatusBadRequest},
+		{"ID too long", http.MethodPost, keyRings + "?keyRingId=" + strings.Repeat("a", 64), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do(s, tt.method, tt.path, `{}`); rec.Code != tt.want {
+				t.Errorf("Expected %d, got %d: %s", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestPrincipalForwarded(t *testing.T) {
+	token := "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(`{"email":"app@p.iam.gserviceaccount.com"}`)) + ".c2ln"
+
+	tests := []struct {
+		name      string
+		headers   map[string]string
+		principal string
+	}{
+		{"explicit header", map[string]string{"X-Emulator-Principal": "user:dev@example.com"}, "user:dev@example.com"},
+		// The gRPC server resolves JWTs, so it can verify them
+		{"bearer JWT", map[string]string{"Authorization": "Bearer " + token}, ""},
+		{"explicit header and JWT", map[string]string{"Authorization": "Bearer " + token, "X-Emulator-Principal": "user:dev@example.com"}, "user:dev@example.com"},
+		{"anonymous", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/projects/p/locations", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			md, _ := metadata.FromOutgoingContext(outgoingContext(req))
+			if got := strings.Join(md.Get("x-emulator-principal"), ","); got != tt.principal {
+				t.Errorf("Expected principal %q, got %q", tt.principal, got)
+			}
+			if auth := tt.headers["Authorization"]; strings.Join(md.Get("authorization"), ",") != auth {
+				t.Errorf("Expected authorization %q to be forwarded, got %v", auth, md.Get("authorization"))
+			}
+		})
+	}
+}
+
+// recordingIAM answers IAM calls with the request it got
+type recordingIAM struct {
+	iampb.UnimplementedIAMPolicyServer
+}
+
+func (recordingIAM) GetIamPolicy(_ context.Context, req *iampb.GetIamPolicyRequest) (*iampb.Policy, error) {
+	return &iampb.Policy{Version: req.GetOptions().GetRequestedPolicyVersion(), Etag: []byte(req.Resource)}, nil
+}
+
+func (recordingIAM) SetIamPolicy(_ context.Context, req *iampb.SetIamPolicyRequest) (*iampb.Policy, error) {
+	req.Policy.Etag = []byte(req.Resource)
+	return req.Policy, nil
+}
+
+func (recordingIAM) TestIamPermissions(_ context.Context, req *iampb.TestIamPermissionsRequest) (*iampb.TestIamPermissionsResponse, error) {
+	return &iampb.TestIamPermissionsResponse{Permissions: append(req.Permissions, req.Resource)}, nil
+}
+
+func TestIAMRoutes(t *testing.T) {
+	lis := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	iampb.RegisterIAMPolicyServer(grpcServer, recordingIAM{})
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+	s, err := NewServer("passthrough:///bufconn", grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}))
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	t.Cleanup(func() { s.Stop(context.Background()) })
+
+	const key = "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+	etag := base64.StdEncoding.EncodeToString([]byte(key))
+
+	// gcloud kms keys get-iam-policy
+	rec := do(s, http.MethodGet, "/v1/"+key+":getIamPolicy?alt=json&options.requestedPolicyVersion=3", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"version":3`) || !strings.Contains(rec.Body.String(), etag) {
+		t.Errorf("Unexpected getIamPolicy response %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(s, http.MethodGet, "/v1/"+key+":getIamPolicy?options.requestedPolicyVersion=x", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid policy version, got %d", rec.Code)
+	}
+
+	// gcloud kms keys add-iam-policy-binding
+	rec = do(s, http.MethodPost, "/v1/"+key+":setIamPolicy", `{"policy": {"bindings": [{"role": "roles/cloudkms.cryptoKeyEncrypter", "members": ["user:a@example.com"]}]}, "updateMask": "bindings,etag"}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "roles/cloudkms.cryptoKeyEncrypter") || !strings.Contains(rec.Body.String(), etag) {
+		t.Errorf("Unexpected setIamPolicy response %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = do(s, http.MethodPost, "/v1/projects/p/locations/global/keyRings/r:testIamPermissions", `{"permissions": ["cloudkms.keyRings.get"]}`)
+	// protojson varies its whitespace between builds
+	if rec.Code != http.StatusOK || !strings.Contains(strings.ReplaceAll(rec.Body.String(), " ", ""), `["cloudkms.keyRings.get","projects/p/locations/global/keyRings/r"]`) {
+		t.Errorf("Unexpected testIamPermissions response %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,361 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// OpenAPIPath serves the OpenAPI 3 document describing the REST surface
+const OpenAPIPath = "/openapi.json"
+
+// openAPIDocument returns the document, built on first use since the route
+// table and descriptors are static
+func (s *Server) openAPIDocument() ([]byte, error) {
+	s.openAPIOnce.Do(func() {
+		doc, err := buildOpenAPI(routes, s.protoNames)
+		if err != nil {
+			s.openAPIErr = err
+			return
+		}
+		s.openAPI, s.openAPIErr = json.MarshalIndent(doc, "", "  ")
+	})
+	return s.openAPI, s.openAPIErr
+}
+
+// handleOpenAPI serves the OpenAPI document
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+	data, err := s.openAPIDocument()
+	if err != nil {
+		writeError(w, codes.Internal, "Failed to build OpenAPI document: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// buildOpenAPI generates an OpenAPI 3 document for routes. Request and
+// response schemas come from the protobuf descriptors of each route's RPC,
+// using the field names the gateway writes: JSON (camelCase) names, or proto
+// names when protoNames is set.
+func buildOpenAPI(routes []route, protoNames bool) (map[string]any, error) {
+	g := &schemaGenerator{
+		protoNames: protoNames,
+		schemas: map[string]any{
+			"Error": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"error": map[string]any{
+						"type": "object",
+						"properties": map[string]any{
+							"code":    map[string]any{"type": "integer"},
+							"message": map[string]any{"type": "string"},
+							"status":  map[string]any{"type": "string"},
+							"details": map[string]any{"type": "array", "items": map[string]any{"type": "object"}},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	paths := map[string]any{}
+	operations := map[protoreflect.FullName]int{} // routes per RPC, for unique operationIds
+	for _, rt := range routes {
+		method, err := rt.methodDescriptor()
+		if err != nil {
+			return nil, err
+		}
+
+		var params []any
+		for _, m := range pathParam.FindAllStringSubmatch(rt.path, -1) {
+			params = append(params, map[string]any{
+				"name": m[1], "in": "path", "required": true,
+				"schema": map[string]any{"type": "string"},
+			})
+		}
+		for _, name := range rt.query {
+			field, err := rt.queryField(method, name)
+			if err != nil {
+				return nil, err
+			}
+			params = append(params, map[string]any{
+				"name": name, "in": "query",
+				"schema": g.fieldSchema(field),
+			})
+		}
+		params = append(params, map[string]any{
+			"name": "fields", "in": "query",
+			"description": "Selects the response fields to return, e.g. name,primary/state",
+			"schema":      map[string]any{"type": "string"},
+		})
+
+		success := "200"
+		if rt.created {
+			success = "201"
+		}
+		// An RPC served on several paths, like Encrypt on keys and on
+		// versions, gets a numbered operationId for each path after the first
+		operationID := fmt.Sprintf("%s_%s", method.Parent().Name(), method.Name())
+		if operations[rt.rpc]++; operations[rt.rpc] > 1 {
+			operationID = fmt.Sprintf("%s_%d", operationID, operations[rt.rpc])
+		}
+		op := map[string]any{
+			"operationId": operationID,
+			"tags":        []string{string(method.Parent().Name())},
+			"parameters":  params,
+			"responses": map[string]any{
+				success:   jsonContent("Successful response", g.messageSchema(method.Output())),
+				"default": jsonContent("Error", map[string]any{"$ref": "#/components/schemas/Error"}),
+			},
+		}
+
+		body, err := rt.bodyMessage(method)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			op["requestBody"] = jsonContent("", g.messageSchema(body))
+		}
+
+		path := "/v1/" + rt.path
+		item, _ := paths[path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[path] = item
+		}
+		item[map[string]string{
+			http.MethodGet:   "get",
+			http.MethodPost:  "post",
+			http.MethodPatch: "patch",
+		}[rt.method]] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "Cloud Key Management Service (KMS) API",
+			"description": "REST surface served by the GCP KMS emulator",
+			"version":     "v1",
+		},
+		"paths":      paths,
+		"components": map[string]any{"schemas": g.schemas},
+	}, nil
+}
+
+// methodDescriptor returns the descriptor of the RPC the route calls
+func (rt *route) methodDescriptor() (protoreflect.MethodDescriptor, error) {
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(rt.rpc)
+	if err != nil {
+		return nil, fmt.Errorf("route %s %s: %w", rt.method, rt.path, err)
+	}
+	method, ok := desc.(protoreflect.MethodDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("route %s %s: %s is not an RPC", rt.method, rt.path, rt.rpc)
+	}
+	return method, nil
+}
+
+// queryField returns the request field set by a query parameter. Dotted
+// names such as options.requestedPolicyVersion set nested fields.
+func (rt *route) queryField(method protoreflect.MethodDescriptor, name string) (protoreflect.FieldDescriptor, error) {
+	md := method.Input()
+	var field protoreflect.FieldDescriptor
+	for _, part := range strings.Split(name, ".") {
+		if md == nil {
+			return nil, fmt.Errorf("route %s %s: %s is not a message field", rt.method, rt.path, field.FullName())
+		}
+		if field = md.Fields().ByJSONName(part); field == nil {
+			return nil, fmt.Errorf("route %s %s: %s has no field %s", rt.method, rt.path, md.FullName(), part)
+		}
+		md = field.Message()
+	}
+	return field, nil
+}
+
+// bodyMessage returns the message read from the route's request body, or
+// nil when it takes none
+func (rt *route) bodyMessage(method protoreflect.MethodDescriptor) (protoreflect.MessageDescriptor, error) {
+	switch rt.body {
+	case "":
+		return nil, nil
+	case "*":
+		return method.Input(), nil
+	}
+	field := method.Input().Fields().ByName(protoreflect.Name(rt.body))
+	if field == nil || field.Message() == nil {
+		return nil, fmt.Errorf("route %s %s: %s has no message field %s", rt.method, rt.path, method.Input().FullName(), rt.body)
+	}
+	return field.Message(), nil
+}
+
+func jsonContent(description string, schema any) map[string]any {
+	content := map[string]any{
+		"content": map[string]any{"application/json": map[string]any{"schema": schema}},
+	}
+	if description != "" {
+		content["description"] = description
+	}
+	return content
+}
+
+// schemaGenerator collects the component schemas of the messages a document
+// uses
+type schemaGenerator struct {
+	protoNames bool
+	schemas    map[string]any
+
+	// discovery writes schemas in the Google API Discovery format: named by
+	// their short message name and referenced by that name
+	discovery bool
+	owners    map[string]protoreflect.FullName // schema name to message
+}
+
+// fieldName is the JSON name the gateway writes for fd
+func (g *schemaGenerator) fieldName(fd protoreflect.FieldDescriptor) string {
+	if g.protoNames {
+		return string(fd.Name())
+	}
+	return fd.JSONName()
+}
+
+// messageSchema returns a reference to the schema of md, adding it and the
+// messages it uses to the components
+func (g *schemaGenerator) messageSchema(md protoreflect.MessageDescriptor) map[string]any {
+	if schema, ok := wellKnownSchema(md.FullName()); ok {
+		if g.discovery {
+			schema = discoveryWellKnown(md.FullName(), schema)
+		}
+		return schema
+	}
+
+	name := g.schemaName(md)
+	ref := map[string]any{"$ref": "#/components/schemas/" + name}
+	if g.discovery {
+		ref = map[string]any{"$ref": name}
+	}
+	if _, ok := g.schemas[name]; ok {
+		return ref
+	}
+
+	properties := map[string]any{}
+	object := map[string]any{"type": "object", "properties": properties}
+	if g.discovery {
+		object["id"] = name
+	}
+	g.schemas[name] = object // registered first so recursive messages terminate
+
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		var schema map[string]any
+		switch {
+		case fd.IsMap():
+			schema = map[string]any{"type": "object", "additionalProperties": g.fieldSchema(fd.MapValue())}
+		case fd.IsList():
+			schema = map[string]any{"type": "array", "items": g.fieldSchema(fd)}
+		default:
+			schema = g.fieldSchema(fd)
+		}
+		properties[g.fieldName(fd)] = schema
+	}
+	return ref
+}
+
+// schemaName names the schema of md: its full name, or in discovery
+// documents its short name unless another message already has it
+func (g *schemaGenerator) schemaName(md protoreflect.MessageDescriptor) string {
+	if !g.discovery {
+		return string(md.FullName())
+	}
+	if g.owners == nil {
+		g.owners = map[string]protoreflect.FullName{}
+	}
+	name := string(md.Name())
+	if owner, ok := g.owners[name]; ok && owner != md.FullName() {
+		name = strings.ReplaceAll(string(md.FullName()), ".", "_")
+	}
+	g.owners[name] = md.FullName()
+	return name
+}
+
+// fieldSchema returns the schema of a single value of fd, following the
+// protobuf JSON mapping
+func (g *schemaGenerator) fieldSchema(fd protoreflect.FieldDescriptor) map[string]any {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return g.messageSchema(fd.Message())
+	case protoreflect.EnumKind:
+		values := fd.Enum().Values()
+		names := make([]string, values.Len())
+		for i := range names {
+			names[i] = string(values.Get(i).Name())
+		}
+		return map[string]any{"type": "string", "enum": names}
+	case protoreflect.BoolKind:
+		return map[string]any{"type": "boolean"}
+	case protoreflect.StringKind:
+		return map[string]any{"type": "string"}
+	case protoreflect.BytesKind:
+		return map[string]any{"type": "string", "format": "byte"}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return map[string]any{"type": "integer", "format": "uint32"}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return map[string]any{"type": "string", "format": "int64"}
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return map[string]any{"type": "string", "format": "uint64"}
+	case protoreflect.FloatKind:
+		return map[string]any{"type": "number", "format": "float"}
+	case protoreflect.DoubleKind:
+		return map[string]any{"type": "number", "format": "double"}
+	}
+	return map[string]any{}
+}
+
+// wellKnownSchema maps the well-known types that have a special JSON form
+func wellKnownSchema(name protoreflect.FullName) (map[string]any, bool) {
+	switch name {
+	case "google.protobuf.Timestamp":
+		return map[string]any{"type": "string", "format": "date-time"}, true
+	case "google.protobuf.Duration":
+		return map[string]any{"type": "string", "format": "duration"}, true
+	case "google.protobuf.FieldMask", "google.protobuf.StringValue":
+		return map[string]any{"type": "string"}, true
+	case "google.protobuf.Int64Value":
+		return map[string]any{"type": "string", "format": "int64"}, true
+	case "google.protobuf.UInt64Value":
+		return map[string]any{"type": "string", "format": "uint64"}, true
+	case "google.protobuf.Int32Value":
+		return map[string]any{"type": "integer", "format": "int32"}, true
+	case "google.protobuf.UInt32Value":
+		return map[string]any{"type": "integer", "format": "uint32"}, true
+	case "google.protobuf.BoolValue":
+		return map[string]any{"type": "boolean"}, true
+	case "google.protobuf.BytesValue":
+		return map[string]any{"type": "string", "format": "byte"}, true
+	case "google.protobuf.FloatValue", "google.protobuf.DoubleValue":
+		return map[string]any{"type": "number"}, true
+	case "google.protobuf.Any":
+		return map[string]any{
+			"type":                 "object",
+			"properties":           map[string]any{"@type": map[string]any{"type": "string"}},
+			"additionalProperties": true,
+		}, true
+	case "google.protobuf.Struct", "google.protobuf.Empty":
+		return map[string]any{"type": "object"}, true
+	case "google.protobuf.Value":
+		return map[string]any{}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,219 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// route is one REST endpoint. handleRequest dispatches on this table and the
+// OpenAPI document is generated from it, so adding an RPC to the gateway is
+// one entry plus its handler.
+type route struct {
+	method string
+	// path is the template relative to /v1. {name} matches one path segment;
+	// a trailing ":verb" is a custom method.
+	path string
+	// name is the template of the resource name passed to handle, usually
+	// the path without its collection or custom verb
+	name   string
+	handle func(s *Server, ctx context.Context, w http.ResponseWriter, r *http.Request, name string)
+
+	// rpc is the gRPC method the route calls
+	rpc protoreflect.FullName
+	// body names the request field read from the JSON body: "*" for the
+	// whole request, "" when the route takes no body
+	body string
+	// query lists the query parameters the route reads, by JSON name
+	query []string
+	// created is set when the route answers 201 rather than 200
+	created bool
+}
+
+const (
+	kmsService       = "google.cloud.kms.v1.KeyManagementService."
+	locationsService = "google.cloud.location.Locations."
+	iamService       = "google.iam.v1.IAMPolicy."
+
+	projectPath   = "projects/{project}"
+	locationPath  = projectPath + "/locations/{location}"
+	keyRingPath   = locationPath + "/keyRings/{keyRing}"
+	keyPath       = keyRingPath + "/cryptoKeys/{cryptoKey}"
+	versionPath   = keyPath + "/cryptoKeyVersions/{cryptoKeyVersion}"
+	importJobPath = keyRingPath + "/importJobs/{importJob}"
+)
+
+var listQuery = []string{"pageSize", "pageToken", "filter", "orderBy"}
+
+var routes = []route{
+	{method: http.MethodGet, path: projectPath + "/locations", name: projectPath, handle: (*Server).listLocations, rpc: locationsService + "ListLocations", query: []string{"pageSize", "pageToken", "filter"}},
+	{method: http.MethodGet, path: locationPath, name: locationPath, handle: (*Server).getLocation, rpc: locationsService + "GetLocation"},
+	{method: http.MethodPost, path: locationPath + ":generateRandomBytes", name: locationPath, handle: (*Server).generateRandomBytes, rpc: kmsService + "GenerateRandomBytes", body: "*"},
+
+	{method: http.MethodPost, path: locationPath + "/keyRings", name: locationPath, handle: (*Server).createKeyRing, rpc: kmsService + "CreateKeyRing", query: []string{"keyRingId"}, created: true},
+	{method: http.MethodGet, path: locationPath + "/keyRings", name: locationPath, handle: (*Server).listKeyRings, rpc: kmsService + "ListKeyRings", query: listQuery},
+	{method: http.MethodGet, path: keyRingPath, name: keyRingPath, handle: (*Server).getKeyRing, rpc: kmsService + "GetKeyRing"},
+
+	{method: http.MethodPost, path: keyRingPath + "/importJobs", name: keyRingPath, handle: (*Server).createImportJob, rpc: kmsService + "CreateImportJob", body: "import_job", query: []string{"importJobId"}, created: true},
+	{method: http.MethodGet, path: keyRingPath + "/importJobs", name: keyRingPath, handle: (*Server).listImportJobs, rpc: kmsService + "ListImportJobs", query: listQuery},
+	{method: http.MethodGet, path: importJobPath, name: importJobPath, handle: (*Server).getImportJob, rpc: kmsService + "GetImportJob"},
+
+	{method: http.MethodPost, path: keyRingPath + "/cryptoKeys", name: keyRingPath, handle: (*Server).createCryptoKey, rpc: kmsService + "CreateCryptoKey", body: "crypto_key", query: []string{"cryptoKeyId"}, created: true},
+	{method: http.MethodGet, path: keyRingPath + "/cryptoKeys", name: keyRingPath, handle: (*Server).listCryptoKeys, rpc: kmsService + "ListCryptoKeys", query: append([]string{"versionView"}, listQuery...)},
+	{method: http.MethodGet, path: keyPath, name: keyPath, handle: (*Server).getCryptoKey, rpc: kmsService + "GetCryptoKey"},
+	{method: http.MethodPatch, path: keyPath, name: keyPath, handle: (*Server).updateCryptoKey, rpc: kmsService + "UpdateCryptoKey", body: "crypto_key", query: []string{"updateMask"}},
+	{method: http.MethodPost, path: keyPath + ":encrypt", name: keyPath, handle: (*Server).encrypt, rpc: kmsService + "Encrypt", body: "*"},
+	{method: http.MethodPost, path: keyPath + ":decrypt", name: keyPath, handle: (*Server).decrypt, rpc: kmsService + "Decrypt", body: "*"},
+	{method: http.MethodPost, path: keyPath + ":updatePrimaryVersion", name: keyPath, handle: (*Server).updateCryptoKeyPrimaryVersion, rpc: kmsService + "UpdateCryptoKeyPrimaryVersion", body: "*"},
+
+	{method: http.MethodPost, path: keyPath + "/cryptoKeyVersions", name: keyPath, handle: (*Server).createCryptoKeyVersion, rpc: kmsService + "CreateCryptoKeyVersion", created: true},
+	{method: http.MethodPost, path: keyPath + "/cryptoKeyVersions:import", name: keyPath, handle: (*Server).importCryptoKeyVersion, rpc: kmsService + "ImportCryptoKeyVersion", body: "*"},
+	{method: http.MethodGet, path: keyPath + "/cryptoKeyVersions", name: keyPath, handle: (*Server).listCryptoKeyVersions, rpc: kmsService + "ListCryptoKeyVersions", query: append([]string{"view"}, listQuery...)},
+	{method: http.MethodGet, path: versionPath, name: versionPath, handle: (*Server).getCryptoKeyVersion, rpc: kmsService + "GetCryptoKeyVersion"},
+	{method: http.MethodPatch, path: versionPath, name: versionPath, handle: (*Server).updateCryptoKeyVersion, rpc: kmsService + "UpdateCryptoKeyVersion", body: "crypto_key_version"},
+	{method: http.MethodPost, path: versionPath + ":destroy", name: versionPath, handle: (*Server).destroyCryptoKeyVersion, rpc: kmsService + "DestroyCryptoKeyVersion"},
+	{method: http.MethodPost, path: versionPath + ":restore", name: versionPath, handle: (*Server).restoreCryptoKeyVersion, rpc: kmsService + "RestoreCryptoKeyVersion"},
+	{method: http.MethodGet, path: versionPath + "/publicKey", name: versionPath, handle: (*Server).getPublicKey, rpc: kmsService + "GetPublicKey"},
+	{method: http.MethodPost, path: versionPath + ":encrypt", name: versionPath, handle: (*Server).encrypt, rpc: kmsService + "Encrypt", body: "*"},
+	{method: http.MethodPost, path: versionPath + ":asymmetricSign", name: versionPath, handle: (*Server).asymmetricSign, rpc: kmsService + "AsymmetricSign", body: "*"},
+	{method: http.MethodPost, path: versionPath + ":asymmetricDecrypt", name: versionPath, handle: (*Server).asymmetricDecrypt, rpc: kmsService + "AsymmetricDecrypt", body: "*"},
+	{method: http.MethodPost, path: versionPath + ":macSign", name: versionPath, handle: (*Server).macSign, rpc: kmsService + "MacSign", body: "*"},
+	{method: http.MethodPost, path: versionPath + ":macVerify", name: versionPath, handle: (*Server).macVerify, rpc: kmsService + "MacVerify", body: "*"},
+
+	// IAM methods on key rings, keys and import jobs. getIamPolicy is a GET,
+	// as on cloudkms.googleapis.com.
+	{method: http.MethodGet, path: keyRingPath + ":getIamPolicy", name: keyRingPath, handle: (*Server).getIamPolicy, rpc: iamService + "GetIamPolicy", query: []string{"options.requestedPolicyVersion"}},
+	{method: http.MethodPost, path: keyRingPath + ":setIamPolicy", name: keyRingPath, handle: (*Server).setIamPolicy, rpc: iamService + "SetIamPolicy", body: "*"},
+	{method: http.MethodPost, path: keyRingPath + ":testIamPermissions", name: keyRingPath, handle: (*Server).testIamPermissions, rpc: iamService + "TestIamPermissions", body: "*"},
+	{method: http.MethodGet, path: keyPath + ":getIamPolicy", name: keyPath, handle: (*Server).getIamPolicy, rpc: iamService + "GetIamPolicy", query: []string{"options.requestedPolicyVersion"}},
+	{method: http.MethodPost, path: keyPath + ":setIamPolicy", name: keyPath, handle: (*Server).setIamPolicy, rpc: iamService + "SetIamPolicy", body: "*"},
+	{method: http.MethodPost, path: keyPath + ":testIamPermissions", name: keyPath, handle: (*Server).testIamPermissions, rpc: iamService + "TestIamPermissions", body: "*"},
+	{method: http.MethodGet, path: importJobPath + ":getIamPolicy", name: importJobPath, handle: (*Server).getIamPolicy, rpc: iamService + "GetIamPolicy", query: []string{"options.requestedPolicyVersion"}},
+	{method: http.MethodPost, path: importJobPath + ":setIamPolicy", name: importJobPath, handle: (*Server).setIamPolicy, rpc: iamService + "SetIamPolicy", body: "*"},
+	{method: http.MethodPost, path: importJobPath + ":testIamPermissions", name: importJobPath, handle: (*Server).testIamPermissions, rpc: iamService + "TestIamPermissions", body: "*"},
+}
+
+var pathParam = regexp.MustCompile(`\{([^}]+)\}`)
+
+// handleRequest dispatches a /v1 request to the route matching its path and
+// method. A path matching routes for other methods only is answered 405
+// with an Allow header; a path with an empty segment, such as a trailing
+// slash, is 400 as the gRPC API rejects such names; any other path matching
+// no route is 404.
+//
+// The path is matched as sent, without decoding percent-escapes, so
+// keyRings/a%2Fb and cryptoKeys/Key%31 reach the gRPC server as those exact
+// names, which it rejects, rather than as other resources.
+func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/v1/")
+	rt, name, allowed := matchRoute(r.Method, path)
+	switch {
+	case rt != nil:
+		rt.handle(s, outgoingContext(r), w, r, name)
+	case len(allowed) > 0:
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		methodNotAllowed(w, r)
+	case strings.HasSuffix(path, "/") || strings.Contains(path, "//"):
+		writeError(w, codes.InvalidArgument, "Invalid resource name %q: resource names have no empty segments", path)
+	default:
+		writeError(w, codes.NotFound, "No route for %s %s", r.Method, r.URL.Path)
+	}
+}
+
+// matchRoute finds the route for method and path (relative to /v1) and the
+// resource name it targets. When no route has the method, it returns the
+// methods of the routes matching path.
+//
+// A custom verb is only split off the last segment when a route with that
+// verb matches, so IDs containing colons still reach the plain routes:
+// cryptoKeys/a:b is the key "a:b", and cryptoKeys/a:b:encrypt encrypts
+// with it.
+func matchRoute(method, path string) (*route, string, []string) {
+	var candidates []*route
+	var candidateVars []map[string]string
+	withVerb := false
+	for i := range routes {
+		rt := &routes[i]
+		vars, ok := rt.match(path)
+		if !ok {
+			continue
+		}
+		if rt.verb() != "" && !withVerb {
+			// A verb match takes precedence over reading the verb as part
+			// of an ID
+			withVerb = true
+			candidates, candidateVars = nil, nil
+		}
+		if withVerb && rt.verb() == "" {
+			continue
+		}
+		candidates = append(candidates, rt)
+		candidateVars = append(candidateVars, vars)
+	}
+
+	var allowed []string
+	for i, rt := range candidates {
+		if rt.method == method {
+			return rt, rt.expand(candidateVars[i]), nil
+		}
+		allowed = append(allowed, rt.method)
+	}
+	sort.Strings(allowed)
+	return nil, "", allowed
+}
+
+// verb returns the custom verb of the route, or ""
+func (rt *route) verb() string {
+	last := rt.path[strings.LastIndex(rt.path, "/")+1:]
+	if i := strings.LastIndex(last, ":"); i >= 0 {
+		return last[i+1:]
+	}
+	return ""
+}
+
+// match reports whether path fits the route template, returning the value
+// of each {variable}
+func (rt *route) match(path string) (map[string]string, bool) {
+	template := rt.path
+	if verb := rt.verb(); verb != "" {
+		template = strings.TrimSuffix(template, ":"+verb)
+		var ok bool
+		if path, ok = strings.CutSuffix(path, ":"+verb); !ok {
+			return nil, false
+		}
+	}
+
+	want := strings.Split(template, "/")
+	got := strings.Split(path, "/")
+	if len(want) != len(got) {
+		return nil, false
+	}
+	vars := make(map[string]string)
+	for i, segment := range want {
+		if name, ok := strings.CutPrefix(segment, "{"); ok {
+			if got[i] == "" {
+				return nil, false
+			}
+			vars[strings.TrimSuffix(name, "}")] = got[i]
+			continue
+		}
+		if segment != got[i] {
+			return nil, false
+		}
+	}
+	return vars, true
+}
+
+// expand fills the name template with the matched variables
+func (rt *route) expand(vars map[string]string) string {
+	return pathParam.ReplaceAllStringFunc(rt.name, func(param string) string {
+		return vars[param[1:len(param)-1]]
+	})
+}
@@ -0,0 +1,209 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestMatchRoute(t *testing.T) {
+	const (
+		location = "projects/p/locations/global"
+		keyRing  = location + "/keyRings/r"
+		key      = keyRing + "/cryptoKeys/k"
+		version  = key + "/cryptoKeyVersions/1"
+	)
+
+	type test struct {
+		method, path string
+		rpc          protoreflect.FullName
+		name         string
+	}
+	tests := []test{
+		{http.MethodGet, "projects/p/locations", locationsService + "ListLocations", "projects/p"},
+		{http.MethodGet, location, locationsService + "GetLocation", location},
+		{http.MethodPost, location + ":generateRandomBytes", kmsService + "GenerateRandomBytes", location},
+
+		{http.MethodPost, location + "/keyRings", kmsService + "CreateKeyRing", location},
+		{http.MethodGet, location + "/keyRings", kmsService + "ListKeyRings", location},
+		{http.MethodGet, keyRing, kmsService + "GetKeyRing", keyRing},
+
+		{http.MethodPost, keyRing + "/importJobs", kmsService + "CreateImportJob", keyRing},
+		{http.MethodGet, keyRing + "/importJobs", kmsService + "ListImportJobs", keyRing},
+		{http.MethodGet, keyRing + "/importJobs/j", kmsService + "GetImportJob", keyRing + "/importJobs/j"},
+
+		{http.MethodPost, keyRing + "/cryptoKeys", kmsService + "CreateCryptoKey", keyRing},
+		{http.MethodGet, keyRing + "/cryptoKeys", kmsService + "ListCryptoKeys", keyRing},
+		{http.MethodGet, key, kmsService + "GetCryptoKey", key},
+		{http.MethodPatch, key, kmsService + "UpdateCryptoKey", key},
+		{http.MethodPost, key + ":encrypt", kmsService + "Encrypt", key},
+		{http.MethodPost, key + ":decrypt", kmsService + "Decrypt", key},
+		{http.MethodPost, key + ":updatePrimaryVersion", kmsService + "UpdateCryptoKeyPrimaryVersion", key},
+
+		{http.MethodPost, key + "/cryptoKeyVersions", kmsService + "CreateCryptoKeyVersion", key},
+		{http.MethodPost, key + "/cryptoKeyVersions:import", kmsService + "ImportCryptoKeyVersion", key},
+		{http.MethodGet, key + "/cryptoKeyVersions", kmsService + "ListCryptoKeyVersions", key},
+		{http.MethodGet, version, kmsService + "GetCryptoKeyVersion", version},
+		{http.MethodPatch, version, kmsService + "UpdateCryptoKeyVersion", version},
+		{http.MethodPost, version + ":destroy", kmsService + "DestroyCryptoKeyVersion", version},
+		{http.MethodPost, version + ":restore", kmsService + "RestoreCryptoKeyVersion", version},
+		{http.MethodGet, version + "/publicKey", kmsService + "GetPublicKey", version},
+		{http.MethodPost, version + ":encrypt", kmsService + "Encrypt", version},
+		{http.MethodPost, version + ":asymmetricSign", kmsService + "AsymmetricSign", version},
+		{http.MethodPost, version + ":asymmetricDecrypt", kmsService + "AsymmetricDecrypt", version},
+		{http.MethodPost, version + ":macSign", kmsService + "MacSign", version},
+		{http.MethodPost, version + ":macVerify", kmsService + "MacVerify", version},
+
+		{http.MethodGet, keyRing + ":getIamPolicy", iamService + "GetIamPolicy", keyRing},
+		{http.MethodPost, keyRing + ":setIamPolicy", iamService + "SetIamPolicy", keyRing},
+		{http.MethodPost, keyRing + ":testIamPermissions", iamService + "TestIamPermissions", keyRing},
+		{http.MethodGet, key + ":getIamPolicy", iamService + "GetIamPolicy", key},
+		{http.MethodPost, key + ":setIamPolicy", iamService + "SetIamPolicy", key},
+		{http.MethodPost, key + ":testIamPermissions", iamService + "TestIamPermissions", key},
+		{http.MethodGet, keyRing + "/importJobs/j:getIamPolicy", iamService + "GetIamPolicy", keyRing + "/importJobs/j"},
+		{http.MethodPost, keyRing + "/importJobs/j:setIamPolicy", iamService + "SetIamPolicy", keyRing + "/importJobs/j"},
+		{http.MethodPost, keyRing + "/importJobs/j:testIamPermissions", iamService + "TestIamPermissions", keyRing + "/importJobs/j"},
+
+		// IDs containing colons and route keywords
+		{http.MethodGet, keyRing + "/cryptoKeys/a:b", kmsService + "GetCryptoKey", keyRing + "/cryptoKeys/a:b"},
+		{http.MethodPost, keyRing + "/cryptoKeys/a:b:encrypt", kmsService + "Encrypt", keyRing + "/cryptoKeys/a:b"},
+		{http.MethodGet, location + "/keyRings/cryptoKeys", kmsService + "GetKeyRing", location + "/keyRings/cryptoKeys"},
+		{http.MethodGet, keyRing + "/cryptoKeys/publicKey", kmsService + "GetCryptoKey", keyRing + "/cryptoKeys/publicKey"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rt, name, allowed := matchRoute(tt.method, tt.path)
+			if rt == nil {
+				t.Fatalf("No route matched (allowed %v)", allowed)
+			}
+			if rt.rpc != tt.rpc || name != tt.name {
+				t.Errorf("Got %s on %q, want %s on %q", rt.rpc, name, tt.rpc, tt.name)
+			}
+		})
+	}
+
+	// Every route in the table is covered above
+	for _, rt := range routes {
+		if !slices.ContainsFunc(tests, func(tt test) bool { return tt.rpc == rt.rpc }) {
+			t.Errorf("No test for %s %s", rt.method, rt.path)
+		}
+	}
+}
+
+func TestMatchRouteErrors(t *testing.T) {
+	const key = "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+
+	tests := []struct {
+		method, path string
+		allowed      []string
+	}{
+		// A verb route takes precedence over reading the verb as part of the ID
+		{http.MethodGet, key + ":encrypt", []string{http.MethodPost}},
+		{http.MethodDelete, key, []string{http.MethodGet, http.MethodPatch}},
+		{http.MethodPut, "projects/p/locations/global/keyRings", []string{http.MethodGet, http.MethodPost}},
+		{http.MethodGet, "projects/p", nil},
+		{http.MethodGet, "projects//locations", nil},
+		{http.MethodGet, key + "/cryptoKeyVersions/1/privateKey", nil},
+		{http.MethodGet, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rt, _, allowed := matchRoute(tt.method, tt.path)
+			if rt != nil {
+				t.Fatalf("Expected no match, got %s", rt.rpc)
+			}
+			if !slices.Equal(allowed, tt.allowed) {
+				t.Errorf("Allowed %v, want %v", allowed, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestMethodNotAllowedSetsAllow(t *testing.T) {
+	s, err := NewServer("passthrough:///unused")
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	defer s.Stop(t.Context())
+
+	rec := httptest.NewRecorder()
+	s.handleRequest(rec, httptest.NewRequest(http.MethodGet, "/v1/projects/p/locations/global/keyRings/r/cryptoKeys/k:encrypt", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected 405, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if allow := rec.Header().Get("Allow"); allow != http.MethodPost {
+		t.Errorf("Expected Allow: POST, got %q", allow)
+	}
+}
+
+// fuzzMethods are the methods the fuzz targets pick from
+var fuzzMethods = []string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodPut, http.MethodDelete}
+
+func FuzzMatchRoute(f *testing.F) {
+	const key = "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+	for _, path := range []string{
+		"", "projects/p/locations", key, key + ":encrypt", key + "/cryptoKeyVersions/1:macVerify",
+		key + "/cryptoKeyVersions:import", "projects//locations", key + ":", ":encrypt", "/", "a:b:c",
+		"projects/p/locations/global/keyRings/cryptoKeys", key + "/cryptoKeyVersions/1/publicKey/",
+	} {
+		f.Add(uint8(0), path)
+		f.Add(uint8(1), path)
+	}
+	f.Fuzz(func(t *testing.T, m uint8, path string) {
+		method := fuzzMethods[int(m)%len(fuzzMethods)]
+		rt, name, allowed := matchRoute(method, path)
+		if rt == nil {
+			if slices.Contains(allowed, method) || !slices.IsSorted(allowed) {
+				t.Fatalf("%s %q: unexpected allowed methods %v", method, path, allowed)
+			}
+			return
+		}
+		if rt.method != method {
+			t.Fatalf("%s %q: matched a %s route", method, path, rt.method)
+		}
+		if _, ok := rt.match(path); !ok {
+			t.Fatalf("%s %q: matched %s, which does not fit the path", method, path, rt.path)
+		}
+		// Resource names are the path up to the collection or verb, with
+		// no empty segments
+		if !strings.HasPrefix(path, name) || slices.Contains(strings.Split(name, "/"), "") {
+			t.Fatalf("%s %q: invalid resource name %q", method, path, name)
+		}
+	})
+}
+
+func FuzzHandleRequest(f *testing.F) {
+	const key = "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+	f.Add(uint8(1), "projects/p/locations/global/keyRings", "keyRingId=r", []byte(`{}`))
+	f.Add(uint8(1), "projects/p/locations/global/keyRings/r/cryptoKeys", "cryptoKeyId=k", []byte(`{"purpose":"ENCRYPT_DECRYPT"}`))
+	f.Add(uint8(1), key+":encrypt", "", []byte(`{"plaintext":"aGVsbG8="}`))
+	f.Add(uint8(1), key+":decrypt", "", []byte(`{"ciphertext":"AAAA"}`))
+	f.Add(uint8(0), "projects/p/locations/global/keyRings/r/cryptoKeys", "pageSize=-1&pageToken=x&filter=%", []byte(nil))
+	f.Add(uint8(2), key, "updateMask=labels,,", []byte(`{"labels":{"a":1}}`))
+	f.Add(uint8(0), key+"/cryptoKeyVersions/1/publicKey", "", []byte(nil))
+	f.Add(uint8(1), key+"/cryptoKeyVersions/x:macVerify", "", []byte(`{"data":"!!","mac":null}`))
+	f.Add(uint8(1), "projects/p/locations/global:generateRandomBytes", "", []byte(`{"lengthBytes":1e9}`))
+	f.Add(uint8(3), "projects/p%2Fq", "", []byte(`[`))
+
+	s := newTestGateway(f)
+	f.Fuzz(func(t *testing.T, m uint8, path, query string, body []byte) {
+		req := httptest.NewRequest(fuzzMethods[int(m)%len(fuzzMethods)], "/v1/", bytes.NewReader(body))
+		req.URL.Path = "/v1/" + path
+		req.URL.RawQuery = query
+		rec := httptest.NewRecorder()
+		s.handleRequest(rec, req)
+
+		if !json.Valid(rec.Body.Bytes()) {
+			t.Fatalf("%s %q: status %d with invalid JSON %q", req.Method, path, rec.Code, rec.Body.String())
+		}
+		if rec.Code >= http.StatusInternalServerError {
+			t.Fatalf("%s %q: status %d: %s", req.Method, path, rec.Code, rec.Body.String())
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package gateway
+
+import (
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/principal"
+)
+
+// systemParameters are the query parameters every Google REST API accepts
+// besides the method's own, as listed in the discovery document. gcloud
+// sends alt=json on every call.
+var systemParameters = map[string]map[string]any{
+	"$.xgafv":      {"type": "string", "enum": []string{"1", "2"}, "description": "V1 error format."},
+	"access_token": {"type": "string", "description": "OAuth access token."},
+	"alt":          {"type": "string", "enum": []string{"json"}, "default": "json", "description": "Data format for response."},
+	"fields":       {"type": "string", "description": "Selector specifying which fields to include in a partial response."},
+	"key":          {"type": "string", "description": "API key. Accepted and ignored."},
+	"prettyPrint":  {"type": "boolean", "default": "true", "description": "Returns response with indentations and line breaks. Accepted and ignored."},
+	"quotaUser":    {"type": "string", "description": "Available to use for quota purposes. Accepted and ignored."},
+}
+
+// withSystemParameters handles the system parameters of /v1 requests:
+//   - alt must be json, the only format the gateway writes
+//   - $.xgafv must be 1 or 2; both get the error format of writeError
+//   - access_token is used as a Bearer token when there is no Authorization
+//     header, as Google APIs do
+//
+// prettyPrint, key and quotaUser are accepted and ignored; fields is
+// handled by withPartialResponse.
+func withSystemParameters(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if alt := query.Get("alt"); alt != "" && alt != "json" {
+			writeError(w, codes.InvalidArgument, "Unsupported value for alt: %q; the emulator only returns json", alt)
+			return
+		}
+		if xgafv := query.Get("$.xgafv"); xgafv != "" && xgafv != "1" && xgafv != "2" {
+			writeError(w, codes.InvalidArgument, "Invalid value for $.xgafv: %q", xgafv)
+			return
+		}
+		if token := query.Get("access_token"); token != "" && r.Header.Get(principal.AuthorizationHeader) == "" {
+			r = r.Clone(r.Context())
+			r.Header.Set(principal.AuthorizationHeader, "Bearer "+token)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
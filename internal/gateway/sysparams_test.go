@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSystemParameters(t *testing.T) {
+	var authorization string
+	handler := withSystemParameters(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	serve := func(query string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v1/projects/p/locations?"+query, nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rec := httptest.NewRecorder()
+		authorization = ""
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, query := range []string{"alt=json", "$.xgafv=2&alt=json&prettyPrint=false", "key=abc&quotaUser=u"} {
+		if rec := serve(query); rec.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d: %s", query, rec.Code, rec.Body.String())
+		}
+	}
+	for _, query := range []string{"alt=proto", "alt=media", "$.xgafv=3"} {
+		if rec := serve(query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d: %s", query, rec.Code, rec.Body.String())
+		}
+	}
+
+	// access_token stands in for a missing Authorization header only
+	serve("access_token=tok")
+	if authorization != "Bearer tok" {
+		t.Errorf("Expected access_token as a Bearer token, got %q", authorization)
+	}
+	serve("access_token=tok", "Authorization", "Bearer header")
+	if authorization != "Bearer header" {
+		t.Errorf("Expected the Authorization header to win, got %q", authorization)
+	}
+}
+
+// TestGcloudRequests replays the requests gcloud kms sends with
+// CLOUDSDK_API_ENDPOINT_OVERRIDES_CLOUDKMS pointing at the gateway
+func TestGcloudRequests(t *testing.T) {
+	s := newTestGateway(t)
+	handler := s.newHTTPServer("").Handler
+	serve := func(method, path, body string) map[string]any {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		if rec.Code/100 != 2 {
+			t.Fatalf("%s %s: expected success, got %d: %s", method, path, rec.Code, rec.Body.String())
+		}
+		var resp map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s %s: invalid JSON: %v", method, path, err)
+		}
+		return resp
+	}
+	const location = "/v1/projects/p/locations/global"
+
+	// gcloud kms locations list
+	if resp := serve(http.MethodGet, "/v1/projects/p/locations?alt=json&pageSize=100", ""); len(resp["locations"].([]any)) == 0 {
+		t.Errorf("Expected locations, got %v", resp)
+	}
+	// gcloud kms keyrings create r --location global
+	serve(http.MethodPost, location+"/keyRings?alt=json&keyRingId=r", "{}")
+	// gcloud kms keyrings list --location global
+	if resp := serve(http.MethodGet, location+"/keyRings?alt=json&pageSize=100", ""); len(resp["keyRings"].([]any)) != 1 {
+		t.Errorf("Expected one key ring, got %v", resp)
+	}
+	// gcloud kms keys create k --purpose encryption --rotation-period ...
+	serve(http.MethodPost, location+"/keyRings/r/cryptoKeys?alt=json&cryptoKeyId=k",
+		`{"purpose": "ENCRYPT_DECRYPT", "rotationPeriod": "7776000s", "nextRotationTime": "2030-01-01T00:00:00Z", "versionTemplate": {"protectionLevel": "SOFTWARE", "algorithm": "GOOGLE_SYMMETRIC_ENCRYPTION"}, "labels": {"env": "test"}}`)
+	// gcloud kms encrypt, with the checksums gcloud always sends
+	resp := serve(http.MethodPost, location+"/keyRings/r/cryptoKeys/k:encrypt?alt=json",
+		`{"plaintext": "aGVsbG8=", "plaintextCrc32c": "2591144780", "additionalAuthenticatedData": "", "additionalAuthenticatedDataCrc32c": "0"}`)
+	if resp["verifiedPlaintextCrc32c"] != true {
+		t.Errorf("Expected a verified plaintext checksum, got %v", resp)
+	}
+	// gcloud kms keys versions list --key k --keyring r --location global
+	if resp := serve(http.MethodGet, location+"/keyRings/r/cryptoKeys/k/cryptoKeyVersions?alt=json&pageSize=100", ""); len(resp["cryptoKeyVersions"].([]any)) != 1 {
+		t.Errorf("Expected one version, got %v", resp)
+	}
+}
@@ -0,0 +1,171 @@
+// Package golden checks the emulator against a corpus of sanitized Cloud KMS
+// responses.
+//
+// The corpus in testdata holds one recording per conformance scenario, in the
+// format of the recording package. The corpus test replays each against a
+// fresh emulator and compares the responses structurally: every field must be
+// present on both sides with the same value, except fields that differ on
+// every call, such as ciphertexts, checksums and timestamps, which only need
+// to be present. This catches fields the emulator stops populating, or
+// populates differently, which status codes alone do not show.
+//
+// The corpus is refreshed from a real project with the capture test (see the
+// README). Captured recordings are sanitized: besides the plaintext the
+// recorder strips, the project and key ring IDs are replaced with fixed ones.
+package golden
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/recording"
+)
+
+// Project and KeyRing replace the project and key ring IDs of captured
+// recordings
+const (
+	Project = "golden-project"
+	KeyRing = "golden"
+)
+
+// volatileFields hold values that differ between calls, so only their
+// presence is compared. Plaintext checksums are volatile too, since replays
+// encrypt zero bytes in place of the redacted plaintext.
+var volatileFields = map[string]bool{
+	"createTime":        true,
+	"generateTime":      true,
+	"destroyTime":       true,
+	"destroyEventTime":  true,
+	"nextRotationTime":  true,
+	"ciphertext":        true,
+	"ciphertextCrc32c":  true,
+	"plaintextCrc32c":   true,
+	"signature":         true,
+	"signatureCrc32c":   true,
+	"mac":               true,
+	"macCrc32c":         true,
+	"pem":               true,
+	"pemCrc32c":         true,
+	"data":              true,
+	"dataCrc32c":        true,
+	"attestation":       true,
+	"publicKey":         true,
+	"wrappingPublicKey": true,
+}
+
+// Difference is a field whose recorded and replayed values differ. A missing
+// field has the value "<unset>".
+type Difference struct {
+	Field              string
+	Recorded, Replayed string
+}
+
+// Compare compares a recorded protojson response with a replayed one
+func Compare(recorded, replayed json.RawMessage) ([]Difference, error) {
+	var r, p any
+	if err := unmarshal(recorded, &r); err != nil {
+		return nil, fmt.Errorf("invalid recorded response: %w", err)
+	}
+	if err := unmarshal(replayed, &p); err != nil {
+		return nil, fmt.Errorf("invalid replayed response: %w", err)
+	}
+	var diffs []Difference
+	compare("", r, p, &diffs)
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Field < diffs[j].Field })
+	return diffs, nil
+}
+
+func unmarshal(data json.RawMessage, v *any) error {
+	if len(data) == 0 {
+		*v = map[string]any{}
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+func compare(path string, recorded, replayed any, diffs *[]Difference) {
+	switch r := recorded.(type) {
+	case map[string]any:
+		p, ok := replayed.(map[string]any)
+		if !ok {
+			*diffs = append(*diffs, Difference{Field: path, Recorded: "object", Replayed: valueString(replayed)})
+			return
+		}
+		keys := make(map[string]bool)
+		for k := range r {
+			keys[k] = true
+		}
+		for k := range p {
+			keys[k] = true
+		}
+		for k := range keys {
+			field := k
+			if path != "" {
+				field = path + "." + k
+			}
+			rv, rok := r[k]
+			pv, pok := p[k]
+			switch {
+			case !rok:
+				*diffs = append(*diffs, Difference{Field: field, Recorded: "<unset>", Replayed: valueString(pv)})
+			case !pok:
+				*diffs = append(*diffs, Difference{Field: field, Recorded: valueString(rv), Replayed: "<unset>"})
+			case !volatileFields[k]:
+				compare(field, rv, pv, diffs)
+			}
+		}
+	case []any:
+		p, ok := replayed.([]any)
+		if !ok || len(p) != len(r) {
+			*diffs = append(*diffs, Difference{Field: path, Recorded: valueString(recorded), Replayed: valueString(replayed)})
+			return
+		}
+		for i := range r {
+			compare(fmt.Sprintf("%s[%d]", path, i), r[i], p[i], diffs)
+		}
+	default:
+		if valueString(recorded) != valueString(replayed) {
+			*diffs = append(*diffs, Difference{Field: path, Recorded: valueString(recorded), Replayed: valueString(replayed)})
+		}
+	}
+}
+
+func valueString(v any) string {
+	switch v := v.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return fmt.Sprintf("list of %d", len(v))
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// Sanitize replaces the project and key ring IDs of records captured from
+// Cloud KMS with Project and KeyRing, and drops the calls that polled for
+// asymmetric versions being generated, which the emulator creates at once.
+// The key ring ID is replaced wherever it appears, so it should be unique,
+// such as one with a timestamp.
+func Sanitize(records []recording.Record, project, keyRing string) []recording.Record {
+	r := strings.NewReplacer(
+		"projects/"+project+"/", "projects/"+Project+"/",
+		keyRing, KeyRing,
+	)
+	out := make([]recording.Record, 0, len(records))
+	for _, rec := range records {
+		if strings.HasSuffix(rec.Method, "/GetCryptoKeyVersion") && strings.Contains(string(rec.Response), `"PENDING_GENERATION"`) {
+			continue
+		}
+		rec.Principal = ""
+		rec.Request = json.RawMessage(r.Replace(string(rec.Request)))
+		if rec.Response != nil {
+			rec.Response = json.RawMessage(r.Replace(string(rec.Response)))
+		}
+		rec.Message = r.Replace(rec.Message)
+		out = append(out, rec)
+	}
+	return out
+}
@@ -0,0 +1,237 @@
+package golden
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/conformance"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/proxy"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/recording"
+	"github.com/blackwell-systems/gcp-kms-emulator/pkg/emulator"
+)
+
+// knownDifferences are differences from Cloud KMS the emulator has not fixed
+// yet, keyed by method and field (list indices as []) or recorded status code,
+// with the reason. Remove entries as they are fixed.
+var knownDifferences = func() map[string]string {
+	m := make(map[string]string)
+	add := func(reason string, keys ...string) {
+		for _, k := range keys {
+			m[k] = reason
+		}
+	}
+	add("keys lack the default version template and destroy scheduled duration",
+		"CreateCryptoKey versionTemplate", "CreateCryptoKey versionTemplate.protectionLevel", "CreateCryptoKey destroyScheduledDuration",
+		"GetCryptoKey versionTemplate", "GetCryptoKey destroyScheduledDuration",
+		"UpdateCryptoKeyPrimaryVersion versionTemplate", "UpdateCryptoKeyPrimaryVersion destroyScheduledDuration")
+	add("replay recomputes the checksum of the redacted plaintext, correcting the wrong one", "Encrypt INVALID_ARGUMENT")
+	return m
+}()
+
+// listIndex matches the list indices of difference fields
+var listIndex = regexp.MustCompile(`\[\d+\]`)
+
+// skippedScenarios are not captured, since they cannot be replayed
+var skippedScenarios = map[string]string{
+	"asymmetric decryption": "the ciphertext is encrypted outside KMS with the captured public key",
+}
+
+func TestCorpus(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("No corpus in testdata")
+	}
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".jsonl"), func(t *testing.T) {
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			records, err := recording.Read(f)
+			if err != nil {
+				t.Fatalf("Invalid recording: %v", err)
+			}
+
+			emu, err := emulator.Start(t.Context(), emulator.WithBufconn(), emulator.WithIAMMode("off"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer emu.Close()
+			conn, err := emu.Dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			results, err := recording.Replay(t.Context(), conn, records)
+			if err != nil {
+				t.Fatalf("Replay failed: %v", err)
+			}
+			for i, r := range results {
+				method := r.Method[strings.LastIndex(r.Method, "/")+1:]
+				if !r.Match() {
+					key := method + " " + r.Want
+					seen[key] = true
+					if _, ok := knownDifferences[key]; !ok {
+						t.Errorf("Call %d %s: Cloud KMS returned %s, the emulator %s: %s", i+1, method, r.Want, r.Got, r.Message)
+					}
+					continue
+				}
+				diffs, err := Compare(r.Recorded, r.Replayed)
+				if err != nil {
+					t.Fatalf("Call %d %s: %v", i+1, method, err)
+				}
+				for _, d := range diffs {
+					key := method + " " + listIndex.ReplaceAllString(d.Field, "[]")
+					seen[key] = true
+					if _, ok := knownDifferences[key]; !ok {
+						t.Errorf("Call %d %s: %s is %s in Cloud KMS, %s in the emulator", i+1, method, d.Field, d.Recorded, d.Replayed)
+					}
+				}
+			}
+		})
+	}
+	for key := range knownDifferences {
+		if !seen[key] {
+			t.Errorf("Known difference %q no longer occurs; remove it", key)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	recorded := []byte(`{"name": "k", "primary": {"state": "ENABLED", "createTime": "2024-01-01T00:00:00Z"},
+		"labels": {"a": "1"}, "ciphertext": "YQ==", "versions": [{"name": "v1"}]}`)
+	replayed := []byte(`{"name": "k", "primary": {"state": "DISABLED", "createTime": "2026-01-01T00:00:00Z"},
+		"ciphertext": "Yg==", "versions": [{"name": "v2"}], "purpose": "MAC"}`)
+	diffs, err := Compare(recorded, replayed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{labels object <unset>} {primary.state "ENABLED" "DISABLED"} {purpose <unset> "MAC"} {versions[0].name "v1" "v2"}]`
+	if got := fmt.Sprint(diffs); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	// Volatile fields must still be present
+	diffs, _ = Compare([]byte(`{"ciphertext": "YQ=="}`), nil)
+	if len(diffs) != 1 || diffs[0].Field != "ciphertext" {
+		t.Errorf("Expected a missing ciphertext, got %v", diffs)
+	}
+	if _, err := Compare([]byte(`{`), nil); err == nil {
+		t.Error("Expected an error for invalid JSON")
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	records := Sanitize([]recording.Record{
+		{
+			Method:    "/google.cloud.kms.v1.KeyManagementService/CreateKeyRing",
+			Principal: "user:me@example.com",
+			Request:   []byte(`{"parent":"projects/acme-42/locations/global","keyRingId":"golden-123-0"}`),
+			Response:  []byte(`{"name":"projects/acme-42/locations/global/keyRings/golden-123-0"}`),
+			Code:      "OK",
+		},
+		{
+			Method:   "/google.cloud.kms.v1.KeyManagementService/GetCryptoKeyVersion",
+			Request:  []byte(`{}`),
+			Response: []byte(`{"state":"PENDING_GENERATION"}`),
+			Code:     "OK",
+		},
+		{
+			Method:  "/google.cloud.kms.v1.KeyManagementService/GetKeyRing",
+			Request: []byte(`{}`),
+			Code:    "NOT_FOUND",
+			Message: "KeyRing projects/acme-42/locations/global/keyRings/golden-123-0-missing not found.",
+		},
+	}, "acme-42", "golden-123-0")
+
+	if len(records) != 2 {
+		t.Fatalf("Expected the polling call to be dropped, got %d records", len(records))
+	}
+	if got := string(records[0].Request) + string(records[0].Response) + records[1].Message + records[0].Principal; strings.Contains(got, "acme-42") ||
+		strings.Contains(got, "123") || strings.Contains(got, "example.com") {
+		t.Errorf("Expected the project, key ring and principal to be replaced, got %s", got)
+	}
+	if !strings.Contains(string(records[0].Response), "projects/golden-project/locations/global/keyRings/golden") {
+		t.Errorf("Unexpected response %s", records[0].Response)
+	}
+}
+
+// TestCapture refreshes the corpus from real Cloud KMS. Like the conformance
+// suite it needs Application Default Credentials and
+// GCP_KMS_CONFORMANCE_PROJECT, and only runs with GCP_KMS_GOLDEN_UPDATE=1.
+func TestCapture(t *testing.T) {
+	project := os.Getenv("GCP_KMS_CONFORMANCE_PROJECT")
+	if project == "" || os.Getenv("GCP_KMS_GOLDEN_UPDATE") != "1" {
+		t.Skip("Skipping corpus capture - GCP_KMS_CONFORMANCE_PROJECT and GCP_KMS_GOLDEN_UPDATE=1 not set")
+	}
+	location := os.Getenv("GCP_KMS_CONFORMANCE_LOCATION")
+	if location == "" {
+		location = "global"
+	}
+
+	ctx := t.Context()
+	var buf bytes.Buffer
+	conn, err := proxy.Dial(ctx, proxy.DefaultEndpoint, grpc.WithChainUnaryInterceptor(recording.NewRecorder(&buf).UnaryClientInterceptor()))
+	if err != nil {
+		t.Fatalf("Failed to connect to Cloud KMS: %v", err)
+	}
+	defer conn.Close()
+	client := kmspb.NewKeyManagementServiceClient(conn)
+
+	parent := "projects/" + project + "/locations/" + location
+	stamp := time.Now().Unix()
+	for i, scenario := range conformance.Scenarios {
+		if _, ok := skippedScenarios[scenario.Name]; ok {
+			continue
+		}
+		buf.Reset()
+		keyRingID := fmt.Sprintf("golden-%d-%d", stamp, i)
+		if err := captureScenario(ctx, client, scenario, parent, keyRingID); err != nil {
+			t.Fatalf("%s: %v", scenario.Name, err)
+		}
+		records, err := recording.Read(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		for _, rec := range Sanitize(records, project, keyRingID) {
+			line, err := json.Marshal(rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out.Write(append(line, '\n'))
+		}
+		path := filepath.Join("testdata", strings.ReplaceAll(strings.ToLower(scenario.Name), " ", "-")+".jsonl")
+		if err := os.WriteFile(path, out.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		conformance.Cleanup(ctx, client, parent+"/keyRings/"+keyRingID)
+	}
+}
+
+// captureScenario runs a scenario in a new key ring
+func captureScenario(ctx context.Context, client kmspb.KeyManagementServiceClient, scenario conformance.Scenario, parent, keyRingID string) error {
+	kr, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: parent, KeyRingId: keyRingID})
+	if err != nil {
+		return err
+	}
+	return scenario.Run(ctx, &conformance.Env{Client: client, Location: parent, KeyRing: kr.Name})
+}
@@ -0,0 +1,35 @@
+// Package hsm is a storage.KeyBackend that keeps key material in an HSM
+// through a PKCS#11 library, such as SoftHSM or a vendor's client library.
+//
+// The emulator keeps serving the Cloud KMS API and the keys' metadata; the
+// HSM generates each selected version's key and performs its encrypt,
+// decrypt, sign and MAC operations. Keys are token objects whose CKA_LABEL
+// and CKA_ID are the version name, so they survive emulator restarts when
+// the state file is kept. They are sensitive and not extractable.
+//
+// Mechanisms: CKM_AES_GCM, CKM_SHA*_HMAC, CKM_RSA_PKCS (over a DigestInfo),
+// CKM_RSA_PKCS_PSS, CKM_RSA_PKCS_OAEP, CKM_ECDSA and CKM_EDDSA. The backend
+// needs cgo; builds without it report an error from Open.
+package hsm
+
+import "github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+
+// Name is the storage.BackendLabel value that selects the backend
+const Name = "pkcs11"
+
+// Config selects the PKCS#11 token holding the keys
+type Config struct {
+	// Module is the path of the PKCS#11 library
+	Module string
+	// TokenLabel is the label of the token; empty picks the first token
+	TokenLabel string
+	// PIN logs in as the normal user; empty skips login
+	PIN string
+}
+
+// Backend is a storage.KeyBackend open on a PKCS#11 token
+type Backend interface {
+	storage.KeyBackend
+	// Close logs out and unloads the library
+	Close() error
+}
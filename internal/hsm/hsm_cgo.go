@@ -0,0 +1,504 @@
+//go:build cgo
+
+package hsm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/miekg/pkcs11"
+
+	kmspkcs11 "github.com/blackwell-systems/gcp-kms-emulator/internal/pkcs11"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+// Curve OIDs of CKA_EC_PARAMS
+var (
+	oidP256    = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidP384    = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+const (
+	gcmNonceSize = 12
+	gcmTagSize   = 16
+)
+
+// backend shares one session between all operations; PKCS#11 sessions
+// run one operation at a time, so mu serializes them
+type backend struct {
+	mu      sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+}
+
+// Open loads the PKCS#11 library and opens a session on its token
+func Open(cfg Config) (Backend, error) {
+	ctx := pkcs11.New(cfg.Module)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 library %s", cfg.Module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed to initialize PKCS#11 library %s: %w", cfg.Module, err)
+	}
+	b := &backend{ctx: ctx}
+	if err := b.open(cfg); err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *backend) open(cfg Config) error {
+	slots, err := b.ctx.GetSlotList(true)
+	if err != nil {
+		return fmt.Errorf("failed to list PKCS#11 slots: %w", err)
+	}
+	slot, found := uint(0), false
+	for _, id := range slots {
+		info, err := b.ctx.GetTokenInfo(id)
+		if err != nil {
+			return fmt.Errorf("failed to read PKCS#11 token of slot %d: %w", id, err)
+		}
+		if cfg.TokenLabel == "" || info.Label == cfg.TokenLabel {
+			slot, found = id, true
+			break
+		}
+	}
+	if !found {
+		if cfg.TokenLabel == "" {
+			return fmt.Errorf("PKCS#11 library %s has no token", cfg.Module)
+		}
+		return fmt.Errorf("PKCS#11 token %q not found", cfg.TokenLabel)
+	}
+
+	b.session, err = b.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return fmt.Errorf("failed to open PKCS#11 session: %w", err)
+	}
+	if cfg.PIN != "" {
+		if err := b.ctx.Login(b.session, pkcs11.CKU_USER, cfg.PIN); err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			return fmt.Errorf("failed to log in to PKCS#11 token: %w", err)
+		}
+	}
+	return nil
+}
+
+func (b *backend) Name() string { return Name }
+
+func (b *backend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ctx.Logout(b.session)
+	b.ctx.CloseSession(b.session)
+	err := b.ctx.Finalize()
+	b.ctx.Destroy()
+	return err
+}
+
+// GenerateKey creates a token key, or key pair, labelled name
+func (b *backend) GenerateKey(name string, spec storage.KeySpec) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, name),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(name)),
+	}
+	private := append([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+	}, id...)
+
+	var err error
+	switch {
+	case spec.Purpose == kmspb.CryptoKey_ENCRYPT_DECRYPT:
+		_, err = b.ctx.GenerateKey(b.session,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_GEN, nil)},
+			append(private,
+				pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+				pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+				pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, spec.KeyBytes),
+				pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+				pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true)))
+	case spec.Purpose == kmspb.CryptoKey_MAC:
+		_, err = b.ctx.GenerateKey(b.session,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_GENERIC_SECRET_KEY_GEN, nil)},
+			append(private,
+				pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+				pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_GENERIC_SECRET),
+				pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, spec.KeyBytes),
+				pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+				pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true)))
+	default:
+		decrypt := spec.Purpose == kmspb.CryptoKey_ASYMMETRIC_DECRYPT
+		public := append([]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, !decrypt),
+			pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, decrypt),
+		}, id...)
+		private = append(private,
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, !decrypt),
+			pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, decrypt))
+
+		var mech uint
+		switch {
+		case spec.RSABits > 0:
+			mech = pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN
+			public = append(public,
+				pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, spec.RSABits),
+				pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}))
+		case spec.Ed25519:
+			mech = kmspkcs11.CKM_EC_EDWARDS_KEY_PAIR_GEN
+			params, _ := asn1.Marshal(oidEd25519)
+			public = append(public, pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params))
+		case spec.Curve == elliptic.P256() || spec.Curve == elliptic.P384():
+			mech = pkcs11.CKM_EC_KEY_PAIR_GEN
+			oid := oidP256
+			if spec.Curve == elliptic.P384() {
+				oid = oidP384
+			}
+			params, _ := asn1.Marshal(oid)
+			public = append(public, pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params))
+		default:
+			return fmt.Errorf("unsupported key spec %+v", spec)
+		}
+		_, _, err = b.ctx.GenerateKeyPair(b.session,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(mech, nil)}, public, private)
+	}
+	return err
+}
+
+// find returns the handle of the object of class labelled name
+func (b *backend) find(name string, class uint) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(name)),
+	}
+	if err := b.ctx.FindObjectsInit(b.session, template); err != nil {
+		return 0, err
+	}
+	handles, _, err := b.ctx.FindObjects(b.session, 1)
+	if finalErr := b.ctx.FindObjectsFinal(b.session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(handles) == 0 {
+		return 0, fmt.Errorf("key %s not found in PKCS#11 token", name)
+	}
+	return handles[0], nil
+}
+
+// DestroyKey deletes every object labelled name
+func (b *backend) DestroyKey(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, class := range []uint{pkcs11.CKO_SECRET_KEY, pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY} {
+		if h, err := b.find(name, class); err == nil {
+			if err := b.ctx.DestroyObject(b.session, h); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *backend) Encrypt(name string, plaintext, aad []byte) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key, err := b.find(name, pkcs11.CKO_SECRET_KEY)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcmNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	params := pkcs11.NewGCMParams(nonce, aad, 8*gcmTagSize)
+	defer params.Free()
+	if err := b.ctx.EncryptInit(b.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_GCM, params)}, key); err != nil {
+		return nil, err
+	}
+	ciphertext, err := b.ctx.Encrypt(b.session, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return append(nonce, ciphertext...), nil
+}
+
+func (b *backend) Decrypt(name string, ciphertext, aad []byte) ([]byte, error) {
+	if len(ciphertext) < gcmNonceSize+gcmTagSize {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key, err := b.find(name, pkcs11.CKO_SECRET_KEY)
+	if err != nil {
+		return nil, err
+	}
+	params := pkcs11.NewGCMParams(ciphertext[:gcmNonceSize], aad, 8*gcmTagSize)
+	defer params.Free()
+	if err := b.ctx.DecryptInit(b.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_GCM, params)}, key); err != nil {
+		return nil, err
+	}
+	return b.ctx.Decrypt(b.session, ciphertext[gcmNonceSize:])
+}
+
+// hmacMechanisms maps MAC hashes to their PKCS#11 mechanisms
+var hmacMechanisms = map[crypto.Hash]uint{
+	crypto.SHA1:   pkcs11.CKM_SHA_1_HMAC,
+	crypto.SHA224: pkcs11.CKM_SHA224_HMAC,
+	crypto.SHA256: pkcs11.CKM_SHA256_HMAC,
+	crypto.SHA384: pkcs11.CKM_SHA384_HMAC,
+	crypto.SHA512: pkcs11.CKM_SHA512_HMAC,
+}
+
+func (b *backend) MAC(name string, hash crypto.Hash, data []byte) ([]byte, error) {
+	mech, ok := hmacMechanisms[hash]
+	if !ok {
+		return nil, fmt.Errorf("unsupported MAC hash %v", hash)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key, err := b.find(name, pkcs11.CKO_SECRET_KEY)
+	if err != nil {
+		return nil, err
+	}
+	return b.sign(key, pkcs11.NewMechanism(mech, nil), data)
+}
+
+// sign runs a single-part C_Sign. b.mu must be held.
+func (b *backend) sign(key pkcs11.ObjectHandle, mech *pkcs11.Mechanism, data []byte) ([]byte, error) {
+	if err := b.ctx.SignInit(b.session, []*pkcs11.Mechanism{mech}, key); err != nil {
+		return nil, err
+	}
+	return b.ctx.Sign(b.session, data)
+}
+
+// Signer returns the private key labelled name, with the public key read
+// from its public key object
+func (b *backend) Signer(name string) (crypto.Signer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	public, err := b.find(name, pkcs11.CKO_PUBLIC_KEY)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := b.ctx.GetAttributeValue(b.session, public, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var pub crypto.PublicKey
+	switch keyType := ulong(attrs[0].Value); keyType {
+	case pkcs11.CKK_RSA:
+		pub, err = b.rsaPublicKey(public)
+	case pkcs11.CKK_EC, kmspkcs11.CKK_EC_EDWARDS:
+		pub, err = b.ecPublicKey(public)
+	default:
+		err = fmt.Errorf("unsupported PKCS#11 key type %#x", keyType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key of %s: %w", name, err)
+	}
+
+	private, err := b.find(name, pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		return nil, err
+	}
+	return &signer{backend: b, key: private, public: pub}, nil
+}
+
+func (b *backend) rsaPublicKey(h pkcs11.ObjectHandle) (*rsa.PublicKey, error) {
+	attrs, err := b.ctx.GetAttributeValue(b.session, h, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(attrs[0].Value),
+		E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+	}, nil
+}
+
+func (b *backend) ecPublicKey(h pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	attrs, err := b.ctx.GetAttributeValue(b.session, h, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(attrs[0].Value, &oid); err != nil {
+		return nil, fmt.Errorf("invalid CKA_EC_PARAMS: %w", err)
+	}
+	// CKA_EC_POINT is a DER OCTET STRING, though some libraries return the
+	// bare point
+	point := attrs[1].Value
+	var inner []byte
+	if rest, err := asn1.Unmarshal(point, &inner); err == nil && len(rest) == 0 {
+		point = inner
+	}
+
+	var curve elliptic.Curve
+	switch {
+	case oid.Equal(oidEd25519):
+		if len(point) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 point")
+		}
+		return ed25519.PublicKey(point), nil
+	case oid.Equal(oidP256):
+		curve = elliptic.P256()
+	case oid.Equal(oidP384):
+		curve = elliptic.P384()
+	default:
+		return nil, fmt.Errorf("unsupported curve %v", oid)
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	if len(point) != 1+2*size || point[0] != 4 {
+		return nil, fmt.Errorf("invalid EC point")
+	}
+	return &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(point[1 : 1+size]),
+		Y:     new(big.Int).SetBytes(point[1+size:]),
+	}, nil
+}
+
+// ulong decodes a CK_ULONG attribute value
+func ulong(v []byte) uint {
+	if len(v) == 4 {
+		return uint(binary.NativeEndian.Uint32(v))
+	}
+	if len(v) != 8 {
+		return 0
+	}
+	return uint(binary.NativeEndian.Uint64(v))
+}
+
+// Hash mechanisms and MGFs of PSS and OAEP parameters
+var (
+	hashMechanisms = map[crypto.Hash]uint{
+		crypto.SHA1:   pkcs11.CKM_SHA_1,
+		crypto.SHA256: pkcs11.CKM_SHA256,
+		crypto.SHA384: pkcs11.CKM_SHA384,
+		crypto.SHA512: pkcs11.CKM_SHA512,
+	}
+	mgfs = map[crypto.Hash]uint{
+		crypto.SHA1:   pkcs11.CKG_MGF1_SHA1,
+		crypto.SHA256: pkcs11.CKG_MGF1_SHA256,
+		crypto.SHA384: pkcs11.CKG_MGF1_SHA384,
+		crypto.SHA512: pkcs11.CKG_MGF1_SHA512,
+	}
+)
+
+// signer is an HSM private key. RSA keys are also crypto.Decrypters.
+type signer struct {
+	backend *backend
+	key     pkcs11.ObjectHandle
+	public  crypto.PublicKey
+}
+
+func (s *signer) Public() crypto.PublicKey { return s.public }
+
+// Sign signs like the crypto/rsa, crypto/ecdsa and crypto/ed25519 keys do:
+// ECDSA signatures are ASN.1, and RSA keys sign a DigestInfo unless opts
+// has no hash
+func (s *signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash := opts.HashFunc()
+	var mech *pkcs11.Mechanism
+	data := digest
+	switch pub := s.public.(type) {
+	case ed25519.PublicKey:
+		mech = pkcs11.NewMechanism(kmspkcs11.CKM_EDDSA, nil)
+	case *ecdsa.PublicKey:
+		mech = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+	case *rsa.PublicKey:
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			salt := pss.SaltLength
+			if salt == rsa.PSSSaltLengthEqualsHash {
+				salt = hash.Size()
+			}
+			if salt < 0 || hashMechanisms[hash] == 0 {
+				return nil, fmt.Errorf("unsupported PSS options %+v", pss)
+			}
+			mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, pkcs11.NewPSSParams(hashMechanisms[hash], mgfs[hash], uint(salt)))
+			break
+		}
+		mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+		if hash != 0 {
+			data = kmspkcs11.DigestInfo(hash, digest)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+
+	s.backend.mu.Lock()
+	signature, err := s.backend.sign(s.key, mech, data)
+	s.backend.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	pub, ok := s.public.(*ecdsa.PublicKey)
+	if !ok {
+		return signature, nil
+	}
+	// PKCS#11 ECDSA signatures are r || s
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	if len(signature) != 2*size {
+		return nil, fmt.Errorf("invalid ECDSA signature length %d", len(signature))
+	}
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		new(big.Int).SetBytes(signature[:size]),
+		new(big.Int).SetBytes(signature[size:]),
+	})
+}
+
+// Decrypt decrypts RSA-OAEP ciphertexts
+func (s *signer) Decrypt(_ io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	oaep, ok := opts.(*rsa.OAEPOptions)
+	if !ok {
+		return nil, fmt.Errorf("unsupported decrypter options %T", opts)
+	}
+	mgfHash := oaep.MGFHash
+	if mgfHash == 0 {
+		mgfHash = oaep.Hash
+	}
+	if hashMechanisms[oaep.Hash] == 0 || mgfs[mgfHash] == 0 {
+		return nil, fmt.Errorf("unsupported OAEP hash %v", oaep.Hash)
+	}
+	params := pkcs11.NewOAEPParams(hashMechanisms[oaep.Hash], mgfs[mgfHash], pkcs11.CKZ_DATA_SPECIFIED, oaep.Label)
+
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	if err := s.backend.ctx.DecryptInit(s.backend.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, params)}, s.key); err != nil {
+		return nil, err
+	}
+	return s.backend.ctx.Decrypt(s.backend.session, ciphertext)
+}
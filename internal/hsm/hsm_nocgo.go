@@ -0,0 +1,10 @@
+//go:build !cgo
+
+package hsm
+
+import "fmt"
+
+// Open loads the PKCS#11 library and opens a session on its token
+func Open(cfg Config) (Backend, error) {
+	return nil, fmt.Errorf("the PKCS#11 key backend needs cgo; rebuild with CGO_ENABLED=1")
+}
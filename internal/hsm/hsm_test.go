@@ -0,0 +1,167 @@
+//go:build cgo
+
+package hsm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+const testRing = "projects/test/locations/global/keyRings/hsm-test"
+
+// openTestBackend opens the token named by GCP_KMS_TEST_PKCS11_TOKEN, e.g.
+// one created with softhsm2-util --init-token --free --label kms-test
+func openTestBackend(t *testing.T) *storage.Storage {
+	t.Helper()
+	module := os.Getenv("GCP_KMS_TEST_PKCS11_MODULE")
+	if module == "" {
+		t.Skip("Skipping PKCS#11 backend tests - GCP_KMS_TEST_PKCS11_MODULE not set")
+	}
+	backend, err := Open(Config{
+		Module:     module,
+		TokenLabel: os.Getenv("GCP_KMS_TEST_PKCS11_TOKEN"),
+		PIN:        os.Getenv("GCP_KMS_TEST_PKCS11_PIN"),
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { backend.Close() })
+
+	s := storage.NewStorage()
+	if err := s.SetKeyBackend(backend, []string{testRing + "/cryptoKeys/*"}); err != nil {
+		t.Fatalf("SetKeyBackend failed: %v", err)
+	}
+	if _, err := s.CreateKeyRing(testRing); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	return s
+}
+
+// createKey creates a key in the token and returns its first version,
+// destroying it when the test ends
+func createKey(t *testing.T, s *storage.Storage, id string, algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm) string {
+	t.Helper()
+	purpose, _ := storage.AlgorithmPurpose(algorithm)
+	key, err := s.CreateCryptoKey(testRing, id, purpose, &kmspb.CryptoKeyVersionTemplate{Algorithm: algorithm}, nil)
+	if err != nil {
+		t.Fatalf("CreateCryptoKey %s failed: %v", id, err)
+	}
+	version := key.Name + "/cryptoKeyVersions/1"
+	t.Cleanup(func() { s.DestroyCryptoKeyVersion(version) })
+	return version
+}
+
+func publicKey(t *testing.T, s *storage.Storage, version string) any {
+	t.Helper()
+	pub, err := s.GetPublicKey(version)
+	if err != nil {
+		t.Fatalf("GetPublicKey failed: %v", err)
+	}
+	block, _ := pem.Decode([]byte(pub.Pem))
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("ParsePKIXPublicKey failed: %v", err)
+	}
+	return key
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	s := openTestBackend(t)
+	createKey(t, s, "encrypt", kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION)
+
+	ciphertext, _, _, err := s.Encrypt(testRing+"/cryptoKeys/encrypt", []byte("secret"), []byte("aad"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	plaintext, _, _, err := s.Decrypt(testRing+"/cryptoKeys/encrypt", ciphertext, []byte("aad"))
+	if err != nil || string(plaintext) != "secret" {
+		t.Fatalf("Decrypt returned %q, %v", plaintext, err)
+	}
+	if _, _, _, err := s.Decrypt(testRing+"/cryptoKeys/encrypt", ciphertext, []byte("other")); err == nil {
+		t.Error("Expected Decrypt with the wrong AAD to fail")
+	}
+}
+
+func TestSign(t *testing.T) {
+	s := openTestBackend(t)
+	digest := sha256.Sum256([]byte("message"))
+	sha256Digest := &kmspb.Digest{Digest: &kmspb.Digest_Sha256{Sha256: digest[:]}}
+
+	tests := []struct {
+		id        string
+		algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm
+		verify    func(pub any, signature []byte) bool
+	}{
+		{"ec", kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256, func(pub any, sig []byte) bool {
+			return ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], sig)
+		}},
+		{"pkcs1", kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_2048_SHA256, func(pub any, sig []byte) bool {
+			return rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig) == nil
+		}},
+		{"pss", kmspb.CryptoKeyVersion_RSA_SIGN_PSS_2048_SHA256, func(pub any, sig []byte) bool {
+			return rsa.VerifyPSS(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			version := createKey(t, s, tt.id, tt.algorithm)
+			signature, _, err := s.AsymmetricSign(version, sha256Digest, nil)
+			if err != nil {
+				t.Fatalf("AsymmetricSign failed: %v", err)
+			}
+			if !tt.verify(publicKey(t, s, version), signature) {
+				t.Error("Signature does not verify")
+			}
+		})
+	}
+
+	t.Run("ed25519", func(t *testing.T) {
+		version := createKey(t, s, "ed25519", kmspb.CryptoKeyVersion_EC_SIGN_ED25519)
+		signature, _, err := s.AsymmetricSign(version, nil, []byte("message"))
+		if err != nil {
+			t.Skipf("Token does not sign with Ed25519: %v", err)
+		}
+		if !ed25519.Verify(publicKey(t, s, version).(ed25519.PublicKey), []byte("message"), signature) {
+			t.Error("Signature does not verify")
+		}
+	})
+}
+
+func TestAsymmetricDecrypt(t *testing.T) {
+	s := openTestBackend(t)
+	version := createKey(t, s, "decrypt", kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_2048_SHA256)
+
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey(t, s, version).(*rsa.PublicKey), []byte("secret"), nil)
+	if err != nil {
+		t.Fatalf("EncryptOAEP failed: %v", err)
+	}
+	plaintext, _, err := s.AsymmetricDecrypt(version, ciphertext)
+	if err != nil || string(plaintext) != "secret" {
+		t.Fatalf("AsymmetricDecrypt returned %q, %v", plaintext, err)
+	}
+}
+
+func TestMAC(t *testing.T) {
+	s := openTestBackend(t)
+	version := createKey(t, s, "mac", kmspb.CryptoKeyVersion_HMAC_SHA256)
+
+	tag, _, err := s.MacSign(version, []byte("data"))
+	if err != nil {
+		t.Fatalf("MacSign failed: %v", err)
+	}
+	if ok, _, err := s.MacVerify(version, []byte("data"), tag); err != nil || !ok {
+		t.Errorf("MacVerify returned %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,132 @@
+package k8skms
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/logging"
+)
+
+// DefaultSocket is the socket path of the plugin unless --listen is set
+const DefaultSocket = "/var/run/kmsplugin/socket.sock"
+
+// Main runs k8s-kms-plugin until SIGINT or SIGTERM and exits
+func Main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := Run(ctx, os.Args[1:], os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+// Run serves the plugin until ctx is done and returns its exit code
+func Run(ctx context.Context, args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("k8s-kms-plugin", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	listen := fs.String("listen", getEnv("K8S_KMS_PLUGIN_SOCKET", DefaultSocket), "Unix socket to serve the KMS v2 API on; the endpoint of the EncryptionConfiguration without unix://")
+	endpoint := fs.String("endpoint", getEnv("KMS_EMULATOR_HOST", "localhost:9090"), "gRPC address of the emulator")
+	key := fs.String("key", os.Getenv("K8S_KMS_PLUGIN_KEY"), "Crypto key to encrypt with (projects/.../cryptoKeys/...)")
+	createKey := fs.Bool("create-key", false, "Create the key ring and crypto key if they do not exist")
+	timeout := fs.Duration("timeout", 10*time.Second, "Deadline for creating the key at startup")
+	logLevel := fs.String("log-level", getEnv("GCP_KMS_LOG_LEVEL", "info"), "Log level (debug, info, warn, error); debug logs every call")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(stderr, "k8s-kms-plugin: unexpected arguments %q\n", fs.Args())
+		return 2
+	}
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintf(stderr, "k8s-kms-plugin: %v\n", err)
+		return 2
+	}
+	logger, _ := logging.New(stderr, level, "text")
+
+	conn, err := grpc.NewClient(*endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		fmt.Fprintf(stderr, "k8s-kms-plugin: failed to connect to %s: %v\n", *endpoint, err)
+		return 1
+	}
+	defer conn.Close()
+	plugin, err := New(conn, *key, logger)
+	if err != nil {
+		fmt.Fprintf(stderr, "k8s-kms-plugin: invalid --key: %v\n", err)
+		return 2
+	}
+	if *createKey {
+		createCtx, cancel := context.WithTimeout(ctx, *timeout)
+		err := plugin.EnsureKey(createCtx)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(stderr, "k8s-kms-plugin: %v\n", err)
+			return 1
+		}
+	}
+
+	lis, err := listenUnix(strings.TrimPrefix(*listen, "unix://"))
+	if err != nil {
+		fmt.Fprintf(stderr, "k8s-kms-plugin: %v\n", err)
+		return 1
+	}
+	server := grpc.NewServer()
+	plugin.Register(server)
+
+	errc := make(chan error, 1)
+	go func() { errc <- server.Serve(lis) }()
+	logger.Info("KMS plugin serving", "socket", lis.Addr().String(), "emulator", *endpoint, "key", *key)
+
+	select {
+	case err := <-errc:
+		fmt.Fprintf(stderr, "k8s-kms-plugin: %v\n", err)
+		return 1
+	case <-ctx.Done():
+		server.GracefulStop()
+		logger.Info("KMS plugin stopped")
+		return 0
+	}
+}
+
+// listenUnix listens on the socket at path, replacing a socket left behind
+// by an earlier run
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	return lis, nil
+}
+
+// getEnv returns the environment variable key, or def if it is unset
+func getEnv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,162 @@
+// Package k8skms bridges the Kubernetes KMS v2 plugin API to the emulator,
+// so kube-apiserver can encrypt Secrets at rest with an emulated crypto key.
+//
+// kube-apiserver calls the plugin over a Unix socket. Each Encrypt wraps a
+// data encryption key with the crypto key's primary version through the
+// emulator's Encrypt. The returned key ID is the name of that version, so
+// rotating the crypto key changes the key ID that Status reports and
+// kube-apiserver rewraps with the new primary. Decrypt sends ciphertexts back
+// to the emulator, which picks the version from the ciphertext.
+package k8skms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"strings"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	kmsapi "k8s.io/kms/apis/v2"
+)
+
+// APIVersion is the KMS plugin API version Status reports
+const APIVersion = "v2"
+
+// healthy is the Status healthz value kube-apiserver treats as healthy
+const healthy = "ok"
+
+// Plugin serves the Kubernetes KMS v2 API with one crypto key
+type Plugin struct {
+	kmsapi.UnimplementedKeyManagementServiceServer
+
+	kms    kmspb.KeyManagementServiceClient
+	key    string
+	logger *slog.Logger
+}
+
+// New returns a plugin encrypting with the crypto key named key on the
+// emulator at conn
+func New(conn grpc.ClientConnInterface, key string, logger *slog.Logger) (*Plugin, error) {
+	if _, _, err := parseKeyName(key); err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Plugin{kms: kmspb.NewKeyManagementServiceClient(conn), key: key, logger: logger}, nil
+}
+
+// Register registers the plugin with a gRPC server
+func (p *Plugin) Register(s *grpc.Server) {
+	kmsapi.RegisterKeyManagementServiceServer(s, p)
+}
+
+// Status reports the primary version as the key ID. The plugin is unhealthy
+// while the key cannot be read or its primary version is not enabled, with
+// the reason as healthz; kube-apiserver shows it in its own health checks.
+func (p *Plugin) Status(ctx context.Context, _ *kmsapi.StatusRequest) (*kmsapi.StatusResponse, error) {
+	resp := &kmsapi.StatusResponse{Version: APIVersion, Healthz: healthy, KeyId: p.key}
+	ck, err := p.kms.GetCryptoKey(ctx, &kmspb.GetCryptoKeyRequest{Name: p.key})
+	switch {
+	case err != nil:
+		resp.Healthz = fmt.Sprintf("failed to get crypto key %s: %v", p.key, status.Convert(err).Message())
+	case ck.Purpose != kmspb.CryptoKey_ENCRYPT_DECRYPT:
+		resp.Healthz = fmt.Sprintf("crypto key %s has purpose %s, expected ENCRYPT_DECRYPT", p.key, ck.Purpose)
+	case ck.Primary == nil:
+		resp.Healthz = fmt.Sprintf("crypto key %s has no primary version", p.key)
+	case ck.Primary.State != kmspb.CryptoKeyVersion_ENABLED:
+		resp.Healthz = fmt.Sprintf("primary version %s is %s", ck.Primary.Name, ck.Primary.State)
+		resp.KeyId = ck.Primary.Name
+	default:
+		resp.KeyId = ck.Primary.Name
+	}
+	if resp.Healthz != healthy {
+		p.logger.Warn("KMS plugin unhealthy", "healthz", resp.Healthz)
+	}
+	return resp, nil
+}
+
+// Encrypt wraps a data encryption key with the primary version
+func (p *Plugin) Encrypt(ctx context.Context, req *kmsapi.EncryptRequest) (*kmsapi.EncryptResponse, error) {
+	resp, err := p.kms.Encrypt(ctx, &kmspb.EncryptRequest{
+		Name:            p.key,
+		Plaintext:       req.Plaintext,
+		PlaintextCrc32C: checksum(req.Plaintext),
+	})
+	if err != nil {
+		p.logger.Debug("KMS plugin encrypt failed", "uid", req.Uid, "error", err)
+		return nil, err
+	}
+	if !resp.VerifiedPlaintextCrc32C || resp.CiphertextCrc32C.GetValue() != checksum(resp.Ciphertext).Value {
+		return nil, status.Error(codes.DataLoss, "checksum mismatch in Encrypt")
+	}
+	p.logger.Debug("KMS plugin encrypt", "uid", req.Uid, "keyId", resp.Name)
+	return &kmsapi.EncryptResponse{Ciphertext: resp.Ciphertext, KeyId: resp.Name}, nil
+}
+
+// Decrypt unwraps a data encryption key. The key ID must name a version of
+// the plugin's key, or the key itself.
+func (p *Plugin) Decrypt(ctx context.Context, req *kmsapi.DecryptRequest) (*kmsapi.DecryptResponse, error) {
+	if req.KeyId != p.key && !strings.HasPrefix(req.KeyId, p.key+"/cryptoKeyVersions/") {
+		return nil, status.Errorf(codes.InvalidArgument, "key ID %q is not a version of %s", req.KeyId, p.key)
+	}
+	resp, err := p.kms.Decrypt(ctx, &kmspb.DecryptRequest{
+		Name:             p.key,
+		Ciphertext:       req.Ciphertext,
+		CiphertextCrc32C: checksum(req.Ciphertext),
+	})
+	if err != nil {
+		p.logger.Debug("KMS plugin decrypt failed", "uid", req.Uid, "keyId", req.KeyId, "error", err)
+		return nil, err
+	}
+	if resp.PlaintextCrc32C.GetValue() != checksum(resp.Plaintext).Value {
+		return nil, status.Error(codes.DataLoss, "checksum mismatch in Decrypt")
+	}
+	p.logger.Debug("KMS plugin decrypt", "uid", req.Uid, "keyId", req.KeyId)
+	return &kmsapi.DecryptResponse{Plaintext: resp.Plaintext}, nil
+}
+
+// EnsureKey creates the plugin's key ring and an ENCRYPT_DECRYPT crypto key
+// if they do not exist, so a fresh emulator needs no setup
+func (p *Plugin) EnsureKey(ctx context.Context) error {
+	ring, id, _ := parseKeyName(p.key)
+	parent, ringID, _ := strings.Cut(ring, "/keyRings/")
+	_, err := p.kms.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: parent, KeyRingId: ringID})
+	if err != nil && status.Code(err) != codes.AlreadyExists {
+		return fmt.Errorf("failed to create key ring %s: %w", ring, err)
+	}
+	_, err = p.kms.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent:      ring,
+		CryptoKeyId: id,
+		CryptoKey:   &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT},
+	})
+	if err != nil && status.Code(err) != codes.AlreadyExists {
+		return fmt.Errorf("failed to create crypto key %s: %w", p.key, err)
+	}
+	return nil
+}
+
+// parseKeyName splits a crypto key name into its key ring name and key ID
+func parseKeyName(name string) (ring, id string, err error) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 8 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "keyRings" || parts[6] != "cryptoKeys" {
+		return "", "", errors.New("key must be projects/{project}/locations/{location}/keyRings/{keyRing}/cryptoKeys/{cryptoKey}, got " + name)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return "", "", errors.New("key has an empty segment: " + name)
+		}
+	}
+	return strings.Join(parts[:6], "/"), parts[7], nil
+}
+
+// checksum returns the CRC32C of data in the form KMS requests carry
+func checksum(data []byte) *wrapperspb.Int64Value {
+	return wrapperspb.Int64(int64(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))))
+}
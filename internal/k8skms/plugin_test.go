@@ -0,0 +1,207 @@
+package k8skms
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	kmsapi "k8s.io/kms/apis/v2"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/pkg/emulator"
+)
+
+const testKey = "projects/p/locations/global/keyRings/k8s/cryptoKeys/etcd"
+
+// newTestPlugin starts an emulator and returns a plugin for testKey, which it
+// creates, and a KMS client for the same emulator
+func newTestPlugin(t *testing.T) (*Plugin, kmspb.KeyManagementServiceClient) {
+	t.Helper()
+	emu, err := emulator.Start(context.Background(), emulator.WithBufconn(), emulator.WithIAMMode("off"))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(func() { emu.Close() })
+	conn, err := emu.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	plugin, err := New(conn, testKey, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := plugin.EnsureKey(context.Background()); err != nil {
+		t.Fatalf("EnsureKey failed: %v", err)
+	}
+	// A second call finds both resources
+	if err := plugin.EnsureKey(context.Background()); err != nil {
+		t.Fatalf("EnsureKey of an existing key failed: %v", err)
+	}
+	return plugin, kmspb.NewKeyManagementServiceClient(conn)
+}
+
+func TestPluginRotation(t *testing.T) {
+	ctx := context.Background()
+	plugin, kms := newTestPlugin(t)
+
+	st, err := plugin.Status(ctx, &kmsapi.StatusRequest{})
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if st.Version != "v2" || st.Healthz != "ok" || st.KeyId != testKey+"/cryptoKeyVersions/1" {
+		t.Fatalf("Unexpected status: %+v", st)
+	}
+
+	dek := []byte("a 32 byte data encryption key!!!")
+	enc, err := plugin.Encrypt(ctx, &kmsapi.EncryptRequest{Plaintext: dek, Uid: "1"})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if enc.KeyId != st.KeyId || len(enc.Ciphertext) >= 1024 {
+		t.Fatalf("Expected a ciphertext under 1 kB from %s, got %d bytes from %s", st.KeyId, len(enc.Ciphertext), enc.KeyId)
+	}
+
+	// Rotating changes the key ID, and the old ciphertext still decrypts
+	if _, err := kms.CreateCryptoKeyVersion(ctx, &kmspb.CreateCryptoKeyVersionRequest{Parent: testKey, CryptoKeyVersion: &kmspb.CryptoKeyVersion{}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kms.UpdateCryptoKeyPrimaryVersion(ctx, &kmspb.UpdateCryptoKeyPrimaryVersionRequest{Name: testKey, CryptoKeyVersionId: "2"}); err != nil {
+		t.Fatal(err)
+	}
+	st, err = plugin.Status(ctx, &kmsapi.StatusRequest{})
+	if err != nil || st.KeyId != testKey+"/cryptoKeyVersions/2" {
+		t.Fatalf("Expected version 2 after rotation, got %+v: %v", st, err)
+	}
+	dec, err := plugin.Decrypt(ctx, &kmsapi.DecryptRequest{Ciphertext: enc.Ciphertext, KeyId: enc.KeyId, Uid: "2"})
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if !bytes.Equal(dec.Plaintext, dek) {
+		t.Errorf("Decrypt returned %q, want %q", dec.Plaintext, dek)
+	}
+	enc2, err := plugin.Encrypt(ctx, &kmsapi.EncryptRequest{Plaintext: dek})
+	if err != nil || enc2.KeyId != st.KeyId {
+		t.Errorf("Expected Encrypt with version 2, got %v: %v", enc2, err)
+	}
+}
+
+func TestPluginErrors(t *testing.T) {
+	ctx := context.Background()
+	plugin, kms := newTestPlugin(t)
+
+	enc, err := plugin.Encrypt(ctx, &kmsapi.EncryptRequest{Plaintext: []byte("dek")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keyID := range []string{"projects/p/locations/global/keyRings/k8s/cryptoKeys/other/cryptoKeyVersions/1", testKey + "x/cryptoKeyVersions/1", ""} {
+		_, err := plugin.Decrypt(ctx, &kmsapi.DecryptRequest{Ciphertext: enc.Ciphertext, KeyId: keyID})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Decrypt with key ID %q: expected InvalidArgument, got %v", keyID, err)
+		}
+	}
+
+	// A disabled primary makes the plugin unhealthy and fails encryption
+	if _, err := kms.UpdateCryptoKeyVersion(ctx, &kmspb.UpdateCryptoKeyVersionRequest{
+		CryptoKeyVersion: &kmspb.CryptoKeyVersion{Name: testKey + "/cryptoKeyVersions/1", State: kmspb.CryptoKeyVersion_DISABLED},
+		UpdateMask:       &fieldmaskpb.FieldMask{Paths: []string{"state"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	st, err := plugin.Status(ctx, &kmsapi.StatusRequest{})
+	if err != nil || st.Healthz == "ok" || !strings.Contains(st.Healthz, "DISABLED") || st.KeyId == "" {
+		t.Errorf("Expected an unhealthy status naming the state, got %+v: %v", st, err)
+	}
+	if _, err := plugin.Encrypt(ctx, &kmsapi.EncryptRequest{Plaintext: []byte("dek")}); err == nil {
+		t.Error("Expected Encrypt with a disabled primary to fail")
+	}
+
+	missing := &Plugin{kms: kms, key: testKey + "-missing", logger: plugin.logger}
+	st, err = missing.Status(ctx, &kmsapi.StatusRequest{})
+	if err != nil || !strings.HasPrefix(st.Healthz, "failed to get crypto key") || st.KeyId != missing.key {
+		t.Errorf("Expected an unhealthy status for a missing key, got %+v: %v", st, err)
+	}
+}
+
+func TestNewInvalidKey(t *testing.T) {
+	for _, key := range []string{"", "projects/p/locations/global/keyRings/k8s", testKey + "/cryptoKeyVersions/1", "projects//locations/global/keyRings/k8s/cryptoKeys/etcd"} {
+		if _, err := New(nil, key, nil); err == nil {
+			t.Errorf("Expected an error for key %q", key)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	emu, err := emulator.Start(context.Background(), emulator.WithIAMMode("off"))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer emu.Close()
+
+	socket := filepath.Join(t.TempDir(), "kms.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	var stderr bytes.Buffer
+	done := make(chan int, 1)
+	go func() {
+		done <- Run(ctx, []string{"--listen", "unix://" + socket, "--endpoint", emu.Addr(), "--key", testKey, "--create-key"}, &stderr)
+	}()
+
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := kmsapi.NewKeyManagementServiceClient(conn)
+
+	// Wait for the socket, retrying while the plugin starts
+	var st *kmsapi.StatusResponse
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		callCtx, callCancel := context.WithTimeout(context.Background(), time.Second)
+		st, err = client.Status(callCtx, &kmsapi.StatusRequest{}, grpc.WaitForReady(true))
+		callCancel()
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil || st.Healthz != "ok" {
+		t.Fatalf("Expected a healthy plugin, got %+v: %v\n%s", st, err, stderr.String())
+	}
+	enc, err := client.Encrypt(context.Background(), &kmsapi.EncryptRequest{Plaintext: []byte("dek"), Uid: "uid"})
+	if err != nil {
+		t.Fatalf("Encrypt over the socket failed: %v", err)
+	}
+	dec, err := client.Decrypt(context.Background(), &kmsapi.DecryptRequest{Ciphertext: enc.Ciphertext, KeyId: enc.KeyId, Uid: "uid"})
+	if err != nil || string(dec.Plaintext) != "dek" {
+		t.Fatalf("Decrypt over the socket returned %v: %v", dec, err)
+	}
+
+	cancel()
+	select {
+	case code := <-done:
+		if code != 0 {
+			t.Errorf("Expected exit code 0, got %d: %s", code, stderr.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not stop after its context was cancelled")
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	for _, args := range [][]string{{"--key", "invalid"}, {"--key", testKey, "extra"}, {"--key", testKey, "--log-level", "loud"}} {
+		var stderr bytes.Buffer
+		if code := Run(context.Background(), args, &stderr); code != 2 {
+			t.Errorf("%q: expected exit code 2, got %d: %s", args, code, stderr.String())
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package kmsemu
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"text/tabwriter"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+// purposes maps gcloud --purpose values to key purposes
+var purposes = map[string]kmspb.CryptoKey_CryptoKeyPurpose{
+	"encryption":            kmspb.CryptoKey_ENCRYPT_DECRYPT,
+	"asymmetric-signing":    kmspb.CryptoKey_ASYMMETRIC_SIGN,
+	"asymmetric-encryption": kmspb.CryptoKey_ASYMMETRIC_DECRYPT,
+	"mac":                   kmspb.CryptoKey_MAC,
+}
+
+// parseAlgorithm accepts gcloud's spelling (ec-sign-p256-sha256) as well as
+// the enum name
+func parseAlgorithm(s string) (kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm, bool) {
+	value, ok := kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm_value[strings.ToUpper(strings.ReplaceAll(s, "-", "_"))]
+	return kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm(value), ok
+}
+
+func createKeyRing(c *cli, args []string) error {
+	positional, err := c.parse(args, 1)
+	if err != nil {
+		return err
+	}
+	name, err := c.keyRingName(positional[0])
+	if err != nil {
+		return err
+	}
+	parent, id, _ := strings.Cut(name, "/keyRings/")
+	if err := c.dial(); err != nil {
+		return err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	ring, err := c.client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: parent, KeyRingId: id})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stdout, ring.Name)
+	return nil
+}
+
+func createKey(c *cli, args []string) error {
+	purposeFlag := c.fs.String("purpose", "", "Key purpose: encryption, asymmetric-signing, asymmetric-encryption or mac")
+	algorithmFlag := c.fs.String("default-algorithm", "", "Algorithm of new versions, e.g. ec-sign-p256-sha256 (default google-symmetric-encryption for encryption keys)")
+	positional, err := c.parse(args, 1)
+	if err != nil {
+		return err
+	}
+	name, err := c.keyName(positional[0])
+	if err != nil {
+		return err
+	}
+
+	purpose, ok := purposes[*purposeFlag]
+	if !ok {
+		return usagef("--purpose must be one of encryption, asymmetric-signing, asymmetric-encryption or mac")
+	}
+	algorithm := kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION
+	switch {
+	case *algorithmFlag != "":
+		if algorithm, ok = parseAlgorithm(*algorithmFlag); !ok {
+			return usagef("unknown algorithm %q", *algorithmFlag)
+		}
+	case purpose != kmspb.CryptoKey_ENCRYPT_DECRYPT:
+		return usagef("--default-algorithm is required for %s keys", *purposeFlag)
+	}
+
+	parent, id, _ := strings.Cut(name, "/cryptoKeys/")
+	if err := c.dial(); err != nil {
+		return err
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	key, err := c.client.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent:      parent,
+		CryptoKeyId: id,
+		CryptoKey: &kmspb.CryptoKey{
+			Purpose:         purpose,
+			VersionTemplate: &kmspb.CryptoKeyVersionTemplate{Algorithm: algorithm},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stdout, key.Name)
+	return nil
+}
+
+func list(c *cli, args []string) error {
+	keyFlag := c.fs.String("key", "", "List the versions of this key")
+	if _, err := c.parse(args, 0); err != nil {
+		return err
+	}
+	if err := c.dial(); err != nil {
+		return err
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	switch {
+	case *keyFlag != "":
+		name, err := c.keyName(*keyFlag)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "NAME\tSTATE\tALGORITHM")
+		return listPages(ctx, func(ctx context.Context, token string) (string, error) {
+			resp, err := c.client.ListCryptoKeyVersions(ctx, &kmspb.ListCryptoKeyVersionsRequest{Parent: name, PageToken: token})
+			for _, v := range resp.GetCryptoKeyVersions() {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", v.Name, v.State, v.Algorithm)
+			}
+			return resp.GetNextPageToken(), err
+		})
+	case c.keyring != "":
+		name, err := c.keyRingName(c.keyring)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "NAME\tPURPOSE\tALGORITHM\tPRIMARY_STATE")
+		return listPages(ctx, func(ctx context.Context, token string) (string, error) {
+			resp, err := c.client.ListCryptoKeys(ctx, &kmspb.ListCryptoKeysRequest{Parent: name, PageToken: token})
+			for _, k := range resp.GetCryptoKeys() {
+				state := "-"
+				if k.Primary != nil {
+					state = k.Primary.State.String()
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", k.Name, k.Purpose, k.VersionTemplate.GetAlgorithm(), state)
+			}
+			return resp.GetNextPageToken(), err
+		})
+	default:
+		name, err := c.locationName()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "NAME")
+		return listPages(ctx, func(ctx context.Context, token string) (string, error) {
+			resp, err := c.client.ListKeyRings(ctx, &kmspb.ListKeyRingsRequest{Parent: name, PageToken: token})
+			for _, r := range resp.GetKeyRings() {
+				fmt.Fprintln(w, r.Name)
+			}
+			return resp.GetNextPageToken(), err
+		})
+	}
+}
+
+// listPages calls page until it returns no next page token
+func listPages(ctx context.Context, page func(ctx context.Context, token string) (string, error)) error {
+	token := ""
+	for {
+		next, err := page(ctx, token)
+		if err != nil || next == "" {
+			return err
+		}
+		token = next
+	}
+}
+
+func encrypt(c *cli, args []string) error {
+	keyFlag := c.fs.String("key", "", "Key ID or resource name")
+	plaintextFile := c.fs.String("plaintext-file", "", "File to encrypt, or - for stdin")
+	ciphertextFile := c.fs.String("ciphertext-file", "", "File to write the ciphertext to, or - for stdout")
+	aadFile := c.fs.String("additional-authenticated-data-file", "", "File with additional authenticated data")
+	if _, err := c.parse(args, 0); err != nil {
+		return err
+	}
+	name, err := c.keyName(*keyFlag)
+	if err != nil {
+		return err
+	}
+	plaintext, err := c.readInput(*plaintextFile, "plaintext-file")
+	if err != nil {
+		return err
+	}
+	var aad []byte
+	if *aadFile != "" {
+		if aad, err = c.readInput(*aadFile, "additional-authenticated-data-file"); err != nil {
+			return err
+		}
+	}
+	if *ciphertextFile == "" {
+		return usagef("--ciphertext-file is required")
+	}
+
+	if err := c.dial(); err != nil {
+		return err
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	resp, err := c.client.Encrypt(ctx, &kmspb.EncryptRequest{Name: name, Plaintext: plaintext, AdditionalAuthenticatedData: aad})
+	if err != nil {
+		return err
+	}
+	return c.writeOutput(*ciphertextFile, "ciphertext-file", resp.Ciphertext)
+}
+
+func decrypt(c *cli, args []string) error {
+	keyFlag := c.fs.String("key", "", "Key ID or resource name")
+	ciphertextFile := c.fs.String("ciphertext-file", "", "File to decrypt, or - for stdin")
+	plaintextFile := c.fs.String("plaintext-file", "", "File to write the plaintext to, or - for stdout")
+	aadFile := c.fs.String("additional-authenticated-data-file", "", "File with additional authenticated data")
+	if _, err := c.parse(args, 0); err != nil {
+		return err
+	}
+	name, err := c.keyName(*keyFlag)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := c.readInput(*ciphertextFile, "ciphertext-file")
+	if err != nil {
+		return err
+	}
+	var aad []byte
+	if *aadFile != "" {
+		if aad, err = c.readInput(*aadFile, "additional-authenticated-data-file"); err != nil {
+			return err
+		}
+	}
+	if *plaintextFile == "" {
+		return usagef("--plaintext-file is required")
+	}
+
+	if err := c.dial(); err != nil {
+		return err
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	resp, err := c.client.Decrypt(ctx, &kmspb.DecryptRequest{Name: name, Ciphertext: ciphertext, AdditionalAuthenticatedData: aad})
+	if err != nil {
+		return err
+	}
+	return c.writeOutput(*plaintextFile, "plaintext-file", resp.Plaintext)
+}
+
+// signingFlags are the flags of sign and verify
+type signingFlags struct {
+	key, version, inputFile, signatureFile *string
+}
+
+func (c *cli) signingFlags(signatureUsage string) signingFlags {
+	return signingFlags{
+		key:           c.fs.String("key", "", "Key ID or resource name"),
+		version:       c.fs.String("version", "", "Key version ID or resource name"),
+		inputFile:     c.fs.String("input-file", "", "File with the data, or - for stdin"),
+		signatureFile: c.fs.String("signature-file", "", signatureUsage),
+	}
+}
+
+// prepareSigning reads the input, connects and looks up the key version
+func (c *cli) prepareSigning(ctx context.Context, f signingFlags) (version *kmspb.CryptoKeyVersion, data []byte, err error) {
+	name, err := c.versionName(*f.key, *f.version)
+	if err != nil {
+		return nil, nil, err
+	}
+	if *f.signatureFile == "" {
+		return nil, nil, usagef("--signature-file is required")
+	}
+	if data, err = c.readInput(*f.inputFile, "input-file"); err != nil {
+		return nil, nil, err
+	}
+	if err := c.dial(); err != nil {
+		return nil, nil, err
+	}
+	version, err = c.client.GetCryptoKeyVersion(ctx, &kmspb.GetCryptoKeyVersionRequest{Name: name})
+	return version, data, err
+}
+
+func sign(c *cli, args []string) error {
+	f := c.signingFlags("File to write the signature or MAC tag to, or - for stdout")
+	if _, err := c.parse(args, 0); err != nil {
+		return err
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	version, data, err := c.prepareSigning(ctx, f)
+	if err != nil {
+		return err
+	}
+
+	var signature []byte
+	switch purpose, _ := storage.AlgorithmPurpose(version.Algorithm); purpose {
+	case kmspb.CryptoKey_MAC:
+		resp, err := c.client.MacSign(ctx, &kmspb.MacSignRequest{Name: version.Name, Data: data})
+		if err != nil {
+			return err
+		}
+		signature = resp.Mac
+	case kmspb.CryptoKey_ASYMMETRIC_SIGN:
+		resp, err := c.client.AsymmetricSign(ctx, &kmspb.AsymmetricSignRequest{Name: version.Name, Data: data})
+		if err != nil {
+			return err
+		}
+		signature = resp.Signature
+	default:
+		return fmt.Errorf("%s is not a signing or MAC key version", version.Name)
+	}
+	return c.writeOutput(*f.signatureFile, "signature-file", signature)
+}
+
+func verify(c *cli, args []string) error {
+	f := c.signingFlags("File with the signature or MAC tag")
+	if _, err := c.parse(args, 0); err != nil {
+		return err
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	version, data, err := c.prepareSigning(ctx, f)
+	if err != nil {
+		return err
+	}
+	signature, err := c.readInput(*f.signatureFile, "signature-file")
+	if err != nil {
+		return err
+	}
+
+	// Cloud KMS has no verify call for signatures; they are checked with the
+	// public key as clients would
+	switch purpose, _ := storage.AlgorithmPurpose(version.Algorithm); purpose {
+	case kmspb.CryptoKey_MAC:
+		resp, err := c.client.MacVerify(ctx, &kmspb.MacVerifyRequest{Name: version.Name, Data: data, Mac: signature})
+		if err != nil {
+			return err
+		}
+		if !resp.Success {
+			return fmt.Errorf("MAC verification failed")
+		}
+	case kmspb.CryptoKey_ASYMMETRIC_SIGN:
+		publicKey, err := c.client.GetPublicKey(ctx, &kmspb.GetPublicKeyRequest{Name: version.Name})
+		if err != nil {
+			return err
+		}
+		if err := storage.VerifySignature(version.Algorithm, publicKey.Pem, data, signature); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s is not a signing or MAC key version", version.Name)
+	}
+	fmt.Fprintln(c.stdout, "Verified OK")
+	return nil
+}
+
+func reset(c *cli, args []string) error {
+	positional, err := c.parseOptional(args, 0, 1)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+
+	url := c.adminEndpoint
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	url = strings.TrimSuffix(url, "/") + "/admin/reset"
+	if len(positional) == 1 {
+		// A key ring name resets one key ring, anything else a project
+		param := "project"
+		if strings.Contains(positional[0], "/keyRings/") {
+			param = "keyRing"
+		}
+		url += "?" + param + "=" + neturl.QueryEscape(positional[0])
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the admin API (is the emulator running with --admin-port?): %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("admin API returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Fprintln(c.stdout, "State reset")
+	return nil
+}
@@ -0,0 +1,292 @@
+// Package kmsemu implements kms-emu, a command line client for a running
+// emulator.
+//
+// Commands and flags follow gcloud kms, so scripts translate directly:
+//
+//	kms-emu create-keyring ring1 --location global
+//	kms-emu create-key key1 --keyring ring1 --purpose encryption
+//	echo -n secret | kms-emu encrypt --key key1 --keyring ring1 --plaintext-file - --ciphertext-file secret.enc
+//	kms-emu decrypt --key key1 --keyring ring1 --ciphertext-file secret.enc --plaintext-file -
+//
+// Files named - are read from stdin or written to stdout. Keys and key rings
+// can also be given as full resource names, in which case --project,
+// --location and --keyring are ignored.
+package kmsemu
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Exit codes
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// command is one kms-emu subcommand
+type command struct {
+	usage   string
+	summary string
+	run     func(c *cli, args []string) error
+}
+
+var commands = map[string]command{
+	"create-keyring": {"create-keyring KEYRING", "Create a key ring", createKeyRing},
+	"create-key":     {"create-key KEY --keyring KEYRING --purpose PURPOSE [--default-algorithm ALGORITHM]", "Create a crypto key", createKey},
+	"list":           {"list [--keyring KEYRING [--key KEY]]", "List key rings, keys in a key ring, or versions of a key", list},
+	"encrypt":        {"encrypt --key KEY --keyring KEYRING --plaintext-file FILE --ciphertext-file FILE", "Encrypt with a symmetric key", encrypt},
+	"decrypt":        {"decrypt --key KEY --keyring KEYRING --ciphertext-file FILE --plaintext-file FILE", "Decrypt with a symmetric key", decrypt},
+	"sign":           {"sign --key KEY --keyring KEYRING --version VERSION --input-file FILE --signature-file FILE", "Sign with an asymmetric signing or MAC key version", sign},
+	"verify":         {"verify --key KEY --keyring KEYRING --version VERSION --input-file FILE --signature-file FILE", "Verify a signature or MAC tag", verify},
+	"reset":          {"reset [PROJECT|KEY_RING] [--admin-endpoint HOST:PORT]", "Delete all emulator state, or one project's or key ring's (needs the admin API)", reset},
+}
+
+// usageError is reported with the command's usage line
+type usageError struct{ msg string }
+
+func (e usageError) Error() string { return e.msg }
+
+func usagef(format string, args ...any) error {
+	return usageError{fmt.Sprintf(format, args...)}
+}
+
+// cli holds the flags shared by every command and the connection they open
+type cli struct {
+	stdin          io.Reader
+	stdout, stderr io.Writer
+
+	fs            *flag.FlagSet
+	endpoint      string
+	adminEndpoint string
+	project       string
+	location      string
+	keyring       string
+	timeout       time.Duration
+
+	conn   *grpc.ClientConn
+	client kmspb.KeyManagementServiceClient
+}
+
+// Main runs kms-emu with the process arguments and exits
+func Main() {
+	os.Exit(Run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// Run runs one kms-emu command and returns its exit code
+func Run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage(stderr)
+		if len(args) == 0 {
+			return exitUsage
+		}
+		return exitOK
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "kms-emu: unknown command %q\n\n", args[0])
+		printUsage(stderr)
+		return exitUsage
+	}
+
+	c := &cli{stdin: stdin, stdout: stdout, stderr: stderr}
+	c.fs = flag.NewFlagSet(args[0], flag.ContinueOnError)
+	c.fs.SetOutput(io.Discard)
+	c.fs.StringVar(&c.endpoint, "endpoint", getEnv("KMS_EMU_ENDPOINT", getEnv("KMS_EMULATOR_HOST", "localhost:9090")), "Emulator gRPC address")
+	c.fs.StringVar(&c.adminEndpoint, "admin-endpoint", getEnv("KMS_EMU_ADMIN_ENDPOINT", "localhost:9091"), "Emulator admin API address")
+	c.fs.StringVar(&c.project, "project", getEnv("CLOUDSDK_CORE_PROJECT", ""), "Project ID")
+	c.fs.StringVar(&c.location, "location", "global", "Location of the key ring")
+	c.fs.StringVar(&c.keyring, "keyring", "", "Key ring ID or resource name")
+	c.fs.DurationVar(&c.timeout, "timeout", 30*time.Second, "Deadline for each call")
+	defer c.close()
+
+	err := cmd.run(c, args[1:])
+	var usage usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, flag.ErrHelp):
+		fmt.Fprintf(stderr, "Usage: kms-emu %s\n\nFlags:\n", cmd.usage)
+		c.fs.SetOutput(stderr)
+		c.fs.PrintDefaults()
+		return exitOK
+	case errors.As(err, &usage):
+		fmt.Fprintf(stderr, "kms-emu %s: %v\nUsage: kms-emu %s\n", args[0], err, cmd.usage)
+		return exitUsage
+	default:
+		if s, ok := status.FromError(err); ok {
+			err = fmt.Errorf("%s: %s", s.Code(), s.Message())
+		}
+		fmt.Fprintf(stderr, "kms-emu %s: %v\n", args[0], err)
+		return exitError
+	}
+}
+
+func printUsage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "Usage: kms-emu COMMAND [ARGS] [FLAGS]")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-16s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintln(w, "\nRun kms-emu COMMAND --help for the flags of a command.")
+}
+
+// parse parses the command's flags, which may come before or after its
+// positional arguments as they can with gcloud, and returns the positional
+// arguments
+func (c *cli) parse(args []string, positional int) ([]string, error) {
+	return c.parseOptional(args, positional, positional)
+}
+
+// parseOptional is parse for commands taking between least and most
+// positional arguments
+func (c *cli) parseOptional(args []string, least, most int) ([]string, error) {
+	var rest []string
+	for {
+		if err := c.fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
+			}
+			return nil, usageError{err.Error()}
+		}
+		if c.fs.NArg() == 0 {
+			break
+		}
+		rest = append(rest, c.fs.Arg(0))
+		args = c.fs.Args()[1:]
+	}
+	switch {
+	case least == most && len(rest) != least:
+		return nil, usagef("expected %d argument(s), got %d", least, len(rest))
+	case len(rest) < least || len(rest) > most:
+		return nil, usagef("expected %d to %d arguments, got %d", least, most, len(rest))
+	}
+	return rest, nil
+}
+
+// dial connects to the emulator's gRPC endpoint
+func (c *cli) dial() error {
+	conn, err := grpc.NewClient(c.endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", c.endpoint, err)
+	}
+	c.conn = conn
+	c.client = kmspb.NewKeyManagementServiceClient(conn)
+	return nil
+}
+
+func (c *cli) close() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// context returns a context bounded by --timeout
+func (c *cli) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), c.timeout)
+}
+
+// locationName returns the location resource name from --project and
+// --location
+func (c *cli) locationName() (string, error) {
+	if c.project == "" {
+		return "", usagef("--project is required (or set CLOUDSDK_CORE_PROJECT)")
+	}
+	return fmt.Sprintf("projects/%s/locations/%s", c.project, c.location), nil
+}
+
+// keyRingName resolves a key ring ID or resource name
+func (c *cli) keyRingName(id string) (string, error) {
+	if strings.HasPrefix(id, "projects/") {
+		return id, nil
+	}
+	if id == "" {
+		return "", usagef("--keyring is required")
+	}
+	location, err := c.locationName()
+	if err != nil {
+		return "", err
+	}
+	return location + "/keyRings/" + id, nil
+}
+
+// keyName resolves a key ID or resource name
+func (c *cli) keyName(id string) (string, error) {
+	if strings.HasPrefix(id, "projects/") {
+		return id, nil
+	}
+	if id == "" {
+		return "", usagef("--key is required")
+	}
+	ring, err := c.keyRingName(c.keyring)
+	if err != nil {
+		return "", err
+	}
+	return ring + "/cryptoKeys/" + id, nil
+}
+
+// versionName resolves a key version ID or resource name
+func (c *cli) versionName(key, version string) (string, error) {
+	if strings.HasPrefix(version, "projects/") {
+		return version, nil
+	}
+	if version == "" {
+		return "", usagef("--version is required")
+	}
+	name, err := c.keyName(key)
+	if err != nil {
+		return "", err
+	}
+	return name + "/cryptoKeyVersions/" + version, nil
+}
+
+// readInput reads a file, or stdin for -
+func (c *cli) readInput(path, flagName string) ([]byte, error) {
+	switch path {
+	case "":
+		return nil, usagef("--%s is required", flagName)
+	case "-":
+		return io.ReadAll(c.stdin)
+	default:
+		return os.ReadFile(path)
+	}
+}
+
+// writeOutput writes a file, or stdout for -
+func (c *cli) writeOutput(path, flagName string, data []byte) error {
+	switch path {
+	case "":
+		return usagef("--%s is required", flagName)
+	case "-":
+		_, err := c.stdout.Write(data)
+		return err
+	default:
+		return os.WriteFile(path, data, 0o600)
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,120 @@
+package kmsemu
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/pkg/emulator"
+)
+
+// kmsEmu runs a command against addr and returns its exit code and output
+func kmsEmu(addr, stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	args = append(args, "--endpoint", addr, "--project", "test")
+	code := Run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestWorkflow(t *testing.T) {
+	emu, err := emulator.Start(context.Background(), emulator.WithIAMMode("off"))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer emu.Close()
+	addr := emu.Addr()
+	dir := t.TempDir()
+
+	steps := []struct {
+		name   string
+		stdin  string
+		args   []string
+		stdout string
+	}{
+		{"create key ring", "", []string{"create-keyring", "ring1", "--location", "global"}, "projects/test/locations/global/keyRings/ring1\n"},
+		{"create key", "", []string{"create-key", "--keyring", "ring1", "key1", "--purpose", "encryption"}, "projects/test/locations/global/keyRings/ring1/cryptoKeys/key1\n"},
+		{"create signing key", "", []string{"create-key", "signer", "--keyring", "ring1", "--purpose", "asymmetric-signing", "--default-algorithm", "ec-sign-p256-sha256"}, "projects/test/locations/global/keyRings/ring1/cryptoKeys/signer\n"},
+		{"create MAC key", "", []string{"create-key", "mac", "--keyring", "ring1", "--purpose", "mac", "--default-algorithm", "HMAC_SHA256"}, "projects/test/locations/global/keyRings/ring1/cryptoKeys/mac\n"},
+		{"encrypt", "secret", []string{"encrypt", "--key", "key1", "--keyring", "ring1", "--plaintext-file", "-", "--ciphertext-file", filepath.Join(dir, "secret.enc")}, ""},
+		{"decrypt", "", []string{"decrypt", "--key", "projects/test/locations/global/keyRings/ring1/cryptoKeys/key1", "--ciphertext-file", filepath.Join(dir, "secret.enc"), "--plaintext-file", "-"}, "secret"},
+		{"sign", "document", []string{"sign", "--key", "signer", "--keyring", "ring1", "--version", "1", "--input-file", "-", "--signature-file", filepath.Join(dir, "doc.sig")}, ""},
+		{"verify", "document", []string{"verify", "--key", "signer", "--keyring", "ring1", "--version", "1", "--input-file", "-", "--signature-file", filepath.Join(dir, "doc.sig")}, "Verified OK\n"},
+		{"MAC sign", "document", []string{"sign", "--key", "mac", "--keyring", "ring1", "--version", "1", "--input-file", "-", "--signature-file", filepath.Join(dir, "doc.mac")}, ""},
+		{"MAC verify", "document", []string{"verify", "--key", "mac", "--keyring", "ring1", "--version", "1", "--input-file", "-", "--signature-file", filepath.Join(dir, "doc.mac")}, "Verified OK\n"},
+		{"list key rings", "", []string{"list"}, "NAME\nprojects/test/locations/global/keyRings/ring1\n"},
+	}
+	for _, step := range steps {
+		code, stdout, stderr := kmsEmu(addr, step.stdin, step.args...)
+		if code != exitOK {
+			t.Fatalf("%s: exit %d: %s", step.name, code, stderr)
+		}
+		if stdout != step.stdout {
+			t.Errorf("%s: stdout %q, want %q", step.name, stdout, step.stdout)
+		}
+	}
+
+	code, stdout, _ := kmsEmu(addr, "", "list", "--keyring", "ring1")
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if code != exitOK || len(lines) != 4 || strings.Join(strings.Fields(lines[3]), " ") != "projects/test/locations/global/keyRings/ring1/cryptoKeys/signer ASYMMETRIC_SIGN EC_SIGN_P256_SHA256 -" {
+		t.Errorf("Unexpected key listing (exit %d):\n%s", code, stdout)
+	}
+
+	if code, _, stderr := kmsEmu(addr, "tampered", "verify", "--key", "signer", "--keyring", "ring1", "--version", "1", "--input-file", "-", "--signature-file", filepath.Join(dir, "doc.sig")); code != exitError || !strings.Contains(stderr, "verification failed") {
+		t.Errorf("Expected verification of other data to fail, got exit %d: %s", code, stderr)
+	}
+	if code, _, stderr := kmsEmu(addr, "", "create-keyring", "ring1"); code != exitError || !strings.Contains(stderr, "AlreadyExists") {
+		t.Errorf("Expected AlreadyExists, got exit %d: %s", code, stderr)
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"unknown command", []string{"rotate"}, `unknown command "rotate"`},
+		{"missing argument", []string{"create-keyring"}, "expected 1 argument(s), got 0"},
+		{"missing purpose", []string{"create-key", "k", "--keyring", "r"}, "--purpose must be one of"},
+		{"missing algorithm", []string{"create-key", "k", "--keyring", "r", "--purpose", "mac"}, "--default-algorithm is required for mac keys"},
+		{"unknown algorithm", []string{"create-key", "k", "--keyring", "r", "--purpose", "mac", "--default-algorithm", "hmac-md5"}, `unknown algorithm "hmac-md5"`},
+		{"missing key ring", []string{"encrypt", "--key", "k", "--plaintext-file", "-", "--ciphertext-file", "-"}, "--keyring is required"},
+		{"unknown flag", []string{"list", "--bogus"}, "flag provided but not defined: -bogus"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, stderr := kmsEmu("localhost:0", "", tt.args...)
+			if code != exitUsage || !strings.Contains(stderr, tt.want) {
+				t.Errorf("Expected usage error %q, got exit %d: %s", tt.want, code, stderr)
+			}
+		})
+	}
+}
+
+func TestReset(t *testing.T) {
+	var got string
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Method + " " + r.URL.RequestURI()
+		w.Write([]byte(`{"status":"reset"}`))
+	}))
+	defer admin.Close()
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"reset"}, "POST /admin/reset"},
+		{[]string{"reset", "my-project"}, "POST /admin/reset?project=my-project"},
+		{[]string{"reset", "projects/p/locations/global/keyRings/r"}, "POST /admin/reset?keyRing=projects%2Fp%2Flocations%2Fglobal%2FkeyRings%2Fr"},
+	}
+	for _, tt := range tests {
+		code, stdout, stderr := kmsEmu("localhost:0", "", append(tt.args, "--admin-endpoint", admin.URL)...)
+		if code != exitOK || got != tt.want || stdout != "State reset\n" {
+			t.Errorf("%v: expected %s, got exit %d, %q: %s%s", tt.args, tt.want, code, got, stdout, stderr)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	emulatorauth "github.com/blackwell-systems/gcp-emulator-auth"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/principal"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/routing"
+)
+
+// sensitiveFields lists proto field names whose values are never logged
+var sensitiveFields = map[protoreflect.Name]bool{
+	"plaintext":                     true,
+	"additional_authenticated_data": true,
+	"data":                          true,
+	"wrapped_key":                   true,
+	"rsa_aes_wrapped_key":           true,
+	"shared_secret":                 true,
+}
+
+// resourceFields lists request fields that identify the target resource, in
+// order of preference
+var resourceFields = []protoreflect.Name{"name", "parent", "resource", "location"}
+
+// UnaryServerInterceptor logs every unary call handled by the server
+func UnaryServerInterceptor(logger *slog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		latency := time.Since(start)
+
+		code := status.Code(err)
+		level := levelForCode(code)
+		if !logger.Enabled(ctx, level) {
+			return resp, err
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", path.Base(info.FullMethod)),
+			slog.String("resource", Resource(req)),
+			slog.String("caller", emulatorauth.ExtractPrincipalFromContext(ctx)),
+			slog.Duration("latency", latency),
+			slog.String("code", code.String()),
+		}
+		if d, ok := principal.DelegationFromContext(ctx); ok {
+			attrs = append(attrs, slog.String("delegation", d.String()))
+		}
+		if err != nil {
+			attrs = append(attrs, slog.String("error", status.Convert(err).Message()))
+		}
+		if apiClient := routing.APIClient(ctx); apiClient != "" {
+			attrs = append(attrs, slog.String("apiClient", apiClient))
+		}
+		if logger.Enabled(ctx, slog.LevelDebug) {
+			if params := routing.RequestParams(ctx); params != "" {
+				attrs = append(attrs, slog.String("requestParams", params))
+			}
+			attrs = append(attrs, Payload("request", req))
+			if resp != nil {
+				attrs = append(attrs, Payload("response", resp))
+			}
+		}
+
+		logger.LogAttrs(ctx, level, "rpc", attrs...)
+		return resp, err
+	}
+}
+
+// levelForCode picks the log level for a call outcome
+func levelForCode(code codes.Code) slog.Level {
+	switch code {
+	case codes.OK:
+		return slog.LevelInfo
+	case codes.Internal, codes.Unknown, codes.DataLoss:
+		return slog.LevelError
+	default:
+		return slog.LevelWarn
+	}
+}
+
+// Resource returns the resource name a request targets, or "" if none
+func Resource(req any) string {
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return ""
+	}
+	return resourceOf(msg.ProtoReflect())
+}
+
+func resourceOf(m protoreflect.Message) string {
+	fields := m.Descriptor().Fields()
+	for _, name := range resourceFields {
+		fd := fields.ByName(name)
+		if fd != nil && fd.Kind() == protoreflect.StringKind && !fd.IsList() {
+			if v := m.Get(fd).String(); v != "" {
+				return v
+			}
+		}
+	}
+
+	// Update requests carry the resource name inside the updated message
+	// (e.g. UpdateCryptoKeyRequest.crypto_key.name)
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if fd.Kind() == protoreflect.MessageKind && !fd.IsList() && !fd.IsMap() && m.Has(fd) {
+			nested := m.Get(fd).Message()
+			if name := nested.Descriptor().Fields().ByName("name"); name != nil && name.Kind() == protoreflect.StringKind {
+				if v := nested.Get(name).String(); v != "" {
+					return v
+				}
+			}
+		}
+	}
+
+	return ""
+}
+
+// Payload returns a log attribute holding msg as JSON with plaintext and key
+// material removed. Redacted fields are listed with their sizes so the log
+// still shows that data was present.
+func Payload(key string, msg any) slog.Attr {
+	pm, ok := msg.(proto.Message)
+	if !ok {
+		return slog.Any(key, msg)
+	}
+
+	clone, redacted := Redact(pm)
+	data, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(clone)
+	if err != nil {
+		return slog.String(key, fmt.Sprintf("<unmarshalable: %v>", err))
+	}
+
+	attrs := []any{slog.String("body", string(data))}
+	if len(redacted) > 0 {
+		attrs = append(attrs, slog.Any("redacted", redacted))
+	}
+	return slog.Group(key, attrs...)
+}
+
+// Redact returns a copy of msg with plaintext and key material cleared, and
+// the names and sizes of the fields it removed
+func Redact(msg proto.Message) (proto.Message, []string) {
+	clone := proto.Clone(msg)
+	var redacted []string
+	redact(clone.ProtoReflect(), "", &redacted)
+	return clone, redacted
+}
+
+// redact clears sensitive fields in m (recursively) and records what it removed
+func redact(m protoreflect.Message, prefix string, redacted *[]string) {
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		name := prefix + string(fd.Name())
+
+		switch {
+		case sensitiveFields[fd.Name()] && fd.Kind() == protoreflect.BytesKind && !fd.IsList():
+			*redacted = append(*redacted, fmt.Sprintf("%s(%d bytes)", name, len(v.Bytes())))
+			m.Clear(fd)
+		case fd.Kind() == protoreflect.MessageKind && !fd.IsList() && !fd.IsMap():
+			redact(v.Message(), name+".", redacted)
+		case fd.Kind() == protoreflect.MessageKind && fd.IsList():
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				redact(list.Get(i).Message(), fmt.Sprintf("%s[%d].", name, i), redacted)
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,183 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func runInterceptor(t *testing.T, level string, req, resp any, handlerErr error) map[string]any {
+	t.Helper()
+
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		t.Fatalf("ParseLevel failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	logger, err := New(&buf, lvl, "json")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-emulator-principal", "user:alice@example.com"))
+	info := &grpc.UnaryServerInfo{FullMethod: "/google.cloud.kms.v1.KeyManagementService/Encrypt"}
+	handler := func(ctx context.Context, req any) (any, error) { return resp, handlerErr }
+
+	if _, err := UnaryServerInterceptor(logger)(ctx, req, info, handler); err != handlerErr {
+		t.Fatalf("Interceptor changed handler error: %v", err)
+	}
+
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Invalid log line %q: %v", buf.String(), err)
+	}
+	return entry
+}
+
+func TestInterceptorLogsCall(t *testing.T) {
+	req := &kmspb.EncryptRequest{
+		Name:      "projects/p/locations/global/keyRings/r/cryptoKeys/k",
+		Plaintext: []byte("secret"),
+	}
+
+	entry := runInterceptor(t, "info", req, &kmspb.EncryptResponse{}, nil)
+	if entry == nil {
+		t.Fatal("Expected a log line at info level")
+	}
+
+	checks := map[string]string{
+		"level":    "INFO",
+		"method":   "Encrypt",
+		"resource": req.Name,
+		"caller":   "user:alice@example.com",
+		"code":     "OK",
+	}
+	for key, want := range checks {
+		if got := entry[key]; got != want {
+			t.Errorf("Expected %s=%q, got %v", key, want, got)
+		}
+	}
+	if _, ok := entry["latency"]; !ok {
+		t.Error("Expected latency attribute")
+	}
+	if _, ok := entry["request"]; ok {
+		t.Error("Payloads must only be logged at debug level")
+	}
+}
+
+func TestInterceptorLogsClientHeaders(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := New(&buf, slog.LevelDebug, "json")
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"x-goog-api-client", "gl-go/1.24.0 gapic/1.25.0",
+		"x-goog-request-params", "name=projects%2Fp",
+	))
+	info := &grpc.UnaryServerInfo{FullMethod: "/google.cloud.kms.v1.KeyManagementService/GetKeyRing"}
+	_, _ = UnaryServerInterceptor(logger)(ctx, &kmspb.GetKeyRingRequest{Name: "projects/p"}, info, func(context.Context, any) (any, error) {
+		return &kmspb.KeyRing{}, nil
+	})
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Invalid log line %q: %v", buf.String(), err)
+	}
+	if entry["apiClient"] != "gl-go/1.24.0 gapic/1.25.0" || entry["requestParams"] != "name=projects%2Fp" {
+		t.Errorf("Expected apiClient and requestParams attributes, got %v", entry)
+	}
+}
+
+func TestInterceptorRespectsLevel(t *testing.T) {
+	req := &kmspb.GetKeyRingRequest{Name: "projects/p/locations/global/keyRings/r"}
+
+	if entry := runInterceptor(t, "warn", req, &kmspb.KeyRing{}, nil); entry != nil {
+		t.Errorf("Successful call should not be logged at warn level, got %v", entry)
+	}
+
+	entry := runInterceptor(t, "warn", req, nil, status.Error(codes.NotFound, "keyring not found"))
+	if entry == nil || entry["level"] != "WARN" || entry["code"] != "NotFound" {
+		t.Errorf("Expected WARN NotFound entry, got %v", entry)
+	}
+
+	entry = runInterceptor(t, "error", req, nil, status.Error(codes.Internal, "boom"))
+	if entry == nil || entry["level"] != "ERROR" {
+		t.Errorf("Expected ERROR entry for Internal, got %v", entry)
+	}
+}
+
+func TestInterceptorRedactsPayloads(t *testing.T) {
+	req := &kmspb.EncryptRequest{
+		Name:                        "projects/p/locations/global/keyRings/r/cryptoKeys/k",
+		Plaintext:                   []byte("top secret value"),
+		AdditionalAuthenticatedData: []byte("aad"),
+	}
+	resp := &kmspb.DecryptResponse{Plaintext: []byte("top secret value")}
+
+	var buf bytes.Buffer
+	logger, _ := New(&buf, slog.LevelDebug, "json")
+	info := &grpc.UnaryServerInfo{FullMethod: "/google.cloud.kms.v1.KeyManagementService/Encrypt"}
+	_, _ = UnaryServerInterceptor(logger)(context.Background(), req, info, func(context.Context, any) (any, error) {
+		return resp, nil
+	})
+
+	out := buf.String()
+	for _, secret := range []string{"top secret value", "dG9wIHNlY3JldCB2YWx1ZQ", "YWFk"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("Log output leaked %q: %s", secret, out)
+		}
+	}
+	if !strings.Contains(out, "plaintext(16 bytes)") || !strings.Contains(out, "additional_authenticated_data(3 bytes)") {
+		t.Errorf("Expected redaction markers, got %s", out)
+	}
+	if !strings.Contains(out, req.Name) {
+		t.Errorf("Expected non-sensitive fields to remain, got %s", out)
+	}
+
+	// The original request must not be modified by redaction
+	if string(req.Plaintext) != "top secret value" {
+		t.Error("Redaction mutated the request")
+	}
+}
+
+func TestResource(t *testing.T) {
+	tests := []struct {
+		name string
+		req  any
+		want string
+	}{
+		{"name field", &kmspb.GetCryptoKeyRequest{Name: "a/b"}, "a/b"},
+		{"parent field", &kmspb.ListKeyRingsRequest{Parent: "projects/p/locations/l"}, "projects/p/locations/l"},
+		{"nested update", &kmspb.UpdateCryptoKeyRequest{CryptoKey: &kmspb.CryptoKey{Name: "k"}}, "k"},
+		{"not a proto", "plain string", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Resource(tt.req); got != tt.want {
+				t.Errorf("Resource() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("Expected error for unknown level")
+	}
+	if _, err := New(&bytes.Buffer{}, slog.LevelInfo, "xml"); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
@@ -0,0 +1,143 @@
+// Package mirror reads the key rings, keys and versions of a real Cloud KMS
+// project, so the emulator can start with a realistic resource tree.
+//
+// Only metadata is read, with Get and List calls; the project is never
+// changed. Key material stays in Cloud KMS, and storage.LoadMirror generates
+// local material for every mirrored version.
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	locationpb "google.golang.org/genproto/googleapis/cloud/location"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/routing"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+var (
+	projectPattern  = regexp.MustCompile(`^projects/[^/]+$`)
+	locationPattern = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+$`)
+)
+
+// Fetch reads every key ring under source, a project (projects/p) or one of
+// its locations (projects/p/locations/l), with its keys and their versions.
+// A project is read in every location it lists.
+func Fetch(ctx context.Context, conn grpc.ClientConnInterface, source string) ([]storage.MirroredKeyRing, error) {
+	var locations []string
+	switch {
+	case locationPattern.MatchString(source):
+		locations = []string{source}
+	case projectPattern.MatchString(source):
+		var err error
+		if locations, err = listLocations(ctx, locationpb.NewLocationsClient(conn), source); err != nil {
+			return nil, fmt.Errorf("failed to list locations of %s: %w", source, err)
+		}
+	default:
+		return nil, fmt.Errorf("mirror source is not valid: %q (expected projects/{project} or projects/{project}/locations/{location})", source)
+	}
+
+	client := kmspb.NewKeyManagementServiceClient(conn)
+	var rings []storage.MirroredKeyRing
+	for _, location := range locations {
+		found, err := fetchLocation(ctx, client, location)
+		if err != nil {
+			return nil, err
+		}
+		rings = append(rings, found...)
+	}
+	return rings, nil
+}
+
+// fetchLocation reads the key rings of one location
+func fetchLocation(ctx context.Context, client kmspb.KeyManagementServiceClient, location string) ([]storage.MirroredKeyRing, error) {
+	var rings []storage.MirroredKeyRing
+	err := forEachPage(func(token string) (string, error) {
+		resp, err := client.ListKeyRings(withParent(ctx, location), &kmspb.ListKeyRingsRequest{Parent: location, PageToken: token})
+		if err != nil {
+			return "", fmt.Errorf("failed to list key rings in %s: %w", location, err)
+		}
+		for _, ring := range resp.KeyRings {
+			keys, err := fetchKeyRing(ctx, client, ring.Name)
+			if err != nil {
+				return "", err
+			}
+			rings = append(rings, storage.MirroredKeyRing{KeyRing: ring, CryptoKeys: keys})
+		}
+		return resp.NextPageToken, nil
+	})
+	return rings, err
+}
+
+// fetchKeyRing reads the keys of a key ring with their versions
+func fetchKeyRing(ctx context.Context, client kmspb.KeyManagementServiceClient, ring string) ([]storage.MirroredCryptoKey, error) {
+	var keys []storage.MirroredCryptoKey
+	err := forEachPage(func(token string) (string, error) {
+		resp, err := client.ListCryptoKeys(withParent(ctx, ring), &kmspb.ListCryptoKeysRequest{Parent: ring, PageToken: token})
+		if err != nil {
+			return "", fmt.Errorf("failed to list crypto keys in %s: %w", ring, err)
+		}
+		for _, key := range resp.CryptoKeys {
+			mk := storage.MirroredCryptoKey{CryptoKey: key}
+			err := forEachPage(func(token string) (string, error) {
+				resp, err := client.ListCryptoKeyVersions(withParent(ctx, key.Name), &kmspb.ListCryptoKeyVersionsRequest{Parent: key.Name, PageToken: token})
+				if err != nil {
+					return "", fmt.Errorf("failed to list versions of %s: %w", key.Name, err)
+				}
+				mk.Versions = append(mk.Versions, resp.CryptoKeyVersions...)
+				return resp.NextPageToken, nil
+			})
+			if err != nil {
+				return "", err
+			}
+			keys = append(keys, mk)
+		}
+		return resp.NextPageToken, nil
+	})
+	return keys, err
+}
+
+// listLocations returns the names of the locations of a project
+func listLocations(ctx context.Context, client locationpb.LocationsClient, project string) ([]string, error) {
+	var locations []string
+	err := forEachPage(func(token string) (string, error) {
+		resp, err := client.ListLocations(withRoutingParam(ctx, "name", project), &locationpb.ListLocationsRequest{Name: project, PageToken: token})
+		if err != nil {
+			return "", err
+		}
+		for _, loc := range resp.Locations {
+			locations = append(locations, loc.Name)
+		}
+		return resp.NextPageToken, nil
+	})
+	return locations, err
+}
+
+// forEachPage calls list with each page token until it returns an empty one
+func forEachPage(list func(token string) (string, error)) error {
+	token := ""
+	for {
+		next, err := list(token)
+		if err != nil || next == "" {
+			return err
+		}
+		token = next
+	}
+}
+
+// withParent adds the routing header of a list call on parent
+func withParent(ctx context.Context, parent string) context.Context {
+	return withRoutingParam(ctx, "parent", parent)
+}
+
+// withRoutingParam adds the routing header Google frontends expect, as the
+// client libraries do
+func withRoutingParam(ctx context.Context, key, value string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, routing.RequestParamsHeader, key+"="+url.QueryEscape(value))
+}
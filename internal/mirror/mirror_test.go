@@ -0,0 +1,102 @@
+package mirror
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	locationpb "google.golang.org/genproto/googleapis/cloud/location"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	emulatorauth "github.com/blackwell-systems/gcp-emulator-auth"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/server"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+// upstream serves an emulator standing in for Cloud KMS
+func upstream(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+	kms, err := server.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kms.SetIAMMode(emulatorauth.AuthModeOff); err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	kmspb.RegisterKeyManagementServiceServer(srv, kms)
+	locationpb.RegisterLocationsServer(srv, server.NewLocations())
+	lis := bufconn.Listen(1 << 20)
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestFetch(t *testing.T) {
+	conn := upstream(t)
+	client := kmspb.NewKeyManagementServiceClient(conn)
+	ctx := t.Context()
+	for _, location := range []string{"projects/real/locations/global", "projects/real/locations/us-east1"} {
+		if _, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: location, KeyRingId: "ring"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ring := "projects/real/locations/us-east1/keyRings/ring"
+	key, err := client.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent:      ring,
+		CryptoKeyId: "key",
+		CryptoKey: &kmspb.CryptoKey{
+			Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT,
+			Labels:  map[string]string{"env": "prod"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CreateCryptoKeyVersion(ctx, &kmspb.CreateCryptoKeyVersionRequest{Parent: key.Name}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A project is read in every location
+	rings, err := Fetch(ctx, conn, "projects/real")
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if len(rings) != 2 {
+		t.Fatalf("Expected 2 key rings, got %d", len(rings))
+	}
+
+	rings, err = Fetch(ctx, conn, "projects/real/locations/us-east1")
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if len(rings) != 1 || len(rings[0].CryptoKeys) != 1 || len(rings[0].CryptoKeys[0].Versions) != 2 {
+		t.Fatalf("Expected one key ring with one key and two versions, got %v", rings)
+	}
+
+	s := storage.NewStorage()
+	if _, err := s.LoadMirror(rings); err != nil {
+		t.Fatalf("LoadMirror failed: %v", err)
+	}
+	mirrored, err := s.GetCryptoKey(key.Name)
+	if err != nil || mirrored.Labels["env"] != "prod" || !mirrored.CreateTime.AsTime().Equal(key.CreateTime.AsTime()) {
+		t.Errorf("Expected the key metadata to be mirrored, got %v: %v", mirrored, err)
+	}
+
+	for _, source := range []string{"", "real", "projects/real/locations", "projects/real/locations/global/keyRings/ring"} {
+		if _, err := Fetch(ctx, conn, source); err == nil {
+			t.Errorf("Expected an error for source %q", source)
+		}
+	}
+}
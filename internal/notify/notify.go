@@ -0,0 +1,306 @@
+// Package notify publishes key lifecycle events to a Pub/Sub topic.
+//
+// Each successful lifecycle call produces one message whose data is the
+// affected resource in JSON (as returned by the REST API) and whose
+// attributes describe the event:
+//
+//   - eventType: KEY_RING_CREATED, CRYPTO_KEY_CREATED, CRYPTO_KEY_UPDATED,
+//     CRYPTO_KEY_PRIMARY_VERSION_UPDATED (rotation),
+//     CRYPTO_KEY_VERSION_CREATED, CRYPTO_KEY_VERSION_ENABLED,
+//     CRYPTO_KEY_VERSION_DISABLED, CRYPTO_KEY_VERSION_UPDATED,
+//     CRYPTO_KEY_VERSION_DESTROY_SCHEDULED or CRYPTO_KEY_VERSION_RESTORED
+//   - resourceName: full name of the affected resource
+//   - eventTime: RFC 3339 time of the call
+//   - payloadFormat: JSON_API_V1
+//
+// Messages are published through the Pub/Sub REST API, normally to the Pub/Sub
+// emulator (PUBSUB_EMULATOR_HOST), by a background worker so calls never wait
+// on Pub/Sub. Events are published in the order the calls completed.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Event types
+const (
+	KeyRingCreated                   = "KEY_RING_CREATED"
+	CryptoKeyCreated                 = "CRYPTO_KEY_CREATED"
+	CryptoKeyUpdated                 = "CRYPTO_KEY_UPDATED"
+	CryptoKeyPrimaryVersionUpdated   = "CRYPTO_KEY_PRIMARY_VERSION_UPDATED"
+	CryptoKeyVersionCreated          = "CRYPTO_KEY_VERSION_CREATED"
+	CryptoKeyVersionEnabled          = "CRYPTO_KEY_VERSION_ENABLED"
+	CryptoKeyVersionDisabled         = "CRYPTO_KEY_VERSION_DISABLED"
+	CryptoKeyVersionUpdated          = "CRYPTO_KEY_VERSION_UPDATED"
+	CryptoKeyVersionDestroyScheduled = "CRYPTO_KEY_VERSION_DESTROY_SCHEDULED"
+	CryptoKeyVersionRestored         = "CRYPTO_KEY_VERSION_RESTORED"
+)
+
+// queueSize bounds the events waiting to be published; further events are
+// dropped rather than slowing down calls
+const queueSize = 1024
+
+var errTopicNotFound = errors.New("topic not found")
+
+var topicPattern = regexp.MustCompile(`^projects/[^/]+/topics/[^/]+$`)
+
+// message is a Pub/Sub PubsubMessage in REST form
+type message struct {
+	Data       string            `json:"data"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// Publisher publishes lifecycle events to a topic
+type Publisher struct {
+	endpoint string
+	topic    string
+	client   *http.Client
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan message
+	done   chan struct{}
+}
+
+// NewPublisher creates a publisher for topic (projects/{project}/topics/{topic})
+// on the Pub/Sub REST endpoint at host, e.g. "localhost:8085"
+func NewPublisher(host, topic string) (*Publisher, error) {
+	if host == "" {
+		return nil, fmt.Errorf("pub/sub host is required")
+	}
+	if !topicPattern.MatchString(topic) {
+		return nil, fmt.Errorf("invalid topic %q (expected projects/{project}/topics/{topic})", topic)
+	}
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+
+	p := &Publisher{
+		endpoint: strings.TrimSuffix(host, "/"),
+		topic:    topic,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan message, queueSize),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p, nil
+}
+
+// Topic returns the topic events are published to
+func (p *Publisher) Topic() string {
+	return p.topic
+}
+
+// EnsureTopic creates the topic if it does not exist yet
+func (p *Publisher) EnsureTopic(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, p.endpoint+"/v1/"+p.topic, strings.NewReader("{}"))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to create topic %s: %w", p.topic, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("failed to create topic %s: %s: %s", p.topic, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// UnaryServerInterceptor queues an event for every successful lifecycle call
+func (p *Publisher) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		resp, err := handler(ctx, req)
+		if err != nil {
+			return resp, err
+		}
+
+		eventType, resource := Event(path.Base(info.FullMethod), req, resp)
+		if eventType == "" {
+			return resp, err
+		}
+		msg, merr := newMessage(eventType, resource, time.Now())
+		if merr != nil {
+			slog.Warn("Failed to encode lifecycle event", "event", eventType, "error", merr)
+			return resp, err
+		}
+
+		p.enqueue(msg)
+		return resp, err
+	}
+}
+
+// enqueue queues msg without blocking, dropping it if the queue is full or
+// the publisher is closed
+func (p *Publisher) enqueue(msg message) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return
+	}
+	select {
+	case p.queue <- msg:
+	default:
+		slog.Warn("Lifecycle event queue full, dropping event", "event", msg.Attributes["eventType"], "resource", msg.Attributes["resourceName"])
+	}
+}
+
+// Close publishes the queued events and stops the publisher. Events still
+// queued when ctx expires are dropped.
+func (p *Publisher) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Event returns the event type and affected resource for a successful call,
+// or "" if the method is not a lifecycle change
+func Event(method string, req, resp any) (string, proto.Message) {
+	switch r := resp.(type) {
+	case *kmspb.KeyRing:
+		if method == "CreateKeyRing" {
+			return KeyRingCreated, r
+		}
+	case *kmspb.CryptoKey:
+		switch method {
+		case "CreateCryptoKey":
+			return CryptoKeyCreated, r
+		case "UpdateCryptoKey":
+			return CryptoKeyUpdated, r
+		case "UpdateCryptoKeyPrimaryVersion":
+			return CryptoKeyPrimaryVersionUpdated, r
+		}
+	case *kmspb.CryptoKeyVersion:
+		switch method {
+		case "CreateCryptoKeyVersion", "ImportCryptoKeyVersion":
+			return CryptoKeyVersionCreated, r
+		case "DestroyCryptoKeyVersion":
+			return CryptoKeyVersionDestroyScheduled, r
+		case "RestoreCryptoKeyVersion":
+			return CryptoKeyVersionRestored, r
+		case "UpdateCryptoKeyVersion":
+			if !updatesState(req) {
+				return CryptoKeyVersionUpdated, r
+			}
+			switch r.State {
+			case kmspb.CryptoKeyVersion_ENABLED:
+				return CryptoKeyVersionEnabled, r
+			case kmspb.CryptoKeyVersion_DISABLED:
+				return CryptoKeyVersionDisabled, r
+			default:
+				return CryptoKeyVersionUpdated, r
+			}
+		}
+	}
+	return "", nil
+}
+
+// updatesState reports whether an UpdateCryptoKeyVersion request changes the
+// version state
+func updatesState(req any) bool {
+	r, ok := req.(*kmspb.UpdateCryptoKeyVersionRequest)
+	if !ok || r.UpdateMask == nil {
+		return true
+	}
+	for _, field := range r.UpdateMask.Paths {
+		if field == "state" {
+			return true
+		}
+	}
+	return false
+}
+
+func newMessage(eventType string, resource proto.Message, now time.Time) (message, error) {
+	data, err := protojson.Marshal(resource)
+	if err != nil {
+		return message{}, err
+	}
+
+	var name string
+	if fd := resource.ProtoReflect().Descriptor().Fields().ByName("name"); fd != nil {
+		name = resource.ProtoReflect().Get(fd).String()
+	}
+
+	return message{
+		Data: base64.StdEncoding.EncodeToString(data),
+		Attributes: map[string]string{
+			"eventType":     eventType,
+			"resourceName":  name,
+			"eventTime":     now.UTC().Format(time.RFC3339Nano),
+			"payloadFormat": "JSON_API_V1",
+		},
+	}, nil
+}
+
+// run publishes queued events one at a time so they arrive in order
+func (p *Publisher) run() {
+	defer close(p.done)
+	for msg := range p.queue {
+		err := p.publish(msg)
+		if errors.Is(err, errTopicNotFound) {
+			// The topic may have been lost with a restarted Pub/Sub emulator
+			if err = p.EnsureTopic(context.Background()); err == nil {
+				err = p.publish(msg)
+			}
+		}
+		if err != nil {
+			slog.Warn("Failed to publish lifecycle event", "topic", p.topic, "event", msg.Attributes["eventType"], "error", err)
+		}
+	}
+}
+
+func (p *Publisher) publish(msg message) error {
+	body, err := json.Marshal(map[string][]message{"messages": {msg}})
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client.Post(p.endpoint+"/v1/"+p.topic+":publish", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", errTopicNotFound, p.topic)
+	}
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
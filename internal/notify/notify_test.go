@@ -0,0 +1,136 @@
+package notify
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+const (
+	topic       = "projects/p/topics/kms-events"
+	versionName = "projects/p/locations/global/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1"
+)
+
+// fakePubSub records published messages and created topics
+type fakePubSub struct {
+	mu       sync.Mutex
+	topics   map[string]bool
+	messages []message
+}
+
+func newFakePubSub(t *testing.T) (*fakePubSub, *httptest.Server) {
+	f := &fakePubSub{topics: make(map[string]bool)}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		name, publish := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/v1/"), ":publish")
+		switch {
+		case r.Method == http.MethodPut:
+			f.topics[name] = true
+			w.Write([]byte("{}"))
+		case publish && !f.topics[name]:
+			http.Error(w, `{"error":{"code":404}}`, http.StatusNotFound)
+		case publish:
+			var body struct{ Messages []message }
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			f.messages = append(f.messages, body.Messages...)
+			w.Write([]byte(`{"messageIds":["1"]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return f, ts
+}
+
+func TestEvent(t *testing.T) {
+	version := &kmspb.CryptoKeyVersion{Name: versionName, State: kmspb.CryptoKeyVersion_DISABLED}
+	stateMask := &kmspb.UpdateCryptoKeyVersionRequest{UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"state"}}}
+	labelMask := &kmspb.UpdateCryptoKeyVersionRequest{UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"labels"}}}
+
+	tests := []struct {
+		method string
+		req    any
+		resp   any
+		want   string
+	}{
+		{"CreateKeyRing", nil, &kmspb.KeyRing{}, KeyRingCreated},
+		{"CreateCryptoKey", nil, &kmspb.CryptoKey{}, CryptoKeyCreated},
+		{"UpdateCryptoKeyPrimaryVersion", nil, &kmspb.CryptoKey{}, CryptoKeyPrimaryVersionUpdated},
+		{"CreateCryptoKeyVersion", nil, version, CryptoKeyVersionCreated},
+		{"UpdateCryptoKeyVersion", stateMask, version, CryptoKeyVersionDisabled},
+		{"UpdateCryptoKeyVersion", labelMask, version, CryptoKeyVersionUpdated},
+		{"DestroyCryptoKeyVersion", nil, version, CryptoKeyVersionDestroyScheduled},
+		{"GetCryptoKeyVersion", nil, version, ""},
+		{"Encrypt", nil, &kmspb.EncryptResponse{}, ""},
+	}
+	for _, tt := range tests {
+		if got, _ := Event(tt.method, tt.req, tt.resp); got != tt.want {
+			t.Errorf("Event(%s) = %q, want %q", tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	fake, ts := newFakePubSub(t)
+	p, err := NewPublisher(ts.URL, topic)
+	if err != nil {
+		t.Fatalf("NewPublisher failed: %v", err)
+	}
+
+	// The topic does not exist yet; the first publish creates it
+	interceptor := p.UnaryServerInterceptor()
+	call := func(method string, resp any) {
+		info := &grpc.UnaryServerInfo{FullMethod: "/google.cloud.kms.v1.KeyManagementService/" + method}
+		interceptor(context.Background(), nil, info, func(context.Context, any) (any, error) { return resp, nil })
+	}
+	call("CreateCryptoKeyVersion", &kmspb.CryptoKeyVersion{Name: versionName, State: kmspb.CryptoKeyVersion_ENABLED})
+	call("GetCryptoKeyVersion", &kmspb.CryptoKeyVersion{Name: versionName})
+	call("DestroyCryptoKeyVersion", &kmspb.CryptoKeyVersion{Name: versionName, State: kmspb.CryptoKeyVersion_DESTROY_SCHEDULED})
+
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(fake.messages))
+	}
+	if got := fake.messages[0].Attributes["eventType"]; got != CryptoKeyVersionCreated {
+		t.Errorf("Expected %s first, got %s", CryptoKeyVersionCreated, got)
+	}
+	msg := fake.messages[1]
+	if msg.Attributes["eventType"] != CryptoKeyVersionDestroyScheduled || msg.Attributes["resourceName"] != versionName {
+		t.Errorf("Unexpected attributes: %v", msg.Attributes)
+	}
+	data, err := base64.StdEncoding.DecodeString(msg.Data)
+	if err != nil || !strings.Contains(string(data), `"state":"DESTROY_SCHEDULED"`) {
+		t.Errorf("Expected the version as JSON data, got %q (%v)", data, err)
+	}
+
+	// Events after Close are dropped instead of panicking
+	call("CreateCryptoKeyVersion", &kmspb.CryptoKeyVersion{Name: versionName})
+}
+
+func TestNewPublisherValidation(t *testing.T) {
+	if _, err := NewPublisher("", topic); err == nil {
+		t.Error("Expected an error without a host")
+	}
+	if _, err := NewPublisher("localhost:8085", "kms-events"); err == nil {
+		t.Error("Expected an error for a topic without a project")
+	}
+}
@@ -0,0 +1,96 @@
+package pkcs11
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigEnv names the environment variable holding the configuration path,
+// as with Google's Cloud KMS PKCS#11 library
+const ConfigEnv = "KMS_PKCS11_CONFIG"
+
+// Config is the module configuration. It reads the YAML format of Google's
+// Cloud KMS PKCS#11 library; settings the emulator has no use for, such as
+// certificate generation, are ignored.
+//
+//	tokens:
+//	  - key_ring: projects/p/locations/global/keyRings/hsm
+//	    label: hsm
+//	kms_endpoint: localhost:9090
+type Config struct {
+	Tokens []TokenConfig `yaml:"tokens"`
+	// KMSEndpoint is the emulator's gRPC address; empty uses
+	// KMS_EMULATOR_HOST or localhost:9090
+	KMSEndpoint string `yaml:"kms_endpoint"`
+	// RPCTimeoutSecs bounds each call to the emulator; zero means 30s
+	RPCTimeoutSecs int `yaml:"rpc_timeout_secs"`
+}
+
+// TokenConfig maps one slot's token to a key ring
+type TokenConfig struct {
+	KeyRing string `yaml:"key_ring"`
+	// Label is the token label; empty uses the key ring ID
+	Label string `yaml:"label"`
+}
+
+// LoadConfig reads the configuration at path, or at $KMS_PKCS11_CONFIG if
+// path is empty
+func LoadConfig(path string) (Config, error) {
+	if path == "" {
+		path = os.Getenv(ConfigEnv)
+	}
+	if path == "" {
+		return Config{}, errors.New(ConfigEnv + " is not set")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return Config{}, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return cfg, cfg.validate()
+}
+
+func (c *Config) validate() error {
+	if len(c.Tokens) == 0 {
+		return errors.New("config has no tokens")
+	}
+	for i := range c.Tokens {
+		t := &c.Tokens[i]
+		parts := strings.Split(t.KeyRing, "/")
+		if len(parts) != 6 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "keyRings" {
+			return fmt.Errorf("token %d: key_ring must be projects/{project}/locations/{location}/keyRings/{keyRing}, got %q", i, t.KeyRing)
+		}
+		if t.Label == "" {
+			t.Label = parts[5]
+		}
+		if len(t.Label) > 32 {
+			return fmt.Errorf("token %d: label %q is longer than 32 bytes", i, t.Label)
+		}
+	}
+	if c.KMSEndpoint == "" {
+		c.KMSEndpoint = os.Getenv("KMS_EMULATOR_HOST")
+	}
+	if c.KMSEndpoint == "" {
+		c.KMSEndpoint = "localhost:9090"
+	}
+	if c.RPCTimeoutSecs < 0 {
+		return errors.New("rpc_timeout_secs must not be negative")
+	}
+	return nil
+}
+
+// rpcTimeout returns the deadline of each call to the emulator
+func (c *Config) rpcTimeout() time.Duration {
+	if c.RPCTimeoutSecs == 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.RPCTimeoutSecs) * time.Second
+}
@@ -0,0 +1,182 @@
+package pkcs11
+
+// PKCS#11 v2.40 constants the module uses, with their values from the
+// OASIS headers. Only the subset the module implements is listed.
+
+// Return values
+const (
+	CKR_OK                             Error = 0x000
+	CKR_HOST_MEMORY                    Error = 0x002
+	CKR_SLOT_ID_INVALID                Error = 0x003
+	CKR_GENERAL_ERROR                  Error = 0x005
+	CKR_FUNCTION_FAILED                Error = 0x006
+	CKR_ARGUMENTS_BAD                  Error = 0x007
+	CKR_ATTRIBUTE_SENSITIVE            Error = 0x011
+	CKR_ATTRIBUTE_TYPE_INVALID         Error = 0x012
+	CKR_ATTRIBUTE_VALUE_INVALID        Error = 0x013
+	CKR_DATA_INVALID                   Error = 0x020
+	CKR_DATA_LEN_RANGE                 Error = 0x021
+	CKR_DEVICE_ERROR                   Error = 0x030
+	CKR_ENCRYPTED_DATA_INVALID         Error = 0x040
+	CKR_FUNCTION_NOT_SUPPORTED         Error = 0x054
+	CKR_KEY_HANDLE_INVALID             Error = 0x060
+	CKR_KEY_TYPE_INCONSISTENT          Error = 0x063
+	CKR_KEY_FUNCTION_NOT_PERMITTED     Error = 0x068
+	CKR_MECHANISM_INVALID              Error = 0x070
+	CKR_MECHANISM_PARAM_INVALID        Error = 0x071
+	CKR_OBJECT_HANDLE_INVALID          Error = 0x082
+	CKR_OPERATION_ACTIVE               Error = 0x090
+	CKR_OPERATION_NOT_INITIALIZED      Error = 0x091
+	CKR_SESSION_HANDLE_INVALID         Error = 0x0B3
+	CKR_SESSION_PARALLEL_NOT_SUPPORTED Error = 0x0B4
+	CKR_SESSION_READ_ONLY              Error = 0x0B5
+	CKR_SIGNATURE_INVALID              Error = 0x0C0
+	CKR_SIGNATURE_LEN_RANGE            Error = 0x0C1
+	CKR_TEMPLATE_INCOMPLETE            Error = 0x0D0
+	CKR_TEMPLATE_INCONSISTENT          Error = 0x0D1
+	CKR_USER_ALREADY_LOGGED_IN         Error = 0x100
+	CKR_USER_NOT_LOGGED_IN             Error = 0x101
+	CKR_USER_TYPE_INVALID              Error = 0x103
+	CKR_BUFFER_TOO_SMALL               Error = 0x150
+	CKR_CRYPTOKI_NOT_INITIALIZED       Error = 0x190
+	CKR_CRYPTOKI_ALREADY_INITIALIZED   Error = 0x191
+)
+
+// Object classes
+const (
+	CKO_PUBLIC_KEY  = 0x2
+	CKO_PRIVATE_KEY = 0x3
+	CKO_SECRET_KEY  = 0x4
+)
+
+// Key types
+const (
+	CKK_RSA            = 0x00
+	CKK_EC             = 0x03
+	CKK_GENERIC_SECRET = 0x10
+	CKK_AES            = 0x1F
+	CKK_EC_EDWARDS     = 0x40
+)
+
+// Attribute types
+const (
+	CKA_CLASS               = 0x000
+	CKA_TOKEN               = 0x001
+	CKA_PRIVATE             = 0x002
+	CKA_LABEL               = 0x003
+	CKA_VALUE               = 0x011
+	CKA_KEY_TYPE            = 0x100
+	CKA_ID                  = 0x102
+	CKA_SENSITIVE           = 0x103
+	CKA_ENCRYPT             = 0x104
+	CKA_DECRYPT             = 0x105
+	CKA_WRAP                = 0x106
+	CKA_UNWRAP              = 0x107
+	CKA_SIGN                = 0x108
+	CKA_SIGN_RECOVER        = 0x109
+	CKA_VERIFY              = 0x10A
+	CKA_VERIFY_RECOVER      = 0x10B
+	CKA_DERIVE              = 0x10C
+	CKA_MODULUS             = 0x120
+	CKA_MODULUS_BITS        = 0x121
+	CKA_PUBLIC_EXPONENT     = 0x122
+	CKA_PUBLIC_KEY_INFO     = 0x129
+	CKA_VALUE_LEN           = 0x161
+	CKA_EXTRACTABLE         = 0x162
+	CKA_LOCAL               = 0x163
+	CKA_NEVER_EXTRACTABLE   = 0x164
+	CKA_ALWAYS_SENSITIVE    = 0x165
+	CKA_MODIFIABLE          = 0x170
+	CKA_COPYABLE            = 0x171
+	CKA_DESTROYABLE         = 0x172
+	CKA_EC_PARAMS           = 0x180
+	CKA_EC_POINT            = 0x181
+	CKA_ALWAYS_AUTHENTICATE = 0x202
+	CKA_VENDOR_DEFINED      = 0x80000000
+)
+
+// Mechanisms
+const (
+	CKM_RSA_PKCS_KEY_PAIR_GEN   = 0x0000
+	CKM_RSA_PKCS                = 0x0001
+	CKM_RSA_PKCS_OAEP           = 0x0009
+	CKM_RSA_PKCS_PSS            = 0x000D
+	CKM_SHA_1                   = 0x0220
+	CKM_SHA_1_HMAC              = 0x0221
+	CKM_SHA256                  = 0x0250
+	CKM_SHA256_HMAC             = 0x0251
+	CKM_SHA224                  = 0x0255
+	CKM_SHA224_HMAC             = 0x0256
+	CKM_SHA384                  = 0x0260
+	CKM_SHA384_HMAC             = 0x0261
+	CKM_SHA512                  = 0x0270
+	CKM_SHA512_HMAC             = 0x0271
+	CKM_GENERIC_SECRET_KEY_GEN  = 0x0350
+	CKM_EC_KEY_PAIR_GEN         = 0x1040
+	CKM_ECDSA                   = 0x1041
+	CKM_EC_EDWARDS_KEY_PAIR_GEN = 0x1055
+	CKM_EDDSA                   = 0x1057
+	CKM_AES_KEY_GEN             = 0x1080
+	CKM_VENDOR_DEFINED          = 0x80000000
+)
+
+// Mask generation functions of OAEP and PSS parameters
+const (
+	CKG_MGF1_SHA1   = 1
+	CKG_MGF1_SHA256 = 2
+	CKG_MGF1_SHA384 = 3
+	CKG_MGF1_SHA512 = 4
+	CKG_MGF1_SHA224 = 5
+)
+
+// Flags of slots, tokens, sessions and mechanisms
+const (
+	CKF_TOKEN_PRESENT        = 0x1
+	CKF_RNG                  = 0x1
+	CKF_USER_PIN_INITIALIZED = 0x8
+	CKF_TOKEN_INITIALIZED    = 0x400
+	CKF_RW_SESSION           = 0x2
+	CKF_SERIAL_SESSION       = 0x4
+	CKF_HW                   = 0x1
+	CKF_ENCRYPT              = 0x100
+	CKF_DECRYPT              = 0x200
+	CKF_SIGN                 = 0x800
+	CKF_VERIFY               = 0x2000
+	CKF_GENERATE             = 0x8000
+	CKF_GENERATE_KEY_PAIR    = 0x10000
+	CKF_EC_NAMEDCURVE        = 0x800000
+	CKF_EC_UNCOMPRESS        = 0x1000000
+)
+
+// User types
+const (
+	CKU_SO   = 0
+	CKU_USER = 1
+)
+
+// Session states
+const (
+	CKS_RO_PUBLIC_SESSION = 0
+	CKS_RO_USER_FUNCTIONS = 1
+	CKS_RW_PUBLIC_SESSION = 2
+	CKS_RW_USER_FUNCTIONS = 3
+)
+
+// Vendor-defined values. KMSVendorCode and CKA_KMS_ALGORITHM are those of
+// Google's Cloud KMS PKCS#11 library, so key generation templates written
+// for it work unchanged.
+const (
+	KMSVendorCode = 0x1E100
+
+	// CKA_KMS_ALGORITHM holds a CryptoKeyVersionAlgorithm as a CK_ULONG
+	CKA_KMS_ALGORITHM = CKA_VENDOR_DEFINED | KMSVendorCode | 0x01
+
+	// CKM_KMS_ENCRYPT encrypts and decrypts with the emulator's Encrypt and
+	// Decrypt, whose ciphertexts carry their own IV and version. Its
+	// optional parameter is the additional authenticated data.
+	CKM_KMS_ENCRYPT = CKM_VENDOR_DEFINED | KMSVendorCode | 0x80
+)
+
+// UnavailableInformation is CK_UNAVAILABLE_INFORMATION, the length reported
+// for attributes that cannot be read
+const UnavailableInformation = ^uint(0)
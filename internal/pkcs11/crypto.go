@@ -0,0 +1,531 @@
+package pkcs11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+// Mechanism is a mechanism with its parameter
+type Mechanism struct {
+	Type uint
+	// Parameter is the raw parameter of mechanisms without a structured
+	// one: the additional authenticated data of CKM_KMS_ENCRYPT
+	Parameter []byte
+	// RSA holds the decoded CK_RSA_PKCS_OAEP_PARAMS or
+	// CK_RSA_PKCS_PSS_PARAMS of CKM_RSA_PKCS_OAEP and CKM_RSA_PKCS_PSS
+	RSA *RSAParams
+}
+
+// RSAParams are the parameters of OAEP and PSS mechanisms
+type RSAParams struct {
+	Hash       uint
+	MGF        uint
+	SaltLength uint
+	// Label is the OAEP source data, which Cloud KMS does not support
+	Label []byte
+}
+
+// mechanisms lists the supported mechanisms and their CK_MECHANISM_INFO
+var mechanisms = map[uint]MechanismInfo{
+	CKM_KMS_ENCRYPT:             {256, 256, CKF_ENCRYPT | CKF_DECRYPT},
+	CKM_SHA_1_HMAC:              {20, 20, CKF_SIGN | CKF_VERIFY},
+	CKM_SHA224_HMAC:             {28, 28, CKF_SIGN | CKF_VERIFY},
+	CKM_SHA256_HMAC:             {32, 32, CKF_SIGN | CKF_VERIFY},
+	CKM_SHA384_HMAC:             {48, 48, CKF_SIGN | CKF_VERIFY},
+	CKM_SHA512_HMAC:             {64, 64, CKF_SIGN | CKF_VERIFY},
+	CKM_ECDSA:                   {256, 384, CKF_SIGN | CKF_VERIFY | CKF_EC_NAMEDCURVE | CKF_EC_UNCOMPRESS},
+	CKM_EDDSA:                   {256, 256, CKF_SIGN | CKF_VERIFY},
+	CKM_RSA_PKCS:                {2048, 4096, CKF_SIGN | CKF_VERIFY},
+	CKM_RSA_PKCS_PSS:            {2048, 4096, CKF_SIGN | CKF_VERIFY},
+	CKM_RSA_PKCS_OAEP:           {2048, 4096, CKF_ENCRYPT | CKF_DECRYPT},
+	CKM_AES_KEY_GEN:             {32, 32, CKF_GENERATE},
+	CKM_GENERIC_SECRET_KEY_GEN:  {20, 64, CKF_GENERATE},
+	CKM_EC_KEY_PAIR_GEN:         {256, 384, CKF_GENERATE_KEY_PAIR | CKF_EC_NAMEDCURVE | CKF_EC_UNCOMPRESS},
+	CKM_EC_EDWARDS_KEY_PAIR_GEN: {256, 256, CKF_GENERATE_KEY_PAIR},
+	CKM_RSA_PKCS_KEY_PAIR_GEN:   {2048, 4096, CKF_GENERATE_KEY_PAIR},
+}
+
+// Mechanisms returns the mechanisms a slot supports, in ascending order
+func (m *Module) Mechanisms(slot uint) ([]uint, error) {
+	if _, err := m.token(slot); err != nil {
+		return nil, err
+	}
+	var types []uint
+	for t := range mechanisms {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types, nil
+}
+
+// MechanismInfo returns the key sizes and operations of a mechanism
+func (m *Module) MechanismInfo(slot, mechanism uint) (MechanismInfo, error) {
+	if _, err := m.token(slot); err != nil {
+		return MechanismInfo{}, err
+	}
+	info, ok := mechanisms[mechanism]
+	if !ok {
+		return MechanismInfo{}, CKR_MECHANISM_INVALID
+	}
+	return info, nil
+}
+
+// opKind is the kind of an operation; a session has at most one of each
+type opKind int
+
+const (
+	opFind opKind = iota
+	opEncrypt
+	opDecrypt
+	opSign
+	opVerify
+)
+
+// operation is an active operation of a session
+type operation struct {
+	mech Mechanism
+	obj  *object
+	// result is the output of an operation whose caller has only asked for
+	// its length so far
+	result []byte
+	found  []uint
+}
+
+func (m *Module) operation(s *session, kind opKind) *operation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return s.operations[kind]
+}
+
+func (m *Module) setOperation(s *session, kind opKind, op *operation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if op == nil {
+		delete(s.operations, kind)
+	} else {
+		s.operations[kind] = op
+	}
+}
+
+// Hash mechanisms and MGFs of OAEP and PSS parameters
+var (
+	hashMechanisms = map[crypto.Hash]uint{crypto.SHA1: CKM_SHA_1, crypto.SHA224: CKM_SHA224, crypto.SHA256: CKM_SHA256, crypto.SHA384: CKM_SHA384, crypto.SHA512: CKM_SHA512}
+	mgfs           = map[crypto.Hash]uint{crypto.SHA1: CKG_MGF1_SHA1, crypto.SHA224: CKG_MGF1_SHA224, crypto.SHA256: CKG_MGF1_SHA256, crypto.SHA384: CKG_MGF1_SHA384, crypto.SHA512: CKG_MGF1_SHA512}
+)
+
+// initOperation starts an operation with a key that must permit attr, such
+// as CKA_SIGN, and whose algorithm uses mech
+func (m *Module) initOperation(h uint, kind opKind, mech Mechanism, key uint, attr uint) error {
+	s, err := m.session(h)
+	if err != nil {
+		return err
+	}
+	if m.operation(s, kind) != nil {
+		return CKR_OPERATION_ACTIVE
+	}
+	if _, ok := mechanisms[mech.Type]; !ok {
+		return CKR_MECHANISM_INVALID
+	}
+	o, err := m.object(s, key)
+	if err != nil {
+		return CKR_KEY_HANDLE_INVALID
+	}
+	if mech.Type != o.spec.mechanism {
+		return CKR_KEY_TYPE_INCONSISTENT
+	}
+	if !o.can(attr) {
+		return CKR_KEY_FUNCTION_NOT_PERMITTED
+	}
+	if mech.Type == CKM_RSA_PKCS_OAEP || mech.Type == CKM_RSA_PKCS_PSS {
+		// Cloud KMS fixes the hash, MGF, salt length and (empty) label
+		p, hash := mech.RSA, o.spec.hash
+		if p == nil || p.Hash != hashMechanisms[hash] || p.MGF != mgfs[hash] ||
+			(mech.Type == CKM_RSA_PKCS_PSS && p.SaltLength != uint(hash.Size())) ||
+			(mech.Type == CKM_RSA_PKCS_OAEP && len(p.Label) > 0) {
+			return CKR_MECHANISM_PARAM_INVALID
+		}
+	}
+	m.setOperation(s, kind, &operation{mech: mech, obj: o})
+	return nil
+}
+
+// finish completes an operation with output under PKCS#11's length query
+// convention. capacity is the caller's buffer size, or negative when it only
+// asks for the length. The output is computed once; the operation stays
+// active until the caller has received it.
+func (m *Module) finish(h uint, kind opKind, capacity int, compute func(op *operation) ([]byte, error)) ([]byte, error) {
+	s, err := m.session(h)
+	if err != nil {
+		return nil, err
+	}
+	op := m.operation(s, kind)
+	if op == nil {
+		return nil, CKR_OPERATION_NOT_INITIALIZED
+	}
+	if op.result == nil {
+		out, err := compute(op)
+		if err != nil {
+			m.setOperation(s, kind, nil)
+			return nil, err
+		}
+		op.result = out
+	}
+	if capacity < 0 {
+		return op.result, nil
+	}
+	if capacity < len(op.result) {
+		return op.result, CKR_BUFFER_TOO_SMALL
+	}
+	m.setOperation(s, kind, nil)
+	return op.result, nil
+}
+
+// EncryptInit starts encryption with a symmetric key or RSA public key
+func (m *Module) EncryptInit(h uint, mech Mechanism, key uint) error {
+	return m.initOperation(h, opEncrypt, mech, key, CKA_ENCRYPT)
+}
+
+// Encrypt encrypts data in one part
+func (m *Module) Encrypt(h uint, data []byte, capacity int) ([]byte, error) {
+	return m.finish(h, opEncrypt, capacity, func(op *operation) ([]byte, error) {
+		if op.mech.Type == CKM_RSA_PKCS_OAEP {
+			out, err := rsa.EncryptOAEP(op.obj.spec.hash.New(), rand.Reader, op.obj.public.(*rsa.PublicKey), data, nil)
+			if err != nil {
+				return nil, CKR_DATA_LEN_RANGE
+			}
+			return out, nil
+		}
+		ctx, cancel := m.context()
+		defer cancel()
+		resp, err := m.kms.Encrypt(ctx, &kmspb.EncryptRequest{Name: op.obj.version, Plaintext: data, AdditionalAuthenticatedData: op.mech.Parameter})
+		if err != nil {
+			return nil, kmsError(err, CKR_DATA_LEN_RANGE)
+		}
+		return resp.Ciphertext, nil
+	})
+}
+
+// DecryptInit starts decryption with a symmetric key or RSA private key
+func (m *Module) DecryptInit(h uint, mech Mechanism, key uint) error {
+	return m.initOperation(h, opDecrypt, mech, key, CKA_DECRYPT)
+}
+
+// Decrypt decrypts data in one part. Symmetric ciphertexts decrypt with
+// whichever version of the key produced them.
+func (m *Module) Decrypt(h uint, data []byte, capacity int) ([]byte, error) {
+	return m.finish(h, opDecrypt, capacity, func(op *operation) ([]byte, error) {
+		ctx, cancel := m.context()
+		defer cancel()
+		if op.mech.Type == CKM_RSA_PKCS_OAEP {
+			resp, err := m.kms.AsymmetricDecrypt(ctx, &kmspb.AsymmetricDecryptRequest{Name: op.obj.version, Ciphertext: data})
+			if err != nil {
+				return nil, kmsError(err, CKR_ENCRYPTED_DATA_INVALID)
+			}
+			return resp.Plaintext, nil
+		}
+		resp, err := m.kms.Decrypt(ctx, &kmspb.DecryptRequest{Name: op.obj.cryptoKey(), Ciphertext: data, AdditionalAuthenticatedData: op.mech.Parameter})
+		if err != nil {
+			return nil, kmsError(err, CKR_ENCRYPTED_DATA_INVALID)
+		}
+		return resp.Plaintext, nil
+	})
+}
+
+// SignInit starts signing with a private key or MAC key
+func (m *Module) SignInit(h uint, mech Mechanism, key uint) error {
+	return m.initOperation(h, opSign, mech, key, CKA_SIGN)
+}
+
+// Sign signs data in one part. CKM_ECDSA and CKM_RSA_PKCS_PSS take the
+// digest of the key's hash, CKM_RSA_PKCS a DigestInfo (or any data for raw
+// PKCS#1 keys), CKM_EDDSA and HMAC mechanisms the data itself. ECDSA
+// signatures are returned as r || s, as PKCS#11 requires.
+func (m *Module) Sign(h uint, data []byte, capacity int) ([]byte, error) {
+	return m.finish(h, opSign, capacity, func(op *operation) ([]byte, error) {
+		o := op.obj
+		ctx, cancel := m.context()
+		defer cancel()
+
+		if o.spec.purpose == kmspb.CryptoKey_MAC {
+			resp, err := m.kms.MacSign(ctx, &kmspb.MacSignRequest{Name: o.version, Data: data})
+			if err != nil {
+				return nil, kmsError(err, CKR_DATA_LEN_RANGE)
+			}
+			return resp.Mac, nil
+		}
+
+		req := &kmspb.AsymmetricSignRequest{Name: o.version}
+		switch {
+		case o.spec.hash == 0:
+			req.Data = data
+		case op.mech.Type == CKM_RSA_PKCS:
+			prefix := digestInfoPrefixes[o.spec.hash]
+			if len(data) != len(prefix)+o.spec.hash.Size() || !bytes.HasPrefix(data, prefix) {
+				return nil, CKR_DATA_INVALID
+			}
+			req.Digest = newDigest(o.spec.hash, data[len(prefix):])
+		default:
+			if len(data) != o.spec.hash.Size() {
+				return nil, CKR_DATA_LEN_RANGE
+			}
+			req.Digest = newDigest(o.spec.hash, data)
+		}
+		resp, err := m.kms.AsymmetricSign(ctx, req)
+		if err != nil {
+			return nil, kmsError(err, CKR_DATA_INVALID)
+		}
+		if op.mech.Type == CKM_ECDSA {
+			return rawECDSASignature(resp.Signature, (o.spec.bits+7)/8)
+		}
+		return resp.Signature, nil
+	})
+}
+
+// VerifyInit starts verification with a public key or MAC key
+func (m *Module) VerifyInit(h uint, mech Mechanism, key uint) error {
+	return m.initOperation(h, opVerify, mech, key, CKA_VERIFY)
+}
+
+// Verify checks a signature over data in one part, taking the same input
+// as Sign. It always ends the operation.
+func (m *Module) Verify(h uint, data, signature []byte) error {
+	_, err := m.finish(h, opVerify, 0, func(op *operation) ([]byte, error) {
+		o := op.obj
+		if o.spec.purpose == kmspb.CryptoKey_MAC {
+			ctx, cancel := m.context()
+			defer cancel()
+			resp, err := m.kms.MacVerify(ctx, &kmspb.MacVerifyRequest{Name: o.version, Data: data, Mac: signature})
+			if err != nil {
+				return nil, kmsError(err, CKR_DATA_LEN_RANGE)
+			}
+			if !resp.Success {
+				return nil, CKR_SIGNATURE_INVALID
+			}
+			return nil, nil
+		}
+
+		var ok bool
+		switch pub := o.public.(type) {
+		case *ecdsa.PublicKey:
+			size := (o.spec.bits + 7) / 8
+			if len(signature) != 2*size {
+				return nil, CKR_SIGNATURE_LEN_RANGE
+			}
+			r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+			ok = ecdsa.Verify(pub, data, r, s)
+		case ed25519.PublicKey:
+			ok = ed25519.Verify(pub, data, signature)
+		case *rsa.PublicKey:
+			if len(signature) != pub.Size() {
+				return nil, CKR_SIGNATURE_LEN_RANGE
+			}
+			if op.mech.Type == CKM_RSA_PKCS_PSS {
+				ok = rsa.VerifyPSS(pub, o.spec.hash, data, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+			} else {
+				// data is the DigestInfo (or raw data), signed as is
+				ok = rsa.VerifyPKCS1v15(pub, 0, data, signature) == nil
+			}
+		}
+		if !ok {
+			return nil, CKR_SIGNATURE_INVALID
+		}
+		return nil, nil
+	})
+	return err
+}
+
+// digestInfoPrefixes are the DER prefixes of PKCS#1 v1.5 DigestInfo values
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// DigestInfo returns the PKCS#1 v1.5 DigestInfo of a digest, the input of
+// CKM_RSA_PKCS signatures
+func DigestInfo(hash crypto.Hash, digest []byte) []byte {
+	return append(append([]byte(nil), digestInfoPrefixes[hash]...), digest...)
+}
+
+func newDigest(hash crypto.Hash, sum []byte) *kmspb.Digest {
+	switch hash {
+	case crypto.SHA384:
+		return &kmspb.Digest{Digest: &kmspb.Digest_Sha384{Sha384: sum}}
+	case crypto.SHA512:
+		return &kmspb.Digest{Digest: &kmspb.Digest_Sha512{Sha512: sum}}
+	default:
+		return &kmspb.Digest{Digest: &kmspb.Digest_Sha256{Sha256: sum}}
+	}
+}
+
+// rawECDSASignature converts an ASN.1 ECDSA signature to r || s
+func rawECDSASignature(der []byte, size int) ([]byte, error) {
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, CKR_DEVICE_ERROR
+	}
+	out := make([]byte, 2*size)
+	sig.R.FillBytes(out[:size])
+	sig.S.FillBytes(out[size:])
+	return out, nil
+}
+
+// GenerateKey creates a crypto key in the session's key ring with one
+// version and returns the handle of its secret key object. CKA_LABEL names
+// the key. CKM_AES_KEY_GEN creates an encryption key and
+// CKM_GENERIC_SECRET_KEY_GEN an HMAC-SHA256 key, unless CKA_KMS_ALGORITHM
+// picks another algorithm of the same kind.
+func (m *Module) GenerateKey(h uint, mech Mechanism, template []Attribute) (uint, error) {
+	var defaultAlgorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm
+	var keyType uint
+	switch mech.Type {
+	case CKM_AES_KEY_GEN:
+		defaultAlgorithm, keyType = kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, CKK_AES
+	case CKM_GENERIC_SECRET_KEY_GEN:
+		defaultAlgorithm, keyType = kmspb.CryptoKeyVersion_HMAC_SHA256, CKK_GENERIC_SECRET
+	default:
+		return 0, CKR_MECHANISM_INVALID
+	}
+	handles, err := m.generate(h, keyType, defaultAlgorithm, template)
+	if err != nil {
+		return 0, err
+	}
+	return handles[CKO_SECRET_KEY], nil
+}
+
+// GenerateKeyPair creates an asymmetric crypto key in the session's key
+// ring and returns the handles of its public and private key objects. The
+// algorithm is CKA_KMS_ALGORITHM if set, otherwise derived from the
+// templates: the curve of CKA_EC_PARAMS, or CKA_MODULUS_BITS (default 2048)
+// with SHA-256 and CKA_DECRYPT choosing OAEP decryption over PKCS#1 signing.
+func (m *Module) GenerateKeyPair(h uint, mech Mechanism, publicTemplate, privateTemplate []Attribute) (uint, uint, error) {
+	template := append(append([]Attribute(nil), publicTemplate...), privateTemplate...)
+	var defaultAlgorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm
+	var keyType uint
+	switch mech.Type {
+	case CKM_EC_KEY_PAIR_GEN:
+		keyType = CKK_EC
+		if params, ok := find(template, CKA_EC_PARAMS); ok {
+			var oid asn1.ObjectIdentifier
+			if _, err := asn1.Unmarshal(params, &oid); err != nil {
+				return 0, 0, CKR_ATTRIBUTE_VALUE_INVALID
+			}
+			switch {
+			case oid.Equal(oidP256):
+				defaultAlgorithm = kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256
+			case oid.Equal(oidP384):
+				defaultAlgorithm = kmspb.CryptoKeyVersion_EC_SIGN_P384_SHA384
+			default:
+				return 0, 0, CKR_ATTRIBUTE_VALUE_INVALID
+			}
+		}
+	case CKM_EC_EDWARDS_KEY_PAIR_GEN:
+		defaultAlgorithm, keyType = kmspb.CryptoKeyVersion_EC_SIGN_ED25519, CKK_EC_EDWARDS
+	case CKM_RSA_PKCS_KEY_PAIR_GEN:
+		keyType = CKK_RSA
+		bits := uint(2048)
+		if v, ok := find(publicTemplate, CKA_MODULUS_BITS); ok {
+			if bits, ok = ulongValue(v); !ok {
+				return 0, 0, CKR_ATTRIBUTE_VALUE_INVALID
+			}
+		}
+		kind := "SIGN_PKCS1"
+		if v, ok := find(privateTemplate, CKA_DECRYPT); ok && bytes.Equal(v, Bool(true)) {
+			kind = "DECRYPT_OAEP"
+		}
+		name := fmt.Sprintf("RSA_%s_%d_SHA256", kind, bits)
+		defaultAlgorithm = kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm(kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm_value[name])
+	default:
+		return 0, 0, CKR_MECHANISM_INVALID
+	}
+	handles, err := m.generate(h, keyType, defaultAlgorithm, template)
+	if err != nil {
+		return 0, 0, err
+	}
+	return handles[CKO_PUBLIC_KEY], handles[CKO_PRIVATE_KEY], nil
+}
+
+// generate creates a crypto key of keyType from a key generation template
+// and returns the handles of its first version's objects by class
+func (m *Module) generate(h uint, keyType uint, defaultAlgorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm, template []Attribute) (map[uint]uint, error) {
+	s, err := m.session(h)
+	if err != nil {
+		return nil, err
+	}
+	if !s.readWrite {
+		return nil, CKR_SESSION_READ_ONLY
+	}
+	label, ok := find(template, CKA_LABEL)
+	if !ok || len(label) == 0 {
+		return nil, CKR_TEMPLATE_INCOMPLETE
+	}
+	alg := defaultAlgorithm
+	if v, ok := find(template, CKA_KMS_ALGORITHM); ok {
+		n, ok := ulongValue(v)
+		if !ok {
+			return nil, CKR_ATTRIBUTE_VALUE_INVALID
+		}
+		alg = kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm(n)
+	}
+	spec, ok := algorithms[alg]
+	if !ok {
+		if alg == kmspb.CryptoKeyVersion_CRYPTO_KEY_VERSION_ALGORITHM_UNSPECIFIED {
+			return nil, CKR_TEMPLATE_INCOMPLETE
+		}
+		return nil, CKR_ATTRIBUTE_VALUE_INVALID
+	}
+	if spec.keyType != keyType {
+		return nil, CKR_TEMPLATE_INCONSISTENT
+	}
+
+	ring := m.tokens[s.slot].keyRing
+	ctx, cancel := m.context()
+	defer cancel()
+	ck, err := m.kms.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent:      ring,
+		CryptoKeyId: string(label),
+		CryptoKey: &kmspb.CryptoKey{
+			Purpose:         spec.purpose,
+			VersionTemplate: &kmspb.CryptoKeyVersionTemplate{Algorithm: alg},
+		},
+	})
+	if err != nil {
+		return nil, kmsError(err, CKR_ATTRIBUTE_VALUE_INVALID)
+	}
+	if err := m.load(s.slot, ck.Name); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	handles := make(map[uint]uint)
+	for _, o := range m.objects {
+		if strings.HasPrefix(o.version, ck.Name+"/cryptoKeyVersions/") {
+			handles[o.class] = o.handle
+		}
+	}
+	if len(handles) == 0 {
+		return nil, CKR_DEVICE_ERROR
+	}
+	return handles, nil
+}
+
+// find returns the value of an attribute in a template
+func find(template []Attribute, t uint) ([]byte, bool) {
+	for _, a := range template {
+		if a.Type == t {
+			return a.Value, true
+		}
+	}
+	return nil, false
+}
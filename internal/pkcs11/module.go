@@ -0,0 +1,365 @@
+// Package pkcs11 is a PKCS#11 token backed by the emulator, so software
+// that only speaks PKCS#11 can sign, encrypt and generate keys against the
+// same key store as Cloud KMS clients. cmd/kms-pkcs11 exposes it as a
+// PKCS#11 shared library; this package holds everything but the C ABI.
+//
+// Each configured key ring is one slot with one token. Every enabled
+// CryptoKeyVersion in the key ring is a key object labelled with its crypto
+// key ID and identified (CKA_ID) by its version name, so one label can match
+// several versions. Symmetric and MAC versions are secret keys; asymmetric
+// versions are a private key and a public key object.
+//
+// Private and secret key operations are calls to the emulator. Public key
+// operations (C_Verify with a public key, C_Encrypt with an RSA public key)
+// are computed locally from the version's public key, as Cloud KMS clients
+// do. Keys never leave the emulator: CKA_VALUE is always sensitive.
+//
+// The module follows Google's Cloud KMS PKCS#11 library where it can: the
+// same configuration file and CKA_KMS_ALGORITHM attribute, no login needed,
+// and any PIN accepted. Symmetric encryption uses the vendor mechanism
+// CKM_KMS_ENCRYPT, because the emulator's ciphertexts carry their own IV.
+package pkcs11
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Error is a PKCS#11 return value (CK_RV)
+type Error uint
+
+func (e Error) Error() string {
+	return fmt.Sprintf("pkcs11: CK_RV 0x%08X", uint(e))
+}
+
+// Manufacturer is the manufacturer ID of the library, slots and tokens
+const Manufacturer = "gcp-kms-emulator"
+
+// Module is an initialized PKCS#11 module
+type Module struct {
+	kms    kmspb.KeyManagementServiceClient
+	conn   *grpc.ClientConn
+	cfg    Config
+	tokens []*token
+
+	mu          sync.Mutex
+	sessions    map[uint]*session
+	nextSession uint
+	objects     map[uint]*object
+	handles     map[string]uint
+	nextObject  uint
+}
+
+// token is the token of one slot
+type token struct {
+	keyRing  string
+	label    string
+	loggedIn bool
+}
+
+// session is an open session and its active operations
+type session struct {
+	slot       uint
+	readWrite  bool
+	operations map[opKind]*operation
+}
+
+// Initialize loads the configuration at configPath (or $KMS_PKCS11_CONFIG)
+// and connects to the emulator, as C_Initialize does
+func Initialize(configPath string) (*Module, error) {
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.NewClient(cfg.KMSEndpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", cfg.KMSEndpoint, err)
+	}
+	m := New(conn, cfg)
+	m.conn = conn
+	return m, nil
+}
+
+// New returns a module for the tokens of cfg using the emulator on conn.
+// cfg must have been validated by LoadConfig.
+func New(conn grpc.ClientConnInterface, cfg Config) *Module {
+	m := &Module{
+		kms:         kmspb.NewKeyManagementServiceClient(conn),
+		cfg:         cfg,
+		sessions:    make(map[uint]*session),
+		nextSession: 1,
+		objects:     make(map[uint]*object),
+		handles:     make(map[string]uint),
+		nextObject:  1,
+	}
+	for _, t := range cfg.Tokens {
+		m.tokens = append(m.tokens, &token{keyRing: t.KeyRing, label: t.Label})
+	}
+	return m
+}
+
+// Finalize closes the connection Initialize opened, as C_Finalize does
+func (m *Module) Finalize() error {
+	if m.conn != nil {
+		return m.conn.Close()
+	}
+	return nil
+}
+
+// context returns the context of one call to the emulator
+func (m *Module) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), m.cfg.rpcTimeout())
+}
+
+// SlotInfo describes a slot (CK_SLOT_INFO)
+type SlotInfo struct {
+	Description string
+	Flags       uint
+}
+
+// TokenInfo describes a token (CK_TOKEN_INFO)
+type TokenInfo struct {
+	Label        string
+	Model        string
+	SerialNumber string
+	Flags        uint
+	SessionCount uint
+}
+
+// SessionInfo describes a session (CK_SESSION_INFO)
+type SessionInfo struct {
+	Slot  uint
+	State uint
+	Flags uint
+}
+
+// MechanismInfo describes a mechanism (CK_MECHANISM_INFO)
+type MechanismInfo struct {
+	MinKeySize uint
+	MaxKeySize uint
+	Flags      uint
+}
+
+// Slots returns the slot IDs, one per configured token
+func (m *Module) Slots() []uint {
+	ids := make([]uint, len(m.tokens))
+	for i := range m.tokens {
+		ids[i] = uint(i)
+	}
+	return ids
+}
+
+func (m *Module) token(slot uint) (*token, error) {
+	if slot >= uint(len(m.tokens)) {
+		return nil, CKR_SLOT_ID_INVALID
+	}
+	return m.tokens[slot], nil
+}
+
+// SlotInfo returns the description of a slot: its key ring
+func (m *Module) SlotInfo(slot uint) (SlotInfo, error) {
+	t, err := m.token(slot)
+	if err != nil {
+		return SlotInfo{}, err
+	}
+	return SlotInfo{Description: t.keyRing, Flags: CKF_TOKEN_PRESENT}, nil
+}
+
+// TokenInfo returns the description of a slot's token
+func (m *Module) TokenInfo(slot uint) (TokenInfo, error) {
+	t, err := m.token(slot)
+	if err != nil {
+		return TokenInfo{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var count uint
+	for _, s := range m.sessions {
+		if s.slot == slot {
+			count++
+		}
+	}
+	return TokenInfo{
+		Label:        t.label,
+		Model:        "Cloud KMS",
+		SerialNumber: fmt.Sprintf("%016x", slot),
+		Flags:        CKF_RNG | CKF_USER_PIN_INITIALIZED | CKF_TOKEN_INITIALIZED,
+		SessionCount: count,
+	}, nil
+}
+
+// OpenSession opens a session on a slot. flags must include
+// CKF_SERIAL_SESSION.
+func (m *Module) OpenSession(slot, flags uint) (uint, error) {
+	if _, err := m.token(slot); err != nil {
+		return 0, err
+	}
+	if flags&CKF_SERIAL_SESSION == 0 {
+		return 0, CKR_SESSION_PARALLEL_NOT_SUPPORTED
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.nextSession
+	m.nextSession++
+	m.sessions[h] = &session{slot: slot, readWrite: flags&CKF_RW_SESSION != 0, operations: make(map[opKind]*operation)}
+	return h, nil
+}
+
+// CloseSession closes a session and ends its operations
+func (m *Module) CloseSession(h uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[h]
+	if !ok {
+		return CKR_SESSION_HANDLE_INVALID
+	}
+	delete(m.sessions, h)
+	m.logoutIfLast(s.slot)
+	return nil
+}
+
+// CloseAllSessions closes every session of a slot
+func (m *Module) CloseAllSessions(slot uint) error {
+	if _, err := m.token(slot); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for h, s := range m.sessions {
+		if s.slot == slot {
+			delete(m.sessions, h)
+		}
+	}
+	m.logoutIfLast(slot)
+	return nil
+}
+
+// logoutIfLast logs the token out once its last session closes, as PKCS#11
+// requires. m.mu must be held.
+func (m *Module) logoutIfLast(slot uint) {
+	for _, s := range m.sessions {
+		if s.slot == slot {
+			return
+		}
+	}
+	m.tokens[slot].loggedIn = false
+}
+
+// session returns an open session
+func (m *Module) session(h uint) (*session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[h]
+	if !ok {
+		return nil, CKR_SESSION_HANDLE_INVALID
+	}
+	return s, nil
+}
+
+// SessionInfo returns the slot, state and flags of a session
+func (m *Module) SessionInfo(h uint) (SessionInfo, error) {
+	s, err := m.session(h)
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info := SessionInfo{Slot: s.slot, State: CKS_RO_PUBLIC_SESSION, Flags: CKF_SERIAL_SESSION}
+	loggedIn := m.tokens[s.slot].loggedIn
+	switch {
+	case s.readWrite && loggedIn:
+		info.State = CKS_RW_USER_FUNCTIONS
+	case s.readWrite:
+		info.State = CKS_RW_PUBLIC_SESSION
+	case loggedIn:
+		info.State = CKS_RO_USER_FUNCTIONS
+	}
+	if s.readWrite {
+		info.Flags |= CKF_RW_SESSION
+	}
+	return info, nil
+}
+
+// Login logs the normal user into a session's token. Any PIN is accepted:
+// the emulator authorizes calls itself, and no operation requires a login.
+func (m *Module) Login(h, userType uint) error {
+	s, err := m.session(h)
+	if err != nil {
+		return err
+	}
+	if userType != CKU_USER {
+		return CKR_USER_TYPE_INVALID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.tokens[s.slot]
+	if t.loggedIn {
+		return CKR_USER_ALREADY_LOGGED_IN
+	}
+	t.loggedIn = true
+	return nil
+}
+
+// Logout logs a session's token out
+func (m *Module) Logout(h uint) error {
+	s, err := m.session(h)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.tokens[s.slot]
+	if !t.loggedIn {
+		return CKR_USER_NOT_LOGGED_IN
+	}
+	t.loggedIn = false
+	return nil
+}
+
+// GenerateRandom returns n random bytes from the emulator's
+// GenerateRandomBytes in the location of the session's key ring
+func (m *Module) GenerateRandom(h uint, n int) ([]byte, error) {
+	s, err := m.session(h)
+	if err != nil {
+		return nil, err
+	}
+	location, _, _ := strings.Cut(m.tokens[s.slot].keyRing, "/keyRings/")
+	ctx, cancel := m.context()
+	defer cancel()
+	resp, err := m.kms.GenerateRandomBytes(ctx, &kmspb.GenerateRandomBytesRequest{
+		Location:        location,
+		LengthBytes:     int32(n),
+		ProtectionLevel: kmspb.ProtectionLevel_HSM,
+	})
+	if err != nil {
+		return nil, kmsError(err, CKR_ARGUMENTS_BAD)
+	}
+	return resp.Data, nil
+}
+
+// kmsError maps an emulator error to a return value; invalidArgument is
+// the value for INVALID_ARGUMENT, which depends on the call
+func kmsError(err error, invalidArgument Error) Error {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.OutOfRange:
+		return invalidArgument
+	case codes.NotFound:
+		return CKR_KEY_HANDLE_INVALID
+	case codes.FailedPrecondition:
+		return CKR_KEY_FUNCTION_NOT_PERMITTED
+	case codes.AlreadyExists:
+		return CKR_TEMPLATE_INCONSISTENT
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return CKR_DEVICE_ERROR
+	default:
+		return CKR_FUNCTION_FAILED
+	}
+}
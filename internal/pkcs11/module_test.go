@@ -0,0 +1,392 @@
+package pkcs11
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/pkg/emulator"
+)
+
+const testKeyRing = "projects/p/locations/global/keyRings/hsm"
+
+// newTestModule starts an emulator with testKeyRing and returns a module
+// with one token for it, a read-write session on that token and a KMS
+// client for the same emulator
+func newTestModule(t *testing.T) (*Module, uint, kmspb.KeyManagementServiceClient) {
+	t.Helper()
+	emu, err := emulator.Start(context.Background(), emulator.WithBufconn(), emulator.WithIAMMode("off"))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(func() { emu.Close() })
+	conn, err := emu.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	kms := kmspb.NewKeyManagementServiceClient(conn)
+	if _, err := kms.CreateKeyRing(context.Background(), &kmspb.CreateKeyRingRequest{
+		Parent: "projects/p/locations/global", KeyRingId: "hsm",
+	}); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	cfg := Config{Tokens: []TokenConfig{{KeyRing: testKeyRing}}}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate failed: %v", err)
+	}
+	m := New(conn, cfg)
+	h, err := m.OpenSession(0, CKF_SERIAL_SESSION|CKF_RW_SESSION)
+	if err != nil {
+		t.Fatalf("OpenSession failed: %v", err)
+	}
+	return m, h, kms
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "kms.yaml")
+	data := "tokens:\n  - key_ring: " + testKeyRing + "\nrpc_timeout_secs: 5\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(ConfigEnv, path)
+	t.Setenv("KMS_EMULATOR_HOST", "kms:9090")
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.Tokens[0].Label != "hsm" || cfg.KMSEndpoint != "kms:9090" || cfg.rpcTimeout().Seconds() != 5 {
+		t.Fatalf("Unexpected config: %+v", cfg)
+	}
+
+	for name, data := range map[string]string{
+		"no tokens":      "kms_endpoint: localhost:9090\n",
+		"bad key ring":   "tokens:\n  - key_ring: projects/p/keyRings/hsm\n",
+		"long label":     "tokens:\n  - key_ring: " + testKeyRing + "\n    label: a-label-longer-than-thirty-two-bytes\n",
+		"invalid syntax": "tokens: [",
+	} {
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("%s: LoadConfig succeeded", name)
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	m, h, _ := newTestModule(t)
+
+	if _, err := m.OpenSession(1, CKF_SERIAL_SESSION); err != CKR_SLOT_ID_INVALID {
+		t.Errorf("OpenSession of a missing slot: got %v", err)
+	}
+	if _, err := m.OpenSession(0, 0); err != CKR_SESSION_PARALLEL_NOT_SUPPORTED {
+		t.Errorf("OpenSession without CKF_SERIAL_SESSION: got %v", err)
+	}
+	ro, err := m.OpenSession(0, CKF_SERIAL_SESSION)
+	if err != nil {
+		t.Fatalf("OpenSession failed: %v", err)
+	}
+	if info, _ := m.TokenInfo(0); info.Label != "hsm" || info.SessionCount != 2 {
+		t.Errorf("Unexpected token info: %+v", info)
+	}
+
+	if err := m.Login(ro, CKU_SO); err != CKR_USER_TYPE_INVALID {
+		t.Errorf("Login as SO: got %v", err)
+	}
+	if err := m.Login(ro, CKU_USER); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if err := m.Login(h, CKU_USER); err != CKR_USER_ALREADY_LOGGED_IN {
+		t.Errorf("Second login: got %v", err)
+	}
+	if info, _ := m.SessionInfo(h); info.State != CKS_RW_USER_FUNCTIONS {
+		t.Errorf("Read-write session state: got %d", info.State)
+	}
+	if info, _ := m.SessionInfo(ro); info.State != CKS_RO_USER_FUNCTIONS || info.Flags&CKF_RW_SESSION != 0 {
+		t.Errorf("Read-only session info: got %+v", info)
+	}
+
+	// Closing the last session logs the token out
+	if err := m.CloseAllSessions(0); err != nil {
+		t.Fatalf("CloseAllSessions failed: %v", err)
+	}
+	if _, err := m.SessionInfo(h); err != CKR_SESSION_HANDLE_INVALID {
+		t.Errorf("SessionInfo of a closed session: got %v", err)
+	}
+	h, _ = m.OpenSession(0, CKF_SERIAL_SESSION)
+	if err := m.Logout(h); err != CKR_USER_NOT_LOGGED_IN {
+		t.Errorf("Logout after the sessions closed: got %v", err)
+	}
+
+	random, err := m.GenerateRandom(h, 32)
+	if err != nil || len(random) != 32 {
+		t.Errorf("GenerateRandom: got %d bytes, %v", len(random), err)
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	m, h, _ := newTestModule(t)
+	label := []Attribute{{CKA_LABEL, []byte("aes")}}
+
+	ro, _ := m.OpenSession(0, CKF_SERIAL_SESSION)
+	if _, err := m.GenerateKey(ro, Mechanism{Type: CKM_AES_KEY_GEN}, label); err != CKR_SESSION_READ_ONLY {
+		t.Errorf("GenerateKey in a read-only session: got %v", err)
+	}
+	if _, err := m.GenerateKey(h, Mechanism{Type: CKM_AES_KEY_GEN}, nil); err != CKR_TEMPLATE_INCOMPLETE {
+		t.Errorf("GenerateKey without a label: got %v", err)
+	}
+	key, err := m.GenerateKey(h, Mechanism{Type: CKM_AES_KEY_GEN}, label)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	if _, err := m.GenerateKey(h, Mechanism{Type: CKM_AES_KEY_GEN}, label); err != CKR_TEMPLATE_INCONSISTENT {
+		t.Errorf("GenerateKey of an existing key: got %v", err)
+	}
+
+	mech := Mechanism{Type: CKM_KMS_ENCRYPT, Parameter: []byte("aad")}
+	if err := m.EncryptInit(h, mech, key); err != nil {
+		t.Fatalf("EncryptInit failed: %v", err)
+	}
+	if err := m.EncryptInit(h, mech, key); err != CKR_OPERATION_ACTIVE {
+		t.Errorf("Second EncryptInit: got %v", err)
+	}
+	// A length query and a short buffer keep the operation active and
+	// return the same ciphertext as the final call
+	sized, err := m.Encrypt(h, []byte("secret"), -1)
+	if err != nil {
+		t.Fatalf("Encrypt length query failed: %v", err)
+	}
+	if _, err := m.Encrypt(h, []byte("secret"), 1); err != CKR_BUFFER_TOO_SMALL {
+		t.Errorf("Encrypt into a short buffer: got %v", err)
+	}
+	ciphertext, err := m.Encrypt(h, []byte("secret"), len(sized))
+	if err != nil || !bytes.Equal(ciphertext, sized) {
+		t.Fatalf("Encrypt: got %x, %v; want %x", ciphertext, err, sized)
+	}
+	if _, err := m.Encrypt(h, []byte("secret"), 1024); err != CKR_OPERATION_NOT_INITIALIZED {
+		t.Errorf("Encrypt after the operation ended: got %v", err)
+	}
+
+	if err := m.DecryptInit(h, mech, key); err != nil {
+		t.Fatalf("DecryptInit failed: %v", err)
+	}
+	plaintext, err := m.Decrypt(h, ciphertext, 1024)
+	if err != nil || string(plaintext) != "secret" {
+		t.Fatalf("Decrypt: got %q, %v", plaintext, err)
+	}
+	m.DecryptInit(h, Mechanism{Type: CKM_KMS_ENCRYPT, Parameter: []byte("other")}, key)
+	if _, err := m.Decrypt(h, ciphertext, 1024); err != CKR_ENCRYPTED_DATA_INVALID {
+		t.Errorf("Decrypt with other AAD: got %v", err)
+	}
+
+	if err := m.SignInit(h, Mechanism{Type: CKM_SHA256_HMAC}, key); err != CKR_KEY_TYPE_INCONSISTENT {
+		t.Errorf("SignInit with an encryption key: got %v", err)
+	}
+}
+
+func TestRSADecrypt(t *testing.T) {
+	m, h, _ := newTestModule(t)
+	pub, priv, err := m.GenerateKeyPair(h, Mechanism{Type: CKM_RSA_PKCS_KEY_PAIR_GEN},
+		[]Attribute{{CKA_MODULUS_BITS, ULong(3072)}},
+		[]Attribute{{CKA_LABEL, []byte("rsa")}, {CKA_DECRYPT, Bool(true)}})
+	if err != nil {
+		t.Fatalf("GenerateKeyPair failed: %v", err)
+	}
+	attrs, _ := m.GetAttributeValue(h, priv, []uint{CKA_KMS_ALGORITHM})
+	if alg, _ := ulongValue(attrs[0].Value); alg != uint(kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_3072_SHA256) {
+		t.Errorf("Algorithm: got %d", alg)
+	}
+
+	mech := Mechanism{Type: CKM_RSA_PKCS_OAEP, RSA: &RSAParams{Hash: CKM_SHA256, MGF: CKG_MGF1_SHA256}}
+	if err := m.EncryptInit(h, mech, priv); err != CKR_KEY_FUNCTION_NOT_PERMITTED {
+		t.Errorf("EncryptInit with the private key: got %v", err)
+	}
+	bad := Mechanism{Type: CKM_RSA_PKCS_OAEP, RSA: &RSAParams{Hash: CKM_SHA_1, MGF: CKG_MGF1_SHA1}}
+	if err := m.EncryptInit(h, bad, pub); err != CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("EncryptInit with SHA-1: got %v", err)
+	}
+	if err := m.EncryptInit(h, mech, pub); err != nil {
+		t.Fatalf("EncryptInit failed: %v", err)
+	}
+	ciphertext, err := m.Encrypt(h, []byte("secret"), 1024)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if err := m.DecryptInit(h, mech, priv); err != nil {
+		t.Fatalf("DecryptInit failed: %v", err)
+	}
+	plaintext, err := m.Decrypt(h, ciphertext, 1024)
+	if err != nil || string(plaintext) != "secret" {
+		t.Fatalf("Decrypt: got %q, %v", plaintext, err)
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	p256, _ := asn1.Marshal(oidP256)
+	digest := sha256.Sum256([]byte("message"))
+	pss := &RSAParams{Hash: CKM_SHA256, MGF: CKG_MGF1_SHA256, SaltLength: 32}
+
+	tests := []struct {
+		name      string
+		gen       uint
+		template  []Attribute
+		mech      Mechanism
+		data      []byte
+		symmetric bool
+	}{
+		{name: "ecdsa", gen: CKM_EC_KEY_PAIR_GEN, template: []Attribute{{CKA_EC_PARAMS, p256}}, mech: Mechanism{Type: CKM_ECDSA}, data: digest[:]},
+		{name: "eddsa", gen: CKM_EC_EDWARDS_KEY_PAIR_GEN, mech: Mechanism{Type: CKM_EDDSA}, data: []byte("message")},
+		{name: "pkcs1", gen: CKM_RSA_PKCS_KEY_PAIR_GEN, mech: Mechanism{Type: CKM_RSA_PKCS}, data: DigestInfo(crypto.SHA256, digest[:])},
+		{name: "pss", gen: CKM_RSA_PKCS_KEY_PAIR_GEN, template: []Attribute{{CKA_KMS_ALGORITHM, ULong(uint(kmspb.CryptoKeyVersion_RSA_SIGN_PSS_2048_SHA256))}}, mech: Mechanism{Type: CKM_RSA_PKCS_PSS, RSA: pss}, data: digest[:]},
+		{name: "hmac", gen: CKM_GENERIC_SECRET_KEY_GEN, mech: Mechanism{Type: CKM_SHA256_HMAC}, data: []byte("message"), symmetric: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, h, _ := newTestModule(t)
+			template := append(tt.template, Attribute{CKA_LABEL, []byte(tt.name)})
+			var pub, priv uint
+			var err error
+			if tt.symmetric {
+				priv, err = m.GenerateKey(h, Mechanism{Type: tt.gen}, template)
+				pub = priv
+			} else {
+				pub, priv, err = m.GenerateKeyPair(h, Mechanism{Type: tt.gen}, template, nil)
+			}
+			if err != nil {
+				t.Fatalf("Generate failed: %v", err)
+			}
+
+			if err := m.SignInit(h, tt.mech, priv); err != nil {
+				t.Fatalf("SignInit failed: %v", err)
+			}
+			sig, err := m.Sign(h, tt.data, 1024)
+			if err != nil {
+				t.Fatalf("Sign failed: %v", err)
+			}
+			if err := m.VerifyInit(h, tt.mech, pub); err != nil {
+				t.Fatalf("VerifyInit failed: %v", err)
+			}
+			if err := m.Verify(h, tt.data, sig); err != nil {
+				t.Fatalf("Verify failed: %v", err)
+			}
+			sig[len(sig)-1] ^= 1
+			m.VerifyInit(h, tt.mech, pub)
+			if err := m.Verify(h, tt.data, sig); err != CKR_SIGNATURE_INVALID {
+				t.Errorf("Verify of a tampered signature: got %v", err)
+			}
+		})
+	}
+}
+
+func TestECDSASignatureFormat(t *testing.T) {
+	m, h, _ := newTestModule(t)
+	p384, _ := asn1.Marshal(oidP384)
+	pub, priv, err := m.GenerateKeyPair(h, Mechanism{Type: CKM_EC_KEY_PAIR_GEN},
+		[]Attribute{{CKA_EC_PARAMS, p384}}, []Attribute{{CKA_LABEL, []byte("ec")}})
+	if err != nil {
+		t.Fatalf("GenerateKeyPair failed: %v", err)
+	}
+
+	m.SignInit(h, Mechanism{Type: CKM_ECDSA}, priv)
+	if _, err := m.Sign(h, make([]byte, 32), 1024); err != CKR_DATA_LEN_RANGE {
+		t.Errorf("Sign of a SHA-256 digest with a P-384 key: got %v", err)
+	}
+	digest := crypto.SHA384.New().Sum(nil)
+	m.SignInit(h, Mechanism{Type: CKM_ECDSA}, priv)
+	sig, err := m.Sign(h, digest, 1024)
+	if err != nil || len(sig) != 96 {
+		t.Fatalf("Sign: got %d bytes, %v", len(sig), err)
+	}
+
+	attrs, err := m.GetAttributeValue(h, pub, []uint{CKA_PUBLIC_KEY_INFO})
+	if err != nil {
+		t.Fatalf("GetAttributeValue failed: %v", err)
+	}
+	key, err := x509.ParsePKIXPublicKey(attrs[0].Value)
+	if err != nil {
+		t.Fatalf("ParsePKIXPublicKey failed: %v", err)
+	}
+	r, s := new(big.Int).SetBytes(sig[:48]), new(big.Int).SetBytes(sig[48:])
+	if !ecdsa.Verify(key.(*ecdsa.PublicKey), digest, r, s) {
+		t.Error("r || s signature does not verify")
+	}
+}
+
+func TestFindObjects(t *testing.T) {
+	m, h, kms := newTestModule(t)
+	ctx := context.Background()
+
+	// Keys created outside the module are found, and every enabled
+	// version is an object
+	key, err := kms.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent: testKeyRing, CryptoKeyId: "external",
+		CryptoKey: &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT},
+	})
+	if err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+	if _, err := kms.CreateCryptoKeyVersion(ctx, &kmspb.CreateCryptoKeyVersionRequest{Parent: key.Name}); err != nil {
+		t.Fatalf("CreateCryptoKeyVersion failed: %v", err)
+	}
+	if _, _, err := m.GenerateKeyPair(h, Mechanism{Type: CKM_EC_EDWARDS_KEY_PAIR_GEN}, nil, []Attribute{{CKA_LABEL, []byte("ed")}}); err != nil {
+		t.Fatalf("GenerateKeyPair failed: %v", err)
+	}
+
+	find := func(template []Attribute) []uint {
+		t.Helper()
+		if err := m.FindObjectsInit(h, template); err != nil {
+			t.Fatalf("FindObjectsInit failed: %v", err)
+		}
+		defer m.FindObjectsFinal(h)
+		var all []uint
+		for {
+			found, err := m.FindObjects(h, 1)
+			if err != nil {
+				t.Fatalf("FindObjects failed: %v", err)
+			}
+			if len(found) == 0 {
+				return all
+			}
+			all = append(all, found...)
+		}
+	}
+	if n := len(find(nil)); n != 4 {
+		t.Errorf("All objects: got %d, want 4", n)
+	}
+	external := find([]Attribute{{CKA_LABEL, []byte("external")}})
+	if len(external) != 2 {
+		t.Fatalf("Objects labelled external: got %d, want 2", len(external))
+	}
+	if n := len(find([]Attribute{{CKA_CLASS, ULong(CKO_PRIVATE_KEY)}, {CKA_KEY_TYPE, ULong(CKK_EC_EDWARDS)}})); n != 1 {
+		t.Errorf("Ed25519 private keys: got %d, want 1", n)
+	}
+	// Handles are stable across searches
+	if again := find([]Attribute{{CKA_LABEL, []byte("external")}}); again[0] != external[0] {
+		t.Errorf("Handle changed from %d to %d", external[0], again[0])
+	}
+
+	attrs, err := m.GetAttributeValue(h, external[0], []uint{CKA_ID, CKA_VALUE_LEN, CKA_VALUE})
+	if err != CKR_ATTRIBUTE_SENSITIVE {
+		t.Errorf("GetAttributeValue of CKA_VALUE: got %v", err)
+	}
+	if string(attrs[0].Value) != key.Name+"/cryptoKeyVersions/1" || !bytes.Equal(attrs[1].Value, ULong(32)) || attrs[2].Value != nil {
+		t.Errorf("Unexpected attributes: %+v", attrs)
+	}
+	if _, err := m.GetAttributeValue(h, 1000, []uint{CKA_ID}); !errors.Is(err, CKR_OBJECT_HANDLE_INVALID) {
+		t.Errorf("GetAttributeValue of a missing object: got %v", err)
+	}
+}
@@ -0,0 +1,473 @@
+package pkcs11
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/api/iterator"
+)
+
+// ULongSize is the size of CK_ULONG. The module supports LP64 platforms,
+// where CK_ULONG is an 8-byte unsigned long; cmd/kms-pkcs11 checks this at
+// compile time.
+const ULongSize = 8
+
+// Attribute is a PKCS#11 attribute with its value in C encoding: CK_ULONG
+// values in native byte order, CK_BBOOL as one byte
+type Attribute struct {
+	Type  uint
+	Value []byte
+}
+
+// ULong encodes a CK_ULONG attribute value
+func ULong(v uint) []byte {
+	b := make([]byte, ULongSize)
+	binary.NativeEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+// Bool encodes a CK_BBOOL attribute value
+func Bool(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// ulongValue decodes a CK_ULONG attribute value
+func ulongValue(b []byte) (uint, bool) {
+	if len(b) != ULongSize {
+		return 0, false
+	}
+	return uint(binary.NativeEndian.Uint64(b)), true
+}
+
+// algorithm describes how a CryptoKeyVersionAlgorithm maps to PKCS#11
+type algorithm struct {
+	purpose kmspb.CryptoKey_CryptoKeyPurpose
+	keyType uint
+	// mechanism is the signing, encryption or MAC mechanism of the key
+	mechanism uint
+	// hash is the digest the key signs, MACs or uses for OAEP; zero for
+	// keys that sign data, such as Ed25519 and raw PKCS#1
+	hash crypto.Hash
+	// bits is the RSA modulus or secret key size
+	bits int
+}
+
+var algorithms = map[kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm]algorithm{
+	kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION: {kmspb.CryptoKey_ENCRYPT_DECRYPT, CKK_AES, CKM_KMS_ENCRYPT, 0, 256},
+
+	kmspb.CryptoKeyVersion_HMAC_SHA1:   {kmspb.CryptoKey_MAC, CKK_GENERIC_SECRET, CKM_SHA_1_HMAC, crypto.SHA1, 160},
+	kmspb.CryptoKeyVersion_HMAC_SHA224: {kmspb.CryptoKey_MAC, CKK_GENERIC_SECRET, CKM_SHA224_HMAC, crypto.SHA224, 224},
+	kmspb.CryptoKeyVersion_HMAC_SHA256: {kmspb.CryptoKey_MAC, CKK_GENERIC_SECRET, CKM_SHA256_HMAC, crypto.SHA256, 256},
+	kmspb.CryptoKeyVersion_HMAC_SHA384: {kmspb.CryptoKey_MAC, CKK_GENERIC_SECRET, CKM_SHA384_HMAC, crypto.SHA384, 384},
+	kmspb.CryptoKeyVersion_HMAC_SHA512: {kmspb.CryptoKey_MAC, CKK_GENERIC_SECRET, CKM_SHA512_HMAC, crypto.SHA512, 512},
+
+	kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256: {kmspb.CryptoKey_ASYMMETRIC_SIGN, CKK_EC, CKM_ECDSA, crypto.SHA256, 256},
+	kmspb.CryptoKeyVersion_EC_SIGN_P384_SHA384: {kmspb.CryptoKey_ASYMMETRIC_SIGN, CKK_EC, CKM_ECDSA, crypto.SHA384, 384},
+	kmspb.CryptoKeyVersion_EC_SIGN_ED25519:     {kmspb.CryptoKey_ASYMMETRIC_SIGN, CKK_EC_EDWARDS, CKM_EDDSA, 0, 256},
+
+	kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_2048_SHA256: {kmspb.CryptoKey_ASYMMETRIC_SIGN, CKK_RSA, CKM_RSA_PKCS, crypto.SHA256, 2048},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_3072_SHA256: {kmspb.CryptoKey_ASYMMETRIC_SIGN, CKK_RSA, CKM_RSA_PKCS, crypto.SHA256, 3072},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_4096_SHA256: {kmspb.CryptoKey_ASYMMETRIC_SIGN, CKK_RSA, CKM_RSA_PKCS, crypto.SHA256, 4096},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_4096_SHA512: {kmspb.CryptoKey_ASYMMETRIC_SIGN, CKK_RSA, CKM_RSA_PKCS, crypto.SHA512, 4096},
+	kmspb.CryptoKeyVersion_RSA_SIGN_RAW_PKCS1_2048:    {kmspb.CryptoKey_ASYMMETRIC_SIGN, CKK_RSA, CKM_RSA_PKCS, 0, 2048},
+	kmspb.CryptoKeyVersion_RSA_SIGN_RAW_PKCS1_3072:    {kmspb.CryptoKey_ASYMMETRIC_SIGN, CKK_RSA, CKM_RSA_PKCS, 0, 3072},
+	kmspb.CryptoKeyVersion_RSA_SIGN_RAW_PKCS1_4096:    {kmspb.CryptoKey_ASYMMETRIC_SIGN, CKK_RSA, CKM_RSA_PKCS, 0, 4096},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PSS_2048_SHA256:   {kmspb.CryptoKey_ASYMMETRIC_SIGN, CKK_RSA, CKM_RSA_PKCS_PSS, crypto.SHA256, 2048},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PSS_3072_SHA256:   {kmspb.CryptoKey_ASYMMETRIC_SIGN, CKK_RSA, CKM_RSA_PKCS_PSS, crypto.SHA256, 3072},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PSS_4096_SHA256:   {kmspb.CryptoKey_ASYMMETRIC_SIGN, CKK_RSA, CKM_RSA_PKCS_PSS, crypto.SHA256, 4096},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PSS_4096_SHA512:   {kmspb.CryptoKey_ASYMMETRIC_SIGN, CKK_RSA, CKM_RSA_PKCS_PSS, crypto.SHA512, 4096},
+
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_2048_SHA1:   {kmspb.CryptoKey_ASYMMETRIC_DECRYPT, CKK_RSA, CKM_RSA_PKCS_OAEP, crypto.SHA1, 2048},
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_2048_SHA256: {kmspb.CryptoKey_ASYMMETRIC_DECRYPT, CKK_RSA, CKM_RSA_PKCS_OAEP, crypto.SHA256, 2048},
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_3072_SHA1:   {kmspb.CryptoKey_ASYMMETRIC_DECRYPT, CKK_RSA, CKM_RSA_PKCS_OAEP, crypto.SHA1, 3072},
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_3072_SHA256: {kmspb.CryptoKey_ASYMMETRIC_DECRYPT, CKK_RSA, CKM_RSA_PKCS_OAEP, crypto.SHA256, 3072},
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_4096_SHA1:   {kmspb.CryptoKey_ASYMMETRIC_DECRYPT, CKK_RSA, CKM_RSA_PKCS_OAEP, crypto.SHA1, 4096},
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_4096_SHA256: {kmspb.CryptoKey_ASYMMETRIC_DECRYPT, CKK_RSA, CKM_RSA_PKCS_OAEP, crypto.SHA256, 4096},
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_4096_SHA512: {kmspb.CryptoKey_ASYMMETRIC_DECRYPT, CKK_RSA, CKM_RSA_PKCS_OAEP, crypto.SHA512, 4096},
+}
+
+// object is a key object: one class of one enabled version
+type object struct {
+	handle    uint
+	slot      uint
+	class     uint
+	version   string
+	algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm
+	spec      algorithm
+	public    crypto.PublicKey
+	attrs     map[uint][]byte
+}
+
+// cryptoKey returns the name of the object's crypto key
+func (o *object) cryptoKey() string {
+	key, _, _ := strings.Cut(o.version, "/cryptoKeyVersions/")
+	return key
+}
+
+// can reports whether the object permits an operation, such as CKA_SIGN
+func (o *object) can(attr uint) bool {
+	return bytes.Equal(o.attrs[attr], Bool(true))
+}
+
+// Curve OIDs of CKA_EC_PARAMS
+var (
+	oidP256    = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidP384    = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+// newObjects returns the key objects of an enabled version: a secret key,
+// or a private and public key pair
+func newObjects(slot uint, v *kmspb.CryptoKeyVersion, publicPEM string) ([]*object, error) {
+	spec, ok := algorithms[v.Algorithm]
+	if !ok {
+		return nil, nil
+	}
+	keyName, _, _ := strings.Cut(v.Name, "/cryptoKeyVersions/")
+	common := map[uint][]byte{
+		CKA_TOKEN:         Bool(true),
+		CKA_PRIVATE:       Bool(false),
+		CKA_LABEL:         []byte(keyName[strings.LastIndex(keyName, "/")+1:]),
+		CKA_ID:            []byte(v.Name),
+		CKA_KEY_TYPE:      ULong(spec.keyType),
+		CKA_MODIFIABLE:    Bool(false),
+		CKA_COPYABLE:      Bool(false),
+		CKA_DESTROYABLE:   Bool(false),
+		CKA_DERIVE:        Bool(false),
+		CKA_LOCAL:         Bool(v.ImportJob == ""),
+		CKA_KMS_ALGORITHM: ULong(uint(v.Algorithm)),
+	}
+	sensitive := map[uint][]byte{
+		CKA_SENSITIVE:           Bool(true),
+		CKA_ALWAYS_SENSITIVE:    Bool(true),
+		CKA_EXTRACTABLE:         Bool(false),
+		CKA_NEVER_EXTRACTABLE:   Bool(true),
+		CKA_ALWAYS_AUTHENTICATE: Bool(false),
+		CKA_WRAP:                Bool(false),
+		CKA_UNWRAP:              Bool(false),
+		CKA_SIGN_RECOVER:        Bool(false),
+	}
+	newObject := func(class uint, sets ...map[uint][]byte) *object {
+		o := &object{slot: slot, class: class, version: v.Name, algorithm: v.Algorithm, spec: spec, attrs: map[uint][]byte{CKA_CLASS: ULong(class)}}
+		for _, set := range append([]map[uint][]byte{common}, sets...) {
+			for k, val := range set {
+				o.attrs[k] = val
+			}
+		}
+		return o
+	}
+
+	if spec.purpose == kmspb.CryptoKey_ENCRYPT_DECRYPT || spec.purpose == kmspb.CryptoKey_MAC {
+		encrypt := spec.purpose == kmspb.CryptoKey_ENCRYPT_DECRYPT
+		return []*object{newObject(CKO_SECRET_KEY, sensitive, map[uint][]byte{
+			CKA_ENCRYPT:   Bool(encrypt),
+			CKA_DECRYPT:   Bool(encrypt),
+			CKA_SIGN:      Bool(!encrypt),
+			CKA_VERIFY:    Bool(!encrypt),
+			CKA_VALUE_LEN: ULong(uint(spec.bits / 8)),
+		})}, nil
+	}
+
+	block, _ := pem.Decode([]byte(publicPEM))
+	if block == nil {
+		return nil, fmt.Errorf("invalid public key PEM for %s", v.Name)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key for %s: %w", v.Name, err)
+	}
+	keyAttrs, pubAttrs, err := publicKeyAttributes(pub)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", v.Name, err)
+	}
+	pubAttrs[CKA_PUBLIC_KEY_INFO] = block.Bytes
+
+	decrypt := spec.purpose == kmspb.CryptoKey_ASYMMETRIC_DECRYPT
+	private := newObject(CKO_PRIVATE_KEY, sensitive, keyAttrs, map[uint][]byte{
+		CKA_SIGN:    Bool(!decrypt),
+		CKA_DECRYPT: Bool(decrypt),
+	})
+	public := newObject(CKO_PUBLIC_KEY, keyAttrs, pubAttrs, map[uint][]byte{
+		CKA_VERIFY:         Bool(!decrypt),
+		CKA_ENCRYPT:        Bool(decrypt),
+		CKA_WRAP:           Bool(false),
+		CKA_VERIFY_RECOVER: Bool(false),
+	})
+	private.public, public.public = pub, pub
+	return []*object{private, public}, nil
+}
+
+// publicKeyAttributes returns the attributes describing a public key on
+// both key objects, and those only on the public key object
+func publicKeyAttributes(pub crypto.PublicKey) (both, public map[uint][]byte, err error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		both = map[uint][]byte{
+			CKA_MODULUS:         k.N.Bytes(),
+			CKA_PUBLIC_EXPONENT: big.NewInt(int64(k.E)).Bytes(),
+		}
+		return both, map[uint][]byte{CKA_MODULUS_BITS: ULong(uint(k.N.BitLen()))}, nil
+	case *ecdsa.PublicKey:
+		oid := oidP256
+		if k.Curve == elliptic.P384() {
+			oid = oidP384
+		}
+		params, _ := asn1.Marshal(oid)
+		ecdhKey, err := k.ECDH()
+		if err != nil {
+			return nil, nil, err
+		}
+		ecPoint, _ := asn1.Marshal(ecdhKey.Bytes())
+		return map[uint][]byte{CKA_EC_PARAMS: params}, map[uint][]byte{CKA_EC_POINT: ecPoint}, nil
+	case ed25519.PublicKey:
+		params, _ := asn1.Marshal(oidEd25519)
+		ecPoint, _ := asn1.Marshal([]byte(k))
+		return map[uint][]byte{CKA_EC_PARAMS: params}, map[uint][]byte{CKA_EC_POINT: ecPoint}, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// load replaces the objects of one crypto key, or of the whole token when
+// key is empty, with those of the enabled versions now in the emulator.
+// Handles stay stable for versions that remain.
+func (m *Module) load(slot uint, key string) error {
+	ctx, cancel := m.context()
+	defer cancel()
+
+	keys := []string{key}
+	if key == "" {
+		keys = nil
+		it := m.listCryptoKeys(ctx, m.tokens[slot].keyRing)
+		for {
+			ck, err := it.Next()
+			if errors.Is(err, iterator.Done) {
+				break
+			}
+			if err != nil {
+				return kmsError(err, CKR_FUNCTION_FAILED)
+			}
+			keys = append(keys, ck.Name)
+		}
+	}
+
+	var loaded []*object
+	for _, name := range keys {
+		it := m.listVersions(ctx, name)
+		for {
+			v, err := it.Next()
+			if errors.Is(err, iterator.Done) {
+				break
+			}
+			if err != nil {
+				return kmsError(err, CKR_FUNCTION_FAILED)
+			}
+			if v.State != kmspb.CryptoKeyVersion_ENABLED {
+				continue
+			}
+			var publicPEM string
+			if spec, ok := algorithms[v.Algorithm]; ok && spec.purpose != kmspb.CryptoKey_ENCRYPT_DECRYPT && spec.purpose != kmspb.CryptoKey_MAC {
+				pk, err := m.kms.GetPublicKey(ctx, &kmspb.GetPublicKeyRequest{Name: v.Name})
+				if err != nil {
+					return kmsError(err, CKR_FUNCTION_FAILED)
+				}
+				publicPEM = pk.Pem
+			}
+			objs, err := newObjects(slot, v, publicPEM)
+			if err != nil {
+				return CKR_DEVICE_ERROR
+			}
+			loaded = append(loaded, objs...)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for h, o := range m.objects {
+		if o.slot == slot && (key == "" || o.cryptoKey() == key) {
+			delete(m.objects, h)
+		}
+	}
+	for _, o := range loaded {
+		id := fmt.Sprintf("%s#%d", o.version, o.class)
+		h, ok := m.handles[id]
+		if !ok {
+			h = m.nextObject
+			m.nextObject++
+			m.handles[id] = h
+		}
+		o.handle = h
+		m.objects[h] = o
+	}
+	return nil
+}
+
+// pageIterator pages through a list call
+type pageIterator[T any] struct {
+	items []T
+	token string
+	done  bool
+	fetch func(token string) ([]T, string, error)
+}
+
+func (it *pageIterator[T]) Next() (T, error) {
+	var zero T
+	for len(it.items) == 0 {
+		if it.done {
+			return zero, iterator.Done
+		}
+		items, next, err := it.fetch(it.token)
+		if err != nil {
+			return zero, err
+		}
+		it.items, it.token, it.done = items, next, next == ""
+	}
+	item := it.items[0]
+	it.items = it.items[1:]
+	return item, nil
+}
+
+func (m *Module) listCryptoKeys(ctx context.Context, ring string) *pageIterator[*kmspb.CryptoKey] {
+	return &pageIterator[*kmspb.CryptoKey]{fetch: func(token string) ([]*kmspb.CryptoKey, string, error) {
+		resp, err := m.kms.ListCryptoKeys(ctx, &kmspb.ListCryptoKeysRequest{Parent: ring, PageToken: token})
+		if err != nil {
+			return nil, "", err
+		}
+		return resp.CryptoKeys, resp.NextPageToken, nil
+	}}
+}
+
+func (m *Module) listVersions(ctx context.Context, key string) *pageIterator[*kmspb.CryptoKeyVersion] {
+	return &pageIterator[*kmspb.CryptoKeyVersion]{fetch: func(token string) ([]*kmspb.CryptoKeyVersion, string, error) {
+		resp, err := m.kms.ListCryptoKeyVersions(ctx, &kmspb.ListCryptoKeyVersionsRequest{Parent: key, PageToken: token})
+		if err != nil {
+			return nil, "", err
+		}
+		return resp.CryptoKeyVersions, resp.NextPageToken, nil
+	}}
+}
+
+// object returns a key object of a session's token
+func (m *Module) object(s *session, h uint) (*object, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.objects[h]
+	if !ok || o.slot != s.slot {
+		return nil, CKR_OBJECT_HANDLE_INVALID
+	}
+	return o, nil
+}
+
+// FindObjectsInit starts a search for the objects matching template. The
+// token's objects are reloaded first, so keys created since are found.
+func (m *Module) FindObjectsInit(h uint, template []Attribute) error {
+	s, err := m.session(h)
+	if err != nil {
+		return err
+	}
+	if m.operation(s, opFind) != nil {
+		return CKR_OPERATION_ACTIVE
+	}
+	if err := m.load(s.slot, ""); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	var found []uint
+	for h, o := range m.objects {
+		if o.slot == s.slot && matches(o, template) {
+			found = append(found, h)
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(found, func(i, j int) bool { return found[i] < found[j] })
+	m.setOperation(s, opFind, &operation{found: found})
+	return nil
+}
+
+// matches reports whether an object has every attribute of template
+func matches(o *object, template []Attribute) bool {
+	for _, a := range template {
+		if v, ok := o.attrs[a.Type]; !ok || !bytes.Equal(v, a.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// FindObjects returns up to max more handles of the active search
+func (m *Module) FindObjects(h uint, max int) ([]uint, error) {
+	s, err := m.session(h)
+	if err != nil {
+		return nil, err
+	}
+	op := m.operation(s, opFind)
+	if op == nil {
+		return nil, CKR_OPERATION_NOT_INITIALIZED
+	}
+	n := min(max, len(op.found))
+	found := op.found[:n]
+	op.found = op.found[n:]
+	return found, nil
+}
+
+// FindObjectsFinal ends the active search
+func (m *Module) FindObjectsFinal(h uint) error {
+	s, err := m.session(h)
+	if err != nil {
+		return err
+	}
+	if m.operation(s, opFind) == nil {
+		return CKR_OPERATION_NOT_INITIALIZED
+	}
+	m.setOperation(s, opFind, nil)
+	return nil
+}
+
+// GetAttributeValue returns the values of the attributes types of an
+// object. Attributes that cannot be read have a nil value, and the error
+// says why: CKR_ATTRIBUTE_SENSITIVE for key material, otherwise
+// CKR_ATTRIBUTE_TYPE_INVALID.
+func (m *Module) GetAttributeValue(h, obj uint, types []uint) ([]Attribute, error) {
+	s, err := m.session(h)
+	if err != nil {
+		return nil, err
+	}
+	o, err := m.object(s, obj)
+	if err != nil {
+		return nil, err
+	}
+	attrs := make([]Attribute, len(types))
+	var result error
+	for i, t := range types {
+		attrs[i].Type = t
+		if v, ok := o.attrs[t]; ok {
+			attrs[i].Value = v
+			continue
+		}
+		if t == CKA_VALUE && o.class != CKO_PUBLIC_KEY {
+			result = CKR_ATTRIBUTE_SENSITIVE
+		} else if result == nil {
+			result = CKR_ATTRIBUTE_TYPE_INVALID
+		}
+	}
+	return attrs, result
+}
@@ -0,0 +1,95 @@
+package principal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// ImpersonateHeader is the HTTP header and gRPC metadata key naming the
+// service accounts a call impersonates, like gcloud's
+// --impersonate-service-account: one service account, or a comma-separated
+// delegation chain ending with the effective one.
+const ImpersonateHeader = "x-emulator-impersonate"
+
+// maxDelegates is the longest delegation chain accepted, as in the IAM
+// Credentials API
+const maxDelegates = 10
+
+// Delegation is the impersonation chain of a call. Each principal in the
+// chain needs iam.serviceAccounts.getAccessToken on the next service
+// account, as when creating impersonated credentials.
+//
+// A call impersonates with ImpersonateHeader, or with a JWT whose act claim
+// (RFC 8693) names the party acting as its subject; nested act claims are
+// earlier links of the chain.
+type Delegation struct {
+	// Caller is the principal that authenticated, or "" if anonymous
+	Caller string
+	// Delegates are the service accounts impersonated in turn; the last is
+	// the effective principal
+	Delegates []string
+}
+
+// Effective returns the principal the call acts as
+func (d Delegation) Effective() string {
+	return d.Delegates[len(d.Delegates)-1]
+}
+
+// Links returns each step of the chain as the impersonating principal and
+// the service account it impersonates
+func (d Delegation) Links() [][2]string {
+	links := make([][2]string, len(d.Delegates))
+	from := d.Caller
+	for i, to := range d.Delegates {
+		links[i] = [2]string{from, to}
+		from = to
+	}
+	return links
+}
+
+// String returns the chain as "caller -> delegate -> ..."
+func (d Delegation) String() string {
+	caller := d.Caller
+	if caller == "" {
+		caller = "anonymous"
+	}
+	return strings.Join(append([]string{caller}, d.Delegates...), " -> ")
+}
+
+type delegationKey struct{}
+
+// DelegationFromContext returns the impersonation chain of a call, or false
+// if it does not impersonate
+func DelegationFromContext(ctx context.Context) (Delegation, bool) {
+	d, ok := ctx.Value(delegationKey{}).(Delegation)
+	return d, ok
+}
+
+// ServiceAccountResource returns the IAM resource name of a service account
+// principal, against which impersonation is checked
+func ServiceAccountResource(principal string) string {
+	return "projects/-/serviceAccounts/" + strings.TrimPrefix(principal, "serviceAccount:")
+}
+
+// parseImpersonation parses ImpersonateHeader values into service account
+// principals
+func parseImpersonation(values []string) ([]string, error) {
+	var delegates []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			email := strings.TrimPrefix(strings.TrimSpace(item), "serviceAccount:")
+			if email == "" {
+				continue
+			}
+			if !strings.Contains(email, "@") || !strings.HasSuffix(email, ".gserviceaccount.com") {
+				return nil, fmt.Errorf("%s must name service accounts, got %q", ImpersonateHeader, item)
+			}
+			delegates = append(delegates, "serviceAccount:"+email)
+		}
+	}
+	if len(delegates) > maxDelegates {
+		return nil, fmt.Errorf("%s names %d service accounts; at most %d can be chained", ImpersonateHeader, len(delegates), maxDelegates)
+	}
+	return delegates, nil
+}
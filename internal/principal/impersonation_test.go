@@ -0,0 +1,59 @@
+package principal
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestImpersonation(t *testing.T) {
+	const (
+		dev = "user:dev@example.com"
+		app = "serviceAccount:app@p.iam.gserviceaccount.com"
+		ci  = "serviceAccount:ci@p.iam.gserviceaccount.com"
+	)
+	tests := []struct {
+		name       string
+		md         metadata.MD
+		effective  string
+		delegation string
+		code       codes.Code
+	}{
+		{"no impersonation", metadata.Pairs("x-emulator-principal", dev), dev, "", codes.OK},
+		{"header", metadata.Pairs("x-emulator-principal", dev, "x-emulator-impersonate", "app@p.iam.gserviceaccount.com"), app, dev + " -> " + app, codes.OK},
+		{"header with member type", metadata.Pairs("x-emulator-principal", dev, "x-emulator-impersonate", app), app, dev + " -> " + app, codes.OK},
+		{"delegation chain", metadata.Pairs("x-emulator-principal", dev, "x-emulator-impersonate", "ci@p.iam.gserviceaccount.com, app@p.iam.gserviceaccount.com"), app, dev + " -> " + ci + " -> " + app, codes.OK},
+		{"anonymous", metadata.Pairs("x-emulator-impersonate", "app@p.iam.gserviceaccount.com"), app, "anonymous -> " + app, codes.OK},
+		{"JWT actor", metadata.Pairs("authorization", "Bearer "+jwt(`{"email":"app@p.iam.gserviceaccount.com","act":{"sub":"dev@example.com"}}`)), app, dev + " -> " + app, codes.OK},
+		{"nested JWT actors", metadata.Pairs("authorization", "Bearer "+jwt(`{"email":"app@p.iam.gserviceaccount.com","act":{"email":"ci@p.iam.gserviceaccount.com","act":{"sub":"dev@example.com"}}}`)), app, dev + " -> " + ci + " -> " + app, codes.OK},
+		{"JWT and header", metadata.Pairs("authorization", "Bearer "+jwt(`{"email":"dev@example.com"}`), "x-emulator-impersonate", "app@p.iam.gserviceaccount.com"), app, dev + " -> " + app, codes.OK},
+		{"not a service account", metadata.Pairs("x-emulator-principal", dev, "x-emulator-impersonate", "other@example.com"), "", "", codes.InvalidArgument},
+		{"chain too long", metadata.Pairs("x-emulator-impersonate", strings.Repeat("app@p.iam.gserviceaccount.com,", 11)), "", "", codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var effective, delegation string
+			handler := func(ctx context.Context, _ any) (any, error) {
+				md, _ := metadata.FromIncomingContext(ctx)
+				effective = strings.Join(md.Get("x-emulator-principal"), ",")
+				if d, ok := DelegationFromContext(ctx); ok {
+					delegation = d.String()
+				}
+				return nil, nil
+			}
+			ctx := metadata.NewIncomingContext(context.Background(), tt.md)
+			_, err := NewResolver(nil).UnaryServerInterceptor()(ctx, nil, &grpc.UnaryServerInfo{}, handler)
+			if code := status.Code(err); code != tt.code {
+				t.Fatalf("Expected %s, got %v", tt.code, err)
+			}
+			if effective != tt.effective || delegation != tt.delegation {
+				t.Errorf("Got principal %q and delegation %q, want %q and %q", effective, delegation, tt.effective, tt.delegation)
+			}
+		})
+	}
+}
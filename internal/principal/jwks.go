@@ -0,0 +1,326 @@
+package principal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GoogleCertsURL is the key set of Google-signed ID tokens
+const GoogleCertsURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+// refreshInterval is how often a key set is fetched again at most, when a
+// token names a key it does not have
+const refreshInterval = time.Minute
+
+// clockSkew is how far past exp or before nbf a token is still accepted
+const clockSkew = time.Minute
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// KeySet verifies JWTs with the keys of JSON Web Key Sets, read from URLs or
+// files. URL sets are fetched again when a token names a key they lack, as
+// Google rotates its signing keys.
+type KeySet struct {
+	sources []string
+
+	mu      sync.Mutex
+	keys    map[string][]crypto.PublicKey // by kid
+	fetched time.Time
+}
+
+// LoadKeySet reads the key sets at sources, which are http(s) URLs or file
+// paths, such as GoogleCertsURL or
+// https://www.googleapis.com/service_accounts/v1/jwk/SA_EMAIL for tokens a
+// service account signed itself
+func LoadKeySet(ctx context.Context, sources ...string) (*KeySet, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no JWKS sources")
+	}
+	k := &KeySet{sources: sources}
+	if err := k.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// refresh reads every source, replacing the keys
+func (k *KeySet) refresh(ctx context.Context) error {
+	keys := make(map[string][]crypto.PublicKey)
+	for _, source := range k.sources {
+		data, err := readSource(ctx, source)
+		if err != nil {
+			return fmt.Errorf("failed to read JWKS %s: %w", source, err)
+		}
+		if err := parseKeySet(data, keys); err != nil {
+			return fmt.Errorf("invalid JWKS %s: %w", source, err)
+		}
+	}
+	k.keys = keys
+	k.fetched = time.Now()
+	return nil
+}
+
+func readSource(ctx context.Context, source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.ReadFile(source)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// jwk is one JSON Web Key. Only RSA and EC signing keys are used.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func parseKeySet(data []byte, keys map[string][]crypto.PublicKey) error {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return err
+	}
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		pub, err := key.publicKey()
+		if err != nil {
+			return fmt.Errorf("key %q: %w", key.Kid, err)
+		}
+		if pub != nil {
+			keys[key.Kid] = append(keys[key.Kid], pub)
+		}
+	}
+	return nil
+}
+
+// publicKey returns the key, or nil for key types that are not used
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, nil
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, nil
+	}
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid base64url integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// lookup returns the keys with kid, or every key if kid is empty. An unknown
+// kid fetches the sets again, at most once per refreshInterval.
+func (k *KeySet) lookup(ctx context.Context, kid string) ([]crypto.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if kid == "" {
+		var all []crypto.PublicKey
+		for _, keys := range k.keys {
+			all = append(all, keys...)
+		}
+		return all, nil
+	}
+	if keys, ok := k.keys[kid]; ok {
+		return keys, nil
+	}
+	if time.Since(k.fetched) >= refreshInterval {
+		if err := k.refresh(ctx); err != nil {
+			return nil, err
+		}
+		if keys, ok := k.keys[kid]; ok {
+			return keys, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// Verify checks the signature and validity period of a JWT and returns its
+// claims
+func (k *KeySet) Verify(ctx context.Context, token string) (json.RawMessage, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return nil, errors.New("malformed JWT signature")
+	}
+	keys, err := k.lookup(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys {
+		if err := verifySignature(header.Alg, key, signed, signature); err == nil {
+			verified = true
+			break
+		} else if errors.Is(err, errUnsupportedAlg) {
+			return nil, err
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid JWT signature")
+	}
+
+	var claims json.RawMessage
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed JWT claims: %w", err)
+	}
+	var times struct {
+		Exp *float64 `json:"exp"`
+		Nbf *float64 `json:"nbf"`
+	}
+	if err := json.Unmarshal(claims, &times); err != nil {
+		return nil, fmt.Errorf("malformed JWT claims: %w", err)
+	}
+	now := time.Now()
+	if times.Exp != nil && now.After(unixTime(*times.Exp).Add(clockSkew)) {
+		return nil, errors.New("JWT has expired")
+	}
+	if times.Nbf != nil && now.Before(unixTime(*times.Nbf).Add(-clockSkew)) {
+		return nil, errors.New("JWT is not valid yet")
+	}
+	return claims, nil
+}
+
+var errUnsupportedAlg = errors.New("unsupported JWT algorithm")
+
+// verifySignature checks a JWS signature with one key. A key of another type
+// than alg needs is an ordinary mismatch.
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var h hash.Hash
+	var hashID crypto.Hash
+	switch alg[min(2, len(alg)):] {
+	case "256":
+		h, hashID = sha256.New(), crypto.SHA256
+	case "384":
+		h, hashID = sha512.New384(), crypto.SHA384
+	case "512":
+		h, hashID = sha512.New(), crypto.SHA512
+	default:
+		return fmt.Errorf("%w %q", errUnsupportedAlg, alg)
+	}
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("not an RSA key")
+		}
+		if alg[:2] == "PS" {
+			return rsa.VerifyPSS(pub, hashID, digest, signature, nil)
+		}
+		return rsa.VerifyPKCS1v15(pub, hashID, digest, signature)
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("not an EC key")
+		}
+		// JWS signatures are r and s, each the size of the curve
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid ECDSA signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w %q", errUnsupportedAlg, alg)
+	}
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
@@ -0,0 +1,153 @@
+package principal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	rsaKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _  = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+// signJWT returns a JWT with claims signed by key under kid
+func signJWT(t *testing.T, key crypto.Signer, kid string, claims map[string]any) string {
+	t.Helper()
+	enc := base64.RawURLEncoding
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+// keySetJSON returns a JWKS with the public keys of rsaKey and ecKey
+func keySetJSON() []byte {
+	enc := base64.RawURLEncoding
+	set := map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "use": "sig", "alg": "RS256", "n": enc.EncodeToString(rsaKey.N.Bytes()), "e": enc.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": enc.EncodeToString(ecKey.X.Bytes()), "y": enc.EncodeToString(ecKey.Y.Bytes())},
+		{"kty": "RSA", "kid": "enc1", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		{"kty": "oct", "kid": "secret", "k": "c2VjcmV0"},
+	}}
+	data, _ := json.Marshal(set)
+	return data
+}
+
+func TestKeySetVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, keySetJSON(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadKeySet(context.Background(), path)
+	if err != nil {
+		t.Fatalf("LoadKeySet failed: %v", err)
+	}
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	now := time.Now().Unix()
+	claims := map[string]any{"email": "app@p.iam.gserviceaccount.com", "exp": now + 3600}
+
+	tamper := func(token string) string {
+		parts := strings.Split(token, ".")
+		parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"email":"admin@example.com"}`))
+		return strings.Join(parts, ".")
+	}
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"RSA", signJWT(t, rsaKey, "rsa1", claims), ""},
+		{"EC", signJWT(t, ecKey, "ec1", claims), ""},
+		{"no kid", signJWT(t, ecKey, "", claims), ""},
+		{"within clock skew", signJWT(t, rsaKey, "rsa1", map[string]any{"sub": "1", "exp": now - 30}), ""},
+		{"expired", signJWT(t, rsaKey, "rsa1", map[string]any{"sub": "1", "exp": now - 3600}), "expired"},
+		{"not yet valid", signJWT(t, rsaKey, "rsa1", map[string]any{"sub": "1", "nbf": now + 3600}), "not valid yet"},
+		{"wrong key", signJWT(t, otherKey, "rsa1", claims), "invalid JWT signature"},
+		{"key of another type", signJWT(t, rsaKey, "ec1", claims), "invalid JWT signature"},
+		{"tampered claims", tamper(signJWT(t, rsaKey, "rsa1", claims)), "invalid JWT signature"},
+		{"unknown kid", signJWT(t, rsaKey, "rsa2", claims), "unknown signing key"},
+		{"unsigned", jwt(`{"email":"admin@example.com"}`), "invalid JWT signature"},
+		{"alg none", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"1"}`)) + ".", "unsupported JWT algorithm"},
+		{"not a JWT", "ya29.opaque", "malformed JWT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := keys.Verify(context.Background(), tt.token)
+			if tt.err == "" && err != nil {
+				t.Errorf("Verify failed: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("Expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestKeySetRefresh(t *testing.T) {
+	var fetches atomic.Int32
+	body := []byte(`{"keys":[]}`)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	keys, err := LoadKeySet(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("LoadKeySet failed: %v", err)
+	}
+	token := signJWT(t, rsaKey, "rsa1", map[string]any{"sub": "1"})
+
+	// Rotated keys are fetched, but not more than once per refreshInterval
+	body = keySetJSON()
+	if _, err := keys.Verify(context.Background(), token); err == nil {
+		t.Fatal("Expected the key to be unknown until the refresh interval passed")
+	}
+	keys.fetched = time.Now().Add(-refreshInterval)
+	if _, err := keys.Verify(context.Background(), token); err != nil {
+		t.Fatalf("Expected the rotated key to be fetched: %v", err)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("Expected 2 fetches, got %d", n)
+	}
+
+	if _, err := LoadKeySet(context.Background(), srv.URL, filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Expected an error for a missing key set")
+	}
+}
@@ -0,0 +1,157 @@
+// Package principal derives the IAM principal of a call from the credentials
+// the client sent.
+//
+// Google client libraries authenticate with an OAuth access token or an ID
+// token in the Authorization header. ID tokens and self-signed service
+// account tokens are JWTs naming the caller in their email or sub claim:
+//
+//	Authorization: Bearer eyJhbGciOi...  ->  serviceAccount:app@p.iam.gserviceaccount.com
+//
+// By default the token is decoded but not verified; the emulator trusts its
+// callers. With a KeySet, tokens must carry a valid signature from one of its
+// keys and be within their validity period, so tests can use the same tokens
+// the application sends Cloud KMS. Opaque access tokens carry no identity and
+// yield no principal, so callers using them still need the
+// x-emulator-principal header.
+//
+// Resolver.UnaryServerInterceptor sets the principal of gRPC calls that do not
+// name one, for IAM checks and everything else reading x-emulator-principal.
+package principal
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	emulatorauth "github.com/blackwell-systems/gcp-emulator-auth"
+)
+
+// AuthorizationHeader is the HTTP header and gRPC metadata key carrying
+// credentials
+const AuthorizationHeader = "authorization"
+
+// jwtClaims are the identity claims of a JWT. act is the RFC 8693 actor
+// claim, naming the party acting as the subject.
+type jwtClaims struct {
+	Email   string     `json:"email"`
+	Subject string     `json:"sub"`
+	Actor   *jwtClaims `json:"act"`
+}
+
+// principal returns the principal named by the email claim, falling back to
+// sub. Service account emails map to "serviceAccount:", every other identity
+// to "user:".
+func (c *jwtClaims) principal() (string, bool) {
+	identity := c.Email
+	if identity == "" {
+		identity = c.Subject
+	}
+	if identity == "" {
+		return "", false
+	}
+	if strings.HasSuffix(identity, ".gserviceaccount.com") {
+		return "serviceAccount:" + identity, true
+	}
+	return "user:" + identity, true
+}
+
+// Resolver derives the principal of calls from their Authorization header
+type Resolver struct {
+	keys *KeySet
+}
+
+// NewResolver returns a resolver verifying JWTs with keys, or trusting them
+// unverified if keys is nil
+func NewResolver(keys *KeySet) *Resolver {
+	return &Resolver{keys: keys}
+}
+
+// Resolve returns the principal named by a Bearer JWT in an Authorization
+// header value, or "" if the value is not one. With a key set, a JWT that
+// does not verify is an error.
+func (r *Resolver) Resolve(ctx context.Context, header string) (string, error) {
+	chain, err := r.resolveChain(ctx, header)
+	if err != nil || len(chain) == 0 {
+		return "", err
+	}
+	return chain[len(chain)-1], nil
+}
+
+// resolveChain returns the principals of a Bearer JWT from its innermost
+// actor to its subject
+func (r *Resolver) resolveChain(ctx context.Context, header string) ([]string, error) {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(header), " ")
+	token = strings.TrimSpace(token)
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.Count(token, ".") != 2 {
+		return nil, nil
+	}
+	var payload []byte
+	if r.keys == nil {
+		var err error
+		if payload, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.Split(token, ".")[1], "=")); err != nil {
+			return nil, nil
+		}
+	} else {
+		var err error
+		if payload, err = r.keys.Verify(ctx, token); err != nil {
+			return nil, err
+		}
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, nil
+	}
+	var chain []string
+	for c := &claims; c != nil && len(chain) < maxDelegates+1; c = c.Actor {
+		if p, ok := c.principal(); ok {
+			chain = append([]string{p}, chain...)
+		}
+	}
+	return chain, nil
+}
+
+// UnaryServerInterceptor sets the principal of calls without an
+// x-emulator-principal header from their Bearer JWT, then applies any
+// impersonation (see Delegation): the effective principal replaces
+// x-emulator-principal and the Delegation is added to the context. Calls
+// whose JWT does not verify fail with UNAUTHENTICATED, as in Cloud KMS.
+func (r *Resolver) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		var chain []string
+		if explicit := md.Get(emulatorauth.PrincipalMetadataKey); len(explicit) > 0 {
+			chain = explicit[:1]
+		} else if auth := md.Get(AuthorizationHeader); len(auth) > 0 {
+			var err error
+			if chain, err = r.resolveChain(ctx, auth[0]); err != nil {
+				return nil, status.Errorf(codes.Unauthenticated, "Request had invalid authentication credentials: %v", err)
+			}
+		}
+
+		delegates, err := parseImpersonation(md.Get(ImpersonateHeader))
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if len(chain) == 0 && len(delegates) == 0 {
+			return handler(ctx, req)
+		}
+		if len(chain) == 0 {
+			chain = []string{""}
+		}
+		chain = append(chain, delegates...)
+
+		md = md.Copy()
+		md.Set(emulatorauth.PrincipalMetadataKey, chain[len(chain)-1])
+		ctx = metadata.NewIncomingContext(ctx, md)
+		if len(chain) > 1 {
+			ctx = context.WithValue(ctx, delegationKey{}, Delegation{Caller: chain[0], Delegates: chain[1:]})
+		}
+		return handler(ctx, req)
+	}
+}
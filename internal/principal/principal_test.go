@@ -0,0 +1,97 @@
+package principal
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func jwt(payload string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(payload)) + ".c2ln"
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"service account", "Bearer " + jwt(`{"email":"app@p.iam.gserviceaccount.com","sub":"123"}`), "serviceAccount:app@p.iam.gserviceaccount.com"},
+		{"user", "Bearer " + jwt(`{"email":"dev@example.com"}`), "user:dev@example.com"},
+		{"sub only", "Bearer " + jwt(`{"sub":"1234567890"}`), "user:1234567890"},
+		{"lowercase scheme", "bearer " + jwt(`{"email":"dev@example.com"}`), "user:dev@example.com"},
+		{"no identity", "Bearer " + jwt(`{"aud":"x"}`), ""},
+		{"opaque access token", "Bearer ya29.a0AfH6SMB", ""},
+		{"basic", "Basic dXNlcjpwYXNz", ""},
+		{"malformed payload", "Bearer a.!!!.c", ""},
+		{"empty", "", ""},
+	}
+	r := NewResolver(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.Resolve(context.Background(), tt.header)
+			if got != tt.want || err != nil {
+				t.Errorf("Resolve = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, keySetJSON(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadKeySet(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := signJWT(t, rsaKey, "rsa1", map[string]any{"email": "app@p.iam.gserviceaccount.com", "exp": time.Now().Unix() + 3600})
+	unsigned := jwt(`{"email":"dev@example.com"}`)
+
+	tests := []struct {
+		name      string
+		keys      *KeySet
+		md        metadata.MD
+		principal string
+		code      codes.Code
+	}{
+		{"unverified JWT", nil, metadata.Pairs("authorization", "Bearer "+unsigned), "user:dev@example.com", codes.OK},
+		{"explicit header wins", nil, metadata.Pairs("authorization", "Bearer "+unsigned, "x-emulator-principal", "user:admin@example.com"), "user:admin@example.com", codes.OK},
+		{"opaque token", nil, metadata.Pairs("authorization", "Bearer ya29.opaque"), "", codes.OK},
+		{"anonymous", nil, metadata.MD{}, "", codes.OK},
+		{"verified JWT", keys, metadata.Pairs("authorization", "Bearer "+signed), "serviceAccount:app@p.iam.gserviceaccount.com", codes.OK},
+		{"unsigned JWT", keys, metadata.Pairs("authorization", "Bearer "+unsigned), "", codes.Unauthenticated},
+		{"opaque token with key set", keys, metadata.Pairs("authorization", "Bearer ya29.opaque"), "", codes.OK},
+		{"explicit header skips verification", keys, metadata.Pairs("authorization", "Bearer "+unsigned, "x-emulator-principal", "user:admin@example.com"), "user:admin@example.com", codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := func(ctx context.Context, _ any) (any, error) {
+				md, _ := metadata.FromIncomingContext(ctx)
+				if v := md.Get("x-emulator-principal"); len(v) > 0 {
+					got = v[0]
+				}
+				return nil, nil
+			}
+			ctx := metadata.NewIncomingContext(context.Background(), tt.md)
+			_, err := NewResolver(tt.keys).UnaryServerInterceptor()(ctx, nil, &grpc.UnaryServerInfo{}, handler)
+			if code := status.Code(err); code != tt.code {
+				t.Fatalf("Expected %s, got %v", tt.code, err)
+			}
+			if got != tt.principal {
+				t.Errorf("Expected principal %q, got %q", tt.principal, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+// Package proxy forwards selected calls to real Cloud KMS, so a test can use
+// one real key, such as an HSM or EKM key, alongside emulated ones.
+//
+// A call is forwarded when the resource it targets matches one of the
+// configured patterns, or, if enabled, when the emulator does not implement
+// it. Patterns are path.Match globs over resource names, and match the
+// resource they name and everything under it:
+//
+//	projects/real-project                            every resource in the project
+//	projects/*/locations/*/keyRings/hsm-ring         one key ring in any project
+//	projects/p/locations/global/keyRings/r/cryptoKeys/k
+//
+// Forwarded calls use ambient credentials (Application Default Credentials)
+// and are checked by Cloud IAM rather than the emulator's IAM mode. Their
+// routing headers are passed on; the emulator principal and other metadata
+// are not.
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+
+	_ "cloud.google.com/go/kms/apiv1/kmspb" // register the KMS types forwarded responses decode into
+	"google.golang.org/api/option"
+	grpctransport "google.golang.org/api/transport/grpc"
+	_ "google.golang.org/genproto/googleapis/cloud/location" // register the Locations types
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/routing"
+)
+
+// DefaultEndpoint is the Cloud KMS gRPC endpoint
+const DefaultEndpoint = "cloudkms.googleapis.com:443"
+
+// scope is the OAuth scope requested for forwarded calls
+const scope = "https://www.googleapis.com/auth/cloudkms"
+
+// resourceFields are the request fields naming the resource a call targets,
+// in order of preference
+var resourceFields = []string{"name", "parent", "resource", "location", "crypto_key.name", "crypto_key_version.name"}
+
+// forwardedHeaders are the request headers passed on to Cloud KMS
+var forwardedHeaders = []string{routing.RequestParamsHeader, routing.APIClientHeader}
+
+// Proxy forwards calls to an upstream KMS
+type Proxy struct {
+	upstream      grpc.ClientConnInterface
+	patterns      []string
+	unimplemented bool
+}
+
+// New creates a proxy forwarding calls to upstream. Calls on resources
+// matching patterns are forwarded, as are calls the emulator does not
+// implement if unimplemented is set.
+func New(upstream grpc.ClientConnInterface, patterns []string, unimplemented bool) (*Proxy, error) {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid proxy pattern %q: %w", p, err)
+		}
+	}
+	return &Proxy{upstream: upstream, patterns: patterns, unimplemented: unimplemented}, nil
+}
+
+// Dial connects to Cloud KMS at endpoint with Application Default
+// Credentials. opts are added to the connection, such as interceptors.
+func Dial(ctx context.Context, endpoint string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	clientOpts := []option.ClientOption{option.WithEndpoint(endpoint), option.WithScopes(scope)}
+	for _, opt := range opts {
+		clientOpts = append(clientOpts, option.WithGRPCDialOption(opt))
+	}
+	return grpctransport.Dial(ctx, clientOpts...)
+}
+
+// Matches reports whether calls on the named resource are forwarded
+func (p *Proxy) Matches(name string) bool {
+	if name == "" {
+		return false
+	}
+	// Try the name and each of its parents
+	for prefix := name; ; {
+		for _, pattern := range p.patterns {
+			if ok, _ := path.Match(pattern, prefix); ok {
+				return true
+			}
+		}
+		i := strings.LastIndex(prefix, "/")
+		if i < 0 {
+			return false
+		}
+		prefix = prefix[:i]
+	}
+}
+
+// UnaryServerInterceptor forwards calls on matching resources, and calls the
+// service does not implement if enabled
+func (p *Proxy) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		msg, ok := req.(proto.Message)
+		if !ok {
+			return handler(ctx, req)
+		}
+		if name := resourceName(msg.ProtoReflect()); p.Matches(name) {
+			slog.Debug("Forwarding call to Cloud KMS", "method", info.FullMethod, "resource", name)
+			return p.forward(ctx, info.FullMethod, msg)
+		}
+
+		resp, err := handler(ctx, req)
+		if p.unimplemented && status.Code(err) == codes.Unimplemented {
+			slog.Debug("Forwarding unimplemented call to Cloud KMS", "method", info.FullMethod)
+			return p.forward(ctx, info.FullMethod, msg)
+		}
+		return resp, err
+	}
+}
+
+// UnknownServiceHandler forwards unary calls to services and methods the
+// emulator does not serve, such as EkmService. Messages are forwarded as is,
+// without decoding. Use it with grpc.UnknownServiceHandler when unimplemented
+// calls are forwarded.
+func (p *Proxy) UnknownServiceHandler() grpc.StreamHandler {
+	return func(_ any, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		// Empty keeps every field it does not know, so the message
+		// round-trips unchanged
+		req := new(emptypb.Empty)
+		if err := stream.RecvMsg(req); err != nil {
+			return err
+		}
+		slog.Debug("Forwarding unknown call to Cloud KMS", "method", method)
+		resp := new(emptypb.Empty)
+		if err := p.upstream.Invoke(outgoingContext(stream.Context()), method, req, resp); err != nil {
+			return err
+		}
+		return stream.SendMsg(resp)
+	}
+}
+
+// forward invokes method upstream with the response type it declares
+func (p *Proxy) forward(ctx context.Context, method string, req proto.Message) (any, error) {
+	resp, err := newResponse(method)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot forward %s: %v", method, err)
+	}
+	if err := p.upstream.Invoke(outgoingContext(ctx), method, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// outgoingContext carries the forwarded headers of an incoming call
+func outgoingContext(ctx context.Context) context.Context {
+	in, _ := metadata.FromIncomingContext(ctx)
+	out := metadata.MD{}
+	for _, key := range forwardedHeaders {
+		if values := in.Get(key); len(values) > 0 {
+			out.Set(key, values...)
+		}
+	}
+	return metadata.NewOutgoingContext(ctx, out)
+}
+
+// newResponse returns an empty response of a full gRPC method name such as
+// /google.cloud.kms.v1.KeyManagementService/Encrypt
+func newResponse(fullMethod string) (proto.Message, error) {
+	service, name, _ := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, err
+	}
+	sd, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("unknown service %q", service)
+	}
+	md := sd.Methods().ByName(protoreflect.Name(name))
+	if md == nil {
+		return nil, fmt.Errorf("unknown method %q", fullMethod)
+	}
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(md.Output().FullName())
+	if err != nil {
+		return nil, err
+	}
+	return mt.New().Interface(), nil
+}
+
+// resourceName returns the resource a request targets, or ""
+func resourceName(m protoreflect.Message) string {
+	for _, field := range resourceFields {
+		if name := stringField(m, field); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// stringField returns the string field at a dotted proto path, or ""
+func stringField(m protoreflect.Message, fieldPath string) string {
+	names := strings.Split(fieldPath, ".")
+	for i, name := range names {
+		fd := m.Descriptor().Fields().ByName(protoreflect.Name(name))
+		if fd == nil || fd.IsList() || fd.IsMap() {
+			return ""
+		}
+		if i == len(names)-1 {
+			if fd.Kind() != protoreflect.StringKind {
+				return ""
+			}
+			return m.Get(fd).String()
+		}
+		if fd.Kind() != protoreflect.MessageKind || !m.Has(fd) {
+			return ""
+		}
+		m = m.Get(fd).Message()
+	}
+	return ""
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	locationpb "google.golang.org/genproto/googleapis/cloud/location"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	emulatorauth "github.com/blackwell-systems/gcp-emulator-auth"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/routing"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/server"
+)
+
+// serve starts a server with the services registered by register over
+// bufconn and returns a connection to it
+func serve(t *testing.T, register func(*grpc.Server), opts ...grpc.ServerOption) *grpc.ClientConn {
+	t.Helper()
+	srv := grpc.NewServer(opts...)
+	register(srv)
+	lis := bufconn.Listen(1 << 20)
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// registerKMS registers a KMS service with IAM enforcement off
+func registerKMS(t *testing.T) func(*grpc.Server) {
+	return func(srv *grpc.Server) {
+		kms, err := server.NewServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := kms.SetIAMMode(emulatorauth.AuthModeOff); err != nil {
+			t.Fatal(err)
+		}
+		kmspb.RegisterKeyManagementServiceServer(srv, kms)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	p, err := New(nil, []string{"projects/real", "projects/*/locations/*/keyRings/hsm"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"projects/real": true,
+		"projects/real/locations/global/keyRings/r":                             true,
+		"projects/p/locations/us/keyRings/hsm":                                  true,
+		"projects/p/locations/us/keyRings/hsm/cryptoKeys/k/cryptoKeyVersions/1": true,
+		"projects/realistic/locations/global":                                   false,
+		"projects/p/locations/us/keyRings/hsm2":                                 false,
+		"projects/p/locations/us":                                               false,
+		"":                                                                      false,
+	} {
+		if got := p.Matches(name); got != want {
+			t.Errorf("Matches(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	if _, err := New(nil, []string{"projects/["}, false); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+}
+
+func TestForwardResources(t *testing.T) {
+	var upstreamMD metadata.MD
+	capture := func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		upstreamMD, _ = metadata.FromIncomingContext(ctx)
+		return handler(ctx, req)
+	}
+	upstream := serve(t, registerKMS(t), grpc.UnaryInterceptor(capture))
+	p, err := New(upstream, []string{"projects/real"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := serve(t, registerKMS(t), grpc.UnaryInterceptor(p.UnaryServerInterceptor()))
+	client := kmspb.NewKeyManagementServiceClient(conn)
+	upstreamClient := kmspb.NewKeyManagementServiceClient(upstream)
+	ctx := t.Context()
+
+	// The real key exists only upstream
+	if _, err := upstreamClient.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/real/locations/global", KeyRingId: "ring"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := upstreamClient.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent:      "projects/real/locations/global/keyRings/ring",
+		CryptoKeyId: "key",
+		CryptoKey:   &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	keyName := "projects/real/locations/global/keyRings/ring/cryptoKeys/key"
+	callCtx := metadata.AppendToOutgoingContext(ctx,
+		routing.RequestParamsHeader, "name="+keyName,
+		emulatorauth.PrincipalMetadataKey, "user:dev@example.com")
+	resp, err := client.Encrypt(callCtx, &kmspb.EncryptRequest{Name: keyName, Plaintext: []byte("secret")})
+	if err != nil {
+		t.Fatalf("Encrypt of a forwarded key failed: %v", err)
+	}
+	if got := upstreamMD.Get(routing.RequestParamsHeader); len(got) != 1 || got[0] != "name="+keyName {
+		t.Errorf("Expected the routing header to be forwarded, got %v", got)
+	}
+	if got := upstreamMD.Get(emulatorauth.PrincipalMetadataKey); len(got) != 0 {
+		t.Errorf("Expected the principal not to be forwarded, got %v", got)
+	}
+	decrypted, err := upstreamClient.Decrypt(ctx, &kmspb.DecryptRequest{Name: keyName, Ciphertext: resp.Ciphertext})
+	if err != nil || string(decrypted.Plaintext) != "secret" {
+		t.Errorf("Expected upstream to decrypt the ciphertext, got %q, %v", decrypted.GetPlaintext(), err)
+	}
+
+	// Other resources stay local
+	upstreamMD = nil
+	if _, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/p/locations/global", KeyRingId: "ring"}); err != nil {
+		t.Fatal(err)
+	}
+	if upstreamMD != nil {
+		t.Error("Expected a local call not to be forwarded")
+	}
+	if _, err := upstreamClient.GetKeyRing(ctx, &kmspb.GetKeyRingRequest{Name: "projects/p/locations/global/keyRings/ring"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected the local key ring to be missing upstream, got %v", err)
+	}
+}
+
+func TestForwardUnimplemented(t *testing.T) {
+	// Upstream serves Locations, which the local server does not
+	upstream := serve(t, func(srv *grpc.Server) {
+		locationpb.RegisterLocationsServer(srv, server.NewLocations())
+	})
+	p, err := New(upstream, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := serve(t, registerKMS(t), grpc.UnaryInterceptor(p.UnaryServerInterceptor()), grpc.UnknownServiceHandler(p.UnknownServiceHandler()))
+
+	loc, err := locationpb.NewLocationsClient(conn).GetLocation(t.Context(), &locationpb.GetLocationRequest{Name: "projects/p/locations/us-east1"})
+	if err != nil {
+		t.Fatalf("GetLocation of an unknown service failed: %v", err)
+	}
+	if loc.LocationId != "us-east1" {
+		t.Errorf("Unexpected location %v", loc)
+	}
+
+	// Calls the service rejects as unimplemented are forwarded too
+	interceptor := p.UnaryServerInterceptor()
+	unimplemented := func(context.Context, any) (any, error) {
+		return nil, status.Error(codes.Unimplemented, "not implemented")
+	}
+	resp, err := interceptor(t.Context(), &locationpb.ListLocationsRequest{Name: "projects/p"},
+		&grpc.UnaryServerInfo{FullMethod: "/google.cloud.location.Locations/ListLocations"}, unimplemented)
+	if err != nil {
+		t.Fatalf("Forwarding an unimplemented call failed: %v", err)
+	}
+	if len(resp.(*locationpb.ListLocationsResponse).Locations) == 0 {
+		t.Error("Expected locations from upstream")
+	}
+
+	// Without the option the error is returned as is
+	p.unimplemented = false
+	if _, err := interceptor(t.Context(), &locationpb.ListLocationsRequest{Name: "projects/p"},
+		&grpc.UnaryServerInfo{FullMethod: "/google.cloud.location.Locations/ListLocations"}, unimplemented); status.Code(err) != codes.Unimplemented {
+		t.Errorf("Expected Unimplemented, got %v", err)
+	}
+}
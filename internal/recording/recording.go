@@ -0,0 +1,184 @@
+// Package recording records the calls an emulator serves so they can be
+// replayed later.
+//
+// A Recorder writes one JSON line per call that reaches the service:
+//
+//	{
+//	  "time": "2026-01-02T03:04:05Z",
+//	  "method": "/google.cloud.kms.v1.KeyManagementService/Encrypt",
+//	  "principal": "user:ci@example.com",
+//	  "request": {"name": "projects/p/...", "plaintextCrc32c": "..."},
+//	  "response": {"name": "...", "ciphertext": "..."},
+//	  "code": "OK",
+//	  "redacted": {"plaintext": 6}
+//	}
+//
+// Recordings are sanitized: plaintext and key material are removed from
+// requests and responses, as in the request log, and only their sizes are
+// kept under "redacted". Credentials and other request metadata are never
+// recorded; only the emulator principal is. Ciphertexts, signatures and MACs
+// are kept, since they are needed to replay dependent calls and reveal
+// nothing without the key material, which stays in the emulator.
+//
+// Replay re-issues a recording against another emulator in order. Redacted
+// fields are filled with zero bytes of the recorded size, and ciphertexts,
+// signatures and MACs produced by earlier calls are swapped for the ones the
+// new emulator produced, so a Decrypt of an earlier Encrypt still succeeds
+// with fresh key material.
+//
+// Calls failed by fault injection or chaos never reach the service and are
+// not recorded, so a replay does not expect them.
+package recording
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	emulatorauth "github.com/blackwell-systems/gcp-emulator-auth"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/logging"
+)
+
+// Record is one recorded call
+type Record struct {
+	Time      time.Time       `json:"time"`
+	Method    string          `json:"method"`
+	Principal string          `json:"principal,omitempty"`
+	Request   json.RawMessage `json:"request"`
+	Response  json.RawMessage `json:"response,omitempty"`
+	Code      string          `json:"code"`
+	Message   string          `json:"message,omitempty"`
+	// Redacted maps the request fields that were removed to their sizes
+	Redacted map[string]int `json:"redacted,omitempty"`
+}
+
+// Recorder writes one Record per call as a JSON line
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	now func() time.Time
+}
+
+// NewRecorder creates a recorder writing to w
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{
+		enc: json.NewEncoder(w),
+		now: time.Now,
+	}
+}
+
+// UnaryServerInterceptor records every call handled by the service
+func (r *Recorder) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		resp, err := handler(ctx, req)
+		r.record(ctx, info.FullMethod, req, resp, err)
+		return resp, err
+	}
+}
+
+// UnaryClientInterceptor records every call made on a client connection,
+// such as one to real Cloud KMS. The principal is not recorded.
+func (r *Recorder) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		r.record(context.Background(), method, req, reply, err)
+		return err
+	}
+}
+
+func (r *Recorder) record(ctx context.Context, method string, req, resp any, callErr error) {
+	rec, err := newRecord(ctx, r.now().UTC(), method, req, resp, callErr)
+	if err != nil {
+		slog.Error("Failed to record call", "method", method, "error", err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_ = r.enc.Encode(rec)
+}
+
+func newRecord(ctx context.Context, now time.Time, method string, req, resp any, callErr error) (*Record, error) {
+	st := status.Convert(callErr)
+	rec := &Record{
+		Time:      now,
+		Method:    method,
+		Principal: emulatorauth.ExtractPrincipalFromContext(ctx),
+		Code:      code.Code(st.Code()).String(),
+		Message:   st.Message(),
+	}
+
+	var err error
+	if rec.Request, rec.Redacted, err = marshal(req); err != nil {
+		return nil, err
+	}
+	if callErr == nil {
+		if rec.Response, _, err = marshal(resp); err != nil {
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+// marshal returns msg as JSON without sensitive fields, and the sizes of the
+// fields it removed
+func marshal(msg any) (json.RawMessage, map[string]int, error) {
+	pm, ok := msg.(proto.Message)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected message type %T", msg)
+	}
+	clone, removed := logging.Redact(pm)
+	data, err := protojson.Marshal(clone)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var redacted map[string]int
+	for _, field := range removed {
+		// Redact describes removed fields as "name(N bytes)"
+		name, size, ok := strings.Cut(field, "(")
+		if !ok {
+			continue
+		}
+		var n int
+		if _, err := fmt.Sscanf(size, "%d bytes)", &n); err != nil {
+			continue
+		}
+		if redacted == nil {
+			redacted = make(map[string]int)
+		}
+		redacted[name] = n
+	}
+	return data, redacted, nil
+}
+
+// Read reads a recording written by a Recorder
+func Read(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<26)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,174 @@
+package recording
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"hash/crc32"
+	"strings"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/pkg/emulator"
+)
+
+const keyRing = "projects/test/locations/global/keyRings/ring"
+
+func startEmulator(t *testing.T, opts ...emulator.Option) *grpc.ClientConn {
+	t.Helper()
+	emu, err := emulator.Start(t.Context(), append([]emulator.Option{emulator.WithBufconn(), emulator.WithIAMMode("off")}, opts...)...)
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(func() { emu.Close() })
+	conn, err := emu.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// recordWorkflow runs calls that depend on each other's output against a
+// recording emulator and returns the recording
+func recordWorkflow(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	conn := startEmulator(t, emulator.WithServerOptions(grpc.ChainUnaryInterceptor(NewRecorder(&buf).UnaryServerInterceptor())))
+	client := kmspb.NewKeyManagementServiceClient(conn)
+	ctx := context.Background()
+
+	if _, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/test/locations/global", KeyRingId: "ring"}); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	for id, key := range map[string]*kmspb.CryptoKey{
+		"enc": {Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT},
+		"mac": {Purpose: kmspb.CryptoKey_MAC, VersionTemplate: &kmspb.CryptoKeyVersionTemplate{Algorithm: kmspb.CryptoKeyVersion_HMAC_SHA256}},
+	} {
+		if _, err := client.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{Parent: keyRing, CryptoKeyId: id, CryptoKey: key}); err != nil {
+			t.Fatalf("CreateCryptoKey failed: %v", err)
+		}
+	}
+
+	plaintext := []byte("top secret")
+	enc, err := client.Encrypt(ctx, &kmspb.EncryptRequest{
+		Name:            keyRing + "/cryptoKeys/enc",
+		Plaintext:       plaintext,
+		PlaintextCrc32C: wrapperspb.Int64(int64(crc32.Checksum(plaintext, crcTable))),
+	})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if _, err := client.Decrypt(ctx, &kmspb.DecryptRequest{Name: keyRing + "/cryptoKeys/enc", Ciphertext: enc.Ciphertext}); err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+
+	version := keyRing + "/cryptoKeys/mac/cryptoKeyVersions/1"
+	mac, err := client.MacSign(ctx, &kmspb.MacSignRequest{Name: version, Data: plaintext})
+	if err != nil {
+		t.Fatalf("MacSign failed: %v", err)
+	}
+	if _, err := client.MacVerify(ctx, &kmspb.MacVerifyRequest{Name: version, Data: plaintext, Mac: mac.Mac}); err != nil {
+		t.Fatalf("MacVerify failed: %v", err)
+	}
+	if _, err := client.GetCryptoKey(ctx, &kmspb.GetCryptoKeyRequest{Name: keyRing + "/cryptoKeys/missing"}); err == nil {
+		t.Fatal("Expected GetCryptoKey of a missing key to fail")
+	}
+	return buf.Bytes()
+}
+
+func TestRecorder(t *testing.T) {
+	data := recordWorkflow(t)
+	if secret := base64.StdEncoding.EncodeToString([]byte("top secret")); strings.Contains(string(data), secret) {
+		t.Errorf("Recording contains the plaintext:\n%s", data)
+	}
+
+	records, err := Read(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(records) != 8 {
+		t.Fatalf("Expected 8 records, got %d", len(records))
+	}
+	encrypt := records[3]
+	if encrypt.Method != "/google.cloud.kms.v1.KeyManagementService/Encrypt" || encrypt.Code != "OK" {
+		t.Errorf("Unexpected Encrypt record: %+v", encrypt)
+	}
+	if encrypt.Redacted["plaintext"] != 10 {
+		t.Errorf("Expected a 10 byte redacted plaintext, got %v", encrypt.Redacted)
+	}
+	if missing := records[7]; missing.Code != "NOT_FOUND" || missing.Response != nil {
+		t.Errorf("Expected a NOT_FOUND record without response, got %+v", missing)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	records, err := Read(bytes.NewReader(recordWorkflow(t)))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	results, err := Replay(context.Background(), startEmulator(t), records)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(results) != len(records) {
+		t.Fatalf("Expected %d results, got %d", len(records), len(results))
+	}
+	for i, r := range results {
+		if !r.Match() {
+			t.Errorf("Record %d %s: recorded %s, replayed %s: %s", i+1, r.Method, r.Want, r.Got, r.Message)
+		}
+		if (r.Got == "OK") != (r.Replayed != nil) {
+			t.Errorf("Record %d %s: expected a replayed response only for OK calls, got %s", i+1, r.Method, r.Replayed)
+		}
+	}
+	if decrypt := results[4]; len(decrypt.Recorded) == 0 || strings.Contains(string(decrypt.Replayed), `"plaintext"`) {
+		t.Errorf("Expected sanitized Decrypt responses, got %s and %s", decrypt.Recorded, decrypt.Replayed)
+	}
+
+	// Without the key ring and keys, the rest of the recording ends differently
+	results, err = Replay(context.Background(), startEmulator(t), records[3:4])
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if results[0].Match() || results[0].Got != "NOT_FOUND" {
+		t.Errorf("Expected Encrypt to end with NOT_FOUND, got %+v", results[0])
+	}
+}
+
+func TestRecorderClient(t *testing.T) {
+	var buf bytes.Buffer
+	emu, err := emulator.Start(t.Context(), emulator.WithBufconn(), emulator.WithIAMMode("off"))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(func() { emu.Close() })
+	conn, err := emu.Dial(grpc.WithChainUnaryInterceptor(NewRecorder(&buf).UnaryClientInterceptor()))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	client := kmspb.NewKeyManagementServiceClient(conn)
+	if _, err := client.CreateKeyRing(context.Background(), &kmspb.CreateKeyRingRequest{Parent: "projects/test/locations/global", KeyRingId: "ring"}); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	records, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(records) != 1 || records[0].Method != "/google.cloud.kms.v1.KeyManagementService/CreateKeyRing" || !strings.Contains(string(records[0].Response), keyRing) {
+		t.Errorf("Expected the CreateKeyRing call, got %+v", records)
+	}
+}
+
+func TestReplayInvalidMethod(t *testing.T) {
+	records := []Record{{Method: "/google.cloud.kms.v1.KeyManagementService/Nope", Request: []byte("{}"), Code: "OK"}}
+	if _, err := Replay(context.Background(), startEmulator(t), records); err == nil {
+		t.Error("Expected an error for an unknown method")
+	}
+}
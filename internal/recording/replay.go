@@ -0,0 +1,191 @@
+package recording
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	_ "cloud.google.com/go/kms/apiv1/kmspb"                  // register the KMS types replayed requests decode into
+	_ "google.golang.org/genproto/googleapis/cloud/location" // register the Locations types
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	emulatorauth "github.com/blackwell-systems/gcp-emulator-auth"
+)
+
+// crcTable computes the CRC32C checksums KMS requests carry
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Result is the outcome of replaying one record
+type Result struct {
+	Method string
+	// Want is the recorded status code and Got the replayed one
+	Want, Got string
+	// Message is the replayed error message
+	Message string
+	// Recorded and Replayed are the responses of calls that succeeded, as
+	// recorded, with sensitive fields removed
+	Recorded, Replayed json.RawMessage
+}
+
+// Match reports whether the replayed call ended like the recorded one
+func (r Result) Match() bool {
+	return r.Want == r.Got
+}
+
+// Replay re-issues records on conn in order and returns one result per
+// record. Only malformed recordings fail the replay; calls that end
+// differently are reported in the results.
+func Replay(ctx context.Context, conn grpc.ClientConnInterface, records []Record) ([]Result, error) {
+	// replaced maps bytes returned in the recording to those returned now
+	replaced := make(map[string][]byte)
+	results := make([]Result, 0, len(records))
+	for i, rec := range records {
+		method, err := findMethod(rec.Method)
+		if err != nil {
+			return results, fmt.Errorf("record %d: %w", i+1, err)
+		}
+		req, err := newMessage(method.Input(), rec.Request)
+		if err != nil {
+			return results, fmt.Errorf("record %d: invalid request: %w", i+1, err)
+		}
+		fillRedacted(req.ProtoReflect(), rec.Redacted)
+		substitute(req.ProtoReflect(), replaced)
+
+		callCtx := ctx
+		if rec.Principal != "" {
+			callCtx = metadata.AppendToOutgoingContext(ctx, emulatorauth.PrincipalMetadataKey, rec.Principal)
+		}
+		resp, err := newMessage(method.Output(), nil)
+		if err != nil {
+			return results, fmt.Errorf("record %d: %w", i+1, err)
+		}
+		callErr := conn.Invoke(callCtx, rec.Method, req, resp)
+
+		st := status.Convert(callErr)
+		result := Result{
+			Method:   rec.Method,
+			Want:     rec.Code,
+			Got:      code.Code(st.Code()).String(),
+			Message:  st.Message(),
+			Recorded: rec.Response,
+		}
+		if callErr == nil {
+			if result.Replayed, _, err = marshal(resp); err != nil {
+				return results, fmt.Errorf("record %d: %w", i+1, err)
+			}
+		}
+		results = append(results, result)
+
+		if callErr == nil && len(rec.Response) > 0 {
+			recorded, err := newMessage(method.Output(), rec.Response)
+			if err != nil {
+				return results, fmt.Errorf("record %d: invalid response: %w", i+1, err)
+			}
+			collectReplaced(recorded.ProtoReflect(), resp.ProtoReflect(), replaced)
+		}
+	}
+	return results, nil
+}
+
+// findMethod resolves a full gRPC method name such as
+// /google.cloud.kms.v1.KeyManagementService/Encrypt
+func findMethod(fullMethod string) (protoreflect.MethodDescriptor, error) {
+	service, name, ok := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid method %q", fullMethod)
+	}
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, fmt.Errorf("unknown service %q", service)
+	}
+	sd, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("unknown service %q", service)
+	}
+	md := sd.Methods().ByName(protoreflect.Name(name))
+	if md == nil {
+		return nil, fmt.Errorf("unknown method %q", fullMethod)
+	}
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		return nil, fmt.Errorf("streaming method %q cannot be replayed", fullMethod)
+	}
+	return md, nil
+}
+
+// newMessage returns an instance of desc decoded from data, if any
+func newMessage(desc protoreflect.MessageDescriptor, data []byte) (proto.Message, error) {
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(desc.FullName())
+	if err != nil {
+		return nil, err
+	}
+	msg := mt.New().Interface()
+	if len(data) == 0 {
+		return msg, nil
+	}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// fillRedacted sets the redacted top-level fields of m to zero bytes of their
+// recorded size
+func fillRedacted(m protoreflect.Message, redacted map[string]int) {
+	for name, size := range redacted {
+		fd := m.Descriptor().Fields().ByName(protoreflect.Name(name))
+		if fd == nil || fd.Kind() != protoreflect.BytesKind || fd.IsList() {
+			continue
+		}
+		setBytes(m, fd, make([]byte, size))
+	}
+}
+
+// substitute swaps top-level bytes fields of m produced by earlier recorded
+// calls for the values the replayed calls produced
+func substitute(m protoreflect.Message, replaced map[string][]byte) {
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if fd.Kind() != protoreflect.BytesKind || fd.IsList() || !m.Has(fd) {
+			continue
+		}
+		if b, ok := replaced[string(m.Get(fd).Bytes())]; ok {
+			setBytes(m, fd, b)
+		}
+	}
+}
+
+// collectReplaced records which top-level bytes fields of the recorded
+// response differ from the replayed one
+func collectReplaced(recorded, replayed protoreflect.Message, replaced map[string][]byte) {
+	recorded.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd.Kind() != protoreflect.BytesKind || fd.IsList() || !replayed.Has(fd) {
+			return true
+		}
+		if now := replayed.Get(fd).Bytes(); !bytes.Equal(v.Bytes(), now) {
+			replaced[string(v.Bytes())] = now
+		}
+		return true
+	})
+}
+
+// setBytes sets a bytes field and, if the request carries one, its CRC32C
+// checksum field so the emulator's integrity check still passes
+func setBytes(m protoreflect.Message, fd protoreflect.FieldDescriptor, b []byte) {
+	m.Set(fd, protoreflect.ValueOfBytes(b))
+	crc := m.Descriptor().Fields().ByName(fd.Name() + "_crc32c")
+	if crc != nil && m.Has(crc) {
+		m.Set(crc, protoreflect.ValueOfMessage(wrapperspb.Int64(int64(crc32.Checksum(b, crcTable))).ProtoReflect()))
+	}
+}
@@ -0,0 +1,119 @@
+// Package routing handles the request headers Google client libraries send
+// alongside every call:
+//
+//   - x-goog-request-params: URL-encoded routing parameters naming the
+//     resource the call targets, e.g. "name=projects%2Fp%2Flocations%2Fglobal"
+//   - x-goog-api-client: space-separated client identifiers such as
+//     "gl-go/1.24.0 gapic/1.25.0 gax/2.14.1 grpc/1.78.0"
+//
+// Googleapis frontends route on x-goog-request-params and reject calls whose
+// routing parameters disagree with the request. The interceptor does the
+// same, so a client that builds the header from the wrong field fails against
+// the emulator instead of only in production:
+//
+//	x-goog-request-params: name=projects%2Fp%2F...%2FcryptoKeys%2Fk1
+//	EncryptRequest{name: ".../cryptoKeys/k2"}  -> INVALID_ARGUMENT
+//
+// Parameters that do not name a request field are ignored, as are calls
+// without the header.
+package routing
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	// RequestParamsHeader carries the routing parameters of a call
+	RequestParamsHeader = "x-goog-request-params"
+	// APIClientHeader identifies the client library making a call
+	APIClientHeader = "x-goog-api-client"
+)
+
+// RequestParams returns the x-goog-request-params of an incoming call, or ""
+func RequestParams(ctx context.Context) string {
+	return incoming(ctx, RequestParamsHeader)
+}
+
+// APIClient returns the x-goog-api-client of an incoming call, or ""
+func APIClient(ctx context.Context) string {
+	return incoming(ctx, APIClientHeader)
+}
+
+func incoming(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	return strings.Join(md.Get(key), "&")
+}
+
+// UnaryServerInterceptor rejects calls whose x-goog-request-params disagree
+// with the request, or cannot be parsed
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if header := RequestParams(ctx); header != "" {
+			if msg, ok := req.(proto.Message); ok {
+				if err := Validate(header, msg); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// Validate checks routing parameters against the request. Each parameter
+// names a request field by its proto path, such as "name" or
+// "crypto_key.name"; a parameter whose field is set in the request must have
+// the same value.
+func Validate(header string, req proto.Message) error {
+	params, err := url.ParseQuery(header)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid %s header %q: %v", RequestParamsHeader, header, err)
+	}
+
+	for key, values := range params {
+		actual, ok := field(req.ProtoReflect(), key)
+		if !ok || actual == "" {
+			continue
+		}
+		for _, value := range values {
+			if value != actual {
+				return status.Errorf(codes.InvalidArgument,
+					"%s %s=%q does not match the %s of the request (%q)", RequestParamsHeader, key, value, key, actual)
+			}
+		}
+	}
+	return nil
+}
+
+// field returns the string field at a dotted proto path
+func field(m protoreflect.Message, path string) (string, bool) {
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		fd := m.Descriptor().Fields().ByName(protoreflect.Name(name))
+		if fd == nil || fd.IsList() || fd.IsMap() {
+			return "", false
+		}
+		if i == len(names)-1 {
+			if fd.Kind() != protoreflect.StringKind {
+				return "", false
+			}
+			return m.Get(fd).String(), true
+		}
+		if fd.Kind() != protoreflect.MessageKind || !m.Has(fd) {
+			return "", false
+		}
+		m = m.Get(fd).Message()
+	}
+	return "", false
+}
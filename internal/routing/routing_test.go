@@ -0,0 +1,73 @@
+package routing
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const keyName = "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		req    *kmspb.UpdateCryptoKeyRequest
+		code   codes.Code
+	}{
+		{"match", "crypto_key.name=" + url.QueryEscape(keyName), &kmspb.UpdateCryptoKeyRequest{CryptoKey: &kmspb.CryptoKey{Name: keyName}}, codes.OK},
+		{"mismatch", "crypto_key.name=" + url.QueryEscape(keyName+"2"), &kmspb.UpdateCryptoKeyRequest{CryptoKey: &kmspb.CryptoKey{Name: keyName}}, codes.InvalidArgument},
+		{"unknown parameter", "location=us&crypto_key.unknown=x", &kmspb.UpdateCryptoKeyRequest{CryptoKey: &kmspb.CryptoKey{Name: keyName}}, codes.OK},
+		{"unset field", "crypto_key.name=" + url.QueryEscape(keyName), &kmspb.UpdateCryptoKeyRequest{}, codes.OK},
+		{"malformed", "crypto_key.name=%zz", &kmspb.UpdateCryptoKeyRequest{CryptoKey: &kmspb.CryptoKey{Name: keyName}}, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := status.Code(Validate(tt.header, tt.req)); code != tt.code {
+				t.Errorf("Expected %v, got %v", tt.code, code)
+			}
+		})
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	interceptor := UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/google.cloud.kms.v1.KeyManagementService/Encrypt"}
+	called := false
+	handler := func(ctx context.Context, req any) (any, error) {
+		called = true
+		return &kmspb.EncryptResponse{}, nil
+	}
+	req := &kmspb.EncryptRequest{Name: keyName}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		RequestParamsHeader, "name="+url.QueryEscape(keyName),
+		APIClientHeader, "gl-go/1.24.0 gapic/1.25.0",
+	))
+	if _, err := interceptor(ctx, req, info, handler); err != nil || !called {
+		t.Fatalf("Expected the call to pass, got %v", err)
+	}
+	if got := APIClient(ctx); got != "gl-go/1.24.0 gapic/1.25.0" {
+		t.Errorf("APIClient = %q", got)
+	}
+
+	called = false
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		RequestParamsHeader, "name="+url.QueryEscape("projects/p/locations/global/keyRings/r/cryptoKeys/other"),
+	))
+	if _, err := interceptor(ctx, req, info, handler); status.Code(err) != codes.InvalidArgument || called {
+		t.Errorf("Expected INVALID_ARGUMENT without calling the handler, got %v", err)
+	}
+
+	// Calls without the header are not checked
+	called = false
+	if _, err := interceptor(context.Background(), req, info, handler); err != nil || !called {
+		t.Errorf("Expected the call to pass, got %v", err)
+	}
+}
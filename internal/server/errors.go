@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+// Error details follow https://google.aip.dev/193, with the reasons and
+// domains Cloud KMS uses, so clients can branch on them rather than on
+// messages.
+const (
+	// ReasonPermissionDenied is the ErrorInfo reason of IAM denials
+	ReasonPermissionDenied = "IAM_PERMISSION_DENIED"
+	// DomainIAM is the ErrorInfo domain of IAM denials
+	DomainIAM = "iam.googleapis.com"
+)
+
+// resourceTypes maps the resource kinds named in storage errors to the type
+// URLs reported in ResourceInfo
+var resourceTypes = map[string]string{
+	"keyring":            "type.googleapis.com/google.cloud.kms.v1.KeyRing",
+	"crypto key":         "type.googleapis.com/google.cloud.kms.v1.CryptoKey",
+	"crypto key version": "type.googleapis.com/google.cloud.kms.v1.CryptoKeyVersion",
+	"import job":         "type.googleapis.com/google.cloud.kms.v1.ImportJob",
+}
+
+// storageResourceError matches storage errors that name a resource, such as
+// "crypto key not found: projects/..."
+var storageResourceError = regexp.MustCompile(`^(keyring|crypto key version|crypto key|import job) (?:not found|already exists): (\S+)$`)
+
+// withDetails attaches details to a status error. Details that fail to
+// marshal are dropped, keeping the code and message.
+func withDetails(code codes.Code, msg string, details ...protoadapt.MessageV1) error {
+	st := status.New(code, msg)
+	if detailed, err := st.WithDetails(details...); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// resourceError converts a storage error about a missing or existing
+// resource to code, with a ResourceInfo naming the resource when the error
+// does
+func resourceError(code codes.Code, err error) error {
+	m := storageResourceError.FindStringSubmatch(err.Error())
+	if m == nil {
+		return status.Error(code, err.Error())
+	}
+	return resourceInfoError(code, resourceTypes[m[1]], m[2], err.Error())
+}
+
+// hookError returns the status of an operation a storage hook failed, or
+// nil for other errors. Hooks choose the code with a status error; other
+// errors are UNKNOWN, as when a gRPC handler returns them.
+func hookError(err error) error {
+	var hookErr *storage.HookError
+	if !errors.As(err, &hookErr) {
+		return nil
+	}
+	return status.Convert(hookErr.Err).Err()
+}
+
+// resourceInfoError returns an error about one resource
+func resourceInfoError(code codes.Code, resourceType, name, msg string) error {
+	return withDetails(code, msg, &errdetails.ResourceInfo{
+		ResourceType: resourceType,
+		ResourceName: name,
+		Description:  msg,
+	})
+}
+
+// invalidArgument returns an InvalidArgument error about one request field,
+// with a BadRequest field violation naming it
+func invalidArgument(field, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	return withDetails(codes.InvalidArgument, msg, &errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: field, Description: msg}},
+	})
+}
+
+// requiredField reports a missing request field
+func requiredField(field string) error {
+	return invalidArgument(field, "%s is required", field)
+}
+
+// permissionDenied reports a failed IAM check, as Cloud KMS does
+func permissionDenied(permission, resource string) error {
+	msg := fmt.Sprintf("Permission '%s' denied on resource '%s' (or it may not exist)", permission, resource)
+	return withDetails(codes.PermissionDenied, msg, &errdetails.ErrorInfo{
+		Reason:   ReasonPermissionDenied,
+		Domain:   DomainIAM,
+		Metadata: map[string]string{"permission": permission, "resource": resource},
+	})
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+// Cloud KMS crypto keys and versions have no etag field, so the emulator
+// carries etags in metadata: responses with a single key or version send its
+// etag in ETagHeader, and UpdateCryptoKey and UpdateCryptoKeyVersion calls
+// sending IfMatchHeader fail with ABORTED if the resource has changed since.
+const (
+	ETagHeader    = "x-emulator-etag"
+	IfMatchHeader = "x-emulator-if-match"
+)
+
+// withETag sends the etag of m as response metadata and returns m. Calls made
+// outside a gRPC server, such as from the in-process fake client, have no
+// response metadata and just get m back.
+func withETag[M proto.Message](ctx context.Context, m M) M {
+	_ = grpc.SetHeader(ctx, metadata.Pairs(ETagHeader, storage.ETag(m)))
+	return m
+}
+
+// ifMatch returns the etag a call requires the resource it updates to have,
+// or "" if it sent none
+func ifMatch(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(IfMatchHeader); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
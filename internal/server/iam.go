@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+
+	"cloud.google.com/go/iam/apiv1/iampb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	emulatorauth "github.com/blackwell-systems/gcp-emulator-auth"
+)
+
+// IAMPolicyServer serves the IAM methods Cloud KMS offers on its resources
+// (the KMS client's ResourceIAM) by forwarding them to the IAM emulator, so
+// cached permission answers are dropped when a policy changes
+type IAMPolicyServer struct {
+	iampb.UnimplementedIAMPolicyServer
+	kms *Server
+}
+
+// IAMPolicy returns the IAM policy service of the server, to register with
+// iampb.RegisterIAMPolicyServer next to the KMS service
+func (s *Server) IAMPolicy() *IAMPolicyServer {
+	return &IAMPolicyServer{kms: s}
+}
+
+// iamPolicyClient connects to the IAM emulator on first use
+func (s *Server) iamPolicyClient() (iampb.IAMPolicyClient, error) {
+	s.iamMu.Lock()
+	defer s.iamMu.Unlock()
+	if s.iamPolicy != nil {
+		return nil, status.Error(codes.FailedPrecondition, "IAM policies are read from the static policy file and cannot be changed at runtime")
+	}
+	if s.iamConn == nil {
+		conn, err := grpc.NewClient(s.iamHost, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to connect to IAM emulator: %v", err)
+		}
+		s.iamConn = conn
+	}
+	return iampb.NewIAMPolicyClient(s.iamConn), nil
+}
+
+// forwardContext passes the caller's principal on to the IAM emulator
+func forwardContext(ctx context.Context) context.Context {
+	return emulatorauth.InjectPrincipalToContext(ctx, emulatorauth.ExtractPrincipalFromContext(ctx))
+}
+
+// SetIamPolicy sets a resource's policy in the IAM emulator and drops the
+// cached answers for the resource and the resources below it
+func (p *IAMPolicyServer) SetIamPolicy(ctx context.Context, req *iampb.SetIamPolicyRequest) (*iampb.Policy, error) {
+	client, err := p.kms.iamPolicyClient()
+	if err != nil {
+		return nil, err
+	}
+	policy, err := client.SetIamPolicy(forwardContext(ctx), req)
+	if err != nil {
+		return nil, err
+	}
+	if cache := p.kms.IAMCache(); cache != nil {
+		cache.Invalidate(req.Resource)
+	}
+	return policy, nil
+}
+
+// GetIamPolicy returns a resource's policy from the IAM emulator
+func (p *IAMPolicyServer) GetIamPolicy(ctx context.Context, req *iampb.GetIamPolicyRequest) (*iampb.Policy, error) {
+	client, err := p.kms.iamPolicyClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.GetIamPolicy(forwardContext(ctx), req)
+}
+
+// TestIamPermissions returns the permissions the caller holds on a resource,
+// from the static policy or the IAM emulator
+func (p *IAMPolicyServer) TestIamPermissions(ctx context.Context, req *iampb.TestIamPermissionsRequest) (*iampb.TestIamPermissionsResponse, error) {
+	p.kms.iamMu.RLock()
+	policy := p.kms.iamPolicy
+	p.kms.iamMu.RUnlock()
+	if policy == nil {
+		client, err := p.kms.iamPolicyClient()
+		if err != nil {
+			return nil, err
+		}
+		return client.TestIamPermissions(forwardContext(ctx), req)
+	}
+
+	caller := emulatorauth.ExtractPrincipalFromContext(ctx)
+	resp := &iampb.TestIamPermissionsResponse{}
+	for _, perm := range req.Permissions {
+		allowed, err := policy.CheckPermission(ctx, caller, req.Resource, perm)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "IAM check failed: %v", err)
+		}
+		if allowed {
+			resp.Permissions = append(resp.Permissions, perm)
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"hash/crc32"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// crc32cTable computes the CRC32C checksums Cloud KMS uses for data integrity
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func crc32c(data []byte) int64 {
+	return int64(crc32.Checksum(data, crc32cTable))
+}
+
+// verifyCRC32C checks an optional client-supplied checksum of a request field.
+// It reports whether a checksum was supplied, which responses echo back as
+// verified_<field>_crc32c.
+func verifyCRC32C(field string, data []byte, checksum *wrapperspb.Int64Value) (bool, error) {
+	if checksum == nil {
+		return false, nil
+	}
+	if crc32c(data) != checksum.GetValue() {
+		return false, invalidArgument(field+"_crc32c", "The checksum in field %s_crc32c did not match the data in field %s.", field, field)
+	}
+	return true, nil
+}
+
+// digestBytes returns whichever hash is set in a digest, which is what
+// digest_crc32c is computed over
+func digestBytes(digest *kmspb.Digest) []byte {
+	switch d := digest.GetDigest().(type) {
+	case *kmspb.Digest_Sha256:
+		return d.Sha256
+	case *kmspb.Digest_Sha384:
+		return d.Sha384
+	case *kmspb.Digest_Sha512:
+		return d.Sha512
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"regexp"
+	"sort"
+)
+
+// Label limits enforced by Cloud KMS, as for other Google Cloud resources
+const (
+	maxLabels      = 64
+	maxLabelLength = 63
+)
+
+var (
+	// labelKey matches label keys: a lowercase letter followed by lowercase
+	// letters, digits, underscores and dashes
+	labelKey = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+	// labelValue matches label values, which may be empty
+	labelValue = regexp.MustCompile(`^[a-z0-9_-]*$`)
+)
+
+// validateLabels checks the labels of a crypto key against the Cloud KMS
+// constraints, so labels real KMS would reject fail locally too. Keys are
+// checked in order, so the same labels always report the same violation.
+func validateLabels(labels map[string]string) error {
+	const field = "crypto_key.labels"
+	if len(labels) > maxLabels {
+		return invalidArgument(field, "a crypto key can have at most %d labels, got %d", maxLabels, len(labels))
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := labels[k]
+		switch {
+		case k == "":
+			return invalidArgument(field, "label keys must not be empty")
+		case len(k) > maxLabelLength:
+			return invalidArgument(field, "label key %q must be at most %d characters, got %d", k, maxLabelLength, len(k))
+		case !labelKey.MatchString(k):
+			return invalidArgument(field, "label key %q must start with a lowercase letter and contain only lowercase letters, digits, underscores and dashes", k)
+		case len(v) > maxLabelLength:
+			return invalidArgument(field, "value of label %q must be at most %d characters, got %d", k, maxLabelLength, len(v))
+		case !labelValue.MatchString(v):
+			return invalidArgument(field, "value %q of label %q must contain only lowercase letters, digits, underscores and dashes", v, k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	emulatorauth "github.com/blackwell-systems/gcp-emulator-auth"
+)
+
+func TestValidateLabels(t *testing.T) {
+	tooMany := make(map[string]string)
+	for i := 0; i <= maxLabels; i++ {
+		tooMany[fmt.Sprintf("k%d", i)] = "v"
+	}
+	tests := []struct {
+		name   string
+		labels map[string]string
+		valid  bool
+	}{
+		{"none", nil, true},
+		{"typical", map[string]string{"env": "prod", "team_name": "pay-ments", "empty": ""}, true},
+		{"longest", map[string]string{"a" + strings.Repeat("b", 62): strings.Repeat("c", 63)}, true},
+		{"too many", tooMany, false},
+		{"empty key", map[string]string{"": "v"}, false},
+		{"key too long", map[string]string{"a" + strings.Repeat("b", 63): "v"}, false},
+		{"key starting with a digit", map[string]string{"1env": "v"}, false},
+		{"uppercase key", map[string]string{"Env": "v"}, false},
+		{"key with a dot", map[string]string{"app.kubernetes.io": "v"}, false},
+		{"value too long", map[string]string{"env": strings.Repeat("c", 64)}, false},
+		{"uppercase value", map[string]string{"env": "Prod"}, false},
+		{"value with a space", map[string]string{"env": "a b"}, false},
+	}
+	for _, tt := range tests {
+		err := validateLabels(tt.labels)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid=%v, got %v", tt.name, tt.valid, err)
+		}
+		if err != nil && status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: expected InvalidArgument, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestLabelsValidatedOnCreateAndUpdate(t *testing.T) {
+	const keyRing = "projects/p/locations/global/keyRings/r"
+	ctx := context.Background()
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetIAMMode(emulatorauth.AuthModeOff); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/p/locations/global", KeyRingId: "r"}); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := map[string]string{"Team": "payments"}
+	_, err = s.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{Parent: keyRing, CryptoKeyId: "k", CryptoKey: &kmspb.CryptoKey{Labels: invalid}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected CreateCryptoKey to reject invalid labels, got %v", err)
+	}
+	key, err := s.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{Parent: keyRing, CryptoKeyId: "k", CryptoKey: &kmspb.CryptoKey{Labels: map[string]string{"team": "payments"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.UpdateCryptoKey(ctx, &kmspb.UpdateCryptoKeyRequest{CryptoKey: &kmspb.CryptoKey{Name: key.Name, Labels: invalid}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected UpdateCryptoKey to reject invalid labels, got %v", err)
+	}
+	if got, _ := s.GetCryptoKey(ctx, &kmspb.GetCryptoKeyRequest{Name: key.Name}); got.Labels["team"] != "payments" {
+		t.Errorf("Expected the rejected update to leave the labels unchanged, got %v", got.Labels)
+	}
+}
@@ -0,0 +1,31 @@
+package server
+
+// Size limits enforced by Cloud KMS
+const (
+	// MaxPayloadBytes is the largest plaintext or additional authenticated
+	// data accepted by Encrypt for SOFTWARE keys
+	MaxPayloadBytes = 64 * 1024
+
+	// MaxMessageBytes bounds a whole request or response. Every valid KMS
+	// message fits well within it, including base64-encoded REST bodies.
+	MaxMessageBytes = 1 << 20
+
+	// minRandomBytes and maxRandomBytes bound GenerateRandomBytes length_bytes
+	minRandomBytes = 8
+	maxRandomBytes = 1024
+)
+
+// SetMaxPayloadBytes changes the plaintext and AAD limit enforced by Encrypt.
+// Zero disables the check, e.g. for stress tests with oversized payloads.
+func (s *Server) SetMaxPayloadBytes(n int) {
+	s.maxPayloadBytes = n
+}
+
+// checkPayloadSize rejects a field larger than the payload limit the way
+// Cloud KMS does
+func (s *Server) checkPayloadSize(field string, data []byte) error {
+	if s.maxPayloadBytes > 0 && len(data) > s.maxPayloadBytes {
+		return invalidArgument(field, "%s must be no larger than %d bytes, got %d", field, s.maxPayloadBytes, len(data))
+	}
+	return nil
+}
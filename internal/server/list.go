@@ -0,0 +1,571 @@
+package server
+
+import (
+	"cmp"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// maxPageSize is the largest page List methods return. It is also used when
+// page_size is unset.
+const maxPageSize = 1000
+
+// listPage applies the filter, order_by, page_size and page_token of a List
+// request to the full result set. It returns the requested page, the token
+// for the next page (empty on the last page) and the number of results
+// matching the filter.
+//
+// Filters use the subset of AIP-160 Cloud KMS documents: comparisons joined by
+// AND (or whitespace) and OR, negated with NOT or a leading "-", such as
+//
+//	state=ENABLED AND labels.env:prod
+//	purpose=MAC OR purpose=ENCRYPT_DECRYPT
+//	create_time>"2024-01-01T00:00:00Z"
+//
+// Values containing spaces or operator characters must be quoted.
+func listPage[T proto.Message](items []T, filter, orderBy string, pageSize int32, pageToken string) ([]T, string, int32, error) {
+	var zero T
+	md := zero.ProtoReflect().Descriptor()
+
+	match, err := parseFilter(md, filter)
+	if err != nil {
+		return nil, "", 0, invalidArgument("filter", "invalid filter %q: %v", filter, err)
+	}
+	less, err := parseOrderBy(md, orderBy)
+	if err != nil {
+		return nil, "", 0, invalidArgument("order_by", "invalid order_by %q: %v", orderBy, err)
+	}
+	if pageSize < 0 {
+		return nil, "", 0, invalidArgument("page_size", "page_size must not be negative")
+	}
+
+	matched := make([]T, 0, len(items))
+	for _, item := range items {
+		if match(item.ProtoReflect()) {
+			matched = append(matched, item)
+		}
+	}
+	if less != nil {
+		sort.SliceStable(matched, func(i, j int) bool {
+			return less(matched[i].ProtoReflect(), matched[j].ProtoReflect())
+		})
+	}
+
+	offset := 0
+	if pageToken != "" {
+		offset, err = decodePageToken(pageToken)
+		if err != nil || offset > len(matched) {
+			return nil, "", 0, invalidArgument("page_token", "invalid page_token %q", pageToken)
+		}
+	}
+
+	size := int(pageSize)
+	if size == 0 || size > maxPageSize {
+		size = maxPageSize
+	}
+	end := min(offset+size, len(matched))
+
+	nextPageToken := ""
+	if end < len(matched) {
+		nextPageToken = encodePageToken(end)
+	}
+	return matched[offset:end], nextPageToken, int32(len(matched)), nil
+}
+
+// Page tokens are opaque to clients; they encode the offset of the next page
+func encodePageToken(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("offset:" + strconv.Itoa(offset)))
+}
+
+func decodePageToken(token string) (int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, err
+	}
+	value, ok := strings.CutPrefix(string(data), "offset:")
+	if !ok {
+		return 0, fmt.Errorf("malformed page token")
+	}
+	offset, err := strconv.Atoi(value)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("malformed page token")
+	}
+	return offset, nil
+}
+
+// fieldPath is a dotted field reference such as "primary.state" or
+// "labels.env", resolved against a message descriptor
+type fieldPath struct {
+	fields []protoreflect.FieldDescriptor
+	// mapKey is set when the path selects one entry of a map field
+	mapKey    string
+	hasMapKey bool
+}
+
+func parseFieldPath(md protoreflect.MessageDescriptor, path string) (fieldPath, error) {
+	var fp fieldPath
+	segments := strings.Split(path, ".")
+	for i, segment := range segments {
+		fd := md.Fields().ByName(protoreflect.Name(segment))
+		if fd == nil {
+			fd = md.Fields().ByJSONName(segment)
+		}
+		if fd == nil {
+			return fp, fmt.Errorf("unknown field %q", path)
+		}
+		fp.fields = append(fp.fields, fd)
+
+		last := i == len(segments)-1
+		switch {
+		case fd.IsMap():
+			if !last {
+				fp.mapKey = strings.Join(segments[i+1:], ".")
+				fp.hasMapKey = true
+			}
+			return fp, nil
+		case fd.IsList():
+			return fp, fmt.Errorf("repeated field %q cannot be filtered or ordered", path)
+		case !last:
+			if fd.Message() == nil || isScalarMessage(fd) {
+				return fp, fmt.Errorf("field %q has no subfields", strings.Join(segments[:i+1], "."))
+			}
+			md = fd.Message()
+		}
+	}
+	return fp, nil
+}
+
+// field returns the descriptor of the value the path selects
+func (fp fieldPath) field() protoreflect.FieldDescriptor {
+	fd := fp.fields[len(fp.fields)-1]
+	if fp.hasMapKey {
+		return fd.MapValue()
+	}
+	return fd
+}
+
+// get returns the value the path selects in m, or false if an enclosing
+// message, the field or the map entry is unset
+func (fp fieldPath) get(m protoreflect.Message) (protoreflect.Value, bool) {
+	for i, fd := range fp.fields {
+		if i < len(fp.fields)-1 {
+			if !m.Has(fd) {
+				return protoreflect.Value{}, false
+			}
+			m = m.Get(fd).Message()
+			continue
+		}
+
+		value := m.Get(fd)
+		if fd.IsMap() && fp.hasMapKey {
+			entry := value.Map().Get(protoreflect.ValueOfString(fp.mapKey).MapKey())
+			return entry, entry.IsValid()
+		}
+		if fd.Message() != nil && !fd.IsMap() && !m.Has(fd) {
+			return protoreflect.Value{}, false
+		}
+		return value, true
+	}
+	return protoreflect.Value{}, false
+}
+
+// isScalarMessage reports whether a message field holds a Timestamp or
+// Duration, which filters compare as single values
+func isScalarMessage(fd protoreflect.FieldDescriptor) bool {
+	if fd.Message() == nil {
+		return false
+	}
+	switch fd.Message().FullName() {
+	case "google.protobuf.Timestamp", "google.protobuf.Duration":
+		return true
+	}
+	return false
+}
+
+// compareValues orders two values of the same field
+func compareValues(fd protoreflect.FieldDescriptor, a, b protoreflect.Value) int {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return strings.Compare(a.String(), b.String())
+	case protoreflect.BoolKind:
+		return cmp.Compare(boolRank(a.Bool()), boolRank(b.Bool()))
+	case protoreflect.EnumKind:
+		return cmp.Compare(a.Enum(), b.Enum())
+	case protoreflect.Int32Kind, protoreflect.Int64Kind, protoreflect.Sint32Kind, protoreflect.Sint64Kind,
+		protoreflect.Sfixed32Kind, protoreflect.Sfixed64Kind:
+		return cmp.Compare(a.Int(), b.Int())
+	case protoreflect.Uint32Kind, protoreflect.Uint64Kind, protoreflect.Fixed32Kind, protoreflect.Fixed64Kind:
+		return cmp.Compare(a.Uint(), b.Uint())
+	case protoreflect.MessageKind:
+		switch fd.Message().FullName() {
+		case "google.protobuf.Timestamp":
+			return a.Message().Interface().(*timestamppb.Timestamp).AsTime().Compare(b.Message().Interface().(*timestamppb.Timestamp).AsTime())
+		case "google.protobuf.Duration":
+			return cmp.Compare(a.Message().Interface().(*durationpb.Duration).AsDuration(), b.Message().Interface().(*durationpb.Duration).AsDuration())
+		}
+	}
+	return 0
+}
+
+func boolRank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// parseLiteral converts a filter value to a value of field fd
+func parseLiteral(fd protoreflect.FieldDescriptor, literal string) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(literal), nil
+	case protoreflect.BoolKind:
+		b, err := strconv.ParseBool(literal)
+		if err != nil {
+			return protoreflect.Value{}, fmt.Errorf("%q is not a boolean", literal)
+		}
+		return protoreflect.ValueOfBool(b), nil
+	case protoreflect.EnumKind:
+		value := fd.Enum().Values().ByName(protoreflect.Name(literal))
+		if value == nil {
+			return protoreflect.Value{}, fmt.Errorf("%q is not a valid %s", literal, fd.Enum().Name())
+		}
+		return protoreflect.ValueOfEnum(value.Number()), nil
+	case protoreflect.Int32Kind, protoreflect.Int64Kind, protoreflect.Sint32Kind, protoreflect.Sint64Kind,
+		protoreflect.Sfixed32Kind, protoreflect.Sfixed64Kind:
+		n, err := strconv.ParseInt(literal, 10, 64)
+		if err != nil {
+			return protoreflect.Value{}, fmt.Errorf("%q is not an integer", literal)
+		}
+		return protoreflect.ValueOfInt64(n), nil
+	case protoreflect.Uint32Kind, protoreflect.Uint64Kind, protoreflect.Fixed32Kind, protoreflect.Fixed64Kind:
+		n, err := strconv.ParseUint(literal, 10, 64)
+		if err != nil {
+			return protoreflect.Value{}, fmt.Errorf("%q is not an unsigned integer", literal)
+		}
+		return protoreflect.ValueOfUint64(n), nil
+	case protoreflect.MessageKind:
+		switch fd.Message().FullName() {
+		case "google.protobuf.Timestamp":
+			t, err := time.Parse(time.RFC3339Nano, literal)
+			if err != nil {
+				return protoreflect.Value{}, fmt.Errorf("%q is not an RFC 3339 timestamp", literal)
+			}
+			return protoreflect.ValueOfMessage(timestamppb.New(t).ProtoReflect()), nil
+		case "google.protobuf.Duration":
+			d, err := time.ParseDuration(literal)
+			if err != nil {
+				return protoreflect.Value{}, fmt.Errorf("%q is not a duration", literal)
+			}
+			return protoreflect.ValueOfMessage(durationpb.New(d).ProtoReflect()), nil
+		}
+	}
+	return protoreflect.Value{}, fmt.Errorf("field %s cannot be compared", fd.Name())
+}
+
+type predicate func(protoreflect.Message) bool
+
+// parseFilter compiles an AIP-160 filter into a predicate. An empty filter
+// matches everything.
+func parseFilter(md protoreflect.MessageDescriptor, filter string) (predicate, error) {
+	tokens, err := tokenizeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{md: md, tokens: tokens}
+	var terms []predicate
+	for !p.done() {
+		if p.peek() == "AND" {
+			p.next()
+			continue
+		}
+		term, err := p.parseDisjunction()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+
+	return func(m protoreflect.Message) bool {
+		for _, term := range terms {
+			if !term(m) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+type filterParser struct {
+	md     protoreflect.MessageDescriptor
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) done() bool { return p.pos >= len(p.tokens) }
+
+func (p *filterParser) peek() string {
+	if p.done() {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+// parseDisjunction parses comparisons joined by OR, which binds tighter than
+// AND in AIP-160
+func (p *filterParser) parseDisjunction() (predicate, error) {
+	var alternatives []predicate
+	for {
+		comparison, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, comparison)
+		if p.peek() != "OR" {
+			break
+		}
+		p.next()
+	}
+
+	return func(m protoreflect.Message) bool {
+		for _, alternative := range alternatives {
+			if alternative(m) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func (p *filterParser) parseComparison() (predicate, error) {
+	negate := false
+	if p.peek() == "NOT" {
+		p.next()
+		negate = true
+	}
+
+	name := p.next()
+	if name == "" || isFilterOperator(name) || name == "AND" || name == "OR" {
+		return nil, fmt.Errorf("expected a field name, got %q", name)
+	}
+	if rest, ok := strings.CutPrefix(name, "-"); ok {
+		name = rest
+		negate = !negate
+	}
+	fp, err := parseFieldPath(p.md, name)
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.next()
+	if !isFilterOperator(op) {
+		return nil, fmt.Errorf("expected an operator after %q, got %q", name, op)
+	}
+	if p.done() {
+		return nil, fmt.Errorf("expected a value after %q", name+op)
+	}
+	literal := unquote(p.next())
+
+	compare, err := comparison(fp, op, literal)
+	if err != nil {
+		return nil, err
+	}
+	if negate {
+		return func(m protoreflect.Message) bool { return !compare(m) }, nil
+	}
+	return compare, nil
+}
+
+// comparison builds the predicate for one "field op value" expression
+func comparison(fp fieldPath, op, literal string) (predicate, error) {
+	fd := fp.field()
+
+	if op == ":" {
+		// field:* tests presence; labels:key tests for a map key
+		if literal == "*" {
+			return func(m protoreflect.Message) bool { _, ok := fp.get(m); return ok }, nil
+		}
+		if fd.IsMap() {
+			key := protoreflect.ValueOfString(literal).MapKey()
+			return func(m protoreflect.Message) bool {
+				value, ok := fp.get(m)
+				return ok && value.Map().Has(key)
+			}, nil
+		}
+		if fd.Kind() == protoreflect.StringKind {
+			return func(m protoreflect.Message) bool {
+				value, ok := fp.get(m)
+				return ok && strings.Contains(value.String(), literal)
+			}, nil
+		}
+		op = "="
+	}
+
+	if fd.IsMap() {
+		return nil, fmt.Errorf("map field %s must be compared by key, such as %s.key=value", fd.Name(), fd.Name())
+	}
+	want, err := parseLiteral(fd, literal)
+	if err != nil {
+		return nil, err
+	}
+
+	var accept func(order int) bool
+	switch op {
+	case "=":
+		accept = func(order int) bool { return order == 0 }
+	case "!=":
+		accept = func(order int) bool { return order != 0 }
+	case "<":
+		accept = func(order int) bool { return order < 0 }
+	case "<=":
+		accept = func(order int) bool { return order <= 0 }
+	case ">":
+		accept = func(order int) bool { return order > 0 }
+	case ">=":
+		accept = func(order int) bool { return order >= 0 }
+	}
+
+	return func(m protoreflect.Message) bool {
+		value, ok := fp.get(m)
+		if !ok {
+			return op == "!="
+		}
+		return accept(compareValues(fd, value, want))
+	}, nil
+}
+
+func isFilterOperator(token string) bool {
+	switch token {
+	case "=", "!=", "<", "<=", ">", ">=", ":":
+		return true
+	}
+	return false
+}
+
+func unquote(token string) string {
+	if len(token) >= 2 && (token[0] == '"' || token[0] == '\'') && token[len(token)-1] == token[0] {
+		return token[1 : len(token)-1]
+	}
+	return token
+}
+
+// tokenizeFilter splits a filter into words, quoted strings and operators
+func tokenizeFilter(filter string) ([]string, error) {
+	const special = " \t\r\n\"'()=!<>:"
+
+	var tokens []string
+	for i := 0; i < len(filter); {
+		c := filter[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(filter[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			tokens = append(tokens, filter[i:i+end+2])
+			i += end + 2
+		case c == '(' || c == ')':
+			return nil, fmt.Errorf("parentheses are not supported")
+		case strings.IndexByte("=!<>:", c) >= 0:
+			op := string(c)
+			if (c == '!' || c == '<' || c == '>') && i+1 < len(filter) && filter[i+1] == '=' {
+				op += "="
+			}
+			if op == "!" {
+				return nil, fmt.Errorf("unexpected %q at offset %d", op, i)
+			}
+			tokens = append(tokens, op)
+			i += len(op)
+		default:
+			end := i
+			for end < len(filter) && strings.IndexByte(special, filter[end]) < 0 {
+				end++
+			}
+			tokens = append(tokens, filter[i:end])
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// parseOrderBy compiles an order_by such as "name" or "create_time desc,
+// name" into a less function. An empty order_by returns nil, keeping the
+// storage order.
+func parseOrderBy(md protoreflect.MessageDescriptor, orderBy string) (func(a, b protoreflect.Message) bool, error) {
+	if strings.TrimSpace(orderBy) == "" {
+		return nil, nil
+	}
+
+	type key struct {
+		path fieldPath
+		desc bool
+	}
+	var keys []key
+	for _, clause := range strings.Split(orderBy, ",") {
+		words := strings.Fields(clause)
+		if len(words) == 0 || len(words) > 2 {
+			return nil, fmt.Errorf("malformed clause %q", strings.TrimSpace(clause))
+		}
+		k := key{}
+		if len(words) == 2 {
+			switch strings.ToLower(words[1]) {
+			case "asc":
+			case "desc":
+				k.desc = true
+			default:
+				return nil, fmt.Errorf("unknown direction %q", words[1])
+			}
+		}
+		fp, err := parseFieldPath(md, words[0])
+		if err != nil {
+			return nil, err
+		}
+		if fp.field().IsMap() || (fp.field().Message() != nil && !isScalarMessage(fp.field())) {
+			return nil, fmt.Errorf("field %q cannot be ordered", words[0])
+		}
+		k.path = fp
+		keys = append(keys, k)
+	}
+
+	return func(a, b protoreflect.Message) bool {
+		for _, k := range keys {
+			av, aok := k.path.get(a)
+			bv, bok := k.path.get(b)
+			order := 0
+			switch {
+			case !aok && !bok:
+			case !aok:
+				order = -1
+			case !bok:
+				order = 1
+			default:
+				order = compareValues(k.path.field(), av, bv)
+			}
+			if k.desc {
+				order = -order
+			}
+			if order != 0 {
+				return order < 0
+			}
+		}
+		return false
+	}, nil
+}
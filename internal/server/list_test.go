@@ -0,0 +1,161 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func testCryptoKeys() []*kmspb.CryptoKey {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return []*kmspb.CryptoKey{
+		{
+			Name:       "projects/p/locations/global/keyRings/r/cryptoKeys/a",
+			Purpose:    kmspb.CryptoKey_ENCRYPT_DECRYPT,
+			CreateTime: timestamppb.New(created),
+			Labels:     map[string]string{"env": "prod", "team": "payments"},
+			Primary:    &kmspb.CryptoKeyVersion{State: kmspb.CryptoKeyVersion_ENABLED},
+		},
+		{
+			Name:       "projects/p/locations/global/keyRings/r/cryptoKeys/b",
+			Purpose:    kmspb.CryptoKey_MAC,
+			CreateTime: timestamppb.New(created.Add(time.Hour)),
+			Labels:     map[string]string{"env": "dev"},
+			Primary:    &kmspb.CryptoKeyVersion{State: kmspb.CryptoKeyVersion_DISABLED},
+		},
+		{
+			Name:       "projects/p/locations/global/keyRings/r/cryptoKeys/c",
+			Purpose:    kmspb.CryptoKey_ASYMMETRIC_SIGN,
+			CreateTime: timestamppb.New(created.Add(2 * time.Hour)),
+		},
+	}
+}
+
+func names(keys []*kmspb.CryptoKey) string {
+	var s string
+	for _, k := range keys {
+		s += k.Name[len(k.Name)-1:]
+	}
+	return s
+}
+
+func TestListPageFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{"", "abc"},
+		{"purpose=MAC", "b"},
+		{"purpose!=MAC", "ac"},
+		{"purpose=MAC OR purpose=ASYMMETRIC_SIGN", "bc"},
+		{"labels.env=prod", "a"},
+		{"labels:team", "a"},
+		{"labels.env:*", "ab"},
+		{"primary.state=ENABLED", "a"},
+		{"NOT primary.state=ENABLED", "bc"},
+		{"-purpose=ENCRYPT_DECRYPT", "bc"},
+		{"name:cryptoKeys/b", "b"},
+		{`create_time>"2024-01-01T00:30:00Z" AND purpose!=ASYMMETRIC_SIGN`, "b"},
+		{`create_time>="2024-01-01T01:00:00Z" labels.env="dev"`, "b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			page, _, total, err := listPage(testCryptoKeys(), tt.filter, "", 0, "")
+			if err != nil {
+				t.Fatalf("listPage failed: %v", err)
+			}
+			if got := names(page); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+			if int(total) != len(tt.want) {
+				t.Errorf("Expected total %d, got %d", len(tt.want), total)
+			}
+		})
+	}
+}
+
+func TestListPageInvalidFilter(t *testing.T) {
+	for _, filter := range []string{
+		"bogus=1",
+		"purpose=NOT_A_PURPOSE",
+		"purpose",
+		"purpose=",
+		"(purpose=MAC)",
+		"labels=prod",
+		`name="unterminated`,
+	} {
+		t.Run(filter, func(t *testing.T) {
+			_, _, _, err := listPage(testCryptoKeys(), filter, "", 0, "")
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("Expected InvalidArgument, got %v", err)
+			}
+		})
+	}
+}
+
+func TestListPageOrderBy(t *testing.T) {
+	tests := []struct {
+		orderBy string
+		want    string
+	}{
+		{"name desc", "cba"},
+		{"create_time desc", "cba"},
+		{"purpose", "acb"},
+		{"primary.state desc, name", "bac"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.orderBy, func(t *testing.T) {
+			page, _, _, err := listPage(testCryptoKeys(), "", tt.orderBy, 0, "")
+			if err != nil {
+				t.Fatalf("listPage failed: %v", err)
+			}
+			if got := names(page); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	if _, _, _, err := listPage(testCryptoKeys(), "", "name sideways", 0, ""); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a bad direction, got %v", err)
+	}
+}
+
+func TestListPagePagination(t *testing.T) {
+	var got string
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("Pagination did not terminate")
+		}
+		page, next, total, err := listPage(testCryptoKeys(), "", "", 2, token)
+		if err != nil {
+			t.Fatalf("listPage failed: %v", err)
+		}
+		if total != 3 {
+			t.Errorf("Expected total 3, got %d", total)
+		}
+		got += names(page)
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	if got != "abc" {
+		t.Errorf("Expected all keys across pages, got %q", got)
+	}
+
+	for _, token := range []string{"garbage", encodePageToken(10)} {
+		if _, _, _, err := listPage(testCryptoKeys(), "", "", 2, token); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument for page token %q, got %v", token, err)
+		}
+	}
+	if _, _, _, err := listPage(testCryptoKeys(), "", "", -1, ""); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a negative page size, got %v", err)
+	}
+}
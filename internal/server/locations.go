@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	locationpb "google.golang.org/genproto/googleapis/cloud/location"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// Location is a Cloud KMS location served by the Locations service
+type Location struct {
+	ID          string
+	DisplayName string
+}
+
+// KMSLocations lists the locations the emulator reports and accepts keyrings
+// in, mirroring the regions, dual-regions and multi-regions of Cloud KMS
+var KMSLocations = []Location{
+	{"global", "Global"},
+	{"us", "United States"},
+	{"europe", "Europe"},
+	{"asia", "Asia"},
+	{"asia1", "Tokyo, Osaka and Seoul"},
+	{"eur3", "Belgium and Netherlands"},
+	{"eur4", "Netherlands and Finland"},
+	{"eur5", "Belgium and London"},
+	{"nam3", "Northern Virginia and South Carolina"},
+	{"nam4", "Iowa and South Carolina"},
+	{"nam-eur-asia1", "North America, Europe and Asia"},
+	{"africa-south1", "Johannesburg"},
+	{"asia-east1", "Taiwan"},
+	{"asia-east2", "Hong Kong"},
+	{"asia-northeast1", "Tokyo"},
+	{"asia-northeast2", "Osaka"},
+	{"asia-northeast3", "Seoul"},
+	{"asia-south1", "Mumbai"},
+	{"asia-south2", "Delhi"},
+	{"asia-southeast1", "Singapore"},
+	{"asia-southeast2", "Jakarta"},
+	{"australia-southeast1", "Sydney"},
+	{"australia-southeast2", "Melbourne"},
+	{"europe-central2", "Warsaw"},
+	{"europe-north1", "Finland"},
+	{"europe-north2", "Stockholm"},
+	{"europe-southwest1", "Madrid"},
+	{"europe-west1", "Belgium"},
+	{"europe-west2", "London"},
+	{"europe-west3", "Frankfurt"},
+	{"europe-west4", "Netherlands"},
+	{"europe-west6", "Zürich"},
+	{"europe-west8", "Milan"},
+	{"europe-west9", "Paris"},
+	{"europe-west10", "Berlin"},
+	{"europe-west12", "Turin"},
+	{"me-central1", "Doha"},
+	{"me-central2", "Dammam"},
+	{"me-west1", "Tel Aviv"},
+	{"northamerica-northeast1", "Montréal"},
+	{"northamerica-northeast2", "Toronto"},
+	{"northamerica-south1", "Querétaro"},
+	{"southamerica-east1", "São Paulo"},
+	{"southamerica-west1", "Santiago"},
+	{"us-central1", "Iowa"},
+	{"us-east1", "South Carolina"},
+	{"us-east4", "Northern Virginia"},
+	{"us-east5", "Columbus"},
+	{"us-south1", "Dallas"},
+	{"us-west1", "Oregon"},
+	{"us-west2", "Los Angeles"},
+	{"us-west3", "Salt Lake City"},
+	{"us-west4", "Las Vegas"},
+}
+
+// locationType is the ResourceInfo type of locations
+const locationType = "type.googleapis.com/google.cloud.location.Location"
+
+// locationID matches well-formed location IDs; anything else is rejected as
+// invalid rather than unknown
+var locationID = regexp.MustCompile(`^[a-z][a-z0-9-]*[a-z0-9]$`)
+
+// withCustomLocations returns KMSLocations followed by the custom location
+// IDs it lacks, which are displayed by ID
+func withCustomLocations(custom []string) ([]Location, error) {
+	locations := KMSLocations
+	for _, id := range custom {
+		if !locationID.MatchString(id) {
+			return nil, fmt.Errorf("invalid location ID %q", id)
+		}
+		if _, ok := findLocation(locations, id); !ok {
+			locations = append(locations[:len(locations):len(locations)], Location{id, id})
+		}
+	}
+	return locations, nil
+}
+
+// findLocation looks up a location by ID
+func findLocation(locations []Location, id string) (Location, bool) {
+	for _, loc := range locations {
+		if loc.ID == id {
+			return loc, true
+		}
+	}
+	return Location{}, false
+}
+
+// SetCustomLocations accepts keyrings in these location IDs as well as in
+// KMSLocations, and reports them from the Locations service returned by
+// Locations. Call it before serving.
+func (s *Server) SetCustomLocations(ids []string) error {
+	locations, err := withCustomLocations(ids)
+	if err != nil {
+		return err
+	}
+	s.locations = locations
+	return nil
+}
+
+// Locations returns the Locations service for the server's locations
+func (s *Server) Locations() *Locations {
+	return &Locations{locations: s.locations}
+}
+
+// checkLocation rejects a parent of the form projects/{project}/locations/{location}
+// naming a location Cloud KMS does not offer: NotFound for an unknown
+// location, InvalidArgument for one that is not a location ID at all
+func (s *Server) checkLocation(parent string) error {
+	parts := strings.Split(parent, "/")
+	if len(parts) != 4 || parts[0] != "projects" || !projectID.MatchString(parts[1]) || parts[2] != "locations" {
+		return invalidArgument("parent", "invalid parent %q, expected projects/{project}/locations/{location}", parent)
+	}
+	if !locationID.MatchString(parts[3]) {
+		return invalidArgument("parent", "invalid location %q in parent %q", parts[3], parent)
+	}
+	if _, ok := findLocation(s.locations, parts[3]); !ok {
+		return resourceInfoError(codes.NotFound, locationType, parent, fmt.Sprintf("Location %s not found", parent))
+	}
+	return nil
+}
+
+// Locations implements the google.cloud.location.Locations service Cloud KMS
+// exposes alongside KeyManagementService. gcloud and discovery-based clients
+// query it before making any KMS call.
+type Locations struct {
+	locationpb.UnimplementedLocationsServer
+	locations []Location
+}
+
+// NewLocations creates the Locations service for KMSLocations
+func NewLocations() *Locations {
+	return &Locations{locations: KMSLocations}
+}
+
+// ListLocations lists the locations of a project
+func (l *Locations) ListLocations(ctx context.Context, req *locationpb.ListLocationsRequest) (*locationpb.ListLocationsResponse, error) {
+	project, ok := strings.CutPrefix(req.Name, "projects/")
+	if !ok || project == "" || strings.Contains(project, "/") {
+		return nil, invalidArgument("name", "invalid project name %q, expected projects/{project}", req.Name)
+	}
+
+	locations := make([]*locationpb.Location, 0, len(l.locations))
+	for _, loc := range l.locations {
+		location, err := locationProto(req.Name, loc)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, location)
+	}
+
+	page, nextPageToken, _, err := listPage(locations, req.Filter, "", req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &locationpb.ListLocationsResponse{
+		Locations:     page,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// GetLocation gets a single location
+func (l *Locations) GetLocation(ctx context.Context, req *locationpb.GetLocationRequest) (*locationpb.Location, error) {
+	parts := strings.Split(req.Name, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[1] == "" || parts[2] != "locations" || parts[3] == "" {
+		return nil, invalidArgument("name", "invalid location name %q, expected projects/{project}/locations/{location}", req.Name)
+	}
+
+	if loc, ok := findLocation(l.locations, parts[3]); ok {
+		return locationProto("projects/"+parts[1], loc)
+	}
+	return nil, resourceInfoError(codes.NotFound, locationType, req.Name, fmt.Sprintf("Location %s not found", req.Name))
+}
+
+// locationProto builds the Location resource for loc in project. The emulator
+// has neither HSM nor EKM keys, so both are reported unavailable.
+func locationProto(project string, loc Location) (*locationpb.Location, error) {
+	metadata, err := anypb.New(&kmspb.LocationMetadata{})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &locationpb.Location{
+		Name:        project + "/locations/" + loc.ID,
+		LocationId:  loc.ID,
+		DisplayName: loc.DisplayName,
+		Metadata:    metadata,
+	}, nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+// implementedMethods lists the KeyManagementService methods the emulator
+// implements; every other method returns Unimplemented. Keep it in sync when
+// implementing a method.
+var implementedMethods = map[string]bool{
+	"CreateKeyRing":                 true,
+	"GetKeyRing":                    true,
+	"ListKeyRings":                  true,
+	"CreateCryptoKey":               true,
+	"GetCryptoKey":                  true,
+	"ListCryptoKeys":                true,
+	"UpdateCryptoKey":               true,
+	"CreateCryptoKeyVersion":        true,
+	"GetCryptoKeyVersion":           true,
+	"ListCryptoKeyVersions":         true,
+	"UpdateCryptoKeyVersion":        true,
+	"UpdateCryptoKeyPrimaryVersion": true,
+	"DestroyCryptoKeyVersion":       true,
+	"RestoreCryptoKeyVersion":       true,
+	"Encrypt":                       true,
+	"Decrypt":                       true,
+	"GetPublicKey":                  true,
+	"AsymmetricSign":                true,
+	"AsymmetricDecrypt":             true,
+	"MacSign":                       true,
+	"MacVerify":                     true,
+	"GenerateRandomBytes":           true,
+	"CreateImportJob":               true,
+	"GetImportJob":                  true,
+	"ListImportJobs":                true,
+	"ImportCryptoKeyVersion":        true,
+}
+
+// SupportedAlgorithms lists the key version algorithms the emulator can
+// create keys with
+var SupportedAlgorithms = storage.Algorithms()
+
+// SupportedPurposes lists the key purposes the emulator can create keys with
+var SupportedPurposes = storage.Purposes()
+
+// Methods returns the name of every KeyManagementService method, in the order
+// the API defines them
+func Methods() []string {
+	methods := kmspb.File_google_cloud_kms_v1_service_proto.Services().ByName("KeyManagementService").Methods()
+	names := make([]string, methods.Len())
+	for i := range names {
+		names[i] = string(methods.Get(i).Name())
+	}
+	return names
+}
+
+// Implemented reports whether method (e.g. "Encrypt") is implemented
+func Implemented(method string) bool {
+	return implementedMethods[method]
+}
+
+// validateAlgorithm checks that a key of the given purpose can be created
+// with algorithm. Only ENCRYPT_DECRYPT keys have a default algorithm.
+func validateAlgorithm(purpose kmspb.CryptoKey_CryptoKeyPurpose, algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm) error {
+	if algorithm == kmspb.CryptoKeyVersion_CRYPTO_KEY_VERSION_ALGORITHM_UNSPECIFIED {
+		if purpose == kmspb.CryptoKey_ENCRYPT_DECRYPT {
+			return nil
+		}
+		return invalidArgument("crypto_key.version_template.algorithm", "version_template.algorithm is required for purpose %s", purpose)
+	}
+
+	algorithmPurpose, ok := storage.AlgorithmPurpose(algorithm)
+	if !ok {
+		return invalidArgument("crypto_key.version_template.algorithm", "algorithm %s is not supported by the emulator", algorithm)
+	}
+	if algorithmPurpose != purpose {
+		return invalidArgument("crypto_key.version_template.algorithm", "algorithm %s is not compatible with purpose %s", algorithm, purpose)
+	}
+	return nil
+}
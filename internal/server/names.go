@@ -0,0 +1,78 @@
+package server
+
+import (
+	"regexp"
+)
+
+// resourceName describes the form of one kind of Cloud KMS resource name
+type resourceName struct {
+	pattern *regexp.Regexp
+	form    string
+}
+
+// Segments of Cloud KMS resource names. Project IDs are lowercase (with the
+// domain prefix of domain-scoped projects), locations as locationID accepts
+// them, and key ring, crypto key and import job IDs as resourceID does. IDs
+// are case-sensitive, and percent signs never match, so URL-encoded segments
+// are rejected rather than decoded.
+const (
+	projectSegment  = `[a-z0-9][a-z0-9.:-]*`
+	locationSegment = `[a-z][a-z0-9-]*[a-z0-9]`
+	idSegment       = `[a-zA-Z0-9_-]{1,63}`
+	keyRingPrefix   = `^projects/` + projectSegment + `/locations/` + locationSegment + `/keyRings/` + idSegment
+)
+
+// Resource names of Cloud KMS. Each segment is one path component, so a name
+// nested under the wrong parent, or of another kind, never matches.
+var (
+	keyRingName = resourceName{
+		regexp.MustCompile(keyRingPrefix + `$`),
+		"projects/{project}/locations/{location}/keyRings/{keyRing}",
+	}
+	cryptoKeyName = resourceName{
+		regexp.MustCompile(keyRingPrefix + `/cryptoKeys/` + idSegment + `$`),
+		"projects/{project}/locations/{location}/keyRings/{keyRing}/cryptoKeys/{cryptoKey}",
+	}
+	cryptoKeyVersionName = resourceName{
+		regexp.MustCompile(keyRingPrefix + `/cryptoKeys/` + idSegment + `/cryptoKeyVersions/[1-9][0-9]*$`),
+		"projects/{project}/locations/{location}/keyRings/{keyRing}/cryptoKeys/{cryptoKey}/cryptoKeyVersions/{cryptoKeyVersion}",
+	}
+	// cryptoKeyOrVersionName is the name Encrypt takes: a key, to encrypt
+	// with its primary version, or one of its versions
+	cryptoKeyOrVersionName = resourceName{
+		regexp.MustCompile(keyRingPrefix + `/cryptoKeys/` + idSegment + `(/cryptoKeyVersions/[1-9][0-9]*)?$`),
+		"projects/{project}/locations/{location}/keyRings/{keyRing}/cryptoKeys/{cryptoKey}[/cryptoKeyVersions/{cryptoKeyVersion}]",
+	}
+	importJobName = resourceName{
+		regexp.MustCompile(keyRingPrefix + `/importJobs/` + idSegment + `$`),
+		"projects/{project}/locations/{location}/keyRings/{keyRing}/importJobs/{importJob}",
+	}
+)
+
+// projectID matches the project IDs of resource names
+var projectID = regexp.MustCompile(`^` + projectSegment + `$`)
+
+// resourceID matches the key ring, crypto key and import job IDs Cloud KMS
+// accepts on creation
+var resourceID = regexp.MustCompile(`^` + idSegment + `$`)
+
+// versionID matches crypto key version IDs, which are positive integers
+var versionID = regexp.MustCompile(`^[1-9][0-9]*$`)
+
+// checkName rejects a malformed resource name in field with InvalidArgument,
+// as Cloud KMS does, rather than letting the lookup report NotFound
+func checkName(field, name string, kind resourceName) error {
+	if !kind.pattern.MatchString(name) {
+		return invalidArgument(field, "invalid resource name %q in %s, expected %s", name, field, kind.form)
+	}
+	return nil
+}
+
+// checkID rejects a key ring, crypto key or import job ID in field with
+// InvalidArgument, in the words Cloud KMS uses
+func checkID(field, id string) error {
+	if !resourceID.MatchString(id) {
+		return invalidArgument(field, "Invalid value for field %q. Expected value to match regular expression %s.", field, resourceID)
+	}
+	return nil
+}
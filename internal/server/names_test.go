@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	emulatorauth "github.com/blackwell-systems/gcp-emulator-auth"
+)
+
+func TestResourceNames(t *testing.T) {
+	const (
+		keyRing = "projects/p/locations/global/keyRings/r"
+		key     = keyRing + "/cryptoKeys/k"
+	)
+	ctx := context.Background()
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetIAMMode(emulatorauth.AuthModeOff); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/p/locations/global", KeyRingId: "r"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{Parent: keyRing, CryptoKeyId: "k", CryptoKey: &kmspb.CryptoKey{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+		code codes.Code
+	}{
+		{"key ring as a key", func() error {
+			_, err := s.GetCryptoKey(ctx, &kmspb.GetCryptoKeyRequest{Name: keyRing})
+			return err
+		}, codes.InvalidArgument},
+		{"key as a version", func() error {
+			_, err := s.GetCryptoKeyVersion(ctx, &kmspb.GetCryptoKeyVersionRequest{Name: key})
+			return err
+		}, codes.InvalidArgument},
+		{"non-numeric version", func() error {
+			_, err := s.DestroyCryptoKeyVersion(ctx, &kmspb.DestroyCryptoKeyVersionRequest{Name: key + "/cryptoKeyVersions/one"})
+			return err
+		}, codes.InvalidArgument},
+		{"trailing segment", func() error {
+			_, err := s.GetKeyRing(ctx, &kmspb.GetKeyRingRequest{Name: keyRing + "/"})
+			return err
+		}, codes.InvalidArgument},
+		{"missing location", func() error {
+			_, err := s.ListCryptoKeys(ctx, &kmspb.ListCryptoKeysRequest{Parent: "projects/p/keyRings/r"})
+			return err
+		}, codes.InvalidArgument},
+		{"version under a key ring", func() error {
+			_, err := s.CreateCryptoKeyVersion(ctx, &kmspb.CreateCryptoKeyVersionRequest{Parent: keyRing, CryptoKeyVersion: &kmspb.CryptoKeyVersion{}})
+			return err
+		}, codes.InvalidArgument},
+		{"primary version named by another key's path", func() error {
+			_, err := s.UpdateCryptoKeyPrimaryVersion(ctx, &kmspb.UpdateCryptoKeyPrimaryVersionRequest{Name: key, CryptoKeyVersionId: keyRing + "/cryptoKeys/other/cryptoKeyVersions/1"})
+			return err
+		}, codes.InvalidArgument},
+		{"invalid key ring ID", func() error {
+			_, err := s.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/p/locations/global", KeyRingId: "not a valid id"})
+			return err
+		}, codes.InvalidArgument},
+		{"invalid crypto key ID", func() error {
+			_, err := s.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{Parent: keyRing, CryptoKeyId: "k/1", CryptoKey: &kmspb.CryptoKey{}})
+			return err
+		}, codes.InvalidArgument},
+		{"URL-encoded segment", func() error {
+			_, err := s.GetKeyRing(ctx, &kmspb.GetKeyRingRequest{Name: "projects/p/locations/global/keyRings/%72"})
+			return err
+		}, codes.InvalidArgument},
+		{"uppercase project", func() error {
+			_, err := s.GetKeyRing(ctx, &kmspb.GetKeyRingRequest{Name: "projects/P/locations/global/keyRings/r"})
+			return err
+		}, codes.InvalidArgument},
+		{"IDs are case-sensitive", func() error {
+			_, err := s.GetCryptoKey(ctx, &kmspb.GetCryptoKeyRequest{Name: keyRing + "/cryptoKeys/K"})
+			return err
+		}, codes.NotFound},
+		{"Encrypt with a version", func() error {
+			resp, err := s.Encrypt(ctx, &kmspb.EncryptRequest{Name: key + "/cryptoKeyVersions/1", Plaintext: []byte("secret")})
+			if err == nil && resp.Name != key+"/cryptoKeyVersions/1" {
+				t.Errorf("Expected Encrypt to use the named version, got %s", resp.Name)
+			}
+			return err
+		}, codes.OK},
+		{"Encrypt with a key ring", func() error {
+			_, err := s.Encrypt(ctx, &kmspb.EncryptRequest{Name: keyRing, Plaintext: []byte("secret")})
+			return err
+		}, codes.InvalidArgument},
+		{"Decrypt with a version", func() error {
+			_, err := s.Decrypt(ctx, &kmspb.DecryptRequest{Name: key + "/cryptoKeyVersions/1", Ciphertext: []byte("ciphertext")})
+			return err
+		}, codes.InvalidArgument},
+		{"AsymmetricSign with a key", func() error {
+			_, err := s.AsymmetricSign(ctx, &kmspb.AsymmetricSignRequest{Name: key, Data: []byte("data")})
+			return err
+		}, codes.InvalidArgument},
+		{"AsymmetricDecrypt with a key", func() error {
+			_, err := s.AsymmetricDecrypt(ctx, &kmspb.AsymmetricDecryptRequest{Name: key, Ciphertext: []byte("ciphertext")})
+			return err
+		}, codes.InvalidArgument},
+		{"GetPublicKey with a key", func() error {
+			_, err := s.GetPublicKey(ctx, &kmspb.GetPublicKeyRequest{Name: key})
+			return err
+		}, codes.InvalidArgument},
+		{"MacSign with a key", func() error {
+			_, err := s.MacSign(ctx, &kmspb.MacSignRequest{Name: key, Data: []byte("data")})
+			return err
+		}, codes.InvalidArgument},
+		{"MacVerify with a key", func() error {
+			_, err := s.MacVerify(ctx, &kmspb.MacVerifyRequest{Name: key, Data: []byte("data"), Mac: []byte("mac")})
+			return err
+		}, codes.InvalidArgument},
+		{"key in another key ring", func() error {
+			_, err := s.GetCryptoKey(ctx, &kmspb.GetCryptoKeyRequest{Name: "projects/p/locations/global/keyRings/other/cryptoKeys/k"})
+			return err
+		}, codes.NotFound},
+		{"well-formed missing version", func() error {
+			_, err := s.GetCryptoKeyVersion(ctx, &kmspb.GetCryptoKeyVersionRequest{Name: key + "/cryptoKeyVersions/9"})
+			return err
+		}, codes.NotFound},
+		{"valid version", func() error {
+			_, err := s.UpdateCryptoKeyPrimaryVersion(ctx, &kmspb.UpdateCryptoKeyPrimaryVersionRequest{Name: key, CryptoKeyVersionId: "1"})
+			return err
+		}, codes.OK},
+	}
+	for _, tt := range tests {
+		if err := tt.call(); status.Code(err) != tt.code {
+			t.Errorf("%s: expected %s, got %v", tt.name, tt.code, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"log/slog"
+	"time"
+
+	emulatorauth "github.com/blackwell-systems/gcp-emulator-auth"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+// Option configures a Server created by NewServer. Without options,
+// NewServer uses empty storage, the system clock, slog.Default() and the
+// IAM emulator configured by IAM_MODE and IAM_EMULATOR_HOST.
+type Option func(*options)
+
+type options struct {
+	storage    *storage.Storage
+	now        func() time.Time
+	logger     *slog.Logger
+	authorizer PermissionChecker
+	iamMode    *emulatorauth.AuthMode
+	iamHost    *string
+}
+
+// WithStorage serves st instead of new, empty storage, so several servers
+// can share state or a test can prepare it directly
+func WithStorage(st *storage.Storage) Option {
+	return func(o *options) { o.storage = st }
+}
+
+// WithClock reads the time from now instead of time.Now, for resource
+// timestamps, destruction schedules and authorization decisions. It is set
+// on the storage, so it also applies to storage passed to WithStorage.
+func WithClock(now func() time.Time) Option {
+	return func(o *options) { o.now = now }
+}
+
+// WithLogger logs authorization decisions to logger instead of
+// slog.Default()
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// WithAuthorizer answers permission checks with checker instead of the IAM
+// emulator, enforcing it in strict mode unless WithIAMMode or IAM_MODE
+// choose permissive. A static policy set later with SetIAMPolicy takes
+// precedence. Answers are never cached.
+func WithAuthorizer(checker PermissionChecker) Option {
+	return func(o *options) { o.authorizer = checker }
+}
+
+// WithIAMMode sets the IAM enforcement mode instead of reading IAM_MODE
+func WithIAMMode(mode emulatorauth.AuthMode) Option {
+	return func(o *options) { o.iamMode = &mode }
+}
+
+// WithIAMHost sets the IAM emulator address instead of reading
+// IAM_EMULATOR_HOST
+func WithIAMHost(host string) Option {
+	return func(o *options) { o.iamHost = &host }
+}
@@ -7,7 +7,7 @@
 // # Error Handling
 //
 // All methods validate input parameters and return appropriate gRPC status codes:
-//   - InvalidArgument: Missing required fields
+//   - InvalidArgument: Missing required fields or oversized payloads
 //   - NotFound: Requested resource doesn't exist
 //   - AlreadyExists: Resource already exists
 //   - FailedPrecondition: Invalid state transition
@@ -21,70 +21,241 @@
 //
 // CryptoKeyVersion Management: CreateCryptoKeyVersion, GetCryptoKeyVersion,
 // ListCryptoKeyVersions, UpdateCryptoKeyVersion, UpdateCryptoKeyPrimaryVersion,
-// DestroyCryptoKeyVersion
+// DestroyCryptoKeyVersion, RestoreCryptoKeyVersion
 //
 // Encryption Operations: Encrypt, Decrypt
 //
+// Asymmetric Keys: GetPublicKey, AsymmetricSign, AsymmetricDecrypt
+//
+// MAC Keys: MacSign, MacVerify
+//
+// Random Generation: GenerateRandomBytes
+//
+// Key Import: CreateImportJob, GetImportJob, ListImportJobs,
+// ImportCryptoKeyVersion
+//
+// Locations (served by Locations): ListLocations, GetLocation
+//
 // # Usage
 //
 //	grpcServer := grpc.NewServer()
-//	kmsServer := server.NewServer()
+//	kmsServer, err := server.NewServer()
 //	kmspb.RegisterKeyManagementServiceServer(grpcServer, kmsServer)
 package server
 
 import (
 	"context"
+	"crypto/rand"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	emulatorauth "github.com/blackwell-systems/gcp-emulator-auth"
 	"github.com/blackwell-systems/gcp-kms-emulator/internal/authz"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/principal"
 	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
 )
 
 // Server implements the KMS KeyManagementService
 type Server struct {
 	kmspb.UnimplementedKeyManagementServiceServer
-	storage   *storage.Storage
+	storage *storage.Storage
+
+	iamMu     sync.RWMutex
 	iamClient *emulatorauth.Client
-	iamMode   emulatorauth.AuthMode
+	iamPolicy *authz.Policy
+	// authorizer replaces the IAM emulator when set (WithAuthorizer)
+	authorizer PermissionChecker
+	checker    PermissionChecker    // iamPolicy, authorizer, iamClient or nil when IAM is off
+	iamCache   *authz.DecisionCache // IAM emulator answers, nil when not cached
+	iamMode    emulatorauth.AuthMode
+	iamHost    string
+	iamConn    *grpc.ClientConn // for IAMPolicy, opened on first use
+	decisions  *authz.DecisionLog
+
+	locations       []Location // KMSLocations and any custom ones
+	maxPayloadBytes int
+	now             func() time.Time
 }
 
 // NewServer creates a new KMS server
-func NewServer() (*Server, error) {
+func NewServer(opts ...Option) (*Server, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	s := &Server{
-		storage: storage.NewStorage(),
+		storage:         o.storage,
+		authorizer:      o.authorizer,
+		decisions:       authz.NewDecisionLog(authz.DefaultDecisionLogSize),
+		locations:       KMSLocations,
+		maxPayloadBytes: MaxPayloadBytes,
+		now:             time.Now,
+	}
+	if s.storage == nil {
+		s.storage = storage.NewStorage()
+	}
+	if o.now != nil {
+		s.now = o.now
+		s.storage.SetClock(o.now)
+	}
+	if o.logger != nil {
+		s.decisions.SetLogger(o.logger)
 	}
 
-	// Load IAM configuration from environment
+	// Load IAM configuration from environment unless given
 	config := emulatorauth.LoadFromEnv()
-	s.iamMode = config.Mode
+	if o.iamHost != nil {
+		config.Host = *o.iamHost
+	}
+	if o.iamMode != nil {
+		config.Mode = *o.iamMode
+	}
+	if s.authorizer != nil && !config.Mode.IsEnabled() {
+		config.Mode = emulatorauth.AuthModeStrict
+	}
+	s.iamHost = config.Host
+	if err := s.SetIAMMode(config.Mode); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
 
-	// Connect to IAM emulator if enabled
-	if config.Mode.IsEnabled() {
-		client, err := emulatorauth.NewClient(config.Host, config.Mode, "gcp-kms-emulator")
+// IAMMode returns the current IAM enforcement mode
+func (s *Server) IAMMode() emulatorauth.AuthMode {
+	s.iamMu.RLock()
+	defer s.iamMu.RUnlock()
+	return s.iamMode
+}
+
+// PermissionChecker answers permission checks: the IAM emulator client, a
+// static policy or an embedder's authorizer (WithAuthorizer)
+type PermissionChecker interface {
+	CheckPermission(ctx context.Context, principal, resource, permission string) (bool, error)
+}
+
+// SetIAMMode changes the IAM enforcement mode at runtime. When enforcement is
+// enabled, permissions are checked against the static policy if one is set,
+// else against the IAM emulator (IAM_EMULATOR_HOST).
+func (s *Server) SetIAMMode(mode emulatorauth.AuthMode) error {
+	s.iamMu.RLock()
+	policy := s.iamPolicy
+	s.iamMu.RUnlock()
+
+	var client *emulatorauth.Client
+	if mode.IsEnabled() && policy == nil && s.authorizer == nil {
+		var err error
+		client, err = emulatorauth.NewClient(s.iamHost, mode, "gcp-kms-emulator")
 		if err != nil {
-			return nil, fmt.Errorf("failed to connect to IAM emulator: %w", err)
+			return fmt.Errorf("failed to connect to IAM emulator: %w", err)
 		}
-		s.iamClient = client
 	}
 
-	return s, nil
+	s.iamMu.Lock()
+	old := s.iamClient
+	s.iamClient = client
+	s.iamMode = mode
+	s.checker = nil
+	if s.iamCache != nil {
+		s.iamCache.Invalidate("")
+	}
+	switch {
+	case !mode.IsEnabled():
+	case policy != nil:
+		s.checker = policy
+	case s.authorizer != nil:
+		s.checker = s.authorizer
+	default:
+		s.checker = client
+	}
+	s.iamMu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// SetIAMPolicy checks permissions against a static policy instead of the IAM
+// emulator, enforcing it in strict mode if IAM is off. A nil policy goes back
+// to the IAM emulator, or to the authorizer given to WithAuthorizer.
+func (s *Server) SetIAMPolicy(policy *authz.Policy) error {
+	s.iamMu.Lock()
+	s.iamPolicy = policy
+	mode := s.iamMode
+	s.iamMu.Unlock()
+
+	if policy != nil && !mode.IsEnabled() {
+		mode = emulatorauth.AuthModeStrict
+	}
+	return s.SetIAMMode(mode)
+}
+
+// SetIAMCacheTTL caches the IAM emulator's answers for ttl, or stops caching
+// them if ttl is 0. Static policies are never cached.
+func (s *Server) SetIAMCacheTTL(ttl time.Duration) {
+	s.iamMu.Lock()
+	defer s.iamMu.Unlock()
+	s.iamCache = nil
+	if ttl > 0 {
+		s.iamCache = authz.NewDecisionCache(ttl)
+	}
+}
+
+// IAMCache returns the cache of IAM emulator answers, or nil
+func (s *Server) IAMCache() *authz.DecisionCache {
+	s.iamMu.RLock()
+	defer s.iamMu.RUnlock()
+	return s.iamCache
+}
+
+// Storage returns the storage backend used by the server
+func (s *Server) Storage() *storage.Storage {
+	return s.storage
+}
+
+// Decisions returns the log of permission checks
+func (s *Server) Decisions() *authz.DecisionLog {
+	return s.decisions
 }
 
 // checkPermission checks if the principal has permission to perform the operation
 func (s *Server) checkPermission(ctx context.Context, operation string, resource string) error {
-	// If IAM is disabled, allow all operations
-	if s.iamClient == nil {
+	s.iamMu.RLock()
+	a := authorizer{client: s.checker, cache: s.iamCache, forced: authz.ForcedDenials(ctx)}
+	if s.iamPolicy != nil || s.authorizer != nil {
+		a.cache = nil
+	}
+	s.iamMu.RUnlock()
+
+	// If IAM is disabled, allow all operations but those denied by
+	// x-emulator-force-deny
+	if a.client == nil && a.forced == nil {
 		return nil
 	}
 
+	// Impersonated calls act as the last service account of the chain, which
+	// each principal in it must be able to impersonate
+	if d, ok := principal.DelegationFromContext(ctx); ok {
+		for _, link := range d.Links() {
+			resource := principal.ServiceAccountResource(link[1])
+			if err := s.check(ctx, a, operation, link[0], resource, authz.ImpersonatePermission); err != nil {
+				return err
+			}
+		}
+	}
+
 	// Extract principal from incoming context
-	principal := emulatorauth.ExtractPrincipalFromContext(ctx)
+	caller := emulatorauth.ExtractPrincipalFromContext(ctx)
 
 	// Get permission for operation
 	permCheck, ok := authz.GetPermission(operation)
@@ -93,26 +264,81 @@ func (s *Server) checkPermission(ctx context.Context, operation string, resource
 		return nil
 	}
 
-	// Check permission
-	allowed, err := s.iamClient.CheckPermission(ctx, principal, resource, permCheck.Permission)
+	return s.check(ctx, a, operation, caller, resource, permCheck.Permission)
+}
+
+// authorizer holds what one call's permission checks need
+type authorizer struct {
+	client PermissionChecker // nil when IAM is off
+	cache  *authz.DecisionCache
+	forced map[string]bool // denied by x-emulator-force-deny
+}
+
+// check asks for one permission, from the cache if it has the answer, and
+// records the decision. Forced denials are not asked for, and calls IAM is
+// off for are not recorded.
+func (s *Server) check(ctx context.Context, a authorizer, operation, caller, resource, permission string) error {
+	forced := authz.IsForcedDenial(a.forced, permission)
+	if !forced && a.client == nil {
+		return nil
+	}
+
+	start := time.Now()
+	at := s.now()
+	var allowed, cached bool
+	var err error
+	if !forced {
+		if a.cache != nil {
+			allowed, cached = a.cache.Get(caller, resource, permission)
+		}
+		if !cached {
+			allowed, err = a.client.CheckPermission(ctx, caller, resource, permission)
+			if err == nil && a.cache != nil {
+				a.cache.Put(caller, resource, permission, allowed)
+			}
+		}
+	}
+	d := authz.Decision{
+		Time:       at,
+		Operation:  operation,
+		Principal:  caller,
+		Permission: permission,
+		Resource:   resource,
+		Outcome:    authz.OutcomeAllowed,
+		Cached:     cached,
+		Forced:     forced,
+		Latency:    time.Since(start),
+	}
+	switch {
+	case err != nil:
+		d.Outcome, d.Error = authz.OutcomeError, err.Error()
+	case !allowed:
+		d.Outcome = authz.OutcomeDenied
+	}
+	s.decisions.Record(ctx, d)
+
 	if err != nil {
 		return status.Errorf(codes.Internal, "IAM check failed: %v", err)
 	}
-
 	if !allowed {
-		return status.Error(codes.PermissionDenied, "Permission denied")
+		return permissionDenied(permission, resource)
 	}
-
 	return nil
 }
 
 // CreateKeyRing creates a new keyring
 func (s *Server) CreateKeyRing(ctx context.Context, req *kmspb.CreateKeyRingRequest) (*kmspb.KeyRing, error) {
 	if req.Parent == "" {
-		return nil, status.Error(codes.InvalidArgument, "parent is required")
+		return nil, requiredField("parent")
 	}
 	if req.KeyRingId == "" {
-		return nil, status.Error(codes.InvalidArgument, "key_ring_id is required")
+		return nil, requiredField("key_ring_id")
+	}
+	if err := s.checkLocation(req.Parent); err != nil {
+		return nil, err
+	}
+	if err := checkID("key_ring_id", req.KeyRingId); err != nil {
+		return nil, err
 	}
 
 	// Check permission (against parent for create operations)
@@ -123,8 +349,11 @@ func (s *Server) CreateKeyRing(ctx context.Context, req *kmspb.CreateKeyRingRequ
 	name := fmt.Sprintf("%s/keyRings/%s", req.Parent, req.KeyRingId)
 	keyring, err := s.storage.CreateKeyRing(name)
 	if err != nil {
+		if herr := hookError(err); herr != nil {
+			return nil, herr
+		}
 		if strings.Contains(err.Error(), "already exists") {
-			return nil, status.Error(codes.AlreadyExists, err.Error())
+			return nil, resourceError(codes.AlreadyExists, err)
 		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
@@ -135,7 +364,10 @@ func (s *Server) CreateKeyRing(ctx context.Context, req *kmspb.CreateKeyRingRequ
 // GetKeyRing retrieves a keyring
 func (s *Server) GetKeyRing(ctx context.Context, req *kmspb.GetKeyRingRequest) (*kmspb.KeyRing, error) {
 	if req.Name == "" {
-		return nil, status.Error(codes.InvalidArgument, "name is required")
+		return nil, requiredField("name")
+	}
+	if err := checkName("name", req.Name, keyRingName); err != nil {
+		return nil, err
 	}
 
 	if err := s.checkPermission(ctx, "GetKeyRing", authz.NormalizeKeyRingResource(req.Name)); err != nil {
@@ -144,7 +376,7 @@ func (s *Server) GetKeyRing(ctx context.Context, req *kmspb.GetKeyRingRequest) (
 
 	keyring, err := s.storage.GetKeyRing(req.Name)
 	if err != nil {
-		return nil, status.Error(codes.NotFound, err.Error())
+		return nil, resourceError(codes.NotFound, err)
 	}
 
 	return keyring, nil
@@ -153,7 +385,10 @@ func (s *Server) GetKeyRing(ctx context.Context, req *kmspb.GetKeyRingRequest) (
 // ListKeyRings lists keyrings in a location
 func (s *Server) ListKeyRings(ctx context.Context, req *kmspb.ListKeyRingsRequest) (*kmspb.ListKeyRingsResponse, error) {
 	if req.Parent == "" {
-		return nil, status.Error(codes.InvalidArgument, "parent is required")
+		return nil, requiredField("parent")
+	}
+	if err := s.checkLocation(req.Parent); err != nil {
+		return nil, err
 	}
 
 	if err := s.checkPermission(ctx, "ListKeyRings", authz.NormalizeParentForCreate(req.Parent)); err != nil {
@@ -165,23 +400,34 @@ func (s *Server) ListKeyRings(ctx context.Context, req *kmspb.ListKeyRingsReques
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	page, nextPageToken, total, err := listPage(keyrings, req.Filter, req.OrderBy, req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+
 	return &kmspb.ListKeyRingsResponse{
-		KeyRings:      keyrings,
-		NextPageToken: "",
-		TotalSize:     int32(len(keyrings)),
+		KeyRings:      page,
+		NextPageToken: nextPageToken,
+		TotalSize:     total,
 	}, nil
 }
 
 // CreateCryptoKey creates a new crypto key
 func (s *Server) CreateCryptoKey(ctx context.Context, req *kmspb.CreateCryptoKeyRequest) (*kmspb.CryptoKey, error) {
 	if req.Parent == "" {
-		return nil, status.Error(codes.InvalidArgument, "parent is required")
+		return nil, requiredField("parent")
 	}
 	if req.CryptoKeyId == "" {
-		return nil, status.Error(codes.InvalidArgument, "crypto_key_id is required")
+		return nil, requiredField("crypto_key_id")
 	}
 	if req.CryptoKey == nil {
-		return nil, status.Error(codes.InvalidArgument, "crypto_key is required")
+		return nil, requiredField("crypto_key")
+	}
+	if err := checkName("parent", req.Parent, keyRingName); err != nil {
+		return nil, err
+	}
+	if err := checkID("crypto_key_id", req.CryptoKeyId); err != nil {
+		return nil, err
 	}
 
 	if err := s.checkPermission(ctx, "CreateCryptoKey", authz.NormalizeKeyRingResource(req.Parent)); err != nil {
@@ -192,6 +438,12 @@ func (s *Server) CreateCryptoKey(ctx context.Context, req *kmspb.CreateCryptoKey
 	if purpose == kmspb.CryptoKey_CRYPTO_KEY_PURPOSE_UNSPECIFIED {
 		purpose = kmspb.CryptoKey_ENCRYPT_DECRYPT
 	}
+	if err := validateAlgorithm(purpose, req.CryptoKey.VersionTemplate.GetAlgorithm()); err != nil {
+		return nil, err
+	}
+	if err := validateLabels(req.CryptoKey.Labels); err != nil {
+		return nil, err
+	}
 
 	cryptoKey, err := s.storage.CreateCryptoKey(
 		req.Parent,
@@ -201,22 +453,31 @@ func (s *Server) CreateCryptoKey(ctx context.Context, req *kmspb.CreateCryptoKey
 		req.CryptoKey.Labels,
 	)
 	if err != nil {
+		if herr := hookError(err); herr != nil {
+			return nil, herr
+		}
 		if strings.Contains(err.Error(), "already exists") {
-			return nil, status.Error(codes.AlreadyExists, err.Error())
+			return nil, resourceError(codes.AlreadyExists, err)
 		}
 		if strings.Contains(err.Error(), "not found") {
-			return nil, status.Error(codes.NotFound, err.Error())
+			return nil, resourceError(codes.NotFound, err)
+		}
+		if strings.Contains(err.Error(), "is not configured") {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
 		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	return cryptoKey, nil
+	return withETag(ctx, cryptoKey), nil
 }
 
 // GetCryptoKey retrieves a crypto key
 func (s *Server) GetCryptoKey(ctx context.Context, req *kmspb.GetCryptoKeyRequest) (*kmspb.CryptoKey, error) {
 	if req.Name == "" {
-		return nil, status.Error(codes.InvalidArgument, "name is required")
+		return nil, requiredField("name")
+	}
+	if err := checkName("name", req.Name, cryptoKeyName); err != nil {
+		return nil, err
 	}
 
 	if err := s.checkPermission(ctx, "GetCryptoKey", authz.NormalizeCryptoKeyResource(req.Name)); err != nil {
@@ -225,70 +486,125 @@ func (s *Server) GetCryptoKey(ctx context.Context, req *kmspb.GetCryptoKeyReques
 
 	cryptoKey, err := s.storage.GetCryptoKey(req.Name)
 	if err != nil {
-		return nil, status.Error(codes.NotFound, err.Error())
+		return nil, resourceError(codes.NotFound, err)
 	}
 
-	return cryptoKey, nil
+	s.sendUsage(ctx, cryptoKey.Name)
+	return withETag(ctx, cryptoKey), nil
 }
 
 // Encrypt encrypts data using a crypto key
 func (s *Server) Encrypt(ctx context.Context, req *kmspb.EncryptRequest) (*kmspb.EncryptResponse, error) {
 	if req.Name == "" {
-		return nil, status.Error(codes.InvalidArgument, "name is required")
+		return nil, requiredField("name")
 	}
 	if len(req.Plaintext) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "plaintext is required")
+		return nil, requiredField("plaintext")
+	}
+	if err := s.checkPayloadSize("plaintext", req.Plaintext); err != nil {
+		return nil, err
+	}
+	if err := s.checkPayloadSize("additional_authenticated_data", req.AdditionalAuthenticatedData); err != nil {
+		return nil, err
+	}
+
+	verifiedPlaintext, err := verifyCRC32C("plaintext", req.Plaintext, req.PlaintextCrc32C)
+	if err != nil {
+		return nil, err
+	}
+	verifiedAAD, err := verifyCRC32C("additional_authenticated_data", req.AdditionalAuthenticatedData, req.AdditionalAuthenticatedDataCrc32C)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkName("name", req.Name, cryptoKeyOrVersionName); err != nil {
+		return nil, err
 	}
 
 	if err := s.checkPermission(ctx, "Encrypt", authz.NormalizeCryptoKeyResource(req.Name)); err != nil {
 		return nil, err
 	}
 
-	ciphertext, err := s.storage.Encrypt(req.Name, req.Plaintext)
+	ciphertext, versionName, level, err := s.storage.Encrypt(req.Name, req.Plaintext, req.AdditionalAuthenticatedData)
 	if err != nil {
+		if herr := hookError(err); herr != nil {
+			return nil, herr
+		}
 		if strings.Contains(err.Error(), "not found") {
-			return nil, status.Error(codes.NotFound, err.Error())
+			return nil, resourceError(codes.NotFound, err)
+		}
+		if strings.Contains(err.Error(), "does not support") || strings.Contains(err.Error(), "no primary version") || strings.Contains(err.Error(), "not enabled") {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
 		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
 	return &kmspb.EncryptResponse{
-		Name:             req.Name,
-		Ciphertext:       ciphertext,
-		CiphertextCrc32C: nil, // Not implementing CRC32C for simplicity
+		Name:                    versionName,
+		Ciphertext:              ciphertext,
+		CiphertextCrc32C:        wrapperspb.Int64(crc32c(ciphertext)),
+		VerifiedPlaintextCrc32C: verifiedPlaintext,
+		VerifiedAdditionalAuthenticatedDataCrc32C: verifiedAAD,
+		ProtectionLevel: level,
 	}, nil
 }
 
 // Decrypt decrypts data using a crypto key
 func (s *Server) Decrypt(ctx context.Context, req *kmspb.DecryptRequest) (*kmspb.DecryptResponse, error) {
 	if req.Name == "" {
-		return nil, status.Error(codes.InvalidArgument, "name is required")
+		return nil, requiredField("name")
 	}
 	if len(req.Ciphertext) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "ciphertext is required")
+		return nil, requiredField("ciphertext")
+	}
+
+	// DecryptResponse has no verified_* fields; a mismatch is still rejected
+	if _, err := verifyCRC32C("ciphertext", req.Ciphertext, req.CiphertextCrc32C); err != nil {
+		return nil, err
+	}
+	if _, err := verifyCRC32C("additional_authenticated_data", req.AdditionalAuthenticatedData, req.AdditionalAuthenticatedDataCrc32C); err != nil {
+		return nil, err
+	}
+	if err := checkName("name", req.Name, cryptoKeyName); err != nil {
+		return nil, err
 	}
 
 	if err := s.checkPermission(ctx, "Decrypt", authz.NormalizeCryptoKeyResource(req.Name)); err != nil {
 		return nil, err
 	}
 
-	plaintext, err := s.storage.Decrypt(req.Name, req.Ciphertext)
+	plaintext, usedPrimary, level, err := s.storage.Decrypt(req.Name, req.Ciphertext, req.AdditionalAuthenticatedData)
 	if err != nil {
+		if herr := hookError(err); herr != nil {
+			return nil, herr
+		}
 		if strings.Contains(err.Error(), "not found") {
-			return nil, status.Error(codes.NotFound, err.Error())
+			return nil, resourceError(codes.NotFound, err)
+		}
+		// The version that produced the ciphertext is disabled or destroyed
+		if strings.Contains(err.Error(), "does not support") || strings.Contains(err.Error(), "not enabled") {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		if strings.Contains(err.Error(), "failed to decrypt") {
+			// The ciphertext is the caller's, as in Cloud KMS
+			return nil, invalidArgument("ciphertext", "%s", err)
 		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
 	return &kmspb.DecryptResponse{
 		Plaintext:       plaintext,
-		PlaintextCrc32C: nil, // Not implementing CRC32C for simplicity
+		PlaintextCrc32C: wrapperspb.Int64(crc32c(plaintext)),
+		UsedPrimary:     usedPrimary,
+		ProtectionLevel: level,
 	}, nil
 }
 
 func (s *Server) ListCryptoKeys(ctx context.Context, req *kmspb.ListCryptoKeysRequest) (*kmspb.ListCryptoKeysResponse, error) {
 	if req.Parent == "" {
-		return nil, status.Error(codes.InvalidArgument, "parent is required")
+		return nil, requiredField("parent")
+	}
+	if err := checkName("parent", req.Parent, keyRingName); err != nil {
+		return nil, err
 	}
 
 	if err := s.checkPermission(ctx, "ListCryptoKeys", authz.NormalizeKeyRingResource(req.Parent)); err != nil {
@@ -298,21 +614,29 @@ func (s *Server) ListCryptoKeys(ctx context.Context, req *kmspb.ListCryptoKeysRe
 	cryptoKeys, err := s.storage.ListCryptoKeys(req.Parent)
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
-			return nil, status.Error(codes.NotFound, err.Error())
+			return nil, resourceError(codes.NotFound, err)
 		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	page, nextPageToken, total, err := listPage(cryptoKeys, req.Filter, req.OrderBy, req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+
 	return &kmspb.ListCryptoKeysResponse{
-		CryptoKeys:    cryptoKeys,
-		NextPageToken: "",
-		TotalSize:     int32(len(cryptoKeys)),
+		CryptoKeys:    page,
+		NextPageToken: nextPageToken,
+		TotalSize:     total,
 	}, nil
 }
 
 func (s *Server) ListCryptoKeyVersions(ctx context.Context, req *kmspb.ListCryptoKeyVersionsRequest) (*kmspb.ListCryptoKeyVersionsResponse, error) {
 	if req.Parent == "" {
-		return nil, status.Error(codes.InvalidArgument, "parent is required")
+		return nil, requiredField("parent")
+	}
+	if err := checkName("parent", req.Parent, cryptoKeyName); err != nil {
+		return nil, err
 	}
 
 	if err := s.checkPermission(ctx, "ListCryptoKeyVersions", authz.NormalizeCryptoKeyResource(req.Parent)); err != nil {
@@ -322,21 +646,29 @@ func (s *Server) ListCryptoKeyVersions(ctx context.Context, req *kmspb.ListCrypt
 	versions, err := s.storage.ListCryptoKeyVersions(req.Parent)
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
-			return nil, status.Error(codes.NotFound, err.Error())
+			return nil, resourceError(codes.NotFound, err)
 		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	page, nextPageToken, total, err := listPage(versions, req.Filter, req.OrderBy, req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+
 	return &kmspb.ListCryptoKeyVersionsResponse{
-		CryptoKeyVersions: versions,
-		NextPageToken:     "",
-		TotalSize:         int32(len(versions)),
+		CryptoKeyVersions: page,
+		NextPageToken:     nextPageToken,
+		TotalSize:         total,
 	}, nil
 }
 
 func (s *Server) GetCryptoKeyVersion(ctx context.Context, req *kmspb.GetCryptoKeyVersionRequest) (*kmspb.CryptoKeyVersion, error) {
 	if req.Name == "" {
-		return nil, status.Error(codes.InvalidArgument, "name is required")
+		return nil, requiredField("name")
+	}
+	if err := checkName("name", req.Name, cryptoKeyVersionName); err != nil {
+		return nil, err
 	}
 
 	if err := s.checkPermission(ctx, "GetCryptoKeyVersion", authz.NormalizeCryptoKeyVersionResource(req.Name)); err != nil {
@@ -345,15 +677,19 @@ func (s *Server) GetCryptoKeyVersion(ctx context.Context, req *kmspb.GetCryptoKe
 
 	version, err := s.storage.GetCryptoKeyVersion(req.Name)
 	if err != nil {
-		return nil, status.Error(codes.NotFound, err.Error())
+		return nil, resourceError(codes.NotFound, err)
 	}
 
-	return version, nil
+	s.sendUsage(ctx, version.Name)
+	return withETag(ctx, version), nil
 }
 
 func (s *Server) CreateCryptoKeyVersion(ctx context.Context, req *kmspb.CreateCryptoKeyVersionRequest) (*kmspb.CryptoKeyVersion, error) {
 	if req.Parent == "" {
-		return nil, status.Error(codes.InvalidArgument, "parent is required")
+		return nil, requiredField("parent")
+	}
+	if err := checkName("parent", req.Parent, cryptoKeyName); err != nil {
+		return nil, err
 	}
 
 	if err := s.checkPermission(ctx, "CreateCryptoKeyVersion", authz.NormalizeCryptoKeyResource(req.Parent)); err != nil {
@@ -362,65 +698,138 @@ func (s *Server) CreateCryptoKeyVersion(ctx context.Context, req *kmspb.CreateCr
 
 	version, err := s.storage.CreateCryptoKeyVersion(req.Parent)
 	if err != nil {
+		if herr := hookError(err); herr != nil {
+			return nil, herr
+		}
 		if strings.Contains(err.Error(), "not found") {
-			return nil, status.Error(codes.NotFound, err.Error())
+			return nil, resourceError(codes.NotFound, err)
+		}
+		if strings.Contains(err.Error(), "is not configured") {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
 		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	return version, nil
+	return withETag(ctx, version), nil
+}
+
+// updatableCryptoKeyFields lists the update_mask paths UpdateCryptoKey accepts
+var updatableCryptoKeyFields = map[string]bool{
+	"labels":                            true,
+	"rotation_period":                   true,
+	"next_rotation_time":                true,
+	"version_template":                  true,
+	"version_template.algorithm":        true,
+	"version_template.protection_level": true,
 }
 
+// minRotationPeriod is the shortest rotation period Cloud KMS accepts
+const minRotationPeriod = 24 * time.Hour
+
+// UpdateCryptoKey updates the fields of a crypto key listed in update_mask.
+// Without a mask only labels are updated, and only when set, as in earlier
+// releases.
 func (s *Server) UpdateCryptoKey(ctx context.Context, req *kmspb.UpdateCryptoKeyRequest) (*kmspb.CryptoKey, error) {
 	if req.CryptoKey == nil || req.CryptoKey.Name == "" {
-		return nil, status.Error(codes.InvalidArgument, "crypto_key.name is required")
+		return nil, requiredField("crypto_key.name")
+	}
+
+	paths := req.GetUpdateMask().GetPaths()
+	if len(paths) == 0 && req.CryptoKey.Labels != nil {
+		paths = []string{"labels"}
+	}
+	for _, path := range paths {
+		if !updatableCryptoKeyFields[path] {
+			return nil, invalidArgument("update_mask", "update_mask path %q is not supported for crypto keys", path)
+		}
+		if path == "labels" {
+			if err := validateLabels(req.CryptoKey.Labels); err != nil {
+				return nil, err
+			}
+		}
+		if path == "rotation_period" && req.CryptoKey.GetRotationPeriod() != nil {
+			if period := req.CryptoKey.GetRotationPeriod().AsDuration(); period < minRotationPeriod {
+				return nil, invalidArgument("crypto_key.rotation_period", "rotation_period must be at least %s, got %s", minRotationPeriod, period)
+			}
+		}
+	}
+	if err := checkName("crypto_key.name", req.CryptoKey.Name, cryptoKeyName); err != nil {
+		return nil, err
 	}
 
 	if err := s.checkPermission(ctx, "UpdateCryptoKey", authz.NormalizeCryptoKeyResource(req.CryptoKey.Name)); err != nil {
 		return nil, err
 	}
 
-	cryptoKey, err := s.storage.UpdateCryptoKey(req.CryptoKey.Name, req.CryptoKey.Labels)
+	cryptoKey, err := s.storage.UpdateCryptoKey(req.CryptoKey.Name, req.CryptoKey, paths, ifMatch(ctx))
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
-			return nil, status.Error(codes.NotFound, err.Error())
+			return nil, resourceError(codes.NotFound, err)
+		}
+		if strings.Contains(err.Error(), "is not valid for") {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if strings.Contains(err.Error(), "is stale") {
+			return nil, status.Error(codes.Aborted, err.Error())
+		}
+		if strings.Contains(err.Error(), "does not support") {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
 		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	return cryptoKey, nil
+	return withETag(ctx, cryptoKey), nil
 }
 
 func (s *Server) UpdateCryptoKeyVersion(ctx context.Context, req *kmspb.UpdateCryptoKeyVersionRequest) (*kmspb.CryptoKeyVersion, error) {
 	if req.CryptoKeyVersion == nil || req.CryptoKeyVersion.Name == "" {
-		return nil, status.Error(codes.InvalidArgument, "crypto_key_version.name is required")
+		return nil, requiredField("crypto_key_version.name")
 	}
 
 	if req.CryptoKeyVersion.State == kmspb.CryptoKeyVersion_CRYPTO_KEY_VERSION_STATE_UNSPECIFIED {
-		return nil, status.Error(codes.InvalidArgument, "crypto_key_version.state is required")
+		return nil, requiredField("crypto_key_version.state")
+	}
+	if err := checkName("crypto_key_version.name", req.CryptoKeyVersion.Name, cryptoKeyVersionName); err != nil {
+		return nil, err
 	}
 
 	if err := s.checkPermission(ctx, "UpdateCryptoKeyVersion", authz.NormalizeCryptoKeyVersionResource(req.CryptoKeyVersion.Name)); err != nil {
 		return nil, err
 	}
 
-	version, err := s.storage.UpdateCryptoKeyVersion(req.CryptoKeyVersion.Name, req.CryptoKeyVersion.State)
+	version, err := s.storage.UpdateCryptoKeyVersion(req.CryptoKeyVersion.Name, req.CryptoKeyVersion.State, ifMatch(ctx))
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
-			return nil, status.Error(codes.NotFound, err.Error())
+			return nil, resourceError(codes.NotFound, err)
+		}
+		if strings.Contains(err.Error(), "is not valid for") {
+			return nil, invalidArgument("crypto_key_version.state", "%s", err)
+		}
+		if strings.Contains(err.Error(), "is stale") {
+			return nil, status.Error(codes.Aborted, err.Error())
+		}
+		if strings.Contains(err.Error(), "cannot be updated") {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
 		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	return version, nil
+	return withETag(ctx, version), nil
 }
 
 func (s *Server) UpdateCryptoKeyPrimaryVersion(ctx context.Context, req *kmspb.UpdateCryptoKeyPrimaryVersionRequest) (*kmspb.CryptoKey, error) {
 	if req.Name == "" {
-		return nil, status.Error(codes.InvalidArgument, "name is required")
+		return nil, requiredField("name")
 	}
 	if req.CryptoKeyVersionId == "" {
-		return nil, status.Error(codes.InvalidArgument, "crypto_key_version_id is required")
+		return nil, requiredField("crypto_key_version_id")
+	}
+	if err := checkName("name", req.Name, cryptoKeyName); err != nil {
+		return nil, err
+	}
+	// An ID, not a name, so the version is always one of the named key's
+	if !versionID.MatchString(req.CryptoKeyVersionId) {
+		return nil, invalidArgument("crypto_key_version_id", "invalid crypto_key_version_id %q, expected a version ID of %s", req.CryptoKeyVersionId, req.Name)
 	}
 
 	if err := s.checkPermission(ctx, "UpdateCryptoKeyPrimaryVersion", authz.NormalizeCryptoKeyResource(req.Name)); err != nil {
@@ -431,20 +840,23 @@ func (s *Server) UpdateCryptoKeyPrimaryVersion(ctx context.Context, req *kmspb.U
 	cryptoKey, err := s.storage.UpdateCryptoKeyPrimaryVersion(req.Name, versionName)
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
-			return nil, status.Error(codes.NotFound, err.Error())
+			return nil, resourceError(codes.NotFound, err)
 		}
-		if strings.Contains(err.Error(), "not enabled") {
+		if strings.Contains(err.Error(), "not enabled") || strings.Contains(err.Error(), "does not support") {
 			return nil, status.Error(codes.FailedPrecondition, err.Error())
 		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	return cryptoKey, nil
+	return withETag(ctx, cryptoKey), nil
 }
 
 func (s *Server) DestroyCryptoKeyVersion(ctx context.Context, req *kmspb.DestroyCryptoKeyVersionRequest) (*kmspb.CryptoKeyVersion, error) {
 	if req.Name == "" {
-		return nil, status.Error(codes.InvalidArgument, "name is required")
+		return nil, requiredField("name")
+	}
+	if err := checkName("name", req.Name, cryptoKeyVersionName); err != nil {
+		return nil, err
 	}
 
 	if err := s.checkPermission(ctx, "DestroyCryptoKeyVersion", authz.NormalizeCryptoKeyVersionResource(req.Name)); err != nil {
@@ -453,60 +865,470 @@ func (s *Server) DestroyCryptoKeyVersion(ctx context.Context, req *kmspb.Destroy
 
 	version, err := s.storage.DestroyCryptoKeyVersion(req.Name)
 	if err != nil {
+		if herr := hookError(err); herr != nil {
+			return nil, herr
+		}
 		if strings.Contains(err.Error(), "not found") {
-			return nil, status.Error(codes.NotFound, err.Error())
+			return nil, resourceError(codes.NotFound, err)
 		}
-		if strings.Contains(err.Error(), "already destroyed") {
+		if strings.Contains(err.Error(), "already destroyed") || strings.Contains(err.Error(), "cannot be destroyed") {
 			return nil, status.Error(codes.FailedPrecondition, err.Error())
 		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	return version, nil
+	return withETag(ctx, version), nil
 }
 
+// RestoreCryptoKeyVersion cancels the scheduled destruction of a version. The
+// restored version is DISABLED and must be enabled before use.
 func (s *Server) RestoreCryptoKeyVersion(ctx context.Context, req *kmspb.RestoreCryptoKeyVersionRequest) (*kmspb.CryptoKeyVersion, error) {
-	return nil, status.Error(codes.Unimplemented, "RestoreCryptoKeyVersion not implemented yet")
+	if req.Name == "" {
+		return nil, requiredField("name")
+	}
+	if err := checkName("name", req.Name, cryptoKeyVersionName); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkPermission(ctx, "RestoreCryptoKeyVersion", authz.NormalizeCryptoKeyVersionResource(req.Name)); err != nil {
+		return nil, err
+	}
+
+	version, err := s.storage.RestoreCryptoKeyVersion(req.Name)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, resourceError(codes.NotFound, err)
+		}
+		if strings.Contains(err.Error(), "not scheduled for destruction") {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return withETag(ctx, version), nil
 }
 
+// GetPublicKey returns the PEM-encoded public key of an asymmetric key version
 func (s *Server) GetPublicKey(ctx context.Context, req *kmspb.GetPublicKeyRequest) (*kmspb.PublicKey, error) {
-	return nil, status.Error(codes.Unimplemented, "GetPublicKey not implemented yet")
+	if req.Name == "" {
+		return nil, requiredField("name")
+	}
+	switch req.PublicKeyFormat {
+	case kmspb.PublicKey_PUBLIC_KEY_FORMAT_UNSPECIFIED, kmspb.PublicKey_PEM:
+	default:
+		return nil, invalidArgument("public_key_format", "public_key_format %s is not supported for this key", req.PublicKeyFormat)
+	}
+	if err := checkName("name", req.Name, cryptoKeyVersionName); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkPermission(ctx, "GetPublicKey", authz.NormalizeCryptoKeyVersionResource(req.Name)); err != nil {
+		return nil, err
+	}
+
+	publicKey, err := s.storage.GetPublicKey(req.Name)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, resourceError(codes.NotFound, err)
+		}
+		if strings.Contains(err.Error(), "does not support") || strings.Contains(err.Error(), "not enabled") {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	publicKey.PemCrc32C = wrapperspb.Int64(crc32c([]byte(publicKey.Pem)))
+	return publicKey, nil
 }
 
+// AsymmetricSign signs a digest or data with an asymmetric signing key version
 func (s *Server) AsymmetricSign(ctx context.Context, req *kmspb.AsymmetricSignRequest) (*kmspb.AsymmetricSignResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "AsymmetricSign not implemented yet")
+	if req.Name == "" {
+		return nil, requiredField("name")
+	}
+	if req.Digest == nil && len(req.Data) == 0 {
+		return nil, invalidArgument("digest", "digest or data is required")
+	}
+	if req.Digest != nil && len(req.Data) > 0 {
+		return nil, invalidArgument("data", "only one of digest and data may be set")
+	}
+	if err := s.checkPayloadSize("data", req.Data); err != nil {
+		return nil, err
+	}
+
+	verifiedDigest, err := verifyCRC32C("digest", digestBytes(req.Digest), req.DigestCrc32C)
+	if err != nil {
+		return nil, err
+	}
+	verifiedData, err := verifyCRC32C("data", req.Data, req.DataCrc32C)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkName("name", req.Name, cryptoKeyVersionName); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkPermission(ctx, "AsymmetricSign", authz.NormalizeCryptoKeyVersionResource(req.Name)); err != nil {
+		return nil, err
+	}
+
+	signature, level, err := s.storage.AsymmetricSign(req.Name, req.Digest, req.Data)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, resourceError(codes.NotFound, err)
+		}
+		if strings.Contains(err.Error(), "does not support") || strings.Contains(err.Error(), "not enabled") {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		if strings.Contains(err.Error(), "does not accept") {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &kmspb.AsymmetricSignResponse{
+		Signature:            signature,
+		SignatureCrc32C:      wrapperspb.Int64(crc32c(signature)),
+		VerifiedDigestCrc32C: verifiedDigest,
+		VerifiedDataCrc32C:   verifiedData,
+		Name:                 req.Name,
+		ProtectionLevel:      level,
+	}, nil
 }
 
+// AsymmetricDecrypt decrypts RSA-OAEP ciphertext with an asymmetric decryption
+// key version
 func (s *Server) AsymmetricDecrypt(ctx context.Context, req *kmspb.AsymmetricDecryptRequest) (*kmspb.AsymmetricDecryptResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "AsymmetricDecrypt not implemented yet")
+	if req.Name == "" {
+		return nil, requiredField("name")
+	}
+	if len(req.Ciphertext) == 0 {
+		return nil, requiredField("ciphertext")
+	}
+
+	verifiedCiphertext, err := verifyCRC32C("ciphertext", req.Ciphertext, req.CiphertextCrc32C)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkName("name", req.Name, cryptoKeyVersionName); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkPermission(ctx, "AsymmetricDecrypt", authz.NormalizeCryptoKeyVersionResource(req.Name)); err != nil {
+		return nil, err
+	}
+
+	plaintext, level, err := s.storage.AsymmetricDecrypt(req.Name, req.Ciphertext)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, resourceError(codes.NotFound, err)
+		}
+		if strings.Contains(err.Error(), "does not support") || strings.Contains(err.Error(), "not enabled") {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		if strings.Contains(err.Error(), "decryption failed") {
+			return nil, invalidArgument("ciphertext", "%s", err)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &kmspb.AsymmetricDecryptResponse{
+		Plaintext:                plaintext,
+		PlaintextCrc32C:          wrapperspb.Int64(crc32c(plaintext)),
+		VerifiedCiphertextCrc32C: verifiedCiphertext,
+		ProtectionLevel:          level,
+	}, nil
 }
 
+// MacSign computes an HMAC tag with a MAC key version
 func (s *Server) MacSign(ctx context.Context, req *kmspb.MacSignRequest) (*kmspb.MacSignResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "MacSign not implemented yet")
+	if req.Name == "" {
+		return nil, requiredField("name")
+	}
+	if len(req.Data) == 0 {
+		return nil, requiredField("data")
+	}
+	if err := s.checkPayloadSize("data", req.Data); err != nil {
+		return nil, err
+	}
+
+	verifiedData, err := verifyCRC32C("data", req.Data, req.DataCrc32C)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkName("name", req.Name, cryptoKeyVersionName); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkPermission(ctx, "MacSign", authz.NormalizeCryptoKeyVersionResource(req.Name)); err != nil {
+		return nil, err
+	}
+
+	mac, level, err := s.storage.MacSign(req.Name, req.Data)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, resourceError(codes.NotFound, err)
+		}
+		if strings.Contains(err.Error(), "does not support") || strings.Contains(err.Error(), "not enabled") {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &kmspb.MacSignResponse{
+		Name:               req.Name,
+		Mac:                mac,
+		MacCrc32C:          wrapperspb.Int64(crc32c(mac)),
+		VerifiedDataCrc32C: verifiedData,
+		ProtectionLevel:    level,
+	}, nil
 }
 
+// MacVerify checks an HMAC tag with a MAC key version. A tag that does not
+// match is reported with success=false rather than an error; tags are
+// compared in constant time. verified_success_integrity mirrors success, so
+// integrity-checking clients can tell a mismatch from a corrupted response.
 func (s *Server) MacVerify(ctx context.Context, req *kmspb.MacVerifyRequest) (*kmspb.MacVerifyResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "MacVerify not implemented yet")
+	if req.Name == "" {
+		return nil, requiredField("name")
+	}
+	if len(req.Data) == 0 {
+		return nil, requiredField("data")
+	}
+	if len(req.Mac) == 0 {
+		return nil, requiredField("mac")
+	}
+	if err := s.checkPayloadSize("data", req.Data); err != nil {
+		return nil, err
+	}
+
+	verifiedData, err := verifyCRC32C("data", req.Data, req.DataCrc32C)
+	if err != nil {
+		return nil, err
+	}
+	verifiedMAC, err := verifyCRC32C("mac", req.Mac, req.MacCrc32C)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkName("name", req.Name, cryptoKeyVersionName); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkPermission(ctx, "MacVerify", authz.NormalizeCryptoKeyVersionResource(req.Name)); err != nil {
+		return nil, err
+	}
+
+	success, level, err := s.storage.MacVerify(req.Name, req.Data, req.Mac)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, resourceError(codes.NotFound, err)
+		}
+		if strings.Contains(err.Error(), "does not support") || strings.Contains(err.Error(), "not enabled") {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &kmspb.MacVerifyResponse{
+		Name:                     req.Name,
+		Success:                  success,
+		VerifiedDataCrc32C:       verifiedData,
+		VerifiedMacCrc32C:        verifiedMAC,
+		VerifiedSuccessIntegrity: success,
+		ProtectionLevel:          level,
+	}, nil
 }
 
+// GenerateRandomBytes returns random bytes from the operating system CSPRNG.
+// Like Cloud KMS it only accepts the HSM protection level and 8 to 1024
+// bytes.
 func (s *Server) GenerateRandomBytes(ctx context.Context, req *kmspb.GenerateRandomBytesRequest) (*kmspb.GenerateRandomBytesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "GenerateRandomBytes not implemented yet")
+	if req.Location == "" {
+		return nil, requiredField("location")
+	}
+	if req.LengthBytes < minRandomBytes || req.LengthBytes > maxRandomBytes {
+		return nil, invalidArgument("length_bytes", "length_bytes must be between %d and %d, got %d", minRandomBytes, maxRandomBytes, req.LengthBytes)
+	}
+	if req.ProtectionLevel != kmspb.ProtectionLevel_HSM {
+		return nil, invalidArgument("protection_level", "protection_level must be HSM, got %s", req.ProtectionLevel)
+	}
+
+	if err := s.checkPermission(ctx, "GenerateRandomBytes", req.Location); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, req.LengthBytes)
+	if _, err := rand.Read(data); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &kmspb.GenerateRandomBytesResponse{
+		Data:       data,
+		DataCrc32C: wrapperspb.Int64(crc32c(data)),
+	}, nil
 }
 
-func (s *Server) ListImportJobs(ctx context.Context, req *kmspb.ListImportJobsRequest) (*kmspb.ListImportJobsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "ListImportJobs not implemented yet")
+// CreateImportJob creates an import job with a new RSA wrapping key. The job
+// is ACTIVE immediately and expires after storage.ImportJobLifetime.
+func (s *Server) CreateImportJob(ctx context.Context, req *kmspb.CreateImportJobRequest) (*kmspb.ImportJob, error) {
+	if req.Parent == "" {
+		return nil, requiredField("parent")
+	}
+	if req.ImportJobId == "" {
+		return nil, requiredField("import_job_id")
+	}
+	if req.ImportJob == nil {
+		return nil, requiredField("import_job")
+	}
+	if req.ImportJob.ImportMethod == kmspb.ImportJob_IMPORT_METHOD_UNSPECIFIED {
+		return nil, requiredField("import_job.import_method")
+	}
+	switch req.ImportJob.ProtectionLevel {
+	case kmspb.ProtectionLevel_SOFTWARE, kmspb.ProtectionLevel_HSM:
+	default:
+		return nil, invalidArgument("import_job.protection_level", "import_job.protection_level must be SOFTWARE or HSM, got %s", req.ImportJob.ProtectionLevel)
+	}
+	if err := checkName("parent", req.Parent, keyRingName); err != nil {
+		return nil, err
+	}
+	if err := checkID("import_job_id", req.ImportJobId); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkPermission(ctx, "CreateImportJob", authz.NormalizeKeyRingResource(req.Parent)); err != nil {
+		return nil, err
+	}
+
+	job, err := s.storage.CreateImportJob(req.Parent, req.ImportJobId, req.ImportJob.ImportMethod, req.ImportJob.ProtectionLevel)
+	if err != nil {
+		if strings.Contains(err.Error(), "already exists") {
+			return nil, resourceError(codes.AlreadyExists, err)
+		}
+		if strings.Contains(err.Error(), "not found") {
+			return nil, resourceError(codes.NotFound, err)
+		}
+		if strings.Contains(err.Error(), "unsupported import method") {
+			return nil, invalidArgument("import_job.import_method", "%s", err)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return job, nil
 }
 
+// GetImportJob retrieves an import job
 func (s *Server) GetImportJob(ctx context.Context, req *kmspb.GetImportJobRequest) (*kmspb.ImportJob, error) {
-	return nil, status.Error(codes.Unimplemented, "GetImportJob not implemented yet")
+	if req.Name == "" {
+		return nil, requiredField("name")
+	}
+	if err := checkName("name", req.Name, importJobName); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkPermission(ctx, "GetImportJob", req.Name); err != nil {
+		return nil, err
+	}
+
+	job, err := s.storage.GetImportJob(req.Name)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, resourceError(codes.NotFound, err)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return job, nil
 }
 
-func (s *Server) CreateImportJob(ctx context.Context, req *kmspb.CreateImportJobRequest) (*kmspb.ImportJob, error) {
-	return nil, status.Error(codes.Unimplemented, "CreateImportJob not implemented yet")
+// ListImportJobs lists the import jobs in a keyring
+func (s *Server) ListImportJobs(ctx context.Context, req *kmspb.ListImportJobsRequest) (*kmspb.ListImportJobsResponse, error) {
+	if req.Parent == "" {
+		return nil, requiredField("parent")
+	}
+	if err := checkName("parent", req.Parent, keyRingName); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkPermission(ctx, "ListImportJobs", authz.NormalizeKeyRingResource(req.Parent)); err != nil {
+		return nil, err
+	}
+
+	jobs, err := s.storage.ListImportJobs(req.Parent)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, resourceError(codes.NotFound, err)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	page, nextPageToken, total, err := listPage(jobs, req.Filter, req.OrderBy, req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kmspb.ListImportJobsResponse{
+		ImportJobs:    page,
+		NextPageToken: nextPageToken,
+		TotalSize:     total,
+	}, nil
 }
 
+// ImportCryptoKeyVersion unwraps key material with an import job and adds it
+// to a crypto key as a new version, or re-imports it into the existing
+// version named by crypto_key_version. Material that cannot be unwrapped
+// leaves the version IMPORT_FAILED with import_failure_reason set.
 func (s *Server) ImportCryptoKeyVersion(ctx context.Context, req *kmspb.ImportCryptoKeyVersionRequest) (*kmspb.CryptoKeyVersion, error) {
-	return nil, status.Error(codes.Unimplemented, "ImportCryptoKeyVersion not implemented yet")
+	if req.Parent == "" {
+		return nil, requiredField("parent")
+	}
+	if req.Algorithm == kmspb.CryptoKeyVersion_CRYPTO_KEY_VERSION_ALGORITHM_UNSPECIFIED {
+		return nil, requiredField("algorithm")
+	}
+	if req.ImportJob == "" {
+		return nil, requiredField("import_job")
+	}
+	wrappedKey := req.WrappedKey
+	if len(wrappedKey) == 0 {
+		// rsa_aes_wrapped_key is the deprecated name of wrapped_key
+		wrappedKey = req.GetRsaAesWrappedKey()
+	}
+	if len(wrappedKey) == 0 {
+		return nil, requiredField("wrapped_key")
+	}
+	if err := checkName("parent", req.Parent, cryptoKeyName); err != nil {
+		return nil, err
+	}
+	if err := checkName("import_job", req.ImportJob, importJobName); err != nil {
+		return nil, err
+	}
+	if req.CryptoKeyVersion != "" {
+		if err := checkName("crypto_key_version", req.CryptoKeyVersion, cryptoKeyVersionName); err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(req.CryptoKeyVersion, req.Parent+"/") {
+			return nil, invalidArgument("crypto_key_version", "crypto_key_version %s is not a version of %s", req.CryptoKeyVersion, req.Parent)
+		}
+	}
+
+	if err := s.checkPermission(ctx, "ImportCryptoKeyVersion", authz.NormalizeCryptoKeyResource(req.Parent)); err != nil {
+		return nil, err
+	}
+
+	version, err := s.storage.ImportCryptoKeyVersion(req.Parent, req.Algorithm, req.ImportJob, wrappedKey, req.CryptoKeyVersion)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, resourceError(codes.NotFound, err)
+		}
+		if strings.Contains(err.Error(), "not active") || strings.Contains(err.Error(), "not eligible for reimport") {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		if strings.Contains(err.Error(), "is not valid for") || strings.Contains(err.Error(), "invalid wrapped key") || strings.Contains(err.Error(), "does not match") {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return withETag(ctx, version), nil
 }
 
 func (s *Server) RawEncrypt(ctx context.Context, req *kmspb.RawEncryptRequest) (*kmspb.RawEncryptResponse, error) {
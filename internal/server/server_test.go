@@ -0,0 +1,596 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/iam/apiv1/iampb"
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	emulatorauth "github.com/blackwell-systems/gcp-emulator-auth"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/authz"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/principal"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+// fakeIAM grants the roles or permissions listed for each principal and
+// resource
+type fakeIAM struct {
+	iampb.UnimplementedIAMPolicyServer
+
+	mu     sync.Mutex
+	grants map[[2]string][]string // principal, resource -> roles
+	calls  int
+}
+
+func (f *fakeIAM) TestIamPermissions(ctx context.Context, req *iampb.TestIamPermissionsRequest) (*iampb.TestIamPermissionsResponse, error) {
+	caller := emulatorauth.ExtractPrincipalFromContext(ctx)
+	f.mu.Lock()
+	f.calls++
+	perms, err := authz.ExpandRoles(f.grants[[2]string{caller, req.Resource}]...)
+	f.mu.Unlock()
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	resp := &iampb.TestIamPermissionsResponse{}
+	for _, want := range req.Permissions {
+		for _, granted := range perms {
+			if granted == want {
+				resp.Permissions = append(resp.Permissions, want)
+			}
+		}
+	}
+	return resp, nil
+}
+
+// SetIamPolicy replaces the grants on a resource with the policy's bindings
+func (f *fakeIAM) SetIamPolicy(_ context.Context, req *iampb.SetIamPolicyRequest) (*iampb.Policy, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for k := range f.grants {
+		if k[1] == req.Resource {
+			delete(f.grants, k)
+		}
+	}
+	for _, b := range req.Policy.GetBindings() {
+		for _, m := range b.Members {
+			k := [2]string{m, req.Resource}
+			f.grants[k] = append(f.grants[k], b.Role)
+		}
+	}
+	return req.Policy, nil
+}
+
+// newStrictServer returns a server enforcing IAM against a fake IAM emulator
+func newStrictServer(t *testing.T, grants map[[2]string][]string) *Server {
+	s, _ := newStrictServerWithIAM(t, grants)
+	return s
+}
+
+func newStrictServerWithIAM(t *testing.T, grants map[[2]string][]string) (*Server, *fakeIAM) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	iam := grpc.NewServer()
+	fake := &fakeIAM{grants: grants}
+	iampb.RegisterIAMPolicyServer(iam, fake)
+	go iam.Serve(lis)
+	t.Cleanup(iam.Stop)
+
+	t.Setenv("IAM_EMULATOR_HOST", lis.Addr().String())
+	t.Setenv("IAM_MODE", "strict")
+	s, err := NewServer()
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	t.Cleanup(func() { s.SetIAMMode(emulatorauth.AuthModeOff) })
+	return s, fake
+}
+
+func TestCheckPermissionImpersonation(t *testing.T) {
+	const (
+		keyRing  = "projects/p/locations/global/keyRings/r"
+		dev      = "user:dev@example.com"
+		deployer = "serviceAccount:deployer@p.iam.gserviceaccount.com"
+		app      = "serviceAccount:app@p.iam.gserviceaccount.com"
+	)
+	s := newStrictServer(t, map[[2]string][]string{
+		{dev, principal.ServiceAccountResource(deployer)}: {"roles/iam.serviceAccountTokenCreator"},
+		{deployer, principal.ServiceAccountResource(app)}: {"roles/iam.serviceAccountTokenCreator"},
+		{app, keyRing}:      {"roles/cloudkms.viewer"},
+		{deployer, keyRing}: {"cloudkms.keyRings.get"},
+	})
+
+	tests := []struct {
+		name string
+		md   metadata.MD
+		code codes.Code
+	}{
+		{"direct caller without the role", metadata.Pairs("x-emulator-principal", dev), codes.PermissionDenied},
+		{"direct service account", metadata.Pairs("x-emulator-principal", app), codes.OK},
+		{"impersonation", metadata.Pairs("x-emulator-principal", dev, "x-emulator-impersonate", "deployer@p.iam.gserviceaccount.com"), codes.OK},
+		{"delegation chain", metadata.Pairs("x-emulator-principal", dev, "x-emulator-impersonate", "deployer@p.iam.gserviceaccount.com,app@p.iam.gserviceaccount.com"), codes.OK},
+		{"chain skipping a link", metadata.Pairs("x-emulator-principal", dev, "x-emulator-impersonate", "app@p.iam.gserviceaccount.com"), codes.PermissionDenied},
+		{"anonymous impersonation", metadata.Pairs("x-emulator-impersonate", "app@p.iam.gserviceaccount.com"), codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), tt.md)
+			_, err := principal.NewResolver(nil).UnaryServerInterceptor()(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, _ any) (any, error) {
+				return nil, s.checkPermission(ctx, "GetKeyRing", keyRing)
+			})
+			if code := status.Code(err); code != tt.code {
+				t.Errorf("Expected %s, got %v", tt.code, err)
+			}
+		})
+	}
+}
+
+func TestCheckPermissionDecisions(t *testing.T) {
+	const keyName = "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+	s := newStrictServer(t, map[[2]string][]string{
+		{"user:dev@example.com", keyName}: {"roles/cloudkms.cryptoKeyEncrypter"},
+	})
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-emulator-principal", "user:dev@example.com"))
+
+	if err := s.checkPermission(ctx, "Encrypt", keyName); err != nil {
+		t.Fatalf("Expected Encrypt to be allowed, got %v", err)
+	}
+	err := s.checkPermission(ctx, "Decrypt", keyName)
+	want := "Permission 'cloudkms.cryptoKeys.decrypt' denied on resource '" + keyName + "' (or it may not exist)"
+	if st, _ := status.FromError(err); st.Code() != codes.PermissionDenied || st.Message() != want {
+		t.Errorf("Expected PermissionDenied %q, got %v", want, err)
+	}
+
+	decisions := s.Decisions().Recent(0)
+	if len(decisions) != 2 {
+		t.Fatalf("Expected 2 decisions, got %+v", decisions)
+	}
+	d := decisions[0]
+	if d.Operation != "Decrypt" || d.Principal != "user:dev@example.com" || d.Permission != "cloudkms.cryptoKeys.decrypt" ||
+		d.Resource != keyName || d.Outcome != authz.OutcomeDenied || d.Time.IsZero() {
+		t.Errorf("Unexpected denial %+v", d)
+	}
+	if decisions[1].Outcome != authz.OutcomeAllowed {
+		t.Errorf("Expected the Encrypt check to be allowed, got %+v", decisions[1])
+	}
+}
+
+// denyDecrypt is an authorizer granting everything but decryption
+type denyDecrypt struct{}
+
+func (denyDecrypt) CheckPermission(_ context.Context, _, _, permission string) (bool, error) {
+	return permission != "cloudkms.cryptoKeys.decrypt", nil
+}
+
+func TestNewServerOptions(t *testing.T) {
+	const keyRing = "projects/p/locations/global/keyRings/r"
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	st := storage.NewStorage()
+	var logs bytes.Buffer
+	s, err := NewServer(
+		WithStorage(st),
+		WithClock(func() time.Time { return now }),
+		WithLogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+		WithIAMMode(emulatorauth.AuthModeOff),
+		WithAuthorizer(denyDecrypt{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Storage() != st {
+		t.Error("Expected the server to serve the given storage")
+	}
+	if s.IAMMode() != emulatorauth.AuthModeStrict {
+		t.Errorf("Expected an authorizer to enforce strict mode, got %v", s.IAMMode())
+	}
+
+	ctx := context.Background()
+	if _, err := s.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/p/locations/global", KeyRingId: "r"}); err != nil {
+		t.Fatal(err)
+	}
+	key, err := s.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{Parent: keyRing, CryptoKeyId: "k", CryptoKey: &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.CreateTime.AsTime().Equal(now) {
+		t.Errorf("Expected createTime %v from the clock, got %v", now, key.CreateTime.AsTime())
+	}
+	resp, err := s.Encrypt(ctx, &kmspb.EncryptRequest{Name: key.Name, Plaintext: []byte("data")})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if _, err := s.Decrypt(ctx, &kmspb.DecryptRequest{Name: key.Name, Ciphertext: resp.Ciphertext}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected the authorizer to deny Decrypt, got %v", err)
+	}
+
+	if d := s.Decisions().Recent(0); len(d) == 0 || !d[0].Time.Equal(now) {
+		t.Errorf("Expected decisions timed by the clock, got %+v", d)
+	}
+	if !strings.Contains(logs.String(), "Authorization decision") {
+		t.Errorf("Expected decisions in the given logger, got %q", logs.String())
+	}
+}
+
+func TestCheckPermissionCache(t *testing.T) {
+	const (
+		keyRing = "projects/p/locations/global/keyRings/r"
+		keyName = keyRing + "/cryptoKeys/k"
+		dev     = "user:dev@example.com"
+	)
+	s, iam := newStrictServerWithIAM(t, map[[2]string][]string{{dev, keyName}: {"roles/cloudkms.cryptoKeyEncrypter"}})
+	s.SetIAMCacheTTL(time.Minute)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-emulator-principal", dev))
+
+	for range 3 {
+		if err := s.checkPermission(ctx, "Encrypt", keyName); err != nil {
+			t.Fatalf("Expected Encrypt to be allowed, got %v", err)
+		}
+	}
+	iam.mu.Lock()
+	calls := iam.calls
+	iam.mu.Unlock()
+	if calls != 1 {
+		t.Errorf("Expected 1 IAM call, got %d", calls)
+	}
+	if d := s.Decisions().Recent(1)[0]; !d.Cached || d.Outcome != authz.OutcomeAllowed {
+		t.Errorf("Expected a cached allowed decision, got %+v", d)
+	}
+	if stats := s.IAMCache().Stats(); stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("Unexpected cache stats %+v", stats)
+	}
+
+	// Setting a policy through the emulator drops the answers for the
+	// resource and those below it
+	if _, err := s.IAMPolicy().SetIamPolicy(ctx, &iampb.SetIamPolicyRequest{Resource: keyName, Policy: &iampb.Policy{}}); err != nil {
+		t.Fatalf("SetIamPolicy failed: %v", err)
+	}
+	if err := s.checkPermission(ctx, "Encrypt", keyName); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied after the policy changed, got %v", err)
+	}
+	if _, err := s.IAMPolicy().SetIamPolicy(ctx, &iampb.SetIamPolicyRequest{Resource: keyRing, Policy: &iampb.Policy{}}); err != nil {
+		t.Fatalf("SetIamPolicy failed: %v", err)
+	}
+	if s.IAMCache().Stats().Entries != 0 {
+		t.Error("Expected the key's answers to be dropped with its key ring's policy")
+	}
+}
+
+func TestCheckPermissionForceDeny(t *testing.T) {
+	const keyName = "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+	deny := func(value string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-emulator-principal", "user:dev@example.com", "x-emulator-force-deny", value))
+	}
+
+	// Denials are forced with IAM off too
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetIAMMode(emulatorauth.AuthModeOff); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		header string
+		code   codes.Code
+	}{
+		{"cloudkms.cryptoKeys.decrypt", codes.PermissionDenied},
+		{"cloudkms.cryptoKeys.encrypt, cloudkms.cryptoKeys.decrypt", codes.PermissionDenied},
+		{"*", codes.PermissionDenied},
+		{"cloudkms.cryptoKeys.encrypt", codes.OK},
+		{"", codes.OK},
+	}
+	for _, tt := range tests {
+		if err := s.checkPermission(deny(tt.header), "Decrypt", keyName); status.Code(err) != tt.code {
+			t.Errorf("%q: expected %s, got %v", tt.header, tt.code, err)
+		}
+	}
+	if d := s.Decisions().Recent(1)[0]; !d.Forced || d.Outcome != authz.OutcomeDenied || d.Permission != "cloudkms.cryptoKeys.decrypt" {
+		t.Errorf("Expected a forced denial, got %+v", d)
+	}
+
+	// and regardless of the policy
+	s, iam := newStrictServerWithIAM(t, map[[2]string][]string{{"user:dev@example.com", keyName}: {"roles/cloudkms.cryptoKeyEncrypterDecrypter"}})
+	if err := s.checkPermission(deny("cloudkms.cryptoKeys.decrypt"), "Decrypt", keyName); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected a forced PermissionDenied, got %v", err)
+	}
+	if err := s.checkPermission(deny("cloudkms.cryptoKeys.decrypt"), "Encrypt", keyName); err != nil {
+		t.Errorf("Expected other permissions to be checked as usual, got %v", err)
+	}
+	iam.mu.Lock()
+	defer iam.mu.Unlock()
+	if iam.calls != 1 {
+		t.Errorf("Expected only the unforced check to reach IAM, got %d calls", iam.calls)
+	}
+}
+
+func TestErrorDetails(t *testing.T) {
+	const keyRing = "projects/p/locations/global/keyRings/r"
+	ctx := context.Background()
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetIAMMode(emulatorauth.AuthModeOff); err != nil {
+		t.Fatal(err)
+	}
+	details := func(err error) []any {
+		t.Helper()
+		st, ok := status.FromError(err)
+		if !ok {
+			t.Fatalf("Expected a status error, got %v", err)
+		}
+		return st.Details()
+	}
+
+	_, err = s.GetKeyRing(ctx, &kmspb.GetKeyRingRequest{Name: keyRing})
+	if d := details(err); status.Code(err) != codes.NotFound || len(d) != 1 {
+		t.Fatalf("Expected NotFound with one detail, got %v %v", err, d)
+	} else if info, ok := d[0].(*errdetails.ResourceInfo); !ok || info.ResourceType != "type.googleapis.com/google.cloud.kms.v1.KeyRing" || info.ResourceName != keyRing {
+		t.Errorf("Expected ResourceInfo for the keyring, got %v", d[0])
+	}
+
+	_, err = s.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/p/locations/global"})
+	if d := details(err); status.Code(err) != codes.InvalidArgument || len(d) != 1 {
+		t.Fatalf("Expected InvalidArgument with one detail, got %v %v", err, d)
+	} else if br, ok := d[0].(*errdetails.BadRequest); !ok || len(br.FieldViolations) != 1 || br.FieldViolations[0].Field != "key_ring_id" {
+		t.Errorf("Expected a key_ring_id field violation, got %v", d[0])
+	}
+
+	denied := metadata.NewIncomingContext(ctx, metadata.Pairs("x-emulator-force-deny", "*"))
+	_, err = s.GetKeyRing(denied, &kmspb.GetKeyRingRequest{Name: keyRing})
+	if d := details(err); status.Code(err) != codes.PermissionDenied || len(d) != 1 {
+		t.Fatalf("Expected PermissionDenied with one detail, got %v %v", err, d)
+	} else if info, ok := d[0].(*errdetails.ErrorInfo); !ok || info.Reason != ReasonPermissionDenied || info.Domain != DomainIAM ||
+		info.Metadata["permission"] != "cloudkms.keyRings.get" || info.Metadata["resource"] != keyRing {
+		t.Errorf("Expected ErrorInfo for the denial, got %v", d[0])
+	}
+}
+
+func TestCheckLocation(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetIAMMode(emulatorauth.AuthModeOff); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetCustomLocations([]string{"edge-lab1", "global"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.locations) != len(KMSLocations)+1 {
+		t.Errorf("Expected one custom location to be added, got %d locations", len(s.locations))
+	}
+	if err := s.SetCustomLocations([]string{"Edge Lab"}); err == nil {
+		t.Error("Expected an invalid custom location to be rejected")
+	}
+
+	tests := []struct {
+		parent string
+		code   codes.Code
+	}{
+		{"projects/p/locations/global", codes.OK},
+		{"projects/p/locations/europe-west4", codes.OK},
+		{"projects/p/locations/edge-lab1", codes.OK},
+		{"projects/p/locations/mars", codes.NotFound},
+		{"projects/p/locations/us-central", codes.NotFound},
+		{"projects/p/locations/US-CENTRAL1", codes.InvalidArgument},
+		{"projects/p/locations/", codes.InvalidArgument},
+		{"projects/p", codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		_, err := s.ListKeyRings(context.Background(), &kmspb.ListKeyRingsRequest{Parent: tt.parent})
+		if status.Code(err) != tt.code {
+			t.Errorf("ListKeyRings(%q): expected %s, got %v", tt.parent, tt.code, err)
+		}
+		_, err = s.CreateKeyRing(context.Background(), &kmspb.CreateKeyRingRequest{Parent: tt.parent, KeyRingId: "r"})
+		if status.Code(err) != tt.code {
+			t.Errorf("CreateKeyRing(%q): expected %s, got %v", tt.parent, tt.code, err)
+		}
+	}
+}
+
+func TestEncryptDecryptMetadata(t *testing.T) {
+	const keyRing = "projects/p/locations/global/keyRings/r"
+	ctx := context.Background()
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetIAMMode(emulatorauth.AuthModeOff); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/p/locations/global", KeyRingId: "r"}); err != nil {
+		t.Fatal(err)
+	}
+	key, err := s.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{Parent: keyRing, CryptoKeyId: "k", CryptoKey: &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, aad := []byte("secret"), []byte("aad")
+	enc, err := s.Encrypt(ctx, &kmspb.EncryptRequest{
+		Name:                              key.Name,
+		Plaintext:                         plaintext,
+		AdditionalAuthenticatedData:       aad,
+		PlaintextCrc32C:                   wrapperspb.Int64(crc32c(plaintext)),
+		AdditionalAuthenticatedDataCrc32C: wrapperspb.Int64(crc32c(aad)),
+	})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if enc.Name != key.Name+"/cryptoKeyVersions/1" || enc.GetCiphertextCrc32C().GetValue() != crc32c(enc.Ciphertext) ||
+		!enc.VerifiedPlaintextCrc32C || !enc.VerifiedAdditionalAuthenticatedDataCrc32C || enc.ProtectionLevel != kmspb.ProtectionLevel_SOFTWARE {
+		t.Errorf("Unexpected EncryptResponse metadata: %v", enc)
+	}
+	_, err = s.Encrypt(ctx, &kmspb.EncryptRequest{Name: key.Name, Plaintext: plaintext, PlaintextCrc32C: wrapperspb.Int64(1)})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected a wrong plaintext checksum to be InvalidArgument, got %v", err)
+	}
+
+	dec, err := s.Decrypt(ctx, &kmspb.DecryptRequest{Name: key.Name, Ciphertext: enc.Ciphertext, CiphertextCrc32C: enc.CiphertextCrc32C, AdditionalAuthenticatedData: aad})
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	_, err = s.Decrypt(ctx, &kmspb.DecryptRequest{Name: key.Name, Ciphertext: enc.Ciphertext, AdditionalAuthenticatedData: []byte("other")})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected the wrong additional authenticated data to be InvalidArgument, got %v", err)
+	}
+	if dec.GetPlaintextCrc32C().GetValue() != crc32c(plaintext) || !dec.UsedPrimary || dec.ProtectionLevel != kmspb.ProtectionLevel_SOFTWARE {
+		t.Errorf("Unexpected DecryptResponse metadata: %v", dec)
+	}
+	_, err = s.Decrypt(ctx, &kmspb.DecryptRequest{Name: key.Name, Ciphertext: enc.Ciphertext, CiphertextCrc32C: wrapperspb.Int64(1)})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected a wrong ciphertext checksum to be InvalidArgument, got %v", err)
+	}
+
+	// A new primary leaves the first version decrypting, but not as primary
+	if _, err := s.CreateCryptoKeyVersion(ctx, &kmspb.CreateCryptoKeyVersionRequest{Parent: key.Name, CryptoKeyVersion: &kmspb.CryptoKeyVersion{}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UpdateCryptoKeyPrimaryVersion(ctx, &kmspb.UpdateCryptoKeyPrimaryVersionRequest{Name: key.Name, CryptoKeyVersionId: "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if dec, err := s.Decrypt(ctx, &kmspb.DecryptRequest{Name: key.Name, Ciphertext: enc.Ciphertext, AdditionalAuthenticatedData: aad}); err != nil || dec.UsedPrimary {
+		t.Errorf("Expected Decrypt with a non-primary version, got %v, %v", dec, err)
+	}
+
+	// Responses carry the protection level of the version that was used
+	hsm, err := s.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{Parent: keyRing, CryptoKeyId: "hsm", CryptoKey: &kmspb.CryptoKey{
+		Purpose:         kmspb.CryptoKey_ENCRYPT_DECRYPT,
+		VersionTemplate: &kmspb.CryptoKeyVersionTemplate{ProtectionLevel: kmspb.ProtectionLevel_HSM},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err = s.Encrypt(ctx, &kmspb.EncryptRequest{Name: hsm.Name, Plaintext: plaintext})
+	if err != nil || enc.ProtectionLevel != kmspb.ProtectionLevel_HSM {
+		t.Fatalf("Expected Encrypt to report HSM, got %v, %v", enc, err)
+	}
+	if dec, err := s.Decrypt(ctx, &kmspb.DecryptRequest{Name: hsm.Name, Ciphertext: enc.Ciphertext}); err != nil || dec.ProtectionLevel != kmspb.ProtectionLevel_HSM {
+		t.Errorf("Expected Decrypt to report HSM, got %v, %v", dec, err)
+	}
+}
+
+// headerStream captures the response metadata a handler sets
+type headerStream struct {
+	header metadata.MD
+}
+
+func (h *headerStream) Method() string { return "" }
+func (h *headerStream) SetHeader(md metadata.MD) error {
+	h.header = metadata.Join(h.header, md)
+	return nil
+}
+func (h *headerStream) SendHeader(md metadata.MD) error { return h.SetHeader(md) }
+func (h *headerStream) SetTrailer(metadata.MD) error    { return nil }
+
+func TestUsageHeaders(t *testing.T) {
+	const keyRing = "projects/p/locations/global/keyRings/r"
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetIAMMode(emulatorauth.AuthModeOff); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := s.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/p/locations/global", KeyRingId: "r"}); err != nil {
+		t.Fatal(err)
+	}
+	key, err := s.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{Parent: keyRing, CryptoKeyId: "k", CryptoKey: &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := &headerStream{}
+	if _, err := s.GetCryptoKey(grpc.NewContextWithServerTransportStream(ctx, stream), &kmspb.GetCryptoKeyRequest{Name: key.Name}); err != nil {
+		t.Fatal(err)
+	}
+	if got := stream.header.Get(UseCountHeader); len(got) != 1 || got[0] != "0" || len(stream.header.Get(LastUseTimeHeader)) != 0 {
+		t.Errorf("Expected an unused key, got %v", stream.header)
+	}
+
+	for range 2 {
+		if _, err := s.Encrypt(ctx, &kmspb.EncryptRequest{Name: key.Name, Plaintext: []byte("data")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream = &headerStream{}
+	if _, err := s.GetCryptoKeyVersion(grpc.NewContextWithServerTransportStream(ctx, stream), &kmspb.GetCryptoKeyVersionRequest{Name: key.Name + "/cryptoKeyVersions/1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := stream.header.Get(UseCountHeader); len(got) != 1 || got[0] != "2" || len(stream.header.Get(LastUseTimeHeader)) != 1 {
+		t.Errorf("Expected a version used twice, got %v", stream.header)
+	}
+}
+
+func TestETags(t *testing.T) {
+	const keyRing = "projects/p/locations/global/keyRings/r"
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetIAMMode(emulatorauth.AuthModeOff); err != nil {
+		t.Fatal(err)
+	}
+	// call returns a context for one call, sending ifMatch if set, and the
+	// stream its response metadata goes to
+	call := func(ifMatch string) (context.Context, *headerStream) {
+		stream := &headerStream{}
+		ctx := context.Background()
+		if ifMatch != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(IfMatchHeader, ifMatch))
+		}
+		return grpc.NewContextWithServerTransportStream(ctx, stream), stream
+	}
+
+	ctx, _ := call("")
+	if _, err := s.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/p/locations/global", KeyRingId: "r"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, stream := call("")
+	key, err := s.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{Parent: keyRing, CryptoKeyId: "k", CryptoKey: &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := stream.header.Get(ETagHeader)
+	if len(etag) != 1 || etag[0] == "" {
+		t.Fatalf("Expected CreateCryptoKey to send an etag, got %v", stream.header)
+	}
+
+	ctx, stream = call(etag[0])
+	update := &kmspb.UpdateCryptoKeyRequest{CryptoKey: &kmspb.CryptoKey{Name: key.Name, Labels: map[string]string{"env": "a"}}}
+	if _, err := s.UpdateCryptoKey(ctx, update); err != nil {
+		t.Fatalf("UpdateCryptoKey with the current etag failed: %v", err)
+	}
+	if got := stream.header.Get(ETagHeader); len(got) != 1 || got[0] == etag[0] {
+		t.Errorf("Expected the update to send a new etag, got %v", got)
+	}
+
+	// A second admin still holding the first etag loses
+	ctx, _ = call(etag[0])
+	update.CryptoKey.Labels = map[string]string{"env": "b"}
+	if _, err := s.UpdateCryptoKey(ctx, update); status.Code(err) != codes.Aborted {
+		t.Errorf("Expected a stale etag to be Aborted, got %v", err)
+	}
+	ctx, _ = call("stale")
+	version := &kmspb.CryptoKeyVersion{Name: key.Name + "/cryptoKeyVersions/1", State: kmspb.CryptoKeyVersion_DISABLED}
+	if _, err := s.UpdateCryptoKeyVersion(ctx, &kmspb.UpdateCryptoKeyVersionRequest{CryptoKeyVersion: version}); status.Code(err) != codes.Aborted {
+		t.Errorf("Expected a stale version etag to be Aborted, got %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Cloud KMS reports key usage through its key usage insights, not on the
+// resources, so the emulator sends it as metadata: GetCryptoKey and
+// GetCryptoKeyVersion responses carry how many cryptographic operations have
+// used the key or version in UseCountHeader and, once it has been used, the
+// RFC 3339 time of the last use in LastUseTimeHeader.
+const (
+	UseCountHeader    = "x-emulator-use-count"
+	LastUseTimeHeader = "x-emulator-last-use-time"
+)
+
+// sendUsage sends the usage of the named key or version as response
+// metadata. Calls made outside a gRPC server have nowhere to send it.
+func (s *Server) sendUsage(ctx context.Context, name string) {
+	usage := s.storage.Usage(name)
+	md := metadata.Pairs(UseCountHeader, strconv.FormatInt(usage.UseCount, 10))
+	if usage.LastUseTime != nil {
+		md.Set(LastUseTimeHeader, usage.LastUseTime.Format(time.RFC3339Nano))
+	}
+	_ = grpc.SetHeader(ctx, md)
+}
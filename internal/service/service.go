@@ -0,0 +1,106 @@
+// Package service integrates the emulator with service managers.
+//
+// Under systemd (Type=notify) the emulator reports readiness, reloads and
+// shutdown over $NOTIFY_SOCKET and answers the watchdog when WatchdogSec is
+// set. Under the Windows service control manager it runs as a service that
+// stops cleanly on Stop and Shutdown requests. Outside a service manager every
+// function is a no-op.
+//
+// The emulator exits with ExitOK after a clean shutdown, ExitFailure when it
+// fails at runtime, and ExitConfig when it is misconfigured. Unit files can
+// use RestartPreventExitStatus=2 so a bad configuration is not restarted in a
+// loop.
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Exit codes
+const (
+	ExitOK      = 0
+	ExitFailure = 1
+	ExitConfig  = 2
+)
+
+// Name is the Windows service name and systemd unit name used in examples
+const Name = "gcp-kms-emulator"
+
+// Notify sends a state string such as "READY=1" to systemd. It does nothing
+// when the process was not started by systemd with NOTIFY_SOCKET set.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Abstract socket names are given with a leading "@"
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to NOTIFY_SOCKET: %w", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Ready reports that the emulator accepts connections
+func Ready(status string) error {
+	markRunning()
+	return Notify("READY=1\nSTATUS=" + status)
+}
+
+// Reloading reports that the configuration is being reloaded; call Ready
+// when done
+func Reloading() error {
+	return Notify("RELOADING=1")
+}
+
+// Stopping reports that shutdown has begun
+func Stopping() error {
+	return Notify("STOPPING=1\nSTATUS=Shutting down")
+}
+
+// WatchdogInterval returns how often systemd expects a watchdog ping, or 0 if
+// the watchdog is disabled for this process
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// StartWatchdog pings the systemd watchdog at half its interval until ctx is
+// done. It does nothing when the watchdog is disabled.
+func StartWatchdog(ctx context.Context) {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_ = Notify("WATCHDOG=1")
+			}
+		}
+	}()
+}
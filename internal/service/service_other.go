@@ -0,0 +1,17 @@
+//go:build !windows
+
+package service
+
+// IsWindowsService reports whether the process was started by the Windows
+// service control manager
+func IsWindowsService() bool {
+	return false
+}
+
+// RunWindowsService runs main as a Windows service. It is only supported on
+// Windows.
+func RunWindowsService(main func(stop <-chan struct{}) int) int {
+	return main(nil)
+}
+
+func markRunning() {}
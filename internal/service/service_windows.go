@@ -0,0 +1,78 @@
+package service
+
+import (
+	"log/slog"
+	"sync"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// running is closed by Ready so the service handler can report SERVICE_RUNNING
+var (
+	running     = make(chan struct{})
+	runningOnce sync.Once
+)
+
+// IsWindowsService reports whether the process was started by the Windows
+// service control manager
+func IsWindowsService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// RunWindowsService runs main as a Windows service. stop is closed when the
+// service control manager asks the service to stop or the machine shuts down;
+// main should then shut down cleanly and return its exit code.
+func RunWindowsService(main func(stop <-chan struct{}) int) int {
+	h := &handler{main: main}
+	if err := svc.Run(Name, h); err != nil {
+		slog.Error("Failed to run as Windows service", "error", err)
+		return ExitFailure
+	}
+	return h.exitCode
+}
+
+func markRunning() {
+	runningOnce.Do(func() { close(running) })
+}
+
+type handler struct {
+	main     func(stop <-chan struct{}) int
+	exitCode int
+}
+
+func (h *handler) Execute(_ []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+	changes <- svc.Status{State: svc.StartPending}
+
+	stop := make(chan struct{})
+	done := make(chan int, 1)
+	go func() { done <- h.main(stop) }()
+
+	ready := running
+	stopping := false
+	for {
+		select {
+		case <-ready:
+			ready = nil // report the transition once
+			if !stopping {
+				changes <- svc.Status{State: svc.Running, Accepts: accepted}
+			}
+		case code := <-done:
+			h.exitCode = code
+			// A non-zero code is reported as a service-specific exit code
+			return code != ExitOK, uint32(code)
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				changes <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				if !stopping {
+					stopping = true
+					changes <- svc.Status{State: svc.StopPending}
+					close(stop)
+				}
+			}
+		}
+	}
+}
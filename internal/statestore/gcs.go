@@ -0,0 +1,145 @@
+package statestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const defaultGCSEndpoint = "https://storage.googleapis.com"
+
+// gcsStore keeps the snapshot in a Google Cloud Storage object using the
+// JSON API directly, so no client library is required.
+type gcsStore struct {
+	bucket   string
+	object   string
+	endpoint string
+	token    func(ctx context.Context) (string, error)
+}
+
+func newGCSStoreFromEnv(bucket, object string) *gcsStore {
+	s := &gcsStore{
+		bucket:   bucket,
+		object:   object,
+		endpoint: defaultGCSEndpoint,
+		token:    gcsTokenFromEnv,
+	}
+
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		s.endpoint = strings.TrimSuffix(host, "/")
+		s.token = nil
+	}
+
+	return s
+}
+
+func (g *gcsStore) Load(ctx context.Context) ([]byte, error) {
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", g.endpoint, url.PathEscape(g.bucket), url.PathEscape(g.object))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := g.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", g, os.ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(g, "download", resp)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+func (g *gcsStore) Save(ctx context.Context, data []byte) error {
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=media&name=%s", g.endpoint, url.PathEscape(g.bucket), url.QueryEscape(g.object))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(g, "upload", resp)
+	}
+	return nil
+}
+
+func (g *gcsStore) String() string {
+	return fmt.Sprintf("gs://%s/%s", g.bucket, g.object)
+}
+
+func (g *gcsStore) do(req *http.Request) (*http.Response, error) {
+	if g.token != nil {
+		token, err := g.token(req.Context())
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to obtain access token: %w", g, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return httpClient.Do(req)
+}
+
+// gcsTokenFromEnv returns GOOGLE_OAUTH_ACCESS_TOKEN if set, otherwise a token
+// for the default service account from the GCE metadata server.
+func gcsTokenFromEnv(ctx context.Context) (string, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+
+	u := fmt.Sprintf("http://%s/computeMetadata/v1/instance/service-accounts/default/token", host)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("set GOOGLE_OAUTH_ACCESS_TOKEN or run on GCP: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %s", resp.Status)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("invalid metadata token response: %w", err)
+	}
+	return body.AccessToken, nil
+}
+
+// responseError formats a non-success object storage response
+func responseError(store Store, op string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s: %s failed: %s: %s", store, op, resp.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,151 @@
+// Package statestore moves emulator state snapshots to and from durable
+// locations so state can outlive the process (and the machine) that created it.
+//
+// A Store is addressed by URI:
+//   - file:///path/state.json or a bare path: local file
+//   - gs://bucket/object: Google Cloud Storage
+//   - s3://bucket/key: Amazon S3 or any S3-compatible service
+//
+// # Credentials
+//
+// GCS uses GOOGLE_OAUTH_ACCESS_TOKEN when set and otherwise asks the GCE
+// metadata server for a token. STORAGE_EMULATOR_HOST points requests at a
+// local fake (e.g. fake-gcs-server) and disables authentication.
+//
+// S3 signs requests with AWS Signature Version 4 using AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and the optional AWS_SESSION_TOKEN. AWS_REGION selects
+// the region and AWS_ENDPOINT_URL_S3 (or AWS_ENDPOINT_URL) switches to
+// path-style requests against a custom endpoint such as MinIO or LocalStack.
+//
+// Snapshots are opaque bytes to this package; the schema is owned by the
+// storage package, which migrates older snapshots on load.
+package statestore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+// Store reads and writes a single state snapshot
+type Store interface {
+	// Load returns the stored snapshot. A missing snapshot returns an error
+	// wrapping os.ErrNotExist.
+	Load(ctx context.Context) ([]byte, error)
+	// Save replaces the stored snapshot with data
+	Save(ctx context.Context, data []byte) error
+	// String returns the URI of the store for logging
+	String() string
+}
+
+// Open returns the Store addressed by uri
+func Open(uri string) (Store, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme == "" || len(u.Scheme) == 1 {
+		// Bare paths (including Windows drive letters) are local files
+		return &fileStore{path: uri}, nil
+	}
+
+	switch u.Scheme {
+	case "file":
+		return &fileStore{path: u.Path}, nil
+	case "gs":
+		bucket, object, err := splitBucketURI(u)
+		if err != nil {
+			return nil, err
+		}
+		return newGCSStoreFromEnv(bucket, object), nil
+	case "s3":
+		bucket, key, err := splitBucketURI(u)
+		if err != nil {
+			return nil, err
+		}
+		return newS3StoreFromEnv(bucket, key)
+	default:
+		return nil, fmt.Errorf("unsupported state URI scheme %q (expected file, gs or s3)", u.Scheme)
+	}
+}
+
+// Restore loads the snapshot from store into st. A missing snapshot returns
+// an error wrapping os.ErrNotExist and leaves st untouched.
+func Restore(ctx context.Context, store Store, st *storage.Storage) error {
+	data, err := store.Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := st.LoadState(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("%s: %w", store, err)
+	}
+	return nil
+}
+
+// Persist writes the current contents of st to store
+func Persist(ctx context.Context, store Store, st *storage.Storage) error {
+	var buf bytes.Buffer
+	if err := st.SaveState(&buf); err != nil {
+		return err
+	}
+	return store.Save(ctx, buf.Bytes())
+}
+
+// StartSync persists st to store every interval until ctx is cancelled.
+// Failures are logged and retried on the next tick.
+func StartSync(ctx context.Context, store Store, st *storage.Storage, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := Persist(ctx, store, st); err != nil && ctx.Err() == nil {
+					slog.Warn("State sync failed", "uri", store.String(), "error", err)
+				}
+			}
+		}
+	}()
+}
+
+func splitBucketURI(u *url.URL) (string, string, error) {
+	bucket := u.Host
+	object := strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || object == "" {
+		return "", "", fmt.Errorf("state URI %q must be %s://bucket/object", u.String(), u.Scheme)
+	}
+	return bucket, object, nil
+}
+
+// fileStore keeps the snapshot in a local file
+type fileStore struct {
+	path string
+}
+
+func (f *fileStore) Load(ctx context.Context) ([]byte, error) {
+	return os.ReadFile(f.path)
+}
+
+func (f *fileStore) Save(ctx context.Context, data []byte) error {
+	return storage.WriteStateFile(f.path, data)
+}
+
+func (f *fileStore) String() string {
+	return f.path
+}
+
+// httpClient is shared by the object storage backends
+var httpClient = &http.Client{Timeout: 60 * time.Second}
@@ -0,0 +1,197 @@
+package statestore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+// fakeObjectServer is a minimal in-memory object store that understands both
+// the GCS JSON API and S3 path-style requests.
+type fakeObjectServer struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	headers http.Header
+}
+
+func newFakeObjectServer(t *testing.T) (*fakeObjectServer, *httptest.Server) {
+	t.Helper()
+	f := &fakeObjectServer{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeObjectServer) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.headers = r.Header.Clone()
+
+	var key string
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/"):
+		bucket := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/upload/storage/v1/b/"), "/o")
+		key = bucket + "/" + r.URL.Query().Get("name")
+	case strings.HasPrefix(r.URL.Path, "/storage/v1/b/"):
+		key = strings.Replace(strings.TrimPrefix(r.URL.Path, "/storage/v1/b/"), "/o/", "/", 1)
+	default:
+		key = strings.TrimPrefix(r.URL.Path, "/")
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	case http.MethodPost, http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[key] = data
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func seededStorage(t *testing.T) *storage.Storage {
+	t.Helper()
+	st := storage.NewStorage()
+	if _, err := st.CreateKeyRing("projects/test/locations/global/keyRings/ring1"); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	return st
+}
+
+func assertRoundTrip(t *testing.T, store Store) {
+	t.Helper()
+	ctx := context.Background()
+
+	err := Restore(ctx, store, storage.NewStorage())
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected os.ErrNotExist before first save, got %v", err)
+	}
+
+	if err := Persist(ctx, store, seededStorage(t)); err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+
+	restored := storage.NewStorage()
+	if err := Restore(ctx, store, restored); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if _, err := restored.GetKeyRing("projects/test/locations/global/keyRings/ring1"); err != nil {
+		t.Errorf("Keyring not restored from %s: %v", store, err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store, err := Open("file://" + path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	assertRoundTrip(t, store)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected state file mode 0600, got %v", info.Mode().Perm())
+	}
+}
+
+func TestGCSStore(t *testing.T) {
+	fake, srv := newFakeObjectServer(t)
+	t.Setenv("STORAGE_EMULATOR_HOST", srv.URL)
+
+	store, err := Open("gs://ci-fixtures/kms/state.json")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if store.String() != "gs://ci-fixtures/kms/state.json" {
+		t.Errorf("Unexpected store name: %s", store)
+	}
+
+	assertRoundTrip(t, store)
+
+	if _, ok := fake.objects["ci-fixtures/kms/state.json"]; !ok {
+		t.Errorf("Object not uploaded, have %v", fake.objects)
+	}
+}
+
+func TestGCSStoreSendsBearerToken(t *testing.T) {
+	fake, srv := newFakeObjectServer(t)
+
+	store := &gcsStore{
+		bucket:   "b",
+		object:   "state.json",
+		endpoint: srv.URL,
+		token:    func(context.Context) (string, error) { return "test-token", nil },
+	}
+	if err := store.Save(context.Background(), []byte(`{}`)); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	if got := fake.headers.Get("Authorization"); got != "Bearer test-token" {
+		t.Errorf("Expected bearer token, got %q", got)
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	fake, srv := newFakeObjectServer(t)
+	t.Setenv("AWS_ENDPOINT_URL_S3", srv.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "session")
+	t.Setenv("AWS_REGION", "eu-west-1")
+
+	store, err := Open("s3://ci-fixtures/kms/state.json")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	assertRoundTrip(t, store)
+
+	if _, ok := fake.objects["ci-fixtures/kms/state.json"]; !ok {
+		t.Errorf("Object not uploaded, have %v", fake.objects)
+	}
+
+	auth := fake.headers.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") ||
+		!strings.Contains(auth, "/eu-west-1/s3/aws4_request") ||
+		!strings.Contains(auth, "SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-security-token") {
+		t.Errorf("Unexpected Authorization header: %q", auth)
+	}
+	if fake.headers.Get("X-Amz-Security-Token") != "session" {
+		t.Error("Session token not sent")
+	}
+}
+
+func TestS3StoreRequiresCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+
+	if _, err := Open("s3://bucket/state.json"); err == nil {
+		t.Error("Expected error without AWS credentials")
+	}
+}
+
+func TestOpenRejectsInvalidURIs(t *testing.T) {
+	for _, uri := range []string{"gs://bucket-only", "s3:///key", "ftp://host/state.json"} {
+		if _, err := Open(uri); err == nil {
+			t.Errorf("Expected error for %q", uri)
+		}
+	}
+}
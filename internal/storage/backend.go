@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"path"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+// BackendLabel is the crypto key label that puts a key's new versions in
+// the key backend; its value is the backend's name, e.g. pkcs11
+const BackendLabel = "emulator-key-backend"
+
+// KeyBackend holds the key material of selected crypto keys outside the
+// emulator, such as in an HSM through PKCS#11, and performs operations with
+// it. The emulator keeps the keys' metadata and the API surface. Keys are
+// identified by version name. Calls run concurrently, including operations
+// with one key while another key is generated.
+type KeyBackend interface {
+	// Name is the value of BackendLabel that selects the backend
+	Name() string
+	// GenerateKey creates the key of a new version
+	GenerateKey(name string, spec KeySpec) error
+	// Signer returns the private key of an asymmetric version. Keys of
+	// ASYMMETRIC_DECRYPT versions also implement crypto.Decrypter with
+	// *rsa.OAEPOptions.
+	Signer(name string) (crypto.Signer, error)
+	// Encrypt encrypts with the AES-256-GCM key of an ENCRYPT_DECRYPT
+	// version and returns the 12-byte nonce, ciphertext and 16-byte tag
+	Encrypt(name string, plaintext, aad []byte) ([]byte, error)
+	// Decrypt reverses Encrypt
+	Decrypt(name string, ciphertext, aad []byte) ([]byte, error)
+	// MAC returns the HMAC tag of data under a MAC version's key
+	MAC(name string, hash crypto.Hash, data []byte) ([]byte, error)
+	// DestroyKey deletes the key of a destroyed version
+	DestroyKey(name string) error
+}
+
+// KeySpec describes the key a backend generates for a version. Exactly one
+// of KeyBytes, RSABits, Curve and Ed25519 is set.
+type KeySpec struct {
+	Purpose kmspb.CryptoKey_CryptoKeyPurpose
+	// KeyBytes is the length of AES (ENCRYPT_DECRYPT) and HMAC (MAC) keys
+	KeyBytes int
+	RSABits  int
+	Curve    elliptic.Curve
+	Ed25519  bool
+	// Hash is the HMAC hash of MAC keys and the OAEP hash of
+	// ASYMMETRIC_DECRYPT keys
+	Hash crypto.Hash
+}
+
+// SetKeyBackend makes new versions of crypto keys whose name matches one of
+// patterns (path.Match globs), or whose BackendLabel names the backend, keep
+// their key material in backend. Existing versions keep theirs where it is.
+func (s *Storage) SetKeyBackend(backend KeyBackend, patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid key pattern %q: %w", p, err)
+		}
+	}
+	s.backend.Store(&backendConfig{backend: backend, keys: patterns})
+	return nil
+}
+
+// backendConfig is the key backend and the patterns of the keys it holds
+type backendConfig struct {
+	backend KeyBackend
+	keys    []string
+}
+
+// selectBackend returns the name of the backend that holds new versions of
+// a crypto key, or "" if the emulator does
+func (s *Storage) selectBackend(keyName string, labels map[string]string) (string, error) {
+	cfg := s.backend.Load()
+	if want := labels[BackendLabel]; want != "" {
+		if cfg == nil || cfg.backend == nil || cfg.backend.Name() != want {
+			return "", fmt.Errorf("key backend %q requested by label %s is not configured", want, BackendLabel)
+		}
+		return want, nil
+	}
+	if cfg == nil || cfg.backend == nil {
+		return "", nil
+	}
+	for _, p := range cfg.keys {
+		if ok, _ := path.Match(p, keyName); ok {
+			return cfg.backend.Name(), nil
+		}
+	}
+	return "", nil
+}
+
+// generateKey creates the key material of a new version of cryptoKey, in
+// the key backend if the key selects it
+func (s *Storage) generateKey(version *StoredCryptoKeyVersion, keyName string, labels map[string]string) error {
+	backend, err := s.selectBackend(keyName, labels)
+	if err != nil {
+		return err
+	}
+	if gen := s.generator.Load(); gen != nil && IsAsymmetric(algorithms[version.Algorithm].purpose) {
+		version.State = kmspb.CryptoKeyVersion_PENDING_GENERATION
+		gen.submit(s, version.Name, version.Algorithm, backend)
+		return nil
+	}
+	return s.generateKeyIn(version, backend)
+}
+
+// generateKeyIn creates the key material of a version in backend, or in the
+// emulator when backend is empty
+func (s *Storage) generateKeyIn(version *StoredCryptoKeyVersion, backend string) error {
+	if backend == "" {
+		var err error
+		version.SymmetricKey, version.PrivateKey, err = s.newKeyMaterial(version.Algorithm)
+		return err
+	}
+
+	spec, ok := algorithms[version.Algorithm]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm: %s", version.Algorithm)
+	}
+	// Background generation can run after the backend is replaced
+	cfg := s.backend.Load()
+	if cfg == nil || cfg.backend == nil || cfg.backend.Name() != backend {
+		return fmt.Errorf("key backend %s for %s is not configured", backend, version.Name)
+	}
+	if err := cfg.backend.GenerateKey(version.Name, spec.keySpec()); err != nil {
+		return fmt.Errorf("failed to generate key for %s in key backend %s: %w", version.Name, backend, err)
+	}
+	version.Backend = backend
+	return nil
+}
+
+func (spec algorithmSpec) keySpec() KeySpec {
+	return KeySpec{
+		Purpose:  spec.purpose,
+		KeyBytes: spec.keyBytes,
+		RSABits:  spec.rsaBits,
+		Curve:    spec.curve,
+		Ed25519:  spec.ed25519,
+		Hash:     spec.hash,
+	}
+}
+
+// keyBackend returns the backend holding a version's key material
+func (s *Storage) keyBackend(version *StoredCryptoKeyVersion) (KeyBackend, error) {
+	cfg := s.backend.Load()
+	if cfg == nil || cfg.backend == nil || cfg.backend.Name() != version.Backend {
+		return nil, fmt.Errorf("key backend %s holding %s is not configured", version.Backend, version.Name)
+	}
+	return cfg.backend, nil
+}
+
+// privateKey returns the private key of an asymmetric version
+func (s *Storage) privateKey(version *StoredCryptoKeyVersion) (crypto.Signer, error) {
+	if version.Backend == "" {
+		return parsePrivateKey(version)
+	}
+	backend, err := s.keyBackend(version)
+	if err != nil {
+		return nil, err
+	}
+	return backend.Signer(version.Name)
+}
+
+// seal encrypts with a symmetric version and returns the nonce, ciphertext
+// and tag, or an AES-SIV envelope when deterministic
+func (s *Storage) seal(version *StoredCryptoKeyVersion, plaintext, aad []byte, deterministic bool) ([]byte, error) {
+	if s.mockCrypto.Load() {
+		return mockSeal(version.Name, plaintext, aad), nil
+	}
+	if version.Backend != "" {
+		backend, err := s.keyBackend(version)
+		if err != nil {
+			return nil, err
+		}
+		return backend.Encrypt(version.Name, plaintext, aad)
+	}
+	if deterministic {
+		return sivSeal(version.SymmetricKey, plaintext, aad)
+	}
+
+	gcm, err := newGCM(version.SymmetricKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// open decrypts what seal returned
+func (s *Storage) open(version *StoredCryptoKeyVersion, ciphertext, aad []byte) ([]byte, error) {
+	if s.mockCrypto.Load() {
+		return mockOpen(version.Name, ciphertext, aad)
+	}
+	if version.Backend != "" {
+		backend, err := s.keyBackend(version)
+		if err != nil {
+			return nil, err
+		}
+		return backend.Decrypt(version.Name, ciphertext, aad)
+	}
+	if plaintext, ok, err := sivOpen(version.SymmetricKey, ciphertext, aad); ok {
+		return plaintext, err
+	}
+
+	gcm, err := newGCM(version.SymmetricKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// mac returns the HMAC tag of data under a MAC version's key
+func (s *Storage) mac(version *StoredCryptoKeyVersion, data []byte) ([]byte, error) {
+	if version.Backend == "" {
+		return computeMAC(version, data), nil
+	}
+	backend, err := s.keyBackend(version)
+	if err != nil {
+		return nil, err
+	}
+	return backend.MAC(version.Name, algorithms[version.Algorithm].hash, data)
+}
+
+// destroyBackendKey deletes the key of a destroyed backend version. It is
+// best effort: the version is destroyed either way, and an HSM that cannot
+// delete the key leaves an object nothing uses.
+func (s *Storage) destroyBackendKey(version *StoredCryptoKeyVersion) {
+	if version.Backend == "" {
+		return
+	}
+	if backend, err := s.keyBackend(version); err == nil {
+		_ = backend.DestroyKey(version.Name)
+	}
+}
@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+// fakeBackend keeps key material in memory, like an HSM would outside the
+// emulator's state
+type fakeBackend struct {
+	secrets   map[string][]byte
+	signers   map[string]crypto.Signer
+	destroyed []string
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{secrets: map[string][]byte{}, signers: map[string]crypto.Signer{}}
+}
+
+func (b *fakeBackend) Name() string { return "fake" }
+
+func (b *fakeBackend) GenerateKey(name string, spec KeySpec) error {
+	var err error
+	switch {
+	case spec.KeyBytes > 0:
+		b.secrets[name] = make([]byte, spec.KeyBytes)
+		_, err = rand.Read(b.secrets[name])
+	case spec.RSABits > 0:
+		b.signers[name], err = rsa.GenerateKey(rand.Reader, spec.RSABits)
+	case spec.Curve != nil:
+		b.signers[name], err = ecdsa.GenerateKey(spec.Curve, rand.Reader)
+	case spec.Ed25519:
+		_, b.signers[name], err = ed25519.GenerateKey(rand.Reader)
+	}
+	return err
+}
+
+func (b *fakeBackend) Signer(name string) (crypto.Signer, error) {
+	if key, ok := b.signers[name]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key %s not found", name)
+}
+
+func (b *fakeBackend) Encrypt(name string, plaintext, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(b.secrets[name])
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func (b *fakeBackend) Decrypt(name string, ciphertext, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(b.secrets[name])
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], aad)
+}
+
+func (b *fakeBackend) MAC(name string, hash crypto.Hash, data []byte) ([]byte, error) {
+	mac := hmac.New(hash.New, b.secrets[name])
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+func (b *fakeBackend) DestroyKey(name string) error {
+	b.destroyed = append(b.destroyed, name)
+	delete(b.secrets, name)
+	delete(b.signers, name)
+	return nil
+}
+
+const backendTestRing = "projects/test/locations/global/keyRings/ring1"
+
+func newBackendTestStorage(t *testing.T) (*Storage, *fakeBackend) {
+	t.Helper()
+	s := NewStorage()
+	backend := newFakeBackend()
+	if err := s.SetKeyBackend(backend, []string{backendTestRing + "/cryptoKeys/hsm-*"}); err != nil {
+		t.Fatalf("SetKeyBackend failed: %v", err)
+	}
+	if _, err := s.CreateKeyRing(backendTestRing); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	return s, backend
+}
+
+func createBackendTestKey(t *testing.T, s *Storage, id string, algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm, labels map[string]string) *StoredCryptoKeyVersion {
+	t.Helper()
+	purpose, _ := AlgorithmPurpose(algorithm)
+	key, err := s.CreateCryptoKey(backendTestRing, id, purpose, &kmspb.CryptoKeyVersionTemplate{Algorithm: algorithm}, labels)
+	if err != nil {
+		t.Fatalf("CreateCryptoKey %s failed: %v", id, err)
+	}
+	return s.keyrings[backendTestRing].CryptoKeys[key.Name].Versions[key.Name+"/cryptoKeyVersions/1"]
+}
+
+func TestKeyBackendSelection(t *testing.T) {
+	s, backend := newBackendTestStorage(t)
+
+	byPattern := createBackendTestKey(t, s, "hsm-key", kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, nil)
+	byLabel := createBackendTestKey(t, s, "labelled", kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, map[string]string{BackendLabel: "fake"})
+	software := createBackendTestKey(t, s, "software", kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, nil)
+
+	for _, v := range []*StoredCryptoKeyVersion{byPattern, byLabel} {
+		if v.Backend != "fake" || v.SymmetricKey != nil {
+			t.Errorf("%s: expected material in the backend, got backend %q and %d key bytes", v.Name, v.Backend, len(v.SymmetricKey))
+		}
+		if backend.secrets[v.Name] == nil {
+			t.Errorf("%s: backend holds no key", v.Name)
+		}
+	}
+	if software.Backend != "" || len(software.SymmetricKey) != 32 {
+		t.Errorf("software: expected emulator key material, got backend %q", software.Backend)
+	}
+
+	// A new version of a backend key goes to the backend too
+	if _, err := s.CreateCryptoKeyVersion(backendTestRing + "/cryptoKeys/labelled"); err != nil {
+		t.Fatalf("CreateCryptoKeyVersion failed: %v", err)
+	}
+	if backend.secrets[backendTestRing+"/cryptoKeys/labelled/cryptoKeyVersions/2"] == nil {
+		t.Error("Expected version 2 in the backend")
+	}
+
+	_, err := s.CreateCryptoKey(backendTestRing, "other", kmspb.CryptoKey_ENCRYPT_DECRYPT, nil, map[string]string{BackendLabel: "pkcs11"})
+	if err == nil || !strings.Contains(err.Error(), "is not configured") {
+		t.Errorf("Expected an unconfigured backend error, got %v", err)
+	}
+
+	if err := s.SetKeyBackend(backend, []string{"["}); err == nil {
+		t.Error("Expected an invalid pattern error")
+	}
+}
+
+func TestKeyBackendOperations(t *testing.T) {
+	s, _ := newBackendTestStorage(t)
+
+	encrypt := createBackendTestKey(t, s, "hsm-encrypt", kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, nil)
+	ciphertext, _, level, err := s.Encrypt(backendTestRing+"/cryptoKeys/hsm-encrypt", []byte("secret"), []byte("aad"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if level != kmspb.ProtectionLevel_HSM {
+		t.Errorf("Expected a backend version to report HSM, got %s", level)
+	}
+	plaintext, _, level, err := s.Decrypt(backendTestRing+"/cryptoKeys/hsm-encrypt", ciphertext, []byte("aad"))
+	if err != nil || string(plaintext) != "secret" || level != kmspb.ProtectionLevel_HSM {
+		t.Fatalf("Decrypt returned %q, %s, %v", plaintext, level, err)
+	}
+	if encrypt.SymmetricKey != nil {
+		t.Error("Expected no key material in the emulator")
+	}
+
+	sign := createBackendTestKey(t, s, "hsm-sign", kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256, nil)
+	pub, ok := publicKeyOf(t, s, sign.Name).(*ecdsa.PublicKey)
+	if !ok {
+		t.Fatal("Expected an ECDSA public key")
+	}
+	digest := sha256.Sum256([]byte("message"))
+	signature, _, err := s.AsymmetricSign(sign.Name, &kmspb.Digest{Digest: &kmspb.Digest_Sha256{Sha256: digest[:]}}, nil)
+	if err != nil {
+		t.Fatalf("AsymmetricSign failed: %v", err)
+	}
+	if !ecdsa.VerifyASN1(pub, digest[:], signature) {
+		t.Error("Signature does not verify")
+	}
+
+	decrypt := createBackendTestKey(t, s, "hsm-decrypt", kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_2048_SHA256, nil)
+	rsaPub := publicKeyOf(t, s, decrypt.Name).(*rsa.PublicKey)
+	ciphertext, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaPub, []byte("secret"), nil)
+	if err != nil {
+		t.Fatalf("EncryptOAEP failed: %v", err)
+	}
+	plaintext, _, err = s.AsymmetricDecrypt(decrypt.Name, ciphertext)
+	if err != nil || string(plaintext) != "secret" {
+		t.Fatalf("AsymmetricDecrypt returned %q, %v", plaintext, err)
+	}
+
+	mac := createBackendTestKey(t, s, "hsm-mac", kmspb.CryptoKeyVersion_HMAC_SHA256, nil)
+	tag, _, err := s.MacSign(mac.Name, []byte("data"))
+	if err != nil {
+		t.Fatalf("MacSign failed: %v", err)
+	}
+	if ok, _, err := s.MacVerify(mac.Name, []byte("data"), tag); err != nil || !ok {
+		t.Errorf("MacVerify returned %v, %v", ok, err)
+	}
+
+	if _, err := s.ExportSymmetricVersions(backendTestRing + "/cryptoKeys/hsm-encrypt"); err == nil {
+		t.Error("Expected exporting backend key material to fail")
+	}
+}
+
+func TestKeyBackendStateAndDestroy(t *testing.T) {
+	s, backend := newBackendTestStorage(t)
+	version := createBackendTestKey(t, s, "hsm-key", kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, nil)
+	ciphertext, _, _, err := s.Encrypt(backendTestRing+"/cryptoKeys/hsm-key", []byte("secret"), nil)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.SaveState(&buf); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	state := buf.Bytes()
+
+	loaded := NewStorage()
+	if err := loaded.SetKeyBackend(backend, nil); err != nil {
+		t.Fatalf("SetKeyBackend failed: %v", err)
+	}
+	if _, err := loaded.LoadState(bytes.NewReader(state)); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	plaintext, _, _, err := loaded.Decrypt(backendTestRing+"/cryptoKeys/hsm-key", ciphertext, nil)
+	if err != nil || string(plaintext) != "secret" {
+		t.Fatalf("Decrypt after LoadState returned %q, %v", plaintext, err)
+	}
+
+	// Without the backend the version's key is unavailable
+	unconfigured := NewStorage()
+	if _, err := unconfigured.LoadState(bytes.NewReader(state)); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	if _, _, _, err := unconfigured.Decrypt(backendTestRing+"/cryptoKeys/hsm-key", ciphertext, nil); err == nil {
+		t.Error("Expected Decrypt without the backend to fail")
+	}
+
+	s.SetDestroyScheduledDuration(0)
+	if _, err := s.DestroyCryptoKeyVersion(version.Name); err != nil {
+		t.Fatalf("DestroyCryptoKeyVersion failed: %v", err)
+	}
+	if len(backend.destroyed) != 1 || backend.destroyed[0] != version.Name {
+		t.Errorf("Expected the backend key to be destroyed, got %v", backend.destroyed)
+	}
+}
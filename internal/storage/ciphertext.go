@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ciphertextMagic starts the ciphertexts Encrypt produces. It is followed by
+// the ID of the version that encrypted the data as a uvarint, then the
+// AES-GCM nonce and sealed data. Like Cloud KMS ciphertexts, this lets
+// Decrypt name the version it needs rather than trying each one.
+//
+// Ciphertexts without the header, written by earlier releases, are still
+// decrypted by trying every enabled version.
+var ciphertextMagic = []byte("\x00kms\x01")
+
+// sealCiphertext prepends the header naming versionName to sealed
+func sealCiphertext(versionName string, sealed []byte) []byte {
+	id, _ := strconv.ParseUint(versionName[strings.LastIndex(versionName, "/")+1:], 10, 64)
+	out := make([]byte, 0, len(ciphertextMagic)+binary.MaxVarintLen64+len(sealed))
+	out = append(out, ciphertextMagic...)
+	out = binary.AppendUvarint(out, id)
+	return append(out, sealed...)
+}
+
+// openCiphertext splits a ciphertext produced by sealCiphertext into the name
+// of the version of keyName that produced it and the sealed data. ok is false
+// for ciphertexts without a header.
+func openCiphertext(keyName string, ciphertext []byte) (versionName string, sealed []byte, ok bool) {
+	rest, ok := bytes.CutPrefix(ciphertext, ciphertextMagic)
+	if !ok {
+		return "", nil, false
+	}
+	id, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return "", nil, false
+	}
+	return fmt.Sprintf("%s/cryptoKeyVersions/%d", keyName, id), rest[n:], true
+}
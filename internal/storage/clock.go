@@ -0,0 +1,49 @@
+package storage
+
+import "time"
+
+// With a frozen clock, every timestamp Storage records (create, generate,
+// import and destroy times) is the frozen time, so responses are byte-stable
+// for golden tests. The clock stands still: versions scheduled for
+// destruction are destroyed only with a destroy-scheduled duration of 0, and
+// import jobs created while frozen never expire.
+
+// SetFrozenTime freezes the clock at t. The zero time lets it run again.
+func (s *Storage) SetFrozenTime(t time.Time) {
+	if t.IsZero() {
+		s.frozenTime.Store(nil)
+		return
+	}
+	t = t.UTC()
+	s.frozenTime.Store(&t)
+}
+
+// FrozenTime returns the time the clock is frozen at, or the zero time
+func (s *Storage) FrozenTime() time.Time {
+	if t := s.frozenTime.Load(); t != nil {
+		return *t
+	}
+	return time.Time{}
+}
+
+// SetClock makes Storage read the time from now instead of time.Now, for
+// tests that control the time; nil goes back to time.Now. A frozen time
+// still wins over the clock.
+func (s *Storage) SetClock(now func() time.Time) {
+	if now == nil {
+		s.clock.Store(nil)
+		return
+	}
+	s.clock.Store(&now)
+}
+
+// now returns the time to record, the frozen time if the clock is frozen
+func (s *Storage) now() time.Time {
+	if t := s.frozenTime.Load(); t != nil {
+		return *t
+	}
+	if clock := s.clock.Load(); clock != nil {
+		return (*clock)()
+	}
+	return time.Now()
+}
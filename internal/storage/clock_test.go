@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+func TestFrozenTime(t *testing.T) {
+	frozen := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := NewStorage()
+	s.SetFrozenTime(frozen)
+	if !s.FrozenTime().Equal(frozen) {
+		t.Fatalf("FrozenTime = %v, expected %v", s.FrozenTime(), frozen)
+	}
+	s.SetDestroyScheduledDuration(time.Hour)
+
+	ring, err := s.CreateKeyRing(viewTestRing)
+	if err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	key, err := s.CreateCryptoKey(viewTestRing, "key1", kmspb.CryptoKey_ENCRYPT_DECRYPT, nil, nil)
+	if err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+	version, err := s.CreateCryptoKeyVersion(viewTestKey)
+	if err != nil {
+		t.Fatalf("CreateCryptoKeyVersion failed: %v", err)
+	}
+	for name, got := range map[string]time.Time{
+		"key ring":     ring.CreateTime.AsTime(),
+		"crypto key":   key.CreateTime.AsTime(),
+		"version":      version.CreateTime.AsTime(),
+		"generateTime": version.GenerateTime.AsTime(),
+	} {
+		if !got.Equal(frozen) {
+			t.Errorf("%s time = %v, expected %v", name, got, frozen)
+		}
+	}
+
+	// The clock stands still, so scheduled destruction does not come due
+	destroyed, err := s.DestroyCryptoKeyVersion(version.Name)
+	if err != nil {
+		t.Fatalf("DestroyCryptoKeyVersion failed: %v", err)
+	}
+	if want := frozen.Add(time.Hour); !destroyed.DestroyTime.AsTime().Equal(want) {
+		t.Errorf("DestroyTime = %v, expected %v", destroyed.DestroyTime.AsTime(), want)
+	}
+	if n := s.DestroyDue(s.now()); n != 0 {
+		t.Errorf("DestroyDue destroyed %d versions, expected none", n)
+	}
+
+	s.SetFrozenTime(time.Time{})
+	if !s.FrozenTime().IsZero() {
+		t.Error("Expected the clock to run again")
+	}
+	if n := s.DestroyDue(s.now()); n != 1 {
+		t.Errorf("DestroyDue destroyed %d versions, expected 1", n)
+	}
+}
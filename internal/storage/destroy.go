@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+// DefaultDestroyScheduledDuration is how long a version stays
+// DESTROY_SCHEDULED before it is destroyed, the Cloud KMS default
+const DefaultDestroyScheduledDuration = 30 * 24 * time.Hour
+
+// DestroyCheckInterval is how often StartDestroyer looks for versions due
+// for destruction
+const DestroyCheckInterval = time.Second
+
+// SetDestroyScheduledDuration sets how long DestroyCryptoKeyVersion leaves
+// versions DESTROY_SCHEDULED. With 0, versions are destroyed at once.
+func (s *Storage) SetDestroyScheduledDuration(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.destroyScheduledDuration = d
+}
+
+// destroy moves v to DESTROYED and wipes its key material. The bytes are
+// zeroed in place, so no copy outlives the version; snapshots, saved state
+// and published read views hold copies of their own, and a read view's copy
+// is dropped once a later view replaces it.
+func (v *StoredCryptoKeyVersion) destroy(now time.Time) {
+	clear(v.SymmetricKey)
+	clear(v.PrivateKey)
+	v.SymmetricKey, v.PrivateKey = nil, nil
+	v.State = kmspb.CryptoKeyVersion_DESTROYED
+	v.DestroyEventTime = now
+}
+
+// DestroyDue destroys the DESTROY_SCHEDULED versions whose destroy time is
+// not after now and returns how many it destroyed
+func (s *Storage) DestroyDue(now time.Time) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	destroyed := 0
+	for _, keyring := range s.keyrings {
+		// Keyrings with nothing due are only read-locked, so that checks
+		// finding nothing do not block other calls
+		if !destroyDue(keyring, now) {
+			continue
+		}
+		keyring.mu.Lock()
+		for _, cryptoKey := range keyring.CryptoKeys {
+			for _, version := range cryptoKey.Versions {
+				if version.State == kmspb.CryptoKeyVersion_DESTROY_SCHEDULED && !version.DestroyTime.After(now) {
+					version.destroy(now)
+					s.destroyBackendKey(version)
+					destroyed++
+				}
+			}
+		}
+		s.publishKeyRing(keyring)
+		keyring.mu.Unlock()
+	}
+	return destroyed
+}
+
+// destroyDue reports whether any version in keyring is due for destruction
+func destroyDue(keyring *StoredKeyRing, now time.Time) bool {
+	keyring.mu.RLock()
+	defer keyring.mu.RUnlock()
+	for _, cryptoKey := range keyring.CryptoKeys {
+		for _, version := range cryptoKey.Versions {
+			if version.State == kmspb.CryptoKeyVersion_DESTROY_SCHEDULED && !version.DestroyTime.After(now) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// StartDestroyer destroys versions as their scheduled destruction comes due,
+// checking every interval until ctx is cancelled
+func (s *Storage) StartDestroyer(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.DestroyDue(s.now())
+			}
+		}
+	}()
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+const destroyTestKey = "projects/test/locations/global/keyRings/ring1/cryptoKeys/key1"
+
+// newDestroyTestStorage returns storage holding a symmetric key and a
+// ciphertext of its first version
+func newDestroyTestStorage(t *testing.T) (*Storage, *StoredCryptoKeyVersion, []byte) {
+	t.Helper()
+	s := NewStorage()
+	if _, err := s.CreateKeyRing("projects/test/locations/global/keyRings/ring1"); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	if _, err := s.CreateCryptoKey("projects/test/locations/global/keyRings/ring1", "key1", kmspb.CryptoKey_ENCRYPT_DECRYPT, nil, nil); err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+	ciphertext, _, _, err := s.Encrypt(destroyTestKey, []byte("secret"), nil)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	version := s.keyrings["projects/test/locations/global/keyRings/ring1"].CryptoKeys[destroyTestKey].Versions[destroyTestKey+"/cryptoKeyVersions/1"]
+	return s, version, ciphertext
+}
+
+func TestDestroyWipesKeyMaterial(t *testing.T) {
+	s, version, ciphertext := newDestroyTestStorage(t)
+	s.SetDestroyScheduledDuration(0)
+	if _, err := s.SaveSnapshot("before"); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	material := version.SymmetricKey
+
+	v, err := s.DestroyCryptoKeyVersion(version.Name)
+	if err != nil || v.State != kmspb.CryptoKeyVersion_DESTROYED {
+		t.Fatalf("DestroyCryptoKeyVersion = %v, %v", v, err)
+	}
+	if version.SymmetricKey != nil || !bytes.Equal(material, make([]byte, len(material))) {
+		t.Error("Expected the key material to be zeroed and dropped")
+	}
+	if version.DestroyEventTime.IsZero() {
+		t.Error("Expected the destroy event time to be recorded")
+	}
+	if _, _, _, err := s.Decrypt(destroyTestKey, ciphertext, nil); err == nil {
+		t.Error("Expected Decrypt with the destroyed version to fail")
+	}
+	if _, err := s.UpdateCryptoKeyVersion(version.Name, kmspb.CryptoKeyVersion_ENABLED, ""); err == nil || !strings.Contains(err.Error(), "cannot be updated") {
+		t.Errorf("Expected the destroyed version to stay destroyed, got %v", err)
+	}
+
+	var state bytes.Buffer
+	if err := s.SaveState(&state); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	if strings.Contains(state.String(), "symmetricKey") {
+		t.Error("Expected saved state to hold no material for the destroyed version")
+	}
+
+	// Snapshots are copies, so one taken before destruction still decrypts
+	if _, err := s.RestoreSnapshot("before"); err != nil {
+		t.Fatalf("RestoreSnapshot failed: %v", err)
+	}
+	if plaintext, _, _, err := s.Decrypt(destroyTestKey, ciphertext, nil); err != nil || string(plaintext) != "secret" {
+		t.Errorf("Decrypt after restoring the snapshot = %q, %v", plaintext, err)
+	}
+}
+
+func TestDestroyDue(t *testing.T) {
+	s, version, _ := newDestroyTestStorage(t)
+	s.SetDestroyScheduledDuration(time.Hour)
+
+	v, err := s.DestroyCryptoKeyVersion(version.Name)
+	if err != nil || v.State != kmspb.CryptoKeyVersion_DESTROY_SCHEDULED {
+		t.Fatalf("DestroyCryptoKeyVersion = %v, %v", v, err)
+	}
+	if n := s.DestroyDue(time.Now()); n != 0 || version.SymmetricKey == nil {
+		t.Errorf("Expected nothing to be due yet, destroyed %d", n)
+	}
+	if n := s.DestroyDue(time.Now().Add(2 * time.Hour)); n != 1 || version.State != kmspb.CryptoKeyVersion_DESTROYED || version.SymmetricKey != nil {
+		t.Errorf("Expected the version to be destroyed, destroyed %d (state %s)", n, version.State)
+	}
+
+	// Restored versions are no longer due
+	s2, version2, ciphertext := newDestroyTestStorage(t)
+	s2.SetDestroyScheduledDuration(time.Hour)
+	if _, err := s2.DestroyCryptoKeyVersion(version2.Name); err != nil {
+		t.Fatalf("DestroyCryptoKeyVersion failed: %v", err)
+	}
+	if _, err := s2.RestoreCryptoKeyVersion(version2.Name); err != nil {
+		t.Fatalf("RestoreCryptoKeyVersion failed: %v", err)
+	}
+	if n := s2.DestroyDue(time.Now().Add(2 * time.Hour)); n != 0 {
+		t.Errorf("Expected the restored version not to be destroyed, destroyed %d", n)
+	}
+	if _, err := s2.UpdateCryptoKeyVersion(version2.Name, kmspb.CryptoKeyVersion_ENABLED, ""); err != nil {
+		t.Fatalf("UpdateCryptoKeyVersion failed: %v", err)
+	}
+	if plaintext, _, _, err := s2.Decrypt(destroyTestKey, ciphertext, nil); err != nil || string(plaintext) != "secret" {
+		t.Errorf("Decrypt = %q, %v", plaintext, err)
+	}
+}
+
+func TestLoadStateDropsDestroyedMaterial(t *testing.T) {
+	s, version, _ := newDestroyTestStorage(t)
+	var state bytes.Buffer
+	if err := s.SaveState(&state); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	doc := regexp.MustCompile(`"state":\s*"ENABLED"`).ReplaceAllString(state.String(), `"state": "DESTROYED"`)
+
+	loaded := NewStorage()
+	if _, err := loaded.LoadState(strings.NewReader(doc)); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	v := loaded.keyrings["projects/test/locations/global/keyRings/ring1"].CryptoKeys[destroyTestKey].Versions[version.Name]
+	if v.State != kmspb.CryptoKeyVersion_DESTROYED || v.SymmetricKey != nil {
+		t.Errorf("Expected a destroyed version without material, got state %s with %d key bytes", v.State, len(v.SymmetricKey))
+	}
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+func TestDeterministicEncryption(t *testing.T) {
+	s := newViewTestStorage(t)
+	labelled := viewTestRing + "/cryptoKeys/golden"
+	if _, err := s.CreateCryptoKey(viewTestRing, "golden", kmspb.CryptoKey_ENCRYPT_DECRYPT, nil, map[string]string{EncryptionLabel: EncryptionDeterministic}); err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+
+	first, _, _, err := s.Encrypt(labelled, []byte("secret"), []byte("aad"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	second, _, _, err := s.Encrypt(labelled, []byte("secret"), []byte("aad"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Error("Expected the labelled key to encrypt deterministically")
+	}
+	if other, _, _, _ := s.Encrypt(labelled, []byte("secret"), []byte("other aad")); bytes.Equal(first, other) {
+		t.Error("Expected different AAD to give a different ciphertext")
+	}
+	if plaintext, _, _, err := s.Decrypt(labelled, first, []byte("aad")); err != nil || string(plaintext) != "secret" {
+		t.Errorf("Decrypt = %q, %v", plaintext, err)
+	}
+	if _, _, _, err := s.Decrypt(labelled, first, []byte("other aad")); err == nil {
+		t.Error("Expected Decrypt with the wrong AAD to fail")
+	}
+
+	// Unlabelled keys stay randomized until the global switch
+	a, _, _, _ := s.Encrypt(viewTestKey, []byte("secret"), nil)
+	b, _, _, _ := s.Encrypt(viewTestKey, []byte("secret"), nil)
+	if bytes.Equal(a, b) {
+		t.Error("Expected an unlabelled key to encrypt with random nonces")
+	}
+	s.SetDeterministicEncryption(true)
+	if !s.DeterministicEncryption() {
+		t.Fatal("Expected deterministic encryption to be on")
+	}
+	c, _, _, _ := s.Encrypt(viewTestKey, []byte("secret"), nil)
+	d, _, _, _ := s.Encrypt(viewTestKey, []byte("secret"), nil)
+	if !bytes.Equal(c, d) {
+		t.Error("Expected every key to encrypt deterministically")
+	}
+
+	// Ciphertexts of both kinds decrypt whatever the setting
+	s.SetDeterministicEncryption(false)
+	for _, ciphertext := range [][]byte{a, c} {
+		if plaintext, _, _, err := s.Decrypt(viewTestKey, ciphertext, nil); err != nil || string(plaintext) != "secret" {
+			t.Errorf("Decrypt = %q, %v", plaintext, err)
+		}
+	}
+}
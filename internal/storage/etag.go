@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ETag returns the etag of a resource's API representation. It changes
+// whenever any field of the representation does, so a client holding an
+// etag can tell whether the resource was changed since it read it.
+func ETag(m proto.Message) string {
+	b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// checkETag fails if etag is set and is not the etag of current, the
+// resource name is about to update
+func checkETag(name, etag string, current proto.Message) error {
+	if etag == "" || etag == ETag(current) {
+		return nil
+	}
+	return fmt.Errorf("etag %s of %s is stale: the resource has been modified", etag, name)
+}
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+func TestETagPreconditions(t *testing.T) {
+	s, version, _ := newDestroyTestStorage(t)
+	key, err := s.GetCryptoKey(destroyTestKey)
+	if err != nil {
+		t.Fatalf("GetCryptoKey failed: %v", err)
+	}
+	keyETag := ETag(key)
+	versionETag := ETag(versionProto(version))
+
+	updated, err := s.UpdateCryptoKeyVersion(version.Name, kmspb.CryptoKeyVersion_DISABLED, versionETag)
+	if err != nil {
+		t.Fatalf("UpdateCryptoKeyVersion with the current etag failed: %v", err)
+	}
+	if ETag(updated) == versionETag {
+		t.Error("Expected the etag to change with the state")
+	}
+	if _, err := s.UpdateCryptoKeyVersion(version.Name, kmspb.CryptoKeyVersion_ENABLED, versionETag); err == nil || !strings.Contains(err.Error(), "is stale") {
+		t.Errorf("Expected a stale etag to be rejected, got %v", err)
+	}
+	if version.State != kmspb.CryptoKeyVersion_DISABLED {
+		t.Errorf("Expected the rejected update to leave the version DISABLED, got %s", version.State)
+	}
+
+	// The primary is part of the key, so disabling it changed the key too
+	update := &kmspb.CryptoKey{Labels: map[string]string{"env": "test"}}
+	if _, err := s.UpdateCryptoKey(destroyTestKey, update, []string{"labels"}, keyETag); err == nil || !strings.Contains(err.Error(), "is stale") {
+		t.Errorf("Expected a stale etag to be rejected, got %v", err)
+	}
+	if key, err = s.GetCryptoKey(destroyTestKey); err != nil {
+		t.Fatalf("GetCryptoKey failed: %v", err)
+	}
+	if _, err := s.UpdateCryptoKey(destroyTestKey, update, []string{"labels"}, ETag(key)); err != nil {
+		t.Errorf("UpdateCryptoKey with the current etag failed: %v", err)
+	}
+	if _, err := s.UpdateCryptoKey(destroyTestKey, update, []string{"labels"}, ""); err != nil {
+		t.Errorf("UpdateCryptoKey without an etag failed: %v", err)
+	}
+}
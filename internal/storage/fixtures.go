@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+// Fixtures is a manifest of key versions created with operator-supplied key
+// material, so ciphertexts, signatures and MACs made with them stay valid
+// across environments:
+//
+//	{
+//	  "versions": [
+//	    {
+//	      "name": "projects/p/locations/global/keyRings/ring/cryptoKeys/golden/cryptoKeyVersions/1",
+//	      "algorithm": "GOOGLE_SYMMETRIC_ENCRYPTION",
+//	      "key": "base64 AES-256 key"
+//	    },
+//	    {
+//	      "name": "projects/p/locations/global/keyRings/ring/cryptoKeys/signer/cryptoKeyVersions/1",
+//	      "algorithm": "EC_SIGN_P256_SHA256",
+//	      "keyFile": "signer.pem"
+//	    }
+//	  ]
+//	}
+//
+// Key rings and keys are created as needed, with the purpose of the
+// algorithm. Symmetric and HMAC keys are raw bytes; private keys are PEM
+// (PKCS#8, PKCS#1 or SEC 1) or PKCS#8 DER.
+type Fixtures struct {
+	Versions []FixtureVersion `json:"versions"`
+}
+
+// FixtureVersion is one key version in a Fixtures manifest
+type FixtureVersion struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm"`
+	// Key is raw key material, base64 encoded in JSON
+	Key []byte `json:"key,omitempty"`
+	// PrivateKeyPEM is a PEM private key given inline
+	PrivateKeyPEM string `json:"privateKeyPem,omitempty"`
+	// KeyFile is a file holding the key material, relative to the manifest
+	KeyFile string `json:"keyFile,omitempty"`
+	// State is ENABLED (the default) or DISABLED
+	State string `json:"state,omitempty"`
+	// Primary makes the version its key's primary. Otherwise the first
+	// version listed for a new key is. Only ENCRYPT_DECRYPT keys have a
+	// primary version.
+	Primary bool `json:"primary,omitempty"`
+	// Labels are set on the key when it is created
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// versionNamePattern matches crypto key version names and captures the key,
+// key ring and version ID
+var versionNamePattern = regexp.MustCompile(`^((projects/[^/]+/locations/[^/]+/keyRings/[^/]+)/cryptoKeys/[^/]+)/cryptoKeyVersions/([1-9][0-9]*)$`)
+
+// ReadFixtures reads a manifest and the key files it names
+func ReadFixtures(path string) (Fixtures, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Fixtures{}, err
+	}
+	var f Fixtures
+	if err := json.Unmarshal(data, &f); err != nil {
+		return Fixtures{}, fmt.Errorf("invalid fixtures %s: %w", path, err)
+	}
+	for i := range f.Versions {
+		v := &f.Versions[i]
+		if v.KeyFile == "" {
+			continue
+		}
+		keyPath := v.KeyFile
+		if !filepath.IsAbs(keyPath) {
+			keyPath = filepath.Join(filepath.Dir(path), keyPath)
+		}
+		if v.Key, err = os.ReadFile(keyPath); err != nil {
+			return Fixtures{}, fmt.Errorf("invalid fixture %s: %w", v.Name, err)
+		}
+		v.KeyFile = ""
+	}
+	return f, nil
+}
+
+// LoadFixtures creates the versions in f, with their key rings and keys if
+// needed, and returns how many versions were created. Versions that already
+// exist with the same key material are left alone, so fixtures can be loaded
+// on top of restored state; any other conflict fails without changes.
+func (s *Storage) LoadFixtures(f Fixtures) (int, error) {
+	versions := make([]*StoredCryptoKeyVersion, len(f.Versions))
+	for i, fv := range f.Versions {
+		v, err := fixtureVersion(fv)
+		if err != nil {
+			return 0, fmt.Errorf("invalid fixture %s: %w", fv.Name, err)
+		}
+		versions[i] = v
+	}
+
+	defer s.lockAll()()
+
+	// Check every version before changing anything
+	keyrings := cloneKeyRings(s.keyrings)
+	created := 0
+	now := s.now()
+	for i, v := range versions {
+		fv := f.Versions[i]
+		m := versionNamePattern.FindStringSubmatch(v.Name)
+		keyName, ringName := m[1], m[2]
+		id, _ := strconv.ParseInt(m[3], 10, 64)
+		purpose, _ := AlgorithmPurpose(v.Algorithm)
+
+		ring, ok := keyrings[ringName]
+		if !ok {
+			ring = &StoredKeyRing{
+				Name:       ringName,
+				CreateTime: now,
+				CryptoKeys: make(map[string]*StoredCryptoKey),
+				ImportJobs: make(map[string]*StoredImportJob),
+			}
+			keyrings[ringName] = ring
+		}
+		key, ok := ring.CryptoKeys[keyName]
+		if !ok {
+			key = &StoredCryptoKey{
+				Name:            keyName,
+				CreateTime:      now,
+				Purpose:         purpose,
+				Versions:        make(map[string]*StoredCryptoKeyVersion),
+				NextVersionID:   1,
+				VersionTemplate: &kmspb.CryptoKeyVersionTemplate{Algorithm: v.Algorithm},
+				Labels:          fv.Labels,
+			}
+			if HasPrimaryVersion(purpose) {
+				key.PrimaryVersion = v.Name
+			}
+			ring.CryptoKeys[keyName] = key
+		} else if key.Purpose != purpose {
+			return 0, fmt.Errorf("algorithm %s of fixture %s is not valid for purpose %s", v.Algorithm, v.Name, key.Purpose)
+		}
+
+		if existing, ok := key.Versions[v.Name]; ok {
+			if existing.Algorithm != v.Algorithm || !bytes.Equal(existing.SymmetricKey, v.SymmetricKey) || !bytes.Equal(existing.PrivateKey, v.PrivateKey) {
+				return 0, fmt.Errorf("crypto key version already exists with different key material: %s", v.Name)
+			}
+			continue
+		}
+		v.CreateTime = now
+		key.Versions[v.Name] = v
+		key.NextVersionID = max(key.NextVersionID, id+1)
+		if fv.Primary && HasPrimaryVersion(purpose) {
+			key.PrimaryVersion = v.Name
+		}
+		created++
+	}
+
+	s.keyrings = keyrings
+	return created, nil
+}
+
+// fixtureVersion checks a fixture and returns the version it describes
+func fixtureVersion(fv FixtureVersion) (*StoredCryptoKeyVersion, error) {
+	if !versionNamePattern.MatchString(fv.Name) {
+		return nil, errors.New("name is not valid for a crypto key version")
+	}
+	algorithm := kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm(kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm_value[fv.Algorithm])
+	if _, ok := algorithms[algorithm]; !ok {
+		return nil, fmt.Errorf("algorithm %q is not valid for fixtures", fv.Algorithm)
+	}
+
+	state := kmspb.CryptoKeyVersion_ENABLED
+	switch fv.State {
+	case "", "ENABLED":
+	case "DISABLED":
+		state = kmspb.CryptoKeyVersion_DISABLED
+	default:
+		return nil, fmt.Errorf("state %q is not valid for fixtures", fv.State)
+	}
+
+	material := fv.Key
+	switch {
+	case fv.KeyFile != "":
+		return nil, errors.New("keyFile is not valid here; give the key inline")
+	case fv.PrivateKeyPEM != "" && len(material) > 0:
+		return nil, errors.New("key and privateKeyPem are mutually exclusive")
+	case fv.PrivateKeyPEM != "":
+		material = []byte(fv.PrivateKeyPEM)
+	case len(material) == 0:
+		return nil, errors.New("key material is required")
+	}
+	if algorithms[algorithm].keyBytes == 0 {
+		der, err := pkcs8FromPEM(material)
+		if err != nil {
+			return nil, err
+		}
+		material = der
+	}
+
+	symmetricKey, privateKey, err := importKeyMaterial(algorithm, material)
+	if err != nil {
+		return nil, err
+	}
+	return &StoredCryptoKeyVersion{
+		Name:         fv.Name,
+		State:        state,
+		Algorithm:    algorithm,
+		SymmetricKey: symmetricKey,
+		PrivateKey:   privateKey,
+	}, nil
+}
+
+// pkcs8FromPEM converts a PEM private key to PKCS#8 DER. Data that is not
+// PEM is returned as is.
+func pkcs8FromPEM(data []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return data, nil
+	}
+
+	var key any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		return block.Bytes, nil
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("PEM block %q is not a private key", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return x509.MarshalPKCS8PrivateKey(key)
+}
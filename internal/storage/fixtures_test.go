@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+const goldenRing = "projects/test/locations/global/keyRings/golden"
+
+func loadTestFixtures(t *testing.T) *Storage {
+	t.Helper()
+	f, err := ReadFixtures("testdata/fixtures.json")
+	if err != nil {
+		t.Fatalf("ReadFixtures failed: %v", err)
+	}
+	s := NewStorage()
+	if n, err := s.LoadFixtures(f); err != nil || n != 3 {
+		t.Fatalf("LoadFixtures created %d versions: %v", n, err)
+	}
+	return s
+}
+
+func TestLoadFixtures(t *testing.T) {
+	a, b := loadTestFixtures(t), loadTestFixtures(t)
+
+	// Material is the same in every environment
+	ciphertext, _, _, err := a.Encrypt(goldenRing+"/cryptoKeys/enc", []byte("golden"), nil)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if plaintext, _, _, err := b.Decrypt(goldenRing+"/cryptoKeys/enc", ciphertext, nil); err != nil || string(plaintext) != "golden" {
+		t.Errorf("Expected the other storage to decrypt, got %q: %v", plaintext, err)
+	}
+	signer := goldenRing + "/cryptoKeys/signer/cryptoKeyVersions/1"
+	signature, _, err := a.AsymmetricSign(signer, nil, []byte("document"))
+	if err != nil {
+		t.Fatalf("AsymmetricSign failed: %v", err)
+	}
+	pub, err := b.GetPublicKey(signer)
+	if err != nil {
+		t.Fatalf("GetPublicKey failed: %v", err)
+	}
+	if err := VerifySignature(kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256, pub.Pem, []byte("document"), signature); err != nil {
+		t.Errorf("Expected the signature to verify: %v", err)
+	}
+
+	key, err := a.GetCryptoKey(goldenRing + "/cryptoKeys/enc")
+	if err != nil {
+		t.Fatalf("GetCryptoKey failed: %v", err)
+	}
+	if key.Primary.GetName() != goldenRing+"/cryptoKeys/enc/cryptoKeyVersions/1" {
+		t.Errorf("Expected the first version to be primary, got %s", key.Primary.GetName())
+	}
+	if v, err := a.GetCryptoKeyVersion(goldenRing + "/cryptoKeys/enc/cryptoKeyVersions/3"); err != nil || v.State != kmspb.CryptoKeyVersion_DISABLED {
+		t.Errorf("Expected version 3 to be disabled, got %v: %v", v, err)
+	}
+	next, err := a.CreateCryptoKeyVersion(goldenRing + "/cryptoKeys/enc")
+	if err != nil || !strings.HasSuffix(next.Name, "/cryptoKeyVersions/4") {
+		t.Errorf("Expected new versions to follow the fixtures, got %v: %v", next, err)
+	}
+	if key, _ := a.GetCryptoKey(goldenRing + "/cryptoKeys/signer"); key.Labels["env"] != "test" {
+		t.Errorf("Expected the fixture labels, got %v", key.Labels)
+	}
+}
+
+func TestLoadFixturesAgain(t *testing.T) {
+	s := loadTestFixtures(t)
+	f, err := ReadFixtures("testdata/fixtures.json")
+	if err != nil {
+		t.Fatalf("ReadFixtures failed: %v", err)
+	}
+	if n, err := s.LoadFixtures(f); err != nil || n != 0 {
+		t.Errorf("Expected loading the same fixtures again to create nothing, got %d: %v", n, err)
+	}
+
+	f.Versions[0].Key = make([]byte, 32)
+	f.Versions = append(f.Versions, FixtureVersion{
+		Name:      goldenRing + "/cryptoKeys/new/cryptoKeyVersions/1",
+		Algorithm: "HMAC_SHA256",
+		Key:       make([]byte, 32),
+	})
+	if _, err := s.LoadFixtures(f); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("Expected a conflict for different key material, got %v", err)
+	}
+	if _, err := s.GetCryptoKey(goldenRing + "/cryptoKeys/new"); err == nil {
+		t.Error("Expected a failed load to change nothing")
+	}
+}
+
+func TestLoadFixturesInvalid(t *testing.T) {
+	ecKey, err := os.ReadFile("testdata/fixture-signer.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := goldenRing + "/cryptoKeys/k/cryptoKeyVersions/1"
+	tests := []struct {
+		desc string
+		fv   FixtureVersion
+	}{
+		{"bad name", FixtureVersion{Name: goldenRing + "/cryptoKeys/k", Algorithm: "HMAC_SHA256", Key: make([]byte, 32)}},
+		{"version 0", FixtureVersion{Name: goldenRing + "/cryptoKeys/k/cryptoKeyVersions/0", Algorithm: "HMAC_SHA256", Key: make([]byte, 32)}},
+		{"bad algorithm", FixtureVersion{Name: name, Algorithm: "AES_999", Key: make([]byte, 32)}},
+		{"short key", FixtureVersion{Name: name, Algorithm: "HMAC_SHA256", Key: make([]byte, 16)}},
+		{"no key", FixtureVersion{Name: name, Algorithm: "HMAC_SHA256"}},
+		{"bad state", FixtureVersion{Name: name, Algorithm: "HMAC_SHA256", Key: make([]byte, 32), State: "DESTROYED"}},
+		{"unread key file", FixtureVersion{Name: name, Algorithm: "HMAC_SHA256", KeyFile: "/etc/passwd"}},
+		{"wrong key type", FixtureVersion{Name: name, Algorithm: "RSA_SIGN_PSS_2048_SHA256", PrivateKeyPEM: string(ecKey)}},
+		{"not a private key", FixtureVersion{Name: name, Algorithm: "EC_SIGN_P256_SHA256", PrivateKeyPEM: "-----BEGIN PUBLIC KEY-----\nAAAA\n-----END PUBLIC KEY-----\n"}},
+	}
+	for _, tt := range tests {
+		if _, err := NewStorage().LoadFixtures(Fixtures{Versions: []FixtureVersion{tt.fv}}); err == nil {
+			t.Errorf("%s: expected an error", tt.desc)
+		}
+	}
+
+	s := NewStorage()
+	if _, err := s.LoadFixtures(Fixtures{Versions: []FixtureVersion{
+		{Name: name, Algorithm: "HMAC_SHA256", Key: make([]byte, 32)},
+		{Name: goldenRing + "/cryptoKeys/k/cryptoKeyVersions/2", Algorithm: "GOOGLE_SYMMETRIC_ENCRYPTION", Key: make([]byte, 32)},
+	}}); err == nil || !strings.Contains(err.Error(), "not valid for purpose") {
+		t.Errorf("Expected mixed purposes to fail, got %v", err)
+	}
+}
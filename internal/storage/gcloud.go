@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	keyRingNamePattern   = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+$`)
+	cryptoKeyNamePattern = regexp.MustCompile(`^(projects/[^/]+/locations/[^/]+/keyRings/[^/]+)/cryptoKeys/[^/]+$`)
+)
+
+// ReadGCloudExports reads the JSON output of gcloud kms list and describe
+// commands, such as
+//
+//	gcloud kms keyrings list --location us-east1 --format=json
+//	gcloud kms keys list --keyring ring --location us-east1 --format=json
+//	gcloud kms keys versions list --key key --keyring ring --location us-east1 --format=json
+//
+// and returns the key rings they describe, for LoadMirror. Each file holds a
+// list of resources or a single one, of any kind; they are told apart by
+// name. Key rings only named by their keys are added, and a key without
+// listed versions gets its primary version, so keys list output alone is
+// enough for symmetric keys.
+func ReadGCloudExports(paths ...string) ([]MirroredKeyRing, error) {
+	rings := make(map[string]*kmspb.KeyRing)
+	keys := make(map[string]*kmspb.CryptoKey)
+	versions := make(map[string]map[string]*kmspb.CryptoKeyVersion)
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		resources, err := splitGCloudExport(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gcloud export %s: %w", path, err)
+		}
+		for i, raw := range resources {
+			var named struct {
+				Name string `json:"name"`
+			}
+			if err := json.Unmarshal(raw, &named); err != nil {
+				return nil, fmt.Errorf("invalid gcloud export %s: resource %d: %w", path, i+1, err)
+			}
+
+			var msg proto.Message
+			switch {
+			case keyRingNamePattern.MatchString(named.Name):
+				ring := &kmspb.KeyRing{}
+				rings[named.Name], msg = ring, ring
+			case cryptoKeyNamePattern.MatchString(named.Name):
+				key := &kmspb.CryptoKey{}
+				keys[named.Name], msg = key, key
+			case versionNamePattern.MatchString(named.Name):
+				version := &kmspb.CryptoKeyVersion{}
+				keyName := versionNamePattern.FindStringSubmatch(named.Name)[1]
+				if versions[keyName] == nil {
+					versions[keyName] = make(map[string]*kmspb.CryptoKeyVersion)
+				}
+				versions[keyName][named.Name], msg = version, version
+			default:
+				return nil, fmt.Errorf("invalid gcloud export %s: resource %d: name is not valid for a key ring, crypto key or version: %q", path, i+1, named.Name)
+			}
+			if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(raw, msg); err != nil {
+				return nil, fmt.Errorf("invalid gcloud export %s: %s: %w", path, named.Name, err)
+			}
+		}
+	}
+
+	// Keys and versions may name key rings and keys that were not exported
+	for keyName := range versions {
+		if _, ok := keys[keyName]; !ok {
+			return nil, fmt.Errorf("crypto key not found in gcloud exports: %s (add the output of gcloud kms keys list)", keyName)
+		}
+	}
+	byRing := make(map[string][]MirroredCryptoKey)
+	for keyName, key := range keys {
+		ringName := cryptoKeyNamePattern.FindStringSubmatch(keyName)[1]
+		if _, ok := rings[ringName]; !ok {
+			rings[ringName] = &kmspb.KeyRing{Name: ringName}
+		}
+		mk := MirroredCryptoKey{CryptoKey: key}
+		for _, v := range versions[keyName] {
+			mk.Versions = append(mk.Versions, v)
+		}
+		if len(mk.Versions) == 0 && key.GetPrimary() != nil {
+			mk.Versions = []*kmspb.CryptoKeyVersion{key.GetPrimary()}
+		}
+		sort.Slice(mk.Versions, func(i, j int) bool { return mk.Versions[i].Name < mk.Versions[j].Name })
+		byRing[ringName] = append(byRing[ringName], mk)
+	}
+
+	result := make([]MirroredKeyRing, 0, len(rings))
+	for name, ring := range rings {
+		ringKeys := byRing[name]
+		sort.Slice(ringKeys, func(i, j int) bool { return ringKeys[i].CryptoKey.Name < ringKeys[j].CryptoKey.Name })
+		result = append(result, MirroredKeyRing{KeyRing: ring, CryptoKeys: ringKeys})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].KeyRing.Name < result[j].KeyRing.Name })
+	return result, nil
+}
+
+// splitGCloudExport returns the resources of a JSON list, or a single
+// resource
+func splitGCloudExport(data []byte) ([]json.RawMessage, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		return []json.RawMessage{data}, nil
+	}
+	var resources []json.RawMessage
+	if err := json.Unmarshal(data, &resources); err != nil {
+		return nil, err
+	}
+	return resources, nil
+}
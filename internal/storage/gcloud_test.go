@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+func TestReadGCloudExports(t *testing.T) {
+	rings, err := ReadGCloudExports("testdata/gcloud/keyrings.json", "testdata/gcloud/keys.json", "testdata/gcloud/versions.json")
+	if err != nil {
+		t.Fatalf("ReadGCloudExports failed: %v", err)
+	}
+	if len(rings) != 2 {
+		t.Fatalf("Expected 2 key rings, got %d", len(rings))
+	}
+
+	s := NewStorage()
+	stats, err := s.LoadMirror(rings)
+	if err != nil {
+		t.Fatalf("LoadMirror failed: %v", err)
+	}
+	if stats.KeyRings != 2 || stats.CryptoKeys != 3 || stats.CryptoKeyVersions != 4 || len(stats.Skipped) != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	payments := "projects/acme-prod/locations/us-east1/keyRings/payments"
+	ring, err := s.GetKeyRing(payments)
+	if err != nil || !ring.CreateTime.AsTime().Equal(time.Date(2022, 11, 3, 9, 15, 42, 184523000, time.UTC)) {
+		t.Errorf("Expected the exported key ring, got %v: %v", ring, err)
+	}
+
+	// Keys list output alone recreates the primary version
+	cardData, err := s.GetCryptoKey(payments + "/cryptoKeys/card-data")
+	if err != nil {
+		t.Fatalf("GetCryptoKey failed: %v", err)
+	}
+	if cardData.Primary.Name != payments+"/cryptoKeys/card-data/cryptoKeyVersions/7" || cardData.Labels["team"] != "payments" ||
+		cardData.VersionTemplate.ProtectionLevel != kmspb.ProtectionLevel_HSM {
+		t.Errorf("Unexpected key %v", cardData)
+	}
+	if _, _, _, err := s.Encrypt(cardData.Name, []byte("4111 1111 1111 1111"), nil); err != nil {
+		t.Errorf("Encrypt failed: %v", err)
+	}
+
+	signer := payments + "/cryptoKeys/receipt-signer"
+	versions, err := s.ListCryptoKeyVersions(signer)
+	if err != nil || len(versions) != 2 || versions[0].State != kmspb.CryptoKeyVersion_DESTROYED {
+		t.Errorf("Expected both exported versions, got %v: %v", versions, err)
+	}
+	if _, _, err := s.AsymmetricSign(signer+"/cryptoKeyVersions/2", nil, []byte("receipt")); err != nil {
+		t.Errorf("AsymmetricSign failed: %v", err)
+	}
+
+	// Key rings only named by their keys are created too
+	if _, err := s.GetKeyRing("projects/acme-prod/locations/europe-west1/keyRings/eu"); err != nil {
+		t.Errorf("Expected the key ring of an exported key: %v", err)
+	}
+}
+
+func TestReadGCloudExportsInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for name, tc := range map[string]struct {
+		data string
+		want string
+	}{
+		"not json":        {`key rings`, "invalid gcloud export"},
+		"unknown name":    {`[{"name": "projects/p/locations/l"}]`, "name is not valid"},
+		"wrong type":      {`{"name": "projects/p/locations/l/keyRings/r/cryptoKeys/k", "labels": "team"}`, "projects/p/locations/l/keyRings/r/cryptoKeys/k"},
+		"versions alone":  {`[{"name": "projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1"}]`, "crypto key not found in gcloud exports"},
+		"not a list item": {`[1]`, "resource 1"},
+	} {
+		path := filepath.Join(dir, strings.ReplaceAll(name, " ", "-")+".json")
+		if err := os.WriteFile(path, []byte(tc.data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadGCloudExports(path); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", name, tc.want, err)
+		}
+	}
+}
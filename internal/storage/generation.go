@@ -0,0 +1,304 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+// Cloud KMS creates asymmetric versions in PENDING_GENERATION and generates
+// their keys in the background, so clients poll until they are ENABLED.
+// StartKeyGeneration does the same: new asymmetric versions are queued, and
+// a fixed set of worker goroutines takes them off the queue, generating at
+// most limits[type] of a key type at a time, so a burst of
+// CreateCryptoKeyVersion calls queues up instead of generating every RSA key
+// at once or starting a goroutine per version. A version becomes ENABLED
+// when its key is ready, or GENERATION_FAILED with the reason. Symmetric and
+// HMAC versions are still created ENABLED, as in Cloud KMS.
+
+// generator runs background key generation
+type generator struct {
+	ctx     context.Context
+	workers int
+	limits  map[string]int
+
+	// mu guards the queue, the stats and the names of the versions queued or
+	// generating. ready is signalled when a version is queued, a key type's
+	// generation finishes or ctx is cancelled.
+	mu      sync.Mutex
+	ready   *sync.Cond
+	queue   []generationJob
+	stats   map[string]*GenerationTypeStats
+	pending map[string]bool
+}
+
+// generationJob is a version queued for generation
+type generationJob struct {
+	name      string
+	algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm
+	backend   string
+	keyType   string
+	queued    time.Time
+}
+
+// GenerationStats reports the background key generation pool
+type GenerationStats struct {
+	Workers int                            `json:"workers"`
+	Limits  map[string]int                 `json:"limits,omitempty"`
+	Types   map[string]GenerationTypeStats `json:"types"`
+}
+
+// GenerationTypeStats counts the background generation of one key type.
+// WaitSeconds and GenerateSeconds total the time finished versions spent
+// queued and generating.
+type GenerationTypeStats struct {
+	Queued          int     `json:"queued"`
+	Running         int     `json:"running"`
+	Generated       int64   `json:"generated"`
+	Failed          int64   `json:"failed"`
+	WaitSeconds     float64 `json:"waitSeconds"`
+	GenerateSeconds float64 `json:"generateSeconds"`
+}
+
+// GenerationKeyTypes returns the key types StartKeyGeneration accepts
+// limits for: the KeyPoolTypes and ed25519
+func GenerationKeyTypes() []string {
+	types := append(KeyPoolTypes(), "ed25519")
+	sort.Strings(types)
+	return types
+}
+
+// generationKeyType is the key type of an asymmetric algorithm's keys
+func (spec algorithmSpec) generationKeyType() string {
+	if spec.ed25519 {
+		return "ed25519"
+	}
+	return spec.poolKeyType()
+}
+
+// ParseGenerationLimits parses a per key type limit list such as
+// rsa-4096=1,rsa-3072=2
+func ParseGenerationLimits(s string) (map[string]int, error) {
+	return parseKeyCounts(s)
+}
+
+// StartKeyGeneration turns on background generation of asymmetric keys,
+// generating at most workers keys at a time and at most limits[type] of a
+// key type (see GenerationKeyTypes), until ctx is cancelled. Versions still
+// queued then stay PENDING_GENERATION.
+func (s *Storage) StartKeyGeneration(ctx context.Context, workers int, limits map[string]int) error {
+	if workers < 1 {
+		return fmt.Errorf("key generation needs at least 1 worker, got %d", workers)
+	}
+	known := GenerationKeyTypes()
+	gen := &generator{
+		ctx:     ctx,
+		workers: workers,
+		limits:  make(map[string]int),
+		stats:   make(map[string]*GenerationTypeStats),
+		pending: make(map[string]bool),
+	}
+	gen.ready = sync.NewCond(&gen.mu)
+	for keyType, limit := range limits {
+		if !slices.Contains(known, keyType) {
+			return fmt.Errorf("unknown key generation type %q (expected one of %s)", keyType, strings.Join(known, ", "))
+		}
+		if limit < 1 {
+			return fmt.Errorf("key generation limit for %s must be at least 1, got %d", keyType, limit)
+		}
+		gen.limits[keyType] = limit
+	}
+	context.AfterFunc(ctx, gen.stop)
+	for range workers {
+		go gen.work(s)
+	}
+	s.generator.Store(gen)
+
+	// Queue the versions left pending by a state loaded earlier
+	s.lockAll()()
+	return nil
+}
+
+// submit queues the generation of a PENDING_GENERATION version's key,
+// unless it is already queued or generating. It never blocks.
+func (g *generator) submit(s *Storage, name string, algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm, backend string) {
+	keyType := algorithms[algorithm].generationKeyType()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pending[name] || g.ctx.Err() != nil {
+		return
+	}
+	g.pending[name] = true
+	g.statsFor(keyType).Queued++
+	g.queue = append(g.queue, generationJob{name: name, algorithm: algorithm, backend: backend, keyType: keyType, queued: time.Now()})
+	g.ready.Signal()
+}
+
+// work generates queued keys until ctx is cancelled
+func (g *generator) work(s *Storage) {
+	for {
+		job, ok := g.next()
+		if !ok {
+			return
+		}
+		started := time.Now()
+		generated := &StoredCryptoKeyVersion{Name: job.name, Algorithm: job.algorithm}
+		err := s.generateKeyIn(generated, job.backend)
+		finished := time.Now()
+
+		g.mu.Lock()
+		st := g.statsFor(job.keyType)
+		st.Running--
+		if err != nil {
+			st.Failed++
+		} else {
+			st.Generated++
+		}
+		st.WaitSeconds += started.Sub(job.queued).Seconds()
+		st.GenerateSeconds += finished.Sub(started).Seconds()
+		// A slot of the key type is free for versions waiting on it
+		g.ready.Broadcast()
+		g.mu.Unlock()
+
+		s.completeGeneration(generated, err, s.now())
+
+		g.mu.Lock()
+		delete(g.pending, job.name)
+		g.mu.Unlock()
+	}
+}
+
+// next waits for the oldest queued version whose key type is under its
+// limit and takes it off the queue, or returns false once ctx is cancelled.
+// Versions waiting on a busy type do not hold up other types.
+func (g *generator) next() (generationJob, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for {
+		if g.ctx.Err() != nil {
+			return generationJob{}, false
+		}
+		for i, job := range g.queue {
+			st := g.statsFor(job.keyType)
+			if limit, ok := g.limits[job.keyType]; ok && st.Running >= limit {
+				continue
+			}
+			g.queue = slices.Delete(g.queue, i, i+1)
+			st.Queued--
+			st.Running++
+			return job, true
+		}
+		g.ready.Wait()
+	}
+}
+
+// stop drops the queue, leaving its versions PENDING_GENERATION, and wakes
+// the workers so they exit
+func (g *generator) stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, job := range g.queue {
+		g.statsFor(job.keyType).Queued--
+		delete(g.pending, job.name)
+	}
+	g.queue = nil
+	g.ready.Broadcast()
+}
+
+// statsFor returns the stats of a key type. The caller must hold g.mu.
+func (g *generator) statsFor(keyType string) *GenerationTypeStats {
+	st := g.stats[keyType]
+	if st == nil {
+		st = &GenerationTypeStats{}
+		g.stats[keyType] = st
+	}
+	return st
+}
+
+// completeGeneration gives a PENDING_GENERATION version the key generated
+// for it and enables it, or marks it GENERATION_FAILED
+func (s *Storage) completeGeneration(generated *StoredCryptoKeyVersion, err error, now time.Time) {
+	defer s.lockKeyRing(generated.Name)()
+
+	_, version := s.findCryptoKeyVersion(generated.Name)
+	if version == nil || version.State != kmspb.CryptoKeyVersion_PENDING_GENERATION {
+		// Cleared or replaced while its key was generating
+		if err == nil {
+			s.destroyBackendKey(generated)
+		}
+		return
+	}
+	finishGeneration(version, generated, err, now)
+}
+
+func finishGeneration(version, generated *StoredCryptoKeyVersion, err error, now time.Time) {
+	if err != nil {
+		version.State = kmspb.CryptoKeyVersion_GENERATION_FAILED
+		version.GenerationFailureReason = err.Error()
+		return
+	}
+	version.SymmetricKey = generated.SymmetricKey
+	version.PrivateKey = generated.PrivateKey
+	version.Backend = generated.Backend
+	version.GenerateTime = now
+	version.State = kmspb.CryptoKeyVersion_ENABLED
+}
+
+// resumeGeneration generates the keys of PENDING_GENERATION versions put in
+// place by a restore or a loaded state: queued when background generation
+// is on, and at once otherwise. Versions still queued from before keep
+// their place. The caller must hold s.mu for writing.
+func (s *Storage) resumeGeneration() {
+	gen := s.generator.Load()
+	for _, keyring := range s.keyrings {
+		for _, cryptoKey := range keyring.CryptoKeys {
+			for _, version := range cryptoKey.Versions {
+				if version.State != kmspb.CryptoKeyVersion_PENDING_GENERATION {
+					continue
+				}
+				backend, err := s.selectBackend(cryptoKey.Name, cryptoKey.Labels)
+				switch {
+				case err == nil && gen != nil:
+					gen.submit(s, version.Name, version.Algorithm, backend)
+				case err == nil:
+					generated := &StoredCryptoKeyVersion{Name: version.Name, Algorithm: version.Algorithm}
+					err = s.generateKeyIn(generated, backend)
+					finishGeneration(version, generated, err, s.now())
+				default:
+					finishGeneration(version, nil, err, s.now())
+				}
+			}
+		}
+	}
+}
+
+// GenerationStats reports the background key generation pool, or nil when
+// keys are generated on creation
+func (s *Storage) GenerationStats() *GenerationStats {
+	gen := s.generator.Load()
+	if gen == nil {
+		return nil
+	}
+	stats := &GenerationStats{
+		Workers: gen.workers,
+		Types:   make(map[string]GenerationTypeStats),
+	}
+	if len(gen.limits) > 0 {
+		stats.Limits = make(map[string]int, len(gen.limits))
+		for keyType, limit := range gen.limits {
+			stats.Limits[keyType] = limit
+		}
+	}
+	gen.mu.Lock()
+	defer gen.mu.Unlock()
+	for keyType, st := range gen.stats {
+		stats.Types[keyType] = *st
+	}
+	return stats
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+func TestStartKeyGenerationInvalid(t *testing.T) {
+	s := NewStorage()
+	for _, tc := range []struct {
+		workers int
+		limits  map[string]int
+	}{
+		{0, nil},
+		{1, map[string]int{"rsa-1024": 1}},
+		{1, map[string]int{"ed25519": 0}},
+	} {
+		if err := s.StartKeyGeneration(context.Background(), tc.workers, tc.limits); err == nil {
+			t.Errorf("Expected %d workers with limits %v to fail", tc.workers, tc.limits)
+		}
+	}
+	if s.GenerationStats() != nil {
+		t.Error("Expected no generation stats when generation did not start")
+	}
+}
+
+// waitForState polls a version until it leaves PENDING_GENERATION
+func waitForState(t *testing.T, s *Storage, name string) *kmspb.CryptoKeyVersion {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		version, err := s.GetCryptoKeyVersion(name)
+		if err != nil {
+			t.Fatalf("GetCryptoKeyVersion failed: %v", err)
+		}
+		if version.State != kmspb.CryptoKeyVersion_PENDING_GENERATION {
+			return version
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is still PENDING_GENERATION", name)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// holdGenerationSlot takes a slot of a key type as if a key of the type
+// were generating, returning the function that frees it
+func holdGenerationSlot(s *Storage, keyType string) (release func()) {
+	gen := s.generator.Load()
+	gen.mu.Lock()
+	gen.statsFor(keyType).Running++
+	gen.mu.Unlock()
+	return func() {
+		gen.mu.Lock()
+		defer gen.mu.Unlock()
+		gen.statsFor(keyType).Running--
+		gen.ready.Broadcast()
+	}
+}
+
+func TestBackgroundKeyGeneration(t *testing.T) {
+	s := NewStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.StartKeyGeneration(ctx, 2, map[string]int{"ec-p256": 1}); err != nil {
+		t.Fatalf("StartKeyGeneration failed: %v", err)
+	}
+	ring := "projects/test/locations/global/keyRings/ring1"
+	if _, err := s.CreateKeyRing(ring); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+
+	// Symmetric versions are still ENABLED on creation
+	if _, err := s.CreateCryptoKey(ring, "enc", kmspb.CryptoKey_ENCRYPT_DECRYPT, nil, nil); err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+	if _, _, _, err := s.Encrypt(ring+"/cryptoKeys/enc", []byte("data"), nil); err != nil {
+		t.Errorf("Encrypt failed: %v", err)
+	}
+
+	// Hold the only ec-p256 slot, so the version stays queued
+	hold := holdGenerationSlot(s, "ec-p256")
+	key, err := s.CreateCryptoKey(ring, "sign", kmspb.CryptoKey_ASYMMETRIC_SIGN, &kmspb.CryptoKeyVersionTemplate{Algorithm: kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256}, nil)
+	if err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+	name := key.Name + "/cryptoKeyVersions/1"
+	version, err := s.GetCryptoKeyVersion(name)
+	if err != nil {
+		t.Fatalf("GetCryptoKeyVersion failed: %v", err)
+	}
+	if version.State != kmspb.CryptoKeyVersion_PENDING_GENERATION || version.GenerateTime != nil {
+		t.Errorf("New version is %s with generate time %v, expected PENDING_GENERATION with none", version.State, version.GenerateTime)
+	}
+	digest := sha256.Sum256([]byte("message"))
+	if _, _, err := s.AsymmetricSign(name, &kmspb.Digest{Digest: &kmspb.Digest_Sha256{Sha256: digest[:]}}, nil); err == nil {
+		t.Error("Expected AsymmetricSign with a pending version to fail")
+	}
+	if _, err := s.DestroyCryptoKeyVersion(name); err == nil {
+		t.Error("Expected DestroyCryptoKeyVersion of a pending version to fail")
+	}
+	if st := s.GenerationStats(); st.Workers != 2 || st.Limits["ec-p256"] != 1 || st.Types["ec-p256"].Queued != 1 {
+		t.Errorf("GenerationStats = %+v, expected one queued ec-p256 version", st)
+	}
+
+	hold()
+	version = waitForState(t, s, name)
+	if version.State != kmspb.CryptoKeyVersion_ENABLED || version.GenerateTime == nil {
+		t.Fatalf("Generated version is %s with generate time %v, expected ENABLED with one", version.State, version.GenerateTime)
+	}
+	if version.GenerateTime.AsTime().Before(version.CreateTime.AsTime()) {
+		t.Error("Expected the version to be generated after it was created")
+	}
+	if _, _, err := s.AsymmetricSign(name, &kmspb.Digest{Digest: &kmspb.Digest_Sha256{Sha256: digest[:]}}, nil); err != nil {
+		t.Errorf("AsymmetricSign failed: %v", err)
+	}
+	if st := s.GenerationStats().Types["ec-p256"]; st.Queued != 0 || st.Running != 0 || st.Generated != 1 || st.Failed != 0 {
+		t.Errorf("ec-p256 stats = %+v, expected one generated", st)
+	}
+}
+
+func TestKeyGenerationWorkers(t *testing.T) {
+	s := NewStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.StartKeyGeneration(ctx, 2, map[string]int{"ec-p256": 1}); err != nil {
+		t.Fatalf("StartKeyGeneration failed: %v", err)
+	}
+	ring := "projects/test/locations/global/keyRings/ring1"
+	if _, err := s.CreateKeyRing(ring); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+
+	// A burst of versions waits in the queue, not in goroutines of its own
+	hold := holdGenerationSlot(s, "ec-p256")
+	before := runtime.NumGoroutine()
+	var names []string
+	for i := range 50 {
+		key, err := s.CreateCryptoKey(ring, fmt.Sprintf("sign-%d", i), kmspb.CryptoKey_ASYMMETRIC_SIGN, &kmspb.CryptoKeyVersionTemplate{Algorithm: kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256}, nil)
+		if err != nil {
+			t.Fatalf("CreateCryptoKey failed: %v", err)
+		}
+		names = append(names, key.Name+"/cryptoKeyVersions/1")
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Expected no goroutines per queued version, went from %d to %d", before, after)
+	}
+	if st := s.GenerationStats().Types["ec-p256"]; st.Queued != 50 {
+		t.Errorf("Expected 50 queued versions, got %+v", st)
+	}
+
+	hold()
+	for _, name := range names {
+		if version := waitForState(t, s, name); version.State != kmspb.CryptoKeyVersion_ENABLED {
+			t.Errorf("%s is %s, expected ENABLED", name, version.State)
+		}
+	}
+	if st := s.GenerationStats().Types["ec-p256"]; st.Queued != 0 || st.Running != 0 || st.Generated != 50 {
+		t.Errorf("ec-p256 stats = %+v, expected 50 generated", st)
+	}
+}
+
+func TestPendingVersionsResume(t *testing.T) {
+	s := newViewTestStorage(t)
+	key, err := s.CreateCryptoKey(viewTestRing, "sign", kmspb.CryptoKey_ASYMMETRIC_SIGN, &kmspb.CryptoKeyVersionTemplate{Algorithm: kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256}, nil)
+	if err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+	name := key.Name + "/cryptoKeyVersions/1"
+
+	// A version left pending, as a state saved during generation has it,
+	// is generated at once without background generation
+	stored := s.keyrings[viewTestRing].CryptoKeys[key.Name].Versions[name]
+	stored.State = kmspb.CryptoKeyVersion_PENDING_GENERATION
+	stored.PrivateKey = nil
+	s.lockAll()()
+	if version := waitForState(t, s, name); version.State != kmspb.CryptoKeyVersion_ENABLED {
+		t.Fatalf("Resumed version is %s, expected ENABLED", version.State)
+	}
+	if _, err := s.GetPublicKey(name); err != nil {
+		t.Errorf("GetPublicKey failed: %v", err)
+	}
+
+	// and queued once background generation starts
+	stored.State = kmspb.CryptoKeyVersion_PENDING_GENERATION
+	stored.PrivateKey = nil
+	stored.GenerateTime = time.Time{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.StartKeyGeneration(ctx, 1, nil); err != nil {
+		t.Fatalf("StartKeyGeneration failed: %v", err)
+	}
+	if version := waitForState(t, s, name); version.State != kmspb.CryptoKeyVersion_ENABLED {
+		t.Fatalf("Resumed version is %s, expected ENABLED", version.State)
+	}
+}
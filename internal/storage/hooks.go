@@ -0,0 +1,95 @@
+package storage
+
+// Hooks let programs embedding the emulator observe and fail storage
+// operations, for bespoke logging, assertions or fault injection. They run
+// for every caller of the operations (gRPC, REST, the bulk service, fixtures
+// and the admin API), synchronously and outside the storage locks, so a hook
+// may call back into Storage.
+
+// Hook operations
+const (
+	// HookCreate is CreateKeyRing, CreateCryptoKey and CreateCryptoKeyVersion
+	HookCreate  = "create"
+	HookEncrypt = "encrypt"
+	HookDecrypt = "decrypt"
+	// HookDestroy is DestroyCryptoKeyVersion
+	HookDestroy = "destroy"
+)
+
+// HookEvent describes an operation to hooks
+type HookEvent struct {
+	// Operation is HookCreate, HookEncrypt, HookDecrypt or HookDestroy
+	Operation string
+	// Name is the resource the call names: the key ring or crypto key to
+	// create, the crypto key to create a version of, the crypto key or
+	// version to encrypt or decrypt with, or the version to destroy
+	Name string
+	// Version is, after a successful operation, the version created (the
+	// first version of a new crypto key), the version that encrypted, or the
+	// version destroyed. Decrypt does not report the version.
+	Version string
+	// Err is the operation's error; After hooks only
+	Err error
+}
+
+// Hooks run before and after storage operations. Either may be nil.
+type Hooks struct {
+	// Before runs before an operation. An error fails the operation with a
+	// HookError without running it or the After hooks; a gRPC status error
+	// chooses the status code clients see.
+	Before func(HookEvent) error
+	// After runs once an operation has finished, with its result
+	After func(HookEvent)
+}
+
+// HookError is the error of an operation failed by a Before hook
+type HookError struct {
+	Operation string
+	Name      string
+	Err       error
+}
+
+func (e *HookError) Error() string { return e.Err.Error() }
+
+func (e *HookError) Unwrap() error { return e.Err }
+
+// SetHooks replaces the hooks; none removes them. Hooks run in order, and
+// the first Before hook to fail an operation stops the others.
+func (s *Storage) SetHooks(hooks ...Hooks) {
+	if len(hooks) == 0 {
+		s.hooks.Store(nil)
+		return
+	}
+	s.hooks.Store(&hooks)
+}
+
+// beforeHooks runs the Before hooks of an operation on name
+func (s *Storage) beforeHooks(op, name string) error {
+	hooks := s.hooks.Load()
+	if hooks == nil {
+		return nil
+	}
+	for _, h := range *hooks {
+		if h.Before == nil {
+			continue
+		}
+		if err := h.Before(HookEvent{Operation: op, Name: name}); err != nil {
+			return &HookError{Operation: op, Name: name, Err: err}
+		}
+	}
+	return nil
+}
+
+// afterHooks runs the After hooks of an operation on name
+func (s *Storage) afterHooks(op, name, version string, err error) {
+	hooks := s.hooks.Load()
+	if hooks == nil {
+		return
+	}
+	event := HookEvent{Operation: op, Name: name, Version: version, Err: err}
+	for _, h := range *hooks {
+		if h.After != nil {
+			h.After(event)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHooks(t *testing.T) {
+	s := newViewTestStorage(t)
+	s.SetDestroyScheduledDuration(0)
+
+	errInjected := errors.New("injected")
+	var after []HookEvent
+	s.SetHooks(Hooks{
+		Before: func(e HookEvent) error {
+			if e.Operation == HookDecrypt {
+				return errInjected
+			}
+			return nil
+		},
+		After: func(e HookEvent) { after = append(after, e) },
+	})
+
+	ciphertext, version, _, err := s.Encrypt(viewTestKey, []byte("secret"), nil)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	_, _, _, err = s.Decrypt(viewTestKey, ciphertext, nil)
+	var hookErr *HookError
+	if !errors.Is(err, errInjected) || !errors.As(err, &hookErr) || hookErr.Operation != HookDecrypt || hookErr.Name != viewTestKey {
+		t.Errorf("Expected the Before hook to fail Decrypt, got %v", err)
+	}
+	if _, err := s.DestroyCryptoKeyVersion(version); err != nil {
+		t.Fatalf("DestroyCryptoKeyVersion failed: %v", err)
+	}
+	if _, err := s.DestroyCryptoKeyVersion(version); err == nil {
+		t.Fatal("Expected destroying a destroyed version to fail")
+	}
+
+	if len(after) != 3 {
+		t.Fatalf("Expected 3 After events (not the failed Decrypt), got %+v", after)
+	}
+	if e := after[0]; e.Operation != HookEncrypt || e.Name != viewTestKey || e.Version != version || e.Err != nil {
+		t.Errorf("Unexpected encrypt event %+v", e)
+	}
+	if e := after[1]; e.Operation != HookDestroy || e.Version != version || e.Err != nil {
+		t.Errorf("Unexpected destroy event %+v", e)
+	}
+	if e := after[2]; e.Operation != HookDestroy || e.Version != "" || e.Err == nil {
+		t.Errorf("Expected the failed destroy with its error, got %+v", e)
+	}
+
+	s.SetHooks()
+	if _, err := s.CreateCryptoKeyVersion(viewTestKey); err != nil {
+		t.Fatalf("CreateCryptoKeyVersion failed: %v", err)
+	}
+	if len(after) != 3 {
+		t.Errorf("Expected no events after removing the hooks, got %+v", after[3:])
+	}
+}
@@ -0,0 +1,519 @@
+package storage
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ImportJobLifetime is how long an import job accepts key material, as in
+// Cloud KMS
+const ImportJobLifetime = 3 * 24 * time.Hour
+
+// StoredImportJob represents an import job and the RSA key that unwraps key
+// material imported with it
+type StoredImportJob struct {
+	Name            string
+	CreateTime      time.Time
+	ImportMethod    kmspb.ImportJob_ImportMethod
+	ProtectionLevel kmspb.ProtectionLevel
+	PrivateKey      []byte // PKCS#8 DER RSA wrapping key
+}
+
+// importMethodSpec describes how key material is wrapped for one import
+// method
+type importMethodSpec struct {
+	rsaBits int
+	hash    crypto.Hash
+	// aesWrap wraps the key material with an ephemeral AES-256 key (RFC
+	// 5649), itself wrapped with RSA-OAEP; otherwise the key material is
+	// wrapped with RSA-OAEP directly
+	aesWrap bool
+}
+
+var importMethods = map[kmspb.ImportJob_ImportMethod]importMethodSpec{
+	kmspb.ImportJob_RSA_OAEP_3072_SHA1_AES_256:   {rsaBits: 3072, hash: crypto.SHA1, aesWrap: true},
+	kmspb.ImportJob_RSA_OAEP_4096_SHA1_AES_256:   {rsaBits: 4096, hash: crypto.SHA1, aesWrap: true},
+	kmspb.ImportJob_RSA_OAEP_3072_SHA256_AES_256: {rsaBits: 3072, hash: crypto.SHA256, aesWrap: true},
+	kmspb.ImportJob_RSA_OAEP_4096_SHA256_AES_256: {rsaBits: 4096, hash: crypto.SHA256, aesWrap: true},
+	kmspb.ImportJob_RSA_OAEP_3072_SHA256:         {rsaBits: 3072, hash: crypto.SHA256},
+	kmspb.ImportJob_RSA_OAEP_4096_SHA256:         {rsaBits: 4096, hash: crypto.SHA256},
+}
+
+// CreateImportJob creates an import job in a keyring with a new wrapping key
+func (s *Storage) CreateImportJob(keyringName, jobID string, method kmspb.ImportJob_ImportMethod, protectionLevel kmspb.ProtectionLevel) (*kmspb.ImportJob, error) {
+	spec, ok := importMethods[method]
+	if !ok {
+		return nil, fmt.Errorf("unsupported import method: %s", method)
+	}
+
+	// Generate the wrapping key before taking the lock; 4096-bit keys take a
+	// noticeable time
+	key, err := rsa.GenerateKey(rand.Reader, spec.rsaBits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate wrapping key: %w", err)
+	}
+	privateKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode wrapping key: %w", err)
+	}
+
+	defer s.lockKeyRing(keyringName)()
+
+	keyring, exists := s.keyrings[keyringName]
+	if !exists {
+		return nil, fmt.Errorf("keyring not found: %s", keyringName)
+	}
+
+	name := fmt.Sprintf("%s/importJobs/%s", keyringName, jobID)
+	if _, exists := keyring.ImportJobs[name]; exists {
+		return nil, fmt.Errorf("import job already exists: %s", name)
+	}
+
+	job := &StoredImportJob{
+		Name:            name,
+		CreateTime:      s.now(),
+		ImportMethod:    method,
+		ProtectionLevel: protectionLevel,
+		PrivateKey:      privateKey,
+	}
+	if keyring.ImportJobs == nil {
+		keyring.ImportJobs = make(map[string]*StoredImportJob)
+	}
+	keyring.ImportJobs[name] = job
+
+	return importJobProto(job, s.now())
+}
+
+// GetImportJob retrieves an import job
+func (s *Storage) GetImportJob(name string) (*kmspb.ImportJob, error) {
+	defer s.rlockKeyRing(name)()
+
+	job := s.findImportJob(name)
+	if job == nil {
+		return nil, fmt.Errorf("import job not found: %s", name)
+	}
+	return importJobProto(job, s.now())
+}
+
+// ListImportJobs lists the import jobs in a keyring, ordered by name
+func (s *Storage) ListImportJobs(keyringName string) ([]*kmspb.ImportJob, error) {
+	defer s.rlockKeyRing(keyringName)()
+
+	keyring, exists := s.keyrings[keyringName]
+	if !exists {
+		return nil, fmt.Errorf("keyring not found: %s", keyringName)
+	}
+
+	var jobs []*kmspb.ImportJob
+	for _, job := range keyring.ImportJobs {
+		pb, err := importJobProto(job, s.now())
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, pb)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+	return jobs, nil
+}
+
+// ImportCryptoKeyVersion unwraps key material with an active import job and
+// adds it to a crypto key as a new ENABLED version. wrappedKey is formatted
+// as WrapKeyMaterial produces it. Key material that cannot be unwrapped or
+// does not suit the algorithm leaves the version IMPORT_FAILED with the
+// reason, as in Cloud KMS, rather than failing the call.
+//
+// A non-empty targetVersion re-imports into an existing version of the key
+// instead, which must have been created by ImportCryptoKeyVersion and be
+// DESTROYED or IMPORT_FAILED. Material re-imported into a version that held
+// material before must be the same material.
+func (s *Storage) ImportCryptoKeyVersion(keyName string, algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm, importJobName string, wrappedKey []byte, targetVersion string) (*kmspb.CryptoKeyVersion, error) {
+	// The import job may be in another keyring, so lock them all
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cryptoKey := s.findCryptoKey(keyName)
+	if cryptoKey == nil {
+		return nil, fmt.Errorf("crypto key not found: %s", keyName)
+	}
+	defer s.publishCryptoKey(s.keyrings[keyRingName(keyName)], keyName)
+
+	job := s.findImportJob(importJobName)
+	if job == nil {
+		return nil, fmt.Errorf("import job not found: %s", importJobName)
+	}
+	if state := importJobState(job, s.now()); state != kmspb.ImportJob_ACTIVE {
+		return nil, fmt.Errorf("import job %s is not active (state %s)", importJobName, state)
+	}
+
+	if purpose, ok := AlgorithmPurpose(algorithm); !ok || purpose != cryptoKey.Purpose {
+		return nil, fmt.Errorf("algorithm %s is not valid for purpose %s", algorithm, cryptoKey.Purpose)
+	}
+
+	var target *StoredCryptoKeyVersion
+	if targetVersion != "" {
+		target = cryptoKey.Versions[targetVersion]
+		if target == nil {
+			return nil, fmt.Errorf("crypto key version not found: %s", targetVersion)
+		}
+		if target.ImportJob == "" {
+			return nil, fmt.Errorf("crypto key version %s was not imported, so it is not eligible for reimport", targetVersion)
+		}
+		if target.State != kmspb.CryptoKeyVersion_DESTROYED && target.State != kmspb.CryptoKeyVersion_IMPORT_FAILED {
+			return nil, fmt.Errorf("crypto key version %s is %s, so it is not eligible for reimport; only DESTROYED and IMPORT_FAILED versions are", targetVersion, target.State)
+		}
+		if target.Algorithm != algorithm {
+			return nil, fmt.Errorf("algorithm %s does not match algorithm %s of %s", algorithm, target.Algorithm, targetVersion)
+		}
+	}
+
+	symmetricKey, privateKey, importErr := unwrapImportedKey(job, algorithm, wrappedKey)
+	hash := sha256.New()
+	hash.Write(symmetricKey)
+	hash.Write(privateKey)
+	if importErr == nil && target != nil && target.ImportedKeyHash != nil && !bytes.Equal(target.ImportedKeyHash, hash.Sum(nil)) {
+		return nil, fmt.Errorf("invalid wrapped key for %s: key material does not match the material previously imported into it", targetVersion)
+	}
+
+	version := target
+	if version == nil {
+		version = s.addImportedVersion(cryptoKey, keyName, algorithm, job.ProtectionLevel, nil, nil)
+	}
+	version.ImportJob = importJobName
+	version.DestroyTime, version.DestroyEventTime = time.Time{}, time.Time{}
+	if importErr != nil {
+		version.State = kmspb.CryptoKeyVersion_IMPORT_FAILED
+		version.ImportFailureReason = importErr.Error()
+		return versionProto(version), nil
+	}
+	version.State = kmspb.CryptoKeyVersion_ENABLED
+	version.SymmetricKey, version.PrivateKey = symmetricKey, privateKey
+	version.ImportTime = s.now()
+	version.ImportFailureReason = ""
+	version.ImportedKeyHash = hash.Sum(nil)
+	return versionProto(version), nil
+}
+
+// unwrapImportedKey unwraps key material with job and checks it against the
+// algorithm, returning it in the form versions store. Errors are the import
+// failure reasons of IMPORT_FAILED versions.
+func unwrapImportedKey(job *StoredImportJob, algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm, wrappedKey []byte) (symmetricKey, privateKey []byte, err error) {
+	material, err := unwrapKeyMaterial(job, wrappedKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to unwrap key material with import job %s: %w", job.Name, err)
+	}
+	symmetricKey, privateKey, err = importKeyMaterial(algorithm, material)
+	if err != nil {
+		return nil, nil, fmt.Errorf("key material is not valid for algorithm %s: %w", algorithm, err)
+	}
+	return symmetricKey, privateKey, nil
+}
+
+// ImportRawKeyMaterial adds a version with unwrapped key material to a key,
+// skipping the import job and wrapping that ImportCryptoKeyVersion requires.
+// Symmetric and HMAC keys are raw bytes; private keys are PEM or PKCS#8 DER.
+// An unspecified algorithm means the key's version template algorithm.
+func (s *Storage) ImportRawKeyMaterial(keyName string, algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm, material []byte) (*kmspb.CryptoKeyVersion, error) {
+	defer s.lockKeyRing(keyName)()
+
+	cryptoKey := s.findCryptoKey(keyName)
+	if cryptoKey == nil {
+		return nil, fmt.Errorf("crypto key not found: %s", keyName)
+	}
+
+	if algorithm == kmspb.CryptoKeyVersion_CRYPTO_KEY_VERSION_ALGORITHM_UNSPECIFIED {
+		algorithm = cryptoKey.VersionTemplate.GetAlgorithm()
+	}
+	if algorithm == kmspb.CryptoKeyVersion_CRYPTO_KEY_VERSION_ALGORITHM_UNSPECIFIED {
+		algorithm = kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION
+	}
+	if purpose, ok := AlgorithmPurpose(algorithm); !ok || purpose != cryptoKey.Purpose {
+		return nil, fmt.Errorf("algorithm %s is not valid for purpose %s", algorithm, cryptoKey.Purpose)
+	}
+
+	if algorithms[algorithm].keyBytes == 0 {
+		der, err := pkcs8FromPEM(material)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key material for algorithm %s: %w", algorithm, err)
+		}
+		material = der
+	}
+	symmetricKey, privateKey, err := importKeyMaterial(algorithm, material)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key material for algorithm %s: %w", algorithm, err)
+	}
+	version := s.addImportedVersion(cryptoKey, keyName, algorithm, templateProtectionLevel(cryptoKey.VersionTemplate), symmetricKey, privateKey)
+	version.ImportTime = version.CreateTime
+	return versionProto(version), nil
+}
+
+// addImportedVersion adds the next version of cryptoKey with imported key
+// material. The caller must hold the storage lock.
+func (s *Storage) addImportedVersion(cryptoKey *StoredCryptoKey, keyName string, algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm, protectionLevel kmspb.ProtectionLevel, symmetricKey, privateKey []byte) *StoredCryptoKeyVersion {
+	versionName := fmt.Sprintf("%s/cryptoKeyVersions/%d", keyName, cryptoKey.NextVersionID)
+	version := &StoredCryptoKeyVersion{
+		Name:            versionName,
+		State:           kmspb.CryptoKeyVersion_ENABLED,
+		CreateTime:      s.now(),
+		Algorithm:       algorithm,
+		ProtectionLevel: protectionLevel,
+		SymmetricKey:    symmetricKey,
+		PrivateKey:      privateKey,
+	}
+	cryptoKey.Versions[versionName] = version
+	cryptoKey.NextVersionID++
+	return version
+}
+
+// findImportJob looks up an import job by name. The caller must hold the
+// keyring's lock, or s.mu for writing.
+func (s *Storage) findImportJob(name string) *StoredImportJob {
+	keyring := s.keyrings[parentName(name, "/importJobs/")]
+	if keyring == nil {
+		return nil
+	}
+	return keyring.ImportJobs[name]
+}
+
+// importJobState reports whether an import job still accepts key material
+// at now
+func importJobState(job *StoredImportJob, now time.Time) kmspb.ImportJob_ImportJobState {
+	if now.Before(job.CreateTime.Add(ImportJobLifetime)) {
+		return kmspb.ImportJob_ACTIVE
+	}
+	return kmspb.ImportJob_EXPIRED
+}
+
+// importJobProto converts a stored import job to its API representation as
+// of now
+func importJobProto(job *StoredImportJob, now time.Time) (*kmspb.ImportJob, error) {
+	key, err := x509.ParsePKCS8PrivateKey(job.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapping key for %s: %w", job.Name, err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.(crypto.Signer).Public())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key: %w", err)
+	}
+
+	expireTime := job.CreateTime.Add(ImportJobLifetime)
+	pb := &kmspb.ImportJob{
+		Name:            job.Name,
+		ImportMethod:    job.ImportMethod,
+		ProtectionLevel: job.ProtectionLevel,
+		CreateTime:      timestamppb.New(job.CreateTime),
+		GenerateTime:    timestamppb.New(job.CreateTime),
+		ExpireTime:      timestamppb.New(expireTime),
+		State:           importJobState(job, now),
+		PublicKey: &kmspb.ImportJob_WrappingPublicKey{
+			Pem: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		},
+	}
+	if pb.State == kmspb.ImportJob_EXPIRED {
+		pb.ExpireEventTime = pb.ExpireTime
+	}
+	return pb, nil
+}
+
+// WrapKeyMaterial wraps key material with the public key of an import job
+// (its public_key.pem) the way ImportCryptoKeyVersion expects. Symmetric and
+// HMAC keys are the raw key bytes; asymmetric keys are PKCS#8 DER.
+func WrapKeyMaterial(method kmspb.ImportJob_ImportMethod, publicKeyPEM string, material []byte) ([]byte, error) {
+	spec, ok := importMethods[method]
+	if !ok {
+		return nil, fmt.Errorf("unsupported import method: %s", method)
+	}
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return nil, errors.New("public key is not PEM encoded")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is %T, not RSA", key)
+	}
+
+	if !spec.aesWrap {
+		return rsa.EncryptOAEP(spec.hash.New(), rand.Reader, rsaKey, material, nil)
+	}
+
+	kek := make([]byte, 32)
+	if _, err := rand.Read(kek); err != nil {
+		return nil, fmt.Errorf("failed to generate wrapping key: %w", err)
+	}
+	wrappedKEK, err := rsa.EncryptOAEP(spec.hash.New(), rand.Reader, rsaKey, kek, nil)
+	if err != nil {
+		return nil, err
+	}
+	wrappedMaterial, err := aesKeyWrapPadded(kek, material)
+	if err != nil {
+		return nil, err
+	}
+	return append(wrappedKEK, wrappedMaterial...), nil
+}
+
+// unwrapKeyMaterial reverses WrapKeyMaterial with the private key of job
+func unwrapKeyMaterial(job *StoredImportJob, wrapped []byte) ([]byte, error) {
+	spec := importMethods[job.ImportMethod]
+	key, err := x509.ParsePKCS8PrivateKey(job.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapping key: %w", err)
+	}
+	rsaKey := key.(*rsa.PrivateKey)
+
+	if !spec.aesWrap {
+		material, err := rsa.DecryptOAEP(spec.hash.New(), nil, rsaKey, wrapped, nil)
+		if err != nil {
+			return nil, errors.New("RSA-OAEP decryption failed")
+		}
+		return material, nil
+	}
+
+	if len(wrapped) <= rsaKey.Size() {
+		return nil, fmt.Errorf("expected %d bytes of wrapped AES key followed by the wrapped key material, got %d bytes", rsaKey.Size(), len(wrapped))
+	}
+	kek, err := rsa.DecryptOAEP(spec.hash.New(), nil, rsaKey, wrapped[:rsaKey.Size()], nil)
+	if err != nil {
+		return nil, errors.New("RSA-OAEP decryption of the AES key failed")
+	}
+	return aesKeyUnwrapPadded(kek, wrapped[rsaKey.Size():])
+}
+
+// importKeyMaterial checks unwrapped key material against the algorithm and
+// returns it in the form versions store
+func importKeyMaterial(algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm, material []byte) (symmetricKey, privateKey []byte, err error) {
+	spec := algorithms[algorithm]
+	if spec.keyBytes > 0 {
+		if len(material) != spec.keyBytes {
+			return nil, nil, fmt.Errorf("expected a %d-byte key, got %d bytes", spec.keyBytes, len(material))
+		}
+		return bytes.Clone(material), nil, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(material)
+	if err != nil {
+		return nil, nil, fmt.Errorf("expected a PKCS#8 private key: %w", err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if spec.rsaBits == 0 || k.N.BitLen() != spec.rsaBits {
+			return nil, nil, fmt.Errorf("got a %d-bit RSA key", k.N.BitLen())
+		}
+	case *ecdsa.PrivateKey:
+		if spec.curve == nil || k.Curve != spec.curve {
+			return nil, nil, fmt.Errorf("got an ECDSA %s key", k.Curve.Params().Name)
+		}
+	case ed25519.PrivateKey:
+		if !spec.ed25519 {
+			return nil, nil, errors.New("got an Ed25519 key")
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return nil, bytes.Clone(material), nil
+}
+
+// aesKeyWrapPadded wraps plaintext with AES Key Wrap with Padding (RFC 5649)
+func aesKeyWrapPadded(kek, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(plaintext) == 0 {
+		return nil, errors.New("nothing to wrap")
+	}
+
+	// Alternative initial value: the constant A65959A6 and the length
+	var a [8]byte
+	binary.BigEndian.PutUint32(a[:4], 0xA65959A6)
+	binary.BigEndian.PutUint32(a[4:], uint32(len(plaintext)))
+
+	padded := make([]byte, (len(plaintext)+7)/8*8)
+	copy(padded, plaintext)
+	n := len(padded) / 8
+
+	if n == 1 {
+		out := make([]byte, 16)
+		block.Encrypt(out, append(a[:], padded...))
+		return out, nil
+	}
+
+	var b [16]byte
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b[:8], a[:])
+			copy(b[8:], padded[(i-1)*8:i*8])
+			block.Encrypt(b[:], b[:])
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(a[:], binary.BigEndian.Uint64(b[:8])^t)
+			copy(padded[(i-1)*8:], b[8:])
+		}
+	}
+	return append(a[:], padded...), nil
+}
+
+// aesKeyUnwrapPadded reverses aesKeyWrapPadded, checking the integrity of the
+// result
+func aesKeyUnwrapPadded(kek, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < 16 || len(ciphertext)%8 != 0 {
+		return nil, fmt.Errorf("AES key wrap ciphertext must be a multiple of 8 bytes and at least 16, got %d bytes", len(ciphertext))
+	}
+
+	n := len(ciphertext)/8 - 1
+	var a [8]byte
+	plaintext := make([]byte, n*8)
+	if n == 1 {
+		var b [16]byte
+		block.Decrypt(b[:], ciphertext)
+		copy(a[:], b[:8])
+		copy(plaintext, b[8:])
+	} else {
+		copy(a[:], ciphertext[:8])
+		copy(plaintext, ciphertext[8:])
+		var b [16]byte
+		for j := 5; j >= 0; j-- {
+			for i := n; i >= 1; i-- {
+				t := uint64(n*j + i)
+				binary.BigEndian.PutUint64(b[:8], binary.BigEndian.Uint64(a[:])^t)
+				copy(b[8:], plaintext[(i-1)*8:i*8])
+				block.Decrypt(b[:], b[:])
+				copy(a[:], b[:8])
+				copy(plaintext[(i-1)*8:], b[8:])
+			}
+		}
+	}
+
+	length := int(binary.BigEndian.Uint32(a[4:]))
+	if binary.BigEndian.Uint32(a[:4]) != 0xA65959A6 || length <= 8*(n-1) || length > 8*n {
+		return nil, errors.New("AES key unwrap integrity check failed")
+	}
+	for _, c := range plaintext[length:] {
+		if c != 0 {
+			return nil, errors.New("AES key unwrap integrity check failed")
+		}
+	}
+	return plaintext[:length], nil
+}
@@ -0,0 +1,320 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+func TestAESKeyWrapPadded(t *testing.T) {
+	// Test vectors from RFC 5649 section 6
+	kek, _ := hex.DecodeString("5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8")
+	tests := []struct {
+		name, key, wrapped string
+	}{
+		{"20 bytes", "c37b7e6492584340bed12207808941155068f738", "138bdeaa9b8fa7fc61f97742e72248ee5ae6ae5360d1ae6a5f54f373fa543b6a"},
+		{"7 bytes", "466f7250617369", "afbeb0f07dfbf5419200f2ccb50bb24f"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, _ := hex.DecodeString(tt.key)
+			wrapped, err := aesKeyWrapPadded(kek, key)
+			if err != nil {
+				t.Fatalf("aesKeyWrapPadded failed: %v", err)
+			}
+			if got := hex.EncodeToString(wrapped); got != tt.wrapped {
+				t.Errorf("Wrapped %s, want %s", got, tt.wrapped)
+			}
+
+			unwrapped, err := aesKeyUnwrapPadded(kek, wrapped)
+			if err != nil {
+				t.Fatalf("aesKeyUnwrapPadded failed: %v", err)
+			}
+			if !bytes.Equal(unwrapped, key) {
+				t.Errorf("Unwrapped %x, want %x", unwrapped, key)
+			}
+
+			wrapped[len(wrapped)-1] ^= 1
+			if _, err := aesKeyUnwrapPadded(kek, wrapped); err == nil {
+				t.Error("Expected a tampered ciphertext to fail the integrity check")
+			}
+		})
+	}
+}
+
+func createImportJob(t *testing.T, s *Storage, method kmspb.ImportJob_ImportMethod) *kmspb.ImportJob {
+	t.Helper()
+
+	job, err := s.CreateImportJob("projects/test/locations/global/keyRings/ring1", "job-"+strings.ToLower(method.String()), method, kmspb.ProtectionLevel_SOFTWARE)
+	if err != nil {
+		t.Fatalf("CreateImportJob failed: %v", err)
+	}
+	return job
+}
+
+func TestImportCryptoKeyVersion(t *testing.T) {
+	s := NewStorage()
+	versionName := createKeyWithAlgorithm(t, s, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION)
+	keyName := versionName[:strings.Index(versionName, "/cryptoKeyVersions/")]
+
+	for _, method := range []kmspb.ImportJob_ImportMethod{
+		kmspb.ImportJob_RSA_OAEP_3072_SHA1_AES_256,
+		kmspb.ImportJob_RSA_OAEP_3072_SHA256_AES_256,
+		kmspb.ImportJob_RSA_OAEP_3072_SHA256,
+	} {
+		t.Run(method.String(), func(t *testing.T) {
+			job := createImportJob(t, s, method)
+			if job.State != kmspb.ImportJob_ACTIVE {
+				t.Errorf("Expected an ACTIVE job, got %v", job.State)
+			}
+
+			key := make([]byte, 32)
+			rand.Read(key)
+			wrapped, err := WrapKeyMaterial(method, job.PublicKey.Pem, key)
+			if err != nil {
+				t.Fatalf("WrapKeyMaterial failed: %v", err)
+			}
+			version, err := s.ImportCryptoKeyVersion(keyName, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, job.Name, wrapped, "")
+			if err != nil {
+				t.Fatalf("ImportCryptoKeyVersion failed: %v", err)
+			}
+			if version.State != kmspb.CryptoKeyVersion_ENABLED {
+				t.Errorf("Expected ENABLED, got %v", version.State)
+			}
+			if version.ImportJob != job.Name || version.ImportTime == nil || !version.ReimportEligible || version.ImportFailureReason != "" {
+				t.Errorf("Expected import_job, import_time and reimport_eligible, got %v", version)
+			}
+
+			if _, err := s.UpdateCryptoKeyPrimaryVersion(keyName, version.Name); err != nil {
+				t.Fatalf("UpdateCryptoKeyPrimaryVersion failed: %v", err)
+			}
+			ciphertext, _, _, err := s.Encrypt(keyName, []byte("secret"), nil)
+			if err != nil {
+				t.Fatalf("Encrypt failed: %v", err)
+			}
+			_, sealed, _ := openCiphertext(keyName, ciphertext)
+			stored := &StoredCryptoKeyVersion{SymmetricKey: key}
+			if plaintext, err := s.decryptWithVersion(stored, sealed, nil); err != nil || string(plaintext) != "secret" {
+				t.Errorf("Expected the imported key to encrypt, got %q, %v", plaintext, err)
+			}
+		})
+	}
+}
+
+func TestImportAsymmetricKey(t *testing.T) {
+	s := NewStorage()
+	versionName := createKeyWithAlgorithm(t, s, kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256)
+	keyName := versionName[:strings.Index(versionName, "/cryptoKeyVersions/")]
+	job := createImportJob(t, s, kmspb.ImportJob_RSA_OAEP_3072_SHA256_AES_256)
+
+	private, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(private)
+	wrapped, err := WrapKeyMaterial(job.ImportMethod, job.PublicKey.Pem, der)
+	if err != nil {
+		t.Fatalf("WrapKeyMaterial failed: %v", err)
+	}
+
+	failed, err := s.ImportCryptoKeyVersion(keyName, kmspb.CryptoKeyVersion_EC_SIGN_P384_SHA384, job.Name, wrapped, "")
+	expectImportFailed(t, failed, err, "got an ECDSA P-256 key")
+
+	version, err := s.ImportCryptoKeyVersion(keyName, kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256, job.Name, wrapped, "")
+	if err != nil {
+		t.Fatalf("ImportCryptoKeyVersion failed: %v", err)
+	}
+	digest := sha256.Sum256([]byte("message"))
+	signature, _, err := s.AsymmetricSign(version.Name, &kmspb.Digest{Digest: &kmspb.Digest_Sha256{Sha256: digest[:]}}, nil)
+	if err != nil {
+		t.Fatalf("AsymmetricSign failed: %v", err)
+	}
+	if !ecdsa.VerifyASN1(&private.PublicKey, digest[:], signature) {
+		t.Error("Signature does not verify with the imported key")
+	}
+}
+
+func TestImportCryptoKeyVersionErrors(t *testing.T) {
+	s := NewStorage()
+	versionName := createKeyWithAlgorithm(t, s, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION)
+	keyName := versionName[:strings.Index(versionName, "/cryptoKeyVersions/")]
+	job := createImportJob(t, s, kmspb.ImportJob_RSA_OAEP_3072_SHA1_AES_256)
+
+	short, err := WrapKeyMaterial(job.ImportMethod, job.PublicKey.Pem, make([]byte, 16))
+	if err != nil {
+		t.Fatalf("WrapKeyMaterial failed: %v", err)
+	}
+	version, err := s.ImportCryptoKeyVersion(keyName, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, job.Name, short, "")
+	expectImportFailed(t, version, err, "expected a 32-byte key, got 16 bytes")
+	version, err = s.ImportCryptoKeyVersion(keyName, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, job.Name, []byte("garbage"), "")
+	expectImportFailed(t, version, err, "failed to unwrap key material")
+	if _, err := s.UpdateCryptoKeyPrimaryVersion(keyName, version.Name); err == nil {
+		t.Error("Expected an IMPORT_FAILED version not to become primary")
+	}
+	if _, err := s.DestroyCryptoKeyVersion(version.Name); err == nil || !strings.Contains(err.Error(), "cannot be destroyed") {
+		t.Errorf("Expected an IMPORT_FAILED version not to be destroyed, got %v", err)
+	}
+
+	if _, err := s.CreateImportJob("projects/test/locations/global/keyRings/ring1", "job-rsa_oaep_3072_sha1_aes_256", job.ImportMethod, kmspb.ProtectionLevel_SOFTWARE); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("Expected a duplicate job to be rejected, got %v", err)
+	}
+
+	// Backdate the job past its lifetime
+	s.findImportJob(job.Name).CreateTime = time.Now().Add(-ImportJobLifetime)
+	expired, err := s.GetImportJob(job.Name)
+	if err != nil {
+		t.Fatalf("GetImportJob failed: %v", err)
+	}
+	if expired.State != kmspb.ImportJob_EXPIRED || expired.ExpireEventTime == nil {
+		t.Errorf("Expected an EXPIRED job with expire_event_time, got %v", expired)
+	}
+	key, err := WrapKeyMaterial(job.ImportMethod, job.PublicKey.Pem, make([]byte, 32))
+	if err != nil {
+		t.Fatalf("WrapKeyMaterial failed: %v", err)
+	}
+	if _, err := s.ImportCryptoKeyVersion(keyName, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, job.Name, key, ""); err == nil || !strings.Contains(err.Error(), "not active") {
+		t.Errorf("Expected an expired job to be rejected, got %v", err)
+	}
+}
+
+// expectImportFailed checks that an import returned an IMPORT_FAILED version
+// whose failure reason mentions reason
+func expectImportFailed(t *testing.T, version *kmspb.CryptoKeyVersion, err error, reason string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("ImportCryptoKeyVersion failed: %v", err)
+	}
+	if version.State != kmspb.CryptoKeyVersion_IMPORT_FAILED || !strings.Contains(version.ImportFailureReason, reason) {
+		t.Errorf("Expected IMPORT_FAILED because %q, got %v", reason, version)
+	}
+	if version.ImportTime != nil || !version.ReimportEligible {
+		t.Errorf("Expected a reimport-eligible version without import_time, got %v", version)
+	}
+}
+
+func TestReimportCryptoKeyVersion(t *testing.T) {
+	s, _, _ := newDestroyTestStorage(t)
+	s.SetDestroyScheduledDuration(0)
+	keyName := destroyTestKey
+	job := createImportJob(t, s, kmspb.ImportJob_RSA_OAEP_3072_SHA256)
+	wrap := func(material []byte) []byte {
+		wrapped, err := WrapKeyMaterial(job.ImportMethod, job.PublicKey.Pem, material)
+		if err != nil {
+			t.Fatalf("WrapKeyMaterial failed: %v", err)
+		}
+		return wrapped
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	other := make([]byte, 32)
+	rand.Read(other)
+
+	// Retrying a failed import into the same version succeeds
+	failed, err := s.ImportCryptoKeyVersion(keyName, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, job.Name, []byte("garbage"), "")
+	expectImportFailed(t, failed, err, "failed to unwrap key material")
+	version, err := s.ImportCryptoKeyVersion(keyName, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, job.Name, wrap(key), failed.Name)
+	if err != nil {
+		t.Fatalf("Reimport failed: %v", err)
+	}
+	if version.Name != failed.Name || version.State != kmspb.CryptoKeyVersion_ENABLED || version.ImportTime == nil || version.ImportFailureReason != "" {
+		t.Errorf("Expected %s to be ENABLED by the reimport, got %v", failed.Name, version)
+	}
+
+	if _, err := s.ImportCryptoKeyVersion(keyName, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, job.Name, wrap(key), version.Name); err == nil || !strings.Contains(err.Error(), "not eligible for reimport") {
+		t.Errorf("Expected an ENABLED version not to be reimported, got %v", err)
+	}
+	if _, err := s.ImportCryptoKeyVersion(keyName, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, job.Name, wrap(key), keyName+"/cryptoKeyVersions/1"); err == nil || !strings.Contains(err.Error(), "was not imported") {
+		t.Errorf("Expected a generated version not to be reimported, got %v", err)
+	}
+
+	// A destroyed version only takes back the material it held
+	if _, err := s.DestroyCryptoKeyVersion(version.Name); err != nil {
+		t.Fatalf("DestroyCryptoKeyVersion failed: %v", err)
+	}
+	if _, err := s.ImportCryptoKeyVersion(keyName, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, job.Name, wrap(other), version.Name); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("Expected different key material to be rejected, got %v", err)
+	}
+	restored, err := s.ImportCryptoKeyVersion(keyName, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, job.Name, wrap(key), version.Name)
+	if err != nil {
+		t.Fatalf("Reimport of destroyed version failed: %v", err)
+	}
+	if restored.State != kmspb.CryptoKeyVersion_ENABLED {
+		t.Errorf("Expected the destroyed version to be ENABLED again, got %v", restored.State)
+	}
+}
+
+func TestImportRawKeyMaterial(t *testing.T) {
+	s := NewStorage()
+	versionName := createKeyWithAlgorithm(t, s, kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256)
+	keyName := versionName[:strings.Index(versionName, "/cryptoKeyVersions/")]
+
+	private, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalECPrivateKey(private)
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	// The algorithm defaults to the key's version template
+	version, err := s.ImportRawKeyMaterial(keyName, kmspb.CryptoKeyVersion_CRYPTO_KEY_VERSION_ALGORITHM_UNSPECIFIED, pemKey)
+	if err != nil {
+		t.Fatalf("ImportRawKeyMaterial failed: %v", err)
+	}
+	if version.Name != keyName+"/cryptoKeyVersions/2" || version.Algorithm != kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256 {
+		t.Errorf("Unexpected version: %v", version)
+	}
+	digest := sha256.Sum256([]byte("message"))
+	signature, _, err := s.AsymmetricSign(version.Name, &kmspb.Digest{Digest: &kmspb.Digest_Sha256{Sha256: digest[:]}}, nil)
+	if err != nil {
+		t.Fatalf("AsymmetricSign failed: %v", err)
+	}
+	if !ecdsa.VerifyASN1(&private.PublicKey, digest[:], signature) {
+		t.Error("Signature does not verify with the imported key")
+	}
+
+	tests := []struct {
+		desc      string
+		algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm
+		material  []byte
+		want      string
+	}{
+		{"wrong curve", kmspb.CryptoKeyVersion_EC_SIGN_P384_SHA384, pemKey, "invalid key material"},
+		{"wrong purpose", kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, make([]byte, 32), "not valid for purpose"},
+		{"garbage", kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256, []byte("garbage"), "invalid key material"},
+	}
+	for _, tt := range tests {
+		if _, err := s.ImportRawKeyMaterial(keyName, tt.algorithm, tt.material); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected %q, got %v", tt.desc, tt.want, err)
+		}
+	}
+	if _, err := s.ImportRawKeyMaterial(keyName+"-missing", 0, pemKey); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected a missing key to be rejected, got %v", err)
+	}
+}
+
+func TestImportJobsPersisted(t *testing.T) {
+	s := NewStorage()
+	createKeyWithAlgorithm(t, s, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION)
+	job := createImportJob(t, s, kmspb.ImportJob_RSA_OAEP_3072_SHA256)
+
+	var buf bytes.Buffer
+	if err := s.SaveState(&buf); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	restored := NewStorage()
+	if _, err := restored.LoadState(&buf); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+
+	jobs, err := restored.ListImportJobs("projects/test/locations/global/keyRings/ring1")
+	if err != nil {
+		t.Fatalf("ListImportJobs failed: %v", err)
+	}
+	if len(jobs) != 1 || jobs[0].PublicKey.GetPem() != job.PublicKey.Pem || jobs[0].ImportMethod != job.ImportMethod {
+		t.Errorf("Expected the job to survive a round trip, got %v", jobs)
+	}
+}
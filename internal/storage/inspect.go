@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+// CiphertextInspection is what InspectCiphertext found out about a
+// ciphertext. It never holds the plaintext.
+type CiphertextInspection struct {
+	// Format is how the data was sealed: aes-gcm, aes-siv (deterministic
+	// encryption) or mock (mock crypto)
+	Format string `json:"format"`
+	// VersionID is the version ID the ciphertext's header names, or 0 for a
+	// ciphertext of an earlier release without one
+	VersionID int64 `json:"versionId,omitempty"`
+	// CryptoKeyVersion is the version that authenticates the ciphertext,
+	// with its state and whether it is its key's primary version
+	CryptoKeyVersion string `json:"cryptoKeyVersion,omitempty"`
+	State            string `json:"state,omitempty"`
+	Primary          bool   `json:"primary,omitempty"`
+	// Decrypts reports whether Decrypt with the version's key and the same
+	// additional authenticated data would succeed now; Reason says why not
+	Decrypts bool   `json:"decrypts"`
+	Reason   string `json:"reason,omitempty"`
+	// Candidates are the versions with the header's ID that do not
+	// authenticate the ciphertext, with their states
+	Candidates map[string]string `json:"candidates,omitempty"`
+}
+
+// InspectCiphertext finds the version that produced a ciphertext of
+// Encrypt and reports whether it would decrypt now, for debugging failed
+// decryptions. It looks at keyName, or at every ENCRYPT_DECRYPT key when
+// keyName is empty. A ciphertext encrypted with additional authenticated
+// data only authenticates with the same aad.
+func (s *Storage) InspectCiphertext(keyName string, ciphertext, aad []byte) (*CiphertextInspection, error) {
+	view := s.view.Load()
+	var keys []*StoredCryptoKey
+	if keyName != "" {
+		cryptoKey := view.cryptoKey(keyName)
+		if cryptoKey == nil {
+			return nil, fmt.Errorf("crypto key not found: %s", keyName)
+		}
+		if cryptoKey.Purpose != kmspb.CryptoKey_ENCRYPT_DECRYPT {
+			return nil, fmt.Errorf("crypto key %s has purpose %s, which does not support Decrypt", keyName, cryptoKey.Purpose)
+		}
+		keys = append(keys, cryptoKey)
+	} else {
+		for _, ring := range view.keyRings {
+			for _, cryptoKey := range ring.cryptoKeys {
+				if cryptoKey.Purpose == kmspb.CryptoKey_ENCRYPT_DECRYPT {
+					keys = append(keys, cryptoKey)
+				}
+			}
+		}
+		slices.SortFunc(keys, func(a, b *StoredCryptoKey) int { return strings.Compare(a.Name, b.Name) })
+	}
+
+	inspection := &CiphertextInspection{Format: "aes-gcm"}
+	sealed := ciphertext
+	if rest, ok := bytes.CutPrefix(ciphertext, ciphertextMagic); ok {
+		if id, n := binary.Uvarint(rest); n > 0 {
+			inspection.VersionID = int64(id)
+			sealed = rest[n:]
+		}
+	}
+	switch {
+	case bytes.HasPrefix(sealed, mockTag):
+		inspection.Format = "mock"
+	case bytes.HasPrefix(sealed, sivTag):
+		inspection.Format = "aes-siv"
+	}
+
+	for _, cryptoKey := range keys {
+		var versions []*StoredCryptoKeyVersion
+		if inspection.VersionID != 0 {
+			if version := cryptoKey.Versions[fmt.Sprintf("%s/cryptoKeyVersions/%d", cryptoKey.Name, inspection.VersionID)]; version != nil {
+				versions = append(versions, version)
+			}
+		} else {
+			versions = sortedVersions(cryptoKey)
+		}
+
+		for _, version := range versions {
+			if version.State == kmspb.CryptoKeyVersion_DESTROYED || version.State == kmspb.CryptoKeyVersion_PENDING_GENERATION {
+				inspection.addCandidate(version)
+				continue
+			}
+			plaintext, err := s.open(version, sealed, aad)
+			clear(plaintext)
+			if err != nil {
+				inspection.addCandidate(version)
+				continue
+			}
+
+			inspection.CryptoKeyVersion = version.Name
+			inspection.State = version.State.String()
+			inspection.Primary = version.Name == cryptoKey.PrimaryVersion
+			inspection.Decrypts = version.State == kmspb.CryptoKeyVersion_ENABLED
+			if !inspection.Decrypts {
+				inspection.Reason = fmt.Sprintf("%s is %s; Decrypt needs it ENABLED", version.Name, version.State)
+			}
+			inspection.Candidates = nil
+			return inspection, nil
+		}
+	}
+
+	inspection.Reason = s.inspectionReason(inspection, keyName)
+	if inspection.VersionID == 0 {
+		// Every version of every key is a candidate, which says nothing
+		inspection.Candidates = nil
+	}
+	return inspection, nil
+}
+
+func (c *CiphertextInspection) addCandidate(version *StoredCryptoKeyVersion) {
+	if c.Candidates == nil {
+		c.Candidates = make(map[string]string)
+	}
+	c.Candidates[version.Name] = version.State.String()
+}
+
+// inspectionReason explains why no version authenticates a ciphertext
+func (s *Storage) inspectionReason(inspection *CiphertextInspection, keyName string) string {
+	switch {
+	case inspection.Format == "mock" && !s.MockCrypto():
+		return "the ciphertext was written with mock crypto, which is off"
+	case inspection.Format != "mock" && s.MockCrypto():
+		return "mock crypto is on, so only ciphertexts written with it decrypt"
+	case inspection.VersionID != 0 && len(inspection.Candidates) == 0 && keyName != "":
+		return fmt.Sprintf("crypto key %s has no version %d", keyName, inspection.VersionID)
+	case inspection.VersionID != 0 && len(inspection.Candidates) == 0:
+		return fmt.Sprintf("no crypto key has a version %d", inspection.VersionID)
+	}
+	if len(inspection.Candidates) == 1 {
+		for name, state := range inspection.Candidates {
+			if state == kmspb.CryptoKeyVersion_DESTROYED.String() {
+				return fmt.Sprintf("%s is DESTROYED, so its key material is gone", name)
+			}
+		}
+	}
+	return "no version authenticates the ciphertext: it was encrypted with another key or other additional authenticated data, or it is corrupted"
+}
+
+// sortedVersions returns a crypto key's versions ordered by version ID
+func sortedVersions(cryptoKey *StoredCryptoKey) []*StoredCryptoKeyVersion {
+	versions := make([]*StoredCryptoKeyVersion, 0, len(cryptoKey.Versions))
+	ids := make(map[*StoredCryptoKeyVersion]int64, len(cryptoKey.Versions))
+	for _, version := range cryptoKey.Versions {
+		ids[version], _ = strconv.ParseInt(version.Name[strings.LastIndex(version.Name, "/")+1:], 10, 64)
+		versions = append(versions, version)
+	}
+	slices.SortFunc(versions, func(a, b *StoredCryptoKeyVersion) int { return cmp.Compare(ids[a], ids[b]) })
+	return versions
+}
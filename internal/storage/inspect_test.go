@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+func TestInspectCiphertext(t *testing.T) {
+	s := newViewTestStorage(t)
+	s.SetDestroyScheduledDuration(0)
+	ciphertext, version, _, err := s.Encrypt(viewTestKey, []byte("secret"), []byte("aad"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	got, err := s.InspectCiphertext("", ciphertext, []byte("aad"))
+	if err != nil {
+		t.Fatalf("InspectCiphertext failed: %v", err)
+	}
+	if got.CryptoKeyVersion != version || got.VersionID != 1 || got.Format != "aes-gcm" || !got.Primary || !got.Decrypts || got.State != "ENABLED" {
+		t.Errorf("InspectCiphertext = %+v", got)
+	}
+
+	// The wrong AAD leaves the version as a candidate
+	got, err = s.InspectCiphertext(viewTestKey, ciphertext, nil)
+	if err != nil {
+		t.Fatalf("InspectCiphertext failed: %v", err)
+	}
+	if got.Decrypts || got.CryptoKeyVersion != "" || got.Candidates[version] != "ENABLED" || !strings.Contains(got.Reason, "additional authenticated data") {
+		t.Errorf("InspectCiphertext with the wrong AAD = %+v", got)
+	}
+
+	if _, err := s.UpdateCryptoKeyVersion(version, kmspb.CryptoKeyVersion_DISABLED, ""); err != nil {
+		t.Fatalf("UpdateCryptoKeyVersion failed: %v", err)
+	}
+	got, _ = s.InspectCiphertext(viewTestKey, ciphertext, []byte("aad"))
+	if got.CryptoKeyVersion != version || got.Decrypts || !strings.Contains(got.Reason, "DISABLED") {
+		t.Errorf("InspectCiphertext of a disabled version = %+v", got)
+	}
+
+	if _, err := s.DestroyCryptoKeyVersion(version); err != nil {
+		t.Fatalf("DestroyCryptoKeyVersion failed: %v", err)
+	}
+	got, _ = s.InspectCiphertext(viewTestKey, ciphertext, []byte("aad"))
+	if got.Decrypts || !strings.Contains(got.Reason, "DESTROYED") {
+		t.Errorf("InspectCiphertext of a destroyed version = %+v", got)
+	}
+
+	if _, err := s.InspectCiphertext(viewTestRing+"/cryptoKeys/missing", ciphertext, nil); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected a missing key to fail with not found, got %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"sort"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Inventory is every stored resource in its API representation, each kind
+// ordered by name
+type Inventory struct {
+	KeyRings          []*kmspb.KeyRing
+	CryptoKeys        []*kmspb.CryptoKey
+	CryptoKeyVersions []*kmspb.CryptoKeyVersion
+	ImportJobs        []*kmspb.ImportJob
+}
+
+// Inventory returns all stored resources as one consistent view, for exports
+// that cover the whole emulator
+func (s *Storage) Inventory() (Inventory, error) {
+	// The write lock waits for calls on every keyring to finish
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var inv Inventory
+	for _, kr := range s.keyrings {
+		inv.KeyRings = append(inv.KeyRings, &kmspb.KeyRing{
+			Name:       kr.Name,
+			CreateTime: timestamppb.New(kr.CreateTime),
+		})
+		for _, ck := range kr.CryptoKeys {
+			inv.CryptoKeys = append(inv.CryptoKeys, cryptoKeyProto(ck))
+			for _, v := range ck.Versions {
+				inv.CryptoKeyVersions = append(inv.CryptoKeyVersions, versionProto(v))
+			}
+		}
+		for _, job := range kr.ImportJobs {
+			pb, err := importJobProto(job, s.now())
+			if err != nil {
+				return Inventory{}, err
+			}
+			inv.ImportJobs = append(inv.ImportJobs, pb)
+		}
+	}
+
+	sort.Slice(inv.KeyRings, func(i, j int) bool { return inv.KeyRings[i].Name < inv.KeyRings[j].Name })
+	sort.Slice(inv.CryptoKeys, func(i, j int) bool { return inv.CryptoKeys[i].Name < inv.CryptoKeys[j].Name })
+	sort.Slice(inv.CryptoKeyVersions, func(i, j int) bool {
+		return inv.CryptoKeyVersions[i].Name < inv.CryptoKeyVersions[j].Name
+	})
+	sort.Slice(inv.ImportJobs, func(i, j int) bool { return inv.ImportJobs[i].Name < inv.ImportJobs[j].Name })
+	return inv, nil
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"crypto/elliptic"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Generating an RSA 4096 key takes around a second, and RSA 3072 a few
+// hundred milliseconds, so suites creating many asymmetric keys spend most
+// of their time in CreateCryptoKey. StartKeyPool keeps keys of chosen types
+// generated ahead in the background; new versions take a key from the pool
+// when it has one and generate their own otherwise. Each pooled key is used
+// once.
+
+// keyPool holds the pre-generated PKCS#8 private keys of each key type
+type keyPool struct {
+	keys map[string]chan []byte
+}
+
+// KeyPoolTypes returns the key types StartKeyPool accepts: rsa-2048,
+// rsa-3072, rsa-4096, ec-p256 and ec-p384. Ed25519 keys generate too fast
+// to need a pool.
+func KeyPoolTypes() []string {
+	seen := make(map[string]bool)
+	var types []string
+	for _, spec := range algorithms {
+		if keyType := spec.poolKeyType(); keyType != "" && !seen[keyType] {
+			seen[keyType] = true
+			types = append(types, keyType)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// poolKeyType is the key pool type of an algorithm's keys, or "" for keys
+// that are not pooled
+func (spec algorithmSpec) poolKeyType() string {
+	switch {
+	case spec.rsaBits > 0:
+		return fmt.Sprintf("rsa-%d", spec.rsaBits)
+	case spec.curve == elliptic.P256():
+		return "ec-p256"
+	case spec.curve == elliptic.P384():
+		return "ec-p384"
+	}
+	return ""
+}
+
+// ParseKeyPool parses a key pool size list such as rsa-2048=8,ec-p256=16
+// into the number of keys to keep of each type
+func ParseKeyPool(s string) (map[string]int, error) {
+	return parseKeyCounts(s)
+}
+
+// parseKeyCounts parses a comma-separated list of type=count entries
+func parseKeyCounts(s string) (map[string]int, error) {
+	sizes := make(map[string]int)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		keyType, countStr, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("entry %q must be type=count", part)
+		}
+		count, err := strconv.Atoi(countStr)
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("invalid key count %q for %s", countStr, keyType)
+		}
+		sizes[keyType] = count
+	}
+	return sizes, nil
+}
+
+// StartKeyPool keeps sizes[type] keys of each key type generated ahead (see
+// KeyPoolTypes), refilling the pools in the background until ctx is
+// cancelled. Each type is generated by one goroutine, one key at a time.
+func (s *Storage) StartKeyPool(ctx context.Context, sizes map[string]int) error {
+	known := KeyPoolTypes()
+	pool := &keyPool{keys: make(map[string]chan []byte)}
+	for keyType, size := range sizes {
+		spec, ok := poolKeySpec(keyType)
+		if !ok {
+			return fmt.Errorf("unknown key pool type %q (expected one of %s)", keyType, strings.Join(known, ", "))
+		}
+		if size <= 0 {
+			continue
+		}
+		keys := make(chan []byte, size)
+		pool.keys[keyType] = keys
+		go fillKeyPool(ctx, spec, keys)
+	}
+	s.keyPool.Store(pool)
+	return nil
+}
+
+// poolKeySpec returns the spec of an algorithm whose keys have keyType
+func poolKeySpec(keyType string) (algorithmSpec, bool) {
+	for _, spec := range algorithms {
+		if spec.poolKeyType() == keyType {
+			return spec, true
+		}
+	}
+	return algorithmSpec{}, false
+}
+
+func fillKeyPool(ctx context.Context, spec algorithmSpec, keys chan<- []byte) {
+	for ctx.Err() == nil {
+		key, err := generatePrivateKey(spec)
+		if err != nil {
+			return
+		}
+		select {
+		case keys <- key:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pooledKey takes a pre-generated private key for an algorithm, reporting
+// false if there is no pool for its key type or the pool is empty
+func (s *Storage) pooledKey(spec algorithmSpec) ([]byte, bool) {
+	pool := s.keyPool.Load()
+	if pool == nil {
+		return nil, false
+	}
+	keys := pool.keys[spec.poolKeyType()]
+	if keys == nil {
+		return nil, false
+	}
+	select {
+	case key := <-keys:
+		return key, true
+	default:
+		return nil, false
+	}
+}
+
+// KeyPoolSizes returns how many keys of each type are ready in the pool
+func (s *Storage) KeyPoolSizes() map[string]int {
+	sizes := make(map[string]int)
+	if pool := s.keyPool.Load(); pool != nil {
+		for keyType, keys := range pool.keys {
+			sizes[keyType] = len(keys)
+		}
+	}
+	return sizes
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+func TestParseKeyPool(t *testing.T) {
+	sizes, err := ParseKeyPool("rsa-4096=2, ec-p256=8,,rsa-2048=0")
+	if err != nil {
+		t.Fatalf("ParseKeyPool failed: %v", err)
+	}
+	if len(sizes) != 3 || sizes["rsa-4096"] != 2 || sizes["ec-p256"] != 8 || sizes["rsa-2048"] != 0 {
+		t.Errorf("ParseKeyPool = %v", sizes)
+	}
+
+	for _, bad := range []string{"rsa-4096", "rsa-4096=x", "ec-p256=-1"} {
+		if _, err := ParseKeyPool(bad); err == nil {
+			t.Errorf("Expected ParseKeyPool(%q) to fail", bad)
+		}
+	}
+}
+
+func TestStartKeyPoolUnknownType(t *testing.T) {
+	s := NewStorage()
+	if err := s.StartKeyPool(context.Background(), map[string]int{"rsa-1024": 1}); err == nil {
+		t.Error("Expected an unknown key type to fail")
+	}
+	if got := KeyPoolTypes(); len(got) != 5 || got[0] != "ec-p256" || got[4] != "rsa-4096" {
+		t.Errorf("KeyPoolTypes = %v", got)
+	}
+}
+
+func TestStartKeyPool(t *testing.T) {
+	s := NewStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.StartKeyPool(ctx, map[string]int{"ec-p256": 2, "rsa-4096": 0}); err != nil {
+		t.Fatalf("StartKeyPool failed: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for s.KeyPoolSizes()["ec-p256"] < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Pool did not fill: %v", s.KeyPoolSizes())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := s.KeyPoolSizes()["rsa-4096"]; ok {
+		t.Error("Expected no pool for a size of 0")
+	}
+}
+
+func TestKeyPool(t *testing.T) {
+	s := NewStorage()
+
+	// A pool holding two known keys, with nothing refilling it
+	spec := algorithms[kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256]
+	keys := make(chan []byte, 2)
+	var pooled [][]byte
+	for range 2 {
+		key, err := generatePrivateKey(spec)
+		if err != nil {
+			t.Fatalf("generatePrivateKey failed: %v", err)
+		}
+		keys <- key
+		pooled = append(pooled, key)
+	}
+	s.keyPool.Store(&keyPool{keys: map[string]chan []byte{"ec-p256": keys}})
+
+	ring := "projects/test/locations/global/keyRings/ring1"
+	if _, err := s.CreateKeyRing(ring); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	create := func(id string, algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm) *StoredCryptoKeyVersion {
+		t.Helper()
+		purpose, _ := AlgorithmPurpose(algorithm)
+		key, err := s.CreateCryptoKey(ring, id, purpose, &kmspb.CryptoKeyVersionTemplate{Algorithm: algorithm}, nil)
+		if err != nil {
+			t.Fatalf("CreateCryptoKey failed: %v", err)
+		}
+		return s.keyrings[ring].CryptoKeys[key.Name].Versions[key.Name+"/cryptoKeyVersions/1"]
+	}
+
+	// Other key types do not draw from the pool
+	create("p384", kmspb.CryptoKeyVersion_EC_SIGN_P384_SHA384)
+	if got := s.KeyPoolSizes()["ec-p256"]; got != 2 {
+		t.Errorf("Pool has %d keys after creating a P-384 key, expected 2", got)
+	}
+
+	// Pooled keys are used once each, then keys are generated on demand
+	for i, id := range []string{"a", "b", "c"} {
+		version := create(id, kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256)
+		fromPool := i < len(pooled) && bytes.Equal(version.PrivateKey, pooled[i])
+		if fromPool != (i < len(pooled)) {
+			t.Errorf("Key %s: from pool %v, expected %v", id, fromPool, i < len(pooled))
+		}
+
+		digest := sha256.Sum256([]byte("message"))
+		signature, _, err := s.AsymmetricSign(version.Name, &kmspb.Digest{Digest: &kmspb.Digest_Sha256{Sha256: digest[:]}}, nil)
+		if err != nil {
+			t.Fatalf("AsymmetricSign failed: %v", err)
+		}
+		if !ecdsa.VerifyASN1(publicKeyOf(t, s, version.Name).(*ecdsa.PublicKey), digest[:], signature) {
+			t.Error("Signature does not verify")
+		}
+	}
+	if got := s.KeyPoolSizes()["ec-p256"]; got != 0 {
+		t.Errorf("Pool has %d keys, expected 0", got)
+	}
+}
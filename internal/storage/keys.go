@@ -0,0 +1,314 @@
+package storage
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"sort"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+// algorithmSpec describes how keys for one CryptoKeyVersionAlgorithm are
+// generated and used
+type algorithmSpec struct {
+	purpose kmspb.CryptoKey_CryptoKeyPurpose
+	// keyBytes is the length of symmetric and HMAC keys
+	keyBytes int
+	// rsaBits, curve and ed25519 select the asymmetric key type
+	rsaBits int
+	curve   elliptic.Curve
+	ed25519 bool
+	// hash is the digest signed, used by OAEP or used by HMAC; zero for raw
+	// PKCS#1 and Ed25519
+	hash crypto.Hash
+	// pss selects RSASSA-PSS over PKCS#1 v1.5 signatures
+	pss bool
+}
+
+// algorithms lists every algorithm the emulator can create keys with
+var algorithms = map[kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm]algorithmSpec{
+	kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION: {purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT, keyBytes: 32},
+
+	kmspb.CryptoKeyVersion_RSA_SIGN_PSS_2048_SHA256:   {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 2048, hash: crypto.SHA256, pss: true},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PSS_3072_SHA256:   {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 3072, hash: crypto.SHA256, pss: true},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PSS_4096_SHA256:   {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 4096, hash: crypto.SHA256, pss: true},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PSS_4096_SHA512:   {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 4096, hash: crypto.SHA512, pss: true},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_2048_SHA256: {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 2048, hash: crypto.SHA256},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_3072_SHA256: {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 3072, hash: crypto.SHA256},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_4096_SHA256: {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 4096, hash: crypto.SHA256},
+	kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_4096_SHA512: {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 4096, hash: crypto.SHA512},
+	kmspb.CryptoKeyVersion_RSA_SIGN_RAW_PKCS1_2048:    {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 2048},
+	kmspb.CryptoKeyVersion_RSA_SIGN_RAW_PKCS1_3072:    {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 3072},
+	kmspb.CryptoKeyVersion_RSA_SIGN_RAW_PKCS1_4096:    {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, rsaBits: 4096},
+	kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256:        {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, curve: elliptic.P256(), hash: crypto.SHA256},
+	kmspb.CryptoKeyVersion_EC_SIGN_P384_SHA384:        {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, curve: elliptic.P384(), hash: crypto.SHA384},
+	kmspb.CryptoKeyVersion_EC_SIGN_ED25519:            {purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN, ed25519: true},
+
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_2048_SHA256: {purpose: kmspb.CryptoKey_ASYMMETRIC_DECRYPT, rsaBits: 2048, hash: crypto.SHA256},
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_3072_SHA256: {purpose: kmspb.CryptoKey_ASYMMETRIC_DECRYPT, rsaBits: 3072, hash: crypto.SHA256},
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_4096_SHA256: {purpose: kmspb.CryptoKey_ASYMMETRIC_DECRYPT, rsaBits: 4096, hash: crypto.SHA256},
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_4096_SHA512: {purpose: kmspb.CryptoKey_ASYMMETRIC_DECRYPT, rsaBits: 4096, hash: crypto.SHA512},
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_2048_SHA1:   {purpose: kmspb.CryptoKey_ASYMMETRIC_DECRYPT, rsaBits: 2048, hash: crypto.SHA1},
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_3072_SHA1:   {purpose: kmspb.CryptoKey_ASYMMETRIC_DECRYPT, rsaBits: 3072, hash: crypto.SHA1},
+	kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_4096_SHA1:   {purpose: kmspb.CryptoKey_ASYMMETRIC_DECRYPT, rsaBits: 4096, hash: crypto.SHA1},
+
+	kmspb.CryptoKeyVersion_HMAC_SHA256: {purpose: kmspb.CryptoKey_MAC, keyBytes: 32, hash: crypto.SHA256},
+	kmspb.CryptoKeyVersion_HMAC_SHA1:   {purpose: kmspb.CryptoKey_MAC, keyBytes: 20, hash: crypto.SHA1},
+	kmspb.CryptoKeyVersion_HMAC_SHA384: {purpose: kmspb.CryptoKey_MAC, keyBytes: 48, hash: crypto.SHA384},
+	kmspb.CryptoKeyVersion_HMAC_SHA512: {purpose: kmspb.CryptoKey_MAC, keyBytes: 64, hash: crypto.SHA512},
+	kmspb.CryptoKeyVersion_HMAC_SHA224: {purpose: kmspb.CryptoKey_MAC, keyBytes: 28, hash: crypto.SHA224},
+}
+
+// Algorithms returns the algorithms keys can be created with, in enum order
+func Algorithms() []kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm {
+	list := make([]kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm, 0, len(algorithms))
+	for algorithm := range algorithms {
+		list = append(list, algorithm)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
+
+// Purposes returns the key purposes that have at least one supported
+// algorithm, in enum order
+func Purposes() []kmspb.CryptoKey_CryptoKeyPurpose {
+	seen := make(map[kmspb.CryptoKey_CryptoKeyPurpose]bool)
+	var list []kmspb.CryptoKey_CryptoKeyPurpose
+	for _, spec := range algorithms {
+		if !seen[spec.purpose] {
+			seen[spec.purpose] = true
+			list = append(list, spec.purpose)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
+
+// AlgorithmPurpose returns the key purpose an algorithm belongs to, or false
+// if the emulator does not support the algorithm
+func AlgorithmPurpose(algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm) (kmspb.CryptoKey_CryptoKeyPurpose, bool) {
+	spec, ok := algorithms[algorithm]
+	return spec.purpose, ok
+}
+
+// IsAsymmetric reports whether a purpose uses public key cryptography
+func IsAsymmetric(purpose kmspb.CryptoKey_CryptoKeyPurpose) bool {
+	return purpose == kmspb.CryptoKey_ASYMMETRIC_SIGN || purpose == kmspb.CryptoKey_ASYMMETRIC_DECRYPT
+}
+
+// generateKeyMaterial creates key material for a new version. Symmetric
+// algorithms return a secret key; asymmetric ones a PKCS#8 private key.
+func generateKeyMaterial(algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm) (symmetricKey, privateKey []byte, err error) {
+	spec, ok := algorithms[algorithm]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported algorithm: %s", algorithm)
+	}
+
+	if spec.keyBytes > 0 {
+		symmetricKey = make([]byte, spec.keyBytes)
+		if _, err := io.ReadFull(rand.Reader, symmetricKey); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+		}
+		return symmetricKey, nil, nil
+	}
+	privateKey, err = generatePrivateKey(spec)
+	return nil, privateKey, err
+}
+
+// generatePrivateKey creates the PKCS#8 private key of an asymmetric
+// algorithm
+func generatePrivateKey(spec algorithmSpec) ([]byte, error) {
+	var key crypto.Signer
+	var err error
+	switch {
+	case spec.rsaBits > 0:
+		key, err = rsa.GenerateKey(rand.Reader, spec.rsaBits)
+	case spec.curve != nil:
+		key, err = ecdsa.GenerateKey(spec.curve, rand.Reader)
+	case spec.ed25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("algorithm has no private key")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode private key: %w", err)
+	}
+	return der, nil
+}
+
+// newKeyMaterial is generateKeyMaterial, taking asymmetric keys from the
+// key pool when it has one ready (see keypool.go)
+func (s *Storage) newKeyMaterial(algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm) (symmetricKey, privateKey []byte, err error) {
+	if spec, ok := algorithms[algorithm]; ok {
+		if key, ok := s.pooledKey(spec); ok {
+			return nil, key, nil
+		}
+	}
+	return generateKeyMaterial(algorithm)
+}
+
+// parsePrivateKey decodes the private key of an asymmetric version
+func parsePrivateKey(version *StoredCryptoKeyVersion) (crypto.Signer, error) {
+	if len(version.PrivateKey) == 0 {
+		return nil, fmt.Errorf("crypto key version has no private key: %s", version.Name)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(version.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key for %s: %w", version.Name, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("invalid private key type %T for %s", key, version.Name)
+	}
+	return signer, nil
+}
+
+// publicKeyPEM returns the PEM-encoded SubjectPublicKeyInfo of a version's
+// private key
+func publicKeyPEM(key crypto.Signer) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return "", fmt.Errorf("failed to encode public key: %w", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+// sign signs with the private key of an ASYMMETRIC_SIGN version. Ed25519
+// and raw PKCS#1 sign data as given; the other algorithms sign digest, or
+// the hash of data when no digest is supplied.
+func sign(key crypto.Signer, version *StoredCryptoKeyVersion, digest *kmspb.Digest, data []byte) ([]byte, error) {
+	spec := algorithms[version.Algorithm]
+	if spec.hash == 0 {
+		if digest != nil {
+			return nil, fmt.Errorf("algorithm %s does not accept a digest, sign data instead", version.Algorithm)
+		}
+		// RSA keys sign data without a DigestInfo prefix for hash 0
+		return key.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+
+	var sum []byte
+	var err error
+	if digest != nil {
+		if sum, err = digestValue(version.Algorithm, spec.hash, digest); err != nil {
+			return nil, err
+		}
+	} else {
+		h := spec.hash.New()
+		h.Write(data)
+		sum = h.Sum(nil)
+	}
+
+	var opts crypto.SignerOpts = spec.hash
+	if spec.pss {
+		// Cloud KMS uses a salt as long as the digest
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: spec.hash}
+	}
+	// ECDSA signatures are ASN.1 DER encoded, as Cloud KMS returns them
+	return key.Sign(rand.Reader, sum, opts)
+}
+
+// VerifySignature checks a signature made by an ASYMMETRIC_SIGN version over
+// data, given the version's PEM public key. Digests are computed from data
+// as Cloud KMS does when it signs data.
+func VerifySignature(algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm, publicKeyPEM string, data, signature []byte) error {
+	spec, ok := algorithms[algorithm]
+	if !ok || spec.purpose != kmspb.CryptoKey_ASYMMETRIC_SIGN {
+		return fmt.Errorf("algorithm %s does not support signing", algorithm)
+	}
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return fmt.Errorf("invalid public key PEM")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+
+	sum := data
+	if spec.hash != 0 {
+		h := spec.hash.New()
+		h.Write(data)
+		sum = h.Sum(nil)
+	}
+	valid := false
+	switch pub := key.(type) {
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(pub, sum, signature)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(pub, data, signature)
+	case *rsa.PublicKey:
+		if spec.pss {
+			err = rsa.VerifyPSS(pub, spec.hash, sum, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: spec.hash})
+		} else {
+			err = rsa.VerifyPKCS1v15(pub, spec.hash, sum, signature)
+		}
+		valid = err == nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+	if !valid {
+		return fmt.Errorf("signature verification failed")
+	}
+	return nil
+}
+
+// digestValue returns the digest bytes after checking they were computed
+// with the hash the algorithm expects
+func digestValue(algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm, hash crypto.Hash, digest *kmspb.Digest) ([]byte, error) {
+	var got crypto.Hash
+	var sum []byte
+	switch d := digest.Digest.(type) {
+	case *kmspb.Digest_Sha256:
+		got, sum = crypto.SHA256, d.Sha256
+	case *kmspb.Digest_Sha384:
+		got, sum = crypto.SHA384, d.Sha384
+	case *kmspb.Digest_Sha512:
+		got, sum = crypto.SHA512, d.Sha512
+	default:
+		return nil, fmt.Errorf("algorithm %s does not accept an empty digest", algorithm)
+	}
+
+	if got != hash {
+		return nil, fmt.Errorf("algorithm %s does not accept a %s digest, expected %s", algorithm, got, hash)
+	}
+	if len(sum) != hash.Size() {
+		return nil, fmt.Errorf("algorithm %s does not accept a %d-byte %s digest, expected %d bytes", algorithm, len(sum), hash, hash.Size())
+	}
+	return sum, nil
+}
+
+// decryptOAEP decrypts with the private key of an ASYMMETRIC_DECRYPT version
+func decryptOAEP(key crypto.Signer, version *StoredCryptoKeyVersion, ciphertext []byte) ([]byte, error) {
+	spec := algorithms[version.Algorithm]
+	decrypter, ok := key.(crypto.Decrypter)
+	if !ok {
+		return nil, fmt.Errorf("invalid private key type %T for %s", key, version.Name)
+	}
+
+	plaintext, err := decrypter.Decrypt(rand.Reader, ciphertext, &rsa.OAEPOptions{Hash: spec.hash})
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: verify that the ciphertext was encrypted with the public key of %s", version.Name)
+	}
+	return plaintext, nil
+}
+
+// computeMAC returns the HMAC tag of data under a MAC version's key
+func computeMAC(version *StoredCryptoKeyVersion, data []byte) []byte {
+	mac := hmac.New(algorithms[version.Algorithm].hash.New, version.SymmetricKey)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
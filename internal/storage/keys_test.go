@@ -0,0 +1,327 @@
+package storage
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+func createKeyWithAlgorithm(t *testing.T, s *Storage, algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm) string {
+	t.Helper()
+
+	if _, err := s.CreateKeyRing("projects/test/locations/global/keyRings/ring1"); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	purpose, ok := AlgorithmPurpose(algorithm)
+	if !ok {
+		t.Fatalf("Algorithm %v not supported", algorithm)
+	}
+	key, err := s.CreateCryptoKey(
+		"projects/test/locations/global/keyRings/ring1",
+		"key1",
+		purpose,
+		&kmspb.CryptoKeyVersionTemplate{Algorithm: algorithm},
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+	return key.Name + "/cryptoKeyVersions/1"
+}
+
+func TestGetPublicKey(t *testing.T) {
+	s := NewStorage()
+	versionName := createKeyWithAlgorithm(t, s, kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256)
+
+	publicKey, err := s.GetPublicKey(versionName)
+	if err != nil {
+		t.Fatalf("GetPublicKey failed: %v", err)
+	}
+
+	if publicKey.Algorithm != kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256 {
+		t.Errorf("Expected algorithm EC_SIGN_P256_SHA256, got %v", publicKey.Algorithm)
+	}
+
+	block, _ := pem.Decode([]byte(publicKey.Pem))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		t.Fatalf("Expected a PUBLIC KEY PEM block, got %q", publicKey.Pem)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("ParsePKIXPublicKey failed: %v", err)
+	}
+	if _, ok := parsed.(*ecdsa.PublicKey); !ok {
+		t.Errorf("Expected an ECDSA public key, got %T", parsed)
+	}
+
+	if _, err := s.UpdateCryptoKeyVersion(versionName, kmspb.CryptoKeyVersion_DISABLED, ""); err != nil {
+		t.Fatalf("UpdateCryptoKeyVersion failed: %v", err)
+	}
+	if _, err := s.GetPublicKey(versionName); err == nil {
+		t.Error("Expected error for disabled version, got nil")
+	}
+}
+
+func TestGetPublicKeySymmetric(t *testing.T) {
+	s := NewStorage()
+	if _, err := s.CreateKeyRing("projects/test/locations/global/keyRings/ring1"); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	key, err := s.CreateCryptoKey("projects/test/locations/global/keyRings/ring1", "key1", kmspb.CryptoKey_ENCRYPT_DECRYPT, nil, nil)
+	if err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+
+	if _, err := s.GetPublicKey(key.Primary.Name); err == nil {
+		t.Error("Expected error for symmetric key, got nil")
+	}
+}
+
+func TestAsymmetricKeyStateRoundTrip(t *testing.T) {
+	s := NewStorage()
+	versionName := createKeyWithAlgorithm(t, s, kmspb.CryptoKeyVersion_EC_SIGN_ED25519)
+
+	before, err := s.GetPublicKey(versionName)
+	if err != nil {
+		t.Fatalf("GetPublicKey failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.SaveState(&buf); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	restored := NewStorage()
+	if _, err := restored.LoadState(&buf); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+
+	after, err := restored.GetPublicKey(versionName)
+	if err != nil {
+		t.Fatalf("GetPublicKey after restore failed: %v", err)
+	}
+	if after.Pem != before.Pem {
+		t.Error("Public key changed across save and load")
+	}
+}
+
+func TestLoadStateVersion1(t *testing.T) {
+	s := NewStorage()
+	doc := `{"version": 1, "keyRings": [{"name": "projects/test/locations/global/keyRings/ring1", "cryptoKeys": []}]}`
+
+	from, err := s.LoadState(bytes.NewBufferString(doc))
+	if err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	if from != 1 {
+		t.Errorf("Expected version 1, got %d", from)
+	}
+	if _, err := s.GetKeyRing("projects/test/locations/global/keyRings/ring1"); err != nil {
+		t.Errorf("GetKeyRing after migration failed: %v", err)
+	}
+}
+
+func publicKeyOf(t *testing.T, s *Storage, versionName string) crypto.PublicKey {
+	t.Helper()
+
+	publicKey, err := s.GetPublicKey(versionName)
+	if err != nil {
+		t.Fatalf("GetPublicKey failed: %v", err)
+	}
+	block, _ := pem.Decode([]byte(publicKey.Pem))
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("ParsePKIXPublicKey failed: %v", err)
+	}
+	return parsed
+}
+
+func TestAsymmetricSign(t *testing.T) {
+	message := []byte("message to sign")
+	sum := sha256.Sum256(message)
+	sha256Digest := &kmspb.Digest{Digest: &kmspb.Digest_Sha256{Sha256: sum[:]}}
+
+	tests := []struct {
+		name      string
+		algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm
+		digest    *kmspb.Digest
+		data      []byte
+		verify    func(pub crypto.PublicKey, signature []byte) bool
+	}{
+		{
+			name:      "EC P-256 digest",
+			algorithm: kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256,
+			digest:    sha256Digest,
+			verify: func(pub crypto.PublicKey, signature []byte) bool {
+				return ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), sum[:], signature)
+			},
+		},
+		{
+			name:      "EC P-256 data",
+			algorithm: kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256,
+			data:      message,
+			verify: func(pub crypto.PublicKey, signature []byte) bool {
+				return ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), sum[:], signature)
+			},
+		},
+		{
+			name:      "RSA PSS",
+			algorithm: kmspb.CryptoKeyVersion_RSA_SIGN_PSS_2048_SHA256,
+			digest:    sha256Digest,
+			verify: func(pub crypto.PublicKey, signature []byte) bool {
+				opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+				return rsa.VerifyPSS(pub.(*rsa.PublicKey), crypto.SHA256, sum[:], signature, opts) == nil
+			},
+		},
+		{
+			name:      "RSA PKCS#1",
+			algorithm: kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_2048_SHA256,
+			digest:    sha256Digest,
+			verify: func(pub crypto.PublicKey, signature []byte) bool {
+				return rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, sum[:], signature) == nil
+			},
+		},
+		{
+			name:      "Ed25519",
+			algorithm: kmspb.CryptoKeyVersion_EC_SIGN_ED25519,
+			data:      message,
+			verify: func(pub crypto.PublicKey, signature []byte) bool {
+				return ed25519.Verify(pub.(ed25519.PublicKey), message, signature)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStorage()
+			versionName := createKeyWithAlgorithm(t, s, tt.algorithm)
+
+			signature, _, err := s.AsymmetricSign(versionName, tt.digest, tt.data)
+			if err != nil {
+				t.Fatalf("AsymmetricSign failed: %v", err)
+			}
+			if !tt.verify(publicKeyOf(t, s, versionName), signature) {
+				t.Error("Signature did not verify with the public key")
+			}
+		})
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	message := []byte("message to sign")
+	for _, algorithm := range []kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm{
+		kmspb.CryptoKeyVersion_EC_SIGN_P384_SHA384,
+		kmspb.CryptoKeyVersion_EC_SIGN_ED25519,
+		kmspb.CryptoKeyVersion_RSA_SIGN_PSS_2048_SHA256,
+		kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_2048_SHA256,
+		kmspb.CryptoKeyVersion_RSA_SIGN_RAW_PKCS1_2048,
+	} {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			s := NewStorage()
+			versionName := createKeyWithAlgorithm(t, s, algorithm)
+			publicKey, err := s.GetPublicKey(versionName)
+			if err != nil {
+				t.Fatalf("GetPublicKey failed: %v", err)
+			}
+			signature, _, err := s.AsymmetricSign(versionName, nil, message)
+			if err != nil {
+				t.Fatalf("AsymmetricSign failed: %v", err)
+			}
+
+			if err := VerifySignature(algorithm, publicKey.Pem, message, signature); err != nil {
+				t.Errorf("VerifySignature failed: %v", err)
+			}
+			if err := VerifySignature(algorithm, publicKey.Pem, []byte("other message"), signature); err == nil {
+				t.Error("Expected a signature over another message to fail")
+			}
+		})
+	}
+}
+
+func TestAsymmetricSignInvalidDigest(t *testing.T) {
+	s := NewStorage()
+	versionName := createKeyWithAlgorithm(t, s, kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256)
+
+	tests := []struct {
+		name   string
+		digest *kmspb.Digest
+	}{
+		{"wrong hash", &kmspb.Digest{Digest: &kmspb.Digest_Sha384{Sha384: make([]byte, 48)}}},
+		{"wrong length", &kmspb.Digest{Digest: &kmspb.Digest_Sha256{Sha256: make([]byte, 20)}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := s.AsymmetricSign(versionName, tt.digest, nil); err == nil {
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+
+	edStorage := NewStorage()
+	ed := createKeyWithAlgorithm(t, edStorage, kmspb.CryptoKeyVersion_EC_SIGN_ED25519)
+	if _, _, err := edStorage.AsymmetricSign(ed, &kmspb.Digest{Digest: &kmspb.Digest_Sha256{Sha256: make([]byte, 32)}}, nil); err == nil {
+		t.Error("Expected error signing a digest with Ed25519, got nil")
+	}
+}
+
+func TestAsymmetricDecrypt(t *testing.T) {
+	s := NewStorage()
+	versionName := createKeyWithAlgorithm(t, s, kmspb.CryptoKeyVersion_RSA_DECRYPT_OAEP_2048_SHA256)
+	pub := publicKeyOf(t, s, versionName).(*rsa.PublicKey)
+
+	plaintext := []byte("secret")
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, plaintext, nil)
+	if err != nil {
+		t.Fatalf("EncryptOAEP failed: %v", err)
+	}
+
+	decrypted, _, err := s.AsymmetricDecrypt(versionName, ciphertext)
+	if err != nil {
+		t.Fatalf("AsymmetricDecrypt failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("Expected %q, got %q", plaintext, decrypted)
+	}
+
+	if _, _, err := s.AsymmetricDecrypt(versionName, []byte("not a ciphertext")); err == nil {
+		t.Error("Expected error for invalid ciphertext, got nil")
+	}
+	if _, _, err := s.AsymmetricSign(versionName, nil, plaintext); err == nil {
+		t.Error("Expected error signing with a decryption key, got nil")
+	}
+}
+
+func TestMacSignVerify(t *testing.T) {
+	s := NewStorage()
+	versionName := createKeyWithAlgorithm(t, s, kmspb.CryptoKeyVersion_HMAC_SHA256)
+	data := []byte("message")
+
+	mac, _, err := s.MacSign(versionName, data)
+	if err != nil {
+		t.Fatalf("MacSign failed: %v", err)
+	}
+	if len(mac) != sha256.Size {
+		t.Errorf("Expected a %d-byte tag, got %d", sha256.Size, len(mac))
+	}
+
+	ok, _, err := s.MacVerify(versionName, data, mac)
+	if err != nil || !ok {
+		t.Errorf("MacVerify of a valid tag: ok=%v err=%v", ok, err)
+	}
+	ok, _, err = s.MacVerify(versionName, []byte("other message"), mac)
+	if err != nil || ok {
+		t.Errorf("MacVerify of a mismatched tag: ok=%v err=%v", ok, err)
+	}
+
+	if _, _, _, err := s.Encrypt("projects/test/locations/global/keyRings/ring1/cryptoKeys/key1", data, nil); err == nil {
+		t.Error("Expected error encrypting with a MAC key, got nil")
+	}
+}
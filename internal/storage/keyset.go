@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+// SymmetricVersion is the raw key material of a symmetric encryption or
+// HMAC key version, the unit exported to and imported from keysets of
+// other libraries such as Tink
+type SymmetricVersion struct {
+	// ID is the version ID, the last segment of its name. It is ignored on
+	// import, where versions get the key's next IDs.
+	ID        uint32
+	Algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm
+	// State is ENABLED or DISABLED
+	State   kmspb.CryptoKeyVersion_CryptoKeyVersionState
+	Primary bool
+	Key     []byte
+}
+
+// ExportSymmetricVersions returns the key material of the enabled and
+// disabled versions of a symmetric encryption or MAC key, ordered by ID.
+// Destroyed and pending versions have no usable material and are left out.
+func (s *Storage) ExportSymmetricVersions(keyName string) ([]SymmetricVersion, error) {
+	defer s.rlockKeyRing(keyName)()
+
+	cryptoKey := s.findCryptoKey(keyName)
+	if cryptoKey == nil {
+		return nil, fmt.Errorf("crypto key not found: %s", keyName)
+	}
+	if cryptoKey.Purpose != kmspb.CryptoKey_ENCRYPT_DECRYPT && cryptoKey.Purpose != kmspb.CryptoKey_MAC {
+		return nil, fmt.Errorf("crypto key %s has purpose %s; only ENCRYPT_DECRYPT and MAC keys can be exported", keyName, cryptoKey.Purpose)
+	}
+
+	var versions []SymmetricVersion
+	for name, version := range cryptoKey.Versions {
+		if version.State != kmspb.CryptoKeyVersion_ENABLED && version.State != kmspb.CryptoKeyVersion_DISABLED {
+			continue
+		}
+		if version.Backend != "" {
+			return nil, fmt.Errorf("key material of %s is held by key backend %s and cannot be exported", name, version.Backend)
+		}
+		id, err := strconv.ParseUint(name[strings.LastIndex(name, "/")+1:], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("version %s has no numeric ID", name)
+		}
+		versions = append(versions, SymmetricVersion{
+			ID:        uint32(id),
+			Algorithm: version.Algorithm,
+			State:     version.State,
+			Primary:   name == cryptoKey.PrimaryVersion,
+			Key:       bytes.Clone(version.SymmetricKey),
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].ID < versions[j].ID })
+	return versions, nil
+}
+
+// ImportSymmetricVersions adds a version to a key for each of versions,
+// keeping their states, and makes the one marked primary the key's primary.
+// Every version is checked before any is added, so a bad one leaves the
+// key unchanged.
+func (s *Storage) ImportSymmetricVersions(keyName string, versions []SymmetricVersion) ([]*kmspb.CryptoKeyVersion, error) {
+	defer s.lockKeyRing(keyName)()
+
+	cryptoKey := s.findCryptoKey(keyName)
+	if cryptoKey == nil {
+		return nil, fmt.Errorf("crypto key not found: %s", keyName)
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("no key versions to import")
+	}
+	for _, v := range versions {
+		if purpose, ok := AlgorithmPurpose(v.Algorithm); !ok || purpose != cryptoKey.Purpose {
+			return nil, fmt.Errorf("algorithm %s is not valid for purpose %s", v.Algorithm, cryptoKey.Purpose)
+		}
+		if v.State != kmspb.CryptoKeyVersion_ENABLED && v.State != kmspb.CryptoKeyVersion_DISABLED {
+			return nil, fmt.Errorf("invalid state %s for an imported version; expected ENABLED or DISABLED", v.State)
+		}
+		if v.Primary && v.State != kmspb.CryptoKeyVersion_ENABLED {
+			return nil, fmt.Errorf("the primary version must be ENABLED")
+		}
+		if algorithms[v.Algorithm].keyBytes == 0 {
+			return nil, fmt.Errorf("algorithm %s does not use symmetric key material", v.Algorithm)
+		}
+		if _, _, err := importKeyMaterial(v.Algorithm, v.Key); err != nil {
+			return nil, fmt.Errorf("invalid key material for algorithm %s: %w", v.Algorithm, err)
+		}
+	}
+
+	imported := make([]*kmspb.CryptoKeyVersion, 0, len(versions))
+	for _, v := range versions {
+		version := s.addImportedVersion(cryptoKey, keyName, v.Algorithm, templateProtectionLevel(cryptoKey.VersionTemplate), bytes.Clone(v.Key), nil)
+		version.ImportTime = version.CreateTime
+		version.State = v.State
+		if v.Primary && HasPrimaryVersion(cryptoKey.Purpose) {
+			cryptoKey.PrimaryVersion = version.Name
+		}
+		imported = append(imported, versionProto(version))
+	}
+	return imported, nil
+}
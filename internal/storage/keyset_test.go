@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+func TestSymmetricVersions(t *testing.T) {
+	s, version, _ := newDestroyTestStorage(t)
+	disabled, err := s.CreateCryptoKeyVersion(destroyTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UpdateCryptoKeyVersion(disabled.Name, kmspb.CryptoKeyVersion_DISABLED, ""); err != nil {
+		t.Fatal(err)
+	}
+	destroyed, err := s.CreateCryptoKeyVersion(destroyTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DestroyCryptoKeyVersion(destroyed.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := s.ExportSymmetricVersions(destroyTestKey)
+	if err != nil {
+		t.Fatalf("ExportSymmetricVersions failed: %v", err)
+	}
+	if len(versions) != 2 || versions[0].ID != 1 || !versions[0].Primary || !bytes.Equal(versions[0].Key, version.SymmetricKey) ||
+		versions[1].ID != 2 || versions[1].State != kmspb.CryptoKeyVersion_DISABLED {
+		t.Fatalf("Expected the enabled primary and the disabled version, got %+v", versions)
+	}
+
+	// Importing them elsewhere keeps states and the primary
+	if _, err := s.CreateCryptoKey("projects/test/locations/global/keyRings/ring1", "copy", kmspb.CryptoKey_ENCRYPT_DECRYPT, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	copyKey := "projects/test/locations/global/keyRings/ring1/cryptoKeys/copy"
+	imported, err := s.ImportSymmetricVersions(copyKey, versions)
+	if err != nil {
+		t.Fatalf("ImportSymmetricVersions failed: %v", err)
+	}
+	if len(imported) != 2 || imported[0].ImportTime == nil || imported[1].State != kmspb.CryptoKeyVersion_DISABLED {
+		t.Errorf("Unexpected imported versions: %v", imported)
+	}
+	if key, _ := s.GetCryptoKey(copyKey); key.Primary.GetName() != imported[0].Name {
+		t.Errorf("Expected %s to be primary, got %s", imported[0].Name, key.Primary.GetName())
+	}
+
+	// A bad version leaves the key unchanged
+	bad := append(versions, SymmetricVersion{Algorithm: kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, State: kmspb.CryptoKeyVersion_ENABLED, Key: []byte("short")})
+	if _, err := s.ImportSymmetricVersions(copyKey, bad); err == nil || !strings.Contains(err.Error(), "invalid key material") {
+		t.Errorf("Expected short key material to be rejected, got %v", err)
+	}
+	if list, _ := s.ListCryptoKeyVersions(copyKey); len(list) != 3 {
+		t.Errorf("Expected the failed import to add nothing, got %d versions", len(list))
+	}
+	mac := []SymmetricVersion{{Algorithm: kmspb.CryptoKeyVersion_HMAC_SHA256, State: kmspb.CryptoKeyVersion_ENABLED, Key: make([]byte, 32)}}
+	if _, err := s.ImportSymmetricVersions(copyKey, mac); err == nil || !strings.Contains(err.Error(), "not valid for purpose") {
+		t.Errorf("Expected an HMAC version to be rejected for an encryption key, got %v", err)
+	}
+}
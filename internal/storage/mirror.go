@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// MirroredKeyRing is a key ring read from Cloud KMS, with its keys
+type MirroredKeyRing struct {
+	KeyRing    *kmspb.KeyRing
+	CryptoKeys []MirroredCryptoKey
+}
+
+// MirroredCryptoKey is a crypto key read from Cloud KMS, with its versions
+type MirroredCryptoKey struct {
+	CryptoKey *kmspb.CryptoKey
+	Versions  []*kmspb.CryptoKeyVersion
+}
+
+// MirrorStats counts the resources added by LoadMirror
+type MirrorStats struct {
+	KeyRings          int `json:"keyRings"`
+	CryptoKeys        int `json:"cryptoKeys"`
+	CryptoKeyVersions int `json:"cryptoKeyVersions"`
+	// Skipped names the keys and versions that could not be mirrored, with
+	// the reason
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// mirroredStates are the version states kept by LoadMirror; versions still
+// being generated or imported, or that failed to be, are skipped
+var mirroredStates = map[kmspb.CryptoKeyVersion_CryptoKeyVersionState]bool{
+	kmspb.CryptoKeyVersion_ENABLED:           true,
+	kmspb.CryptoKeyVersion_DISABLED:          true,
+	kmspb.CryptoKeyVersion_DESTROYED:         true,
+	kmspb.CryptoKeyVersion_DESTROY_SCHEDULED: true,
+}
+
+// LoadMirror adds key rings read from Cloud KMS, keeping their metadata
+// (names, create times, labels, templates, rotation schedules and version
+// states) and generating fresh local key material for every version that is
+// not destroyed.
+//
+// Key rings and keys that already exist are left alone. Versions with
+// algorithms the emulator does not support are skipped, as are keys left
+// without versions. ENCRYPT_DECRYPT keys whose primary version was not
+// mirrored use their newest mirrored version as primary; keys of other
+// purposes have none, as in Cloud KMS.
+func (s *Storage) LoadMirror(rings []MirroredKeyRing) (MirrorStats, error) {
+	var stats MirrorStats
+	type keyToAdd struct {
+		ring string
+		key  *StoredCryptoKey
+	}
+	var newRings []*StoredKeyRing
+	var newKeys []keyToAdd
+
+	// Generate key material without holding the lock
+	s.mu.Lock()
+	existing := make(map[string]bool)
+	for name, ring := range s.keyrings {
+		existing[name] = true
+		for keyName := range ring.CryptoKeys {
+			existing[keyName] = true
+		}
+	}
+	s.mu.Unlock()
+
+	for _, mr := range rings {
+		ringName := mr.KeyRing.GetName()
+		if !existing[ringName] {
+			newRings = append(newRings, &StoredKeyRing{
+				Name:       ringName,
+				CreateTime: s.timeOrNow(mr.KeyRing.GetCreateTime()),
+				CryptoKeys: make(map[string]*StoredCryptoKey),
+				ImportJobs: make(map[string]*StoredImportJob),
+			})
+			existing[ringName] = true
+		}
+		for _, mk := range mr.CryptoKeys {
+			if existing[mk.CryptoKey.GetName()] {
+				continue
+			}
+			key, skipped, err := s.mirroredCryptoKey(mk)
+			if err != nil {
+				return MirrorStats{}, err
+			}
+			stats.Skipped = append(stats.Skipped, skipped...)
+			if key != nil {
+				newKeys = append(newKeys, keyToAdd{ring: ringName, key: key})
+				existing[key.Name] = true
+			}
+		}
+	}
+
+	defer s.lockAll()()
+	for _, ring := range newRings {
+		if _, ok := s.keyrings[ring.Name]; !ok {
+			s.keyrings[ring.Name] = ring
+			stats.KeyRings++
+		}
+	}
+	for _, k := range newKeys {
+		// The ring may have been cleared, or the key created, meanwhile
+		ring, ok := s.keyrings[k.ring]
+		if !ok {
+			continue
+		}
+		if _, ok := ring.CryptoKeys[k.key.Name]; ok {
+			continue
+		}
+		ring.CryptoKeys[k.key.Name] = k.key
+		stats.CryptoKeys++
+		stats.CryptoKeyVersions += len(k.key.Versions)
+	}
+	return stats, nil
+}
+
+// mirroredCryptoKey converts a mirrored key, generating material for its
+// versions. It returns nil if no version could be mirrored.
+func (s *Storage) mirroredCryptoKey(mk MirroredCryptoKey) (*StoredCryptoKey, []string, error) {
+	ck := mk.CryptoKey
+	var skipped []string
+	key := &StoredCryptoKey{
+		Name:          ck.GetName(),
+		CreateTime:    s.timeOrNow(ck.GetCreateTime()),
+		Purpose:       ck.GetPurpose(),
+		Versions:      make(map[string]*StoredCryptoKeyVersion),
+		NextVersionID: 1,
+		Labels:        ck.GetLabels(),
+	}
+	if ck.GetVersionTemplate() != nil {
+		key.VersionTemplate = proto.Clone(ck.GetVersionTemplate()).(*kmspb.CryptoKeyVersionTemplate)
+	}
+	if ck.GetRotationPeriod() != nil {
+		key.RotationPeriod = ck.GetRotationPeriod().AsDuration()
+	}
+	if ck.GetNextRotationTime() != nil {
+		key.NextRotationTime = ck.GetNextRotationTime().AsTime()
+	}
+
+	var newest int64
+	var newestVersion *StoredCryptoKeyVersion
+	for _, v := range mk.Versions {
+		id, err := strconv.ParseInt(v.GetName()[strings.LastIndex(v.GetName(), "/")+1:], 10, 64)
+		if err != nil || !strings.HasPrefix(v.GetName(), key.Name+"/cryptoKeyVersions/") {
+			return nil, nil, fmt.Errorf("crypto key version name is not valid for %s: %s", key.Name, v.GetName())
+		}
+		key.NextVersionID = max(key.NextVersionID, id+1)
+
+		if purpose, ok := AlgorithmPurpose(v.GetAlgorithm()); !ok || purpose != key.Purpose {
+			skipped = append(skipped, fmt.Sprintf("%s: algorithm %s is not supported", v.GetName(), v.GetAlgorithm()))
+			continue
+		}
+		if !mirroredStates[v.GetState()] {
+			skipped = append(skipped, fmt.Sprintf("%s: state %s is not supported", v.GetName(), v.GetState()))
+			continue
+		}
+		version := &StoredCryptoKeyVersion{
+			Name:            v.GetName(),
+			State:           v.GetState(),
+			CreateTime:      s.timeOrNow(v.GetCreateTime()),
+			Algorithm:       v.GetAlgorithm(),
+			ProtectionLevel: v.GetProtectionLevel(),
+		}
+		// Destroyed versions have no material to generate
+		if version.State != kmspb.CryptoKeyVersion_DESTROYED {
+			if version.SymmetricKey, version.PrivateKey, err = generateKeyMaterial(version.Algorithm); err != nil {
+				return nil, nil, err
+			}
+		}
+		key.Versions[version.Name] = version
+		if id > newest {
+			newest = id
+			newestVersion = version
+		}
+	}
+
+	if len(key.Versions) == 0 {
+		return nil, append(skipped, fmt.Sprintf("%s: no versions could be mirrored", key.Name)), nil
+	}
+	if HasPrimaryVersion(key.Purpose) {
+		key.PrimaryVersion = newestVersion.Name
+		if primary := ck.GetPrimary().GetName(); key.Versions[primary] != nil {
+			key.PrimaryVersion = primary
+		}
+	}
+	if key.VersionTemplate == nil {
+		key.VersionTemplate = &kmspb.CryptoKeyVersionTemplate{Algorithm: newestVersion.Algorithm}
+	}
+	return key, skipped, nil
+}
+
+// timeOrNow returns ts, or the storage clock's current time if it is unset
+func (s *Storage) timeOrNow(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return s.now()
+	}
+	return ts.AsTime()
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const mirrorRing = "projects/real/locations/us-east1/keyRings/prod"
+
+func mirroredVersion(key string, id string, state kmspb.CryptoKeyVersion_CryptoKeyVersionState, algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm) *kmspb.CryptoKeyVersion {
+	return &kmspb.CryptoKeyVersion{
+		Name:       mirrorRing + "/cryptoKeys/" + key + "/cryptoKeyVersions/" + id,
+		State:      state,
+		Algorithm:  algorithm,
+		CreateTime: timestamppb.New(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)),
+	}
+}
+
+func TestLoadMirror(t *testing.T) {
+	created := time.Date(2023, 6, 7, 8, 9, 10, 0, time.UTC)
+	enc := mirrorRing + "/cryptoKeys/enc"
+	ring := MirroredKeyRing{
+		KeyRing: &kmspb.KeyRing{Name: mirrorRing, CreateTime: timestamppb.New(created)},
+		CryptoKeys: []MirroredCryptoKey{
+			{
+				CryptoKey: &kmspb.CryptoKey{
+					Name:             enc,
+					Purpose:          kmspb.CryptoKey_ENCRYPT_DECRYPT,
+					CreateTime:       timestamppb.New(created),
+					Primary:          &kmspb.CryptoKeyVersion{Name: enc + "/cryptoKeyVersions/1"},
+					Labels:           map[string]string{"team": "payments"},
+					RotationSchedule: &kmspb.CryptoKey_RotationPeriod{RotationPeriod: durationpb.New(90 * 24 * time.Hour)},
+					VersionTemplate: &kmspb.CryptoKeyVersionTemplate{
+						Algorithm:       kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION,
+						ProtectionLevel: kmspb.ProtectionLevel_HSM,
+					},
+				},
+				Versions: []*kmspb.CryptoKeyVersion{
+					mirroredVersion("enc", "1", kmspb.CryptoKeyVersion_ENABLED, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION),
+					mirroredVersion("enc", "2", kmspb.CryptoKeyVersion_DESTROYED, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION),
+					mirroredVersion("enc", "3", kmspb.CryptoKeyVersion_PENDING_GENERATION, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION),
+				},
+			},
+			{
+				// Asymmetric keys have no primary
+				CryptoKey: &kmspb.CryptoKey{Name: mirrorRing + "/cryptoKeys/signer", Purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN},
+				Versions: []*kmspb.CryptoKeyVersion{
+					mirroredVersion("signer", "1", kmspb.CryptoKeyVersion_DISABLED, kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256),
+					mirroredVersion("signer", "2", kmspb.CryptoKeyVersion_ENABLED, kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256),
+				},
+			},
+			{
+				CryptoKey: &kmspb.CryptoKey{Name: mirrorRing + "/cryptoKeys/ekm", Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT},
+				Versions: []*kmspb.CryptoKeyVersion{
+					mirroredVersion("ekm", "1", kmspb.CryptoKeyVersion_ENABLED, kmspb.CryptoKeyVersion_EXTERNAL_SYMMETRIC_ENCRYPTION),
+				},
+			},
+		},
+	}
+
+	s := NewStorage()
+	stats, err := s.LoadMirror([]MirroredKeyRing{ring})
+	if err != nil {
+		t.Fatalf("LoadMirror failed: %v", err)
+	}
+	if stats.KeyRings != 1 || stats.CryptoKeys != 2 || stats.CryptoKeyVersions != 4 || len(stats.Skipped) != 3 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	kr, err := s.GetKeyRing(mirrorRing)
+	if err != nil || !kr.CreateTime.AsTime().Equal(created) {
+		t.Errorf("Expected the key ring create time to be kept, got %v: %v", kr.GetCreateTime(), err)
+	}
+	key, err := s.GetCryptoKey(enc)
+	if err != nil {
+		t.Fatalf("GetCryptoKey failed: %v", err)
+	}
+	if key.Labels["team"] != "payments" || key.GetRotationPeriod().AsDuration() != 90*24*time.Hour ||
+		key.VersionTemplate.ProtectionLevel != kmspb.ProtectionLevel_HSM || !key.CreateTime.AsTime().Equal(created) {
+		t.Errorf("Expected the key metadata to be kept, got %v", key)
+	}
+	if key.Primary.Name != enc+"/cryptoKeyVersions/1" {
+		t.Errorf("Expected version 1 as primary, got %s", key.Primary.Name)
+	}
+
+	// Crypto works with local material, and new versions follow the mirrored ones
+	ciphertext, _, _, err := s.Encrypt(enc, []byte("secret"), nil)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if plaintext, _, _, err := s.Decrypt(enc, ciphertext, nil); err != nil || string(plaintext) != "secret" {
+		t.Errorf("Decrypt = %q, %v", plaintext, err)
+	}
+	if v, err := s.CreateCryptoKeyVersion(enc); err != nil || v.Name != enc+"/cryptoKeyVersions/4" {
+		t.Errorf("Expected version 4, got %v: %v", v.GetName(), err)
+	}
+
+	signer, err := s.GetCryptoKey(mirrorRing + "/cryptoKeys/signer")
+	if err != nil || signer.Primary != nil || signer.VersionTemplate.GetAlgorithm() != kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256 {
+		t.Errorf("Expected no primary and the newest version's algorithm, got %v: %v", signer, err)
+	}
+	if _, _, err := s.AsymmetricSign(mirrorRing+"/cryptoKeys/signer/cryptoKeyVersions/2", nil, []byte("data")); err != nil {
+		t.Errorf("AsymmetricSign failed: %v", err)
+	}
+	if _, err := s.GetCryptoKey(mirrorRing + "/cryptoKeys/ekm"); err == nil {
+		t.Error("Expected the key without supported versions to be skipped")
+	}
+
+	// Existing resources are left alone
+	stats, err = s.LoadMirror([]MirroredKeyRing{ring})
+	if err != nil || stats.KeyRings != 0 || stats.CryptoKeys != 0 {
+		t.Errorf("Expected nothing to be added again, got %+v: %v", stats, err)
+	}
+	if plaintext, _, _, err := s.Decrypt(enc, ciphertext, nil); err != nil || string(plaintext) != "secret" {
+		t.Errorf("Expected the existing key material to be kept, got %q: %v", plaintext, err)
+	}
+}
+
+func TestLoadMirrorInvalid(t *testing.T) {
+	s := NewStorage()
+	_, err := s.LoadMirror([]MirroredKeyRing{{
+		KeyRing: &kmspb.KeyRing{Name: mirrorRing},
+		CryptoKeys: []MirroredCryptoKey{{
+			CryptoKey: &kmspb.CryptoKey{Name: mirrorRing + "/cryptoKeys/k", Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT},
+			Versions:  []*kmspb.CryptoKeyVersion{mirroredVersion("other", "1", kmspb.CryptoKeyVersion_ENABLED, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION)},
+		}},
+	}})
+	if err == nil {
+		t.Fatal("Expected an error for a version of another key")
+	}
+	if rings, _ := s.ListKeyRings("projects/real/locations/us-east1"); len(rings) != 0 {
+		t.Errorf("Expected nothing to be added, got %v", rings)
+	}
+}
+
+func TestLoadMirrorWithoutCreateTimes(t *testing.T) {
+	frozen := time.Date(2025, 3, 4, 5, 6, 7, 0, time.UTC)
+	s := NewStorage()
+	s.SetFrozenTime(frozen)
+
+	version := mirroredVersion("k", "1", kmspb.CryptoKeyVersion_ENABLED, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION)
+	version.CreateTime = nil
+	_, err := s.LoadMirror([]MirroredKeyRing{{
+		KeyRing: &kmspb.KeyRing{Name: mirrorRing},
+		CryptoKeys: []MirroredCryptoKey{{
+			CryptoKey: &kmspb.CryptoKey{Name: mirrorRing + "/cryptoKeys/k", Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT},
+			Versions:  []*kmspb.CryptoKeyVersion{version},
+		}},
+	}})
+	if err != nil {
+		t.Fatalf("LoadMirror failed: %v", err)
+	}
+
+	// Missing create times come from the storage clock
+	kr, err := s.GetKeyRing(mirrorRing)
+	if err != nil || !kr.CreateTime.AsTime().Equal(frozen) {
+		t.Errorf("Expected the key ring create time %v, got %v: %v", frozen, kr.GetCreateTime(), err)
+	}
+	key, err := s.GetCryptoKey(mirrorRing + "/cryptoKeys/k")
+	if err != nil {
+		t.Fatalf("GetCryptoKey failed: %v", err)
+	}
+	if !key.CreateTime.AsTime().Equal(frozen) || !key.Primary.CreateTime.AsTime().Equal(frozen) {
+		t.Errorf("Expected key and version create times %v, got %v", frozen, key)
+	}
+}
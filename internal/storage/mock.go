@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// With mock crypto on, Encrypt and Decrypt skip AES-GCM: the ciphertext is
+// the plaintext in a tagged envelope, mockTag followed by a CRC32C of the
+// version name and the additional authenticated data, behind the usual
+// version header. Decrypt still fails for the wrong key, the wrong AAD or a
+// ciphertext from the other mode, so suites checking API semantics behave
+// the same, but the plaintext can be read straight out of the ciphertext.
+// It is for unit test suites running millions of operations, never for
+// data that matters.
+
+// mockTag starts every mock envelope
+var mockTag = []byte("KMSEMU-MOCK\x00")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// SetMockCrypto turns mock crypto on or off. Ciphertexts written in one mode
+// do not decrypt in the other.
+func (s *Storage) SetMockCrypto(on bool) {
+	s.mockCrypto.Store(on)
+}
+
+// MockCrypto reports whether mock crypto is on
+func (s *Storage) MockCrypto() bool {
+	return s.mockCrypto.Load()
+}
+
+func mockSeal(versionName string, plaintext, aad []byte) []byte {
+	envelope := make([]byte, 0, len(mockTag)+4+len(plaintext))
+	envelope = append(envelope, mockTag...)
+	envelope = binary.BigEndian.AppendUint32(envelope, mockChecksum(versionName, aad))
+	return append(envelope, plaintext...)
+}
+
+func mockOpen(versionName string, envelope, aad []byte) ([]byte, error) {
+	if !bytes.HasPrefix(envelope, mockTag) || len(envelope) < len(mockTag)+4 {
+		return nil, fmt.Errorf("not a mock crypto ciphertext")
+	}
+	envelope = envelope[len(mockTag):]
+	if binary.BigEndian.Uint32(envelope) != mockChecksum(versionName, aad) {
+		return nil, fmt.Errorf("mock crypto ciphertext is for another version or additional authenticated data")
+	}
+	return bytes.Clone(envelope[4:]), nil
+}
+
+// mockChecksum binds a mock envelope to its version and AAD
+func mockChecksum(versionName string, aad []byte) uint32 {
+	sum := crc32.Update(0, castagnoli, []byte(versionName))
+	sum = crc32.Update(sum, castagnoli, []byte{0})
+	return crc32.Update(sum, castagnoli, aad)
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+func TestMockCrypto(t *testing.T) {
+	s := newViewTestStorage(t)
+	if _, err := s.CreateCryptoKey(viewTestRing, "other", kmspb.CryptoKey_ENCRYPT_DECRYPT, nil, nil); err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+	otherKey := viewTestRing + "/cryptoKeys/other"
+	real, _, _, err := s.Encrypt(viewTestKey, []byte("secret"), nil)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	s.SetMockCrypto(true)
+	if !s.MockCrypto() {
+		t.Fatal("Expected mock crypto to be on")
+	}
+	ciphertext, name, _, err := s.Encrypt(viewTestKey, []byte("secret"), []byte("aad"))
+	if err != nil || name != viewTestKey+"/cryptoKeyVersions/1" {
+		t.Fatalf("Encrypt = %s, %v", name, err)
+	}
+	if !bytes.Contains(ciphertext, []byte("secret")) {
+		t.Error("Expected the mock ciphertext to hold the plaintext")
+	}
+	plaintext, primary, _, err := s.Decrypt(viewTestKey, ciphertext, []byte("aad"))
+	if err != nil || !primary || string(plaintext) != "secret" {
+		t.Errorf("Decrypt = %q, %v, %v", plaintext, primary, err)
+	}
+
+	// API semantics still hold
+	if _, _, _, err := s.Decrypt(viewTestKey, ciphertext, []byte("other aad")); err == nil {
+		t.Error("Expected Decrypt with the wrong AAD to fail")
+	}
+	if _, _, _, err := s.Decrypt(otherKey, ciphertext, []byte("aad")); err == nil {
+		t.Error("Expected Decrypt with another key to fail")
+	}
+	if _, _, _, err := s.Decrypt(viewTestKey, real, nil); err == nil {
+		t.Error("Expected a real ciphertext not to decrypt in mock mode")
+	}
+	if _, err := s.UpdateCryptoKeyVersion(viewTestKey+"/cryptoKeyVersions/1", kmspb.CryptoKeyVersion_DISABLED, ""); err != nil {
+		t.Fatalf("UpdateCryptoKeyVersion failed: %v", err)
+	}
+	if _, _, _, err := s.Decrypt(viewTestKey, ciphertext, []byte("aad")); err == nil {
+		t.Error("Expected Decrypt with a disabled version to fail")
+	}
+	if _, err := s.UpdateCryptoKeyVersion(viewTestKey+"/cryptoKeyVersions/1", kmspb.CryptoKeyVersion_ENABLED, ""); err != nil {
+		t.Fatalf("UpdateCryptoKeyVersion failed: %v", err)
+	}
+
+	s.SetMockCrypto(false)
+	if _, _, _, err := s.Decrypt(viewTestKey, ciphertext, []byte("aad")); err == nil {
+		t.Error("Expected a mock ciphertext not to decrypt with real crypto")
+	}
+	if plaintext, _, _, err := s.Decrypt(viewTestKey, real, nil); err != nil || string(plaintext) != "secret" {
+		t.Errorf("Decrypt of the real ciphertext = %q, %v", plaintext, err)
+	}
+}
+
+func BenchmarkEncryptMockCrypto(b *testing.B) {
+	s := newViewTestStorage(b)
+	s.SetMockCrypto(true)
+	plaintext := []byte("benchmark plaintext")
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, _, _, err := s.Encrypt(viewTestKey, plaintext, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"sort"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/protobuf/proto"
+)
+
+// SnapshotInfo describes a named in-memory snapshot
+type SnapshotInfo struct {
+	Name       string    `json:"name"`
+	CreateTime time.Time `json:"createTime"`
+	KeyRings   int       `json:"keyRings"`
+}
+
+// snapshot is a deep copy of the keyrings at one point in time
+type snapshot struct {
+	createTime time.Time
+	keyrings   map[string]*StoredKeyRing
+}
+
+// SaveSnapshot copies the current state under name, replacing any snapshot
+// with that name. Snapshots stay in memory and survive Clear, so fixtures
+// built once can be restored before every test.
+func (s *Storage) SaveSnapshot(name string) (SnapshotInfo, error) {
+	if name == "" {
+		return SnapshotInfo{}, fmt.Errorf("snapshot name is not valid for saving")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := &snapshot{createTime: time.Now(), keyrings: cloneKeyRings(s.keyrings)}
+	if s.snapshots == nil {
+		s.snapshots = make(map[string]*snapshot)
+	}
+	s.snapshots[name] = snap
+	return snap.info(name), nil
+}
+
+// RestoreSnapshot replaces the current state with a copy of a snapshot. The
+// snapshot is kept and can be restored again.
+func (s *Storage) RestoreSnapshot(name string) (SnapshotInfo, error) {
+	defer s.lockAll()()
+	snap, ok := s.snapshots[name]
+	if !ok {
+		return SnapshotInfo{}, fmt.Errorf("snapshot not found: %s", name)
+	}
+	s.keyrings = cloneKeyRings(snap.keyrings)
+	return snap.info(name), nil
+}
+
+// DeleteSnapshot removes a snapshot
+func (s *Storage) DeleteSnapshot(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.snapshots[name]; !ok {
+		return fmt.Errorf("snapshot not found: %s", name)
+	}
+	delete(s.snapshots, name)
+	return nil
+}
+
+// ListSnapshots returns the saved snapshots sorted by name
+func (s *Storage) ListSnapshots() []SnapshotInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]SnapshotInfo, 0, len(s.snapshots))
+	for name, snap := range s.snapshots {
+		list = append(list, snap.info(name))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (snap *snapshot) info(name string) SnapshotInfo {
+	return SnapshotInfo{Name: name, CreateTime: snap.createTime, KeyRings: len(snap.keyrings)}
+}
+
+// cloneKeyRings deep copies keyrings so later changes to either copy do not
+// affect the other
+func cloneKeyRings(keyrings map[string]*StoredKeyRing) map[string]*StoredKeyRing {
+	out := make(map[string]*StoredKeyRing, len(keyrings))
+	for name, kr := range keyrings {
+		ring := StoredKeyRing{Name: kr.Name, CreateTime: kr.CreateTime}
+		ring.CryptoKeys = make(map[string]*StoredCryptoKey, len(kr.CryptoKeys))
+		for keyName, ck := range kr.CryptoKeys {
+			ring.CryptoKeys[keyName] = cloneCryptoKey(ck)
+		}
+		ring.ImportJobs = make(map[string]*StoredImportJob, len(kr.ImportJobs))
+		for jobName, job := range kr.ImportJobs {
+			copied := *job
+			ring.ImportJobs[jobName] = &copied
+		}
+		out[name] = &ring
+	}
+	return out
+}
+
+// cloneCryptoKey deep copies a crypto key and its versions, including their
+// key material, which destroying a version zeroes in place
+func cloneCryptoKey(ck *StoredCryptoKey) *StoredCryptoKey {
+	key := *ck
+	key.Labels = maps.Clone(ck.Labels)
+	if ck.VersionTemplate != nil {
+		key.VersionTemplate = proto.Clone(ck.VersionTemplate).(*kmspb.CryptoKeyVersionTemplate)
+	}
+	key.Versions = make(map[string]*StoredCryptoKeyVersion, len(ck.Versions))
+	for versionName, v := range ck.Versions {
+		version := *v
+		version.SymmetricKey = bytes.Clone(v.SymmetricKey)
+		version.PrivateKey = bytes.Clone(v.PrivateKey)
+		key.Versions[versionName] = &version
+	}
+	return &key
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+func TestSnapshots(t *testing.T) {
+	s := NewStorage()
+	versionName := createKeyWithAlgorithm(t, s, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION)
+	keyName := versionName[:strings.Index(versionName, "/cryptoKeyVersions/")]
+	ciphertext, _, _, err := s.Encrypt(keyName, []byte("secret"), nil)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	info, err := s.SaveSnapshot("fixture")
+	if err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	if info.Name != "fixture" || info.KeyRings != 1 {
+		t.Errorf("Unexpected snapshot info %+v", info)
+	}
+
+	// Changes after the snapshot must not leak into it
+	if _, err := s.UpdateCryptoKeyVersion(versionName, kmspb.CryptoKeyVersion_DISABLED, ""); err != nil {
+		t.Fatalf("UpdateCryptoKeyVersion failed: %v", err)
+	}
+	if _, err := s.CreateKeyRing("projects/test/locations/global/keyRings/ring2"); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.RestoreSnapshot("fixture"); err != nil {
+			t.Fatalf("RestoreSnapshot failed: %v", err)
+		}
+		if got := s.Stats().KeyRings; got != 1 {
+			t.Errorf("Expected 1 keyring after restore, got %d", got)
+		}
+		if plaintext, _, _, err := s.Decrypt(keyName, ciphertext, nil); err != nil || string(plaintext) != "secret" {
+			t.Errorf("Expected the restored key to decrypt, got %q, %v", plaintext, err)
+		}
+		// Changes after a restore must not leak into the snapshot either
+		s.Clear()
+	}
+
+	if got := s.ListSnapshots(); len(got) != 1 || got[0].Name != "fixture" {
+		t.Errorf("Unexpected snapshots %+v", got)
+	}
+	if err := s.DeleteSnapshot("fixture"); err != nil {
+		t.Fatalf("DeleteSnapshot failed: %v", err)
+	}
+	if _, err := s.RestoreSnapshot("fixture"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected a deleted snapshot to be not found, got %v", err)
+	}
+}
@@ -0,0 +1,561 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// CurrentStateVersion is the schema version written by SaveState.
+//
+// Bump this whenever the persisted layout changes and register a migration
+// from the previous version in stateMigrations so existing state files keep
+// loading after an upgrade.
+const CurrentStateVersion = 8
+
+// ErrUnsupportedStateVersion is returned when a state document declares a
+// schema version this build does not know how to read.
+var ErrUnsupportedStateVersion = errors.New("unsupported state version")
+
+// stateMigration upgrades a decoded state document by exactly one version.
+type stateMigration func(doc map[string]any) error
+
+// stateMigrations maps a source version to the migration that upgrades it
+// to the next version.
+var stateMigrations = map[int]stateMigration{
+	// Version 2 adds privateKey to versions of asymmetric keys, which version
+	// 1 could not hold, so version 1 documents are already valid
+	1: func(doc map[string]any) error { return nil },
+	// Version 3 adds importJobs to keyrings; version 2 documents have none
+	2: func(doc map[string]any) error { return nil },
+	// Version 4 adds backend to versions whose key material a key backend
+	// holds; version 3 documents hold all key material themselves
+	3: func(doc map[string]any) error { return nil },
+	// Version 5 saves PENDING_GENERATION versions, with generateTime and
+	// generationFailureReason once generated; version 4 versions were all
+	// generated on creation
+	4: func(doc map[string]any) error { return nil },
+	// Version 6 records protectionLevel on versions; version 5 versions
+	// were all SOFTWARE
+	5: func(doc map[string]any) error {
+		for _, version := range docVersions(doc) {
+			if _, ok := version["protectionLevel"]; !ok {
+				version["protectionLevel"] = kmspb.ProtectionLevel_SOFTWARE.String()
+			}
+		}
+		return nil
+	},
+	// Version 7 adds destroyTime and destroyEventTime to versions. Version 6
+	// builds never destroyed scheduled versions, so these are given the
+	// default schedule from when the file was saved instead of being
+	// destroyed as soon as they load
+	6: func(doc map[string]any) error {
+		savedAt, _ := doc["savedAt"].(string)
+		for _, version := range docVersions(doc) {
+			if version["state"] != kmspb.CryptoKeyVersion_DESTROY_SCHEDULED.String() || version["destroyTime"] != nil {
+				continue
+			}
+			scheduled, err := time.Parse(time.RFC3339Nano, savedAt)
+			if err != nil {
+				createTime, _ := version["createTime"].(string)
+				if scheduled, err = time.Parse(time.RFC3339Nano, createTime); err != nil {
+					return fmt.Errorf("cannot schedule destruction of %v without savedAt or createTime", version["name"])
+				}
+			}
+			version["destroyTime"] = scheduled.Add(DefaultDestroyScheduledDuration).Format(time.RFC3339Nano)
+		}
+		return nil
+	},
+	// Version 8 adds importJob, importTime, importFailureReason and
+	// importedKeyHash to versions; version 7 did not tell imported versions
+	// apart, so its documents are already valid
+	7: func(doc map[string]any) error { return nil },
+}
+
+// docVersions returns the crypto key versions of a decoded state document.
+// Records of an unexpected shape are skipped and left for decoding to reject.
+func docVersions(doc map[string]any) []map[string]any {
+	var versions []map[string]any
+	keyRings, _ := doc["keyRings"].([]any)
+	for _, keyRing := range keyRings {
+		keyRing, _ := keyRing.(map[string]any)
+		cryptoKeys, _ := keyRing["cryptoKeys"].([]any)
+		for _, cryptoKey := range cryptoKeys {
+			cryptoKey, _ := cryptoKey.(map[string]any)
+			records, _ := cryptoKey["versions"].([]any)
+			for _, record := range records {
+				if version, ok := record.(map[string]any); ok {
+					versions = append(versions, version)
+				}
+			}
+		}
+	}
+	return versions
+}
+
+// persistedState is the on-disk representation of the storage contents
+type persistedState struct {
+	Version  int                `json:"version"`
+	SavedAt  time.Time          `json:"savedAt"`
+	KeyRings []persistedKeyRing `json:"keyRings"`
+}
+
+type persistedKeyRing struct {
+	Name       string               `json:"name"`
+	CreateTime time.Time            `json:"createTime"`
+	CryptoKeys []persistedCryptoKey `json:"cryptoKeys"`
+	ImportJobs []persistedImportJob `json:"importJobs,omitempty"`
+}
+
+type persistedCryptoKey struct {
+	Name             string                      `json:"name"`
+	CreateTime       time.Time                   `json:"createTime"`
+	Purpose          string                      `json:"purpose"`
+	PrimaryVersion   string                      `json:"primaryVersion"`
+	NextVersionID    int64                       `json:"nextVersionId"`
+	VersionTemplate  json.RawMessage             `json:"versionTemplate,omitempty"`
+	Labels           map[string]string           `json:"labels,omitempty"`
+	RotationPeriod   time.Duration               `json:"rotationPeriod,omitempty"`
+	NextRotationTime *time.Time                  `json:"nextRotationTime,omitempty"`
+	Versions         []persistedCryptoKeyVersion `json:"versions"`
+}
+
+type persistedCryptoKeyVersion struct {
+	Name         string    `json:"name"`
+	State        string    `json:"state"`
+	CreateTime   time.Time `json:"createTime"`
+	Algorithm    string    `json:"algorithm"`
+	SymmetricKey []byte    `json:"symmetricKey,omitempty"`
+	PrivateKey   []byte    `json:"privateKey,omitempty"`
+
+	// ProtectionLevel is filled in as SOFTWARE when files saved before it
+	// was recorded are migrated
+	ProtectionLevel string `json:"protectionLevel,omitempty"`
+
+	// Backend names the key backend holding the key material; the file
+	// only refers to it
+	Backend string `json:"backend,omitempty"`
+
+	DestroyTime      *time.Time `json:"destroyTime,omitempty"`
+	DestroyEventTime *time.Time `json:"destroyEventTime,omitempty"`
+
+	ImportJob           string     `json:"importJob,omitempty"`
+	ImportTime          *time.Time `json:"importTime,omitempty"`
+	ImportFailureReason string     `json:"importFailureReason,omitempty"`
+	ImportedKeyHash     []byte     `json:"importedKeyHash,omitempty"`
+
+	GenerateTime            *time.Time `json:"generateTime,omitempty"`
+	GenerationFailureReason string     `json:"generationFailureReason,omitempty"`
+}
+
+type persistedImportJob struct {
+	Name            string    `json:"name"`
+	CreateTime      time.Time `json:"createTime"`
+	ImportMethod    string    `json:"importMethod"`
+	ProtectionLevel string    `json:"protectionLevel"`
+	PrivateKey      []byte    `json:"privateKey,omitempty"`
+}
+
+// SaveState writes all stored resources, including key material, to w as a
+// versioned JSON document.
+func (s *Storage) SaveState(w io.Writer) error {
+	return s.writeState(w, true)
+}
+
+// DumpState writes the same document as SaveState with key material omitted.
+// The output is meant for inspection and cannot be loaded back.
+func (s *Storage) DumpState(w io.Writer) error {
+	return s.writeState(w, false)
+}
+
+func (s *Storage) writeState(w io.Writer, includeKeys bool) error {
+	// The write lock waits for calls on every keyring to finish, so the
+	// state is consistent across keyrings
+	s.mu.Lock()
+	state := persistedState{
+		Version: CurrentStateVersion,
+		SavedAt: time.Now().UTC(),
+	}
+	for _, kr := range s.keyrings {
+		pkr := persistedKeyRing{
+			Name:       kr.Name,
+			CreateTime: kr.CreateTime,
+		}
+		for _, ck := range kr.CryptoKeys {
+			pck := persistedCryptoKey{
+				Name:           ck.Name,
+				CreateTime:     ck.CreateTime,
+				Purpose:        ck.Purpose.String(),
+				PrimaryVersion: ck.PrimaryVersion,
+				NextVersionID:  ck.NextVersionID,
+				Labels:         ck.Labels,
+				RotationPeriod: ck.RotationPeriod,
+			}
+			if !ck.NextRotationTime.IsZero() {
+				next := ck.NextRotationTime
+				pck.NextRotationTime = &next
+			}
+			if ck.VersionTemplate != nil {
+				data, err := protojson.Marshal(ck.VersionTemplate)
+				if err != nil {
+					s.mu.Unlock()
+					return fmt.Errorf("failed to encode version template for %s: %w", ck.Name, err)
+				}
+				pck.VersionTemplate = data
+			}
+			for _, v := range ck.Versions {
+				pv := persistedCryptoKeyVersion{
+					Name:                v.Name,
+					State:               v.State.String(),
+					CreateTime:          v.CreateTime,
+					Algorithm:           v.Algorithm.String(),
+					ProtectionLevel:     versionProtectionLevel(v).String(),
+					ImportJob:           v.ImportJob,
+					ImportFailureReason: v.ImportFailureReason,
+					ImportedKeyHash:     v.ImportedKeyHash,
+					Backend:             v.Backend,
+
+					GenerationFailureReason: v.GenerationFailureReason,
+				}
+				// Copied, since destruction wipes the originals in place
+				if includeKeys {
+					pv.SymmetricKey = bytes.Clone(v.SymmetricKey)
+					pv.PrivateKey = bytes.Clone(v.PrivateKey)
+				}
+				if !v.GenerateTime.IsZero() {
+					generateTime := v.GenerateTime
+					pv.GenerateTime = &generateTime
+				}
+				if !v.DestroyTime.IsZero() {
+					destroyTime := v.DestroyTime
+					pv.DestroyTime = &destroyTime
+				}
+				if !v.DestroyEventTime.IsZero() {
+					eventTime := v.DestroyEventTime
+					pv.DestroyEventTime = &eventTime
+				}
+				if !v.ImportTime.IsZero() {
+					importTime := v.ImportTime
+					pv.ImportTime = &importTime
+				}
+				pck.Versions = append(pck.Versions, pv)
+			}
+			pkr.CryptoKeys = append(pkr.CryptoKeys, pck)
+		}
+		for _, job := range kr.ImportJobs {
+			pj := persistedImportJob{
+				Name:            job.Name,
+				CreateTime:      job.CreateTime,
+				ImportMethod:    job.ImportMethod.String(),
+				ProtectionLevel: job.ProtectionLevel.String(),
+			}
+			if includeKeys {
+				pj.PrivateKey = job.PrivateKey
+			}
+			pkr.ImportJobs = append(pkr.ImportJobs, pj)
+		}
+		state.KeyRings = append(state.KeyRings, pkr)
+	}
+	s.mu.Unlock()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(state)
+}
+
+// LoadState replaces all stored resources with the contents of a state
+// document read from r. Documents written by older releases are migrated
+// forward in memory; documents from newer releases are rejected with
+// ErrUnsupportedStateVersion. It returns the version the document was
+// written with.
+func (s *Storage) LoadState(r io.Reader) (int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read state: %w", err)
+	}
+
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return 0, fmt.Errorf("failed to parse state: %w", err)
+	}
+
+	from, err := migrateState(doc, stateMigrations, CurrentStateVersion)
+	if err != nil {
+		return 0, err
+	}
+
+	if from != CurrentStateVersion {
+		if data, err = json.Marshal(doc); err != nil {
+			return 0, fmt.Errorf("failed to re-encode migrated state: %w", err)
+		}
+	}
+
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, fmt.Errorf("failed to decode state: %w", err)
+	}
+
+	keyrings, err := restoreKeyRings(state.KeyRings)
+	if err != nil {
+		return 0, err
+	}
+
+	unlock := s.lockAll()
+	s.keyrings = keyrings
+	unlock()
+
+	return from, nil
+}
+
+// SaveStateFile writes the current state to path with WriteStateFile.
+func (s *Storage) SaveStateFile(path string) error {
+	var buf bytes.Buffer
+	if err := s.SaveState(&buf); err != nil {
+		return err
+	}
+	return WriteStateFile(path, buf.Bytes())
+}
+
+// WriteStateFile writes a state document to path, readable only by its
+// owner. The file is written to a temporary sibling first and renamed into
+// place so a crash mid-write never leaves a truncated state file behind.
+func WriteStateFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o600); err != nil {
+		return fmt.Errorf("failed to set state file permissions: %w", err)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadStateFile loads state from path. A missing file returns an error
+// wrapping os.ErrNotExist.
+//
+// If the file was written with an older schema version, the original is
+// preserved as "<path>.v<N>.bak" and the file is rewritten in the current
+// format before returning.
+func (s *Storage) LoadStateFile(path string) error {
+	_, err := s.loadStateFile(path)
+	return err
+}
+
+// MigrateStateFile upgrades the state file at path to CurrentStateVersion
+// without starting a server. It returns the version the file was written
+// with; files already at the current version are left untouched.
+func MigrateStateFile(path string) (int, error) {
+	return NewStorage().loadStateFile(path)
+}
+
+func (s *Storage) loadStateFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	from, err := s.LoadState(bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if from == CurrentStateVersion {
+		return from, nil
+	}
+
+	backup := fmt.Sprintf("%s.v%d.bak", path, from)
+	if err := os.WriteFile(backup, data, 0o600); err != nil {
+		return from, fmt.Errorf("failed to back up state file before migration: %w", err)
+	}
+
+	return from, s.SaveStateFile(path)
+}
+
+// migrateState applies migrations to doc until it reaches target and returns
+// the version the document started at.
+func migrateState(doc map[string]any, migrations map[int]stateMigration, target int) (int, error) {
+	raw, ok := doc["version"]
+	if !ok {
+		return 0, fmt.Errorf("%w: state has no version field", ErrUnsupportedStateVersion)
+	}
+
+	num, ok := raw.(float64)
+	if !ok || num != float64(int(num)) {
+		return 0, fmt.Errorf("%w: invalid version %v", ErrUnsupportedStateVersion, raw)
+	}
+
+	from := int(num)
+	if from < 1 {
+		return 0, fmt.Errorf("%w: invalid version %d", ErrUnsupportedStateVersion, from)
+	}
+	if from > target {
+		return 0, fmt.Errorf("%w: state version %d is newer than supported version %d", ErrUnsupportedStateVersion, from, target)
+	}
+
+	for v := from; v < target; v++ {
+		migrate, ok := migrations[v]
+		if !ok {
+			return 0, fmt.Errorf("%w: no migration from version %d", ErrUnsupportedStateVersion, v)
+		}
+		if err := migrate(doc); err != nil {
+			return 0, fmt.Errorf("failed to migrate state from version %d to %d: %w", v, v+1, err)
+		}
+		doc["version"] = float64(v + 1)
+	}
+
+	return from, nil
+}
+
+// restoreKeyRings rebuilds the in-memory keyring map from persisted records
+func restoreKeyRings(records []persistedKeyRing) (map[string]*StoredKeyRing, error) {
+	keyrings := make(map[string]*StoredKeyRing, len(records))
+
+	for _, pkr := range records {
+		if pkr.Name == "" {
+			return nil, fmt.Errorf("invalid state: keyring without name")
+		}
+
+		kr := &StoredKeyRing{
+			Name:       pkr.Name,
+			CreateTime: pkr.CreateTime,
+			CryptoKeys: make(map[string]*StoredCryptoKey, len(pkr.CryptoKeys)),
+			ImportJobs: make(map[string]*StoredImportJob, len(pkr.ImportJobs)),
+		}
+
+		for _, pck := range pkr.CryptoKeys {
+			purpose, ok := kmspb.CryptoKey_CryptoKeyPurpose_value[pck.Purpose]
+			if !ok {
+				return nil, fmt.Errorf("invalid state: unknown purpose %q for %s", pck.Purpose, pck.Name)
+			}
+
+			ck := &StoredCryptoKey{
+				Name:           pck.Name,
+				CreateTime:     pck.CreateTime,
+				Purpose:        kmspb.CryptoKey_CryptoKeyPurpose(purpose),
+				PrimaryVersion: pck.PrimaryVersion,
+				NextVersionID:  pck.NextVersionID,
+				Labels:         pck.Labels,
+				RotationPeriod: pck.RotationPeriod,
+				Versions:       make(map[string]*StoredCryptoKeyVersion, len(pck.Versions)),
+			}
+			if pck.NextRotationTime != nil {
+				ck.NextRotationTime = *pck.NextRotationTime
+			}
+
+			if len(pck.VersionTemplate) > 0 {
+				ck.VersionTemplate = &kmspb.CryptoKeyVersionTemplate{}
+				if err := protojson.Unmarshal(pck.VersionTemplate, ck.VersionTemplate); err != nil {
+					return nil, fmt.Errorf("invalid state: version template for %s: %w", pck.Name, err)
+				}
+			}
+
+			for _, pv := range pck.Versions {
+				state, ok := kmspb.CryptoKeyVersion_CryptoKeyVersionState_value[pv.State]
+				if !ok {
+					return nil, fmt.Errorf("invalid state: unknown version state %q for %s", pv.State, pv.Name)
+				}
+				algorithm, ok := kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm_value[pv.Algorithm]
+				if !ok {
+					return nil, fmt.Errorf("invalid state: unknown algorithm %q for %s", pv.Algorithm, pv.Name)
+				}
+
+				protectionLevel := kmspb.ProtectionLevel_SOFTWARE
+				if pv.ProtectionLevel != "" {
+					level, ok := kmspb.ProtectionLevel_value[pv.ProtectionLevel]
+					if !ok {
+						return nil, fmt.Errorf("invalid state: unknown protection level %q for %s", pv.ProtectionLevel, pv.Name)
+					}
+					protectionLevel = kmspb.ProtectionLevel(level)
+				}
+
+				ck.Versions[pv.Name] = &StoredCryptoKeyVersion{
+					Name:            pv.Name,
+					State:           kmspb.CryptoKeyVersion_CryptoKeyVersionState(state),
+					CreateTime:      pv.CreateTime,
+					Algorithm:       kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm(algorithm),
+					ProtectionLevel: protectionLevel,
+					SymmetricKey:    pv.SymmetricKey,
+					PrivateKey:      pv.PrivateKey,
+					Backend:         pv.Backend,
+
+					ImportJob:           pv.ImportJob,
+					ImportFailureReason: pv.ImportFailureReason,
+					ImportedKeyHash:     pv.ImportedKeyHash,
+
+					GenerationFailureReason: pv.GenerationFailureReason,
+				}
+				version := ck.Versions[pv.Name]
+				if pv.GenerateTime != nil {
+					version.GenerateTime = *pv.GenerateTime
+				}
+				if pv.ImportTime != nil {
+					version.ImportTime = *pv.ImportTime
+				}
+				if pv.DestroyTime != nil {
+					version.DestroyTime = *pv.DestroyTime
+				}
+				if pv.DestroyEventTime != nil {
+					version.DestroyEventTime = *pv.DestroyEventTime
+				}
+				// Destroyed versions keep no material, even if the file has some
+				if version.State == kmspb.CryptoKeyVersion_DESTROYED {
+					version.destroy(version.DestroyEventTime)
+				}
+			}
+
+			// State saved before only ENCRYPT_DECRYPT keys had a primary
+			// version names one for every key
+			if !HasPrimaryVersion(ck.Purpose) {
+				ck.PrimaryVersion = ""
+			} else if _, ok := ck.Versions[ck.PrimaryVersion]; ck.PrimaryVersion != "" && !ok {
+				return nil, fmt.Errorf("invalid state: primary version %q missing for %s", ck.PrimaryVersion, ck.Name)
+			}
+
+			kr.CryptoKeys[ck.Name] = ck
+		}
+
+		for _, pj := range pkr.ImportJobs {
+			method, ok := kmspb.ImportJob_ImportMethod_value[pj.ImportMethod]
+			if !ok {
+				return nil, fmt.Errorf("invalid state: unknown import method %q for %s", pj.ImportMethod, pj.Name)
+			}
+			protectionLevel, ok := kmspb.ProtectionLevel_value[pj.ProtectionLevel]
+			if !ok {
+				return nil, fmt.Errorf("invalid state: unknown protection level %q for %s", pj.ProtectionLevel, pj.Name)
+			}
+			if len(pj.PrivateKey) == 0 {
+				return nil, fmt.Errorf("invalid state: import job %s has no wrapping key", pj.Name)
+			}
+
+			kr.ImportJobs[pj.Name] = &StoredImportJob{
+				Name:            pj.Name,
+				CreateTime:      pj.CreateTime,
+				ImportMethod:    kmspb.ImportJob_ImportMethod(method),
+				ProtectionLevel: kmspb.ProtectionLevel(protectionLevel),
+				PrivateKey:      pj.PrivateKey,
+			}
+		}
+
+		keyrings[kr.Name] = kr
+	}
+
+	return keyrings, nil
+}
@@ -0,0 +1,375 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+func TestSaveLoadStateRoundTrip(t *testing.T) {
+	s := NewStorage()
+
+	_, err := s.CreateKeyRing("projects/test/locations/global/keyRings/ring1")
+	if err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+
+	keyName := "projects/test/locations/global/keyRings/ring1/cryptoKeys/key1"
+	_, err = s.CreateCryptoKey(
+		"projects/test/locations/global/keyRings/ring1",
+		"key1",
+		kmspb.CryptoKey_ENCRYPT_DECRYPT,
+		&kmspb.CryptoKeyVersionTemplate{Algorithm: kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION},
+		map[string]string{"env": "test"},
+	)
+	if err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+
+	ciphertext, _, _, err := s.Encrypt(keyName, []byte("persist me"), nil)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.SaveState(&buf); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+
+	restored := NewStorage()
+	from, err := restored.LoadState(&buf)
+	if err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	if from != CurrentStateVersion {
+		t.Errorf("Expected version %d, got %d", CurrentStateVersion, from)
+	}
+
+	plaintext, _, _, err := restored.Decrypt(keyName, ciphertext, nil)
+	if err != nil {
+		t.Fatalf("Decrypt after restore failed: %v", err)
+	}
+	if string(plaintext) != "persist me" {
+		t.Errorf("Expected 'persist me', got '%s'", plaintext)
+	}
+
+	key, err := restored.GetCryptoKey(keyName)
+	if err != nil {
+		t.Fatalf("GetCryptoKey after restore failed: %v", err)
+	}
+	if key.Labels["env"] != "test" {
+		t.Errorf("Expected label env=test, got %v", key.Labels)
+	}
+	if key.VersionTemplate.GetAlgorithm() != kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION {
+		t.Errorf("Version template not restored: %v", key.VersionTemplate)
+	}
+
+	version, err := restored.CreateCryptoKeyVersion(keyName)
+	if err != nil {
+		t.Fatalf("CreateCryptoKeyVersion after restore failed: %v", err)
+	}
+	if !strings.HasSuffix(version.Name, "/cryptoKeyVersions/2") {
+		t.Errorf("Expected next version 2, got %s", version.Name)
+	}
+}
+
+func TestLoadStateRejectsUnknownVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		{name: "newer version", doc: `{"version": 999, "keyRings": []}`},
+		{name: "missing version", doc: `{"keyRings": []}`},
+		{name: "zero version", doc: `{"version": 0, "keyRings": []}`},
+		{name: "non-integer version", doc: `{"version": "1", "keyRings": []}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStorage()
+			if _, err := s.CreateKeyRing("projects/test/locations/global/keyRings/keep"); err != nil {
+				t.Fatalf("CreateKeyRing failed: %v", err)
+			}
+
+			_, err := s.LoadState(strings.NewReader(tt.doc))
+			if !errors.Is(err, ErrUnsupportedStateVersion) {
+				t.Fatalf("Expected ErrUnsupportedStateVersion, got %v", err)
+			}
+
+			// Existing state must be left untouched on failure
+			if _, err := s.GetKeyRing("projects/test/locations/global/keyRings/keep"); err != nil {
+				t.Errorf("Existing keyring lost after failed load: %v", err)
+			}
+		})
+	}
+}
+
+func TestMigrateStateAppliesStepsInOrder(t *testing.T) {
+	var applied []int
+	migrations := map[int]stateMigration{
+		1: func(doc map[string]any) error {
+			applied = append(applied, 1)
+			doc["renamed"] = doc["old"]
+			delete(doc, "old")
+			return nil
+		},
+		2: func(doc map[string]any) error {
+			applied = append(applied, 2)
+			return nil
+		},
+	}
+
+	doc := map[string]any{"version": float64(1), "old": "value"}
+	from, err := migrateState(doc, migrations, 3)
+	if err != nil {
+		t.Fatalf("migrateState failed: %v", err)
+	}
+
+	if from != 1 {
+		t.Errorf("Expected from=1, got %d", from)
+	}
+	if len(applied) != 2 || applied[0] != 1 || applied[1] != 2 {
+		t.Errorf("Expected migrations [1 2], got %v", applied)
+	}
+	if doc["version"] != float64(3) {
+		t.Errorf("Expected version 3, got %v", doc["version"])
+	}
+	if doc["renamed"] != "value" {
+		t.Errorf("Expected migrated field, got %v", doc)
+	}
+}
+
+func TestMigrateStateMissingStep(t *testing.T) {
+	doc := map[string]any{"version": float64(1)}
+	_, err := migrateState(doc, map[int]stateMigration{}, 2)
+	if !errors.Is(err, ErrUnsupportedStateVersion) {
+		t.Fatalf("Expected ErrUnsupportedStateVersion, got %v", err)
+	}
+}
+
+// olderState is a state document at version holding one symmetric key, in
+// the fields every version since 1 has
+func olderState(version int, versions string) string {
+	return fmt.Sprintf(`{
+  "version": %d,
+  "savedAt": "2024-01-01T00:00:00Z",
+  "keyRings": [{
+    "name": "projects/test/locations/global/keyRings/ring1",
+    "createTime": "2024-01-01T00:00:00Z",
+    "cryptoKeys": [{
+      "name": "projects/test/locations/global/keyRings/ring1/cryptoKeys/key1",
+      "createTime": "2024-01-01T00:00:00Z",
+      "purpose": "ENCRYPT_DECRYPT",
+      "primaryVersion": "projects/test/locations/global/keyRings/ring1/cryptoKeys/key1/cryptoKeyVersions/1",
+      "nextVersionId": 2,
+      "versions": [%s]
+    }]
+  }]
+}`, version, versions)
+}
+
+// olderVersion is the primary version of olderState, as it would be saved
+// before any optional version fields were added
+const olderVersion = `{
+  "name": "projects/test/locations/global/keyRings/ring1/cryptoKeys/key1/cryptoKeyVersions/1",
+  "state": "ENABLED",
+  "createTime": "2024-01-01T00:00:00Z",
+  "algorithm": "GOOGLE_SYMMETRIC_ENCRYPTION",
+  "symmetricKey": "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+}`
+
+func TestLoadStateFromOlderVersions(t *testing.T) {
+	const keyName = "projects/test/locations/global/keyRings/ring1/cryptoKeys/key1"
+
+	tests := []struct {
+		name     string
+		doc      string
+		expected func(t *testing.T, s *Storage)
+	}{
+		{
+			name: "v3 without key backends",
+			doc:  olderState(3, olderVersion),
+			expected: func(t *testing.T, s *Storage) {
+				ciphertext, _, level, err := s.Encrypt(keyName, []byte("migrated"), nil)
+				if err != nil {
+					t.Fatalf("Encrypt failed: %v", err)
+				}
+				if level != kmspb.ProtectionLevel_SOFTWARE {
+					t.Errorf("Expected SOFTWARE, got %v", level)
+				}
+				plaintext, _, _, err := s.Decrypt(keyName, ciphertext, nil)
+				if err != nil || string(plaintext) != "migrated" {
+					t.Errorf("Decrypt after migration: %q, %v", plaintext, err)
+				}
+			},
+		},
+		{
+			name: "v4 without background generation",
+			doc:  olderState(4, olderVersion),
+			expected: func(t *testing.T, s *Storage) {
+				version, err := s.GetCryptoKeyVersion(keyName + "/cryptoKeyVersions/1")
+				if err != nil {
+					t.Fatalf("GetCryptoKeyVersion failed: %v", err)
+				}
+				if version.State != kmspb.CryptoKeyVersion_ENABLED {
+					t.Errorf("Expected ENABLED, got %v", version.State)
+				}
+				if !version.GenerateTime.AsTime().Equal(version.CreateTime.AsTime()) {
+					t.Errorf("Expected generate time %v to be the create time %v", version.GenerateTime.AsTime(), version.CreateTime.AsTime())
+				}
+			},
+		},
+		{
+			name: "v5 without protection levels",
+			doc:  olderState(5, olderVersion),
+			expected: func(t *testing.T, s *Storage) {
+				version, err := s.GetCryptoKeyVersion(keyName + "/cryptoKeyVersions/1")
+				if err != nil {
+					t.Fatalf("GetCryptoKeyVersion failed: %v", err)
+				}
+				if version.ProtectionLevel != kmspb.ProtectionLevel_SOFTWARE {
+					t.Errorf("Expected SOFTWARE, got %v", version.ProtectionLevel)
+				}
+			},
+		},
+		{
+			name: "v6 without destroy times",
+			doc: olderState(6, olderVersion+`, {
+  "name": "projects/test/locations/global/keyRings/ring1/cryptoKeys/key1/cryptoKeyVersions/2",
+  "state": "DESTROY_SCHEDULED",
+  "createTime": "2024-01-01T00:00:00Z",
+  "algorithm": "GOOGLE_SYMMETRIC_ENCRYPTION",
+  "symmetricKey": "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+}`),
+			expected: func(t *testing.T, s *Storage) {
+				version, err := s.GetCryptoKeyVersion(keyName + "/cryptoKeyVersions/2")
+				if err != nil {
+					t.Fatalf("GetCryptoKeyVersion failed: %v", err)
+				}
+				if version.State != kmspb.CryptoKeyVersion_DESTROY_SCHEDULED {
+					t.Errorf("Expected DESTROY_SCHEDULED, got %v", version.State)
+				}
+				expected := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(DefaultDestroyScheduledDuration)
+				if !version.DestroyTime.AsTime().Equal(expected) {
+					t.Errorf("Expected destroy time %v, got %v", expected, version.DestroyTime.AsTime())
+				}
+				if _, err := s.RestoreCryptoKeyVersion(version.Name); err != nil {
+					t.Errorf("Expected the scheduled version to be restorable: %v", err)
+				}
+			},
+		},
+		{
+			name: "v7 without import status",
+			doc:  olderState(7, olderVersion),
+			expected: func(t *testing.T, s *Storage) {
+				version, err := s.GetCryptoKeyVersion(keyName + "/cryptoKeyVersions/1")
+				if err != nil {
+					t.Fatalf("GetCryptoKeyVersion failed: %v", err)
+				}
+				if version.ImportJob != "" || version.ImportTime != nil || version.ReimportEligible {
+					t.Errorf("Expected no import status, got %v", version)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state.json")
+			if err := os.WriteFile(path, []byte(tt.doc), 0o600); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+
+			s := NewStorage()
+			if err := s.LoadStateFile(path); err != nil {
+				t.Fatalf("LoadStateFile failed: %v", err)
+			}
+			tt.expected(t, s)
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("ReadFile failed: %v", err)
+			}
+			var doc map[string]any
+			if err := json.Unmarshal(data, &doc); err != nil {
+				t.Fatalf("Migrated state is not JSON: %v", err)
+			}
+			if doc["version"] != float64(CurrentStateVersion) {
+				t.Errorf("Expected file rewritten at version %d, got %v", CurrentStateVersion, doc["version"])
+			}
+
+			// A build one version older must refuse the rewritten file
+			// rather than drop the fields it does not know
+			if _, err := migrateState(doc, stateMigrations, CurrentStateVersion-1); !errors.Is(err, ErrUnsupportedStateVersion) {
+				t.Errorf("Expected ErrUnsupportedStateVersion from an older build, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMigrateStateProtectionLevel(t *testing.T) {
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(olderState(5, olderVersion)), &doc); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if err := stateMigrations[5](doc); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+
+	versions := docVersions(doc)
+	if len(versions) != 1 || versions[0]["protectionLevel"] != "SOFTWARE" {
+		t.Errorf("Expected protectionLevel SOFTWARE, got %v", versions)
+	}
+}
+
+func TestStateFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	s := NewStorage()
+	if _, err := s.CreateKeyRing("projects/test/locations/global/keyRings/ring1"); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	if err := s.SaveStateFile(path); err != nil {
+		t.Fatalf("SaveStateFile failed: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("State file not written: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected state file mode 0600, got %v", info.Mode().Perm())
+	}
+
+	restored := NewStorage()
+	if err := restored.LoadStateFile(path); err != nil {
+		t.Fatalf("LoadStateFile failed: %v", err)
+	}
+	if _, err := restored.GetKeyRing("projects/test/locations/global/keyRings/ring1"); err != nil {
+		t.Errorf("Keyring not restored: %v", err)
+	}
+
+	from, err := MigrateStateFile(path)
+	if err != nil {
+		t.Fatalf("MigrateStateFile failed: %v", err)
+	}
+	if from != CurrentStateVersion {
+		t.Errorf("Expected version %d, got %d", CurrentStateVersion, from)
+	}
+}
+
+func TestLoadStateFileMissing(t *testing.T) {
+	s := NewStorage()
+	err := s.LoadStateFile(filepath.Join(t.TempDir(), "missing.json"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected os.ErrNotExist, got %v", err)
+	}
+}
@@ -4,60 +4,143 @@
 // a complete in-memory representation of keyrings, crypto keys, and key versions
 // with real AES-256-GCM encryption.
 //
-// All storage operations are thread-safe using sync.RWMutex, allowing concurrent
-// access from multiple gRPC or REST API handlers.
+// All storage operations are safe for concurrent use by gRPC and REST API
+// handlers. The hot read paths (Get*, Encrypt, Decrypt and the other
+// cryptographic operations) take no locks: they read an immutable view of
+// the resources that writers publish atomically, copy-on-write, before
+// unlocking (see view.go). Writers lock only the keyring they change (see
+// lockKeyRing), so writes to different keyrings do not block each other;
+// operations that add keyrings or span all of them take the storage-wide
+// lock.
 //
 // # Key Features
 //
 // Real cryptographic operations using Go's crypto/aes and crypto/cipher packages.
 // Automatic key version management with auto-incrementing version IDs. Version-aware
-// decryption that tries all enabled versions. State management for version lifecycle
+// decryption with the version that encrypted the data. State management for version lifecycle
 // (ENABLED, DISABLED, DESTROY_SCHEDULED, DESTROYED).
+// Versions reaching DESTROYED have their key material zeroed and dropped (see
+// destroy.go).
+//
+// Asymmetric keys (ASYMMETRIC_SIGN, ASYMMETRIC_DECRYPT) hold an RSA, ECDSA or
+// Ed25519 private key per version, stored PKCS#8-encoded. MAC keys hold an
+// HMAC key in place of the AES key. See keys.go for the supported algorithms.
+//
+// Import jobs hold an RSA wrapping key; ImportCryptoKeyVersion unwraps key
+// material with it into a new version (see imports.go).
 //
 // # Storage Structure
 //
 // Storage maintains a hierarchical structure:
 //   - KeyRings: Top-level containers identified by name
 //   - CryptoKeys: Keys within keyrings with purpose and metadata
-//   - CryptoKeyVersions: Individual versions with symmetric keys and state
+//   - ImportJobs: Wrapping keys within keyrings for importing key material
+//   - CryptoKeyVersions: Individual versions with key material and state
 //
 // # Thread Safety
 //
-// All public methods use appropriate read or write locks. Read operations
-// (Get, List) use RLock for concurrent reads. Write operations (Create, Update,
-// Delete) use Lock for exclusive access.
+// Calls on one keyring lock that keyring (see lockKeyRing), so calls on
+// different keyrings run concurrently, and calls that span every keyring
+// lock them all. The hot read paths (Get, Encrypt, Decrypt, sign and MAC)
+// take no locks: they read an immutable view that writers publish after
+// every change (see view.go).
 //
 // # Encryption
 //
-// Encrypt operations use the primary version's symmetric key. Decrypt operations
-// try all enabled versions to support data encrypted with older keys. Each version
-// has a unique 256-bit AES key generated with crypto/rand.
+// Encrypt operations use the primary version's symmetric key and name that
+// version in the ciphertext (see ciphertext.go), so Decrypt uses the version
+// that produced it, and reports whether it is the primary. Each version has a
+// unique 256-bit AES key generated with crypto/rand.
+//
+// # Persistence
+//
+// SaveState and LoadState serialize the full storage contents, including key
+// material, to a versioned JSON document. Documents written by older releases
+// are migrated forward on load; documents from newer releases are rejected
+// rather than partially understood.
+//
+// Named snapshots (SaveSnapshot, RestoreSnapshot) are in-memory deep copies
+// for resetting to a fixture between tests without serializing anything.
 package storage
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
+	"crypto/hmac"
 	"fmt"
-	"io"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // Storage manages in-memory KMS resources
 type Storage struct {
-	mu       sync.RWMutex
-	keyrings map[string]*StoredKeyRing
+	// mu guards the keyrings map and the settings below. Calls on one
+	// keyring hold it for reading along with that keyring's lock (see
+	// lockKeyRing), so calls on different keyrings do not block each other;
+	// calls that add keyrings or span all of them hold it for writing.
+	mu        sync.RWMutex
+	keyrings  map[string]*StoredKeyRing
+	snapshots map[string]*snapshot
+
+	// view is what the lock-free read paths read, and publishMu orders the
+	// writers publishing it (see view.go)
+	view      atomic.Pointer[readView]
+	publishMu sync.Mutex
+
+	destroyScheduledDuration time.Duration
+
+	// backend holds the key material of the keys it is selected for, by
+	// BackendLabel or by a pattern (see backend.go). It is atomic because
+	// the lock-free read paths use it.
+	backend atomic.Pointer[backendConfig]
+
+	// keyPool holds pre-generated asymmetric keys (see keypool.go)
+	keyPool atomic.Pointer[keyPool]
+
+	// generator generates asymmetric keys in the background when
+	// asynchronous generation is on (see generation.go)
+	generator atomic.Pointer[generator]
+
+	// mockCrypto replaces AES-GCM in Encrypt and Decrypt with a plaintext
+	// envelope (see mock.go)
+	mockCrypto atomic.Bool
+
+	// deterministic makes Encrypt use AES-SIV for every crypto key (see
+	// deterministic.go)
+	deterministic atomic.Bool
+
+	// frozenTime, when set, is recorded instead of the current time (see
+	// clock.go)
+	frozenTime atomic.Pointer[time.Time]
+
+	// clock, when set, replaces time.Now (see clock.go)
+	clock atomic.Pointer[func() time.Time]
+
+	// usage counts the operations on each crypto key and version by name
+	// (see usage.go)
+	usage sync.Map
+
+	// hooks run around storage operations for embedders (see hooks.go)
+	hooks atomic.Pointer[[]Hooks]
 }
 
 // StoredKeyRing represents a keyring and its crypto keys
 type StoredKeyRing struct {
+	// mu guards CryptoKeys, ImportJobs and everything in them; Name and
+	// CreateTime never change
+	mu sync.RWMutex
+
 	Name       string
 	CreateTime time.Time
 	CryptoKeys map[string]*StoredCryptoKey
+	ImportJobs map[string]*StoredImportJob
 }
 
 // StoredCryptoKey represents a crypto key and its versions
@@ -70,6 +153,10 @@ type StoredCryptoKey struct {
 	NextVersionID   int64
 	VersionTemplate *kmspb.CryptoKeyVersionTemplate
 	Labels          map[string]string
+	// RotationPeriod and NextRotationTime are recorded for API fidelity; the
+	// emulator does not rotate keys on its own
+	RotationPeriod   time.Duration
+	NextRotationTime time.Time
 }
 
 // StoredCryptoKeyVersion represents a single version of a crypto key
@@ -79,17 +166,55 @@ type StoredCryptoKeyVersion struct {
 	CreateTime   time.Time
 	Algorithm    kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm
 	SymmetricKey []byte // AES key for symmetric encryption
+	PrivateKey   []byte // PKCS#8 DER private key for asymmetric algorithms
+	// ProtectionLevel is fixed when the version is created; unspecified
+	// means SOFTWARE
+	ProtectionLevel kmspb.ProtectionLevel
+	// DestroyTime is when a DESTROY_SCHEDULED version is due to be destroyed,
+	// and DestroyEventTime when it was. Destroyed versions have no key
+	// material.
+	DestroyTime      time.Time
+	DestroyEventTime time.Time
+	// ImportJob is the import job that last imported key material into a
+	// version created by ImportCryptoKeyVersion, ImportTime when that import
+	// succeeded and ImportFailureReason why it failed, for IMPORT_FAILED
+	// versions. ImportedKeyHash is the SHA-256 of the imported material,
+	// which re-imports must match.
+	ImportJob           string
+	ImportTime          time.Time
+	ImportFailureReason string
+	ImportedKeyHash     []byte
+	// Backend names the key backend holding the key material, which the
+	// version then has none of; empty when the emulator holds it
+	Backend string
+	// GenerateTime is when background generation finished, and
+	// GenerationFailureReason why it failed, for GENERATION_FAILED versions.
+	// Versions generated on creation leave GenerateTime zero.
+	GenerateTime            time.Time
+	GenerationFailureReason string
 }
 
 // NewStorage creates a new storage instance
 func NewStorage() *Storage {
-	return &Storage{
-		keyrings: make(map[string]*StoredKeyRing),
+	s := &Storage{
+		keyrings:                 make(map[string]*StoredKeyRing),
+		destroyScheduledDuration: DefaultDestroyScheduledDuration,
 	}
+	s.view.Store(&readView{})
+	return s
 }
 
 // CreateKeyRing creates a new keyring
 func (s *Storage) CreateKeyRing(name string) (*kmspb.KeyRing, error) {
+	if err := s.beforeHooks(HookCreate, name); err != nil {
+		return nil, err
+	}
+	keyring, err := s.createKeyRing(name)
+	s.afterHooks(HookCreate, name, "", err)
+	return keyring, err
+}
+
+func (s *Storage) createKeyRing(name string) (*kmspb.KeyRing, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -97,14 +222,16 @@ func (s *Storage) CreateKeyRing(name string) (*kmspb.KeyRing, error) {
 		return nil, fmt.Errorf("keyring already exists: %s", name)
 	}
 
-	now := time.Now()
+	now := s.now()
 	keyring := &StoredKeyRing{
 		Name:       name,
 		CreateTime: now,
 		CryptoKeys: make(map[string]*StoredCryptoKey),
+		ImportJobs: make(map[string]*StoredImportJob),
 	}
 
 	s.keyrings[name] = keyring
+	s.publishKeyRing(keyring)
 
 	return &kmspb.KeyRing{
 		Name:       name,
@@ -114,52 +241,66 @@ func (s *Storage) CreateKeyRing(name string) (*kmspb.KeyRing, error) {
 
 // GetKeyRing retrieves a keyring
 func (s *Storage) GetKeyRing(name string) (*kmspb.KeyRing, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	keyring, exists := s.keyrings[name]
+	keyring, exists := s.view.Load().keyRings[name]
 	if !exists {
 		return nil, fmt.Errorf("keyring not found: %s", name)
 	}
 
 	return &kmspb.KeyRing{
-		Name:       keyring.Name,
-		CreateTime: timestamppb.New(keyring.CreateTime),
+		Name:       name,
+		CreateTime: timestamppb.New(keyring.createTime),
 	}, nil
 }
 
-// ListKeyRings lists all keyrings in a location
+// ListKeyRings lists the keyrings in a location, ordered by name
 func (s *Storage) ListKeyRings(parent string) ([]*kmspb.KeyRing, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	prefix := parent + "/keyRings/"
 	var keyrings []*kmspb.KeyRing
 	for _, kr := range s.keyrings {
+		if !strings.HasPrefix(kr.Name, prefix) {
+			continue
+		}
 		keyrings = append(keyrings, &kmspb.KeyRing{
 			Name:       kr.Name,
 			CreateTime: timestamppb.New(kr.CreateTime),
 		})
 	}
 
+	sort.Slice(keyrings, func(i, j int) bool { return keyrings[i].Name < keyrings[j].Name })
 	return keyrings, nil
 }
 
 // CreateCryptoKey creates a new crypto key
 func (s *Storage) CreateCryptoKey(keyringName, keyID string, purpose kmspb.CryptoKey_CryptoKeyPurpose, versionTemplate *kmspb.CryptoKeyVersionTemplate, labels map[string]string) (*kmspb.CryptoKey, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	keyName := fmt.Sprintf("%s/cryptoKeys/%s", keyringName, keyID)
+	if err := s.beforeHooks(HookCreate, keyName); err != nil {
+		return nil, err
+	}
+	cryptoKey, err := s.createCryptoKey(keyringName, keyName, purpose, versionTemplate, labels)
+	var version string
+	if err == nil {
+		version = keyName + "/cryptoKeyVersions/1"
+	}
+	s.afterHooks(HookCreate, keyName, version, err)
+	return cryptoKey, err
+}
+
+func (s *Storage) createCryptoKey(keyringName, keyName string, purpose kmspb.CryptoKey_CryptoKeyPurpose, versionTemplate *kmspb.CryptoKeyVersionTemplate, labels map[string]string) (*kmspb.CryptoKey, error) {
+	defer s.lockKeyRing(keyName)()
 
 	keyring, exists := s.keyrings[keyringName]
 	if !exists {
 		return nil, fmt.Errorf("keyring not found: %s", keyringName)
 	}
 
-	keyName := fmt.Sprintf("%s/cryptoKeys/%s", keyringName, keyID)
 	if _, exists := keyring.CryptoKeys[keyName]; exists {
 		return nil, fmt.Errorf("crypto key already exists: %s", keyName)
 	}
 
-	now := time.Now()
+	now := s.now()
 
 	// Create first version automatically
 	versionName := fmt.Sprintf("%s/cryptoKeyVersions/1", keyName)
@@ -168,176 +309,152 @@ func (s *Storage) CreateCryptoKey(keyringName, keyID string, purpose kmspb.Crypt
 		algorithm = versionTemplate.Algorithm
 	}
 
-	// Generate symmetric key for encryption
-	symmetricKey := make([]byte, 32) // AES-256
-	if _, err := io.ReadFull(rand.Reader, symmetricKey); err != nil {
-		return nil, fmt.Errorf("failed to generate key: %w", err)
-	}
-
 	version := &StoredCryptoKeyVersion{
-		Name:         versionName,
-		State:        kmspb.CryptoKeyVersion_ENABLED,
-		CreateTime:   now,
-		Algorithm:    algorithm,
-		SymmetricKey: symmetricKey,
+		Name:            versionName,
+		State:           kmspb.CryptoKeyVersion_ENABLED,
+		CreateTime:      now,
+		Algorithm:       algorithm,
+		ProtectionLevel: templateProtectionLevel(versionTemplate),
+	}
+	if err := s.generateKey(version, keyName, labels); err != nil {
+		return nil, err
 	}
 
 	cryptoKey := &StoredCryptoKey{
 		Name:            keyName,
 		CreateTime:      now,
 		Purpose:         purpose,
-		PrimaryVersion:  versionName,
 		Versions:        map[string]*StoredCryptoKeyVersion{versionName: version},
 		NextVersionID:   2,
 		VersionTemplate: versionTemplate,
 		Labels:          labels,
 	}
+	if HasPrimaryVersion(purpose) {
+		cryptoKey.PrimaryVersion = versionName
+	}
 
 	keyring.CryptoKeys[keyName] = cryptoKey
 
-	return &kmspb.CryptoKey{
-		Name:       keyName,
-		CreateTime: timestamppb.New(now),
-		Purpose:    purpose,
-		Primary: &kmspb.CryptoKeyVersion{
-			Name:       versionName,
-			State:      kmspb.CryptoKeyVersion_ENABLED,
-			CreateTime: timestamppb.New(now),
-			Algorithm:  algorithm,
-		},
-		VersionTemplate: versionTemplate,
-		Labels:          labels,
-	}, nil
+	return cryptoKeyProto(cryptoKey), nil
 }
 
 // GetCryptoKey retrieves a crypto key
 func (s *Storage) GetCryptoKey(name string) (*kmspb.CryptoKey, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	for _, keyring := range s.keyrings {
-		if cryptoKey, exists := keyring.CryptoKeys[name]; exists {
-			primary := cryptoKey.Versions[cryptoKey.PrimaryVersion]
-			return &kmspb.CryptoKey{
-				Name:       cryptoKey.Name,
-				CreateTime: timestamppb.New(cryptoKey.CreateTime),
-				Purpose:    cryptoKey.Purpose,
-				Primary: &kmspb.CryptoKeyVersion{
-					Name:       primary.Name,
-					State:      primary.State,
-					CreateTime: timestamppb.New(primary.CreateTime),
-					Algorithm:  primary.Algorithm,
-				},
-				VersionTemplate: cryptoKey.VersionTemplate,
-				Labels:          cryptoKey.Labels,
-			}, nil
-		}
+	if cryptoKey := s.view.Load().cryptoKey(name); cryptoKey != nil {
+		return cryptoKeyProto(cryptoKey), nil
 	}
 
 	return nil, fmt.Errorf("crypto key not found: %s", name)
 }
 
-// Encrypt encrypts plaintext using a crypto key
-func (s *Storage) Encrypt(keyName string, plaintext []byte) ([]byte, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// Encrypt encrypts plaintext using a crypto key's primary version, or the
+// version name names, returning the ciphertext and the name and protection
+// level of the version. The ciphertext only decrypts with the same
+// additional authenticated data.
+func (s *Storage) Encrypt(name string, plaintext, aad []byte) ([]byte, string, kmspb.ProtectionLevel, error) {
+	if err := s.beforeHooks(HookEncrypt, name); err != nil {
+		return nil, "", 0, err
+	}
+	ciphertext, version, level, err := s.encrypt(name, plaintext, aad)
+	s.afterHooks(HookEncrypt, name, version, err)
+	return ciphertext, version, level, err
+}
+
+func (s *Storage) encrypt(name string, plaintext, aad []byte) ([]byte, string, kmspb.ProtectionLevel, error) {
+	view := s.view.Load()
 
 	var cryptoKey *StoredCryptoKey
-	for _, keyring := range s.keyrings {
-		if ck, exists := keyring.CryptoKeys[keyName]; exists {
-			cryptoKey = ck
-			break
+	var version *StoredCryptoKeyVersion
+	if parentName(name, "/cryptoKeyVersions/") != "" {
+		if cryptoKey, version = view.cryptoKeyVersion(name); version == nil {
+			return nil, "", 0, fmt.Errorf("crypto key version not found: %s", name)
 		}
+	} else if cryptoKey = view.cryptoKey(name); cryptoKey == nil {
+		return nil, "", 0, fmt.Errorf("crypto key not found: %s", name)
 	}
-
-	if cryptoKey == nil {
-		return nil, fmt.Errorf("crypto key not found: %s", keyName)
+	if cryptoKey.Purpose != kmspb.CryptoKey_ENCRYPT_DECRYPT {
+		return nil, "", 0, fmt.Errorf("crypto key %s has purpose %s, which does not support Encrypt", cryptoKey.Name, cryptoKey.Purpose)
 	}
 
-	primaryVersion := cryptoKey.Versions[cryptoKey.PrimaryVersion]
-	if primaryVersion == nil {
-		return nil, fmt.Errorf("primary version not found")
-	}
-
-	if primaryVersion.State != kmspb.CryptoKeyVersion_ENABLED {
-		return nil, fmt.Errorf("primary version is not enabled")
+	if version == nil {
+		if version = cryptoKey.Versions[cryptoKey.PrimaryVersion]; version == nil {
+			return nil, "", 0, fmt.Errorf("crypto key %s has no primary version", name)
+		}
+		if version.State != kmspb.CryptoKeyVersion_ENABLED {
+			return nil, "", 0, fmt.Errorf("primary version %s is not enabled", version.Name)
+		}
+	} else if version.State != kmspb.CryptoKeyVersion_ENABLED {
+		return nil, "", 0, fmt.Errorf("crypto key version is not enabled: %s (state %s)", name, version.State)
 	}
 
-	// AES-GCM encryption
-	block, err := aes.NewCipher(primaryVersion.SymmetricKey)
+	// AES-GCM, or AES-SIV for deterministic keys
+	ciphertext, err := s.seal(version, plaintext, aad, s.encryptsDeterministically(cryptoKey))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+		return nil, "", 0, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %w", err)
-	}
+	s.recordUse(opEncrypt, version.Name, len(plaintext))
+	return sealCiphertext(version.Name, ciphertext), version.Name, versionProtectionLevel(version), nil
+}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+// Decrypt decrypts ciphertext using a crypto key and the additional
+// authenticated data it was encrypted with, reporting whether the version
+// that decrypted it is the primary, and its protection level
+func (s *Storage) Decrypt(keyName string, ciphertext, aad []byte) ([]byte, bool, kmspb.ProtectionLevel, error) {
+	if err := s.beforeHooks(HookDecrypt, keyName); err != nil {
+		return nil, false, 0, err
 	}
-
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
-	return ciphertext, nil
+	plaintext, primary, level, err := s.decrypt(keyName, ciphertext, aad)
+	s.afterHooks(HookDecrypt, keyName, "", err)
+	return plaintext, primary, level, err
 }
 
-// Decrypt decrypts ciphertext using a crypto key
-func (s *Storage) Decrypt(keyName string, ciphertext []byte) ([]byte, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	var cryptoKey *StoredCryptoKey
-	for _, keyring := range s.keyrings {
-		if ck, exists := keyring.CryptoKeys[keyName]; exists {
-			cryptoKey = ck
-			break
-		}
+func (s *Storage) decrypt(keyName string, ciphertext, aad []byte) ([]byte, bool, kmspb.ProtectionLevel, error) {
+	cryptoKey := s.view.Load().cryptoKey(keyName)
+	if cryptoKey == nil {
+		return nil, false, 0, fmt.Errorf("crypto key not found: %s", keyName)
+	}
+	if cryptoKey.Purpose != kmspb.CryptoKey_ENCRYPT_DECRYPT {
+		return nil, false, 0, fmt.Errorf("crypto key %s has purpose %s, which does not support Decrypt", keyName, cryptoKey.Purpose)
 	}
 
-	if cryptoKey == nil {
-		return nil, fmt.Errorf("crypto key not found: %s", keyName)
+	// The ciphertext names the version that produced it, which must be
+	// enabled, as in Cloud KMS
+	if versionName, sealed, ok := openCiphertext(keyName, ciphertext); ok {
+		if version := cryptoKey.Versions[versionName]; version != nil {
+			if version.State != kmspb.CryptoKeyVersion_ENABLED {
+				return nil, false, 0, fmt.Errorf("%s is not enabled, current state is: %s", versionName, version.State)
+			}
+			if plaintext, err := s.decryptWithVersion(version, sealed, aad); err == nil {
+				s.recordUse(opDecrypt, versionName, len(plaintext))
+				return plaintext, versionName == cryptoKey.PrimaryVersion, versionProtectionLevel(version), nil
+			}
+		}
 	}
 
-	// Try all versions (in case it was encrypted with a non-primary version)
+	// Ciphertexts from earlier releases may come from any enabled version
 	for _, version := range cryptoKey.Versions {
 		if version.State != kmspb.CryptoKeyVersion_ENABLED {
 			continue
 		}
 
-		plaintext, err := s.decryptWithVersion(version, ciphertext)
+		plaintext, err := s.decryptWithVersion(version, ciphertext, aad)
 		if err == nil {
-			return plaintext, nil
+			s.recordUse(opDecrypt, version.Name, len(plaintext))
+			return plaintext, version.Name == cryptoKey.PrimaryVersion, versionProtectionLevel(version), nil
 		}
 	}
 
-	return nil, fmt.Errorf("failed to decrypt with any key version")
+	return nil, false, 0, fmt.Errorf("failed to decrypt with any key version")
 }
 
-func (s *Storage) decryptWithVersion(version *StoredCryptoKeyVersion, ciphertext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(version.SymmetricKey)
-	if err != nil {
-		return nil, err
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
-	}
-
-	if len(ciphertext) < gcm.NonceSize() {
-		return nil, fmt.Errorf("ciphertext too short")
-	}
-
-	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
-	return gcm.Open(nil, nonce, ciphertext, nil)
+func (s *Storage) decryptWithVersion(version *StoredCryptoKeyVersion, ciphertext, aad []byte) ([]byte, error) {
+	return s.open(version, ciphertext, aad)
 }
 
-// ListCryptoKeys lists all crypto keys in a keyring
+// ListCryptoKeys lists all crypto keys in a keyring, ordered by name
 func (s *Storage) ListCryptoKeys(keyringName string) ([]*kmspb.CryptoKey, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	defer s.rlockKeyRing(keyringName)()
 
 	keyring, exists := s.keyrings[keyringName]
 	if !exists {
@@ -346,43 +463,33 @@ func (s *Storage) ListCryptoKeys(keyringName string) ([]*kmspb.CryptoKey, error)
 
 	var cryptoKeys []*kmspb.CryptoKey
 	for _, ck := range keyring.CryptoKeys {
-		primary := ck.Versions[ck.PrimaryVersion]
-		cryptoKeys = append(cryptoKeys, &kmspb.CryptoKey{
-			Name:       ck.Name,
-			CreateTime: timestamppb.New(ck.CreateTime),
-			Purpose:    ck.Purpose,
-			Primary: &kmspb.CryptoKeyVersion{
-				Name:       primary.Name,
-				State:      primary.State,
-				CreateTime: timestamppb.New(primary.CreateTime),
-				Algorithm:  primary.Algorithm,
-			},
-			VersionTemplate: ck.VersionTemplate,
-			Labels:          ck.Labels,
-		})
+		cryptoKeys = append(cryptoKeys, cryptoKeyProto(ck))
 	}
 
+	sort.Slice(cryptoKeys, func(i, j int) bool { return cryptoKeys[i].Name < cryptoKeys[j].Name })
+
 	return cryptoKeys, nil
 }
 
 // CreateCryptoKeyVersion creates a new version for an existing crypto key
 func (s *Storage) CreateCryptoKeyVersion(keyName string) (*kmspb.CryptoKeyVersion, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	var cryptoKey *StoredCryptoKey
-	for _, keyring := range s.keyrings {
-		if ck, exists := keyring.CryptoKeys[keyName]; exists {
-			cryptoKey = ck
-			break
-		}
+	if err := s.beforeHooks(HookCreate, keyName); err != nil {
+		return nil, err
 	}
+	version, err := s.createCryptoKeyVersion(keyName)
+	s.afterHooks(HookCreate, keyName, version.GetName(), err)
+	return version, err
+}
 
+func (s *Storage) createCryptoKeyVersion(keyName string) (*kmspb.CryptoKeyVersion, error) {
+	defer s.lockKeyRing(keyName)()
+
+	cryptoKey := s.findCryptoKey(keyName)
 	if cryptoKey == nil {
 		return nil, fmt.Errorf("crypto key not found: %s", keyName)
 	}
 
-	now := time.Now()
+	now := s.now()
 	versionID := cryptoKey.NextVersionID
 	versionName := fmt.Sprintf("%s/cryptoKeyVersions/%d", keyName, versionID)
 
@@ -391,46 +498,34 @@ func (s *Storage) CreateCryptoKeyVersion(keyName string) (*kmspb.CryptoKeyVersio
 		algorithm = cryptoKey.VersionTemplate.Algorithm
 	}
 
-	symmetricKey := make([]byte, 32)
-	if _, err := io.ReadFull(rand.Reader, symmetricKey); err != nil {
-		return nil, fmt.Errorf("failed to generate key: %w", err)
-	}
-
 	version := &StoredCryptoKeyVersion{
-		Name:         versionName,
-		State:        kmspb.CryptoKeyVersion_ENABLED,
-		CreateTime:   now,
-		Algorithm:    algorithm,
-		SymmetricKey: symmetricKey,
+		Name:            versionName,
+		State:           kmspb.CryptoKeyVersion_ENABLED,
+		CreateTime:      now,
+		Algorithm:       algorithm,
+		ProtectionLevel: templateProtectionLevel(cryptoKey.VersionTemplate),
+	}
+	if err := s.generateKey(version, keyName, cryptoKey.Labels); err != nil {
+		return nil, err
 	}
 
 	cryptoKey.Versions[versionName] = version
 	cryptoKey.NextVersionID++
 
-	return &kmspb.CryptoKeyVersion{
-		Name:       versionName,
-		State:      kmspb.CryptoKeyVersion_ENABLED,
-		CreateTime: timestamppb.New(now),
-		Algorithm:  algorithm,
-	}, nil
+	return versionProto(version), nil
 }
 
 // UpdateCryptoKeyPrimaryVersion sets a new primary version for a crypto key
 func (s *Storage) UpdateCryptoKeyPrimaryVersion(keyName, versionName string) (*kmspb.CryptoKey, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	var cryptoKey *StoredCryptoKey
-	for _, keyring := range s.keyrings {
-		if ck, exists := keyring.CryptoKeys[keyName]; exists {
-			cryptoKey = ck
-			break
-		}
-	}
+	defer s.lockKeyRing(keyName)()
 
+	cryptoKey := s.findCryptoKey(keyName)
 	if cryptoKey == nil {
 		return nil, fmt.Errorf("crypto key not found: %s", keyName)
 	}
+	if !HasPrimaryVersion(cryptoKey.Purpose) {
+		return nil, fmt.Errorf("crypto key %s has purpose %s, which does not support UpdateCryptoKeyPrimaryVersion", keyName, cryptoKey.Purpose)
+	}
 
 	version, exists := cryptoKey.Versions[versionName]
 	if !exists {
@@ -443,161 +538,554 @@ func (s *Storage) UpdateCryptoKeyPrimaryVersion(keyName, versionName string) (*k
 
 	cryptoKey.PrimaryVersion = versionName
 
-	primary := cryptoKey.Versions[cryptoKey.PrimaryVersion]
-	return &kmspb.CryptoKey{
-		Name:       cryptoKey.Name,
-		CreateTime: timestamppb.New(cryptoKey.CreateTime),
-		Purpose:    cryptoKey.Purpose,
-		Primary: &kmspb.CryptoKeyVersion{
-			Name:       primary.Name,
-			State:      primary.State,
-			CreateTime: timestamppb.New(primary.CreateTime),
-			Algorithm:  primary.Algorithm,
-		},
-		VersionTemplate: cryptoKey.VersionTemplate,
-		Labels:          cryptoKey.Labels,
-	}, nil
+	return cryptoKeyProto(cryptoKey), nil
 }
 
 // GetCryptoKeyVersion retrieves a specific crypto key version
 func (s *Storage) GetCryptoKeyVersion(versionName string) (*kmspb.CryptoKeyVersion, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	_, version := s.view.Load().cryptoKeyVersion(versionName)
+	if version == nil {
+		return nil, fmt.Errorf("crypto key version not found: %s", versionName)
+	}
+	return versionProto(version), nil
+}
 
-	for _, keyring := range s.keyrings {
-		for _, cryptoKey := range keyring.CryptoKeys {
-			if version, exists := cryptoKey.Versions[versionName]; exists {
-				return &kmspb.CryptoKeyVersion{
-					Name:       version.Name,
-					State:      version.State,
-					CreateTime: timestamppb.New(version.CreateTime),
-					Algorithm:  version.Algorithm,
-				}, nil
-			}
-		}
+// GetPublicKey returns the public key of an enabled asymmetric crypto key
+// version
+func (s *Storage) GetPublicKey(versionName string) (*kmspb.PublicKey, error) {
+	cryptoKey, version := s.view.Load().cryptoKeyVersion(versionName)
+	if version == nil {
+		return nil, fmt.Errorf("crypto key version not found: %s", versionName)
+	}
+	if !IsAsymmetric(cryptoKey.Purpose) {
+		return nil, fmt.Errorf("crypto key %s has purpose %s, which does not support GetPublicKey", cryptoKey.Name, cryptoKey.Purpose)
+	}
+	if version.State != kmspb.CryptoKeyVersion_ENABLED {
+		return nil, fmt.Errorf("crypto key version is not enabled: %s (state %s)", versionName, version.State)
 	}
 
-	return nil, fmt.Errorf("crypto key version not found: %s", versionName)
+	key, err := s.privateKey(version)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := publicKeyPEM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &kmspb.PublicKey{
+		Name:            version.Name,
+		Pem:             pem,
+		Algorithm:       version.Algorithm,
+		ProtectionLevel: versionProtectionLevel(version),
+	}, nil
 }
 
-// ListCryptoKeyVersions lists all versions of a crypto key
-func (s *Storage) ListCryptoKeyVersions(keyName string) ([]*kmspb.CryptoKeyVersion, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// AsymmetricSign signs a digest, or data for algorithms that sign the
+// message itself, with an enabled ASYMMETRIC_SIGN crypto key version,
+// returning the signature and the version's protection level
+func (s *Storage) AsymmetricSign(versionName string, digest *kmspb.Digest, data []byte) ([]byte, kmspb.ProtectionLevel, error) {
+	cryptoKey, version := s.view.Load().cryptoKeyVersion(versionName)
+	if version == nil {
+		return nil, 0, fmt.Errorf("crypto key version not found: %s", versionName)
+	}
+	if cryptoKey.Purpose != kmspb.CryptoKey_ASYMMETRIC_SIGN {
+		return nil, 0, fmt.Errorf("crypto key %s has purpose %s, which does not support AsymmetricSign", cryptoKey.Name, cryptoKey.Purpose)
+	}
+	if version.State != kmspb.CryptoKeyVersion_ENABLED {
+		return nil, 0, fmt.Errorf("crypto key version is not enabled: %s (state %s)", versionName, version.State)
+	}
+	key, err := s.privateKey(version)
+	if err != nil {
+		return nil, 0, err
+	}
+	signature, err := sign(key, version, digest, data)
+	if err == nil {
+		s.recordUse(opAsymmetricSign, versionName, len(data))
+	}
+	return signature, versionProtectionLevel(version), err
+}
 
-	var cryptoKey *StoredCryptoKey
-	for _, keyring := range s.keyrings {
-		if ck, exists := keyring.CryptoKeys[keyName]; exists {
-			cryptoKey = ck
-			break
-		}
+// AsymmetricDecrypt decrypts RSA-OAEP ciphertext with an enabled
+// ASYMMETRIC_DECRYPT crypto key version, returning the plaintext and the
+// version's protection level
+func (s *Storage) AsymmetricDecrypt(versionName string, ciphertext []byte) ([]byte, kmspb.ProtectionLevel, error) {
+	cryptoKey, version := s.view.Load().cryptoKeyVersion(versionName)
+	if version == nil {
+		return nil, 0, fmt.Errorf("crypto key version not found: %s", versionName)
 	}
+	if cryptoKey.Purpose != kmspb.CryptoKey_ASYMMETRIC_DECRYPT {
+		return nil, 0, fmt.Errorf("crypto key %s has purpose %s, which does not support AsymmetricDecrypt", cryptoKey.Name, cryptoKey.Purpose)
+	}
+	if version.State != kmspb.CryptoKeyVersion_ENABLED {
+		return nil, 0, fmt.Errorf("crypto key version is not enabled: %s (state %s)", versionName, version.State)
+	}
+	key, err := s.privateKey(version)
+	if err != nil {
+		return nil, 0, err
+	}
+	plaintext, err := decryptOAEP(key, version, ciphertext)
+	if err == nil {
+		s.recordUse(opAsymmetricDecrypt, versionName, len(plaintext))
+	}
+	return plaintext, versionProtectionLevel(version), err
+}
 
+// MacSign computes the HMAC tag of data with an enabled MAC crypto key
+// version, returning the tag and the version's protection level
+func (s *Storage) MacSign(versionName string, data []byte) ([]byte, kmspb.ProtectionLevel, error) {
+	cryptoKey, version := s.view.Load().cryptoKeyVersion(versionName)
+	if version == nil {
+		return nil, 0, fmt.Errorf("crypto key version not found: %s", versionName)
+	}
+	if cryptoKey.Purpose != kmspb.CryptoKey_MAC {
+		return nil, 0, fmt.Errorf("crypto key %s has purpose %s, which does not support MacSign", cryptoKey.Name, cryptoKey.Purpose)
+	}
+	if version.State != kmspb.CryptoKeyVersion_ENABLED {
+		return nil, 0, fmt.Errorf("crypto key version is not enabled: %s (state %s)", versionName, version.State)
+	}
+	mac, err := s.mac(version, data)
+	if err == nil {
+		s.recordUse(opMacSign, versionName, len(data))
+	}
+	return mac, versionProtectionLevel(version), err
+}
+
+// MacVerify reports whether mac is the HMAC tag of data under an enabled MAC
+// crypto key version, comparing tags in constant time, and the version's
+// protection level. A mismatch is not an error.
+func (s *Storage) MacVerify(versionName string, data, mac []byte) (bool, kmspb.ProtectionLevel, error) {
+	cryptoKey, version := s.view.Load().cryptoKeyVersion(versionName)
+	if version == nil {
+		return false, 0, fmt.Errorf("crypto key version not found: %s", versionName)
+	}
+	if cryptoKey.Purpose != kmspb.CryptoKey_MAC {
+		return false, 0, fmt.Errorf("crypto key %s has purpose %s, which does not support MacVerify", cryptoKey.Name, cryptoKey.Purpose)
+	}
+	if version.State != kmspb.CryptoKeyVersion_ENABLED {
+		return false, 0, fmt.Errorf("crypto key version is not enabled: %s (state %s)", versionName, version.State)
+	}
+	expected, err := s.mac(version, data)
+	if err != nil {
+		return false, 0, err
+	}
+	s.recordUse(opMacVerify, versionName, len(data))
+	return hmac.Equal(expected, mac), versionProtectionLevel(version), nil
+}
+
+// ListCryptoKeyVersions lists all versions of a crypto key, ordered by
+// version number
+func (s *Storage) ListCryptoKeyVersions(keyName string) ([]*kmspb.CryptoKeyVersion, error) {
+	defer s.rlockKeyRing(keyName)()
+
+	cryptoKey := s.findCryptoKey(keyName)
 	if cryptoKey == nil {
 		return nil, fmt.Errorf("crypto key not found: %s", keyName)
 	}
 
+	ids := make(map[string]int64, len(cryptoKey.Versions))
 	var versions []*kmspb.CryptoKeyVersion
 	for _, version := range cryptoKey.Versions {
-		versions = append(versions, &kmspb.CryptoKeyVersion{
-			Name:       version.Name,
-			State:      version.State,
-			CreateTime: timestamppb.New(version.CreateTime),
-			Algorithm:  version.Algorithm,
-		})
+		ids[version.Name], _ = strconv.ParseInt(version.Name[strings.LastIndex(version.Name, "/")+1:], 10, 64)
+		versions = append(versions, versionProto(version))
 	}
 
+	sort.Slice(versions, func(i, j int) bool { return ids[versions[i].Name] < ids[versions[j].Name] })
 	return versions, nil
 }
 
-// UpdateCryptoKeyVersion updates the state of a crypto key version
-func (s *Storage) UpdateCryptoKeyVersion(versionName string, state kmspb.CryptoKeyVersion_CryptoKeyVersionState) (*kmspb.CryptoKeyVersion, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	for _, keyring := range s.keyrings {
-		for _, cryptoKey := range keyring.CryptoKeys {
-			if version, exists := cryptoKey.Versions[versionName]; exists {
-				version.State = state
-				return &kmspb.CryptoKeyVersion{
-					Name:       version.Name,
-					State:      version.State,
-					CreateTime: timestamppb.New(version.CreateTime),
-					Algorithm:  version.Algorithm,
-				}, nil
-			}
-		}
+// UpdateCryptoKeyVersion updates the state of a crypto key version, which
+// can only move between ENABLED and DISABLED. A non-empty etag must be the
+// version's current ETag.
+func (s *Storage) UpdateCryptoKeyVersion(versionName string, state kmspb.CryptoKeyVersion_CryptoKeyVersionState, etag string) (*kmspb.CryptoKeyVersion, error) {
+	if state != kmspb.CryptoKeyVersion_ENABLED && state != kmspb.CryptoKeyVersion_DISABLED {
+		return nil, fmt.Errorf("state %s is not valid for UpdateCryptoKeyVersion, only ENABLED and DISABLED are", state)
 	}
 
-	return nil, fmt.Errorf("crypto key version not found: %s", versionName)
+	defer s.lockKeyRing(versionName)()
+
+	_, version := s.findCryptoKeyVersion(versionName)
+	if version == nil {
+		return nil, fmt.Errorf("crypto key version not found: %s", versionName)
+	}
+	if err := checkETag(versionName, etag, versionProto(version)); err != nil {
+		return nil, err
+	}
+	if version.State != kmspb.CryptoKeyVersion_ENABLED && version.State != kmspb.CryptoKeyVersion_DISABLED {
+		return nil, fmt.Errorf("crypto key version %s is %s, so its state cannot be updated", versionName, version.State)
+	}
+	version.State = state
+	return versionProto(version), nil
 }
 
 // DestroyCryptoKeyVersion schedules a crypto key version for destruction
+// after the destroy scheduled duration, or destroys it at once if that is 0
 func (s *Storage) DestroyCryptoKeyVersion(versionName string) (*kmspb.CryptoKeyVersion, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := s.beforeHooks(HookDestroy, versionName); err != nil {
+		return nil, err
+	}
+	version, err := s.destroyCryptoKeyVersion(versionName)
+	var destroyed string
+	if err == nil {
+		destroyed = versionName
+	}
+	s.afterHooks(HookDestroy, versionName, destroyed, err)
+	return version, err
+}
 
-	for _, keyring := range s.keyrings {
-		for _, cryptoKey := range keyring.CryptoKeys {
-			if version, exists := cryptoKey.Versions[versionName]; exists {
-				if version.State == kmspb.CryptoKeyVersion_DESTROYED || version.State == kmspb.CryptoKeyVersion_DESTROY_SCHEDULED {
-					return nil, fmt.Errorf("crypto key version already destroyed or scheduled: %s", versionName)
-				}
-
-				version.State = kmspb.CryptoKeyVersion_DESTROY_SCHEDULED
-				return &kmspb.CryptoKeyVersion{
-					Name:       version.Name,
-					State:      version.State,
-					CreateTime: timestamppb.New(version.CreateTime),
-					Algorithm:  version.Algorithm,
-				}, nil
+func (s *Storage) destroyCryptoKeyVersion(versionName string) (*kmspb.CryptoKeyVersion, error) {
+	defer s.lockKeyRing(versionName)()
+
+	_, version := s.findCryptoKeyVersion(versionName)
+	if version == nil {
+		return nil, fmt.Errorf("crypto key version not found: %s", versionName)
+	}
+	if version.State == kmspb.CryptoKeyVersion_DESTROYED || version.State == kmspb.CryptoKeyVersion_DESTROY_SCHEDULED {
+		return nil, fmt.Errorf("crypto key version already destroyed or scheduled: %s", versionName)
+	}
+	if version.State != kmspb.CryptoKeyVersion_ENABLED && version.State != kmspb.CryptoKeyVersion_DISABLED {
+		return nil, fmt.Errorf("crypto key version %s is %s, so it cannot be destroyed", versionName, version.State)
+	}
+
+	now := s.now()
+	if s.destroyScheduledDuration == 0 {
+		version.DestroyTime = now
+		version.destroy(now)
+		s.destroyBackendKey(version)
+	} else {
+		version.State = kmspb.CryptoKeyVersion_DESTROY_SCHEDULED
+		version.DestroyTime = now.Add(s.destroyScheduledDuration)
+	}
+	return versionProto(version), nil
+}
+
+// RestoreCryptoKeyVersion cancels the scheduled destruction of a version,
+// leaving it DISABLED
+func (s *Storage) RestoreCryptoKeyVersion(versionName string) (*kmspb.CryptoKeyVersion, error) {
+	defer s.lockKeyRing(versionName)()
+
+	_, version := s.findCryptoKeyVersion(versionName)
+	if version == nil {
+		return nil, fmt.Errorf("crypto key version not found: %s", versionName)
+	}
+	if version.State != kmspb.CryptoKeyVersion_DESTROY_SCHEDULED {
+		return nil, fmt.Errorf("crypto key version is not scheduled for destruction: %s (state %s)", versionName, version.State)
+	}
+
+	version.State = kmspb.CryptoKeyVersion_DISABLED
+	version.DestroyTime = time.Time{}
+	return versionProto(version), nil
+}
+
+// UpdateCryptoKey updates the fields of a crypto key named by paths, using
+// update_mask syntax: labels, rotation_period, next_rotation_time,
+// version_template, version_template.algorithm and
+// version_template.protection_level. Other fields are left unchanged. A
+// non-empty etag must be the key's current ETag.
+func (s *Storage) UpdateCryptoKey(keyName string, update *kmspb.CryptoKey, paths []string, etag string) (*kmspb.CryptoKey, error) {
+	defer s.lockKeyRing(keyName)()
+
+	cryptoKey := s.findCryptoKey(keyName)
+	if cryptoKey == nil {
+		return nil, fmt.Errorf("crypto key not found: %s", keyName)
+	}
+	if err := checkETag(keyName, etag, cryptoKeyProto(cryptoKey)); err != nil {
+		return nil, err
+	}
+
+	// Validate every path before changing anything so a failed update leaves
+	// the key untouched
+	template := cloneVersionTemplate(cryptoKey.VersionTemplate)
+	for _, path := range paths {
+		switch path {
+		case "rotation_period", "next_rotation_time":
+			if cryptoKey.Purpose != kmspb.CryptoKey_ENCRYPT_DECRYPT {
+				return nil, fmt.Errorf("crypto key %s has purpose %s, which does not support automatic rotation", keyName, cryptoKey.Purpose)
 			}
+		case "version_template":
+			template = cloneVersionTemplate(update.GetVersionTemplate())
+		case "version_template.algorithm":
+			template.Algorithm = update.GetVersionTemplate().GetAlgorithm()
+		case "version_template.protection_level":
+			template.ProtectionLevel = update.GetVersionTemplate().GetProtectionLevel()
+		}
+	}
+	if algorithm := template.GetAlgorithm(); algorithm != kmspb.CryptoKeyVersion_CRYPTO_KEY_VERSION_ALGORITHM_UNSPECIFIED {
+		if purpose, ok := AlgorithmPurpose(algorithm); !ok || purpose != cryptoKey.Purpose {
+			return nil, fmt.Errorf("algorithm %s is not valid for purpose %s", algorithm, cryptoKey.Purpose)
 		}
 	}
 
-	return nil, fmt.Errorf("crypto key version not found: %s", versionName)
+	for _, path := range paths {
+		switch path {
+		case "labels":
+			cryptoKey.Labels = update.Labels
+		case "rotation_period":
+			cryptoKey.RotationPeriod = update.GetRotationPeriod().AsDuration()
+		case "next_rotation_time":
+			cryptoKey.NextRotationTime = time.Time{}
+			if update.NextRotationTime != nil {
+				cryptoKey.NextRotationTime = update.NextRotationTime.AsTime()
+			}
+		case "version_template", "version_template.algorithm", "version_template.protection_level":
+			cryptoKey.VersionTemplate = template
+		}
+	}
+
+	return cryptoKeyProto(cryptoKey), nil
 }
 
-// UpdateCryptoKey updates metadata of a crypto key
-func (s *Storage) UpdateCryptoKey(keyName string, labels map[string]string) (*kmspb.CryptoKey, error) {
+// cloneVersionTemplate returns a copy of template, or an empty template if it
+// is nil
+func cloneVersionTemplate(template *kmspb.CryptoKeyVersionTemplate) *kmspb.CryptoKeyVersionTemplate {
+	if template == nil {
+		return &kmspb.CryptoKeyVersionTemplate{}
+	}
+	return proto.Clone(template).(*kmspb.CryptoKeyVersionTemplate)
+}
+
+// HasPrimaryVersion reports whether keys of purpose have a primary version.
+// Only ENCRYPT_DECRYPT keys do: every other purpose names the version to use
+// in each request.
+func HasPrimaryVersion(purpose kmspb.CryptoKey_CryptoKeyPurpose) bool {
+	return purpose == kmspb.CryptoKey_ENCRYPT_DECRYPT
+}
+
+// cryptoKeyProto converts a stored crypto key to its API representation.
+// Primary is left unset when the key has no primary version.
+func cryptoKeyProto(cryptoKey *StoredCryptoKey) *kmspb.CryptoKey {
+	ck := &kmspb.CryptoKey{
+		Name:            cryptoKey.Name,
+		CreateTime:      timestamppb.New(cryptoKey.CreateTime),
+		Purpose:         cryptoKey.Purpose,
+		VersionTemplate: cryptoKey.VersionTemplate,
+		Labels:          cryptoKey.Labels,
+	}
+	if primary := cryptoKey.Versions[cryptoKey.PrimaryVersion]; primary != nil {
+		ck.Primary = versionProto(primary)
+	}
+	if cryptoKey.RotationPeriod > 0 {
+		ck.RotationSchedule = &kmspb.CryptoKey_RotationPeriod{RotationPeriod: durationpb.New(cryptoKey.RotationPeriod)}
+	}
+	if !cryptoKey.NextRotationTime.IsZero() {
+		ck.NextRotationTime = timestamppb.New(cryptoKey.NextRotationTime)
+	}
+	return ck
+}
+
+// lockKeyRing read-locks s.mu and locks the keyring the named resource is
+// in for writing, returning the function that publishes the crypto key the
+// resource is in, if any, and unlocks both. A keyring that does not exist is
+// not locked; lookups in it then find nothing.
+func (s *Storage) lockKeyRing(name string) (unlock func()) {
+	s.mu.RLock()
+	keyring := s.keyrings[keyRingName(name)]
+	if keyring == nil {
+		return s.mu.RUnlock
+	}
+	keyring.mu.Lock()
+	return func() {
+		if keyName := cryptoKeyName(name); keyName != "" {
+			s.publishCryptoKey(keyring, keyName)
+		}
+		keyring.mu.Unlock()
+		s.mu.RUnlock()
+	}
+}
+
+// lockAll locks s.mu for writing, for calls that replace keyrings wholesale,
+// returning the function that publishes every keyring and unlocks
+func (s *Storage) lockAll() (unlock func()) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	return func() {
+		s.resumeGeneration()
+		s.publishAll()
+		s.mu.Unlock()
+	}
+}
 
-	var cryptoKey *StoredCryptoKey
-	for _, keyring := range s.keyrings {
-		if ck, exists := keyring.CryptoKeys[keyName]; exists {
-			cryptoKey = ck
-			break
+// rlockKeyRing is lockKeyRing for calls that only read the keyring
+func (s *Storage) rlockKeyRing(name string) (unlock func()) {
+	s.mu.RLock()
+	keyring := s.keyrings[keyRingName(name)]
+	if keyring == nil {
+		return s.mu.RUnlock
+	}
+	keyring.mu.RLock()
+	return func() {
+		keyring.mu.RUnlock()
+		s.mu.RUnlock()
+	}
+}
+
+// keyRingName returns the keyring a resource name is in: the part before
+// its crypto key or import job, or name itself for a keyring
+func keyRingName(name string) string {
+	for _, collection := range []string{"/cryptoKeys/", "/importJobs/"} {
+		if i := strings.Index(name, collection); i >= 0 {
+			return name[:i]
 		}
 	}
+	return name
+}
 
+// findCryptoKey looks up a crypto key in the keyring its name is under, so a
+// key is only found by its own path. The caller must hold the keyring's
+// lock, or s.mu for writing.
+func (s *Storage) findCryptoKey(name string) *StoredCryptoKey {
+	keyring := s.keyrings[parentName(name, "/cryptoKeys/")]
+	if keyring == nil {
+		return nil
+	}
+	return keyring.CryptoKeys[name]
+}
+
+// findCryptoKeyVersion looks up a crypto key version in the crypto key its
+// name is under, returning both. The caller must hold the keyring's lock, or
+// s.mu for writing.
+func (s *Storage) findCryptoKeyVersion(name string) (*StoredCryptoKey, *StoredCryptoKeyVersion) {
+	cryptoKey := s.findCryptoKey(parentName(name, "/cryptoKeyVersions/"))
 	if cryptoKey == nil {
-		return nil, fmt.Errorf("crypto key not found: %s", keyName)
+		return nil, nil
 	}
+	version := cryptoKey.Versions[name]
+	if version == nil {
+		return nil, nil
+	}
+	return cryptoKey, version
+}
 
-	if labels != nil {
-		cryptoKey.Labels = labels
+// parentName returns the part of name before its last collection segment,
+// e.g. the keyring of a crypto key for "/cryptoKeys/", or "" if name has none
+func parentName(name, collection string) string {
+	i := strings.LastIndex(name, collection)
+	if i < 0 {
+		return ""
 	}
+	return name[:i]
+}
 
-	primary := cryptoKey.Versions[cryptoKey.PrimaryVersion]
-	return &kmspb.CryptoKey{
-		Name:       cryptoKey.Name,
-		CreateTime: timestamppb.New(cryptoKey.CreateTime),
-		Purpose:    cryptoKey.Purpose,
-		Primary: &kmspb.CryptoKeyVersion{
-			Name:       primary.Name,
-			State:      primary.State,
-			CreateTime: timestamppb.New(primary.CreateTime),
-			Algorithm:  primary.Algorithm,
-		},
-		VersionTemplate: cryptoKey.VersionTemplate,
-		Labels:          cryptoKey.Labels,
-	}, nil
+// versionProto converts a stored crypto key version to its API
+// representation
+func versionProto(version *StoredCryptoKeyVersion) *kmspb.CryptoKeyVersion {
+	pb := &kmspb.CryptoKeyVersion{
+		Name:                    version.Name,
+		State:                   version.State,
+		ProtectionLevel:         versionProtectionLevel(version),
+		CreateTime:              timestamppb.New(version.CreateTime),
+		Algorithm:               version.Algorithm,
+		ImportJob:               version.ImportJob,
+		ImportFailureReason:     version.ImportFailureReason,
+		GenerationFailureReason: version.GenerationFailureReason,
+		ReimportEligible:        version.ImportJob != "",
+	}
+	// Material the emulator generated itself was generated on creation
+	// unless it was generated in the background; imported versions report
+	// import_time instead
+	switch {
+	case !version.GenerateTime.IsZero():
+		pb.GenerateTime = timestamppb.New(version.GenerateTime)
+	case version.State == kmspb.CryptoKeyVersion_PENDING_GENERATION || version.State == kmspb.CryptoKeyVersion_GENERATION_FAILED:
+	case version.ImportJob == "" && version.ImportTime.IsZero():
+		pb.GenerateTime = pb.CreateTime
+	}
+	if !version.ImportTime.IsZero() {
+		pb.ImportTime = timestamppb.New(version.ImportTime)
+	}
+	if !version.DestroyTime.IsZero() {
+		pb.DestroyTime = timestamppb.New(version.DestroyTime)
+	}
+	if !version.DestroyEventTime.IsZero() {
+		pb.DestroyEventTime = timestamppb.New(version.DestroyEventTime)
+	}
+	return pb
+}
+
+// versionProtectionLevel is the protection level of a version: HSM for
+// software-level versions whose key material is in a key backend, and
+// SOFTWARE for versions created before protection levels were recorded
+func versionProtectionLevel(version *StoredCryptoKeyVersion) kmspb.ProtectionLevel {
+	switch {
+	case version.Backend != "" && (version.ProtectionLevel == kmspb.ProtectionLevel_PROTECTION_LEVEL_UNSPECIFIED || version.ProtectionLevel == kmspb.ProtectionLevel_SOFTWARE):
+		return kmspb.ProtectionLevel_HSM
+	case version.ProtectionLevel == kmspb.ProtectionLevel_PROTECTION_LEVEL_UNSPECIFIED:
+		return kmspb.ProtectionLevel_SOFTWARE
+	}
+	return version.ProtectionLevel
+}
+
+// templateProtectionLevel is the protection level of versions created from
+// a version template, SOFTWARE unless the template sets one
+func templateProtectionLevel(template *kmspb.CryptoKeyVersionTemplate) kmspb.ProtectionLevel {
+	if level := template.GetProtectionLevel(); level != kmspb.ProtectionLevel_PROTECTION_LEVEL_UNSPECIFIED {
+		return level
+	}
+	return kmspb.ProtectionLevel_SOFTWARE
+}
+
+// ResourceStats summarizes the resources held in storage
+type ResourceStats struct {
+	KeyRings          int            `json:"keyRings"`
+	CryptoKeys        int            `json:"cryptoKeys"`
+	CryptoKeyVersions int            `json:"cryptoKeyVersions"`
+	VersionsByState   map[string]int `json:"versionsByState"`
+}
+
+// Stats returns resource counts across all keyrings
+func (s *Storage) Stats() ResourceStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := ResourceStats{
+		KeyRings:        len(s.keyrings),
+		VersionsByState: make(map[string]int),
+	}
+	for _, keyring := range s.keyrings {
+		keyring.mu.RLock()
+		stats.CryptoKeys += len(keyring.CryptoKeys)
+		for _, cryptoKey := range keyring.CryptoKeys {
+			stats.CryptoKeyVersions += len(cryptoKey.Versions)
+			for _, version := range cryptoKey.Versions {
+				stats.VersionsByState[version.State.String()]++
+			}
+		}
+		keyring.mu.RUnlock()
+	}
+
+	return stats
 }
 
 // Clear removes all stored data (for testing)
 func (s *Storage) Clear() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	defer s.lockAll()()
 	s.keyrings = make(map[string]*StoredKeyRing)
+	s.forgetUsage("")
+}
+
+// ClearProject deletes the keyrings, keys and versions of one project and
+// returns how many keyrings were deleted
+func (s *Storage) ClearProject(project string) int {
+	prefix := "projects/" + project + "/"
+
+	defer s.lockAll()()
+	deleted := 0
+	for name := range s.keyrings {
+		if strings.HasPrefix(name, prefix) {
+			delete(s.keyrings, name)
+			deleted++
+		}
+	}
+	s.forgetUsage(prefix)
+	return deleted
+}
+
+// ClearKeyRing deletes one keyring with its keys, versions and import jobs,
+// and reports whether it existed
+func (s *Storage) ClearKeyRing(name string) bool {
+	defer s.lockAll()()
+	if _, ok := s.keyrings[name]; !ok {
+		return false
+	}
+	delete(s.keyrings, name)
+	s.forgetUsage(name + "/")
+	return true
 }
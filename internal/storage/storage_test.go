@@ -1,9 +1,17 @@
 package storage
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestCreateKeyRing(t *testing.T) {
@@ -231,7 +239,7 @@ func TestEncryptDecrypt(t *testing.T) {
 	}
 
 	plaintext := []byte("Hello, KMS!")
-	ciphertext, err := s.Encrypt("projects/test/locations/global/keyRings/ring1/cryptoKeys/key1", plaintext)
+	ciphertext, _, _, err := s.Encrypt("projects/test/locations/global/keyRings/ring1/cryptoKeys/key1", plaintext, nil)
 	if err != nil {
 		t.Fatalf("Encrypt failed: %v", err)
 	}
@@ -240,7 +248,7 @@ func TestEncryptDecrypt(t *testing.T) {
 		t.Error("Ciphertext should not be empty")
 	}
 
-	decrypted, err := s.Decrypt("projects/test/locations/global/keyRings/ring1/cryptoKeys/key1", ciphertext)
+	decrypted, _, _, err := s.Decrypt("projects/test/locations/global/keyRings/ring1/cryptoKeys/key1", ciphertext, nil)
 	if err != nil {
 		t.Fatalf("Decrypt failed: %v", err)
 	}
@@ -283,6 +291,102 @@ func TestCreateCryptoKeyVersion(t *testing.T) {
 	}
 }
 
+func TestCryptoKeyVersionMetadata(t *testing.T) {
+	s := NewStorage()
+	if _, err := s.CreateKeyRing("projects/test/locations/global/keyRings/ring1"); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	template := &kmspb.CryptoKeyVersionTemplate{ProtectionLevel: kmspb.ProtectionLevel_HSM}
+	if _, err := s.CreateCryptoKey("projects/test/locations/global/keyRings/ring1", "key1", kmspb.CryptoKey_ENCRYPT_DECRYPT, template, nil); err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+	versionName := "projects/test/locations/global/keyRings/ring1/cryptoKeys/key1/cryptoKeyVersions/1"
+
+	version, err := s.GetCryptoKeyVersion(versionName)
+	if err != nil {
+		t.Fatalf("GetCryptoKeyVersion failed: %v", err)
+	}
+	if version.ProtectionLevel != kmspb.ProtectionLevel_HSM || !version.GenerateTime.AsTime().Equal(version.CreateTime.AsTime()) {
+		t.Errorf("Expected an HSM version generated on creation, got %v", version)
+	}
+	if version.DestroyTime != nil || version.DestroyEventTime != nil {
+		t.Errorf("Expected no destroy times on an enabled version, got %v", version)
+	}
+
+	scheduled, err := s.DestroyCryptoKeyVersion(versionName)
+	if err != nil {
+		t.Fatalf("DestroyCryptoKeyVersion failed: %v", err)
+	}
+	if scheduled.DestroyTime == nil || scheduled.DestroyEventTime != nil {
+		t.Errorf("Expected destroy_time only on a DESTROY_SCHEDULED version, got %v", scheduled)
+	}
+	if s.DestroyDue(scheduled.DestroyTime.AsTime()) != 1 {
+		t.Fatal("Expected the version to be destroyed")
+	}
+
+	// The metadata survives saving and loading state
+	var buf bytes.Buffer
+	if err := s.SaveState(&buf); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	restored := NewStorage()
+	if _, err := restored.LoadState(&buf); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	destroyed, err := restored.GetCryptoKeyVersion(versionName)
+	if err != nil {
+		t.Fatalf("GetCryptoKeyVersion failed: %v", err)
+	}
+	if destroyed.State != kmspb.CryptoKeyVersion_DESTROYED || destroyed.DestroyTime == nil || destroyed.DestroyEventTime == nil ||
+		destroyed.ProtectionLevel != kmspb.ProtectionLevel_HSM || destroyed.GenerateTime == nil {
+		t.Errorf("Expected a destroyed HSM version with destroy and generate times, got %v", destroyed)
+	}
+}
+
+func TestRestoreCryptoKeyVersion(t *testing.T) {
+	s := NewStorage()
+
+	_, err := s.CreateKeyRing("projects/test/locations/global/keyRings/ring1")
+	if err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+
+	_, err = s.CreateCryptoKey(
+		"projects/test/locations/global/keyRings/ring1",
+		"key1",
+		kmspb.CryptoKey_ENCRYPT_DECRYPT,
+		nil,
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+
+	versionName := "projects/test/locations/global/keyRings/ring1/cryptoKeys/key1/cryptoKeyVersions/1"
+
+	// Only versions scheduled for destruction can be restored
+	if _, err := s.RestoreCryptoKeyVersion(versionName); err == nil {
+		t.Error("Expected error restoring an enabled version, got nil")
+	}
+
+	if _, err := s.DestroyCryptoKeyVersion(versionName); err != nil {
+		t.Fatalf("DestroyCryptoKeyVersion failed: %v", err)
+	}
+
+	version, err := s.RestoreCryptoKeyVersion(versionName)
+	if err != nil {
+		t.Fatalf("RestoreCryptoKeyVersion failed: %v", err)
+	}
+
+	if version.State != kmspb.CryptoKeyVersion_DISABLED {
+		t.Errorf("Expected state DISABLED, got %v", version.State)
+	}
+
+	if _, err := s.RestoreCryptoKeyVersion(versionName + "0"); err == nil {
+		t.Error("Expected error for missing version, got nil")
+	}
+}
+
 func TestUpdateCryptoKeyPrimaryVersion(t *testing.T) {
 	s := NewStorage()
 
@@ -320,6 +424,138 @@ func TestUpdateCryptoKeyPrimaryVersion(t *testing.T) {
 	}
 }
 
+func TestPrimaryVersionPurposes(t *testing.T) {
+	s := NewStorage()
+	ring := "projects/test/locations/global/keyRings/ring1"
+	if _, err := s.CreateKeyRing(ring); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+
+	tests := []struct {
+		id         string
+		purpose    kmspb.CryptoKey_CryptoKeyPurpose
+		algorithm  kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm
+		hasPrimary bool
+	}{
+		{"sym", kmspb.CryptoKey_ENCRYPT_DECRYPT, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, true},
+		{"sign", kmspb.CryptoKey_ASYMMETRIC_SIGN, kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256, false},
+		{"mac", kmspb.CryptoKey_MAC, kmspb.CryptoKeyVersion_HMAC_SHA256, false},
+	}
+	for _, tt := range tests {
+		key, err := s.CreateCryptoKey(ring, tt.id, tt.purpose, &kmspb.CryptoKeyVersionTemplate{Algorithm: tt.algorithm}, nil)
+		if err != nil {
+			t.Fatalf("CreateCryptoKey(%s) failed: %v", tt.id, err)
+		}
+		if (key.Primary != nil) != tt.hasPrimary {
+			t.Errorf("%s: expected primary %v, got %v", tt.id, tt.hasPrimary, key.Primary)
+		}
+		_, err = s.UpdateCryptoKeyPrimaryVersion(key.Name, key.Name+"/cryptoKeyVersions/1")
+		if (err == nil) != tt.hasPrimary {
+			t.Errorf("%s: UpdateCryptoKeyPrimaryVersion returned %v", tt.id, err)
+		}
+	}
+
+	// Keys without versions, such as import-only keys, have no primary
+	empty := ring + "/cryptoKeys/empty"
+	s.keyrings[ring].CryptoKeys[empty] = &StoredCryptoKey{
+		Name:     empty,
+		Purpose:  kmspb.CryptoKey_ENCRYPT_DECRYPT,
+		Versions: make(map[string]*StoredCryptoKeyVersion),
+	}
+	s.publishCryptoKey(s.keyrings[ring], empty)
+	if key, err := s.GetCryptoKey(empty); err != nil || key.Primary != nil {
+		t.Errorf("GetCryptoKey = %v, %v", key, err)
+	}
+	if keys, err := s.ListCryptoKeys(ring); err != nil || len(keys) != 4 {
+		t.Errorf("ListCryptoKeys = %d keys, %v", len(keys), err)
+	}
+	if _, _, _, err := s.Encrypt(empty, []byte("secret"), nil); err == nil {
+		t.Error("Expected Encrypt without a primary version to fail")
+	}
+}
+
+func TestUpdateCryptoKey(t *testing.T) {
+	s := NewStorage()
+	keyName := "projects/test/locations/global/keyRings/ring1/cryptoKeys/key1"
+
+	_, err := s.CreateKeyRing("projects/test/locations/global/keyRings/ring1")
+	if err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	_, err = s.CreateCryptoKey(
+		"projects/test/locations/global/keyRings/ring1",
+		"key1",
+		kmspb.CryptoKey_ENCRYPT_DECRYPT,
+		nil,
+		map[string]string{"env": "test"},
+	)
+	if err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+
+	next := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	update := &kmspb.CryptoKey{
+		Labels:           map[string]string{"env": "prod"},
+		RotationSchedule: &kmspb.CryptoKey_RotationPeriod{RotationPeriod: durationpb.New(30 * 24 * time.Hour)},
+		NextRotationTime: timestamppb.New(next),
+	}
+
+	// Only the masked fields change
+	cryptoKey, err := s.UpdateCryptoKey(keyName, update, []string{"rotation_period", "next_rotation_time"}, "")
+	if err != nil {
+		t.Fatalf("UpdateCryptoKey failed: %v", err)
+	}
+	if cryptoKey.Labels["env"] != "test" {
+		t.Errorf("Expected labels unchanged, got %v", cryptoKey.Labels)
+	}
+	if got := cryptoKey.GetRotationPeriod().AsDuration(); got != 30*24*time.Hour {
+		t.Errorf("Expected rotation period 720h, got %s", got)
+	}
+	if !cryptoKey.NextRotationTime.AsTime().Equal(next) {
+		t.Errorf("Expected next rotation %s, got %s", next, cryptoKey.NextRotationTime.AsTime())
+	}
+
+	cryptoKey, err = s.UpdateCryptoKey(keyName, update, []string{"labels"}, "")
+	if err != nil {
+		t.Fatalf("UpdateCryptoKey failed: %v", err)
+	}
+	if cryptoKey.Labels["env"] != "prod" {
+		t.Errorf("Expected env=prod, got %v", cryptoKey.Labels)
+	}
+
+	// An algorithm from another purpose is rejected without changing the key
+	invalid := &kmspb.CryptoKey{VersionTemplate: &kmspb.CryptoKeyVersionTemplate{Algorithm: kmspb.CryptoKeyVersion_HMAC_SHA256}}
+	if _, err := s.UpdateCryptoKey(keyName, invalid, []string{"labels", "version_template.algorithm"}, ""); err == nil {
+		t.Error("Expected error for an HMAC algorithm on an ENCRYPT_DECRYPT key, got nil")
+	}
+
+	// Rotation settings survive a save and load
+	var buf bytes.Buffer
+	if err := s.SaveState(&buf); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	restored := NewStorage()
+	if _, err := restored.LoadState(&buf); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	cryptoKey, err = restored.GetCryptoKey(keyName)
+	if err != nil {
+		t.Fatalf("GetCryptoKey failed: %v", err)
+	}
+	if cryptoKey.GetRotationPeriod().AsDuration() != 30*24*time.Hour || !cryptoKey.NextRotationTime.AsTime().Equal(next) {
+		t.Errorf("Rotation schedule not restored: %v", cryptoKey)
+	}
+}
+
+func TestUpdateCryptoKeyNotFound(t *testing.T) {
+	s := NewStorage()
+
+	_, err := s.UpdateCryptoKey("projects/test/locations/global/keyRings/ring1/cryptoKeys/missing", &kmspb.CryptoKey{}, []string{"labels"}, "")
+	if err == nil {
+		t.Error("Expected error for missing crypto key, got nil")
+	}
+}
+
 func TestDecryptWithMultipleVersions(t *testing.T) {
 	s := NewStorage()
 
@@ -340,7 +576,7 @@ func TestDecryptWithMultipleVersions(t *testing.T) {
 	}
 
 	plaintext := []byte("Test versioning")
-	ciphertext1, err := s.Encrypt("projects/test/locations/global/keyRings/ring1/cryptoKeys/key1", plaintext)
+	ciphertext1, _, _, err := s.Encrypt("projects/test/locations/global/keyRings/ring1/cryptoKeys/key1", plaintext, nil)
 	if err != nil {
 		t.Fatalf("Encrypt with v1 failed: %v", err)
 	}
@@ -358,12 +594,12 @@ func TestDecryptWithMultipleVersions(t *testing.T) {
 		t.Fatalf("UpdateCryptoKeyPrimaryVersion failed: %v", err)
 	}
 
-	ciphertext2, err := s.Encrypt("projects/test/locations/global/keyRings/ring1/cryptoKeys/key1", plaintext)
+	ciphertext2, _, _, err := s.Encrypt("projects/test/locations/global/keyRings/ring1/cryptoKeys/key1", plaintext, nil)
 	if err != nil {
 		t.Fatalf("Encrypt with v2 failed: %v", err)
 	}
 
-	decrypted1, err := s.Decrypt("projects/test/locations/global/keyRings/ring1/cryptoKeys/key1", ciphertext1)
+	decrypted1, _, _, err := s.Decrypt("projects/test/locations/global/keyRings/ring1/cryptoKeys/key1", ciphertext1, nil)
 	if err != nil {
 		t.Fatalf("Decrypt v1 ciphertext failed: %v", err)
 	}
@@ -372,7 +608,7 @@ func TestDecryptWithMultipleVersions(t *testing.T) {
 		t.Errorf("Expected plaintext '%s', got '%s'", string(plaintext), string(decrypted1))
 	}
 
-	decrypted2, err := s.Decrypt("projects/test/locations/global/keyRings/ring1/cryptoKeys/key1", ciphertext2)
+	decrypted2, _, _, err := s.Decrypt("projects/test/locations/global/keyRings/ring1/cryptoKeys/key1", ciphertext2, nil)
 	if err != nil {
 		t.Fatalf("Decrypt v2 ciphertext failed: %v", err)
 	}
@@ -382,6 +618,68 @@ func TestDecryptWithMultipleVersions(t *testing.T) {
 	}
 }
 
+func TestEncryptWithVersion(t *testing.T) {
+	s, _, _ := newDestroyTestStorage(t)
+	version2, err := s.CreateCryptoKeyVersion(destroyTestKey)
+	if err != nil {
+		t.Fatalf("CreateCryptoKeyVersion failed: %v", err)
+	}
+
+	// A named version is used even though it is not the primary
+	ciphertext, used, _, err := s.Encrypt(version2.Name, []byte("secret"), nil)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if used != version2.Name {
+		t.Errorf("Expected %s to be used, got %s", version2.Name, used)
+	}
+	plaintext, usedPrimary, _, err := s.Decrypt(destroyTestKey, ciphertext, nil)
+	if err != nil || string(plaintext) != "secret" || usedPrimary {
+		t.Errorf("Expected the ciphertext to decrypt with a non-primary version, got %q, %v, %v", plaintext, usedPrimary, err)
+	}
+
+	if _, err := s.UpdateCryptoKeyVersion(version2.Name, kmspb.CryptoKeyVersion_DISABLED, ""); err != nil {
+		t.Fatalf("UpdateCryptoKeyVersion failed: %v", err)
+	}
+	if _, _, _, err := s.Encrypt(version2.Name, []byte("secret"), nil); err == nil || !strings.Contains(err.Error(), "not enabled") {
+		t.Errorf("Expected a disabled version to be rejected, got %v", err)
+	}
+	if _, _, _, err := s.Encrypt(destroyTestKey+"/cryptoKeyVersions/9", []byte("secret"), nil); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected a missing version to be rejected, got %v", err)
+	}
+}
+
+func TestDecryptDisabledVersion(t *testing.T) {
+	s, version, ciphertext := newDestroyTestStorage(t)
+	if _, err := s.CreateCryptoKeyVersion(destroyTestKey); err != nil {
+		t.Fatalf("CreateCryptoKeyVersion failed: %v", err)
+	}
+	if _, err := s.UpdateCryptoKeyVersion(version.Name, kmspb.CryptoKeyVersion_DISABLED, ""); err != nil {
+		t.Fatalf("UpdateCryptoKeyVersion failed: %v", err)
+	}
+
+	// The error names the version that produced the ciphertext, even though
+	// another version is enabled
+	_, _, _, err := s.Decrypt(destroyTestKey, ciphertext, nil)
+	want := version.Name + " is not enabled, current state is: DISABLED"
+	if err == nil || err.Error() != want {
+		t.Errorf("Expected %q, got %v", want, err)
+	}
+
+	if _, err := s.UpdateCryptoKeyVersion(version.Name, kmspb.CryptoKeyVersion_ENABLED, ""); err != nil {
+		t.Fatalf("UpdateCryptoKeyVersion failed: %v", err)
+	}
+	if plaintext, _, _, err := s.Decrypt(destroyTestKey, ciphertext, nil); err != nil || string(plaintext) != "secret" {
+		t.Errorf("Decrypt after re-enabling = %q, %v", plaintext, err)
+	}
+
+	// Ciphertexts from earlier releases carry no header
+	_, legacy, _ := openCiphertext(destroyTestKey, ciphertext)
+	if plaintext, _, _, err := s.Decrypt(destroyTestKey, legacy, nil); err != nil || string(plaintext) != "secret" {
+		t.Errorf("Decrypt of a headerless ciphertext = %q, %v", plaintext, err)
+	}
+}
+
 func TestConcurrentAccess(t *testing.T) {
 	s := NewStorage()
 
@@ -405,11 +703,11 @@ func TestConcurrentAccess(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		go func() {
 			plaintext := []byte("Concurrent test")
-			ciphertext, err := s.Encrypt("projects/test/locations/global/keyRings/ring1/cryptoKeys/key1", plaintext)
+			ciphertext, _, _, err := s.Encrypt("projects/test/locations/global/keyRings/ring1/cryptoKeys/key1", plaintext, nil)
 			if err != nil {
 				t.Errorf("Concurrent Encrypt failed: %v", err)
 			}
-			_, err = s.Decrypt("projects/test/locations/global/keyRings/ring1/cryptoKeys/key1", ciphertext)
+			_, _, _, err = s.Decrypt("projects/test/locations/global/keyRings/ring1/cryptoKeys/key1", ciphertext, nil)
 			if err != nil {
 				t.Errorf("Concurrent Decrypt failed: %v", err)
 			}
@@ -421,3 +719,179 @@ func TestConcurrentAccess(t *testing.T) {
 		<-done
 	}
 }
+
+func TestKeyRingLocksAreIndependent(t *testing.T) {
+	const ringA, ringB = "projects/test/locations/global/keyRings/a", "projects/test/locations/global/keyRings/b"
+	s := NewStorage()
+	for _, ring := range []string{ringA, ringB} {
+		if _, err := s.CreateKeyRing(ring); err != nil {
+			t.Fatalf("CreateKeyRing failed: %v", err)
+		}
+		if _, err := s.CreateCryptoKey(ring, "key1", kmspb.CryptoKey_ENCRYPT_DECRYPT, nil, nil); err != nil {
+			t.Fatalf("CreateCryptoKey failed: %v", err)
+		}
+	}
+
+	// Hold keyring a as a slow write would
+	unlock := s.lockKeyRing(ringA + "/cryptoKeys/key1")
+
+	list := func(ring string) chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := s.ListCryptoKeys(ring)
+			done <- err
+		}()
+		return done
+	}
+	select {
+	case err := <-list(ringB):
+		if err != nil {
+			t.Fatalf("ListCryptoKeys failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListCryptoKeys on keyring b waited for keyring a")
+	}
+
+	blocked := list(ringA)
+	select {
+	case <-blocked:
+		t.Fatal("ListCryptoKeys on keyring a did not wait for its lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	if err := <-blocked; err != nil {
+		t.Fatalf("ListCryptoKeys failed: %v", err)
+	}
+}
+
+func TestConcurrentKeyRings(t *testing.T) {
+	s := NewStorage()
+	s.SetDestroyScheduledDuration(time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := range 4 {
+		ring := fmt.Sprintf("projects/test/locations/global/keyRings/ring%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.CreateKeyRing(ring); err != nil {
+				t.Errorf("CreateKeyRing failed: %v", err)
+				return
+			}
+			key, err := s.CreateCryptoKey(ring, "key1", kmspb.CryptoKey_ENCRYPT_DECRYPT, nil, nil)
+			if err != nil {
+				t.Errorf("CreateCryptoKey failed: %v", err)
+				return
+			}
+			for range 20 {
+				version, err := s.CreateCryptoKeyVersion(key.Name)
+				if err != nil {
+					t.Errorf("CreateCryptoKeyVersion failed: %v", err)
+					return
+				}
+				if _, _, _, err := s.Encrypt(version.Name, []byte("data"), nil); err != nil {
+					t.Errorf("Encrypt failed: %v", err)
+				}
+				if _, err := s.DestroyCryptoKeyVersion(version.Name); err != nil {
+					t.Errorf("DestroyCryptoKeyVersion failed: %v", err)
+				}
+			}
+		}()
+	}
+	// Calls spanning every keyring run alongside
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 20 {
+			s.Stats()
+			s.DestroyDue(time.Now())
+			if err := s.SaveState(io.Discard); err != nil {
+				t.Errorf("SaveState failed: %v", err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	if stats := s.Stats(); stats.KeyRings != 4 || stats.CryptoKeyVersions != 4*21 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func FuzzDecrypt(f *testing.F) {
+	const key = "projects/test/locations/global/keyRings/ring1/cryptoKeys/key1"
+	s := NewStorage()
+	if _, err := s.CreateKeyRing("projects/test/locations/global/keyRings/ring1"); err != nil {
+		f.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	if _, err := s.CreateCryptoKey("projects/test/locations/global/keyRings/ring1", "key1", kmspb.CryptoKey_ENCRYPT_DECRYPT, nil, nil); err != nil {
+		f.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+	// A second version, so ciphertexts are tried against several
+	if _, err := s.CreateCryptoKeyVersion(key); err != nil {
+		f.Fatalf("CreateCryptoKeyVersion failed: %v", err)
+	}
+	plaintext := []byte("fuzz me")
+	valid, _, _, err := s.Encrypt(key, plaintext, nil)
+	if err != nil {
+		f.Fatalf("Encrypt failed: %v", err)
+	}
+
+	// Ciphertexts from earlier releases carry no header
+	_, legacy, _ := openCiphertext(key, valid)
+	header := len(valid) - len(legacy)
+
+	f.Add(valid)
+	f.Add(legacy)
+	f.Add([]byte{})
+	f.Add(valid[:header-1])
+	f.Add(valid[:header+11])
+	f.Add(valid[:header+12])
+	f.Add(valid[:len(valid)-1])
+	f.Add(append(bytes.Clone(valid), 0))
+	flipped := bytes.Clone(valid)
+	flipped[len(flipped)/2] ^= 1
+	f.Add(flipped)
+	f.Fuzz(func(t *testing.T, ciphertext []byte) {
+		got, _, _, err := s.Decrypt(key, ciphertext, nil)
+		if err != nil {
+			return
+		}
+		// GCM authenticates the sealed data, so only the one Encrypt
+		// produced decrypts, with or without a header
+		sealed := ciphertext
+		if _, rest, ok := openCiphertext(key, ciphertext); ok {
+			sealed = rest
+		}
+		if !bytes.Equal(sealed, legacy) || !bytes.Equal(got, plaintext) {
+			t.Fatalf("Decrypt accepted %x as %q", ciphertext, got)
+		}
+	})
+}
+
+func FuzzEncryptDecrypt(f *testing.F) {
+	const key = "projects/test/locations/global/keyRings/ring1/cryptoKeys/key1"
+	s := NewStorage()
+	if _, err := s.CreateKeyRing("projects/test/locations/global/keyRings/ring1"); err != nil {
+		f.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	if _, err := s.CreateCryptoKey("projects/test/locations/global/keyRings/ring1", "key1", kmspb.CryptoKey_ENCRYPT_DECRYPT, nil, nil); err != nil {
+		f.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+
+	f.Add([]byte{})
+	f.Add([]byte("Hello, KMS!"))
+	f.Add(bytes.Repeat([]byte{0xff}, 4096))
+	f.Fuzz(func(t *testing.T, plaintext []byte) {
+		ciphertext, _, _, err := s.Encrypt(key, plaintext, nil)
+		if err != nil {
+			t.Fatalf("Encrypt failed: %v", err)
+		}
+		got, _, _, err := s.Decrypt(key, ciphertext, nil)
+		if err != nil {
+			t.Fatalf("Decrypt failed: %v", err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("Expected %x, got %x", plaintext, got)
+		}
+	})
+}
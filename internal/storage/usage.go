@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Usage tracking counts the cryptographic operations that succeed on each
+// crypto key and version and records when each was last used, like Cloud
+// KMS key usage insights, so key hygiene tooling can find unused keys.
+// Counters live beside the resources rather than in them, so recording a
+// use takes no locks and publishes nothing; timestamps follow the storage
+// clock (see clock.go).
+
+// usageOperations names the counted operations, indexed by the op*
+// constants
+var usageOperations = [...]string{"encrypt", "decrypt", "asymmetricSign", "asymmetricDecrypt", "macSign", "macVerify"}
+
+const (
+	opEncrypt = iota
+	opDecrypt
+	opAsymmetricSign
+	opAsymmetricDecrypt
+	opMacSign
+	opMacVerify
+)
+
+// usageCounter counts the operations on one crypto key or version
+type usageCounter struct {
+	ops     [len(usageOperations)]atomic.Int64
+	bytes   atomic.Int64
+	lastUse atomic.Int64 // Unix nanoseconds, 0 until first used
+}
+
+// KeyUsage is how often a crypto key or version has been used and when it
+// was last used
+type KeyUsage struct {
+	Name string `json:"name"`
+	// Purpose is set for crypto keys, and Algorithm, ProtectionLevel and
+	// State for versions, in UsageReport
+	Purpose         string `json:"purpose,omitempty"`
+	Algorithm       string `json:"algorithm,omitempty"`
+	ProtectionLevel string `json:"protectionLevel,omitempty"`
+	State           string `json:"state,omitempty"`
+	// UseCount is the total of Operations
+	UseCount   int64            `json:"useCount"`
+	Operations map[string]int64 `json:"operations,omitempty"`
+	// Bytes is the data processed: the plaintext encrypted and decrypted,
+	// and the data signed and MACed
+	Bytes int64 `json:"bytes,omitempty"`
+	// LastUseTime is nil for keys and versions never used
+	LastUseTime *time.Time `json:"lastUseTime,omitempty"`
+	// Versions is the usage of each version of a crypto key, by version ID
+	Versions []KeyUsage `json:"versions,omitempty"`
+}
+
+// recordUse counts a successful operation on n bytes with a version and its
+// crypto key
+func (s *Storage) recordUse(op int, versionName string, n int) {
+	now := s.now().UnixNano()
+	for _, name := range [...]string{parentName(versionName, "/cryptoKeyVersions/"), versionName} {
+		counter, ok := s.usage.Load(name)
+		if !ok {
+			counter, _ = s.usage.LoadOrStore(name, new(usageCounter))
+		}
+		c := counter.(*usageCounter)
+		c.ops[op].Add(1)
+		c.bytes.Add(int64(n))
+		// Skip the write when it would barely move the time, so parallel
+		// callers of one key contend on a single counter rather than two
+		if now-c.lastUse.Load() > int64(time.Millisecond) {
+			c.lastUse.Store(now)
+		}
+	}
+}
+
+// Usage returns the usage of a crypto key or version. Resources never used,
+// or that do not exist, have a zero count.
+func (s *Storage) Usage(name string) KeyUsage {
+	usage := KeyUsage{Name: name}
+	counter, ok := s.usage.Load(name)
+	if !ok {
+		return usage
+	}
+	c := counter.(*usageCounter)
+	for op := range c.ops {
+		if n := c.ops[op].Load(); n > 0 {
+			if usage.Operations == nil {
+				usage.Operations = make(map[string]int64)
+			}
+			usage.Operations[usageOperations[op]] = n
+			usage.UseCount += n
+		}
+	}
+	usage.Bytes = c.bytes.Load()
+	if last := c.lastUse.Load(); last != 0 {
+		t := time.Unix(0, last).UTC()
+		usage.LastUseTime = &t
+	}
+	return usage
+}
+
+// UsageReport returns the usage of every crypto key and its versions,
+// ordered by name, including those never used
+func (s *Storage) UsageReport() []KeyUsage {
+	view := s.view.Load()
+	var keys []*StoredCryptoKey
+	for _, ring := range view.keyRings {
+		for _, cryptoKey := range ring.cryptoKeys {
+			keys = append(keys, cryptoKey)
+		}
+	}
+	slices.SortFunc(keys, func(a, b *StoredCryptoKey) int { return strings.Compare(a.Name, b.Name) })
+
+	report := make([]KeyUsage, 0, len(keys))
+	for _, cryptoKey := range keys {
+		usage := s.Usage(cryptoKey.Name)
+		usage.Purpose = cryptoKey.Purpose.String()
+		for _, version := range sortedVersions(cryptoKey) {
+			versionUsage := s.Usage(version.Name)
+			versionUsage.Algorithm = version.Algorithm.String()
+			versionUsage.ProtectionLevel = versionProtectionLevel(version).String()
+			versionUsage.State = version.State.String()
+			usage.Versions = append(usage.Versions, versionUsage)
+		}
+		report = append(report, usage)
+	}
+	return report
+}
+
+// forgetUsage drops the counters of resources whose names start with
+// prefix, or of all resources for an empty prefix, so resources created
+// again under the same names start unused
+func (s *Storage) forgetUsage(prefix string) {
+	s.usage.Range(func(name, _ any) bool {
+		if strings.HasPrefix(name.(string), prefix) {
+			s.usage.Delete(name)
+		}
+		return true
+	})
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+func TestUsage(t *testing.T) {
+	s := newViewTestStorage(t)
+	frozen := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.SetFrozenTime(frozen)
+	if _, err := s.CreateCryptoKey(viewTestRing, "unused", kmspb.CryptoKey_ENCRYPT_DECRYPT, nil, nil); err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+
+	ciphertext, version, _, err := s.Encrypt(viewTestKey, []byte("data"), nil)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if _, _, _, err := s.Decrypt(viewTestKey, ciphertext, nil); err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	// Failed operations are not uses
+	if _, _, _, err := s.Decrypt(viewTestKey, ciphertext, []byte("wrong")); err == nil {
+		t.Fatal("Expected Decrypt with the wrong AAD to fail")
+	}
+
+	for _, name := range []string{viewTestKey, version} {
+		usage := s.Usage(name)
+		if usage.UseCount != 2 || usage.Operations["encrypt"] != 1 || usage.Operations["decrypt"] != 1 {
+			t.Errorf("Usage(%s) = %+v", name, usage)
+		}
+		if usage.LastUseTime == nil || !usage.LastUseTime.Equal(frozen) {
+			t.Errorf("Usage(%s).LastUseTime = %v, expected %v", name, usage.LastUseTime, frozen)
+		}
+	}
+
+	report := s.UsageReport()
+	if len(report) != 2 || report[0].Name != viewTestKey || report[1].Name != viewTestRing+"/cryptoKeys/unused" {
+		t.Fatalf("UsageReport = %+v", report)
+	}
+	if unused := report[1]; unused.UseCount != 0 || unused.LastUseTime != nil || len(unused.Versions) != 1 {
+		t.Errorf("Expected the unused key to be reported unused, got %+v", unused)
+	}
+
+	s.Clear()
+	if usage := s.Usage(viewTestKey); usage.UseCount != 0 {
+		t.Errorf("Expected Clear to forget usage, got %+v", usage)
+	}
+}
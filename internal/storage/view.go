@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"maps"
+	"strings"
+	"time"
+)
+
+// The hot read paths (GetKeyRing, GetCryptoKey, GetCryptoKeyVersion,
+// GetPublicKey, Encrypt, Decrypt, AsymmetricSign, AsymmetricDecrypt, MacSign
+// and MacVerify) take no locks. They read a readView: an immutable copy of
+// the keyrings, crypto keys and versions that writers publish through an
+// atomic pointer after every change. Writers change the stored resources
+// under their locks as before, then publish copy-on-write: a change to one
+// crypto key copies that key with its versions and the map of keys in its
+// keyring, and shares everything else with the previous view. Publishing
+// happens before the writer unlocks, so a call that returned has its change
+// visible to every later read.
+
+// readView is a published view of the stored resources, never modified
+type readView struct {
+	keyRings map[string]*ringView
+}
+
+// ringView is a keyring in a readView. Its crypto keys are deep copies
+// (see cloneCryptoKey), so destroying a version does not wipe the key
+// material under a read that loaded an earlier view.
+type ringView struct {
+	createTime time.Time
+	cryptoKeys map[string]*StoredCryptoKey
+}
+
+// cryptoKey looks up a crypto key in the keyring its name is under
+func (v *readView) cryptoKey(name string) *StoredCryptoKey {
+	ring := v.keyRings[parentName(name, "/cryptoKeys/")]
+	if ring == nil {
+		return nil
+	}
+	return ring.cryptoKeys[name]
+}
+
+// cryptoKeyVersion looks up a crypto key version in the crypto key its name
+// is under, returning both
+func (v *readView) cryptoKeyVersion(name string) (*StoredCryptoKey, *StoredCryptoKeyVersion) {
+	cryptoKey := v.cryptoKey(parentName(name, "/cryptoKeyVersions/"))
+	if cryptoKey == nil {
+		return nil, nil
+	}
+	version := cryptoKey.Versions[name]
+	if version == nil {
+		return nil, nil
+	}
+	return cryptoKey, version
+}
+
+// publishAll publishes a view of every keyring. The caller must hold s.mu
+// for writing.
+func (s *Storage) publishAll() {
+	view := &readView{keyRings: make(map[string]*ringView, len(s.keyrings))}
+	for name, keyring := range s.keyrings {
+		view.keyRings[name] = newRingView(keyring)
+	}
+
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+	s.view.Store(view)
+}
+
+// publishKeyRing publishes a new view of one keyring. The caller must hold
+// the keyring's lock, or s.mu for writing.
+func (s *Storage) publishKeyRing(keyring *StoredKeyRing) {
+	ring := newRingView(keyring)
+
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+	s.view.Store(s.view.Load().with(keyring.Name, ring))
+}
+
+// publishCryptoKey publishes a new view of one crypto key in keyring,
+// removing it from the view if it no longer exists. The caller must hold
+// the keyring's lock, or s.mu for writing.
+func (s *Storage) publishCryptoKey(keyring *StoredKeyRing, name string) {
+	var cryptoKey *StoredCryptoKey
+	if ck := keyring.CryptoKeys[name]; ck != nil {
+		cryptoKey = cloneCryptoKey(ck)
+	}
+
+	// Holding publishMu from load to store keeps writers on other keyrings,
+	// which hold other locks, from publishing over each other
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+	view := s.view.Load()
+	ring := &ringView{createTime: keyring.CreateTime, cryptoKeys: make(map[string]*StoredCryptoKey)}
+	if old := view.keyRings[keyring.Name]; old != nil {
+		maps.Copy(ring.cryptoKeys, old.cryptoKeys)
+	}
+	if cryptoKey != nil {
+		ring.cryptoKeys[name] = cryptoKey
+	} else {
+		delete(ring.cryptoKeys, name)
+	}
+	s.view.Store(view.with(keyring.Name, ring))
+}
+
+// with returns a copy of v with the named keyring replaced by ring
+func (v *readView) with(name string, ring *ringView) *readView {
+	keyRings := maps.Clone(v.keyRings)
+	if keyRings == nil {
+		keyRings = make(map[string]*ringView)
+	}
+	keyRings[name] = ring
+	return &readView{keyRings: keyRings}
+}
+
+func newRingView(keyring *StoredKeyRing) *ringView {
+	ring := &ringView{
+		createTime: keyring.CreateTime,
+		cryptoKeys: make(map[string]*StoredCryptoKey, len(keyring.CryptoKeys)),
+	}
+	for name, cryptoKey := range keyring.CryptoKeys {
+		ring.cryptoKeys[name] = cloneCryptoKey(cryptoKey)
+	}
+	return ring
+}
+
+// cryptoKeyName returns the crypto key a resource name is in: the part
+// before its version, name itself for a crypto key, or "" for keyrings and
+// import jobs
+func cryptoKeyName(name string) string {
+	if !strings.Contains(name, "/cryptoKeys/") {
+		return ""
+	}
+	if key := parentName(name, "/cryptoKeyVersions/"); key != "" {
+		return key
+	}
+	return name
+}
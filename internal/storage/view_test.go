@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+const (
+	viewTestRing = "projects/test/locations/global/keyRings/ring1"
+	viewTestKey  = viewTestRing + "/cryptoKeys/key1"
+)
+
+func newViewTestStorage(tb testing.TB) *Storage {
+	tb.Helper()
+	s := NewStorage()
+	if _, err := s.CreateKeyRing(viewTestRing); err != nil {
+		tb.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	if _, err := s.CreateCryptoKey(viewTestRing, "key1", kmspb.CryptoKey_ENCRYPT_DECRYPT, nil, nil); err != nil {
+		tb.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+	return s
+}
+
+func TestReadsDoNotWaitForWriters(t *testing.T) {
+	s := newViewTestStorage(t)
+	ciphertext, _, _, err := s.Encrypt(viewTestKey, []byte("data"), nil)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	// Hold the keyring as a slow write, such as generating an RSA key, would
+	unlock := s.lockKeyRing(viewTestKey)
+	done := make(chan error, 1)
+	go func() {
+		if _, err := s.GetKeyRing(viewTestRing); err != nil {
+			done <- err
+			return
+		}
+		if _, err := s.GetCryptoKey(viewTestKey); err != nil {
+			done <- err
+			return
+		}
+		if _, _, _, err := s.Encrypt(viewTestKey, []byte("data"), nil); err != nil {
+			done <- err
+			return
+		}
+		_, _, _, err := s.Decrypt(viewTestKey, ciphertext, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reads waited for the keyring lock")
+	}
+	unlock()
+}
+
+func TestReadsSeeCompletedWrites(t *testing.T) {
+	s := newViewTestStorage(t)
+	version := viewTestKey + "/cryptoKeyVersions/1"
+
+	if _, err := s.UpdateCryptoKeyVersion(version, kmspb.CryptoKeyVersion_DISABLED, ""); err != nil {
+		t.Fatalf("UpdateCryptoKeyVersion failed: %v", err)
+	}
+	if v, err := s.GetCryptoKeyVersion(version); err != nil || v.State != kmspb.CryptoKeyVersion_DISABLED {
+		t.Fatalf("GetCryptoKeyVersion = %v, %v, expected DISABLED", v, err)
+	}
+	if _, _, _, err := s.Encrypt(viewTestKey, []byte("data"), nil); err == nil {
+		t.Error("Expected Encrypt with a disabled primary to fail")
+	}
+
+	created, err := s.CreateCryptoKeyVersion(viewTestKey)
+	if err != nil {
+		t.Fatalf("CreateCryptoKeyVersion failed: %v", err)
+	}
+	if _, name, _, err := s.Encrypt(created.Name, []byte("data"), nil); err != nil || name != created.Name {
+		t.Errorf("Encrypt with new version = %s, %v", name, err)
+	}
+
+	// Calls replacing every keyring publish them all
+	if _, err := s.SaveSnapshot("before"); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	s.Clear()
+	if _, err := s.GetKeyRing(viewTestRing); err == nil {
+		t.Error("Expected GetKeyRing to fail after Clear")
+	}
+	if _, err := s.RestoreSnapshot("before"); err != nil {
+		t.Fatalf("RestoreSnapshot failed: %v", err)
+	}
+	if _, err := s.GetCryptoKeyVersion(created.Name); err != nil {
+		t.Errorf("GetCryptoKeyVersion after RestoreSnapshot failed: %v", err)
+	}
+}
+
+func TestReadViewKeepsItsKeyMaterial(t *testing.T) {
+	s := newViewTestStorage(t)
+	s.SetDestroyScheduledDuration(0)
+	version := viewTestKey + "/cryptoKeyVersions/1"
+
+	// A read that loaded the view before the destroy still encrypts with the
+	// real key
+	view := s.view.Load()
+	_, loaded := view.cryptoKeyVersion(version)
+	if _, err := s.DestroyCryptoKeyVersion(version); err != nil {
+		t.Fatalf("DestroyCryptoKeyVersion failed: %v", err)
+	}
+	if bytes.Equal(loaded.SymmetricKey, make([]byte, len(loaded.SymmetricKey))) {
+		t.Error("Destroy zeroed the key material of an earlier view")
+	}
+	if _, v := s.view.Load().cryptoKeyVersion(version); v.State != kmspb.CryptoKeyVersion_DESTROYED || v.SymmetricKey != nil {
+		t.Errorf("Published version is %s with %d key bytes, expected DESTROYED with none", v.State, len(v.SymmetricKey))
+	}
+}
+
+// The benchmarks compare reads against the keyring locks they took before
+// reads went through the published view; see docs/benchmarks.md.
+
+func BenchmarkGetCryptoKey(b *testing.B) {
+	s := newViewTestStorage(b)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := s.GetCryptoKey(viewTestKey); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkEncrypt(b *testing.B) {
+	s := newViewTestStorage(b)
+	plaintext := []byte("benchmark plaintext")
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, _, _, err := s.Encrypt(viewTestKey, plaintext, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	s := newViewTestStorage(b)
+	ciphertext, _, _, err := s.Encrypt(viewTestKey, []byte("benchmark plaintext"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, _, _, err := s.Decrypt(viewTestKey, ciphertext, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkEncryptDuringKeyGeneration encrypts while another key in the
+// same keyring keeps generating RSA versions, which holds the keyring lock
+func BenchmarkEncryptDuringKeyGeneration(b *testing.B) {
+	s := newViewTestStorage(b)
+	signKey, err := s.CreateCryptoKey(viewTestRing, "sign", kmspb.CryptoKey_ASYMMETRIC_SIGN, &kmspb.CryptoKeyVersionTemplate{Algorithm: kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_2048_SHA256}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := s.CreateCryptoKeyVersion(signKey.Name); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+
+	plaintext := []byte("benchmark plaintext")
+	for b.Loop() {
+		if _, _, _, err := s.Encrypt(viewTestKey, plaintext, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	close(stop)
+	<-done
+}
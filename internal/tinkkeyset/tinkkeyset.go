@@ -0,0 +1,168 @@
+// Package tinkkeyset converts between Tink keysets and the key material of
+// emulator key versions.
+//
+// GOOGLE_SYMMETRIC_ENCRYPTION versions map to Tink AesGcmKey keys and
+// HMAC_SHA* versions to HmacKey keys with full-length tags. Exported keys use
+// the RAW output prefix, so a Tink MAC verifies the emulator's MacSign tags
+// and the emulator decrypts what a Tink AEAD encrypted with an imported RAW
+// key. Keys are numbered by version ID.
+//
+// Keysets are cleartext JSON, as written by insecurecleartextkeyset. They
+// hold raw key material and are meant for tests only.
+package tinkkeyset
+
+import (
+	"bytes"
+	"fmt"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/tink-crypto/tink-go/v2/keyset"
+	gcmpb "github.com/tink-crypto/tink-go/v2/proto/aes_gcm_go_proto"
+	commonpb "github.com/tink-crypto/tink-go/v2/proto/common_go_proto"
+	hmacpb "github.com/tink-crypto/tink-go/v2/proto/hmac_go_proto"
+	tinkpb "github.com/tink-crypto/tink-go/v2/proto/tink_go_proto"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+// Type URLs of the Tink key types the emulator's algorithms map to
+const (
+	AESGCMTypeURL = "type.googleapis.com/google.crypto.tink.AesGcmKey"
+	HMACTypeURL   = "type.googleapis.com/google.crypto.tink.HmacKey"
+)
+
+// hmacHashes maps HMAC algorithms to Tink hash types
+var hmacHashes = map[kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm]commonpb.HashType{
+	kmspb.CryptoKeyVersion_HMAC_SHA1:   commonpb.HashType_SHA1,
+	kmspb.CryptoKeyVersion_HMAC_SHA224: commonpb.HashType_SHA224,
+	kmspb.CryptoKeyVersion_HMAC_SHA256: commonpb.HashType_SHA256,
+	kmspb.CryptoKeyVersion_HMAC_SHA384: commonpb.HashType_SHA384,
+	kmspb.CryptoKeyVersion_HMAC_SHA512: commonpb.HashType_SHA512,
+}
+
+// Marshal returns the versions as a cleartext Tink keyset in JSON. The
+// primary version is the keyset's primary; keys without one, such as MAC
+// keys, use their newest enabled version.
+func Marshal(versions []storage.SymmetricVersion) ([]byte, error) {
+	ks := &tinkpb.Keyset{}
+	var newestEnabled uint32
+	for _, v := range versions {
+		data, err := keyData(v)
+		if err != nil {
+			return nil, err
+		}
+		status := tinkpb.KeyStatusType_DISABLED
+		if v.State == kmspb.CryptoKeyVersion_ENABLED {
+			status = tinkpb.KeyStatusType_ENABLED
+			newestEnabled = max(newestEnabled, v.ID)
+		}
+		if v.Primary {
+			ks.PrimaryKeyId = v.ID
+		}
+		ks.Key = append(ks.Key, &tinkpb.Keyset_Key{
+			KeyData:          data,
+			Status:           status,
+			KeyId:            v.ID,
+			OutputPrefixType: tinkpb.OutputPrefixType_RAW,
+		})
+	}
+	if ks.PrimaryKeyId == 0 {
+		if newestEnabled == 0 {
+			return nil, fmt.Errorf("no enabled version to make the keyset primary")
+		}
+		ks.PrimaryKeyId = newestEnabled
+	}
+
+	var buf bytes.Buffer
+	if err := keyset.NewJSONWriter(&buf).Write(ks); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// keyData returns the Tink key data holding a version's key material
+func keyData(v storage.SymmetricVersion) (*tinkpb.KeyData, error) {
+	var (
+		typeURL string
+		key     proto.Message
+	)
+	if v.Algorithm == kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION {
+		typeURL, key = AESGCMTypeURL, &gcmpb.AesGcmKey{KeyValue: v.Key}
+	} else if hash, ok := hmacHashes[v.Algorithm]; ok {
+		typeURL, key = HMACTypeURL, &hmacpb.HmacKey{
+			Params:   &hmacpb.HmacParams{Hash: hash, TagSize: uint32(len(v.Key))},
+			KeyValue: v.Key,
+		}
+	} else {
+		return nil, fmt.Errorf("version %d has algorithm %s, which has no Tink key type", v.ID, v.Algorithm)
+	}
+	value, err := proto.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	return &tinkpb.KeyData{TypeUrl: typeURL, Value: value, KeyMaterialType: tinkpb.KeyData_SYMMETRIC}, nil
+}
+
+// Unmarshal reads a cleartext Tink keyset in JSON, returning a version for
+// each enabled or disabled key, in keyset order. Destroyed keys are
+// skipped. Output prefixes are ignored: only RAW keys produce ciphertexts
+// and tags the emulator accepts.
+func Unmarshal(data []byte) ([]storage.SymmetricVersion, error) {
+	ks, err := keyset.NewJSONReader(bytes.NewReader(data)).Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid Tink keyset: %w", err)
+	}
+
+	var versions []storage.SymmetricVersion
+	for _, k := range ks.Key {
+		var state kmspb.CryptoKeyVersion_CryptoKeyVersionState
+		switch k.Status {
+		case tinkpb.KeyStatusType_ENABLED:
+			state = kmspb.CryptoKeyVersion_ENABLED
+		case tinkpb.KeyStatusType_DISABLED:
+			state = kmspb.CryptoKeyVersion_DISABLED
+		case tinkpb.KeyStatusType_DESTROYED:
+			continue
+		default:
+			return nil, fmt.Errorf("key %d has invalid status %s", k.KeyId, k.Status)
+		}
+		algorithm, key, err := keyMaterial(k.KeyData)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", k.KeyId, err)
+		}
+		versions = append(versions, storage.SymmetricVersion{
+			ID:        k.KeyId,
+			Algorithm: algorithm,
+			State:     state,
+			Primary:   k.KeyId == ks.PrimaryKeyId,
+			Key:       key,
+		})
+	}
+	return versions, nil
+}
+
+// keyMaterial returns the algorithm and raw key of Tink key data
+func keyMaterial(data *tinkpb.KeyData) (kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm, []byte, error) {
+	switch data.GetTypeUrl() {
+	case AESGCMTypeURL:
+		var key gcmpb.AesGcmKey
+		if err := proto.Unmarshal(data.Value, &key); err != nil {
+			return 0, nil, fmt.Errorf("invalid AesGcmKey: %w", err)
+		}
+		return kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION, key.KeyValue, nil
+	case HMACTypeURL:
+		var key hmacpb.HmacKey
+		if err := proto.Unmarshal(data.Value, &key); err != nil {
+			return 0, nil, fmt.Errorf("invalid HmacKey: %w", err)
+		}
+		for algorithm, hash := range hmacHashes {
+			if hash == key.GetParams().GetHash() {
+				return algorithm, key.KeyValue, nil
+			}
+		}
+		return 0, nil, fmt.Errorf("unsupported HMAC hash %s", key.GetParams().GetHash())
+	default:
+		return 0, nil, fmt.Errorf("unsupported key type %s; expected AesGcmKey or HmacKey", data.GetTypeUrl())
+	}
+}
@@ -0,0 +1,159 @@
+package tinkkeyset
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/tink-crypto/tink-go/v2/aead"
+	"github.com/tink-crypto/tink-go/v2/insecurecleartextkeyset"
+	"github.com/tink-crypto/tink-go/v2/keyset"
+	"github.com/tink-crypto/tink-go/v2/mac"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+const testRing = "projects/p/locations/global/keyRings/ring"
+
+func newTestKey(t *testing.T, id string, purpose kmspb.CryptoKey_CryptoKeyPurpose, algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm) (*storage.Storage, string) {
+	t.Helper()
+	s := storage.NewStorage()
+	if _, err := s.CreateKeyRing(testRing); err != nil {
+		t.Fatal(err)
+	}
+	key, err := s.CreateCryptoKey(testRing, id, purpose, &kmspb.CryptoKeyVersionTemplate{Algorithm: algorithm}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, key.Name
+}
+
+func readHandle(t *testing.T, data []byte) *keyset.Handle {
+	t.Helper()
+	handle, err := insecurecleartextkeyset.Read(keyset.NewJSONReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("Tink rejected the keyset: %v\n%s", err, data)
+	}
+	return handle
+}
+
+func TestExportMAC(t *testing.T) {
+	s, key := newTestKey(t, "mac", kmspb.CryptoKey_MAC, kmspb.CryptoKeyVersion_HMAC_SHA256)
+	if _, err := s.CreateCryptoKeyVersion(key); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := s.ExportSymmetricVersions(key)
+	if err != nil {
+		t.Fatalf("ExportSymmetricVersions failed: %v", err)
+	}
+	data, err := Marshal(versions)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	handle := readHandle(t, data)
+	if info := handle.KeysetInfo(); info.PrimaryKeyId != 2 || len(info.KeyInfo) != 2 {
+		t.Errorf("Expected two keys with version 2 primary, got %v", info)
+	}
+
+	// Tags from either version verify in Tink
+	m, err := mac.New(handle)
+	if err != nil {
+		t.Fatalf("mac.New failed: %v", err)
+	}
+	for _, version := range []string{"/cryptoKeyVersions/1", "/cryptoKeyVersions/2"} {
+		tag, _, err := s.MacSign(key+version, []byte("data"))
+		if err != nil {
+			t.Fatalf("MacSign failed: %v", err)
+		}
+		if err := m.VerifyMAC(tag, []byte("data")); err != nil {
+			t.Errorf("Expected Tink to verify the tag of %s: %v", version, err)
+		}
+	}
+}
+
+func TestImportAEAD(t *testing.T) {
+	handle, err := keyset.NewHandle(aead.AES256GCMNoPrefixKeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := insecurecleartextkeyset.Write(handle, keyset.NewJSONWriter(&buf)); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := Unmarshal(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if len(versions) != 1 || !versions[0].Primary || versions[0].Algorithm != kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION {
+		t.Fatalf("Expected one primary symmetric version, got %+v", versions)
+	}
+
+	s, key := newTestKey(t, "enc", kmspb.CryptoKey_ENCRYPT_DECRYPT, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION)
+	imported, err := s.ImportSymmetricVersions(key, versions)
+	if err != nil {
+		t.Fatalf("ImportSymmetricVersions failed: %v", err)
+	}
+
+	// The emulator decrypts what Tink encrypted with the same key
+	a, err := aead.New(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := a.Encrypt([]byte("secret"), []byte("context"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, usedPrimary, _, err := s.Decrypt(key, ciphertext, []byte("context"))
+	if err != nil || string(plaintext) != "secret" || !usedPrimary {
+		t.Errorf("Expected %s to decrypt Tink's ciphertext as primary, got %q %v: %v", imported[0].Name, plaintext, usedPrimary, err)
+	}
+
+	// And the exported keyset holds the same key
+	exported, err := s.ExportSymmetricVersions(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Marshal(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := aead.New(readHandle(t, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := b.Decrypt(ciphertext, []byte("context")); err != nil || string(plaintext) != "secret" {
+		t.Errorf("Expected the exported keyset to decrypt, got %q: %v", plaintext, err)
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	tests := []struct {
+		desc     string
+		versions []storage.SymmetricVersion
+		want     string
+	}{
+		{"no enabled version", []storage.SymmetricVersion{{ID: 1, Algorithm: kmspb.CryptoKeyVersion_HMAC_SHA256, State: kmspb.CryptoKeyVersion_DISABLED, Key: make([]byte, 32)}}, "no enabled version"},
+		{"asymmetric", []storage.SymmetricVersion{{ID: 1, Algorithm: kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256, State: kmspb.CryptoKeyVersion_ENABLED}}, "no Tink key type"},
+	}
+	for _, tt := range tests {
+		if _, err := Marshal(tt.versions); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.desc, tt.want, err)
+		}
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		desc, keyset, want string
+	}{
+		{"not a keyset", `{"primaryKeyId": "x"}`, "invalid Tink keyset"},
+		{"unsupported type", `{"primaryKeyId": 1, "key": [{"keyData": {"typeUrl": "type.googleapis.com/google.crypto.tink.ChaCha20Poly1305Key", "value": "", "keyMaterialType": "SYMMETRIC"}, "status": "ENABLED", "keyId": 1, "outputPrefixType": "RAW"}]}`, "unsupported key type"},
+		{"unknown status", `{"primaryKeyId": 1, "key": [{"keyData": {"typeUrl": "` + AESGCMTypeURL + `", "value": "", "keyMaterialType": "SYMMETRIC"}, "keyId": 1, "outputPrefixType": "RAW"}]}`, "invalid status"},
+	}
+	for _, tt := range tests {
+		if _, err := Unmarshal([]byte(tt.keyset)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.desc, tt.want, err)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+// Package webhook POSTs an event to an HTTP endpoint for KMS calls.
+//
+// Each call that reaches the KMS service, and that the filter selects,
+// produces one JSON event:
+//
+//	{
+//	  "id": "3f2a9c1e0b7d4a65",
+//	  "time": "2024-01-01T00:00:00.123Z",
+//	  "method": "UpdateCryptoKeyVersion",
+//	  "resourceName": "projects/p/locations/global/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1",
+//	  "eventType": "CRYPTO_KEY_VERSION_DISABLED",
+//	  "principal": "user:ci@example.com",
+//	  "code": "OK",
+//	  "resource": {"name": "projects/p/.../cryptoKeyVersions/1", "state": "DISABLED", ...}
+//	}
+//
+// eventType and resource are set for successful lifecycle calls, with the
+// event types the Pub/Sub integration publishes (see package notify); failed
+// calls carry their status code and message. Events never include request
+// payloads, so plaintext and key material stay out of them.
+//
+// Events are delivered by a background worker, in the order the calls
+// completed, so calls never wait on the endpoint. A delivery that fails with
+// a network error, 429 or a 5xx status is retried with exponential backoff;
+// other statuses are not retried. Each request carries the event ID in
+// X-Emulator-Event-Id and the attempt number in X-Emulator-Delivery-Attempt,
+// so receivers can drop duplicates.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	emulatorauth "github.com/blackwell-systems/gcp-emulator-auth"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/logging"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/notify"
+)
+
+// Delivery headers
+const (
+	EventIDHeader = "X-Emulator-Event-Id"
+	AttemptHeader = "X-Emulator-Delivery-Attempt"
+)
+
+// queueSize bounds the events waiting to be delivered; further events are
+// dropped rather than slowing down calls
+const queueSize = 1024
+
+// Event is the JSON body of a delivery
+type Event struct {
+	ID           string          `json:"id"`
+	Time         string          `json:"time"`
+	Method       string          `json:"method"`
+	ResourceName string          `json:"resourceName,omitempty"`
+	EventType    string          `json:"eventType,omitempty"`
+	Principal    string          `json:"principal,omitempty"`
+	Code         string          `json:"code"`
+	Message      string          `json:"message,omitempty"`
+	Resource     json.RawMessage `json:"resource,omitempty"`
+}
+
+// Config configures a Sender
+type Config struct {
+	// URL is the http or https endpoint events are POSTed to
+	URL string
+	// Filter selects the calls to send: path.Match globs over method names
+	// (Encrypt, Create*) and lifecycle event types
+	// (CRYPTO_KEY_VERSION_DISABLED, CRYPTO_KEY_*). Empty sends every call.
+	Filter []string
+	// Retries is how many times a failed delivery is retried
+	Retries int
+	// Backoff is the delay before the first retry; it doubles with each
+	// further retry. Zero uses one second.
+	Backoff time.Duration
+}
+
+// Sender delivers events to a webhook endpoint
+type Sender struct {
+	url     string
+	filter  []string
+	retries int
+	backoff time.Duration
+	client  *http.Client
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan Event
+	done   chan struct{}
+	// stop ends delivery when Close gives up waiting
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewSender validates config and starts delivering events
+func NewSender(config Config) (*Sender, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q (expected http:// or https://)", config.URL)
+	}
+	for _, pattern := range config.Filter {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid webhook filter %q: %w", pattern, err)
+		}
+	}
+	if config.Retries < 0 {
+		return nil, fmt.Errorf("webhook retries must not be negative")
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = time.Second
+	}
+
+	s := &Sender{
+		url:     config.URL,
+		filter:  config.Filter,
+		retries: config.Retries,
+		backoff: config.Backoff,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan Event, queueSize),
+		done:    make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// UnaryServerInterceptor queues an event for every call the filter selects
+func (s *Sender) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		resp, err := handler(ctx, req)
+
+		method := path.Base(info.FullMethod)
+		var eventType string
+		var resource []byte
+		if err == nil {
+			var msg proto.Message
+			if eventType, msg = notify.Event(method, req, resp); eventType != "" {
+				resource, _ = protojson.Marshal(msg)
+			}
+		}
+		if !s.selects(method, eventType) {
+			return resp, err
+		}
+
+		st := status.Convert(err)
+		event := Event{
+			ID:           eventID(),
+			Time:         time.Now().UTC().Format(time.RFC3339Nano),
+			Method:       method,
+			ResourceName: resourceName(method, req, resp),
+			EventType:    eventType,
+			Principal:    emulatorauth.ExtractPrincipalFromContext(ctx),
+			Code:         st.Code().String(),
+			Message:      st.Message(),
+			Resource:     resource,
+		}
+		s.enqueue(event)
+		return resp, err
+	}
+}
+
+// selects reports whether the filter selects a call
+func (s *Sender) selects(method, eventType string) bool {
+	if len(s.filter) == 0 {
+		return true
+	}
+	for _, pattern := range s.filter {
+		if ok, _ := path.Match(pattern, method); ok {
+			return true
+		}
+		if eventType != "" {
+			if ok, _ := path.Match(pattern, eventType); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resourceName is the resource a call acted on; creates name the new
+// resource rather than its parent
+func resourceName(method string, req, resp any) string {
+	if strings.HasPrefix(method, "Create") {
+		if name := logging.Resource(resp); name != "" {
+			return name
+		}
+	}
+	return logging.Resource(req)
+}
+
+// enqueue queues event without blocking, dropping it if the queue is full or
+// the sender is closed
+func (s *Sender) enqueue(event Event) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- event:
+	default:
+		slog.Warn("Webhook queue full, dropping event", "method", event.Method, "resource", event.ResourceName)
+	}
+}
+
+// Close delivers the queued events and stops the sender. Events still
+// queued when ctx expires are dropped.
+func (s *Sender) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		s.stopOnce.Do(func() { close(s.stop) })
+		return ctx.Err()
+	}
+}
+
+// run delivers queued events one at a time so they arrive in order
+func (s *Sender) run() {
+	defer close(s.done)
+	for event := range s.queue {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		body, err := json.Marshal(event)
+		if err != nil {
+			slog.Warn("Failed to encode webhook event", "method", event.Method, "error", err)
+			continue
+		}
+		if err := s.deliver(event.ID, body); err != nil {
+			slog.Warn("Failed to deliver webhook event", "url", s.url, "method", event.Method, "resource", event.ResourceName, "error", err)
+		}
+	}
+}
+
+// deliver POSTs body, retrying with exponential backoff
+func (s *Sender) deliver(id string, body []byte) error {
+	delay := s.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(id, attempt, body)
+		if err == nil || !retry || attempt > s.retries {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-s.stop:
+			return fmt.Errorf("%w (shutting down)", err)
+		}
+		delay *= 2
+	}
+}
+
+// post makes one delivery attempt and reports whether a failure is worth
+// retrying
+func (s *Sender) post(id string, attempt int, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventIDHeader, id)
+	req.Header.Set(AttemptHeader, strconv.Itoa(attempt))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return false, nil
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+func eventID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
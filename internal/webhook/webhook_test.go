@@ -0,0 +1,168 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+const versionName = "projects/p/locations/global/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1"
+
+// receiver records delivered events, failing the first failures attempts of
+// each with status
+type receiver struct {
+	mu       sync.Mutex
+	events   []Event
+	attempts map[string][]string
+}
+
+func newReceiver(t *testing.T, failures, status int) (*receiver, *httptest.Server) {
+	r := &receiver{attempts: make(map[string][]string)}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		id := req.Header.Get(EventIDHeader)
+		r.attempts[id] = append(r.attempts[id], req.Header.Get(AttemptHeader))
+		if len(r.attempts[id]) <= failures {
+			http.Error(w, "unavailable", status)
+			return
+		}
+		var event Event
+		if err := json.NewDecoder(req.Body).Decode(&event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.events = append(r.events, event)
+	}))
+	t.Cleanup(ts.Close)
+	return r, ts
+}
+
+func call(interceptor grpc.UnaryServerInterceptor, method string, req, resp any, err error) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/google.cloud.kms.v1.KeyManagementService/" + method}
+	interceptor(context.Background(), req, info, func(context.Context, any) (any, error) { return resp, err })
+}
+
+func TestDeliver(t *testing.T) {
+	r, ts := newReceiver(t, 0, 0)
+	s, err := NewSender(Config{URL: ts.URL})
+	if err != nil {
+		t.Fatalf("NewSender failed: %v", err)
+	}
+
+	interceptor := s.UnaryServerInterceptor()
+	disable := &kmspb.UpdateCryptoKeyVersionRequest{
+		CryptoKeyVersion: &kmspb.CryptoKeyVersion{Name: versionName},
+		UpdateMask:       &fieldmaskpb.FieldMask{Paths: []string{"state"}},
+	}
+	call(interceptor, "UpdateCryptoKeyVersion", disable, &kmspb.CryptoKeyVersion{Name: versionName, State: kmspb.CryptoKeyVersion_DISABLED}, nil)
+	call(interceptor, "Encrypt", &kmspb.EncryptRequest{Name: "projects/p/locations/global/keyRings/r/cryptoKeys/k", Plaintext: []byte("secret")}, nil, status.Error(codes.FailedPrecondition, "no primary version"))
+
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(r.events))
+	}
+	update := r.events[0]
+	if update.Method != "UpdateCryptoKeyVersion" || update.EventType != "CRYPTO_KEY_VERSION_DISABLED" || update.ResourceName != versionName || update.Code != "OK" || !strings.Contains(string(update.Resource), `"DISABLED"`) {
+		t.Errorf("Unexpected lifecycle event: %+v", update)
+	}
+	encrypt := r.events[1]
+	if encrypt.Method != "Encrypt" || encrypt.EventType != "" || encrypt.Code != "FailedPrecondition" || encrypt.Message != "no primary version" || encrypt.Resource != nil {
+		t.Errorf("Unexpected failed call event: %+v", encrypt)
+	}
+
+	// Events after Close are dropped instead of panicking
+	call(interceptor, "Encrypt", nil, nil, nil)
+}
+
+func TestFilter(t *testing.T) {
+	r, ts := newReceiver(t, 0, 0)
+	s, err := NewSender(Config{URL: ts.URL, Filter: []string{"Create*", "CRYPTO_KEY_VERSION_DESTROY_SCHEDULED"}})
+	if err != nil {
+		t.Fatalf("NewSender failed: %v", err)
+	}
+
+	interceptor := s.UnaryServerInterceptor()
+	call(interceptor, "CreateKeyRing", nil, &kmspb.KeyRing{Name: "projects/p/locations/global/keyRings/r"}, nil)
+	call(interceptor, "Encrypt", nil, &kmspb.EncryptResponse{}, nil)
+	call(interceptor, "DestroyCryptoKeyVersion", nil, &kmspb.CryptoKeyVersion{Name: versionName, State: kmspb.CryptoKeyVersion_DESTROY_SCHEDULED}, nil)
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.events) != 2 || r.events[0].Method != "CreateKeyRing" || r.events[0].ResourceName != "projects/p/locations/global/keyRings/r" || r.events[1].Method != "DestroyCryptoKeyVersion" {
+		t.Errorf("Expected the CreateKeyRing and DestroyCryptoKeyVersion events, got %+v", r.events)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	r, ts := newReceiver(t, 2, http.StatusServiceUnavailable)
+	s, err := NewSender(Config{URL: ts.URL, Retries: 3, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewSender failed: %v", err)
+	}
+	call(s.UnaryServerInterceptor(), "Encrypt", nil, nil, nil)
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.events) != 1 {
+		t.Fatalf("Expected the event after two failed attempts, got %d events", len(r.events))
+	}
+	if got := r.attempts[r.events[0].ID]; strings.Join(got, ",") != "1,2,3" {
+		t.Errorf("Expected attempts 1,2,3, got %v", got)
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	r, ts := newReceiver(t, 1, http.StatusBadRequest)
+	s, err := NewSender(Config{URL: ts.URL, Retries: 3, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewSender failed: %v", err)
+	}
+	call(s.UnaryServerInterceptor(), "Encrypt", nil, nil, nil)
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.events) != 0 || len(r.attempts) != 1 {
+		t.Errorf("Expected a single attempt for a 400, got events %v and attempts %v", r.events, r.attempts)
+	}
+}
+
+func TestNewSenderValidation(t *testing.T) {
+	for _, config := range []Config{
+		{URL: ""},
+		{URL: "localhost:8080/events"},
+		{URL: "ftp://example.com"},
+		{URL: "http://localhost/events", Filter: []string{"["}},
+		{URL: "http://localhost/events", Retries: -1},
+	} {
+		if _, err := NewSender(config); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Package kmscontainer starts the KMS emulator image with testcontainers-go.
+//
+//	ctr, err := kmscontainer.Run(ctx, kmscontainer.DefaultImage)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer testcontainers.TerminateContainer(ctr)
+//
+//	endpoint, err := ctr.GRPCEndpoint(ctx)
+//	conn, err := grpc.NewClient(endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+//
+// The container serves both protocols unless WithMode says otherwise. Run
+// waits for the /health endpoint, or for the gRPC port in grpc mode.
+//
+// It is a separate module so the emulator itself does not depend on Docker
+// client libraries.
+package kmscontainer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+const (
+	// DefaultImage is the published emulator image. Every variant of the
+	// image serves the mode set by WithMode.
+	DefaultImage = "ghcr.io/blackwell-systems/gcp-kms-emulator:latest"
+
+	// GRPCPort is the gRPC port exposed by the image
+	GRPCPort = "9090/tcp"
+
+	// RESTPort is the REST gateway port exposed by the image
+	RESTPort = "8080/tcp"
+
+	// seedPath is where WithSeed copies the state file in the container.
+	// /tmp is writable by the image's non-root user, so state is saved back
+	// on shutdown.
+	seedPath = "/tmp/kms-seed.json"
+)
+
+// Container is a running emulator container
+type Container struct {
+	testcontainers.Container
+}
+
+// Run starts the emulator image img and waits until it is ready
+func Run(ctx context.Context, img string, opts ...testcontainers.ContainerCustomizer) (*Container, error) {
+	req := testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        img,
+			ExposedPorts: []string{GRPCPort, RESTPort},
+			Env: map[string]string{
+				"GCP_KMS_MODE": "dual",
+				"GCP_KMS_HOST": "0.0.0.0",
+			},
+		},
+		Started: true,
+	}
+	for _, opt := range opts {
+		if err := opt.Customize(&req); err != nil {
+			return nil, fmt.Errorf("customize: %w", err)
+		}
+	}
+
+	// The health endpoint is served by the REST gateway, which grpc mode lacks
+	if req.WaitingFor == nil {
+		if req.Env["GCP_KMS_MODE"] == "grpc" {
+			req.WaitingFor = wait.ForListeningPort(GRPCPort)
+		} else {
+			req.WaitingFor = wait.ForHTTP("/health").WithPort(RESTPort)
+		}
+	}
+
+	ctr, err := testcontainers.GenericContainer(ctx, req)
+	var c *Container
+	if ctr != nil {
+		c = &Container{Container: ctr}
+	}
+	if err != nil {
+		return c, fmt.Errorf("run kms emulator: %w", err)
+	}
+	return c, nil
+}
+
+// WithMode sets the serving mode: grpc, rest or dual
+func WithMode(mode string) testcontainers.CustomizeRequestOption {
+	return WithEnv("GCP_KMS_MODE", mode)
+}
+
+// WithIAMMode sets the IAM enforcement mode (off, permissive or strict).
+// Enforcement also needs IAM_EMULATOR_HOST reachable from the container.
+func WithIAMMode(mode string) testcontainers.CustomizeRequestOption {
+	return WithEnv("IAM_MODE", mode)
+}
+
+// WithEnv sets an environment variable, such as GCP_KMS_LOG_LEVEL
+func WithEnv(key, value string) testcontainers.CustomizeRequestOption {
+	return func(req *testcontainers.GenericContainerRequest) error {
+		if req.Env == nil {
+			req.Env = map[string]string{}
+		}
+		req.Env[key] = value
+		return nil
+	}
+}
+
+// WithSeed copies a state file (as written by --state-file or the admin
+// API's state export) into the container and loads it at startup
+func WithSeed(hostPath string) testcontainers.CustomizeRequestOption {
+	return func(req *testcontainers.GenericContainerRequest) error {
+		req.Files = append(req.Files, testcontainers.ContainerFile{
+			HostFilePath:      hostPath,
+			ContainerFilePath: seedPath,
+			FileMode:          0o666,
+		})
+		return WithEnv("GCP_KMS_STATE_FILE", seedPath)(req)
+	}
+}
+
+// GRPCEndpoint returns the host:port clients dial for gRPC
+func (c *Container) GRPCEndpoint(ctx context.Context) (string, error) {
+	return c.PortEndpoint(ctx, GRPCPort, "")
+}
+
+// RESTEndpoint returns the base URL of the REST gateway, such as
+// http://localhost:32768
+func (c *Container) RESTEndpoint(ctx context.Context) (string, error) {
+	return c.PortEndpoint(ctx, RESTPort, "http")
+}
@@ -0,0 +1,45 @@
+package kmscontainer
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/testcontainers/testcontainers-go"
+)
+
+// KMS_EMULATOR_IMAGE tests a locally built image, such as gcp-kms-emulator:dual
+func testImage() string {
+	if img := os.Getenv("KMS_EMULATOR_IMAGE"); img != "" {
+		return img
+	}
+	return DefaultImage
+}
+
+func TestRun(t *testing.T) {
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	ctx := context.Background()
+
+	ctr, err := Run(ctx, testImage(), WithEnv("GCP_KMS_LOG_LEVEL", "debug"))
+	testcontainers.CleanupContainer(t, ctr)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if _, err := ctr.GRPCEndpoint(ctx); err != nil {
+		t.Errorf("GRPCEndpoint failed: %v", err)
+	}
+	rest, err := ctr.RESTEndpoint(ctx)
+	if err != nil {
+		t.Fatalf("RESTEndpoint failed: %v", err)
+	}
+	resp, err := http.Get(rest + "/v1/projects/p/locations/global/keyRings")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 listing key rings, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,537 @@
+// Package emulator runs the KMS emulator inside a Go program or test.
+//
+// Start serves the KeyManagementService and Locations APIs on a loopback
+// port, or over an in-memory connection with WithBufconn, and optionally the
+// REST gateway:
+//
+//	emu, err := emulator.Start(ctx)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer emu.Close()
+//
+//	conn, err := emu.Dial()
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	client, err := kms.NewKeyManagementClient(ctx, option.WithGRPCConn(conn))
+//
+// Every emulator has its own empty storage. IAM enforcement follows
+// IAM_MODE and IAM_EMULATOR_HOST unless WithIAMMode is given.
+package emulator
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/iam/apiv1/iampb"
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	locationpb "google.golang.org/genproto/googleapis/cloud/location"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	emulatorauth "github.com/blackwell-systems/gcp-emulator-auth"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/authz"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/bulk"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/gateway"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/principal"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/routing"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/server"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/storage"
+)
+
+// BufconnTarget is the gRPC target reported by Addr for in-memory emulators.
+// It only resolves with the dial options from DialOptions.
+const BufconnTarget = "passthrough:///bufconn"
+
+// bufconnSize is the buffer of the in-memory connection
+const bufconnSize = 1 << 20
+
+// Option configures an emulator started by Start
+type Option func(*options)
+
+type options struct {
+	addr       string
+	bufconn    bool
+	restAddr   string
+	iamMode    string
+	iamPolicy  string
+	locations  []string
+	destroy    *time.Duration
+	keyPool    map[string]int
+	keyGen     int
+	keyGenMax  map[string]int
+	extensions bool
+	mockCrypto bool
+	determ     bool
+	frozen     time.Time
+	fixtures   string
+	gcloud     []string
+	jwks       []string
+	tlsCert    string
+	tlsKey     string
+	serverOpts []grpc.ServerOption
+	unary      []grpc.UnaryServerInterceptor
+	stream     []grpc.StreamServerInterceptor
+	hooks      []Hooks
+}
+
+// WithAddr sets the gRPC listen address. The default is 127.0.0.1:0, a free
+// loopback port.
+func WithAddr(addr string) Option {
+	return func(o *options) { o.addr = addr }
+}
+
+// WithBufconn serves gRPC over an in-memory connection instead of a port.
+// Clients must dial with DialOptions or use Dial.
+func WithBufconn() Option {
+	return func(o *options) { o.bufconn = true }
+}
+
+// WithREST also serves the REST gateway on addr, such as 127.0.0.1:0
+func WithREST(addr string) Option {
+	return func(o *options) { o.restAddr = addr }
+}
+
+// WithIAMMode sets the IAM enforcement mode (off, permissive or strict),
+// overriding IAM_MODE
+func WithIAMMode(mode string) Option {
+	return func(o *options) { o.iamMode = mode }
+}
+
+// WithIAMPolicy checks permissions against the static IAM policy file at
+// path (see --iam-policy) instead of the IAM emulator, in strict mode unless
+// WithIAMMode sets permissive
+func WithIAMPolicy(path string) Option {
+	return func(o *options) { o.iamPolicy = path }
+}
+
+// WithLocations accepts keyrings in these location IDs as well as in the
+// Cloud KMS locations (see --extra-locations)
+func WithLocations(ids ...string) Option {
+	return func(o *options) { o.locations = append(o.locations, ids...) }
+}
+
+// WithDestroyScheduledDuration sets how long destroyed versions stay
+// DESTROY_SCHEDULED before their key material is wiped (see
+// --destroy-scheduled-duration). With 0 they are destroyed at once.
+func WithDestroyScheduledDuration(d time.Duration) Option {
+	return func(o *options) { o.destroy = &d }
+}
+
+// WithKeyPool keeps this many asymmetric keys of each type generated ahead,
+// such as {"rsa-4096": 4}, so suites creating many keys stay fast (see
+// --key-pool and storage.KeyPoolTypes)
+func WithKeyPool(sizes map[string]int) Option {
+	return func(o *options) { o.keyPool = sizes }
+}
+
+// WithKeyGeneration creates asymmetric versions PENDING_GENERATION, like
+// Cloud KMS, and generates their keys on this many background workers, at
+// most limits[type] of a key type at a time (see --key-generation-workers
+// and storage.GenerationKeyTypes)
+func WithKeyGeneration(workers int, limits map[string]int) Option {
+	return func(o *options) {
+		o.keyGen = workers
+		o.keyGenMax = limits
+	}
+}
+
+// WithExtensions serves the emulator-only gRPC extensions, such as
+// streaming bulk encrypt and decrypt (see --extensions). Their calls go
+// through the emulator's own interceptors and those of
+// WithUnaryInterceptors, not those of WithServerOptions.
+func WithExtensions() Option {
+	return func(o *options) { o.extensions = true }
+}
+
+// WithMockCrypto makes Encrypt and Decrypt wrap plaintext in a readable
+// envelope instead of encrypting it, for suites that need the API's
+// behaviour but not its cryptography (see --mock-crypto). Never use it for
+// data that matters.
+func WithMockCrypto() Option {
+	return func(o *options) { o.mockCrypto = true }
+}
+
+// WithDeterministicEncryption makes every crypto key encrypt with AES-SIV,
+// so the same plaintext and additional authenticated data always give the
+// same ciphertext (see --deterministic-encryption)
+func WithDeterministicEncryption() Option {
+	return func(o *options) { o.determ = true }
+}
+
+// WithFrozenTime records t as every create, generate, import and destroy
+// time, so responses are byte-stable for golden tests (see --frozen-time)
+func WithFrozenTime(t time.Time) Option {
+	return func(o *options) { o.frozen = t }
+}
+
+// WithFixtures creates the key versions in a fixtures manifest (see
+// --fixtures) at startup, so golden ciphertexts and signatures verify
+func WithFixtures(path string) Option {
+	return func(o *options) { o.fixtures = path }
+}
+
+// WithGCloudImport recreates the resources in the JSON output of gcloud kms
+// list commands (see --gcloud-import) at startup, with local key material
+func WithGCloudImport(paths ...string) Option {
+	return func(o *options) { o.gcloud = append(o.gcloud, paths...) }
+}
+
+// WithJWKS verifies Bearer JWTs against the JSON Web Key Sets at these URLs
+// or files (see --jwks) before using them as the principal. Without it,
+// tokens are trusted unverified.
+func WithJWKS(sources ...string) Option {
+	return func(o *options) { o.jwks = append(o.jwks, sources...) }
+}
+
+// WithTLS serves gRPC and the REST gateway over TLS with the PEM certificate
+// and key files (see --tls-cert). Dial and DialOptions then skip certificate
+// verification; clients that verify, such as Vault's gcpckms seal, need a
+// certificate for the host name they dial.
+func WithTLS(certFile, keyFile string) Option {
+	return func(o *options) { o.tlsCert, o.tlsKey = certFile, keyFile }
+}
+
+// WithServerOptions adds options to the gRPC server, such as interceptors
+func WithServerOptions(opts ...grpc.ServerOption) Option {
+	return func(o *options) { o.serverOpts = append(o.serverOpts, opts...) }
+}
+
+// WithUnaryInterceptors adds interceptors to every unary call, after the
+// emulator resolves the caller's principal, for bespoke logging, assertions
+// or fault injection. Each request of a streaming extension call also goes
+// through them.
+func WithUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) Option {
+	return func(o *options) { o.unary = append(o.unary, interceptors...) }
+}
+
+// WithStreamInterceptors adds interceptors to every streaming call
+func WithStreamInterceptors(interceptors ...grpc.StreamServerInterceptor) Option {
+	return func(o *options) { o.stream = append(o.stream, interceptors...) }
+}
+
+// Hooks run before and after storage operations. Unlike interceptors, they
+// see the operations of every caller, fixtures included, and the names the
+// operations resolve to.
+type Hooks = storage.Hooks
+
+// HookEvent describes a storage operation to Hooks
+type HookEvent = storage.HookEvent
+
+// HookError is the error of an operation a Before hook failed
+type HookError = storage.HookError
+
+// Operations passed to Hooks
+const (
+	HookCreate  = storage.HookCreate
+	HookEncrypt = storage.HookEncrypt
+	HookDecrypt = storage.HookDecrypt
+	HookDestroy = storage.HookDestroy
+)
+
+// WithHooks runs hooks before and after every create, encrypt, decrypt and
+// destroy in storage, in order. A Before hook that returns an error fails
+// the operation; a gRPC status error chooses the code clients see:
+//
+//	emulator.WithHooks(emulator.Hooks{
+//		Before: func(e emulator.HookEvent) error {
+//			if e.Operation == emulator.HookEncrypt && strings.HasSuffix(e.Name, "/cryptoKeys/flaky") {
+//				return status.Error(codes.Unavailable, "injected")
+//			}
+//			return nil
+//		},
+//	})
+func WithHooks(hooks ...Hooks) Option {
+	return func(o *options) { o.hooks = append(o.hooks, hooks...) }
+}
+
+// Emulator is a running KMS emulator
+type Emulator struct {
+	addr     string
+	restAddr string
+
+	grpcServer *grpc.Server
+	gateway    *gateway.Server
+	bufLis     *bufconn.Listener
+	storage    *storage.Storage
+	tlsConfig  *tls.Config
+
+	closeOnce sync.Once
+	closeErr  error
+	done      chan struct{}
+}
+
+// Start starts an emulator. It is stopped by Close or when ctx is done.
+func Start(ctx context.Context, opts ...Option) (*Emulator, error) {
+	o := options{addr: "127.0.0.1:0"}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var serverOpts []server.Option
+	if o.iamMode != "" {
+		serverOpts = append(serverOpts, server.WithIAMMode(emulatorauth.ParseAuthMode(o.iamMode)))
+	}
+	kmsServer, err := server.NewServer(serverOpts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := kmsServer.SetCustomLocations(o.locations); err != nil {
+		return nil, err
+	}
+	if o.destroy != nil {
+		kmsServer.Storage().SetDestroyScheduledDuration(*o.destroy)
+	}
+	if o.mockCrypto {
+		kmsServer.Storage().SetMockCrypto(true)
+	}
+	if o.determ {
+		kmsServer.Storage().SetDeterministicEncryption(true)
+	}
+	kmsServer.Storage().SetFrozenTime(o.frozen)
+	kmsServer.Storage().SetHooks(o.hooks...)
+	if o.iamPolicy != "" {
+		policy, err := authz.LoadPolicy(o.iamPolicy)
+		if err != nil {
+			return nil, err
+		}
+		if err := kmsServer.SetIAMPolicy(policy); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(o.gcloud) > 0 {
+		rings, err := storage.ReadGCloudExports(o.gcloud...)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := kmsServer.Storage().LoadMirror(rings); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.fixtures != "" {
+		fixtures, err := storage.ReadFixtures(o.fixtures)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := kmsServer.Storage().LoadFixtures(fixtures); err != nil {
+			return nil, err
+		}
+	}
+
+	var keys *principal.KeySet
+	if len(o.jwks) > 0 {
+		if keys, err = principal.LoadKeySet(ctx, o.jwks...); err != nil {
+			return nil, err
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if o.tlsCert != "" || o.tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(o.tlsCert, o.tlsKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS credentials: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	interceptors := []grpc.UnaryServerInterceptor{principal.NewResolver(keys).UnaryServerInterceptor(), routing.UnaryServerInterceptor()}
+	interceptors = append(interceptors, o.unary...)
+	grpcOpts := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(server.MaxMessageBytes),
+		grpc.MaxSendMsgSize(server.MaxMessageBytes),
+		grpc.ChainUnaryInterceptor(interceptors...),
+		grpc.ChainStreamInterceptor(o.stream...),
+	}
+	if tlsConfig != nil {
+		grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	e := &Emulator{
+		grpcServer: grpc.NewServer(append(grpcOpts, o.serverOpts...)...),
+		storage:    kmsServer.Storage(),
+		tlsConfig:  tlsConfig,
+		done:       make(chan struct{}),
+	}
+	kmspb.RegisterKeyManagementServiceServer(e.grpcServer, kmsServer)
+	iampb.RegisterIAMPolicyServer(e.grpcServer, kmsServer.IAMPolicy())
+	locationpb.RegisterLocationsServer(e.grpcServer, kmsServer.Locations())
+	if o.extensions {
+		bulk.NewService(kmsServer, interceptors...).Register(e.grpcServer)
+	}
+
+	var lis net.Listener
+	if o.bufconn {
+		e.bufLis = bufconn.Listen(bufconnSize)
+		lis = e.bufLis
+		e.addr = BufconnTarget
+	} else {
+		lis, err = net.Listen("tcp", o.addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", o.addr, err)
+		}
+		e.addr = lis.Addr().String()
+	}
+	go e.grpcServer.Serve(lis) //nolint:errcheck // returns when Close stops the server
+
+	if o.restAddr != "" {
+		if err := e.startREST(o.restAddr); err != nil {
+			e.grpcServer.Stop()
+			return nil, err
+		}
+	}
+
+	destroyerCtx, stopDestroyer := context.WithCancel(context.Background())
+	if len(o.keyPool) > 0 {
+		if err := e.storage.StartKeyPool(destroyerCtx, o.keyPool); err != nil {
+			stopDestroyer()
+			e.Close()
+			return nil, err
+		}
+	}
+	if o.keyGen > 0 {
+		if err := e.storage.StartKeyGeneration(destroyerCtx, o.keyGen, o.keyGenMax); err != nil {
+			stopDestroyer()
+			e.Close()
+			return nil, err
+		}
+	}
+	e.storage.StartDestroyer(destroyerCtx, storage.DestroyCheckInterval)
+	go func() {
+		select {
+		case <-ctx.Done():
+			e.Close()
+		case <-e.done:
+		}
+		stopDestroyer()
+	}()
+	return e, nil
+}
+
+// startREST serves the gateway on addr, dialing the gRPC server the same
+// way clients do
+func (e *Emulator) startREST(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	dialOpts := append(e.DialOptions(), grpc.WithDefaultCallOptions(
+		grpc.MaxCallRecvMsgSize(server.MaxMessageBytes),
+		grpc.MaxCallSendMsgSize(server.MaxMessageBytes),
+	))
+	e.gateway, err = gateway.NewServer(e.addr, dialOpts...)
+	if err != nil {
+		lis.Close()
+		return err
+	}
+	e.restAddr = lis.Addr().String()
+	if e.tlsConfig != nil {
+		config := e.tlsConfig.Clone()
+		config.NextProtos = []string{"h2", "http/1.1"}
+		lis = tls.NewListener(lis, config)
+	}
+	go func() {
+		// A gateway stopped before it started leaves the listener open
+		if err := e.gateway.Serve(lis); err != nil {
+			lis.Close()
+		}
+	}()
+	return nil
+}
+
+// Addr returns the gRPC address, or BufconnTarget for in-memory emulators
+func (e *Emulator) Addr() string {
+	return e.addr
+}
+
+// RESTAddr returns the REST gateway address, or "" if WithREST was not given
+func (e *Emulator) RESTAddr() string {
+	return e.restAddr
+}
+
+// DialOptions returns the options needed to dial Addr: plaintext
+// credentials, or TLS without certificate verification under WithTLS, and
+// the in-memory dialer for bufconn emulators
+func (e *Emulator) DialOptions() []grpc.DialOption {
+	creds := insecure.NewCredentials()
+	if e.tlsConfig != nil {
+		creds = credentials.NewTLS(&tls.Config{InsecureSkipVerify: true}) //nolint:gosec // the emulator's own test certificate
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if e.bufLis != nil {
+		opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return e.bufLis.DialContext(ctx)
+		}))
+	}
+	return opts
+}
+
+// Dial returns a client connection to the emulator. The caller closes it.
+func (e *Emulator) Dial(opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	return grpc.NewClient(e.addr, append(e.DialOptions(), opts...)...)
+}
+
+// Reset deletes all key rings, keys and versions, or only those of project
+// if it is not empty, so tests can share one emulator
+func (e *Emulator) Reset(project string) {
+	if project == "" {
+		e.storage.Clear()
+		return
+	}
+	e.storage.ClearProject(project)
+}
+
+// ResetKeyRing deletes one key ring with its keys, versions and import jobs,
+// so tests sharing a project can clean up only their own fixtures. It
+// reports whether the key ring existed.
+func (e *Emulator) ResetKeyRing(name string) bool {
+	return e.storage.ClearKeyRing(name)
+}
+
+// ImportKeyMaterial adds a version with unwrapped key material to an
+// existing key, without the import job and wrapping ImportCryptoKeyVersion
+// needs. Symmetric and HMAC keys are raw bytes; private keys are PEM or
+// PKCS#8 DER. An unspecified algorithm means the key's default algorithm.
+func (e *Emulator) ImportKeyMaterial(keyName string, algorithm kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm, material []byte) (*kmspb.CryptoKeyVersion, error) {
+	return e.storage.ImportRawKeyMaterial(keyName, algorithm, material)
+}
+
+// SaveSnapshot copies the current state in memory under name, replacing any
+// snapshot with that name, so expensive fixtures can be built once per suite
+func (e *Emulator) SaveSnapshot(name string) error {
+	_, err := e.storage.SaveSnapshot(name)
+	return err
+}
+
+// RestoreSnapshot replaces the current state with a copy of a snapshot saved
+// by SaveSnapshot. The snapshot can be restored again.
+func (e *Emulator) RestoreSnapshot(name string) error {
+	_, err := e.storage.RestoreSnapshot(name)
+	return err
+}
+
+// Close stops the emulator immediately. In-flight calls fail and all state
+// is discarded. It is safe to call more than once.
+func (e *Emulator) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.done)
+		if e.gateway != nil {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if err := e.gateway.Stop(ctx); err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, http.ErrServerClosed) {
+				e.closeErr = err
+			}
+		}
+		e.grpcServer.Stop()
+	})
+	return e.closeErr
+}
@@ -0,0 +1,641 @@
+package emulator
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	locationpb "google.golang.org/genproto/googleapis/cloud/location"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/bulk"
+)
+
+func TestStart(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"tcp", nil},
+		{"bufconn", []Option{WithBufconn()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			emu, err := Start(ctx, append(tt.opts, WithIAMMode("off"))...)
+			if err != nil {
+				t.Fatalf("Start failed: %v", err)
+			}
+			defer emu.Close()
+
+			conn, err := emu.Dial()
+			if err != nil {
+				t.Fatalf("Dial failed: %v", err)
+			}
+			defer conn.Close()
+
+			client := kmspb.NewKeyManagementServiceClient(conn)
+			ring, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{
+				Parent:    "projects/test/locations/global",
+				KeyRingId: "ring1",
+			})
+			if err != nil {
+				t.Fatalf("CreateKeyRing failed: %v", err)
+			}
+			if ring.Name != "projects/test/locations/global/keyRings/ring1" {
+				t.Errorf("Unexpected key ring name %q", ring.Name)
+			}
+		})
+	}
+}
+
+func TestStartREST(t *testing.T) {
+	emu, err := Start(context.Background(), WithBufconn(), WithREST("127.0.0.1:0"), WithIAMMode("off"))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer emu.Close()
+
+	resp, err := http.Post("http://"+emu.RESTAddr()+"/v1/projects/test/locations/global/keyRings?keyRingId=ring1", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || !strings.Contains(string(body), "keyRings/ring1") {
+		t.Errorf("Expected the key ring to be created, got %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	emu, err := Start(ctx, WithIAMMode("off"))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	cancel()
+	<-emu.done
+
+	if err := emu.Close(); err != nil {
+		t.Errorf("Close after cancellation failed: %v", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	ctx := context.Background()
+	emu, err := Start(ctx, WithBufconn(), WithIAMMode("off"))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer emu.Close()
+	conn, err := emu.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	client := kmspb.NewKeyManagementServiceClient(conn)
+
+	for _, ring := range [][2]string{{"a", "ring"}, {"b", "ring"}, {"b", "other"}} {
+		if _, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/" + ring[0] + "/locations/global", KeyRingId: ring[1]}); err != nil {
+			t.Fatalf("CreateKeyRing failed: %v", err)
+		}
+	}
+	count := func(project string) int {
+		resp, err := client.ListKeyRings(ctx, &kmspb.ListKeyRingsRequest{Parent: "projects/" + project + "/locations/global"})
+		if err != nil {
+			t.Fatalf("ListKeyRings failed: %v", err)
+		}
+		return len(resp.KeyRings)
+	}
+
+	emu.Reset("a")
+	if count("a") != 0 || count("b") != 2 {
+		t.Errorf("Expected only project a to be reset, got a=%d b=%d", count("a"), count("b"))
+	}
+	if !emu.ResetKeyRing("projects/b/locations/global/keyRings/other") || count("b") != 1 {
+		t.Errorf("Expected only key ring other to be reset, got b=%d", count("b"))
+	}
+	if emu.ResetKeyRing("projects/b/locations/global/keyRings/other") {
+		t.Error("Expected resetting a missing key ring to report false")
+	}
+	emu.Reset("")
+	if count("b") != 0 {
+		t.Errorf("Expected everything to be reset, got b=%d", count("b"))
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	ctx := context.Background()
+	emu, err := Start(ctx, WithBufconn(), WithIAMMode("off"))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer emu.Close()
+	conn, err := emu.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	client := kmspb.NewKeyManagementServiceClient(conn)
+
+	parent := "projects/test/locations/global"
+	if _, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: parent, KeyRingId: "fixture"}); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	if err := emu.SaveSnapshot("base"); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	if _, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: parent, KeyRingId: "extra"}); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+
+	if err := emu.RestoreSnapshot("base"); err != nil {
+		t.Fatalf("RestoreSnapshot failed: %v", err)
+	}
+	resp, err := client.ListKeyRings(ctx, &kmspb.ListKeyRingsRequest{Parent: parent})
+	if err != nil {
+		t.Fatalf("ListKeyRings failed: %v", err)
+	}
+	if len(resp.KeyRings) != 1 || resp.KeyRings[0].Name != parent+"/keyRings/fixture" {
+		t.Errorf("Expected only the fixture key ring after restore, got %v", resp.KeyRings)
+	}
+	if err := emu.RestoreSnapshot("missing"); err == nil {
+		t.Error("Expected an error restoring a missing snapshot")
+	}
+}
+
+func TestWithFixtures(t *testing.T) {
+	ctx := context.Background()
+	emu, err := Start(ctx, WithBufconn(), WithIAMMode("off"), WithFixtures("testdata/fixtures.json"))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer emu.Close()
+	conn, err := emu.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	client := kmspb.NewKeyManagementServiceClient(conn)
+
+	// Encrypted once with the fixture key, outside any emulator
+	golden, _ := base64.StdEncoding.DecodeString("AAAAAAAAAAAAAAAAadPZutBCoSWRKD0KVFwpVUV0X993YQ==")
+	resp, err := client.Decrypt(ctx, &kmspb.DecryptRequest{
+		Name:       "projects/test/locations/global/keyRings/golden/cryptoKeys/enc",
+		Ciphertext: golden,
+	})
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if string(resp.Plaintext) != "golden" {
+		t.Errorf("Expected plaintext %q, got %q", "golden", resp.Plaintext)
+	}
+
+	if _, err := Start(ctx, WithBufconn(), WithFixtures("testdata/missing.json")); err == nil {
+		t.Error("Expected Start to fail with a missing fixtures file")
+	}
+}
+
+func TestWithGCloudImport(t *testing.T) {
+	ctx := context.Background()
+	emu, err := Start(ctx, WithBufconn(), WithIAMMode("off"), WithGCloudImport("testdata/gcloud-keys.json"))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer emu.Close()
+	conn, err := emu.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	client := kmspb.NewKeyManagementServiceClient(conn)
+
+	key, err := client.GetCryptoKey(ctx, &kmspb.GetCryptoKeyRequest{Name: "projects/acme-prod/locations/europe-west1/keyRings/eu/cryptoKeys/backups"})
+	if err != nil {
+		t.Fatalf("GetCryptoKey failed: %v", err)
+	}
+	if key.Labels["team"] != "backups" || !strings.HasSuffix(key.Primary.Name, "/cryptoKeyVersions/4") {
+		t.Errorf("Expected the exported key, got %v", key)
+	}
+	if _, err := client.Encrypt(ctx, &kmspb.EncryptRequest{Name: key.Name, Plaintext: []byte("backup")}); err != nil {
+		t.Errorf("Encrypt failed: %v", err)
+	}
+}
+
+func TestWithJWKS(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, []byte(`{"keys":[]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	emu, err := Start(ctx, WithBufconn(), WithIAMMode("off"), WithJWKS(path))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer emu.Close()
+	conn, err := emu.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	client := kmspb.NewKeyManagementServiceClient(conn)
+	req := &kmspb.ListKeyRingsRequest{Parent: "projects/p/locations/global"}
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"alg":"RS256"}`)) + "." + enc.EncodeToString([]byte(`{"sub":"1"}`)) + ".c2ln"
+	if _, err := client.ListKeyRings(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+unsigned), req); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected UNAUTHENTICATED for an unsigned JWT, got %v", err)
+	}
+	if _, err := client.ListKeyRings(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer ya29.opaque"), req); err != nil {
+		t.Errorf("Expected opaque tokens to pass, got %v", err)
+	}
+
+	if _, err := Start(ctx, WithBufconn(), WithJWKS(filepath.Join(t.TempDir(), "missing.json"))); err == nil {
+		t.Error("Expected Start to fail with a missing key set")
+	}
+}
+
+func TestWithIAMPolicy(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	policy := "principals:\n  user:ci@example.com:\n    roles/cloudkms.viewer: [projects/p]\n"
+	if err := os.WriteFile(path, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	emu, err := Start(ctx, WithBufconn(), WithIAMMode("off"), WithIAMPolicy(path))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer emu.Close()
+	conn, err := emu.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	client := kmspb.NewKeyManagementServiceClient(conn)
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-emulator-principal", "user:ci@example.com")
+	if _, err := client.ListKeyRings(ctx, &kmspb.ListKeyRingsRequest{Parent: "projects/p/locations/global"}); err != nil {
+		t.Errorf("Expected the viewer to list key rings, got %v", err)
+	}
+	if _, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/p/locations/global", KeyRingId: "r"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PERMISSION_DENIED creating a key ring, got %v", err)
+	}
+}
+
+func TestWithLocations(t *testing.T) {
+	ctx := context.Background()
+	emu, err := Start(ctx, WithBufconn(), WithIAMMode("off"), WithLocations("edge-lab1"))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer emu.Close()
+	conn, err := emu.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	client := kmspb.NewKeyManagementServiceClient(conn)
+
+	if _, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/p/locations/edge-lab1", KeyRingId: "r"}); err != nil {
+		t.Errorf("Expected a key ring in the custom location, got %v", err)
+	}
+	if _, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/p/locations/us-centrall", KeyRingId: "r"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NOT_FOUND for a misspelled region, got %v", err)
+	}
+	loc, err := locationpb.NewLocationsClient(conn).GetLocation(ctx, &locationpb.GetLocationRequest{Name: "projects/p/locations/edge-lab1"})
+	if err != nil || loc.LocationId != "edge-lab1" {
+		t.Errorf("Expected the custom location to be served, got %v, %v", loc, err)
+	}
+}
+
+func TestWithKeyPool(t *testing.T) {
+	if _, err := Start(context.Background(), WithBufconn(), WithKeyPool(map[string]int{"rsa-1024": 1})); err == nil {
+		t.Fatal("Expected an unknown key pool type to fail")
+	}
+
+	emu, err := Start(context.Background(), WithBufconn(), WithIAMMode("off"), WithKeyPool(map[string]int{"ec-p256": 1}))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer emu.Close()
+	if sizes := emu.storage.KeyPoolSizes(); len(sizes) != 1 {
+		t.Errorf("KeyPoolSizes = %v, expected an ec-p256 pool", sizes)
+	}
+}
+
+func TestWithExtensions(t *testing.T) {
+	ctx := context.Background()
+	for _, extensions := range []bool{false, true} {
+		opts := []Option{WithBufconn(), WithIAMMode("off")}
+		if extensions {
+			opts = append(opts, WithExtensions())
+		}
+		emu, err := Start(ctx, opts...)
+		if err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer emu.Close()
+		conn, err := emu.Dial()
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+		client := kmspb.NewKeyManagementServiceClient(conn)
+		if _, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/test/locations/global", KeyRingId: "ring"}); err != nil {
+			t.Fatalf("CreateKeyRing failed: %v", err)
+		}
+		key, err := client.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{Parent: "projects/test/locations/global/keyRings/ring", CryptoKeyId: "key", CryptoKey: &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT}})
+		if err != nil {
+			t.Fatalf("CreateCryptoKey failed: %v", err)
+		}
+
+		stream, err := conn.NewStream(ctx, &bulk.EncryptStreamDesc, bulk.StreamEncryptMethod)
+		if err != nil {
+			t.Fatalf("NewStream failed: %v", err)
+		}
+		if err := stream.SendMsg(&kmspb.EncryptRequest{Name: key.Name, Plaintext: []byte("data")}); err != nil {
+			t.Fatalf("SendMsg failed: %v", err)
+		}
+		var resp kmspb.EncryptResponse
+		err = stream.RecvMsg(&resp)
+		if extensions && err != nil {
+			t.Errorf("StreamEncrypt failed: %v", err)
+		}
+		if !extensions && status.Code(err) != codes.Unimplemented {
+			t.Errorf("StreamEncrypt without extensions returned %v, expected Unimplemented", err)
+		}
+	}
+}
+
+func TestWithKeyGeneration(t *testing.T) {
+	ctx := context.Background()
+	emu, err := Start(ctx, WithBufconn(), WithIAMMode("off"), WithKeyGeneration(1, map[string]int{"ec-p256": 1}))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer emu.Close()
+	conn, err := emu.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	client := kmspb.NewKeyManagementServiceClient(conn)
+
+	if _, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/test/locations/global", KeyRingId: "ring"}); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	key, err := client.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent:      "projects/test/locations/global/keyRings/ring",
+		CryptoKeyId: "sign",
+		CryptoKey: &kmspb.CryptoKey{
+			Purpose:         kmspb.CryptoKey_ASYMMETRIC_SIGN,
+			VersionTemplate: &kmspb.CryptoKeyVersionTemplate{Algorithm: kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+
+	// Clients poll until the version is generated, as against Cloud KMS
+	name := key.Name + "/cryptoKeyVersions/1"
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		version, err := client.GetCryptoKeyVersion(ctx, &kmspb.GetCryptoKeyVersionRequest{Name: name})
+		if err != nil {
+			t.Fatalf("GetCryptoKeyVersion failed: %v", err)
+		}
+		if version.State == kmspb.CryptoKeyVersion_ENABLED {
+			break
+		}
+		if version.State != kmspb.CryptoKeyVersion_PENDING_GENERATION || time.Now().After(deadline) {
+			t.Fatalf("Version is %s, expected it to become ENABLED", version.State)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := client.GetPublicKey(ctx, &kmspb.GetPublicKeyRequest{Name: name}); err != nil {
+		t.Errorf("GetPublicKey failed: %v", err)
+	}
+	if st := emu.storage.GenerationStats(); st == nil || st.Types["ec-p256"].Generated != 1 {
+		t.Errorf("GenerationStats = %+v, expected one ec-p256 key generated", st)
+	}
+}
+
+func TestWithMockCrypto(t *testing.T) {
+	ctx := context.Background()
+	emu, err := Start(ctx, WithBufconn(), WithIAMMode("off"), WithMockCrypto())
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer emu.Close()
+	if !emu.storage.MockCrypto() {
+		t.Fatal("Expected mock crypto to be on")
+	}
+	conn, err := emu.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	client := kmspb.NewKeyManagementServiceClient(conn)
+
+	if _, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/test/locations/global", KeyRingId: "ring"}); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	key, err := client.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent:      "projects/test/locations/global/keyRings/ring",
+		CryptoKeyId: "key",
+		CryptoKey:   &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT},
+	})
+	if err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+	enc, err := client.Encrypt(ctx, &kmspb.EncryptRequest{Name: key.Name, Plaintext: []byte("secret")})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	dec, err := client.Decrypt(ctx, &kmspb.DecryptRequest{Name: key.Name, Ciphertext: enc.Ciphertext})
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if string(dec.Plaintext) != "secret" {
+		t.Errorf("Decrypt = %q, expected %q", dec.Plaintext, "secret")
+	}
+}
+
+func TestWithDeterministicEncryption(t *testing.T) {
+	ctx := context.Background()
+	emu, err := Start(ctx, WithBufconn(), WithIAMMode("off"), WithDeterministicEncryption())
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer emu.Close()
+	conn, err := emu.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	client := kmspb.NewKeyManagementServiceClient(conn)
+
+	if _, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/test/locations/global", KeyRingId: "ring"}); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	key, err := client.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent:      "projects/test/locations/global/keyRings/ring",
+		CryptoKeyId: "key",
+		CryptoKey:   &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT},
+	})
+	if err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+	var ciphertexts [2][]byte
+	for i := range ciphertexts {
+		resp, err := client.Encrypt(ctx, &kmspb.EncryptRequest{Name: key.Name, Plaintext: []byte("secret")})
+		if err != nil {
+			t.Fatalf("Encrypt failed: %v", err)
+		}
+		ciphertexts[i] = resp.Ciphertext
+	}
+	if string(ciphertexts[0]) != string(ciphertexts[1]) {
+		t.Error("Expected the same ciphertext for the same plaintext")
+	}
+}
+
+func TestWithFrozenTime(t *testing.T) {
+	ctx := context.Background()
+	frozen := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	emu, err := Start(ctx, WithBufconn(), WithIAMMode("off"), WithFrozenTime(frozen))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer emu.Close()
+	conn, err := emu.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	client := kmspb.NewKeyManagementServiceClient(conn)
+
+	ring, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/test/locations/global", KeyRingId: "ring"})
+	if err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	key, err := client.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent:      ring.Name,
+		CryptoKeyId: "key",
+		CryptoKey:   &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT},
+	})
+	if err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+	if !ring.CreateTime.AsTime().Equal(frozen) || !key.CreateTime.AsTime().Equal(frozen) || !key.Primary.CreateTime.AsTime().Equal(frozen) {
+		t.Errorf("Create times = %v, %v, %v, expected %v", ring.CreateTime.AsTime(), key.CreateTime.AsTime(), key.Primary.CreateTime.AsTime(), frozen)
+	}
+}
+
+func TestWithHooks(t *testing.T) {
+	ctx := context.Background()
+	var methods, events []string
+	record := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		methods = append(methods, info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:])
+		return handler(ctx, req)
+	}
+	hooks := Hooks{
+		Before: func(e HookEvent) error {
+			if e.Operation == HookEncrypt && strings.HasSuffix(e.Name, "/cryptoKeys/flaky") {
+				return status.Error(codes.Unavailable, "injected")
+			}
+			return nil
+		},
+		After: func(e HookEvent) { events = append(events, e.Operation+" "+e.Version) },
+	}
+	emu, err := Start(ctx, WithBufconn(), WithIAMMode("off"), WithUnaryInterceptors(record), WithHooks(hooks))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer emu.Close()
+	conn, err := emu.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	client := kmspb.NewKeyManagementServiceClient(conn)
+
+	ring, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/test/locations/global", KeyRingId: "ring"})
+	if err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	for _, id := range []string{"key", "flaky"} {
+		if _, err := client.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+			Parent:      ring.Name,
+			CryptoKeyId: id,
+			CryptoKey:   &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT},
+		}); err != nil {
+			t.Fatalf("CreateCryptoKey failed: %v", err)
+		}
+	}
+	if _, err := client.Encrypt(ctx, &kmspb.EncryptRequest{Name: ring.Name + "/cryptoKeys/key", Plaintext: []byte("data")}); err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	_, err = client.Encrypt(ctx, &kmspb.EncryptRequest{Name: ring.Name + "/cryptoKeys/flaky", Plaintext: []byte("data")})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected the hook to fail Encrypt with Unavailable, got %v", err)
+	}
+
+	if got := strings.Join(methods, ","); got != "CreateKeyRing,CreateCryptoKey,CreateCryptoKey,Encrypt,Encrypt" {
+		t.Errorf("Interceptor saw %s", got)
+	}
+	want := []string{"create ", "create " + ring.Name + "/cryptoKeys/key/cryptoKeyVersions/1", "create " + ring.Name + "/cryptoKeys/flaky/cryptoKeyVersions/1", "encrypt " + ring.Name + "/cryptoKeys/key/cryptoKeyVersions/1"}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Errorf("After hooks saw %q, want %q", events, want)
+	}
+}
+
+func TestImportKeyMaterial(t *testing.T) {
+	ctx := context.Background()
+	emu, err := Start(ctx, WithBufconn(), WithIAMMode("off"))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer emu.Close()
+	conn, err := emu.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	client := kmspb.NewKeyManagementServiceClient(conn)
+
+	parent := "projects/test/locations/global/keyRings/ring"
+	if _, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/test/locations/global", KeyRingId: "ring"}); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	key, err := client.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{Parent: parent, CryptoKeyId: "enc", CryptoKey: &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT}})
+	if err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+
+	material := make([]byte, 32)
+	for i := range material {
+		material[i] = byte(i)
+	}
+	version, err := emu.ImportKeyMaterial(key.Name, kmspb.CryptoKeyVersion_CRYPTO_KEY_VERSION_ALGORITHM_UNSPECIFIED, material)
+	if err != nil {
+		t.Fatalf("ImportKeyMaterial failed: %v", err)
+	}
+
+	// The same ciphertext TestWithFixtures decrypts, made with this key
+	golden, _ := base64.StdEncoding.DecodeString("AAAAAAAAAAAAAAAAadPZutBCoSWRKD0KVFwpVUV0X993YQ==")
+	resp, err := client.Decrypt(ctx, &kmspb.DecryptRequest{Name: key.Name, Ciphertext: golden})
+	if err != nil || string(resp.GetPlaintext()) != "golden" {
+		t.Errorf("Expected %s to decrypt the golden ciphertext, got %q: %v", version.Name, resp.GetPlaintext(), err)
+	}
+}
@@ -0,0 +1,358 @@
+package emulator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// cloudKMSHost is the host Vault's gcpckms seal dials; it has no endpoint
+// setting, so the emulator answers under this name
+const cloudKMSHost = "cloudkms.googleapis.com"
+
+// vaultSeal holds what Vault's gcpckms seal needs to reach an emulator as
+// Cloud KMS: a TLS emulator with the seal key, a certificate to trust and
+// service account credentials
+type vaultSeal struct {
+	emu         *Emulator
+	certFile    string
+	credentials string
+	keyName     string
+}
+
+// startVaultSeal starts a TLS emulator holding the key
+// projects/vault-test/locations/global/keyRings/vault/cryptoKeys/unseal
+func startVaultSeal(t *testing.T) *vaultSeal {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, cloudKMSHost)
+	v := &vaultSeal{
+		certFile:    certFile,
+		credentials: writeTestServiceAccount(t, dir, "vault@vault-test.iam.gserviceaccount.com"),
+		keyName:     "projects/vault-test/locations/global/keyRings/vault/cryptoKeys/unseal",
+	}
+
+	var err error
+	v.emu, err = Start(context.Background(), WithTLS(certFile, keyFile), WithIAMMode("off"))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(func() { v.emu.Close() })
+
+	conn, err := v.emu.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	client := kmspb.NewKeyManagementServiceClient(conn)
+	if _, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/vault-test/locations/global", KeyRingId: "vault"}); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	if _, err := client.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent:      "projects/vault-test/locations/global/keyRings/vault",
+		CryptoKeyId: "unseal",
+		CryptoKey:   &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT},
+	}); err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+	return v
+}
+
+// TestVaultSealCalls makes the calls of Vault's gcpckms seal the way it makes
+// them: with the generated client, Application Default Credentials from a
+// service account key file, and TLS verified for cloudkms.googleapis.com
+func TestVaultSealCalls(t *testing.T) {
+	v := startVaultSeal(t)
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", v.credentials)
+
+	cert, err := os.ReadFile(v.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(cert)
+	ctx := context.Background()
+	client, err := kms.NewKeyManagementClient(ctx,
+		option.WithEndpoint(v.emu.Addr()),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: roots, ServerName: cloudKMSHost}))),
+		option.WithUserAgent("vault-gcpckms-test"),
+	)
+	if err != nil {
+		t.Fatalf("NewKeyManagementClient failed: %v", err)
+	}
+	defer client.Close()
+
+	// The seal checks the key on setup, then wraps a data key with the key
+	// name, keeps the version name from the response as the key ID, and
+	// unwraps with the key name again
+	key, err := client.GetCryptoKey(ctx, &kmspb.GetCryptoKeyRequest{Name: v.keyName})
+	if err != nil {
+		t.Fatalf("GetCryptoKey failed: %v", err)
+	}
+	if key.Purpose != kmspb.CryptoKey_ENCRYPT_DECRYPT || key.Primary == nil {
+		t.Fatalf("Expected an ENCRYPT_DECRYPT key with a primary version, got %v", key)
+	}
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	encrypted, err := client.Encrypt(ctx, &kmspb.EncryptRequest{Name: v.keyName, Plaintext: dataKey})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if encrypted.Name != key.Primary.Name {
+		t.Errorf("Expected the key ID %s, got %s", key.Primary.Name, encrypted.Name)
+	}
+	decrypted, err := client.Decrypt(ctx, &kmspb.DecryptRequest{Name: v.keyName, Ciphertext: encrypted.Ciphertext})
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if !bytes.Equal(decrypted.Plaintext, dataKey) {
+		t.Errorf("Expected the data key back, got %q", decrypted.Plaintext)
+	}
+}
+
+// TestVaultAutoUnseal initializes a Vault server sealed by the emulator,
+// restarts it and checks it unseals itself. It needs a vault binary on PATH.
+// Vault reaches the emulator through a CONNECT proxy that sends
+// cloudkms.googleapis.com to it, so no DNS or hosts changes are needed.
+func TestVaultAutoUnseal(t *testing.T) {
+	vault, err := exec.LookPath("vault")
+	if err != nil {
+		t.Skip("vault not found on PATH")
+	}
+	v := startVaultSeal(t)
+	proxy := startConnectProxy(t, v.emu.Addr())
+
+	dir := t.TempDir()
+	vaultAddr := "127.0.0.1:" + freePort(t)
+	config := filepath.Join(dir, "vault.hcl")
+	if err := os.WriteFile(config, []byte(fmt.Sprintf(`
+storage "file" {
+  path = %q
+}
+listener "tcp" {
+  address     = %q
+  tls_disable = true
+}
+seal "gcpckms" {
+  project    = "vault-test"
+  region     = "global"
+  key_ring   = "vault"
+  crypto_key = "unseal"
+}
+disable_mlock = true
+`, filepath.Join(dir, "data"), vaultAddr)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	env := append(os.Environ(),
+		"VAULT_ADDR=http://"+vaultAddr,
+		"HTTPS_PROXY=http://"+proxy,
+		"NO_PROXY=127.0.0.1,localhost",
+		"SSL_CERT_FILE="+v.certFile,
+		"GOOGLE_APPLICATION_CREDENTIALS="+v.credentials,
+	)
+	run := func(args ...string) ([]byte, error) {
+		cmd := exec.Command(vault, args...)
+		cmd.Env = env
+		return cmd.CombinedOutput()
+	}
+	start := func() (stop func()) {
+		cmd := exec.Command(vault, "server", "-config", config)
+		cmd.Env = env
+		var logs bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &logs, &logs
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("Starting vault failed: %v", err)
+		}
+		stop = func() {
+			cmd.Process.Kill() //nolint:errcheck // may have exited already
+			cmd.Wait()         //nolint:errcheck // killed
+			if t.Failed() {
+				t.Logf("vault server output:\n%s", logs.String())
+			}
+		}
+		t.Cleanup(stop)
+		return stop
+	}
+	waitUnsealed := func() {
+		var out []byte
+		for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(200 * time.Millisecond) {
+			out, _ = run("status", "-format=json")
+			var status struct {
+				Initialized bool `json:"initialized"`
+				Sealed      bool `json:"sealed"`
+			}
+			if json.Unmarshal(out, &status) == nil && status.Initialized && !status.Sealed {
+				return
+			}
+		}
+		t.Fatalf("Vault did not unseal: %s", out)
+	}
+
+	stop := start()
+	var out []byte
+	for deadline := time.Now().Add(30 * time.Second); ; time.Sleep(200 * time.Millisecond) {
+		if out, err = run("operator", "init", "-recovery-shares=1", "-recovery-threshold=1"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("vault operator init failed: %v\n%s", err, out)
+		}
+	}
+	waitUnsealed()
+
+	// A restarted server reads its root key back with Decrypt
+	stop()
+	start()
+	waitUnsealed()
+}
+
+// writeTestCertificate writes a self-signed certificate for hosts and its
+// key, returning their paths. The certificate is its own CA, so clients can
+// trust it through SSL_CERT_FILE.
+func writeTestCertificate(t *testing.T, dir string, hosts ...string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		DNSNames:              hosts,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+// writeTestServiceAccount writes a service account key file for email. The
+// client libraries sign their own JWTs with it for Cloud KMS, so it works
+// without reaching Google's token endpoint.
+func writeTestServiceAccount(t *testing.T, dir, email string) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "vault-test",
+		"private_key_id": "emulator",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   email,
+		"client_id":      "1",
+		"token_uri":      "https://oauth2.googleapis.com/token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "service-account.json")
+	if err := os.WriteFile(path, account, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startConnectProxy serves an HTTP CONNECT proxy that tunnels every
+// connection to target, returning its address
+func startConnectProxy(t *testing.T, target string) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go tunnel(conn, target)
+		}
+	}()
+	return lis.Addr().String()
+}
+
+func tunnel(conn net.Conn, target string) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil || req.Method != http.MethodConnect || !strings.HasPrefix(req.Host, cloudKMSHost+":") {
+		fmt.Fprint(conn, "HTTP/1.1 403 Forbidden\r\n\r\n")
+		return
+	}
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		fmt.Fprint(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer upstream.Close()
+	fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go io.Copy(upstream, br) //nolint:errcheck // ends when either side closes
+	io.Copy(conn, upstream)  //nolint:errcheck // ends when either side closes
+}
+
+// freePort returns a loopback port that was free a moment ago
+func freePort(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	return port
+}
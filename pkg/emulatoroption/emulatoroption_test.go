@@ -0,0 +1,41 @@
+package emulatoroption
+
+import (
+	"testing"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/pkg/emulator"
+)
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv(EnvVar, "")
+	if opts := FromEnv(); opts != nil {
+		t.Errorf("Expected no options without %s, got %v", EnvVar, opts)
+	}
+
+	emu, err := emulator.Start(t.Context(), emulator.WithIAMMode("off"))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer emu.Close()
+
+	t.Setenv(EnvVar, emu.Addr())
+	client, err := kms.NewKeyManagementClient(t.Context(), FromEnv()...)
+	if err != nil {
+		t.Fatalf("NewKeyManagementClient failed: %v", err)
+	}
+	defer client.Close()
+
+	ring, err := client.CreateKeyRing(t.Context(), &kmspb.CreateKeyRingRequest{
+		Parent:    "projects/p/locations/global",
+		KeyRingId: "ring",
+	})
+	if err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	if ring.Name != "projects/p/locations/global/keyRings/ring" {
+		t.Errorf("Unexpected key ring %s", ring.Name)
+	}
+}
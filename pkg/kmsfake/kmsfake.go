@@ -0,0 +1,325 @@
+// Package kmsfake is an in-memory Cloud KMS client for unit tests.
+//
+// A Client has the methods of cloud.google.com/go/kms/apiv1.KeyManagementClient
+// and serves them by calling the emulator's request handlers directly: no
+// listener, no connection and no goroutines, so each call takes microseconds.
+// Requests are validated, and errors returned, exactly as the emulator does.
+//
+//	client, err := kmsfake.NewClient()
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	resp, err := client.Encrypt(ctx, &kmspb.EncryptRequest{Name: key, Plaintext: []byte("secret")})
+//
+// Code under test should depend on an interface holding the methods it
+// calls, which both *kms.KeyManagementClient and *Client satisfy. List methods
+// return this package's iterators, since the client library's cannot be
+// built outside it; they have the same Next and All methods. IAM policy and
+// operations methods are not provided.
+//
+// Use pkg/emulator or pkg/kmstest for tests that should cross a real gRPC
+// connection.
+package kmsfake
+
+import (
+	"context"
+	"iter"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/googleapis/gax-go/v2"
+	"github.com/googleapis/gax-go/v2/apierror"
+	"google.golang.org/api/iterator"
+	locationpb "google.golang.org/genproto/googleapis/cloud/location"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	emulatorauth "github.com/blackwell-systems/gcp-emulator-auth"
+	"github.com/blackwell-systems/gcp-kms-emulator/internal/server"
+)
+
+// Client is an in-memory KeyManagementClient. It is safe for concurrent use.
+type Client struct {
+	kms       *server.Server
+	locations locationpb.LocationsServer
+}
+
+// NewClient returns a client with its own empty state. IAM is never
+// enforced.
+func NewClient() (*Client, error) {
+	kms, err := server.NewServer(server.WithIAMMode(emulatorauth.AuthModeOff))
+	if err != nil {
+		return nil, err
+	}
+	return &Client{kms: kms, locations: kms.Locations()}, nil
+}
+
+// Close does nothing; it is provided for parity with KeyManagementClient
+func (c *Client) Close() error {
+	return nil
+}
+
+// call runs a handler the way a call through the client library ends: a
+// done context fails the call, and errors are *apierror.APIError values
+func call[Req, Resp any](ctx context.Context, handler func(context.Context, Req) (Resp, error), req Req) (Resp, error) {
+	var zero Resp
+	if err := ctx.Err(); err != nil {
+		return zero, wrapError(status.FromContextError(err).Err())
+	}
+	resp, err := handler(ctx, req)
+	if err != nil {
+		return zero, wrapError(err)
+	}
+	return resp, nil
+}
+
+func wrapError(err error) error {
+	if apiErr, ok := apierror.FromError(err); ok {
+		return apiErr
+	}
+	return err
+}
+
+// GetKeyRing returns metadata for a given KeyRing.
+func (c *Client) GetKeyRing(ctx context.Context, req *kmspb.GetKeyRingRequest, _ ...gax.CallOption) (*kmspb.KeyRing, error) {
+	return call(ctx, c.kms.GetKeyRing, req)
+}
+
+// GetCryptoKey returns metadata for a given CryptoKey, as well as its primary
+// CryptoKeyVersion.
+func (c *Client) GetCryptoKey(ctx context.Context, req *kmspb.GetCryptoKeyRequest, _ ...gax.CallOption) (*kmspb.CryptoKey, error) {
+	return call(ctx, c.kms.GetCryptoKey, req)
+}
+
+// GetCryptoKeyVersion returns metadata for a given CryptoKeyVersion.
+func (c *Client) GetCryptoKeyVersion(ctx context.Context, req *kmspb.GetCryptoKeyVersionRequest, _ ...gax.CallOption) (*kmspb.CryptoKeyVersion, error) {
+	return call(ctx, c.kms.GetCryptoKeyVersion, req)
+}
+
+// GetPublicKey returns the public key for the given CryptoKeyVersion.
+func (c *Client) GetPublicKey(ctx context.Context, req *kmspb.GetPublicKeyRequest, _ ...gax.CallOption) (*kmspb.PublicKey, error) {
+	return call(ctx, c.kms.GetPublicKey, req)
+}
+
+// GetImportJob returns metadata for a given ImportJob.
+func (c *Client) GetImportJob(ctx context.Context, req *kmspb.GetImportJobRequest, _ ...gax.CallOption) (*kmspb.ImportJob, error) {
+	return call(ctx, c.kms.GetImportJob, req)
+}
+
+// CreateKeyRing creates a new KeyRing in a given Project and Location.
+func (c *Client) CreateKeyRing(ctx context.Context, req *kmspb.CreateKeyRingRequest, _ ...gax.CallOption) (*kmspb.KeyRing, error) {
+	return call(ctx, c.kms.CreateKeyRing, req)
+}
+
+// CreateCryptoKey creates a new CryptoKey within a KeyRing.
+func (c *Client) CreateCryptoKey(ctx context.Context, req *kmspb.CreateCryptoKeyRequest, _ ...gax.CallOption) (*kmspb.CryptoKey, error) {
+	return call(ctx, c.kms.CreateCryptoKey, req)
+}
+
+// CreateCryptoKeyVersion creates a new CryptoKeyVersion in a CryptoKey.
+func (c *Client) CreateCryptoKeyVersion(ctx context.Context, req *kmspb.CreateCryptoKeyVersionRequest, _ ...gax.CallOption) (*kmspb.CryptoKeyVersion, error) {
+	return call(ctx, c.kms.CreateCryptoKeyVersion, req)
+}
+
+// ImportCryptoKeyVersion imports wrapped key material into a CryptoKey.
+func (c *Client) ImportCryptoKeyVersion(ctx context.Context, req *kmspb.ImportCryptoKeyVersionRequest, _ ...gax.CallOption) (*kmspb.CryptoKeyVersion, error) {
+	return call(ctx, c.kms.ImportCryptoKeyVersion, req)
+}
+
+// CreateImportJob creates a new ImportJob within a KeyRing.
+func (c *Client) CreateImportJob(ctx context.Context, req *kmspb.CreateImportJobRequest, _ ...gax.CallOption) (*kmspb.ImportJob, error) {
+	return call(ctx, c.kms.CreateImportJob, req)
+}
+
+// UpdateCryptoKey updates a CryptoKey.
+func (c *Client) UpdateCryptoKey(ctx context.Context, req *kmspb.UpdateCryptoKeyRequest, _ ...gax.CallOption) (*kmspb.CryptoKey, error) {
+	return call(ctx, c.kms.UpdateCryptoKey, req)
+}
+
+// UpdateCryptoKeyVersion updates a CryptoKeyVersion's metadata.
+func (c *Client) UpdateCryptoKeyVersion(ctx context.Context, req *kmspb.UpdateCryptoKeyVersionRequest, _ ...gax.CallOption) (*kmspb.CryptoKeyVersion, error) {
+	return call(ctx, c.kms.UpdateCryptoKeyVersion, req)
+}
+
+// UpdateCryptoKeyPrimaryVersion updates the version of a CryptoKey used in
+// Encrypt.
+func (c *Client) UpdateCryptoKeyPrimaryVersion(ctx context.Context, req *kmspb.UpdateCryptoKeyPrimaryVersionRequest, _ ...gax.CallOption) (*kmspb.CryptoKey, error) {
+	return call(ctx, c.kms.UpdateCryptoKeyPrimaryVersion, req)
+}
+
+// DestroyCryptoKeyVersion schedules a CryptoKeyVersion for destruction.
+func (c *Client) DestroyCryptoKeyVersion(ctx context.Context, req *kmspb.DestroyCryptoKeyVersionRequest, _ ...gax.CallOption) (*kmspb.CryptoKeyVersion, error) {
+	return call(ctx, c.kms.DestroyCryptoKeyVersion, req)
+}
+
+// RestoreCryptoKeyVersion restores a CryptoKeyVersion in the
+// DESTROY_SCHEDULED state.
+func (c *Client) RestoreCryptoKeyVersion(ctx context.Context, req *kmspb.RestoreCryptoKeyVersionRequest, _ ...gax.CallOption) (*kmspb.CryptoKeyVersion, error) {
+	return call(ctx, c.kms.RestoreCryptoKeyVersion, req)
+}
+
+// Encrypt encrypts data with the primary version of a symmetric CryptoKey.
+func (c *Client) Encrypt(ctx context.Context, req *kmspb.EncryptRequest, _ ...gax.CallOption) (*kmspb.EncryptResponse, error) {
+	return call(ctx, c.kms.Encrypt, req)
+}
+
+// Decrypt decrypts data that was protected by Encrypt.
+func (c *Client) Decrypt(ctx context.Context, req *kmspb.DecryptRequest, _ ...gax.CallOption) (*kmspb.DecryptResponse, error) {
+	return call(ctx, c.kms.Decrypt, req)
+}
+
+// RawEncrypt encrypts data with a raw symmetric CryptoKeyVersion.
+func (c *Client) RawEncrypt(ctx context.Context, req *kmspb.RawEncryptRequest, _ ...gax.CallOption) (*kmspb.RawEncryptResponse, error) {
+	return call(ctx, c.kms.RawEncrypt, req)
+}
+
+// RawDecrypt decrypts data that was encrypted by RawEncrypt.
+func (c *Client) RawDecrypt(ctx context.Context, req *kmspb.RawDecryptRequest, _ ...gax.CallOption) (*kmspb.RawDecryptResponse, error) {
+	return call(ctx, c.kms.RawDecrypt, req)
+}
+
+// AsymmetricSign signs data with an asymmetric signing CryptoKeyVersion.
+func (c *Client) AsymmetricSign(ctx context.Context, req *kmspb.AsymmetricSignRequest, _ ...gax.CallOption) (*kmspb.AsymmetricSignResponse, error) {
+	return call(ctx, c.kms.AsymmetricSign, req)
+}
+
+// AsymmetricDecrypt decrypts data encrypted with the public key of an
+// asymmetric decryption CryptoKeyVersion.
+func (c *Client) AsymmetricDecrypt(ctx context.Context, req *kmspb.AsymmetricDecryptRequest, _ ...gax.CallOption) (*kmspb.AsymmetricDecryptResponse, error) {
+	return call(ctx, c.kms.AsymmetricDecrypt, req)
+}
+
+// MacSign signs data with a MAC CryptoKeyVersion.
+func (c *Client) MacSign(ctx context.Context, req *kmspb.MacSignRequest, _ ...gax.CallOption) (*kmspb.MacSignResponse, error) {
+	return call(ctx, c.kms.MacSign, req)
+}
+
+// MacVerify verifies a MAC tag made by MacSign.
+func (c *Client) MacVerify(ctx context.Context, req *kmspb.MacVerifyRequest, _ ...gax.CallOption) (*kmspb.MacVerifyResponse, error) {
+	return call(ctx, c.kms.MacVerify, req)
+}
+
+// Decapsulate decapsulates data encapsulated with the public key of a key
+// encapsulation CryptoKeyVersion.
+func (c *Client) Decapsulate(ctx context.Context, req *kmspb.DecapsulateRequest, _ ...gax.CallOption) (*kmspb.DecapsulateResponse, error) {
+	return call(ctx, c.kms.Decapsulate, req)
+}
+
+// GenerateRandomBytes generates random bytes.
+func (c *Client) GenerateRandomBytes(ctx context.Context, req *kmspb.GenerateRandomBytesRequest, _ ...gax.CallOption) (*kmspb.GenerateRandomBytesResponse, error) {
+	return call(ctx, c.kms.GenerateRandomBytes, req)
+}
+
+// GetLocation gets information about a location.
+func (c *Client) GetLocation(ctx context.Context, req *locationpb.GetLocationRequest, _ ...gax.CallOption) (*locationpb.Location, error) {
+	return call(ctx, c.locations.GetLocation, req)
+}
+
+// Iterator iterates over the results of a list call, fetching pages as
+// needed, like the client library's iterators
+type Iterator[T any] struct {
+	fetch     func(pageToken string) ([]T, string, error)
+	buf       []T
+	pageToken string
+	started   bool
+	err       error
+}
+
+// Iterator types returned by the list methods
+type (
+	KeyRingIterator          = Iterator[*kmspb.KeyRing]
+	CryptoKeyIterator        = Iterator[*kmspb.CryptoKey]
+	CryptoKeyVersionIterator = Iterator[*kmspb.CryptoKeyVersion]
+	ImportJobIterator        = Iterator[*kmspb.ImportJob]
+	LocationIterator         = Iterator[*locationpb.Location]
+)
+
+// Next returns the next result. Its second return value is iterator.Done if
+// there are no more results. Once Next returns Done, all subsequent calls
+// will return Done.
+func (it *Iterator[T]) Next() (T, error) {
+	for len(it.buf) == 0 {
+		var zero T
+		if it.err != nil {
+			return zero, it.err
+		}
+		if it.started && it.pageToken == "" {
+			return zero, iterator.Done
+		}
+		it.started = true
+		it.buf, it.pageToken, it.err = it.fetch(it.pageToken)
+	}
+	item := it.buf[0]
+	it.buf = it.buf[1:]
+	return item, nil
+}
+
+// All returns an iterator. If an error is returned by the iterator, the
+// iterator will stop after that iteration.
+func (it *Iterator[T]) All() iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		for {
+			item, err := it.Next()
+			if err == iterator.Done {
+				return
+			}
+			if !yield(item, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// newIterator pages through a list handler from the page token of req,
+// setting later tokens on copies of it
+func newIterator[T any, Req interface {
+	proto.Message
+	GetPageToken() string
+}, Resp any](ctx context.Context, handler func(context.Context, Req) (Resp, error), req Req, results func(Resp) ([]T, string)) *Iterator[T] {
+	return &Iterator[T]{pageToken: req.GetPageToken(), fetch: func(pageToken string) ([]T, string, error) {
+		page := proto.Clone(req).(Req)
+		page.ProtoReflect().Set(page.ProtoReflect().Descriptor().Fields().ByName("page_token"), protoreflect.ValueOfString(pageToken))
+		resp, err := call(ctx, handler, page)
+		if err != nil {
+			return nil, "", err
+		}
+		items, next := results(resp)
+		return items, next, nil
+	}}
+}
+
+// ListKeyRings lists KeyRings.
+func (c *Client) ListKeyRings(ctx context.Context, req *kmspb.ListKeyRingsRequest, _ ...gax.CallOption) *KeyRingIterator {
+	return newIterator(ctx, c.kms.ListKeyRings, req, func(resp *kmspb.ListKeyRingsResponse) ([]*kmspb.KeyRing, string) {
+		return resp.KeyRings, resp.NextPageToken
+	})
+}
+
+// ListCryptoKeys lists CryptoKeys.
+func (c *Client) ListCryptoKeys(ctx context.Context, req *kmspb.ListCryptoKeysRequest, _ ...gax.CallOption) *CryptoKeyIterator {
+	return newIterator(ctx, c.kms.ListCryptoKeys, req, func(resp *kmspb.ListCryptoKeysResponse) ([]*kmspb.CryptoKey, string) {
+		return resp.CryptoKeys, resp.NextPageToken
+	})
+}
+
+// ListCryptoKeyVersions lists CryptoKeyVersions.
+func (c *Client) ListCryptoKeyVersions(ctx context.Context, req *kmspb.ListCryptoKeyVersionsRequest, _ ...gax.CallOption) *CryptoKeyVersionIterator {
+	return newIterator(ctx, c.kms.ListCryptoKeyVersions, req, func(resp *kmspb.ListCryptoKeyVersionsResponse) ([]*kmspb.CryptoKeyVersion, string) {
+		return resp.CryptoKeyVersions, resp.NextPageToken
+	})
+}
+
+// ListImportJobs lists ImportJobs.
+func (c *Client) ListImportJobs(ctx context.Context, req *kmspb.ListImportJobsRequest, _ ...gax.CallOption) *ImportJobIterator {
+	return newIterator(ctx, c.kms.ListImportJobs, req, func(resp *kmspb.ListImportJobsResponse) ([]*kmspb.ImportJob, string) {
+		return resp.ImportJobs, resp.NextPageToken
+	})
+}
+
+// ListLocations lists information about the supported locations for this
+// service.
+func (c *Client) ListLocations(ctx context.Context, req *locationpb.ListLocationsRequest, _ ...gax.CallOption) *LocationIterator {
+	return newIterator(ctx, c.locations.ListLocations, req, func(resp *locationpb.ListLocationsResponse) ([]*locationpb.Location, string) {
+		return resp.Locations, resp.NextPageToken
+	})
+}
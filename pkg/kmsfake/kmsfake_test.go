@@ -0,0 +1,146 @@
+package kmsfake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/googleapis/gax-go/v2"
+	"github.com/googleapis/gax-go/v2/apierror"
+	"google.golang.org/api/iterator"
+	locationpb "google.golang.org/genproto/googleapis/cloud/location"
+	"google.golang.org/grpc/codes"
+)
+
+// keyManager holds the methods code under test would use; both clients must
+// satisfy it
+type keyManager interface {
+	CreateKeyRing(context.Context, *kmspb.CreateKeyRingRequest, ...gax.CallOption) (*kmspb.KeyRing, error)
+	CreateCryptoKey(context.Context, *kmspb.CreateCryptoKeyRequest, ...gax.CallOption) (*kmspb.CryptoKey, error)
+	GetCryptoKey(context.Context, *kmspb.GetCryptoKeyRequest, ...gax.CallOption) (*kmspb.CryptoKey, error)
+	Encrypt(context.Context, *kmspb.EncryptRequest, ...gax.CallOption) (*kmspb.EncryptResponse, error)
+	Decrypt(context.Context, *kmspb.DecryptRequest, ...gax.CallOption) (*kmspb.DecryptResponse, error)
+	AsymmetricSign(context.Context, *kmspb.AsymmetricSignRequest, ...gax.CallOption) (*kmspb.AsymmetricSignResponse, error)
+	MacSign(context.Context, *kmspb.MacSignRequest, ...gax.CallOption) (*kmspb.MacSignResponse, error)
+	Decapsulate(context.Context, *kmspb.DecapsulateRequest, ...gax.CallOption) (*kmspb.DecapsulateResponse, error)
+	GetLocation(context.Context, *locationpb.GetLocationRequest, ...gax.CallOption) (*locationpb.Location, error)
+	Close() error
+}
+
+var (
+	_ keyManager = (*kms.KeyManagementClient)(nil)
+	_ keyManager = (*Client)(nil)
+)
+
+func newClient(t *testing.T) *Client {
+	t.Helper()
+	client, err := NewClient()
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	client := newClient(t)
+	ctx := t.Context()
+
+	if _, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{
+		Parent:    "projects/p/locations/global",
+		KeyRingId: "ring",
+	}); err != nil {
+		t.Fatalf("CreateKeyRing failed: %v", err)
+	}
+	key, err := client.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent:      "projects/p/locations/global/keyRings/ring",
+		CryptoKeyId: "key",
+		CryptoKey:   &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT},
+	})
+	if err != nil {
+		t.Fatalf("CreateCryptoKey failed: %v", err)
+	}
+
+	encrypted, err := client.Encrypt(ctx, &kmspb.EncryptRequest{Name: key.Name, Plaintext: []byte("secret")})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	decrypted, err := client.Decrypt(ctx, &kmspb.DecryptRequest{Name: key.Name, Ciphertext: encrypted.Ciphertext})
+	if err != nil || string(decrypted.Plaintext) != "secret" {
+		t.Errorf("Decrypt = %q, %v; want %q", decrypted.GetPlaintext(), err, "secret")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	client := newClient(t)
+
+	_, err := client.GetKeyRing(t.Context(), &kmspb.GetKeyRingRequest{Name: "projects/p/locations/global/keyRings/missing"})
+	var apiErr *apierror.APIError
+	if !errors.As(err, &apiErr) || apiErr.GRPCStatus().Code() != codes.NotFound {
+		t.Errorf("Expected NotFound APIError, got %T %v", err, err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	_, err = client.GenerateRandomBytes(ctx, &kmspb.GenerateRandomBytesRequest{
+		Location:        "projects/p/locations/global",
+		LengthBytes:     16,
+		ProtectionLevel: kmspb.ProtectionLevel_HSM,
+	})
+	if !errors.As(err, &apiErr) || apiErr.GRPCStatus().Code() != codes.Canceled {
+		t.Errorf("Expected Canceled APIError, got %T %v", err, err)
+	}
+}
+
+func TestListPages(t *testing.T) {
+	client := newClient(t)
+	ctx := t.Context()
+
+	for i := range 5 {
+		if _, err := client.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{
+			Parent:    "projects/p/locations/global",
+			KeyRingId: fmt.Sprintf("ring%d", i),
+		}); err != nil {
+			t.Fatalf("CreateKeyRing failed: %v", err)
+		}
+	}
+
+	it := client.ListKeyRings(ctx, &kmspb.ListKeyRingsRequest{Parent: "projects/p/locations/global", PageSize: 2})
+	var names []string
+	for {
+		ring, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		names = append(names, ring.Name)
+	}
+	if len(names) != 5 {
+		t.Errorf("Expected 5 key rings, got %v", names)
+	}
+	if _, err := it.Next(); err != iterator.Done {
+		t.Errorf("Expected Done after the last result, got %v", err)
+	}
+
+	count := 0
+	for _, err := range client.ListLocations(ctx, &locationpb.ListLocationsRequest{Name: "projects/p"}).All() {
+		if err != nil {
+			t.Fatalf("ListLocations failed: %v", err)
+		}
+		count++
+	}
+	if count == 0 {
+		t.Error("Expected locations")
+	}
+
+	it = client.ListKeyRings(ctx, &kmspb.ListKeyRingsRequest{Parent: "projects/p/locations/global", PageToken: "garbage"})
+	var apiErr *apierror.APIError
+	if _, err := it.Next(); !errors.As(err, &apiErr) || apiErr.GRPCStatus().Code() != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a malformed page token, got %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+package kmstest
+
+import (
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+func TestMustCreateKey(t *testing.T) {
+	srv := NewServer(t)
+
+	key := srv.MustCreateKey(t, "projects/p/locations/global/keyRings/r/cryptoKeys/k",
+		kmspb.CryptoKey_ENCRYPT_DECRYPT, kmspb.CryptoKeyVersion_GOOGLE_SYMMETRIC_ENCRYPTION)
+	encrypted, err := srv.Client.Encrypt(t.Context(), &kmspb.EncryptRequest{Name: key.Name, Plaintext: []byte("secret")})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	decrypted, err := srv.Client.Decrypt(t.Context(), &kmspb.DecryptRequest{Name: key.Name, Ciphertext: encrypted.Ciphertext})
+	if err != nil || string(decrypted.Plaintext) != "secret" {
+		t.Errorf("Decrypt = %q, %v; want %q", decrypted.GetPlaintext(), err, "secret")
+	}
+
+	// A second key in the same ring reuses it
+	signing := srv.MustCreateKey(t, "projects/p/locations/global/keyRings/r/cryptoKeys/signing",
+		kmspb.CryptoKey_ASYMMETRIC_SIGN, kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256)
+	if signing.VersionTemplate.GetAlgorithm() != kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256 {
+		t.Errorf("Expected EC_SIGN_P256_SHA256, got %v", signing.VersionTemplate.GetAlgorithm())
+	}
+}
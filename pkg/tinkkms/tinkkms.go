@@ -0,0 +1,125 @@
+// Package tinkkms is a Tink KMS client backed by the emulator, so code that
+// wraps data keys with Tink's KMS envelope encryption runs against it
+// unchanged:
+//
+//	conn, err := emu.Dial()
+//	client, err := tinkkms.New(conn, "")
+//	registry.RegisterKMSClient(client)
+//
+//	kek, err := client.GetAEAD("gcp-kms://projects/p/locations/global/keyRings/r/cryptoKeys/k")
+//	envelope := aead.NewKMSEnvelopeAEAD2(aead.AES256GCMKeyTemplate(), kek)
+//
+// Key URIs take the gcp-kms:// form of Tink's Cloud KMS client, so the same
+// URIs work against Cloud KMS in production. The client calls Encrypt and
+// Decrypt over gRPC and checks their CRC32C checksums, as Tink's client does.
+package tinkkms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/tink-crypto/tink-go/v2/core/registry"
+	"github.com/tink-crypto/tink-go/v2/tink"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// URIPrefix is the prefix of Cloud KMS key URIs in Tink
+const URIPrefix = "gcp-kms://"
+
+// Client is a Tink KMS client for the keys of an emulator
+type Client struct {
+	kms       kmspb.KeyManagementServiceClient
+	uriPrefix string
+}
+
+var (
+	_ registry.KMSClient   = (*Client)(nil)
+	_ tink.AEADWithContext = (*remoteAEAD)(nil)
+)
+
+// New returns a client for the emulator on conn that supports key URIs
+// starting with uriPrefix, or every gcp-kms:// URI if it is empty
+func New(conn grpc.ClientConnInterface, uriPrefix string) (*Client, error) {
+	if uriPrefix == "" {
+		uriPrefix = URIPrefix
+	}
+	if !strings.HasPrefix(strings.ToLower(uriPrefix), URIPrefix) {
+		return nil, fmt.Errorf("uriPrefix must start with %s, got %s", URIPrefix, uriPrefix)
+	}
+	return &Client{kms: kmspb.NewKeyManagementServiceClient(conn), uriPrefix: uriPrefix}, nil
+}
+
+// Supported reports whether the client handles keyURI
+func (c *Client) Supported(keyURI string) bool {
+	return strings.HasPrefix(keyURI, c.uriPrefix)
+}
+
+// GetAEAD returns an AEAD encrypting with the crypto key named by keyURI.
+// It also implements tink.AEADWithContext.
+func (c *Client) GetAEAD(keyURI string) (tink.AEAD, error) {
+	if !c.Supported(keyURI) {
+		return nil, fmt.Errorf("key URI must start with %s, got %s", c.uriPrefix, keyURI)
+	}
+	return &remoteAEAD{kms: c.kms, name: keyURI[len(URIPrefix):]}, nil
+}
+
+// remoteAEAD encrypts and decrypts with one crypto key
+type remoteAEAD struct {
+	kms  kmspb.KeyManagementServiceClient
+	name string
+}
+
+func (a *remoteAEAD) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	return a.EncryptWithContext(context.Background(), plaintext, associatedData)
+}
+
+func (a *remoteAEAD) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	return a.DecryptWithContext(context.Background(), ciphertext, associatedData)
+}
+
+func (a *remoteAEAD) EncryptWithContext(ctx context.Context, plaintext, associatedData []byte) ([]byte, error) {
+	resp, err := a.kms.Encrypt(ctx, &kmspb.EncryptRequest{
+		Name:                              a.name,
+		Plaintext:                         plaintext,
+		PlaintextCrc32C:                   checksum(plaintext),
+		AdditionalAuthenticatedData:       associatedData,
+		AdditionalAuthenticatedDataCrc32C: checksum(associatedData),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.VerifiedPlaintextCrc32C || !resp.VerifiedAdditionalAuthenticatedDataCrc32C {
+		return nil, errors.New("KMS did not verify the request checksums")
+	}
+	if resp.CiphertextCrc32C.GetValue() != checksum(resp.Ciphertext).Value {
+		return nil, errors.New("KMS returned a corrupted ciphertext")
+	}
+	return resp.Ciphertext, nil
+}
+
+func (a *remoteAEAD) DecryptWithContext(ctx context.Context, ciphertext, associatedData []byte) ([]byte, error) {
+	resp, err := a.kms.Decrypt(ctx, &kmspb.DecryptRequest{
+		Name:                              a.name,
+		Ciphertext:                        ciphertext,
+		CiphertextCrc32C:                  checksum(ciphertext),
+		AdditionalAuthenticatedData:       associatedData,
+		AdditionalAuthenticatedDataCrc32C: checksum(associatedData),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.PlaintextCrc32C.GetValue() != checksum(resp.Plaintext).Value {
+		return nil, errors.New("KMS returned a corrupted plaintext")
+	}
+	return resp.Plaintext, nil
+}
+
+// checksum returns the CRC32C of data in the form KMS requests carry
+func checksum(data []byte) *wrapperspb.Int64Value {
+	return wrapperspb.Int64(int64(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))))
+}
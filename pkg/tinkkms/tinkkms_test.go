@@ -0,0 +1,125 @@
+package tinkkms
+
+import (
+	"context"
+	"testing"
+
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/tink-crypto/tink-go/v2/aead"
+	"github.com/tink-crypto/tink-go/v2/tink"
+
+	"github.com/blackwell-systems/gcp-kms-emulator/pkg/emulator"
+)
+
+const testRing = "projects/p/locations/global/keyRings/ring"
+
+// newTestClient starts an emulator with the encryption keys kek and other
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+	ctx := context.Background()
+	emu, err := emulator.Start(ctx, emulator.WithBufconn(), emulator.WithIAMMode("off"))
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(func() { emu.Close() })
+	conn, err := emu.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	kms := kmspb.NewKeyManagementServiceClient(conn)
+	if _, err := kms.CreateKeyRing(ctx, &kmspb.CreateKeyRingRequest{Parent: "projects/p/locations/global", KeyRingId: "ring"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"kek", "other"} {
+		if _, err := kms.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{Parent: testRing, CryptoKeyId: id, CryptoKey: &kmspb.CryptoKey{Purpose: kmspb.CryptoKey_ENCRYPT_DECRYPT}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, err := New(conn, "")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	return client
+}
+
+func getAEAD(t *testing.T, client *Client, id string) tink.AEAD {
+	t.Helper()
+	a, err := client.GetAEAD(URIPrefix + testRing + "/cryptoKeys/" + id)
+	if err != nil {
+		t.Fatalf("GetAEAD failed: %v", err)
+	}
+	return a
+}
+
+func TestKMSEnvelopeAEAD(t *testing.T) {
+	client := newTestClient(t)
+	envelope := aead.NewKMSEnvelopeAEAD2(aead.AES256GCMKeyTemplate(), getAEAD(t, client, "kek"))
+
+	ciphertext, err := envelope.Encrypt([]byte("payload"), []byte("context"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	plaintext, err := envelope.Decrypt(ciphertext, []byte("context"))
+	if err != nil || string(plaintext) != "payload" {
+		t.Fatalf("Expected the payload back, got %q: %v", plaintext, err)
+	}
+
+	if _, err := envelope.Decrypt(ciphertext, []byte("other context")); err == nil {
+		t.Error("Expected other associated data to fail")
+	}
+	other := aead.NewKMSEnvelopeAEAD2(aead.AES256GCMKeyTemplate(), getAEAD(t, client, "other"))
+	if _, err := other.Decrypt(ciphertext, []byte("context")); err == nil {
+		t.Error("Expected another key encryption key to fail")
+	}
+}
+
+func TestRemoteAEAD(t *testing.T) {
+	client := newTestClient(t)
+	kek := getAEAD(t, client, "kek")
+
+	ciphertext, err := kek.Encrypt([]byte("data key"), []byte("aad"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if plaintext, err := kek.Decrypt(ciphertext, []byte("aad")); err != nil || string(plaintext) != "data key" {
+		t.Errorf("Expected the data key back, got %q: %v", plaintext, err)
+	}
+	if _, err := kek.Decrypt(ciphertext, nil); err == nil {
+		t.Error("Expected Decrypt without the associated data to fail")
+	}
+
+	withContext, ok := kek.(tink.AEADWithContext)
+	if !ok {
+		t.Fatal("Expected the AEAD to implement tink.AEADWithContext")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := withContext.EncryptWithContext(ctx, []byte("data key"), nil); err == nil {
+		t.Error("Expected a cancelled context to fail")
+	}
+	if _, err := getAEAD(t, client, "missing").Encrypt([]byte("data key"), nil); err == nil {
+		t.Error("Expected an unknown key to fail")
+	}
+}
+
+func TestSupported(t *testing.T) {
+	client, err := New(nil, URIPrefix+testRing+"/")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if !client.Supported(URIPrefix + testRing + "/cryptoKeys/kek") {
+		t.Error("Expected keys in the ring to be supported")
+	}
+	if client.Supported(URIPrefix + "projects/p/locations/global/keyRings/other/cryptoKeys/kek") {
+		t.Error("Expected keys in other rings to be unsupported")
+	}
+	if _, err := client.GetAEAD("aws-kms://arn:aws:kms:us-east-1:1:key/k"); err == nil {
+		t.Error("Expected GetAEAD to reject unsupported URIs")
+	}
+	if _, err := New(nil, "aws-kms://"); err == nil {
+		t.Error("Expected New to reject prefixes of other KMSs")
+	}
+}